@@ -3,10 +3,14 @@ package agent
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -18,70 +22,253 @@ import (
 
 	"github.com/rupor-github/win-gpg-agent/assuan/client"
 	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/noise"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/testagent"
 	"github.com/rupor-github/win-gpg-agent/util"
 )
 
+// ErrGPGNotFound is returned when gpg-agent executable is not where configuration says it is.
+var ErrGPGNotFound = errors.New("gpg-agent is not found")
+
+// ErrBind matches (with errors.Is) any error returned when connector could not start serving.
+var ErrBind = errors.New("unable to serve connector")
+
+// BindError reports connector which failed to start serving, usually because its address is unavailable.
+type BindError struct {
+	Connector ConnectorType
+	Err       error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("unable to serve %s: %s", e.Connector, e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrBind) true for all connector failures.
+func (e *BindError) Is(target error) bool {
+	return target == ErrBind
+}
+
 // Agent structure wraps running gpg-agent process.
 type Agent struct {
-	Cfg       *config.Config
-	Ver, Exe  string
-	locked    int32
+	Cfg      *config.Config
+	Ver, Exe string
+	Dialect  util.CygwinDialect
+	locked   int32
+	// disconnected is set while user session is not attached to console or RDP
+	disconnected int32
+	// blocked is what connectors check: session is locked (unless it is ignored) or disconnected
+	blocked   int32
 	cmd       *exec.Cmd
 	cmdOutput bytes.Buffer
-	cancel    context.CancelFunc
-	ctx       context.Context
-	wg        sync.WaitGroup
-	conns     []*Connector
+	// socket of gpg-agent we talk to, pid of the one another tool started instead of ours and wake up for upstream watch
+	// when connector could not dial gpg-agent
+	stamp     socketStamp
+	adopted   int32
+	recheck   chan struct{}
+	watchOnce sync.Once
+	// GnuPG home is on network share and if it did not answer last reachability check
+	netHome  bool
+	offline  int32
+	cancel   context.CancelFunc
+	ctx      context.Context
+	wg       sync.WaitGroup
+	restart  sync.Mutex
+	backupMu sync.Mutex
+	conns    []*Connector
+	fake     *testagent.Agent
+	alog     agentLog
+	policy   policyRef
+	loopback *loopbackStore
+	batch    *batchMode
+	unlock   *unlockWindow
 }
 
-// NewAgent initializes Agent structure.
-func NewAgent(cfg *config.Config) (*Agent, error) {
+// Prepare discovers gpg-agent and prepares connectors without touching file system or network. Resulting Agent is only
+// good for inspection (GetConnector, DryRun), use NewAgent to get one which could be started.
+func Prepare(cfg *config.Config) (*Agent, error) {
 
-	a := &Agent{Cfg: cfg}
+	a := &Agent{Cfg: cfg, recheck: make(chan struct{}, 1)}
 
-	fname := filepath.Join(a.Cfg.GPG.Path, "bin", util.GPGAgentName+".exe")
-	cmd := exec.Command(fname, "--version")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("unable to run \"%s\": %w", fname, err)
-	}
-	lines := strings.Split(string(out), "\n")
-	if len(lines) > 0 {
-		words := strings.Split(lines[0], " ")
-		if len(words) >= 3 {
-			a.Ver = words[2]
-		} else {
-			a.Ver = lines[0]
+	if a.Cfg.GUI.FakeAgent {
+		// no GnuPG is necessary, keep fake sockets away from real gpg-agent home
+		a.Ver = testagent.Version
+		a.Cfg.GPG.Sockets = filepath.Join(a.Cfg.GUI.Home, "fake-gnupg")
+	} else {
+		fname := filepath.Join(a.Cfg.GPG.Path, "bin", util.GPGAgentName+".exe")
+		if !util.FileExists(fname) {
+			return nil, fmt.Errorf("%w: %s", ErrGPGNotFound, fname)
+		}
+		if err := a.verifyBinaries(fname); err != nil {
+			return nil, err
 		}
+		cmd := exec.Command(fname, "--version")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("unable to run \"%s\": %w", fname, err)
+		}
+		lines := strings.Split(string(out), "\n")
+		if len(lines) > 0 {
+			words := strings.Split(lines[0], " ")
+			if len(words) >= 3 {
+				a.Ver = words[2]
+			} else {
+				a.Ver = lines[0]
+			}
+		}
+		a.Exe = fname
+		a.prepareNetworkHome()
 	}
-	a.Exe = fname
 
 	a.conns = make([]*Connector, maxConnector)
 
-	var locked *int32
-	if !a.Cfg.GUI.IgnoreSessionLock {
-		locked = &a.locked
-	}
+	locked := &a.blocked
 
 	sdir := a.Cfg.GPG.Home
 	if len(a.Cfg.GPG.Sockets) != 0 {
 		sdir = a.Cfg.GPG.Sockets
 	}
 
-	a.conns[ConnectorSockAgent] = NewConnector(ConnectorSockAgent, sdir, a.Cfg.GUI.Home, util.SocketAgentName, locked, &a.wg)
-	a.conns[ConnectorSockAgentExtra] = NewConnector(ConnectorSockAgentExtra, sdir, a.Cfg.GUI.Home, util.SocketAgentExtraName, locked, &a.wg)
-	a.conns[ConnectorSockAgentBrowser] = NewConnector(ConnectorSockAgentBrowser, sdir, a.Cfg.GUI.Home, util.SocketAgentBrowserName, locked, &a.wg)
-	a.conns[ConnectorSockAgentSSH] = NewConnector(ConnectorSockAgentSSH, sdir, a.Cfg.GUI.Home, util.SocketAgentSSHName, locked, &a.wg)
+	a.conns[ConnectorSockAgent] = NewConnector(ConnectorSockAgent, sdir, a.Cfg.GUI.Sockets, util.SocketAgentName, locked, &a.wg)
+	a.conns[ConnectorSockAgentExtra] = NewConnector(ConnectorSockAgentExtra, sdir, a.Cfg.GUI.Sockets, util.SocketAgentExtraName, locked, &a.wg)
+	a.conns[ConnectorSockAgentBrowser] = NewConnector(ConnectorSockAgentBrowser, sdir, a.Cfg.GUI.Sockets, util.SocketAgentBrowserName, locked, &a.wg)
+	a.conns[ConnectorSockAgentSSH] = NewConnector(ConnectorSockAgentSSH, sdir, a.Cfg.GUI.Sockets, util.SocketAgentSSHName, locked, &a.wg)
 	a.conns[ConnectorPipeSSH] = NewConnector(ConnectorPipeSSH, "", "", a.Cfg.GUI.PipeName, locked, &a.wg)
-	a.conns[ConnectorSockAgentCygwinSSH] = NewConnector(ConnectorSockAgentCygwinSSH, "", a.Cfg.GUI.Home, util.SocketAgentSSHCygwinName, locked, &a.wg)
+	a.conns[ConnectorPipeSSH].pipe = newPipeOptions(&a.Cfg.GUI.Pipe)
+	a.Dialect = util.DetectCygwinDialect(a.Cfg.GUI.CygwinDialect)
+	a.conns[ConnectorSockAgentCygwinSSH] = NewConnector(ConnectorSockAgentCygwinSSH, "", a.Cfg.GUI.Sockets, util.SocketAgentSSHCygwinName, locked, &a.wg)
+	a.conns[ConnectorSockAgentCygwinSSH].nonceTTL = a.Cfg.GUI.CygwinNonceTTL
 	if a.Cfg.GUI.ExtraPort != 0 {
-		// Since OpenSSH-Win32 does not yet know how to redirect unix sockets we have no choice but to make available this additional port on local host only
+		// Since OpenSSH-Win32 does not yet know how to redirect unix sockets we have no choice but to make available this additional port,
+		// by default on local host only
 		a.conns[ConnectorExtraPort] = NewConnector(ConnectorExtraPort, sdir, fmt.Sprintf("localhost:%d", a.Cfg.GUI.ExtraPort), util.SocketAgentExtraName, locked, &a.wg)
+		a.conns[ConnectorExtraPort].bind = a.Cfg.GUI.ExtraBind
+		a.conns[ConnectorExtraPort].port = a.Cfg.GUI.ExtraPort
+		if a.Cfg.GUI.ExtraSSPI.Enabled {
+			a.conns[ConnectorExtraPort].principals = a.Cfg.GUI.ExtraSSPI.Principals
+			if len(a.conns[ConnectorExtraPort].principals) == 0 {
+				u, err := user.Current()
+				if err != nil {
+					return nil, fmt.Errorf("unable to get current user: %w", err)
+				}
+				a.conns[ConnectorExtraPort].principals = []string{u.Username}
+			}
+		}
+	}
+	if a.Cfg.GUI.HyperV.SSHPort > 0 {
+		a.conns[ConnectorHvsockSSH] = NewConnector(ConnectorHvsockSSH, "", a.Cfg.GUI.HyperV.VMID, "", locked, &a.wg)
+		a.conns[ConnectorHvsockSSH].port = a.Cfg.GUI.HyperV.SSHPort
+	}
+	if a.Cfg.GUI.HyperV.ExtraPort > 0 {
+		a.conns[ConnectorHvsockExtra] = NewConnector(ConnectorHvsockExtra, sdir, a.Cfg.GUI.HyperV.VMID, util.SocketAgentExtraName, locked, &a.wg)
+		a.conns[ConnectorHvsockExtra].port = a.Cfg.GUI.HyperV.ExtraPort
+	}
+	if a.Cfg.GUI.Noise.Port > 0 {
+		kp, peers, err := noiseKeys(&a.Cfg.GUI.Noise)
+		if err != nil {
+			return nil, err
+		}
+		name := util.SocketAgentExtraName
+		if a.Cfg.GUI.Noise.Agent == "ssh" {
+			name = ""
+		}
+		a.conns[ConnectorNoise] = NewConnector(ConnectorNoise, sdir, "", name, locked, &a.wg)
+		a.conns[ConnectorNoise].bind = a.Cfg.GUI.Noise.Bind
+		a.conns[ConnectorNoise].port = a.Cfg.GUI.Noise.Port
+		a.conns[ConnectorNoise].kp = kp
+		a.conns[ConnectorNoise].peers = peers
+	}
+	if a.Cfg.GUI.WebSocket.Port > 0 {
+		if len(a.Cfg.GUI.WebSocket.Token) == 0 {
+			token := make([]byte, 16)
+			if _, err := rand.Read(token); err != nil {
+				return nil, fmt.Errorf("unable to generate WebSocket token: %w", err)
+			}
+			a.Cfg.GUI.WebSocket.Token = hex.EncodeToString(token)
+		}
+		a.conns[ConnectorWebSocket] = NewConnector(ConnectorWebSocket, "", "", "", locked, &a.wg)
+		a.conns[ConnectorWebSocket].port = a.Cfg.GUI.WebSocket.Port
+		a.conns[ConnectorWebSocket].origins = a.Cfg.GUI.WebSocket.Origins
+		a.conns[ConnectorWebSocket].token = a.Cfg.GUI.WebSocket.Token
+	}
+	if a.Cfg.GUI.Dirmngr.Enabled {
+		a.conns[ConnectorSockDirmngr] = NewConnector(ConnectorSockDirmngr, sdir, a.Cfg.GUI.Sockets, util.SocketDirmngrName, locked, &a.wg)
+		if !a.Cfg.GUI.FakeAgent {
+			a.conns[ConnectorSockDirmngr].launch = a.launchDirmngr
+		}
 	}
 	if a.Cfg.GUI.XAgentCookieSize > 0 {
 		a.conns[ConnectorXShell] = NewConnector(ConnectorXShell, "", "", util.XAgentCookieString(a.Cfg.GUI.XAgentCookieSize), locked, &a.wg)
 	}
 
+	p, err := NewPolicy(&a.Cfg.GUI)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		p.status = a.Status
+	}
+	a.policy.set(p)
+	if a.loopback, err = newLoopbackStore(&a.Cfg.GUI.Loopback); err != nil {
+		return nil, err
+	}
+	if err := checkLimits(a.Cfg.GUI.Limits); err != nil {
+		return nil, err
+	}
+	a.batch = newBatchMode(&a.Cfg.GUI.Batch)
+	a.unlock = newUnlockWindow(&a.Cfg.GUI.Unlock)
+	if a.Cfg.GUI.Batch.Enabled {
+		// gpg-agent is not running yet, it picks up cache TTL on start
+		if err := a.SetBatch(true); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range a.conns {
+		if c != nil {
+			c.policy = &a.policy
+			c.tty = a.Cfg.GUI.Pinentry.TTY
+			c.loopback = a.loopback
+			c.batch = a.batch
+			c.unlock = a.unlock
+			c.limit = newLimit(c.index, a.Cfg.GUI.Limits)
+			// dirmngr is started on demand, pool would keep it running
+			if len(c.pathGPG) > 0 && c.launch == nil {
+				c.pool = newUpstreamPool(&a.Cfg.GUI.Pool, a.batch, c.dialAssuan)
+				c.lost = a.upstreamLost
+			}
+			if a.netHome {
+				c.retries, c.retryDelay = a.Cfg.GPG.Network.Retries, a.Cfg.GPG.Network.RetryDelay
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// NewAgent initializes Agent structure.
+func NewAgent(cfg *config.Config) (*Agent, error) {
+
+	a, err := Prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if a.Cfg.GUI.FakeAgent {
+		if err := os.MkdirAll(a.Cfg.GPG.Sockets, 0700); err != nil {
+			return nil, fmt.Errorf("unable to create fake agent directory: %w", err)
+		}
+	}
+
+	if a.policy.approvals, err = loadApprovals(a.Cfg.GUI.Home); err != nil {
+		return nil, err
+	}
+	if p := a.policy.get(); p != nil {
+		p.approvals = a.policy.approvals
+	}
+
 	util.WaitForFileDeparture(time.Second*5,
 		a.conns[ConnectorSockAgent].PathGPG(),
 		a.conns[ConnectorSockAgentExtra].PathGPG(),
@@ -93,25 +280,142 @@ func NewAgent(cfg *config.Config) (*Agent, error) {
 	return a, nil
 }
 
+// noiseKeys prepares static key pair and list of allowed remote peers for Noise transport.
+func noiseKeys(cfg *config.NoiseConfig) (*noise.KeyPair, map[[32]byte]bool, error) {
+	if len(cfg.Key) == 0 {
+		return nil, nil, fmt.Errorf("gui.noise.private_key is required for noise transport")
+	}
+	kp, err := noise.NewKeyPair(cfg.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad gui.noise.private_key: %w", err)
+	}
+	peers := make(map[[32]byte]bool, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		pk, err := noise.ParseKey(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad gui.noise.public_keys[%d]: %w", i, err)
+		}
+		peers[pk] = true
+	}
+	if len(peers) == 0 {
+		log.Print("Noise transport has no allowed public keys, all connections will be rejected")
+	}
+	return kp, peers, nil
+}
+
 // Status returns string with currently running agent configuration.
 func (a *Agent) Status() string {
 	var buf strings.Builder
 
 	fmt.Fprintf(&buf, "\n\n---------------------------\nGnuPG version:\n---------------------------\n%s", a.Ver)
-	fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent command line:\n---------------------------\n%s", a.cmd.String())
+	if a.fake != nil {
+		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent command line:\n---------------------------\n%s", "in-process fake agent")
+	} else {
+		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent command line:\n---------------------------\n%s", a.cmd.String())
+		if pid := a.Adopted(); pid != 0 {
+			fmt.Fprintf(&buf, "\nreplaced by gpg-agent (pid %d) another tool started, restart agent to use options above", pid)
+		}
+	}
 	fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent home directory:\n---------------------------\n%s", a.Cfg.GPG.Home)
+	if a.netHome {
+		if a.HomeOffline() {
+			fmt.Fprint(&buf, "\non network share, presently not reachable")
+		} else {
+			fmt.Fprint(&buf, "\non network share")
+		}
+	}
 	if len(a.Cfg.GPG.Sockets) != 0 {
 		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent sockets directory:\n---------------------------\n%s", a.Cfg.GPG.Sockets)
 	}
 	if a.Cfg.GUI.ExtraPort != 0 {
-		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent Assuan extra socket on TCP:\n---------------------------\nlocalhost:%d", a.Cfg.GUI.ExtraPort)
+		addrs := fmt.Sprintf("localhost:%d", a.Cfg.GUI.ExtraPort)
+		if l := a.conns[ConnectorExtraPort].listener; l != nil {
+			addrs = util.ListenerAddrs(l)
+		}
+		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent Assuan extra socket on TCP:\n---------------------------\n%s", addrs)
+	}
+	fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui AF_UNIX and Cygwin sockets directory:\n---------------------------\n%s", a.Cfg.GUI.Sockets)
+	if a.Cfg.GUI.Sockets != a.Cfg.GUI.Home {
+		fmt.Fprintf(&buf, "\nrelocated from %s (path is too long for AF_UNIX sockets)", a.Cfg.GUI.Home)
 	}
-	fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui AF_UNIX and Cygwin sockets directory:\n---------------------------\n%s", a.Cfg.GUI.Home)
+	fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui Cygwin socket dialect:\n---------------------------\n%s\n%s",
+		a.Dialect, a.Dialect.Path(a.conns[ConnectorSockAgentCygwinSSH].PathGUI()))
 	fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui SSH named pipe:\n---------------------------\n%s", a.Cfg.GUI.PipeName)
+	if a.DelegatesPipe() {
+		fmt.Fprint(&buf, "\nserved by Windows OpenSSH ssh-agent service")
+	}
+	fmt.Fprintf(&buf, "\n\n---------------------------\nWindows OpenSSH ssh-agent service:\n---------------------------\n%s", a.openSSHServiceStatus())
+	if a.Cfg.GUI.HyperV.SSHPort > 0 {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui SSH Hyper-V socket (vsock port):\n---------------------------\n%d", a.Cfg.GUI.HyperV.SSHPort)
+	}
+	if a.Cfg.GUI.HyperV.ExtraPort > 0 {
+		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent Assuan extra Hyper-V socket (vsock port):\n---------------------------\n%d", a.Cfg.GUI.HyperV.ExtraPort)
+	}
+	if a.Cfg.GUI.Noise.Port > 0 {
+		addrs := fmt.Sprintf("localhost:%d", a.Cfg.GUI.Noise.Port)
+		if l := a.conns[ConnectorNoise].listener; l != nil {
+			addrs = util.ListenerAddrs(l)
+		}
+		fmt.Fprintf(&buf, "\n\n---------------------------\n%s agent on Noise encrypted TCP:\n---------------------------\n%s\npublic key: %s",
+			a.Cfg.GUI.Noise.Agent, addrs, hex.EncodeToString(a.conns[ConnectorNoise].kp.Public[:]))
+	}
+	if a.Cfg.GUI.WebSocket.Port > 0 {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nagent-gui SSH WebSocket bridge:\n---------------------------\nws://localhost:%d/ssh-agent?token=%s",
+			a.Cfg.GUI.WebSocket.Port, a.Cfg.GUI.WebSocket.Token)
+	}
 	if a.Cfg.GUI.XAgentCookieSize > 0 {
 		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent XAgent protocol socket on TCP:\n---------------------------\nlocalhost:%d", a.conns[ConnectorXShell].Port())
 	}
 
+	if fname := a.LogFile(); len(fname) > 0 {
+		fmt.Fprintf(&buf, "\n\n---------------------------\ngpg-agent log file:\n---------------------------\n%s", fname)
+		if problems := a.LogProblems(); len(problems) > 0 {
+			fmt.Fprintf(&buf, "\nrecent problems:\n%s", strings.Join(problems, "\n"))
+		}
+	}
+	if a.fake == nil && (a.Cfg.GUI.Backup.Interval > 0 || !a.LastBackup().IsZero()) {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nLast keyring backup:\n---------------------------\n%s", a.backupStatus())
+	}
+	if us := a.unlock.state(); us.Enabled {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nUnlock window:\n---------------------------\n%s", us.String())
+	}
+	if qs := a.QuietHours(); qs.Configured {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nQuiet hours:\n---------------------------\n%s", qs.String())
+	}
+	if usage := a.QuotaUsage(); len(usage) > 0 {
+		fmt.Fprint(&buf, "\n\n---------------------------\nKey quotas:\n---------------------------")
+		for _, ku := range usage {
+			fmt.Fprintf(&buf, "\n%s", ku.String())
+		}
+	}
+	if bs := a.batch.snapshot(); bs.Active || bs.Signs > 0 {
+		fmt.Fprintf(&buf, "\n\n---------------------------\nBatch signing mode:\n---------------------------\n%s", bs.String())
+	}
+	fmt.Fprint(&buf, "\n\n---------------------------\nConnector statistics:\n---------------------------")
+	for _, c := range a.conns {
+		if c == nil || c.listener == nil {
+			continue
+		}
+		st := c.Stats()
+		fmt.Fprintf(&buf, "\n%s: accepted %d, active %d, failed %d, in %d bytes, out %d bytes",
+			c.index, st.Accepted, st.Active, st.Failed, st.BytesIn, st.BytesOut)
+		if st.AssuanErrors > 0 {
+			fmt.Fprintf(&buf, ", gpg-agent errors %d", st.AssuanErrors)
+		}
+		if len(st.Commands) > 0 {
+			fmt.Fprintf(&buf, "\n    commands: %s", st.CommandsString())
+		}
+		if st.Limit != nil {
+			fmt.Fprintf(&buf, "\n    concurrency: %s", st.Limit)
+		}
+		if st.Pool != nil && st.Pool.Dialed > 0 {
+			fmt.Fprintf(&buf, "\n    gpg-agent connections: %s", st.Pool)
+		}
+		if len(st.LastError) > 0 {
+			fmt.Fprintf(&buf, "\n    last error at %s: %s", st.LastErrorTime.Format("15:04:05"), st.LastError)
+		}
+	}
+
 	return buf.String()
 }
 
@@ -119,7 +423,12 @@ func (a *Agent) Status() string {
 func (a *Agent) SessionLock() {
 	if a != nil {
 		atomic.StoreInt32(&a.locked, 1)
+		a.updateBlocked()
 		log.Print("Session locked")
+		notify.Notify(notify.SessionLocked, "Session", "Session locked")
+		a.policy.get().forget()
+		a.loopback.forget("")
+		a.CloseUnlockWindow()
 	}
 }
 
@@ -127,8 +436,47 @@ func (a *Agent) SessionLock() {
 func (a *Agent) SessionUnlock() {
 	if a != nil {
 		atomic.StoreInt32(&a.locked, 0)
+		a.updateBlocked()
 		log.Print("Session unlocked")
+		notify.Notify(notify.SessionUnlocked, "Session", "Session unlocked")
+	}
+}
+
+// SessionDisconnect suspends serving while user session is disconnected (Fast User Switching, RDP), regardless of
+// gui.ignore_session_lock - somebody else is using the console.
+func (a *Agent) SessionDisconnect() {
+	if a != nil {
+		atomic.StoreInt32(&a.disconnected, 1)
+		a.updateBlocked()
+		log.Print("Session disconnected, serving is suspended")
+		notify.Notify(notify.SessionDisconnected, "Session", "Session disconnected")
+		a.policy.get().forget()
+		a.loopback.forget("")
+		a.CloseUnlockWindow()
+	}
+}
+
+// SessionReconnect resumes serving when user session is connected again (unless it is still locked).
+func (a *Agent) SessionReconnect() {
+	if a != nil {
+		atomic.StoreInt32(&a.disconnected, 0)
+		a.updateBlocked()
+		log.Print("Session connected, serving is resumed")
+	}
+}
+
+// Disconnected reports if user session is presently disconnected.
+func (a *Agent) Disconnected() bool {
+	return a != nil && atomic.LoadInt32(&a.disconnected) != 0
+}
+
+// updateBlocked recalculates flag connectors check before serving requests.
+func (a *Agent) updateBlocked() {
+	var v int32
+	if atomic.LoadInt32(&a.disconnected) != 0 || (atomic.LoadInt32(&a.locked) != 0 && !a.Cfg.GUI.IgnoreSessionLock) {
+		v = 1
 	}
+	atomic.StoreInt32(&a.blocked, v)
 }
 
 func (a *Agent) forceCleanup() error {
@@ -163,6 +511,18 @@ func (a *Agent) Start() error {
 
 	const DETACHED_PROCESS = 0x00000008
 
+	if a.Cfg.GUI.FakeAgent {
+		return a.startFake()
+	}
+	sshBackend = queryPageant
+	if a.Delegates() {
+		sshBackend = queryOpenSSHService
+	}
+
+	if err := a.verifyBinaries(a.Exe, a.pinentryPath()); err != nil {
+		return err
+	}
+
 	expath, err := os.Executable()
 	if err != nil {
 		return err
@@ -182,9 +542,14 @@ func (a *Agent) Start() error {
 	if len(a.Cfg.GPG.Config) > 0 && util.FileExists(a.Cfg.GPG.Config) {
 		args = append(args, "--options", a.Cfg.GPG.Config)
 	}
+	if fname := a.LogFile(); len(fname) > 0 {
+		args = append(args, "--log-file", fname)
+		a.followLog()
+	}
 	if len(a.Cfg.GPG.Args) > 0 {
 		args = append(args, a.Cfg.GPG.Args...)
 	}
+	args = append(args, a.batch.args()...)
 	a.cmd = exec.Command(a.Exe, args...)
 	a.cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: DETACHED_PROCESS}
 	a.cmd.Stdout = &a.cmdOutput
@@ -213,6 +578,17 @@ func (a *Agent) Start() error {
 	); err != nil {
 		return multierr.Combine(err, a.forceCleanup())
 	}
+	a.stamp, _ = readSocketStamp(sockPath)
+	atomic.StoreInt32(&a.adopted, 0)
+	a.watchOnce.Do(func() {
+		go a.watchUpstream()
+		if a.netHome && a.Cfg.GPG.Network.CheckInterval > 0 {
+			go a.watchHome()
+		}
+		if a.Cfg.GUI.Backup.Interval > 0 {
+			go a.watchBackup()
+		}
+	})
 
 	// Always terminate gracefully - see all in flight conversations to completion.
 	go func() {
@@ -236,7 +612,10 @@ func (a *Agent) Serve(ct ConnectorType) error {
 	if a == nil || ct > maxConnector {
 		return fmt.Errorf("gui agent has not been initialized properly")
 	}
-	return a.conns[ct].Serve(a.Cfg.GUI.Deadline)
+	if err := a.conns[ct].Serve(a.Cfg.GUI.Deadline); err != nil {
+		return &BindError{Connector: ct, Err: err}
+	}
+	return nil
 }
 
 // Close stops serving requests for a particular ConnectorType.
@@ -250,10 +629,17 @@ func (a *Agent) Close(ct ConnectorType) {
 // Stop stops all connectors and gpg-agent cleanly.
 func (a *Agent) Stop() error {
 
+	if a != nil && a.fake != nil {
+		return a.stopFake()
+	}
 	if a == nil || a.cmd == nil {
 		return nil
 	}
 
+	// upstream watch must not start gpg-agent again while it is being stopped
+	a.restart.Lock()
+	defer a.restart.Unlock()
+
 	defer func() {
 		// FIXME: what if gpg-agent is chatty? Do we want to buffer it forever?
 		output := a.cmdOutput.String()
@@ -282,7 +668,8 @@ func (a *Agent) Stop() error {
 		return multierr.Combine(err, a.forceCleanup())
 	}
 
-	if err := a.cmd.Wait(); err != nil {
+	// process we started could have been replaced by another tool long ago
+	if err := a.cmd.Wait(); err != nil && a.Adopted() == 0 {
 		return err
 	}
 	return nil
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const (
+	agentLogName    = "gpg-agent.log"
+	agentLogMaxSize = 1 << 20
+	maxLogProblems  = 10
+	// directory entry of file kept open by gpg-agent may be updated lazily, so log is read now and then even without
+	// change notifications
+	agentLogRecheck = 10 * time.Second
+)
+
+// agentLog follows gpg-agent log file picking up problems reported there.
+type agentLog struct {
+	fname  string
+	once   sync.Once
+	mu     sync.Mutex
+	recent []string
+	report func(line string)
+}
+
+// LogFile returns name of gpg-agent log file or empty string if logging is disabled.
+func (a *Agent) LogFile() string {
+	if a == nil || !a.Cfg.GPG.Log || a.Cfg.GUI.FakeAgent {
+		return ""
+	}
+	return filepath.Join(a.Cfg.GUI.Home, agentLogName)
+}
+
+// OnLogProblem sets function called for every warning or error gpg-agent (and its helpers) writes to log.
+func (a *Agent) OnLogProblem(f func(line string)) {
+	a.alog.mu.Lock()
+	defer a.alog.mu.Unlock()
+	a.alog.report = f
+}
+
+// LogProblems returns last warnings and errors found in gpg-agent log.
+func (a *Agent) LogProblems() []string {
+	a.alog.mu.Lock()
+	defer a.alog.mu.Unlock()
+	return append([]string(nil), a.alog.recent...)
+}
+
+// followLog starts following gpg-agent log once, should be called before gpg-agent is started.
+func (a *Agent) followLog() {
+	fname := a.LogFile()
+	if len(fname) == 0 {
+		return
+	}
+	a.alog.once.Do(func() {
+		a.alog.fname = fname
+		// keep single previous log around
+		if fi, err := os.Stat(fname); err == nil && fi.Size() > agentLogMaxSize {
+			if err := os.Rename(fname, fname+".old"); err != nil {
+				log.Printf("Unable to rotate gpg-agent log: %s", err)
+			}
+		}
+		var offset int64
+		if fi, err := os.Stat(fname); err == nil {
+			offset = fi.Size()
+		}
+		go a.alog.follow(a.ctx, offset)
+	})
+}
+
+// isLogProblem reports if gpg-agent log line is something user should know about.
+func isLogProblem(line string) bool {
+	l := strings.ToLower(line)
+	for _, s := range []string{"error", "failed", "warning", "can't", "cannot", "no such device", "not found"} {
+		if strings.Contains(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *agentLog) process(line string) {
+	if !isLogProblem(line) {
+		return
+	}
+	log.Printf("gpg-agent log: %s", line)
+
+	l.mu.Lock()
+	l.recent = append(l.recent, line)
+	if len(l.recent) > maxLogProblems {
+		l.recent = l.recent[len(l.recent)-maxLogProblems:]
+	}
+	report := l.report
+	l.mu.Unlock()
+
+	if report != nil {
+		report(line)
+	}
+}
+
+func (l *agentLog) follow(ctx context.Context, offset int64) {
+
+	var partial string
+
+	recheck := agentLogRecheck
+	changed, err := util.WatchDir(ctx, filepath.Dir(l.fname))
+	if err != nil {
+		log.Printf("gpg-agent log will be polled: %s", err)
+		recheck = time.Second
+	}
+	t := time.NewTimer(recheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changed:
+			if !ok {
+				changed, recheck = nil, time.Second
+			}
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+		}
+		t.Reset(recheck)
+
+		f, err := os.Open(l.fname)
+		if err != nil {
+			continue
+		}
+		if fi, err := f.Stat(); err == nil && fi.Size() < offset {
+			// truncated or replaced
+			offset, partial = 0, ""
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			continue
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		offset += int64(len(data))
+
+		lines := strings.Split(partial+string(data), "\n")
+		partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				l.process(line)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// approvalsFileName is the name of the file in gui.homedir remembered approvals are kept in, encrypted with DPAPI.
+const approvalsFileName = "approvals.dat"
+
+// Approval is standing decision to let process use key without confirmation, it is taken with "Always allow" answer
+// to confirmation.
+type Approval struct {
+	Process  string    `json:"process"`
+	Key      string    `json:"key"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+func (ap *Approval) String() string {
+	s := fmt.Sprintf("%s with %s, since %s", ap.Process, ap.Key, ap.Created.Format("2006-01-02"))
+	if !ap.LastUsed.IsZero() {
+		s += ", last used " + ap.LastUsed.Format("2006-01-02 15:04")
+	}
+	return s
+}
+
+func (ap *Approval) matches(process, key string) bool {
+	return strings.EqualFold(ap.Process, process) && ap.Key == key
+}
+
+// approvalStore keeps remembered approvals, every change is saved immediately. Executable is identified by full image
+// path, so only clients which image could be determined are ever remembered.
+type approvalStore struct {
+	mu    sync.Mutex
+	fname string
+	items []Approval
+}
+
+// loadApprovals reads remembered approvals from gui.homedir, missing file means there are none.
+func loadApprovals(home string) (*approvalStore, error) {
+	s := &approvalStore{fname: filepath.Join(home, approvalsFileName)}
+	data, err := os.ReadFile(s.fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read approvals: %w", err)
+	}
+	if data, err = util.UnprotectData(data); err != nil {
+		return nil, fmt.Errorf("unable to decrypt approvals %s: %w", s.fname, err)
+	}
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		return nil, fmt.Errorf("unable to parse approvals %s: %w", s.fname, err)
+	}
+	return s, nil
+}
+
+// save writes approvals, should be called with lock held.
+func (s *approvalStore) save() error {
+	data, err := json.Marshal(s.items)
+	if err != nil {
+		return err
+	}
+	if data, err = util.ProtectData(data, "win-gpg-agent approvals"); err != nil {
+		return err
+	}
+	// readers should never see partially written file
+	tmp := s.fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("unable to write approvals: %w", err)
+	}
+	if err := os.Rename(tmp, s.fname); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write approvals: %w", err)
+	}
+	return nil
+}
+
+// rememberable tells if approval could be kept for client.
+func rememberable(ci *ClientInfo) bool {
+	return ci != nil && len(ci.Image) > 0
+}
+
+// allowed checks if process has standing approval to use key and marks it used.
+func (s *approvalStore) allowed(ci *ClientInfo, key string) bool {
+	if s == nil || !rememberable(ci) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.items {
+		ap := &s.items[i]
+		if !ap.matches(ci.Image, key) {
+			continue
+		}
+		// usage time is informational, do not rewrite file on every signature
+		if now := time.Now(); now.Sub(ap.LastUsed) > time.Hour {
+			ap.LastUsed = now
+			if err := s.save(); err != nil {
+				log.Printf("Unable to update approvals: %s", err)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// add remembers approval for process to use key.
+func (s *approvalStore) add(ci *ClientInfo, key string) {
+	if s == nil || !rememberable(ci) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.items {
+		if s.items[i].matches(ci.Image, key) {
+			return
+		}
+	}
+	s.items = append(s.items, Approval{Process: ci.Image, Key: key, Created: time.Now()})
+	if err := s.save(); err != nil {
+		log.Printf("Unable to save approvals: %s", err)
+		return
+	}
+	log.Printf("Remembered approval for %s to use key %s", ci.Image, key)
+}
+
+func (s *approvalStore) list() []Approval {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Approval(nil), s.items...)
+}
+
+// revoke drops listed approvals, returns number of approvals removed.
+func (s *approvalStore) revoke(aps []Approval) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rest := s.items[:0]
+	for _, ap := range s.items {
+		drop := false
+		for _, r := range aps {
+			if ap.matches(r.Process, r.Key) {
+				drop = true
+				break
+			}
+		}
+		if drop {
+			log.Printf("Revoked approval for %s to use key %s", ap.Process, ap.Key)
+			continue
+		}
+		rest = append(rest, ap)
+	}
+	n := len(s.items) - len(rest)
+	s.items = rest
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
+
+// Approvals returns remembered "always allow" decisions.
+func (a *Agent) Approvals() []Approval {
+	return a.policy.approvals.list()
+}
+
+// RevokeApprovals forgets remembered decisions, following requests from those processes are confirmed again.
+func (a *Agent) RevokeApprovals(aps []Approval) (int, error) {
+	return a.policy.approvals.revoke(aps)
+}
+
+// LoadApprovals returns approvals remembered in gui.homedir, it does not need running instance.
+func LoadApprovals(home string) ([]Approval, error) {
+	s, err := loadApprovals(home)
+	if err != nil {
+		return nil, err
+	}
+	return s.items, nil
+}
+
+// ImportApprovals adds approvals to ones remembered in gui.homedir (encrypting them for current user), returns number
+// of approvals which were not there. Running instance picks them up on restart.
+func ImportApprovals(home string, aps []Approval) (int, error) {
+	s, err := loadApprovals(home)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, ap := range aps {
+		known := false
+		for i := range s.items {
+			if s.items[i].matches(ap.Process, ap.Key) {
+				known = true
+				break
+			}
+		}
+		if !known && len(ap.Process) > 0 && len(ap.Key) > 0 {
+			s.items = append(s.items, ap)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
@@ -0,0 +1,583 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/trace"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+var errSessionLocked = errors.New("session is locked or disconnected")
+
+// assuanReader splits Assuan stream into lines keeping all data in single buffer owned by caller, so it could be wiped.
+type assuanReader struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	// length of next line found by buffered, 0 if not known
+	lineLen int
+}
+
+// next returns next complete line. When buffer is full or reading fails whatever is available is returned instead with
+// complete set to false. Returned slice is only valid until next call.
+func (ar *assuanReader) next() (line []byte, complete bool, err error) {
+	if n := ar.lineLen; n > 0 {
+		ar.lineLen = 0
+		line = ar.buf[ar.start : ar.start+n]
+		ar.start += n
+		return line, true, nil
+	}
+	for {
+		if i := bytes.IndexByte(ar.buf[ar.start:ar.end], '\n'); i >= 0 {
+			line = ar.buf[ar.start : ar.start+i+1]
+			ar.start += i + 1
+			return line, true, nil
+		}
+		if ar.start > 0 {
+			n := copy(ar.buf, ar.buf[ar.start:ar.end])
+			util.Wipe(ar.buf[n:ar.end])
+			ar.start, ar.end = 0, n
+		}
+		if ar.end == len(ar.buf) {
+			ar.start = ar.end
+			return ar.buf, false, nil
+		}
+		n, err := ar.r.Read(ar.buf[ar.end:])
+		ar.end += n
+		if err != nil {
+			line = ar.buf[ar.start:ar.end]
+			ar.start = ar.end
+			return line, false, err
+		}
+	}
+}
+
+// buffered checks if complete line is available without reading.
+func (ar *assuanReader) buffered() bool {
+	if ar.lineLen == 0 {
+		ar.lineLen = bytes.IndexByte(ar.buf[ar.start:ar.end], '\n') + 1
+	}
+	return ar.lineLen > 0
+}
+
+// grow replaces buffer with larger one keeping unread data, old buffer is wiped.
+func (ar *assuanReader) grow(size int) {
+	buf := make([]byte, size)
+	ar.end = copy(buf, ar.buf[ar.start:ar.end])
+	// lineLen is relative to start, so it stays valid
+	ar.start = 0
+	util.Wipe(ar.buf)
+	ar.buf = buf
+}
+
+// dataLine checks if line is Assuan D line, these are never inspected beyond that to keep bulk transfers cheap.
+func dataLine(line []byte) bool {
+	return len(line) > 1 && line[0] == 'D' && line[1] == ' '
+}
+
+// assuanVerb returns upper cased first word of Assuan line.
+func assuanVerb(line []byte) string {
+	line = bytes.TrimLeft(line, " \t")
+	if i := bytes.IndexAny(line, " \t\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(string(line))
+}
+
+// assuanArgs returns Assuan line without its verb and line ending.
+func assuanArgs(line []byte) string {
+	s := strings.TrimSpace(string(line))
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return strings.TrimSpace(s[i:])
+	}
+	return ""
+}
+
+// assuanCommand is command client sent which gpg-agent has not finished yet.
+type assuanCommand struct {
+	verb  string
+	start time.Time
+	// internal command was sent by agent-gui itself, its result is not relayed to client
+	internal bool
+	// bridged command gets passphrase from loopback store instead of pinentry
+	bridged  bool
+	attempts int
+	// option is OPTION line, it is remembered when gpg-agent accepts it
+	option string
+}
+
+// lockedWriter serializes writes to gpg-agent coming from client relay and from session itself.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.w == nil {
+		// gpg-agent is not bound yet, only comments could come before first command
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
+
+// set connects writer to gpg-agent.
+func (lw *lockedWriter) set(w io.Writer) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.w = w
+}
+
+// pinentryMode returns value of pinentry-mode option if line sets it.
+func pinentryMode(line []byte) (string, bool) {
+	name, value := assuanArgs(line), ""
+	if i := strings.IndexAny(name, "= \t"); i >= 0 {
+		name, value = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	if !strings.EqualFold(name, "pinentry-mode") {
+		return "", false
+	}
+	return value, true
+}
+
+// assuanSession follows Assuan conversation relayed between client and gpg-agent line by line. Unlike byte relay it
+// knows who is talking: data client sends in response to INQUIRE is never taken for commands and passes untouched,
+// commands could be rejected before they reach gpg-agent and every command is matched with its final OK or ERR.
+// Only command verbs and results are ever reported, so arguments and D lines carrying secrets do not leak to logs.
+type assuanSession struct {
+	mu      sync.Mutex
+	inquire bool
+	pending []assuanCommand
+	// onCommand is called for every client command, returned error is sent to client instead of passing command on
+	onCommand func(verb string, line []byte) *common.Error
+	// onResult is called when gpg-agent finishes command, err is nil for OK
+	onResult func(verb string, err error, elapsed time.Duration)
+
+	// agent receives commands and inquiry answers session sends itself, nil disables loopback bridging
+	agent io.Writer
+	// mode is pinentry mode client has set, it is restored after bridged command
+	mode string
+	// options are OPTION lines gpg-agent accepted in order they were sent. RESET does not clear them, so connection
+	// is only reused by client which sets exactly the same options
+	options []string
+	// bind connects session to gpg-agent on first client command other than OPTION gpg-agent has accepted before,
+	// those are answered by session until then. Nil when gpg-agent is connected from the start
+	bind func(options []string) error
+	// known checks if gpg-agent has accepted OPTION line before
+	known func(option string) bool
+	// bridge is called for client command, true means passphrase gpg-agent inquires for it is supplied by session
+	bridge func(verb string) bool
+	// passphrase returns passphrase for bridged command, caller wipes it. Nil when it is not available any more
+	passphrase func() []byte
+	// keepAlive tells if gpg-agent connection could be reused, then BYE is answered without passing it on
+	keepAlive func() bool
+}
+
+// idle checks if nothing is going on in the conversation, so gpg-agent connection could be given to another client.
+func (s *assuanSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.inquire && len(s.pending) == 0
+}
+
+// reusable checks if gpg-agent connection could be given to another client. Options client has set stay with
+// connection, see optionSet.
+func (s *assuanSession) reusable() bool {
+	return s.idle()
+}
+
+// optionSet returns OPTION lines gpg-agent accepted from client.
+func (s *assuanSession) optionSet() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.options...)
+}
+
+// internal sends command to gpg-agent on behalf of session, its result is consumed by agentLine. Must be called with
+// mutex held.
+func (s *assuanSession) internal(cmd string) error {
+	if _, err := io.WriteString(s.agent, cmd+"\n"); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, assuanCommand{verb: assuanVerb([]byte(cmd)), start: time.Now(), internal: true})
+	return nil
+}
+
+// clientLine inspects line client sent, false means line should not be relayed - reply has been sent to w instead.
+func (s *assuanSession) clientLine(line []byte, w io.Writer) bool {
+	s.mu.Lock()
+	if s.inquire {
+		// D lines until END or CAN
+		if !dataLine(line) {
+			if verb := assuanVerb(line); verb == "END" || verb == "CAN" {
+				s.inquire = false
+			}
+		}
+		s.mu.Unlock()
+		return true
+	}
+	s.mu.Unlock()
+
+	verb := assuanVerb(line)
+
+	if len(verb) == 0 || verb[0] == '#' {
+		return true
+	}
+	if verb == "BYE" && s.keepAlive != nil && s.keepAlive() {
+		// client closes connection after reply, gpg-agent would close its side too
+		if _, err := io.WriteString(w, "OK closing connection\n"); err != nil {
+			log.Printf("Unable to reply to %s: %s", verb, err.Error())
+		}
+		return false
+	}
+	if s.onCommand != nil {
+		if e := s.onCommand(verb, line); e != nil {
+			// client is waiting for response, gpg-agent does not send anything in the meantime
+			msg := fmt.Sprintf("ERR %d %s <%s>\n", common.MakeErrCode(e.Src, e.Code), e.Message, e.SrcName)
+			if _, err := io.WriteString(w, msg); err != nil {
+				log.Printf("Unable to reject %s: %s", verb, err.Error())
+			}
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var option string
+	if verb == "OPTION" {
+		option = strings.TrimSpace(string(line))
+		if mode, ok := pinentryMode(line); ok {
+			s.mode = mode
+		}
+	}
+	if s.bind != nil {
+		if len(option) > 0 && s.known != nil && s.known(option) {
+			s.options = append(s.options, option)
+			if _, err := io.WriteString(w, "OK\n"); err != nil {
+				log.Printf("Unable to reply to %s: %s", verb, err.Error())
+			}
+			return false
+		}
+		bind := s.bind
+		s.bind = nil
+		if err := bind(s.options); err != nil {
+			log.Printf("Unable to connect to gpg-agent for %s: %s", verb, err.Error())
+			return false
+		}
+	}
+	cmd := assuanCommand{verb: verb, start: time.Now(), option: option}
+	if s.agent != nil && s.bridge != nil && s.bridge(verb) {
+		// command line is written to gpg-agent right after this one
+		if err := s.internal("OPTION pinentry-mode=loopback"); err != nil {
+			log.Printf("Unable to switch gpg-agent to loopback pinentry for %s: %s", verb, err.Error())
+		} else {
+			cmd.bridged = true
+		}
+	}
+	s.pending = append(s.pending, cmd)
+	return true
+}
+
+// answer sends passphrase gpg-agent inquired for bridged command. Repeated inquiry means passphrase was wrong and is
+// canceled, so bad passphrase is not tried over and over. Must be called with mutex held.
+func (s *assuanSession) answer(cmd *assuanCommand) {
+	var data []byte
+	if cmd.attempts++; cmd.attempts == 1 {
+		if p := s.passphrase(); p != nil {
+			data = escapeData(p)
+			util.Wipe(p)
+		}
+	}
+	if data == nil {
+		data = []byte("CAN\n")
+	} else {
+		data = append(data, "END\n"...)
+	}
+	defer util.Wipe(data)
+	if _, err := s.agent.Write(data); err != nil {
+		log.Printf("Unable to answer passphrase inquiry for %s: %s", cmd.verb, err.Error())
+	}
+}
+
+// agentLine inspects line gpg-agent sent, false means line should not be relayed - it is answer to session itself.
+func (s *assuanSession) agentLine(line []byte) bool {
+	if dataLine(line) {
+		return true
+	}
+	var err error
+	switch verb := assuanVerb(line); verb {
+	case "INQUIRE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.pending) > 0 && s.pending[0].bridged && strings.EqualFold(assuanArgs(line), "PASSPHRASE") {
+			s.answer(&s.pending[0])
+			return false
+		}
+		s.inquire = true
+		return true
+	case "S":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// status preceding passphrase inquiry client does not expect
+		return len(s.pending) == 0 || !s.pending[0].bridged || !strings.HasPrefix(assuanArgs(line), "INQUIRE_MAXLEN")
+	case "ERR":
+		err = common.DecodeErrCmd(assuanArgs(line))
+	case "OK":
+	default:
+		return true
+	}
+
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		// greeting
+		s.mu.Unlock()
+		return true
+	}
+	cmd := s.pending[0]
+	s.pending = s.pending[1:]
+	s.inquire = false
+	if len(cmd.option) > 0 && err == nil {
+		s.options = append(s.options, cmd.option)
+	}
+	if cmd.internal {
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("gpg-agent rejected %s: %s", strings.TrimSpace(string(line)), common.Explain(err))
+		}
+		return false
+	}
+	if cmd.bridged {
+		// client has not seen result yet, so nothing else could be sent in the meantime
+		mode := s.mode
+		if len(mode) == 0 {
+			mode = "ask"
+		}
+		if e := s.internal("OPTION pinentry-mode=" + mode); e != nil {
+			log.Printf("Unable to restore pinentry mode after %s: %s", cmd.verb, e.Error())
+		}
+	}
+	s.mu.Unlock()
+
+	if s.onResult != nil {
+		s.onResult(cmd.verb, err, time.Since(cmd.start))
+	}
+	return true
+}
+
+const (
+	// bulkBufferSize is size of relay buffers once stream turns out to be bulk data (large decryption or encryption).
+	bulkBufferSize = 256 * 1024
+	// bulkLines is number of consecutive D lines after which stream is considered bulk data.
+	bulkLines = 64
+)
+
+// relayAssuan copies Assuan stream from one side of connection to the other inspecting every complete line. Pieces of
+// overlong lines are relayed as is. Relayed lines are written out straight from read buffer in runs, only when nothing
+// more could be read without waiting, and buffer grows when long run of D lines is seen, so bulk transfers do not pay
+// for every 1000 byte line with its own write. Returns number of bytes relayed.
+func (c *Connector) relayAssuan(from net.Conn, to io.Writer, deadline time.Duration, inspect func(line []byte) bool) (int64, error) {
+
+	var (
+		r = &assuanReader{r: from, buf: make([]byte, copyBufferSize)}
+		// run of relayed lines in r.buf not written yet
+		head, tail int
+		total      int64
+		partial    bool
+		data       int
+	)
+	// relayed stream may carry passphrases (loopback pinentry) and key material
+	defer func() { util.Wipe(r.buf) }()
+
+	flush := func() error {
+		if head == tail {
+			return nil
+		}
+		_, err := to.Write(r.buf[head:tail])
+		head, tail = 0, 0
+		return err
+	}
+
+	for c.locked == nil || atomic.LoadInt32(c.locked) == 0 {
+		if !r.buffered() {
+			// next read may move data in buffer or block, other side should have everything relayed so far
+			if err := flush(); err != nil {
+				return total, err
+			}
+			if deadline != 0 {
+				_ = from.SetReadDeadline(time.Now().Add(deadline))
+			}
+		}
+		line, complete, err := r.next()
+		if len(line) > 0 {
+			if partial || !complete || inspect(line) {
+				// line is always slice of r.buf
+				off := len(r.buf) - cap(line)
+				if off != tail {
+					if err := flush(); err != nil {
+						return total, err
+					}
+					head = off
+				}
+				tail = off + len(line)
+				total += int64(len(line))
+			} else if err := flush(); err != nil {
+				return total, err
+			}
+		}
+		partial = !complete
+
+		if complete && dataLine(line) {
+			data++
+		} else {
+			data = 0
+		}
+		if data == bulkLines && len(r.buf) < bulkBufferSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+			r.grow(bulkBufferSize)
+		}
+
+		if err != nil {
+			if e := flush(); e != nil {
+				return total, e
+			}
+			if errors.Is(err, io.EOF) {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+	return total, errSessionLocked
+}
+
+// TTYPrefix starts ttyname option value which carries PID of the client, pinentry uses its console.
+const TTYPrefix = "winpid:"
+
+// wantsTTY checks if pinentry should know client process, so it could ask for passphrase on its terminal. With "auto"
+// this is only done for clients in other sessions (OpenSSH) or when there is no desktop to show dialogs on.
+func (c *Connector) wantsTTY(ci *ClientInfo) bool {
+	if ci == nil || ci.PID == 0 {
+		return false
+	}
+	switch strings.ToLower(c.tty) {
+	case "never":
+		return false
+	case "always":
+		return true
+	default:
+	}
+	return util.OtherSession(ci.PID) || !util.InteractiveDesktop()
+}
+
+// readAssuanLine reads single line byte by byte, so nothing after it is consumed.
+func readAssuanLine(r io.Reader) ([]byte, error) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for len(line) < common.MaxLineLen {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return line, nil
+		}
+	}
+	return nil, fmt.Errorf("line is too long")
+}
+
+// announceTTY tells gpg-agent PID of the client as ttyname option before client could talk to it, gpg-agent passes it
+// to pinentry. Option reply is consumed here.
+func (c *Connector) announceTTY(id int64, agent io.ReadWriter, pid uint32) error {
+	if _, err := fmt.Fprintf(agent, "OPTION ttyname=%s%d\n", TTYPrefix, pid); err != nil {
+		return fmt.Errorf("unable to send ttyname option: %w", err)
+	}
+	reply, err := readAssuanLine(agent)
+	if err != nil {
+		return fmt.Errorf("unable to read ttyname option reply: %w", err)
+	}
+	if assuanVerb(reply) != "OK" {
+		log.Printf("[%d] gpg-agent did not accept ttyname: %s", id, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// newAssuanSession prepares session which enforces access policy on secret key operations clients are asking for,
+// reports them and errors gpg-agent returns to client with human readable hints. Passphrases for keys whitelisted for
+// loopback bridging are sent to gpg-agent over agent.
+func (c *Connector) newAssuanSession(id int64, ci *ClientInfo, remote bool, agent io.Writer, span *trace.Span) *assuanSession {
+	var keygrip string
+	return &assuanSession{
+		agent:     agent,
+		keepAlive: c.pool.reusable,
+		bridge: func(verb string) bool {
+			return (verb == "PKSIGN" || verb == "PKDECRYPT") && c.loopback.allowed(keygrip)
+		},
+		passphrase: func() []byte {
+			p, source := c.loopback.passphrase(keygrip)
+			if p != nil {
+				log.Printf("[%d] Passphrase for %s supplied to gpg-agent from %s", id, keygrip, source)
+			}
+			return p
+		},
+		onCommand: func(verb string, line []byte) *common.Error {
+			var op string
+			switch verb {
+			case "SIGKEY", "SETKEY":
+				if f := strings.Fields(assuanArgs(line)); len(f) > 0 {
+					keygrip = f[0]
+				}
+				return nil
+			case "PKSIGN":
+				op = "sign"
+			case "PKDECRYPT":
+				op = "decrypt"
+			default:
+				return nil
+			}
+			policy := span.Child("policy", "operation", op, "key", keygrip)
+			err := c.authorize(ci, op, keygrip, remote)
+			policy.End(err)
+			if err != nil {
+				log.Printf("[%d] %s rejected: %s", id, verb, err.Error())
+				c.stats.command(verb, nil, true, 0)
+				return &common.Error{Src: common.ErrSrcGPGagent, Code: common.ErrNotConfirmed, SrcName: "GPG Agent", Message: "Not confirmed"}
+			}
+			c.assuanKeyUsed(op, keygrip)
+			return nil
+		},
+		onResult: func(verb string, err error, elapsed time.Duration) {
+			span.Record(verb, time.Now().Add(-elapsed), err)
+			c.stats.command(verb, err, false, elapsed)
+			if err == nil {
+				if verb == "PKSIGN" {
+					c.batch.signed(elapsed)
+				}
+				if trackedCommands[verb] {
+					log.Printf("[%d] %s OK in %s", id, verb, elapsed)
+				}
+				return
+			}
+			msg := common.Explain(err)
+			log.Printf("[%d] gpg-agent returned error to %s client on %s: %s", id, c.index, verb, msg)
+			c.stats.assuanError(msg)
+			if e, ok := err.(common.Error); ok && (e.Code == common.ErrCardRemoved || e.Code == common.ErrCardNotPresent) {
+				notify.Notify(notify.CardRemoved, "Smartcard", msg, "connector", c.index.String())
+			}
+		},
+	}
+}
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+)
+
+// streamConn is client side of connection serving prepared stream in chunks socket would return.
+type streamConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (sc *streamConn) Read(p []byte) (int, error) {
+	const chunk = 64 * 1024
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	return sc.r.Read(p)
+}
+
+func (sc *streamConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// countingWriter counts writes to connection, every one of them is a syscall.
+type countingWriter struct {
+	net.Conn
+	writes int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Conn.Write(p)
+}
+
+// discardConn returns loopback TCP connection everything written to which is read and discarded.
+func discardConn(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+// dataStream returns size bytes of payload as maximum length D lines followed by OK.
+func dataStream(size int) []byte {
+	const payload = 1000 - len("D \n")
+	var buf bytes.Buffer
+	buf.Grow(size + size/payload*3 + 3)
+	line := append([]byte("D "), bytes.Repeat([]byte{'A'}, payload)...)
+	line = append(line, '\n')
+	for n := 0; n < size; n += payload {
+		buf.Write(line)
+	}
+	buf.WriteString("OK\n")
+	return buf.Bytes()
+}
+
+// relayString relays input through relayAssuan in one byte reads, so lines are split between reads, and returns what
+// came out.
+func relayString(t *testing.T, input string, inspect func(line []byte) bool) string {
+	t.Helper()
+	var out bytes.Buffer
+	n, err := (&Connector{}).relayAssuan(&streamConn{r: iotest.OneByteReader(strings.NewReader(input))}, &out, 0, inspect)
+	if err != nil {
+		t.Fatalf("relay failed: %s", err)
+	}
+	if n != int64(out.Len()) {
+		t.Fatalf("relay reported %d bytes, %d written", n, out.Len())
+	}
+	return out.String()
+}
+
+// recordingSession returns session which keeps verbs of client commands and results of finished ones.
+func recordingSession(commands, results *[]string) *assuanSession {
+	return &assuanSession{
+		onCommand: func(verb string, line []byte) *common.Error {
+			*commands = append(*commands, verb)
+			return nil
+		},
+		onResult: func(verb string, err error, elapsed time.Duration) {
+			res := "OK"
+			if err != nil {
+				res = "ERR"
+			}
+			*results = append(*results, verb+" "+res)
+		},
+		keepAlive: func() bool { return true },
+	}
+}
+
+func TestRelayInquireData(t *testing.T) {
+	var commands, results []string
+	s := recordingSession(&commands, &results)
+
+	if !s.clientLine([]byte("PKDECRYPT\n"), io.Discard) || !s.agentLine([]byte("INQUIRE CIPHERTEXT\n")) {
+		t.Fatal("command and inquiry should be relayed")
+	}
+	// data lines look like commands which would be rejected or answered by session
+	const data = "D BYE\nD PKSIGN\nD (enc-val (rsa (a #00#)))\nEND\n"
+	if out := relayString(t, data, func(line []byte) bool { return s.clientLine(line, io.Discard) }); out != data {
+		t.Fatalf("inquiry data changed in relay: %q", out)
+	}
+	if len(commands) != 1 || commands[0] != "PKDECRYPT" {
+		t.Fatalf("inquiry data taken for commands: %v", commands)
+	}
+	if s.idle() {
+		t.Fatal("session is idle before command result")
+	}
+	if !s.agentLine([]byte("D (5:value3:abc)\n")) || !s.agentLine([]byte("OK\n")) {
+		t.Fatal("command result should be relayed")
+	}
+	if len(results) != 1 || results[0] != "PKDECRYPT OK" || !s.idle() {
+		t.Fatalf("unexpected results %v, idle %t", results, s.idle())
+	}
+
+	// after END client talks commands again
+	s.clientLine([]byte("BYE\n"), io.Discard)
+	if len(commands) != 1 {
+		t.Fatalf("BYE should be answered by session, got commands %v", commands)
+	}
+	s.clientLine([]byte("GETINFO version\n"), io.Discard)
+	if len(commands) != 2 || commands[1] != "GETINFO" {
+		t.Fatalf("command after inquiry was not seen: %v", commands)
+	}
+}
+
+func TestRelayRejectedCommand(t *testing.T) {
+	var commands, results []string
+	s := recordingSession(&commands, &results)
+	s.onCommand = func(verb string, line []byte) *common.Error {
+		commands = append(commands, verb)
+		if verb == "PKSIGN" {
+			return &common.Error{Src: common.ErrSrcGPGagent, Code: common.ErrNotConfirmed, SrcName: "GPG Agent", Message: "Not confirmed"}
+		}
+		return nil
+	}
+
+	var client bytes.Buffer
+	agent := relayString(t, "SIGKEY 0123ABCD\nPKSIGN\nGETINFO version\n", func(line []byte) bool { return s.clientLine(line, &client) })
+	if agent != "SIGKEY 0123ABCD\nGETINFO version\n" {
+		t.Fatalf("gpg-agent got %q", agent)
+	}
+	want := fmt.Sprintf("ERR %d Not confirmed <GPG Agent>\n", common.MakeErrCode(common.ErrSrcGPGagent, common.ErrNotConfirmed))
+	if client.String() != want {
+		t.Fatalf("client got %q, want %q", client.String(), want)
+	}
+	if len(s.pending) != 2 || s.pending[0].verb != "SIGKEY" || s.pending[1].verb != "GETINFO" {
+		t.Fatalf("rejected command should not wait for result: %v", s.pending)
+	}
+}
+
+func TestRelayLongAndPartialLines(t *testing.T) {
+	long := "D " + strings.Repeat("x", 3*copyBufferSize+17) + "\n"
+	input := "OK Pleased to meet you\n" + long + "OK\n" + "S PROGRESS unfinished"
+
+	var inspected []string
+	out := relayString(t, input, func(line []byte) bool {
+		inspected = append(inspected, string(line))
+		return true
+	})
+	if out != input {
+		t.Fatalf("relayed %d bytes differ from %d bytes of input", len(out), len(input))
+	}
+	// pieces of overlong line and unterminated tail are passed without inspection
+	if len(inspected) != 2 || inspected[0] != "OK Pleased to meet you\n" || inspected[1] != "OK\n" {
+		t.Fatalf("unexpected inspected lines %q", inspected)
+	}
+}
+
+func TestAgentLineResults(t *testing.T) {
+	var commands, results []string
+	s := recordingSession(&commands, &results)
+
+	if !s.agentLine([]byte("OK Pleased to meet you\n")) || len(results) != 0 {
+		t.Fatalf("greeting taken for result: %v", results)
+	}
+	for _, cmd := range []string{"GETINFO version", "HAVEKEY 0123ABCD", "# comment", "KEYINFO 0123ABCD"} {
+		s.clientLine([]byte(cmd+"\n"), io.Discard)
+	}
+	for _, line := range []string{
+		"D 2.2.27\n",
+		"OK\n",
+		"S PROGRESS x\n",
+		fmt.Sprintf("ERR %d No secret key <GPG Agent>\n", common.MakeErrCode(common.ErrSrcGPGagent, common.ErrNoSeckey)),
+		"# comment\n",
+		"OK\n",
+	} {
+		if !s.agentLine([]byte(line)) {
+			t.Fatalf("line %q was not relayed", line)
+		}
+	}
+	want := []string{"GETINFO OK", "HAVEKEY ERR", "KEYINFO OK"}
+	if strings.Join(results, ",") != strings.Join(want, ",") {
+		t.Fatalf("results %v, want %v", results, want)
+	}
+}
+
+func TestAgentLineError(t *testing.T) {
+	var got error
+	s := &assuanSession{onResult: func(verb string, err error, elapsed time.Duration) { got = err }}
+	s.clientLine([]byte("PKSIGN\n"), io.Discard)
+	s.agentLine([]byte(fmt.Sprintf("ERR %d Operation cancelled <Pinentry>\n", common.MakeErrCode(common.ErrSrcPinentry, common.ErrCanceled))))
+
+	var e common.Error
+	if !errors.As(got, &e) || e.Code != common.ErrCanceled {
+		t.Fatalf("unexpected error %v", got)
+	}
+}
+
+func TestSessionIdle(t *testing.T) {
+	s := &assuanSession{}
+	steps := []struct {
+		client bool
+		line   string
+		idle   bool
+	}{
+		{false, "OK Pleased to meet you", true},
+		{true, "# comment", true},
+		{true, "", true},
+		{true, "PKDECRYPT", false},
+		{false, "S INQUIRE_MAXLEN 4096", false},
+		{false, "INQUIRE CIPHERTEXT", false},
+		{true, "D 00", false},
+		{true, "END", false},
+		{false, "OK", true},
+		{true, "PKSIGN", false},
+		{false, "INQUIRE PINENTRY_LAUNCHED 1234", false},
+		{true, "CAN", false},
+		{false, "ERR 83886179 Operation cancelled <Pinentry>", true},
+	}
+	for i, step := range steps {
+		if step.client {
+			s.clientLine([]byte(step.line+"\n"), io.Discard)
+		} else {
+			s.agentLine([]byte(step.line + "\n"))
+		}
+		if s.idle() != step.idle {
+			t.Fatalf("step %d %q: idle is %t", i, step.line, s.idle())
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, inspect func(s *assuanSession) func(line []byte) bool) {
+	stream := dataStream(100 << 20)
+	c := &Connector{}
+	w := &countingWriter{Conn: discardConn(b)}
+	defer w.Close()
+
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := &assuanSession{pending: []assuanCommand{{verb: "PKDECRYPT", start: time.Now()}}}
+		n, err := c.relayAssuan(&streamConn{r: bytes.NewReader(stream)}, w, 0, inspect(s))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != int64(len(stream)) {
+			b.Fatalf("relayed %d bytes out of %d", n, len(stream))
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+// BenchmarkRelayAssuanAgent relays 100MB of plaintext gpg-agent returns for large decryption.
+func BenchmarkRelayAssuanAgent(b *testing.B) {
+	benchmarkRelay(b, func(s *assuanSession) func(line []byte) bool {
+		return s.agentLine
+	})
+}
+
+// BenchmarkRelayAssuanClient relays 100MB of ciphertext client sends in response to INQUIRE.
+func BenchmarkRelayAssuanClient(b *testing.B) {
+	benchmarkRelay(b, func(s *assuanSession) func(line []byte) bool {
+		s.inquire = true
+		return func(line []byte) bool { return s.clientLine(line, io.Discard) }
+	})
+}
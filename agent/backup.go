@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const (
+	// backupLayout names snapshot directories, so they sort by time
+	backupLayout = "20060102-150405"
+	// backupCheck is how often backup schedule is checked, first check is done backupDelay after start
+	backupCheck = time.Hour
+	backupDelay = time.Minute
+	// backupNag limits how often user is reminded about overdue backup
+	backupNag = 24 * time.Hour
+)
+
+// backupFiles are files of keyring snapshot and gpg arguments producing them. Secret keys are not exported - this is
+// not key escrow, they are either on card or should be backed up offline.
+var backupFiles = []struct {
+	name string
+	args []string
+}{
+	{"pubring.asc", []string{"--armor", "--export"}},
+	{"ownertrust.txt", []string{"--export-ownertrust"}},
+}
+
+// snapshots returns names of keyring snapshot directories in dir, oldest first.
+func snapshots(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := time.ParseInLocation(backupLayout, e.Name(), time.Local); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LastBackup returns time of the newest keyring snapshot, zero time if there is none.
+func (a *Agent) LastBackup() time.Time {
+	names := snapshots(a.Cfg.GUI.Backup.Directory)
+	if len(names) == 0 {
+		return time.Time{}
+	}
+	t, _ := time.ParseInLocation(backupLayout, names[len(names)-1], time.Local)
+	return t
+}
+
+// Backup writes snapshot of public keyring and ownertrust into new directory under gui.backup.directory and removes
+// snapshots over gui.backup.keep. Snapshot directory is returned.
+func (a *Agent) Backup() (string, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	a.backupMu.Lock()
+	defer a.backupMu.Unlock()
+
+	dir := filepath.Join(a.Cfg.GUI.Backup.Directory, time.Now().Format(backupLayout))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create backup directory: %w", err)
+	}
+	for _, f := range backupFiles {
+		cmd := exec.Command(filepath.Join(filepath.Dir(a.Exe), "gpg.exe"), append([]string{"--homedir", a.Cfg.GPG.Home, "--batch"}, f.args...)...)
+		cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+		out, err := cmd.Output()
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, f.name), out, 0600)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("unable to back up %s: %w", f.name, err)
+		}
+	}
+	if keep := a.Cfg.GUI.Backup.Keep; keep > 0 {
+		names := snapshots(a.Cfg.GUI.Backup.Directory)
+		for i := 0; i < len(names)-keep; i++ {
+			if err := os.RemoveAll(filepath.Join(a.Cfg.GUI.Backup.Directory, names[i])); err != nil {
+				log.Printf("Unable to remove old keyring snapshot: %s", err)
+			}
+		}
+	}
+	log.Printf("Keyring snapshot is written to %s", dir)
+	notify.Notify(notify.BackupDone, util.GPGAgentName, fmt.Sprintf("Keyring snapshot is written to %s", dir),
+		"home", a.Cfg.GPG.Home, "snapshot", dir)
+	return dir, nil
+}
+
+// backupStatus describes last backup for Status.
+func (a *Agent) backupStatus() string {
+	last := a.LastBackup()
+	if last.IsZero() {
+		return fmt.Sprintf("never, snapshots go to %s", a.Cfg.GUI.Backup.Directory)
+	}
+	return fmt.Sprintf("%s in %s", last.Format("2006-01-02 15:04:05"), a.Cfg.GUI.Backup.Directory)
+}
+
+// watchBackup checks if keyring backup is due and either takes snapshot or reminds user about it.
+func (a *Agent) watchBackup() {
+	t := time.NewTimer(backupDelay)
+	defer t.Stop()
+	var reminded time.Time
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-t.C:
+			reminded = a.checkBackup(reminded)
+			t.Reset(backupCheck)
+		}
+	}
+}
+
+// checkBackup acts on overdue backup and returns time user was last reminded.
+func (a *Agent) checkBackup(reminded time.Time) time.Time {
+	last := a.LastBackup()
+	if time.Since(last) < a.Cfg.GUI.Backup.Interval {
+		return reminded
+	}
+	if a.Cfg.GUI.Backup.Auto {
+		if _, err := a.Backup(); err != nil {
+			log.Printf("Scheduled keyring backup failed: %s", err)
+			notify.Notify(notify.BackupDue, util.GPGAgentName, fmt.Sprintf("Scheduled keyring backup failed: %s", err),
+				"home", a.Cfg.GPG.Home, "state", "failed")
+		}
+		return reminded
+	}
+	if time.Since(reminded) < backupNag {
+		return reminded
+	}
+	when, lastField := "never been backed up", ""
+	if !last.IsZero() {
+		when = "not been backed up since " + last.Format("2006-01-02")
+		lastField = last.Format(time.RFC3339)
+	}
+	log.Printf("Keyring backup is due, keyring has %s", when)
+	notify.Send(&notify.Message{
+		Event:  notify.BackupDue,
+		Title:  util.GPGAgentName,
+		Text:   fmt.Sprintf("Public keyring and ownertrust have %s. Click to back them up now.", when),
+		Fields: map[string]string{"home": a.Cfg.GPG.Home, "last_backup": lastField, "state": "reminder"},
+		Action: func() {
+			if _, err := a.Backup(); err != nil {
+				log.Print(err.Error())
+				util.ShowOKMessage(util.MsgError, util.WinAgentName, err.Error())
+			}
+		},
+	})
+	return time.Now()
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// defaultBatchConnections is number of idle gpg-agent connections kept per connector in batch mode.
+const defaultBatchConnections = 4
+
+// BatchStats describes batch signing mode and throughput measured while it is on.
+type BatchStats struct {
+	Active     bool      `json:"active"`
+	Since      time.Time `json:"since,omitempty"`
+	Until      time.Time `json:"until,omitempty"`
+	Signs      int64     `json:"signs"`
+	PerSecond  float64   `json:"signs_per_second"`
+	AvgMs      float64   `json:"avg_sign_ms"`
+	Reused     int64     `json:"reused_connections"`
+	Suppressed int64     `json:"suppressed_notifications"`
+}
+
+// String formats batch statistics in single line.
+func (bs *BatchStats) String() string {
+	state := "off"
+	if bs.Active {
+		state = "on since " + bs.Since.Format("15:04:05")
+		if !bs.Until.IsZero() {
+			state += " until " + bs.Until.Format("15:04:05")
+		}
+	}
+	return fmt.Sprintf("%s, %d signatures (%.1f/s, %.0f ms average), %d connections reused, %d notifications suppressed",
+		state, bs.Signs, bs.PerSecond, bs.AvgMs, bs.Reused, bs.Suppressed)
+}
+
+// batchMode tunes agent for bursts of sign requests (git rebase re-signing every commit): gpg-agent connections are
+// reused, passphrases are cached longer and only first use of every key is notified. Throughput is measured while it
+// is on.
+type batchMode struct {
+	cacheTTL    time.Duration
+	connections int
+	duration    time.Duration
+
+	mu         sync.Mutex
+	active     bool
+	since      time.Time
+	until      time.Time
+	ended      time.Time
+	signs      int64
+	signTime   time.Duration
+	reused     int64
+	suppressed int64
+	seen       map[string]bool
+	timer      *time.Timer
+	report     func(on bool)
+}
+
+func newBatchMode(cfg *config.BatchConfig) *batchMode {
+	b := &batchMode{cacheTTL: cfg.CacheTTL, connections: cfg.Connections, duration: cfg.Duration}
+	if b.connections <= 0 {
+		b.connections = defaultBatchConnections
+	}
+	return b
+}
+
+// on checks if batch mode is active.
+func (b *batchMode) on() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// start turns batch mode on resetting counters, expired is called when configured duration is over.
+func (b *batchMode) start(expired func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active, b.since, b.until, b.ended = true, time.Now(), time.Time{}, time.Time{}
+	b.signs, b.signTime, b.reused, b.suppressed = 0, 0, 0, 0
+	b.seen = make(map[string]bool)
+	if b.duration > 0 {
+		b.until = b.since.Add(b.duration)
+		b.timer = time.AfterFunc(b.duration, expired)
+	}
+}
+
+// stop turns batch mode off.
+func (b *batchMode) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.active, b.ended, b.seen = false, time.Now(), nil
+}
+
+// signed records completed signature.
+func (b *batchMode) signed(elapsed time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active {
+		b.signs++
+		b.signTime += elapsed
+	}
+}
+
+// reuse records reused gpg-agent connection.
+func (b *batchMode) reuse() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reused++
+}
+
+// quiet checks if key used notification should be suppressed - in batch mode only first use of every key is shown.
+func (b *batchMode) quiet(key string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.active {
+		return false
+	}
+	if !b.seen[key] {
+		b.seen[key] = true
+		return false
+	}
+	b.suppressed++
+	return true
+}
+
+func (b *batchMode) snapshot() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bs := BatchStats{Active: b.active, Since: b.since, Until: b.until, Signs: b.signs, Reused: b.reused, Suppressed: b.suppressed}
+	end := b.ended
+	if b.active || end.IsZero() {
+		end = time.Now()
+	}
+	if d := end.Sub(b.since); d > 0 && b.signs > 0 {
+		bs.PerSecond = float64(b.signs) / d.Seconds()
+		bs.AvgMs = float64(b.signTime.Milliseconds()) / float64(b.signs)
+	}
+	return bs
+}
+
+// args returns gpg-agent arguments extending passphrase cache TTL while batch mode is on.
+func (b *batchMode) args() []string {
+	if !b.on() || b.cacheTTL <= 0 {
+		return nil
+	}
+	ttl := strconv.Itoa(int(b.cacheTTL / time.Second))
+	return []string{"--default-cache-ttl", ttl, "--max-cache-ttl", ttl, "--default-cache-ttl-ssh", ttl, "--max-cache-ttl-ssh", ttl}
+}
+
+// SetBatch turns batch signing mode on or off. When cache TTL is configured gpg-agent is restarted to pick it up (and
+// again to drop extended TTL), so passphrases cached so far are forgotten.
+func (a *Agent) SetBatch(on bool) error {
+	if a.batch.on() == on {
+		return nil
+	}
+	if on {
+		a.batch.start(func() {
+			log.Print("Batch signing mode has expired")
+			if err := a.SetBatch(false); err != nil {
+				log.Printf("Unable to turn batch signing mode off: %s", err)
+			}
+		})
+		log.Print("Batch signing mode is on")
+	} else {
+		a.batch.stop()
+		for _, c := range a.conns {
+			if c != nil {
+				c.pool.drop()
+			}
+		}
+		bs := a.batch.snapshot()
+		log.Printf("Batch signing mode is off: %s", bs.String())
+		if bs.Suppressed > 0 {
+			notify.Notify(notify.KeyUsed, "Batch signing", fmt.Sprintf("%d signatures made in batch mode, %d notifications suppressed", bs.Signs, bs.Suppressed),
+				"signatures", strconv.FormatInt(bs.Signs, 10))
+		}
+	}
+	a.batch.mu.Lock()
+	report := a.batch.report
+	a.batch.mu.Unlock()
+	if report != nil {
+		report(on)
+	}
+	if a.batch.cacheTTL <= 0 || a.fake != nil || a.cmd == nil {
+		return nil
+	}
+	return a.Restart()
+}
+
+// OnBatch sets function called when batch signing mode is turned on or off.
+func (a *Agent) OnBatch(f func(on bool)) {
+	a.batch.mu.Lock()
+	defer a.batch.mu.Unlock()
+	a.batch.report = f
+}
+
+// Batch returns state of batch signing mode.
+func (a *Agent) Batch() BatchStats {
+	return a.batch.snapshot()
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+)
+
+// cardSlots names OpenPGP card key slots in order of their numbers.
+var cardSlots = [3]string{"Signature", "Encryption", "Authentication"}
+
+// CardKey is key slot of OpenPGP card.
+type CardKey struct {
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Keygrip     string    `json:"keygrip,omitempty"`
+	Created     time.Time `json:"created,omitempty"`
+}
+
+// CardInfo is state of OpenPGP card as scdaemon reports it.
+type CardInfo struct {
+	Serial       string     `json:"serialno"`
+	AppType      string     `json:"apptype,omitempty"`
+	Reader       string     `json:"reader,omitempty"`
+	Manufacturer string     `json:"manufacturer,omitempty"`
+	Holder       string     `json:"holder,omitempty"`
+	Language     string     `json:"language,omitempty"`
+	URL          string     `json:"url,omitempty"`
+	Login        string     `json:"login,omitempty"`
+	Signatures   int        `json:"signatures"`
+	Keys         [3]CardKey `json:"keys"`
+	// remaining attempts for PIN, reset code and admin PIN
+	Retries [3]int `json:"retries"`
+}
+
+// unescapeStatus decodes status line value: '+' stands for space, the rest is percent-encoded.
+func unescapeStatus(s string) string {
+	if v, err := common.UnescapeParameters(strings.ReplaceAll(s, "+", " ")); err == nil {
+		return v
+	}
+	return s
+}
+
+// cardHolder makes readable name from ISO 7501-1 form card keeps it in: "Surname<<Given<Names".
+func cardHolder(name string) string {
+	if i := strings.Index(name, "<<"); i >= 0 {
+		name = name[i+2:] + " " + name[:i]
+	}
+	return strings.TrimSpace(strings.ReplaceAll(name, "<", " "))
+}
+
+// cardSlot converts key reference ("1" or "OPENPGP.1") to slot index.
+func cardSlot(ref string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(ref, "OPENPGP."))
+	if err != nil || n < 1 || n > len(cardSlots) {
+		return 0, false
+	}
+	return n - 1, true
+}
+
+// status records single status line of LEARN.
+func (ci *CardInfo) status(keyword, params string) {
+	f := strings.Fields(params)
+	value := func(i int) string {
+		if i < len(f) {
+			return unescapeStatus(f[i])
+		}
+		return ""
+	}
+	switch keyword {
+	case "SERIALNO":
+		ci.Serial = value(0)
+	case "APPTYPE":
+		ci.AppType = value(0)
+	case "READER":
+		ci.Reader = unescapeStatus(params)
+	case "MANUFACTURER":
+		// numeric id and name
+		ci.Manufacturer = unescapeStatus(strings.TrimSpace(strings.TrimPrefix(params, value(0))))
+	case "DISP-NAME":
+		ci.Holder = cardHolder(value(0))
+	case "DISP-LANG":
+		ci.Language = value(0)
+	case "PUBKEY-URL":
+		ci.URL = value(0)
+	case "LOGIN-DATA":
+		ci.Login = value(0)
+	case "SIG-COUNTER":
+		ci.Signatures, _ = strconv.Atoi(value(0))
+	case "KEY-FPR":
+		if i, ok := cardSlot(value(0)); ok {
+			ci.Keys[i].Fingerprint = strings.ToUpper(value(1))
+		}
+	case "KEY-TIME":
+		if i, ok := cardSlot(value(0)); ok {
+			if ts, err := strconv.ParseInt(value(1), 10, 64); err == nil && ts > 0 {
+				ci.Keys[i].Created = time.Unix(ts, 0)
+			}
+		}
+	case "KEYPAIRINFO":
+		if i, ok := cardSlot(value(1)); ok {
+			ci.Keys[i].Keygrip = value(0)
+		}
+	case "CHV-STATUS":
+		// cached flag, maximum lengths of three PINs, then their retry counters
+		v := strings.Fields(unescapeStatus(params))
+		for i := range ci.Retries {
+			if len(v) > 4+i {
+				ci.Retries[i], _ = strconv.Atoi(v[4+i])
+			}
+		}
+	default:
+	}
+}
+
+func (ci *CardInfo) String() string {
+	var buf strings.Builder
+	line := func(name, value string) {
+		if len(value) == 0 {
+			value = "[not set]"
+		}
+		fmt.Fprintf(&buf, "%-20s%s\r\n", name+":", value)
+	}
+	if len(ci.Reader) > 0 {
+		line("Reader", ci.Reader)
+	}
+	line("Application", ci.AppType)
+	line("Serial number", ci.Serial)
+	line("Manufacturer", ci.Manufacturer)
+	line("Card holder", ci.Holder)
+	line("Language", ci.Language)
+	line("Login data", ci.Login)
+	line("Public key URL", ci.URL)
+	line("Signature counter", strconv.Itoa(ci.Signatures))
+	line("PIN retries", fmt.Sprintf("PIN %d, reset code %d, admin PIN %d", ci.Retries[0], ci.Retries[1], ci.Retries[2]))
+	for i, k := range ci.Keys {
+		buf.WriteString("\r\n")
+		line(cardSlots[i]+" key", k.Fingerprint)
+		if len(k.Fingerprint) > 0 {
+			line("  keygrip", k.Keygrip)
+			if !k.Created.IsZero() {
+				line("  created", k.Created.Format("2006-01-02 15:04:05"))
+			}
+		}
+	}
+	return buf.String()
+}
+
+// Card asks scdaemon (through gpg-agent) about inserted OpenPGP card.
+func (a *Agent) Card() (*CardInfo, error) {
+	ci := &CardInfo{}
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	if err := sendAssuanCmd(sockPath,
+		func(ses *client.Session) error {
+			ses.Pipe.OnStatus(ci.status)
+			defer ses.Pipe.OnStatus(nil)
+			if _, err := ses.SimpleCmd("SCD", "SERIALNO"); err != nil {
+				return fmt.Errorf("unable to access card: %w", err)
+			}
+			if _, err := ses.SimpleCmd("SCD", "LEARN --force"); err != nil {
+				return fmt.Errorf("unable to send SCD LEARN on \"%s\": %w", sockPath, err)
+			}
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+	if len(ci.Serial) == 0 {
+		return nil, errors.New("card did not report serial number")
+	}
+	return ci, nil
+}
+
+// LearnCard makes gpg-agent create key stubs for inserted card, it is needed after card was replaced.
+func (a *Agent) LearnCard() error {
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	return sendAssuanCmd(sockPath,
+		func(ses *client.Session) error {
+			if _, err := ses.SimpleCmd("SCD", "SERIALNO"); err != nil {
+				return fmt.Errorf("unable to access card: %w", err)
+			}
+			if _, err := ses.SimpleCmd("LEARN", "--force"); err != nil {
+				return fmt.Errorf("unable to send LEARN on \"%s\": %w", sockPath, err)
+			}
+			log.Print("Card keys are learned")
+			return nil
+		},
+	)
+}
+
+// ChangeCardPIN changes card PIN (or admin PIN) with gpg --card-edit, PINs are asked by pinentry.
+func (a *Agent) ChangeCardPIN(admin bool) error {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	// answers to card-edit prompts: without admin mode passwd changes PIN directly, with it there is menu
+	commands := "passwd\nquit\n"
+	if admin {
+		commands = "admin\npasswd\n3\nq\nquit\n"
+	}
+	cmd := exec.Command(filepath.Join(filepath.Dir(a.Exe), "gpg.exe"), "--homedir", a.Cfg.GPG.Home,
+		"--no-tty", "--command-fd", "0", "--status-fd", "1", "--card-edit")
+	cmd.Stdin = strings.NewReader(commands)
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to change PIN: %w", err)
+	}
+	// gpg reports failures with status lines and keeps going
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(l, "[GNUPG:] SC_OP_FAILURE") {
+			return fmt.Errorf("unable to change PIN: %s", strings.TrimSpace(strings.TrimPrefix(l, "[GNUPG:] ")))
+		}
+	}
+	if admin {
+		log.Print("Card admin PIN is changed")
+	} else {
+		log.Print("Card PIN is changed")
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// ClientInfo describes local process on the other side of connection.
+type ClientInfo struct {
+	PID       uint32 `json:"pid"`
+	Image     string `json:"image,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+}
+
+func (ci *ClientInfo) String() string {
+	if ci == nil {
+		return "remote client"
+	}
+	if len(ci.Image) == 0 {
+		return fmt.Sprintf("pid %d", ci.PID)
+	}
+	return fmt.Sprintf("%s (pid %d)", ci.Image, ci.PID)
+}
+
+type signature struct {
+	size      int64
+	modTime   time.Time
+	publisher string
+	err       error
+}
+
+// signatures caches Authenticode verification results until executable changes.
+var signatures = struct {
+	sync.Mutex
+	m map[string]signature
+}{m: make(map[string]signature)}
+
+// publisher verifies Authenticode signature of executable and returns its signer.
+func publisher(image string) (string, error) {
+	fi, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+
+	signatures.Lock()
+	sig, ok := signatures.m[image]
+	signatures.Unlock()
+	if ok && sig.size == fi.Size() && sig.modTime.Equal(fi.ModTime()) {
+		return sig.publisher, sig.err
+	}
+
+	sig = signature{size: fi.Size(), modTime: fi.ModTime()}
+	var s *util.Signature
+	if s, sig.err = util.VerifyAuthenticode(image); sig.err == nil {
+		sig.publisher = s.Publisher
+	}
+
+	signatures.Lock()
+	signatures.m[image] = sig
+	signatures.Unlock()
+	return sig.publisher, sig.err
+}
+
+// matchImage checks executable path against list of base names or full path patterns (case insensitive).
+func matchImage(patterns []string, image string) bool {
+	base := strings.ToLower(filepath.Base(image))
+	full := strings.ToLower(filepath.Clean(image))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		name := base
+		if strings.ContainsAny(pattern, `\/`) {
+			name, pattern = full, filepath.Clean(pattern)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPublisher verifies client signature against list of trusted publishers.
+func matchPublisher(publishers []string, ci *ClientInfo) (bool, error) {
+	if len(ci.Publisher) == 0 {
+		pub, err := publisher(ci.Image)
+		if err != nil {
+			return false, fmt.Errorf("unable to verify signature of %s: %w", ci, err)
+		}
+		ci.Publisher = pub
+	}
+	for _, pub := range publishers {
+		if strings.EqualFold(pub, ci.Publisher) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clientPolicy enforces process allow-list and optionally checks Authenticode signature of connecting process, so
+// renamed binary could not impersonate allowed one.
+type clientPolicy struct {
+	allow        []string
+	publishers   []string
+	allowUnknown bool
+}
+
+func newClientPolicy(cfg *config.ClientsConfig) *clientPolicy {
+	if len(cfg.Allow) == 0 && len(cfg.Publishers) == 0 {
+		return nil
+	}
+	return &clientPolicy{
+		allow:        cfg.Allow,
+		publishers:   cfg.Publishers,
+		allowUnknown: cfg.AllowUnknown,
+	}
+}
+
+// identify finds process on the other side of connection.
+func identify(conn net.Conn) (*ClientInfo, error) {
+	pid, err := util.PeerPID(conn)
+	if err != nil {
+		return nil, err
+	}
+	ci := &ClientInfo{PID: pid}
+	if ci.Image, err = util.ProcessImage(pid); err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// check returns nil if client is allowed to use agent.
+func (p *clientPolicy) check(ci *ClientInfo) error {
+	if len(p.allow) > 0 && !matchImage(p.allow, ci.Image) {
+		return fmt.Errorf("%s is not in the allowed clients list", ci)
+	}
+	if len(p.publishers) == 0 {
+		return nil
+	}
+	ok, err := matchPublisher(p.publishers, ci)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is signed by \"%s\" who is not trusted", ci, ci.Publisher)
+	}
+	return nil
+}
+
+// isRemote reports connections which are not coming from local processes, they are protected by other means.
+func (c *Connector) isRemote(conn net.Conn) bool {
+	switch c.index {
+	case ConnectorNoise, ConnectorHvsockSSH, ConnectorHvsockExtra:
+		return true
+	default:
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return !addr.IP.IsLoopback()
+	}
+	return false
+}
+
+// remoteKeyUse reports if key operations on connection should be treated as coming from another machine: remote peers
+// and everybody on extra socket connectors, which exist to be forwarded (ssh RemoteForward, socat over Hyper-V).
+func (c *Connector) remoteKeyUse(conn net.Conn) bool {
+	switch c.index {
+	case ConnectorSockAgentExtra, ConnectorExtraPort, ConnectorHvsockExtra:
+		return true
+	default:
+	}
+	return c.isRemote(conn)
+}
+
+// admit rejects local peers running as other users and checks connecting process against client allow-list and
+// access policy. It returns identified local client (nil for remote connections or if there is nothing to check and
+// pinentry may not use client console).
+func (c *Connector) admit(conn net.Conn) (*ClientInfo, bool) {
+	if err := util.CheckPeerOwner(conn); err != nil && !util.IsPeerUnknown(err) {
+		log.Printf("Rejecting client on %s: %s", c.index, err)
+		c.denied(err)
+		return nil, false
+	}
+	p := c.policy.get()
+	if p == nil {
+		if strings.EqualFold(c.tty, "never") || c.isRemote(conn) {
+			return nil, true
+		}
+		// wantsTTY needs client process even when nothing is checked
+		ci, err := identify(conn)
+		if err != nil {
+			log.Printf("Unable to identify client on %s: %s", c.index, err)
+			return nil, true
+		}
+		return ci, true
+	}
+	var ci *ClientInfo
+	if !c.isRemote(conn) {
+		var err error
+		if ci, err = identify(conn); err != nil {
+			if p.clients != nil && !p.clients.allowUnknown {
+				c.denied(fmt.Errorf("unable to identify client: %w", err))
+				return nil, false
+			}
+			log.Printf("Unable to identify client on %s: %s", c.index, err)
+		}
+	}
+	if p.clients != nil && ci != nil {
+		if err := p.clients.check(ci); err != nil {
+			log.Printf("Rejecting client on %s: %s", c.index, err)
+			c.denied(err)
+			return nil, false
+		}
+	}
+	if act, rule, _ := p.decide(&request{connector: c.index, client: ci, op: "connect"}, time.Now()); act == actionDeny {
+		err := fmt.Errorf("connection from %s denied by policy rule \"%s\"", ci, rule)
+		log.Printf("Rejecting client on %s: %s", c.index, err)
+		c.denied(err)
+		return nil, false
+	}
+	return ci, true
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// loopbackPair returns accepted end of loopback TCP connection dialed by this process.
+func loopbackPair(t *testing.T) (accepted, dialed net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if dialed, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if accepted, err = l.Accept(); err != nil {
+		dialed.Close()
+		t.Fatal(err)
+	}
+	return accepted, dialed
+}
+
+func TestAdmitIdentifiesClientWithoutPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		tty string
+		ci  bool
+	}{
+		{"never", false},
+		{"auto", true},
+		{"always", true},
+	} {
+		t.Run(tc.tty, func(t *testing.T) {
+			conn, peer := loopbackPair(t)
+			defer conn.Close()
+			defer peer.Close()
+
+			// test process is the client, its console is the one pinentry would use
+			c := NewConnector(ConnectorSockAgent, "", "", "", new(int32), nil)
+			c.tty = tc.tty
+			ci, ok := c.admit(conn)
+			if !ok {
+				t.Fatal("client rejected")
+			}
+			if (ci != nil) != tc.ci {
+				t.Fatalf("client identified %t, expected %t", ci != nil, tc.ci)
+			}
+			if ci == nil {
+				return
+			}
+			if ci.PID != uint32(os.Getpid()) {
+				t.Fatalf("client pid %d, expected %d", ci.PID, os.Getpid())
+			}
+			if tc.tty != "always" {
+				return
+			}
+			if !c.wantsTTY(ci) {
+				t.Fatal("TTY is not used for identified client")
+			}
+
+			agent, upstream := net.Pipe()
+			defer agent.Close()
+			lines := make(chan string, 1)
+			go func() {
+				defer upstream.Close()
+				line, _ := bufio.NewReader(upstream).ReadString('\n')
+				lines <- line
+				_, _ = io.WriteString(upstream, "OK\n")
+			}()
+			if err := c.announceTTY(1, agent, ci.PID); err != nil {
+				t.Fatal(err)
+			}
+			if line, expected := <-lines, fmt.Sprintf("OPTION ttyname=%s%d\n", TTYPrefix, ci.PID); line != expected {
+				t.Fatalf("announced %q, expected %q", line, expected)
+			}
+		})
+	}
+}
@@ -1,16 +1,20 @@
 package agent
 
 import (
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,7 +25,10 @@ import (
 	"golang.org/x/sys/windows"
 
 	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/noise"
+	"github.com/rupor-github/win-gpg-agent/trace"
 	"github.com/rupor-github/win-gpg-agent/util"
+	"github.com/rupor-github/win-gpg-agent/websocket"
 )
 
 // ConnectorType to define what we support.
@@ -37,6 +44,11 @@ const (
 	ConnectorSockAgentCygwinSSH
 	ConnectorExtraPort
 	ConnectorXShell
+	ConnectorHvsockSSH
+	ConnectorHvsockExtra
+	ConnectorNoise
+	ConnectorWebSocket
+	ConnectorSockDirmngr
 	maxConnector
 )
 
@@ -58,6 +70,16 @@ func (ct ConnectorType) String() string {
 		return "gpg-agent extra socket on local port"
 	case ConnectorXShell:
 		return "xagent protocol socket"
+	case ConnectorHvsockSSH:
+		return "ssh-agent Hyper-V socket"
+	case ConnectorHvsockExtra:
+		return "gpg-agent extra Hyper-V socket"
+	case ConnectorNoise:
+		return "noise encrypted remote transport"
+	case ConnectorWebSocket:
+		return "ssh-agent WebSocket bridge"
+	case ConnectorSockDirmngr:
+		return "dirmngr socket"
 	default:
 	}
 	return fmt.Sprintf("unknown connector type %d", ct)
@@ -70,9 +92,42 @@ type Connector struct {
 	pathGUI  string
 	name     string
 	locked   *int32
+	bind     []string
+	port     int
+	kp       *noise.KeyPair
+	peers    map[[32]byte]bool
+	origins  []string
+	token    string
 	wg       *sync.WaitGroup
 	listener net.Listener
 	xa       io.Closer
+	stats    connStats
+	policy   *policyRef
+	// principals allowed to connect from other machines, if set Negotiate authentication is required
+	principals []string
+	// launch starts upstream server if it is not running yet (dirmngr is started on demand)
+	launch func() error
+	// lost tells agent upstream could not be dialed, it may have been restarted underneath us
+	lost func()
+	// when pinentry should use terminal of the client, see config.PinentryConfig
+	tty string
+	// passphrases for keys gpg-agent uses without pinentry
+	loopback *loopbackStore
+	batch    *batchMode
+	// key operations are denied while it is closed
+	unlock *unlockWindow
+	// authenticated gpg-agent connections, nil if connector dials upstream for every client
+	pool *upstreamPool
+	// dial attempts repeated when GnuPG home is on network share
+	retries    int
+	retryDelay time.Duration
+	// number of clients served at once, nil if connector is not limited
+	limit *slots
+	// named pipe creation parameters and admission checks
+	pipe pipeOptions
+	// Cygwin socket nonce and how often it is replaced
+	nonce    *util.CygwinNonce
+	nonceTTL time.Duration
 }
 
 // NewConnector initializes Connector of particular ConnectorType.
@@ -98,21 +153,32 @@ func (c *Connector) Close() {
 		}
 	}
 
+	c.pool.close()
+	if c.nonce != nil {
+		c.nonce.Stop()
+	}
+
 	if c.index == ConnectorXShell && c.xa != nil {
 		if err := c.xa.Close(); err != nil {
 			log.Printf("Error closing connector for %s: %s", c.index, err)
 		}
 	}
-	if c.index != ConnectorPipeSSH && c.index != ConnectorExtraPort && c.index != ConnectorXShell && len(c.PathGUI()) != 0 {
+	if c.index != ConnectorPipeSSH && c.index != ConnectorExtraPort && c.index != ConnectorXShell &&
+		c.index != ConnectorHvsockSSH && c.index != ConnectorHvsockExtra && c.index != ConnectorNoise && c.index != ConnectorWebSocket && len(c.PathGUI()) != 0 {
 		if err := os.Remove(c.PathGUI()); err != nil {
 			log.Printf("Error closing connector for %s: %s", c.index, err.Error())
 		}
 	}
 }
 
-// PathGPG returns path to gpg socket being served.
+// PathGPG returns path to gpg socket being served. When socket file in GnuPG home is libassuan redirection (socketdir
+// moved elsewhere) path it points to is returned.
 func (c *Connector) PathGPG() string {
-	return filepath.Join(c.pathGPG, c.name)
+	fn, err := client.Redirect(filepath.Join(c.pathGPG, c.name))
+	if err != nil {
+		log.Printf("Unable to follow socket redirection: %s", err)
+	}
+	return fn
 }
 
 // PathGUI returns path to unix socket being served.
@@ -141,6 +207,8 @@ func (c *Connector) Serve(deadline time.Duration) error {
 	case ConnectorSockAgent:
 		fallthrough
 	case ConnectorSockAgentExtra:
+		fallthrough
+	case ConnectorSockDirmngr:
 		return c.serveAssuanSocket(deadline)
 	case ConnectorSockAgentSSH:
 		return c.serveSSHSocket()
@@ -152,13 +220,21 @@ func (c *Connector) Serve(deadline time.Duration) error {
 		return c.serveExtraPortSocket(deadline)
 	case ConnectorXShell:
 		return c.serveXAgentSocket()
+	case ConnectorHvsockSSH:
+		fallthrough
+	case ConnectorHvsockExtra:
+		return c.serveHvsock(deadline)
+	case ConnectorNoise:
+		return c.serveNoise(deadline)
+	case ConnectorWebSocket:
+		return c.serveWebSocket()
 	default:
 	}
 	log.Printf("Connector for %s is not supported", c.index)
 	return nil
 }
 
-func (c *Connector) handleAssuanRequest(socketName string, conn net.Conn, deadline time.Duration) {
+func (c *Connector) handleAssuanRequest(socketName string, conn net.Conn, ci *ClientInfo, deadline time.Duration) {
 
 	defer c.wg.Done()
 	defer conn.Close()
@@ -166,66 +242,158 @@ func (c *Connector) handleAssuanRequest(socketName string, conn net.Conn, deadli
 	id := time.Now().UnixNano() // create unique id for debug tracing
 	log.Printf("[%d] Accepted request from %s", id, socketName)
 
+	span := trace.Start("assuan connection", "connector", c.index.String(), "client", ci.String())
+	var failure error
+	defer func() { span.End(failure) }()
+
+	release, err := c.admitConcurrent(id)
+	if err != nil {
+		log.Printf("[%d] Rejecting request: %s", id, err.Error())
+		c.stats.fail(err)
+		failure = err
+		return
+	}
+	defer release()
+
 	socketNameAssuan := c.PathGPG()
-	connAssuan, err := client.Dial(socketNameAssuan)
+	tty := c.wantsTTY(ci)
+	// client talks to session until it is known which gpg-agent connection carries options it wants
+	deferred := !tty && c.pool.deferred()
+	var (
+		connAssuan net.Conn
+		greeting   []byte
+	)
+	dial := span.Upstream("connect to gpg-agent", "pooled", strconv.FormatBool(c.pool != nil))
+	if deferred {
+		greeting, err = c.pool.reserve(id)
+	} else {
+		connAssuan, greeting, err = c.upstream(id)
+	}
+	dial.End(err)
 	if err != nil {
 		log.Printf("[%d] Unable to dial assuan socket \"%s\": %s", id, socketNameAssuan, err.Error())
+		c.stats.fail(err)
+		failure = err
+		return
 	}
 
-	c.wg.Add(1)
-	go func() {
-		defer c.wg.Done()
-		defer connAssuan.Close()
-		log.Printf("[%d] Copying from %s to %s", id, socketName, socketNameAssuan)
-		for c.locked == nil || atomic.LoadInt32(c.locked) == 0 {
-			if deadline != 0 {
-				_ = conn.SetDeadline(time.Now().Add(deadline))
-			}
-			l, err := io.Copy(connAssuan, conn)
-			if err != nil {
-				if errors.Is(err, os.ErrDeadlineExceeded) {
-					if l > 0 {
-						log.Printf("[%d] Copied from %s to %s - %d bytes, continuing", id, socketName, socketNameAssuan, l)
-						continue
-					}
-					log.Printf("[%d] No activity on connection from %s to %s, exiting", id, socketName, socketNameAssuan)
-					return
-				}
-				if !util.IsNetClosing(err) {
-					log.Printf("[%d] Error copying from %s to %s - %d: %s", id, socketName, socketNameAssuan, l, err.Error())
-					return
-				}
-			}
-			log.Printf("[%d] Copied from %s to %s - %d bytes", id, socketName, socketNameAssuan, l)
+	if tty {
+		if err := c.announceTTY(id, connAssuan, ci.PID); err != nil {
+			log.Printf("[%d] %s", id, err.Error())
+			connAssuan.Close()
+			c.done(id, nil, nil)
+			c.stats.fail(err)
+			failure = err
 			return
 		}
-		log.Print("Session is locked")
-	}()
-
-	log.Printf("[%d] Copying from %s to %s", id, socketNameAssuan, socketName)
-	for c.locked == nil || atomic.LoadInt32(c.locked) == 0 {
-		if deadline != 0 {
-			_ = connAssuan.SetDeadline(time.Now().Add(deadline))
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		log.Printf("[%d] Unable to send greeting: %s", id, err.Error())
+		if connAssuan != nil {
+			connAssuan.Close()
 		}
-		l, err := io.Copy(conn, connAssuan)
-		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
-				if l > 0 {
-					log.Printf("[%d] Copied from %s to %s - %d bytes, continuing", id, socketNameAssuan, socketName, l)
-					continue
-				}
-				log.Printf("[%d] No activity on connection from %s to %s, exiting", id, socketNameAssuan, socketName)
-				return
+		c.done(id, nil, nil)
+		return
+	}
+
+	toAgent := &lockedWriter{w: connAssuan}
+	session := c.newAssuanSession(id, ci, c.remoteKeyUse(conn), toAgent, span)
+
+	var detached int32
+	done := make(chan struct{})
+	relayAgent := func() {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer close(done)
+			log.Printf("[%d] Copying from %s to %s", id, socketNameAssuan, socketName)
+			l, err := c.relayAssuan(connAssuan, conn, deadline, session.agentLine)
+			if atomic.LoadInt32(&detached) == 0 {
+				conn.Close()
+				c.logRelay(id, socketNameAssuan, socketName, l, err)
 			}
-			if !util.IsNetClosing(err) {
-				log.Printf("[%d] Error copying from %s to %s - %d: %s", id, socketNameAssuan, socketName, l, err.Error())
-				return
+		}()
+	}
+	if deferred {
+		session.known = c.pool.known
+		// called from client relay below, so connAssuan is only set by this goroutine
+		session.bind = func(options []string) error {
+			bound, _, err := c.pool.bind(id, options)
+			if err != nil {
+				c.stats.fail(err)
+				failure = err
+				conn.Close()
+				return err
 			}
+			connAssuan = bound
+			toAgent.set(bound)
+			relayAgent()
+			return nil
 		}
-		log.Printf("[%d] Copied from %s to %s - %d bytes", id, socketNameAssuan, socketName, l)
+	} else {
+		relayAgent()
+	}
+
+	log.Printf("[%d] Copying from %s to %s", id, socketName, socketNameAssuan)
+	l, err := c.relayAssuan(conn, toAgent, deadline, func(line []byte) bool { return session.clientLine(line, conn) })
+	c.logRelay(id, socketName, socketNameAssuan, l, err)
+
+	if connAssuan == nil {
+		// client left before sending any command
+		c.done(id, nil, nil)
+		return
+	}
+	if err == nil && c.keepUpstream(session, tty) {
+		atomic.StoreInt32(&detached, 1)
+		interruptRead(connAssuan, done)
+		c.done(id, connAssuan, session.optionSet())
+		return
+	}
+	connAssuan.Close()
+	<-done
+	c.done(id, nil, nil)
+}
+
+// keepUpstream tells if gpg-agent connection could go back to the pool when client is done. Options client has set
+// are remembered with connection, ttyname we announced is not, so such connection is never reused.
+func (c *Connector) keepUpstream(session *assuanSession, tty bool) bool {
+	return !tty && session.reusable() && c.pool.reusable()
+}
+
+// upstream returns connection to gpg-agent and its greeting, from the pool if connector has one.
+func (c *Connector) upstream(id int64) (net.Conn, []byte, error) {
+	if c.pool != nil {
+		return c.pool.get(id)
+	}
+	return dialGreeting(id, c.dialAssuan)
+}
+
+// done returns connection with options client has set to the pool or closes it, nil conn means it is closed already.
+func (c *Connector) done(id int64, conn net.Conn, options []string) {
+	if c.pool != nil {
+		c.pool.put(id, conn, options)
 		return
 	}
-	log.Print("Session is locked")
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// logRelay reports how relaying of one direction of Assuan connection ended.
+func (c *Connector) logRelay(id int64, from, to string, l int64, err error) {
+	switch {
+	case err == nil:
+		log.Printf("[%d] Copied from %s to %s - %d bytes", id, from, to, l)
+	case errors.Is(err, errSessionLocked):
+		log.Print("Session is locked")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("[%d] No activity on connection from %s to %s after %d bytes, exiting", id, from, to, l)
+	case util.IsNetClosing(err):
+		log.Printf("[%d] Copied from %s to %s - %d bytes (closed)", id, from, to, l)
+	default:
+		log.Printf("[%d] Error copying from %s to %s - %d: %s", id, from, to, l, err.Error())
+		c.stats.fail(err)
+	}
 }
 
 func (c *Connector) serveAssuanSocket(deadline time.Duration) error {
@@ -256,12 +424,18 @@ func (c *Connector) serveAssuanSocket(deadline time.Duration) error {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !util.IsNetClosing(err) {
-					log.Printf("Quiting - unable to serve on unix socket: %s", err.Error())
+					c.failed(fmt.Errorf("unable to serve on unix socket: %w", err))
 				}
 				return
 			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
 			c.wg.Add(1)
-			go c.handleAssuanRequest(socketName, conn, deadline)
+			go c.handleAssuanRequest(socketName, conn, ci, deadline)
 		}
 	}()
 	return nil
@@ -275,11 +449,11 @@ func (c *Connector) serveExtraPortSocket(deadline time.Duration) error {
 
 	var err error
 
-	socketName := c.pathGUI
-	c.listener, err = net.Listen("tcp", socketName)
+	c.listener, err = util.ListenTCP(c.bind, c.port)
 	if err != nil {
-		return fmt.Errorf("could not open socket %s: %w", socketName, err)
+		return fmt.Errorf("could not open socket for %s: %w", c.index, err)
 	}
+	socketName := util.ListenerAddrs(c.listener)
 
 	go func() {
 		log.Printf("Serving %s on %s", c.index, socketName)
@@ -287,17 +461,56 @@ func (c *Connector) serveExtraPortSocket(deadline time.Duration) error {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !util.IsNetClosing(err) {
-					log.Printf("Quiting - unable to serve on TCP socket: %s", err.Error())
+					c.failed(fmt.Errorf("unable to serve on TCP socket: %w", err))
 				}
 				return
 			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
 			c.wg.Add(1)
-			go c.handleAssuanRequest(socketName, conn, deadline)
+			go func() {
+				if len(c.principals) > 0 && c.isRemote(conn) {
+					if err := c.authenticate(conn); err != nil {
+						c.wg.Done()
+						conn.Close()
+						log.Printf("Rejecting connection from %s: %s", conn.RemoteAddr(), err)
+						c.denied(err)
+						return
+					}
+				}
+				c.handleAssuanRequest(socketName, conn, ci, deadline)
+			}()
 		}
 	}()
 	return nil
 }
 
+// authenticate performs Negotiate (Kerberos or NTLM) authentication of remote client and checks that it is one of
+// allowed principals.
+func (c *Connector) authenticate(conn net.Conn) error {
+	const handshakeTimeout = 30 * time.Second
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) //nolint:errcheck
+
+	name, err := util.SSPIAccept(conn)
+	if err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	for _, p := range c.principals {
+		if strings.EqualFold(p, name) {
+			log.Printf("Authenticated %s from %s", name, conn.RemoteAddr())
+			return util.SSPIVerdict(conn, true)
+		}
+	}
+	_ = util.SSPIVerdict(conn, false)
+	return fmt.Errorf("%s is not allowed to connect", name)
+}
+
 func (c *Connector) serveSSHPipe() error {
 
 	if c == nil || len(c.name) == 0 {
@@ -305,7 +518,10 @@ func (c *Connector) serveSSHPipe() error {
 	}
 
 	var err error
-	cfg := &winio.PipeConfig{}
+	cfg := &winio.PipeConfig{
+		InputBufferSize:  c.pipe.inBuffer,
+		OutputBufferSize: c.pipe.outBuffer,
+	}
 	c.listener, err = winio.ListenPipe(c.Name(), cfg)
 	if err != nil {
 		return fmt.Errorf("unable to listen on pipe %s: %w", c.Name(), err)
@@ -317,18 +533,33 @@ func (c *Connector) serveSSHPipe() error {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !errors.Is(err, winio.ErrPipeListenerClosed) {
-					log.Printf("Quiting - unable to serve on named pipe: %s", err)
+					c.failed(fmt.Errorf("unable to serve on named pipe: %w", err))
 				}
 				return
 			}
+			if err := c.pipe.admit(conn); err != nil {
+				log.Printf("Rejecting client on %s: %s", c.index, err)
+				c.denied(err)
+				conn.Close()
+				continue
+			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				c.pipe.release()
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
 			c.wg.Add(1)
 			go func() {
 				defer c.wg.Done()
+				defer c.pipe.release()
 				defer conn.Close()
 				id := time.Now().UnixNano() // create unique id for debug tracing
 				log.Printf("[%d] Accepted request from %s", id, c.Name())
-				if err := serveSSH(id, conn, c.locked); err != nil {
+				if err := c.serveSSH(id, conn, ci); err != nil {
 					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
 				}
 			}()
 		}
@@ -364,18 +595,25 @@ func (c *Connector) serveSSHSocket() error {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !util.IsNetClosing(err) {
-					log.Printf("Quiting - unable to serve on unix socket: %s", err)
+					c.failed(fmt.Errorf("unable to serve on unix socket: %w", err))
 				}
 				return
 			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
 			c.wg.Add(1)
 			go func() {
 				defer c.wg.Done()
 				defer conn.Close()
 				id := time.Now().UnixNano() // create unique id for debug tracing
 				log.Printf("[%d] Accepted request from %s", id, socketName)
-				if err := serveSSH(id, conn, c.locked); err != nil {
+				if err := c.serveSSH(id, conn, ci); err != nil {
 					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
 				}
 			}()
 		}
@@ -383,6 +621,9 @@ func (c *Connector) serveSSHSocket() error {
 	return nil
 }
 
+// cygwinHandshakeTimeout limits nonce and credentials exchange on Cygwin socket.
+const cygwinHandshakeTimeout = 10 * time.Second
+
 func (c *Connector) serveSSHCygwinSocket() error {
 
 	if c == nil {
@@ -406,32 +647,47 @@ func (c *Connector) serveSSHCygwinSocket() error {
 	}
 
 	port := c.listener.Addr().(*net.TCPAddr).Port
-	nonce, err := util.CygwinCreateSocketFile(socketName, port)
+	nonce, err := util.NewCygwinNonce(socketName, port, c.nonceTTL)
 	if err != nil {
-		return err
+		c.listener.Close()
+		return fmt.Errorf("could not create cygwin socket file: %w", err)
 	}
+	c.nonce = nonce
 
 	go func() {
-		log.Printf("Serving %s on %s:%d with nonce: %s", c.index, socketName, port, util.CygwinNonceString(nonce))
+		log.Printf("Serving %s on %s:%d", c.index, socketName, port)
 		for {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !util.IsNetClosing(err) {
-					log.Printf("Quiting - unable to serve on Cygwin socket: %s", err)
+					c.failed(fmt.Errorf("unable to serve on Cygwin socket: %w", err))
 				}
 				return
 			}
-			if err = util.CygwinPerformHandshake(conn, nonce); err != nil {
-				log.Printf("Unable to perform handshake on Cygwin socket: %s", err)
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
 			}
+			conn = c.stats.track(conn)
 			c.wg.Add(1)
 			go func() {
 				defer c.wg.Done()
 				defer conn.Close()
 				id := time.Now().UnixNano() // create unique id for debug tracing
-				log.Printf("[%d] Accepted request from %s", id, socketName)
-				if err := serveSSH(id, conn, c.locked); err != nil {
+				// slow or silent client should not hold the connection forever
+				_ = conn.SetDeadline(time.Now().Add(cygwinHandshakeTimeout))
+				peer, err := util.CygwinPerformHandshake(conn, nonce)
+				if err != nil {
+					log.Printf("[%d] Rejecting Cygwin handshake from %s (%s): %s", id, conn.RemoteAddr(), ci, err)
+					c.denied(fmt.Errorf("cygwin handshake failed: %w", err))
+					return
+				}
+				_ = conn.SetDeadline(time.Time{})
+				log.Printf("[%d] Accepted request from %s, cygwin pid=%d uid=%d gid=%d", id, socketName, peer.PID, peer.UID, peer.GID)
+				if err := c.serveSSH(id, conn, ci); err != nil {
 					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
 				}
 			}()
 		}
@@ -464,12 +720,19 @@ func (c *Connector) serveXAgentSocket() error {
 			conn, err := c.listener.Accept()
 			if err != nil {
 				if !util.IsNetClosing(err) {
-					log.Printf("Quiting - unable to serve on xagent socket: %s", err)
+					c.failed(fmt.Errorf("unable to serve on xagent socket: %w", err))
 				}
 				return
 			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
 			if err = util.XAgentPerformHandshake(conn, cookie); err != nil {
 				log.Printf("Unable to perform handshake on xagent socket: %s", err)
+				c.denied(err)
 			}
 			c.wg.Add(1)
 			go func() {
@@ -477,8 +740,120 @@ func (c *Connector) serveXAgentSocket() error {
 				defer conn.Close()
 				id := time.Now().UnixNano() // create unique id for debug tracing
 				log.Printf("[%d] Accepted request from %s", id, cookie)
-				if err := serveSSH(id, conn, c.locked); err != nil {
+				if err := c.serveSSH(id, conn, ci); err != nil {
+					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+func (c *Connector) serveHvsock(deadline time.Duration) error {
+
+	if c == nil || c.port <= 0 {
+		return fmt.Errorf("gpg agent has not been initialized properly")
+	}
+
+	addr := &winio.HvsockAddr{VMID: util.HvsockVMID(c.pathGUI), ServiceID: winio.VsockServiceID(uint32(c.port))}
+	if err := util.RegisterHvsockService(addr.ServiceID, fmt.Sprintf("%s %s", util.WinAgentName, c.index)); err != nil {
+		log.Printf("Unable to register Hyper-V socket service %s (administrative rights are required, register it manually): %s", addr.ServiceID, err)
+	}
+
+	var err error
+	c.listener, err = winio.ListenHvsock(addr)
+	if err != nil {
+		return fmt.Errorf("could not open Hyper-V socket %s: %w", addr, err)
+	}
+	socketName := addr.String()
+
+	go func() {
+		log.Printf("Serving %s on %s (vsock port %d)", c.index, socketName, c.port)
+		for {
+			conn, err := c.listener.Accept()
+			if err != nil {
+				if !util.IsNetClosing(err) {
+					c.failed(fmt.Errorf("unable to serve on Hyper-V socket: %w", err))
+				}
+				return
+			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
+			c.wg.Add(1)
+			if c.index == ConnectorHvsockExtra {
+				go c.handleAssuanRequest(socketName, conn, ci, deadline)
+				continue
+			}
+			go func() {
+				defer c.wg.Done()
+				defer conn.Close()
+				id := time.Now().UnixNano() // create unique id for debug tracing
+				log.Printf("[%d] Accepted request from %s", id, conn.RemoteAddr())
+				if err := c.serveSSH(id, conn, ci); err != nil {
+					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+func (c *Connector) serveNoise(deadline time.Duration) error {
+
+	if c == nil || c.kp == nil || c.port <= 0 {
+		return fmt.Errorf("gpg agent has not been initialized properly")
+	}
+
+	var err error
+	c.listener, err = util.ListenTCP(c.bind, c.port)
+	if err != nil {
+		return fmt.Errorf("could not open socket for %s: %w", c.index, err)
+	}
+	socketName := util.ListenerAddrs(c.listener)
+
+	go func() {
+		log.Printf("Serving %s on %s", c.index, socketName)
+		for {
+			conn, err := c.listener.Accept()
+			if err != nil {
+				if !util.IsNetClosing(err) {
+					c.failed(fmt.Errorf("unable to serve on TCP socket: %w", err))
+				}
+				return
+			}
+			ci, ok := c.admit(conn)
+			if !ok {
+				conn.Close()
+				continue
+			}
+			conn = c.stats.track(conn)
+			c.wg.Add(1)
+			go func() {
+				nc, err := noise.Server(conn, c.kp, c.peers)
+				if err != nil {
+					c.wg.Done()
+					conn.Close()
+					log.Printf("Rejecting connection: %s", err)
+					c.denied(err)
+					return
+				}
+				if len(c.name) != 0 {
+					c.handleAssuanRequest(socketName, nc, ci, deadline)
+					return
+				}
+				defer c.wg.Done()
+				defer nc.Close()
+				id := time.Now().UnixNano() // create unique id for debug tracing
+				log.Printf("[%d] Accepted request from %s", id, conn.RemoteAddr())
+				if err := c.serveSSH(id, nc, ci); err != nil {
 					log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+					c.stats.fail(err)
 				}
 			}()
 		}
@@ -486,6 +861,81 @@ func (c *Connector) serveXAgentSocket() error {
 	return nil
 }
 
+// allowOrigin checks browser supplied Origin against configured list. Requests without Origin are coming from
+// non-browser clients and are always allowed, token is still required.
+func (c *Connector) allowOrigin(origin string) bool {
+	if len(origin) == 0 {
+		return true
+	}
+	for _, o := range c.origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Connector) serveWebSocket() error {
+
+	if c == nil || c.port <= 0 || len(c.token) == 0 {
+		return fmt.Errorf("gpg agent has not been initialized properly")
+	}
+
+	var err error
+	c.listener, err = util.ListenTCP([]string{"localhost"}, c.port)
+	if err != nil {
+		return fmt.Errorf("could not open socket for %s: %w", c.index, err)
+	}
+	socketName := util.ListenerAddrs(c.listener)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ssh-agent", func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); !c.allowOrigin(origin) {
+			log.Printf("Rejecting WebSocket request from origin %s", origin)
+			c.denied(fmt.Errorf("origin %s is not allowed", origin))
+			http.Error(w, "origin is not allowed", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(c.token)) != 1 {
+			log.Printf("Rejecting WebSocket request from %s with bad token", r.RemoteAddr)
+			c.denied(fmt.Errorf("bad token from %s", r.RemoteAddr))
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		wc, err := websocket.Upgrade(w, r)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %s", err)
+			c.stats.fail(err)
+			return
+		}
+		ci, ok := c.admit(wc.Conn)
+		if !ok {
+			wc.Close()
+			return
+		}
+		conn := c.stats.track(wc)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer conn.Close()
+			id := time.Now().UnixNano() // create unique id for debug tracing
+			log.Printf("[%d] Accepted request from %s (%s)", id, r.RemoteAddr, r.Header.Get("Origin"))
+			if err := c.serveSSH(id, conn, ci); err != nil {
+				log.Printf("[%d] SSH handler returned error: %s", id, err.Error())
+				c.stats.fail(err)
+			}
+		}()
+	})
+
+	go func() {
+		log.Printf("Serving %s on %s", c.index, socketName)
+		if err := http.Serve(c.listener, mux); err != nil && !util.IsNetClosing(err) {
+			c.failed(fmt.Errorf("unable to serve WebSocket: %w", err))
+		}
+	}()
+	return nil
+}
+
 func makeInheritSaWithSid() *windows.SecurityAttributes {
 	var sa windows.SecurityAttributes
 	u, err := user.Current()
@@ -502,6 +952,12 @@ func makeInheritSaWithSid() *windows.SecurityAttributes {
 
 var mapCounter uint64
 
+// copyBufferSize is size of buffers used to relay Assuan streams.
+const copyBufferSize = 32 * 1024
+
+// sshBackend processes ssh-agent requests, could be replaced (with fake agent for example).
+var sshBackend = queryPageant
+
 func queryPageant(req []byte) ([]byte, error) {
 
 	const (
@@ -535,10 +991,12 @@ func queryPageant(req []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	//nolint:errcheck
-	defer windows.UnmapViewOfFile(sharedMemory)
-
 	sharedMemoryArray := (*[util.MaxAgentMsgLen]byte)(unsafe.Pointer(sharedMemory))
+	defer func() {
+		// requests and responses may have private keys (ssh-add)
+		util.Wipe(sharedMemoryArray[:])
+		_ = windows.UnmapViewOfFile(sharedMemory)
+	}()
 	binary.BigEndian.PutUint32(sharedMemoryArray[:4], uint32(len(req)))
 	copy(sharedMemoryArray[4:], req)
 
@@ -568,13 +1026,31 @@ func queryPageant(req []byte) ([]byte, error) {
 	return result, nil
 }
 
-func serveSSH(id int64, from io.ReadWriter, locked *int32) error {
+func (c *Connector) serveSSH(id int64, from io.ReadWriter, ci *ClientInfo) error {
 
 	const (
 		agentFailure = 5
 		agentSuccess = 6
 	)
 
+	release, err := c.admitConcurrent(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	locked := c.locked
+
+	var remote bool
+	if conn, ok := from.(net.Conn); ok {
+		remote = c.isRemote(conn)
+	}
+
+	session := newSSHSession(ci)
+
+	span := trace.Start("ssh-agent connection", "connector", c.index.String(), "client", ci.String())
+	defer span.End(nil)
+
 	var length [4]byte
 	for {
 		if _, err := io.ReadFull(from, length[:]); err != nil {
@@ -601,14 +1077,33 @@ func serveSSH(id int64, from io.ReadWriter, locked *int32) error {
 			resp []byte
 			err  error
 		)
+		session.bind(req)
+		key, sign := sshSignKey(req)
+		var denied error
 		if locked != nil && atomic.LoadInt32(locked) == 1 {
 			log.Print("Session is locked")
+			denied = errSessionLocked
+		} else if sign {
+			policy := span.Child("policy", "operation", "ssh-sign", "key", key)
+			if denied = c.guardForwarding(ci, session, key); denied == nil {
+				denied = c.authorize(ci, "ssh-sign", key, remote)
+			}
+			policy.End(denied)
+		}
+		if denied != nil {
 			resp = []byte{agentFailure}
 		} else {
-			resp, err = queryPageant(req)
+			if sign {
+				c.sshKeyUsed(key)
+			}
+			start := time.Now()
+			resp, err = sshBackend(req)
+			span.Record(sshRequestName(req[0]), start, err)
 			if err != nil {
 				log.Printf("[%d] Unable to process ssh request via Pageant: %s", id, err.Error())
 				resp = []byte{agentFailure}
+			} else if sign {
+				c.batch.signed(time.Since(start))
 			}
 			if len(resp) > util.MaxAgentMsgLen-4 {
 				return fmt.Errorf("agent: reply too large: %d bytes", len(resp))
@@ -619,10 +1114,14 @@ func serveSSH(id int64, from io.ReadWriter, locked *int32) error {
 		}
 
 		binary.BigEndian.PutUint32(length[:], uint32(len(resp)))
-		if _, err := from.Write(length[:]); err != nil {
-			return err
+		_, err = from.Write(length[:])
+		if err == nil {
+			_, err = from.Write(resp)
 		}
-		if _, err := from.Write(resp); err != nil {
+		// SSH_AGENTC_ADD_IDENTITY carries private key
+		util.Wipe(req)
+		util.Wipe(resp)
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// dialAssuan connects to upstream Assuan socket starting upstream server first if connector knows how to.
+func (c *Connector) dialAssuan(id int64) (net.Conn, error) {
+	conn, err := c.dialRetry(id)
+	if err != nil && c.lost != nil {
+		c.lost()
+	}
+	if err == nil || c.launch == nil {
+		return conn, err
+	}
+	log.Printf("[%d] Unable to dial assuan socket \"%s\", starting %s: %s", id, c.PathGPG(), c.index, err.Error())
+	if err := c.launch(); err != nil {
+		return nil, err
+	}
+	return client.Dial(c.PathGPG())
+}
+
+// dirmngrProbeURL is used to discover proxy for dirmngr - it is default keyserver of modern GnuPG.
+const dirmngrProbeURL = "https://keys.openpgp.org"
+
+// launchDirmngr starts dirmngr the same way gpg does when it needs keyserver access. If proxy is configured dirmngr is
+// started directly, so it could be told which proxy to use.
+func (a *Agent) launchDirmngr() error {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	var cmd *exec.Cmd
+	proxy, err := util.ResolveProxy(a.Cfg.GUI.Proxy.Mode(a.Cfg.GUI.Proxy.Dirmngr), dirmngrProbeURL)
+	if err != nil {
+		log.Printf("Unable to resolve proxy for %s: %s", util.DirmngrName, err)
+	}
+	if proxy != nil {
+		cmd = exec.Command(filepath.Join(filepath.Dir(a.Exe), util.DirmngrName+".exe"), "--homedir", a.Cfg.GPG.Home, "--daemon", "--http-proxy", proxy.String())
+	} else {
+		cmd = exec.Command(filepath.Join(filepath.Dir(a.Exe), "gpgconf.exe"), "--homedir", a.Cfg.GPG.Home, "--launch", util.DirmngrName)
+	}
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	log.Printf("Executing: %s", cmd.String())
+	if proxy != nil {
+		// daemon keeps running, do not wait for its output
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("unable to launch %s: %w", util.DirmngrName, err)
+		}
+		go cmd.Wait() //nolint:errcheck
+	} else if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to launch %s: %w (%s)", util.DirmngrName, err, out)
+	}
+	if sockPath := a.conns[ConnectorSockDirmngr].PathGPG(); !util.WaitForFileArrival(time.Second*5, sockPath) {
+		return fmt.Errorf("unable to access socket: %s", sockPath)
+	}
+	return nil
+}
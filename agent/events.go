@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// sshAgentSignRequest is SSH_AGENTC_SIGN_REQUEST message type.
+const sshAgentSignRequest = 13
+
+// sshRequestName names ssh-agent request type for traces.
+func sshRequestName(t byte) string {
+	switch t {
+	case 11:
+		return "ssh request-identities"
+	case sshAgentSignRequest:
+		return "ssh sign"
+	case 17, 25:
+		return "ssh add-identity"
+	case 18:
+		return "ssh remove-identity"
+	case 27:
+		return "ssh extension"
+	default:
+	}
+	return fmt.Sprintf("ssh request %d", t)
+}
+
+// sshSignKey checks if request is signing request and returns fingerprint of the key.
+func sshSignKey(req []byte) (string, bool) {
+	if len(req) < 5 || req[0] != sshAgentSignRequest {
+		return "", false
+	}
+	key := "unknown key"
+	if l := binary.BigEndian.Uint32(req[1:5]); uint64(l) <= uint64(len(req)-5) {
+		if pk, err := ssh.ParsePublicKey(req[5 : 5+l]); err == nil {
+			key = ssh.FingerprintSHA256(pk)
+		}
+	}
+	return key, true
+}
+
+// sshKeyUsed reports signing request for ssh key.
+func (c *Connector) sshKeyUsed(key string) {
+	c.keyUsed(key)(notify.KeyUsed, "Key used", fmt.Sprintf("ssh key %s was used to sign via %s", key, c.index),
+		"key", key, "connector", c.index.String(), "operation", "ssh-sign")
+}
+
+// assuanKeyUsed reports gpg-agent secret key operation requested by client.
+func (c *Connector) assuanKeyUsed(op, keygrip string) {
+	if len(keygrip) == 0 {
+		keygrip = "unknown key"
+	}
+	c.keyUsed(keygrip)(notify.KeyUsed, "Key used", fmt.Sprintf("key %s was used for %s via %s", keygrip, op, c.index),
+		"key", keygrip, "connector", c.index.String(), "operation", op)
+}
+
+// keyUsed selects how key use is reported, in batch mode repeated uses of the same key are only audited.
+func (c *Connector) keyUsed(key string) func(ev notify.Event, title, text string, kv ...string) {
+	if c.batch.quiet(key) {
+		return notify.Quiet
+	}
+	return notify.Notify
+}
+
+// denied records and reports rejected client.
+func (c *Connector) denied(err error) {
+	c.stats.fail(err)
+	notify.Notify(notify.ClientDenied, "Client denied", fmt.Sprintf("%s: %s", c.index, err), "connector", c.index.String(), "reason", err.Error())
+}
+
+// failed records and reports connector which stopped serving.
+func (c *Connector) failed(err error) {
+	log.Printf("Quiting - %s", err)
+	notify.Notify(notify.ConnectorFailed, "Connector failed", fmt.Sprintf("%s stopped serving: %s", c.index, err), "connector", c.index.String(), "reason", err.Error())
+}
@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+)
+
+// ExpiringKey is signing or authentication (ssh) key or subkey which has expiration date.
+type ExpiringKey struct {
+	Fingerprint string `json:"fingerprint"`
+	// Primary is fingerprint of primary key, the same as Fingerprint for primary keys
+	Primary string    `json:"primary"`
+	Keygrip string    `json:"keygrip"`
+	UserID  string    `json:"uid,omitempty"`
+	Usage   string    `json:"usage"`
+	Expires time.Time `json:"expires"`
+	Expired bool      `json:"expired,omitempty"`
+}
+
+// Days returns number of whole days left before key expires, negative if it has expired.
+func (k *ExpiringKey) Days() int {
+	d := time.Until(k.Expires)
+	if d < 0 {
+		return -int((-d).Hours()/24) - 1
+	}
+	return int(d.Hours() / 24)
+}
+
+// Subkey tells if key is subkey.
+func (k *ExpiringKey) Subkey() bool {
+	return k.Fingerprint != k.Primary
+}
+
+// capsUsage names what key is used for by its capabilities, empty if it is used for neither signing nor ssh.
+func capsUsage(caps string) string {
+	var usage []string
+	if strings.ContainsRune(caps, 's') {
+		usage = append(usage, "signing")
+	}
+	if strings.ContainsRune(caps, 'a') {
+		usage = append(usage, "ssh")
+	}
+	return strings.Join(usage, ", ")
+}
+
+// parseKeyExpiry takes signing and authentication keys which expire from gpg --with-colons --fixed-list-mode
+// --with-keygrip output. Revoked keys are skipped.
+func parseKeyExpiry(out string) []ExpiringKey {
+	var (
+		res []ExpiringKey
+		// key fpr and grp records belong to, nil if key is of no interest
+		cur *ExpiringKey
+		// next fpr record is fingerprint of primary key
+		pub          bool
+		primary, uid string
+		first        int
+	)
+	flush := func() {
+		// user id comes after primary key, but belongs to all keys of certificate
+		for i := first; i < len(res); i++ {
+			res[i].UserID = uid
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(strings.TrimRight(line, "\r"), ":")
+		if len(f) < 10 {
+			continue
+		}
+		switch f[0] {
+		case "pub", "sub":
+			if pub = f[0] == "pub"; pub {
+				flush()
+				primary, uid, first = "", "", len(res)
+			}
+			cur = nil
+			// capabilities of the key itself are in lower case
+			var usage string
+			if len(f) > 11 {
+				usage = capsUsage(f[11])
+			}
+			ts, err := strconv.ParseInt(f[6], 10, 64)
+			if f[1] == "r" || len(usage) == 0 || err != nil || ts <= 0 {
+				continue
+			}
+			res = append(res, ExpiringKey{Usage: usage, Expires: time.Unix(ts, 0), Expired: f[1] == "e"})
+			cur = &res[len(res)-1]
+		case "fpr":
+			if pub {
+				primary, pub = f[9], false
+			}
+			if cur != nil && len(cur.Fingerprint) == 0 {
+				cur.Fingerprint, cur.Primary = f[9], primary
+			}
+		case "grp":
+			if cur != nil && len(cur.Keygrip) == 0 {
+				cur.Keygrip = f[9]
+			}
+		case "uid":
+			if len(uid) == 0 && f[1] != "r" {
+				uid = unescapeColons(f[9])
+			}
+		default:
+		}
+	}
+	flush()
+	return res
+}
+
+// secretKeygrips asks gpg-agent which keys it has secret parts (or card stubs) for.
+func (a *Agent) secretKeygrips() (map[string]bool, error) {
+	grips := make(map[string]bool)
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	if err := sendAssuanCmd(sockPath,
+		func(ses *client.Session) error {
+			ses.Pipe.OnStatus(func(keyword, params string) {
+				if f := strings.Fields(params); keyword == "KEYINFO" && len(f) > 0 {
+					grips[strings.ToUpper(f[0])] = true
+				}
+			})
+			defer ses.Pipe.OnStatus(nil)
+			if _, err := ses.SimpleCmd("KEYINFO", "--list"); err != nil {
+				return fmt.Errorf("unable to send KEYINFO on \"%s\": %w", sockPath, err)
+			}
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+	return grips, nil
+}
+
+// KeyExpiry lists own signing and ssh keys and subkeys which expire, the ones expiring first come first.
+func (a *Agent) KeyExpiry() ([]ExpiringKey, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	cmd := exec.Command(filepath.Join(filepath.Dir(a.Exe), "gpg.exe"), "--homedir", a.Cfg.GPG.Home,
+		"--batch", "--with-colons", "--fixed-list-mode", "--with-keygrip", "--list-keys")
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys: %w", err)
+	}
+	grips, err := a.secretKeygrips()
+	if err != nil {
+		return nil, err
+	}
+	// keys of other people expire too, but this is not our business
+	keys := parseKeyExpiry(string(out))
+	own := keys[:0]
+	for _, k := range keys {
+		if grips[strings.ToUpper(k.Keygrip)] {
+			own = append(own, k)
+		}
+	}
+	sort.SliceStable(own, func(i, j int) bool { return own[i].Expires.Before(own[j].Expires) })
+	return own, nil
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/rupor-github/win-gpg-agent/testagent"
+)
+
+// startFake serves gpg-agent sockets and ssh requests with in-process fake agent instead of running GnuPG.
+func (a *Agent) startFake() error {
+
+	fake, err := testagent.New()
+	if err != nil {
+		return err
+	}
+	if err := fake.ServeAssuan(
+		a.conns[ConnectorSockAgent].PathGPG(),
+		a.conns[ConnectorSockAgentExtra].PathGPG(),
+		a.conns[ConnectorSockAgentBrowser].PathGPG(),
+		a.conns[ConnectorSockAgentSSH].PathGPG(),
+	); err != nil {
+		return fmt.Errorf("unable to start fake agent: %w", err)
+	}
+	log.Printf("Using fake gpg-agent, test key %s", testagent.Keygrip())
+
+	a.fake = fake
+	sshBackend = fake.SSH
+
+	go func() {
+		<-a.ctx.Done()
+		a.wg.Wait()
+	}()
+	return nil
+}
+
+func (a *Agent) stopFake() error {
+	for _, c := range a.conns {
+		c.Close()
+	}
+	a.cancel()
+	sshBackend = queryPageant
+	return a.fake.Close()
+}
@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// OpenSSH 8.9+ binds agent connections to ssh sessions with session-bind@openssh.com extension. When agent is
+// forwarded local ssh binds forwarded connection with is_forwarding set, and ssh on the remote host binds it again for
+// every host it connects to from there. Signature requested on such connection is our agent being used by remote host
+// to reach third one - which is exactly what anybody with root on that host could do as well.
+const (
+	sshAgentExtension    = 27
+	sessionBindExtension = "session-bind@openssh.com"
+)
+
+const (
+	defaultForwardBurst  = 5
+	defaultForwardWindow = time.Minute
+)
+
+type forwardAction int
+
+const (
+	forwardWarn forwardAction = iota
+	forwardAllow
+	forwardConfirm
+	forwardDeny
+)
+
+func parseForwardAction(s string) (forwardAction, error) {
+	switch strings.ToLower(s) {
+	case "", "warn":
+		return forwardWarn, nil
+	case "allow":
+		return forwardAllow, nil
+	case "confirm":
+		return forwardConfirm, nil
+	case "deny":
+		return forwardDeny, nil
+	default:
+	}
+	return forwardWarn, fmt.Errorf("unknown action \"%s\", should be one of \"warn\", \"allow\", \"confirm\" or \"deny\"", s)
+}
+
+// forwardGuard is forwarding part of access policy.
+type forwardGuard struct {
+	action forwardAction
+	burst  int
+	window time.Duration
+}
+
+func newForwardGuard(cfg *config.ForwardingConfig) (forwardGuard, error) {
+	g := forwardGuard{burst: cfg.Burst, window: cfg.Window}
+	var err error
+	if g.action, err = parseForwardAction(cfg.Action); err != nil {
+		return g, fmt.Errorf("gui.policy.forwarding: %w", err)
+	}
+	if g.burst <= 0 {
+		g.burst = defaultForwardBurst
+	}
+	if g.window <= 0 {
+		g.window = defaultForwardWindow
+	}
+	return g, nil
+}
+
+// configured is true when guard differs from default behavior.
+func (g *forwardGuard) configured() bool {
+	return g.action != forwardWarn || g.burst != defaultForwardBurst || g.window != defaultForwardWindow
+}
+
+// sshHop is single session bind.
+type sshHop struct {
+	host       string
+	forwarding bool
+}
+
+// sshSession keeps session binds of ssh agent connection.
+type sshSession struct {
+	hops []sshHop
+	// client is sshd serving incoming session with agent forwarding
+	sshd   bool
+	warned bool
+}
+
+func newSSHSession(ci *ClientInfo) *sshSession {
+	return &sshSession{sshd: ci != nil && strings.EqualFold(filepath.Base(ci.Image), "sshd.exe")}
+}
+
+// sshString reads SSH wire protocol string.
+func sshString(data []byte) (value, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	l := binary.BigEndian.Uint32(data)
+	if uint64(l) > uint64(len(data)-4) {
+		return nil, nil, false
+	}
+	return data[4 : 4+l], data[4+l:], true
+}
+
+// bind records session bind if request is one.
+func (s *sshSession) bind(req []byte) {
+	if len(req) < 1 || req[0] != sshAgentExtension {
+		return
+	}
+	name, rest, ok := sshString(req[1:])
+	if !ok || string(name) != sessionBindExtension {
+		return
+	}
+	hostKey, rest, ok := sshString(rest)
+	if !ok {
+		return
+	}
+	// session id and signature are verified by the agent which handles request
+	for i := 0; i < 2 && ok; i++ {
+		_, rest, ok = sshString(rest)
+	}
+	if !ok || len(rest) < 1 {
+		return
+	}
+	hop := sshHop{host: "unknown host", forwarding: rest[0] != 0}
+	if pk, err := ssh.ParsePublicKey(hostKey); err == nil {
+		hop.host = ssh.FingerprintSHA256(pk)
+	}
+	s.hops = append(s.hops, hop)
+}
+
+// forwarded is true when requests on connection come from another host.
+func (s *sshSession) forwarded() bool {
+	if s.sshd {
+		return true
+	}
+	for _, h := range s.hops {
+		if h.forwarding {
+			return true
+		}
+	}
+	return false
+}
+
+// path describes how connection reached us, host keys in order of binds.
+func (s *sshSession) path() string {
+	parts := make([]string, 0, len(s.hops)+1)
+	if s.sshd {
+		parts = append(parts, "incoming sshd session")
+	}
+	for _, h := range s.hops {
+		parts = append(parts, h.host)
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// forwardUses counts recent signatures over forwarded connections.
+var forwardUses struct {
+	sync.Mutex
+	times    []time.Time
+	reported time.Time
+}
+
+// forwardBurst records forwarded signature and returns true if burst should be reported now.
+func forwardBurst(now time.Time, g *forwardGuard) (int, bool) {
+	forwardUses.Lock()
+	defer forwardUses.Unlock()
+
+	recent := forwardUses.times[:0]
+	for _, t := range forwardUses.times {
+		if now.Sub(t) < g.window {
+			recent = append(recent, t)
+		}
+	}
+	forwardUses.times = append(recent, now)
+	n := len(forwardUses.times)
+	if n < g.burst || now.Sub(forwardUses.reported) < g.window {
+		return n, false
+	}
+	forwardUses.reported = now
+	return n, true
+}
+
+// guardForwarding applies forwarding guard to ssh signature request. Non nil error means request is rejected.
+func (c *Connector) guardForwarding(ci *ClientInfo, s *sshSession, key string) error {
+	if !s.forwarded() {
+		return nil
+	}
+	p := c.policy.get()
+	g := forwardGuard{action: forwardWarn, burst: defaultForwardBurst, window: defaultForwardWindow}
+	if p != nil {
+		g = p.forwarding
+	}
+
+	if n, burst := forwardBurst(time.Now(), &g); burst {
+		text := fmt.Sprintf("%d signatures over forwarded agent connections in %s, agent may be abused on remote host", n, g.window)
+		log.Printf("Forwarding guard on %s: %s", c.index, text)
+		notify.Notify(notify.Forwarded, "Agent forwarding burst", text, "connector", c.index.String(), "count", fmt.Sprint(n))
+	}
+
+	text := fmt.Sprintf("ssh key %s is used by %s over forwarded agent connection: %s", key, ci, s.path())
+	switch g.action {
+	case forwardAllow:
+		return nil
+	case forwardConfirm:
+		req := &request{connector: c.index, client: ci, op: "ssh-sign on remote host " + s.path(), key: key}
+		if p.ask(req, false) {
+			return nil
+		}
+		err := fmt.Errorf("forwarded ssh-sign with key %s by %s was not confirmed", key, ci)
+		log.Printf("Rejecting request on %s: %s", c.index, err)
+		c.denied(err)
+		return err
+	case forwardDeny:
+		err := fmt.Errorf("forwarded ssh-sign with key %s by %s denied, path %s", key, ci, s.path())
+		log.Printf("Rejecting request on %s: %s", c.index, err)
+		c.denied(err)
+		return err
+	default:
+	}
+	if !s.warned {
+		s.warned = true
+		log.Printf("Forwarding guard on %s: %s", c.index, text)
+		notify.Notify(notify.Forwarded, "Agent is forwarded", text, "connector", c.index.String(), "key", key, "path", s.path())
+	}
+	return nil
+}
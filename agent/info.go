@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Endpoint describes address single connector is serving on.
+type Endpoint struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Stats   *Stats `json:"stats,omitempty"`
+}
+
+// KeyInfo describes single key known to gpg-agent as reported by KEYINFO.
+type KeyInfo struct {
+	Keygrip     string `json:"keygrip"`
+	Type        string `json:"type"`
+	SerialNo    string `json:"serialno,omitempty"`
+	IDStr       string `json:"idstr,omitempty"`
+	Cached      bool   `json:"cached"`
+	Protection  string `json:"protection"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Address returns printable address connector is serving on or empty string if it is not active.
+func (c *Connector) Address() string {
+	if c == nil || c.listener == nil {
+		return ""
+	}
+	switch c.index {
+	case ConnectorPipeSSH:
+		return c.Name()
+	case ConnectorExtraPort, ConnectorNoise, ConnectorWebSocket:
+		return util.ListenerAddrs(c.listener)
+	case ConnectorXShell:
+		return fmt.Sprintf("localhost:%d", c.Port())
+	case ConnectorHvsockSSH, ConnectorHvsockExtra:
+		return fmt.Sprintf("vsock:%d", c.port)
+	default:
+	}
+	if _, ok := c.listener.Addr().(*net.TCPAddr); ok {
+		return c.listener.Addr().String()
+	}
+	return c.PathGUI()
+}
+
+// Endpoints returns addresses of all active connectors.
+func (a *Agent) Endpoints() []Endpoint {
+	if a == nil {
+		return nil
+	}
+	res := make([]Endpoint, 0, len(a.conns))
+	for _, c := range a.conns {
+		if addr := c.Address(); len(addr) > 0 {
+			st := c.Stats()
+			res = append(res, Endpoint{ID: c.index.ID(), Name: c.index.String(), Address: addr, Stats: &st})
+		}
+	}
+	return res
+}
+
+// PID returns process id of running gpg-agent or 0.
+func (a *Agent) PID() int {
+	if a != nil && a.fake != nil {
+		return os.Getpid()
+	}
+	if pid := a.Adopted(); pid != 0 {
+		return pid
+	}
+	if a == nil || a.cmd == nil || a.cmd.Process == nil {
+		return 0
+	}
+	return a.cmd.Process.Pid
+}
+
+// Locked reports if user session is presently locked.
+func (a *Agent) Locked() bool {
+	return a != nil && atomic.LoadInt32(&a.locked) != 0
+}
+
+// Keys lists keys known to gpg-agent.
+func (a *Agent) Keys() ([]KeyInfo, error) {
+
+	var data []byte
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	if err := sendAssuanCmd(sockPath,
+		func(ses *client.Session) (err error) {
+			if data, err = ses.SimpleCmd("KEYINFO", "--list --data"); err != nil {
+				return fmt.Errorf("unable to send KEYINFO on \"%s\": %w", sockPath, err)
+			}
+			return nil
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	// KEYINFO <keygrip> <type> <serialno> <idstr> <cached> <protection> <fpr> <ttl> <flags>
+	field := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+	var res []KeyInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 7 || f[0] != "KEYINFO" {
+			continue
+		}
+		var fpr string
+		if len(f) > 7 {
+			fpr = field(f[7])
+		}
+		res = append(res, KeyInfo{
+			Keygrip:     f[1],
+			Type:        f[2],
+			SerialNo:    field(f[3]),
+			IDStr:       field(f[4]),
+			Cached:      f[5] == "1",
+			Protection:  f[6],
+			Fingerprint: fpr,
+		})
+	}
+	return res, nil
+}
+
+// ClearCache tells gpg-agent to forget all cached passphrases.
+func (a *Agent) ClearCache() error {
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	return sendAssuanCmd(sockPath,
+		func(ses *client.Session) error {
+			if _, err := ses.SimpleCmd("RELOADAGENT", ""); err != nil {
+				return fmt.Errorf("unable to send RELOADAGENT on \"%s\": %w", sockPath, err)
+			}
+			return nil
+		},
+	)
+}
+
+// Restart restarts gpg-agent process, all connectors keep serving.
+func (a *Agent) Restart() error {
+
+	if a != nil && a.fake != nil {
+		// fake agent has nothing to restart, just forget cached state
+		return a.ClearCache()
+	}
+	if a == nil || a.cmd == nil {
+		return fmt.Errorf("gpg agent has not been started")
+	}
+
+	a.restart.Lock()
+	defer a.restart.Unlock()
+
+	// pooled connections die with gpg-agent
+	for _, c := range a.conns {
+		if c != nil {
+			c.pool.drop()
+		}
+	}
+
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	if err := sendAssuanCmd(sockPath,
+		func(ses *client.Session) error {
+			if _, err := ses.SimpleCmd("KILLAGENT", ""); err != nil {
+				return fmt.Errorf("unable to send KILLAGENT on \"%s\": %w", sockPath, err)
+			}
+			return nil
+		},
+	); err != nil {
+		if err := a.forceCleanup(); err != nil {
+			return err
+		}
+	}
+	_ = a.cmd.Wait()
+	util.WaitForFileDeparture(time.Second*5, sockPath)
+	a.cmdOutput.Reset()
+
+	if err := a.Start(); err != nil {
+		return err
+	}
+	notify.Notify(notify.AgentRestarted, util.GPGAgentName, "gpg-agent was restarted", "pid", strconv.Itoa(a.PID()))
+	return nil
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+// defaultLimitWait limits how long client waits for its turn when connector is at its limit.
+const defaultLimitWait = time.Minute
+
+// LimitStats describes concurrency limit of connector.
+type LimitStats struct {
+	Max       int   `json:"max"`
+	Active    int   `json:"active"`
+	Queued    int   `json:"queued"`
+	MaxQueued int   `json:"max_queued"`
+	Waited    int64 `json:"waited"`
+	WaitMs    int64 `json:"wait_ms"`
+	TimedOut  int64 `json:"timed_out"`
+}
+
+// String formats limit counters in single line.
+func (ls *LimitStats) String() string {
+	res := fmt.Sprintf("active %d of %d, queued %d (peak %d), waited %d", ls.Active, ls.Max, ls.Queued, ls.MaxQueued, ls.Waited)
+	if ls.Waited > 0 {
+		res += fmt.Sprintf(" (%d ms average)", ls.WaitMs/ls.Waited)
+	}
+	if ls.TimedOut > 0 {
+		res += fmt.Sprintf(", timed out %d", ls.TimedOut)
+	}
+	return res
+}
+
+// slots limits number of concurrent users of some resource, users over the limit wait in order of arrival.
+type slots struct {
+	max  int
+	wait time.Duration
+	what string
+
+	mu        sync.Mutex
+	used      int
+	waiters   []chan struct{}
+	maxQueued int
+	waited    int64
+	waitTime  time.Duration
+	timedOut  int64
+}
+
+// acquire takes slot, waiting in line if limit is reached.
+func (s *slots) acquire(id int64) error {
+	s.mu.Lock()
+	if s.max <= 0 || s.used < s.max {
+		s.used++
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	if len(s.waiters) > s.maxQueued {
+		s.maxQueued = len(s.waiters)
+	}
+	s.waited++
+	s.mu.Unlock()
+
+	log.Printf("[%d] All %d %s are busy, waiting", id, s.max, s.what)
+	start := time.Now()
+	defer func() {
+		s.mu.Lock()
+		s.waitTime += time.Since(start)
+		s.mu.Unlock()
+	}()
+
+	t := time.NewTimer(s.wait)
+	defer t.Stop()
+	select {
+	case <-ch:
+		// slot is handed over by release
+		return nil
+	case <-t.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == ch {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.timedOut++
+			return fmt.Errorf("all %d %s are busy", s.max, s.what)
+		}
+	}
+	// slot was handed over while timing out
+	return nil
+}
+
+// release gives slot to the first user in line or frees it.
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) > 0 {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		return
+	}
+	s.used--
+}
+
+// snapshot returns limit counters, nil if there is no limit.
+func (s *slots) snapshot() *LimitStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &LimitStats{Max: s.max, Active: s.used, Queued: len(s.waiters), MaxQueued: s.maxQueued, Waited: s.waited,
+		WaitMs: s.waitTime.Milliseconds(), TimedOut: s.timedOut}
+}
+
+// newLimit returns concurrency limit configured for connector, nil if connector is not limited. Limit for connector ID
+// takes precedence over default one ("*").
+func newLimit(ct ConnectorType, limits map[string]config.LimitConfig) *slots {
+	lc, ok := limits[ct.ID()]
+	if !ok {
+		lc = limits["*"]
+	}
+	if lc.Max <= 0 {
+		return nil
+	}
+	s := &slots{max: lc.Max, wait: lc.Wait, what: ct.String() + " connections"}
+	if s.wait <= 0 {
+		s.wait = defaultLimitWait
+	}
+	return s
+}
+
+// checkLimits validates connector names used in gui.limits.
+func checkLimits(limits map[string]config.LimitConfig) error {
+	for name := range limits {
+		if name == "*" {
+			continue
+		}
+		known := false
+		for ct := ConnectorType(0); ct < maxConnector; ct++ {
+			if name == ct.ID() {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("gui.limits: unknown connector \"%s\"", name)
+		}
+	}
+	return nil
+}
+
+// admitConcurrent waits until connector is below its concurrency limit, returned function must be called when client
+// is done.
+func (c *Connector) admitConcurrent(id int64) (func(), error) {
+	if c.limit == nil {
+		return func() {}, nil
+	}
+	if err := c.limit.acquire(id); err != nil {
+		return nil, err
+	}
+	return c.limit.release, nil
+}
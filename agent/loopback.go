@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+	"github.com/rupor-github/win-gpg-agent/wincred"
+)
+
+// maxLoopbackPassphrase limits size of passphrase accepted for loopback bridging.
+const maxLoopbackPassphrase = 1024
+
+// Loopback passphrase sources.
+const (
+	SourceControl     = "control"
+	SourceCredentials = "credential manager"
+)
+
+// LoopbackCredentialName returns Credential Manager target name passphrase for keygrip is read from.
+func LoopbackCredentialName(keygrip string) string {
+	return "GnuPG:Loopback=" + keygrip
+}
+
+// LoopbackKey describes key whitelisted for loopback bridging, passphrase itself is never reported.
+type LoopbackKey struct {
+	Keygrip string `json:"keygrip"`
+	// where passphrase is coming from, empty when it is not available
+	Source  string `json:"source,omitempty"`
+	Expires string `json:"expires,omitempty"`
+}
+
+type loopbackEntry struct {
+	pass    *util.SecureBuffer
+	expires time.Time
+}
+
+// loopbackStore keeps passphrases for keys gpg-agent could use without pinentry. Only whitelisted keygrips are ever
+// answered, passphrases set over control API are kept in secure buffers until they expire or session is locked.
+type loopbackStore struct {
+	mu      sync.Mutex
+	keys    map[string]bool
+	creds   bool
+	ttl     time.Duration
+	entries map[string]*loopbackEntry
+}
+
+// newLoopbackStore prepares store from configuration, returns nil if no keys are whitelisted.
+func newLoopbackStore(cfg *config.LoopbackConfig) (*loopbackStore, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+	s := &loopbackStore{keys: make(map[string]bool), creds: cfg.Credentials, ttl: cfg.TTL, entries: make(map[string]*loopbackEntry)}
+	for _, k := range cfg.Keys {
+		grip, err := normalizeKeygrip(k)
+		if err != nil {
+			return nil, fmt.Errorf("gui.loopback.keys: %w", err)
+		}
+		s.keys[grip] = true
+	}
+	return s, nil
+}
+
+func normalizeKeygrip(k string) (string, error) {
+	k = strings.ToUpper(strings.TrimSpace(k))
+	if b, err := hex.DecodeString(k); err != nil || len(b) != 20 {
+		return "", fmt.Errorf("bad keygrip \"%s\", should be 40 hexadecimal digits", k)
+	}
+	return k, nil
+}
+
+// allowed checks if keygrip is whitelisted and its passphrase is available.
+func (s *loopbackStore) allowed(keygrip string) bool {
+	if s == nil {
+		return false
+	}
+	keygrip = strings.ToUpper(keygrip)
+	if !s.keys[keygrip] {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.valid(keygrip) {
+		return true
+	}
+	return s.creds
+}
+
+// valid checks if passphrase set over control API is present and not expired, dropping expired one. Must be called
+// with mutex held.
+func (s *loopbackStore) valid(keygrip string) bool {
+	e, ok := s.entries[keygrip]
+	if !ok {
+		return false
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		log.Printf("Loopback passphrase for %s expired", keygrip)
+		e.pass.Free()
+		delete(s.entries, keygrip)
+		return false
+	}
+	return true
+}
+
+// passphrase returns copy of passphrase for keygrip and its source, caller has to wipe it. Returns nil if passphrase
+// is not available.
+func (s *loopbackStore) passphrase(keygrip string) ([]byte, string) {
+	if s == nil {
+		return nil, ""
+	}
+	keygrip = strings.ToUpper(keygrip)
+	if !s.keys[keygrip] {
+		return nil, ""
+	}
+
+	s.mu.Lock()
+	if s.valid(keygrip) {
+		p := s.entries[keygrip].pass.Bytes()
+		res := make([]byte, len(p))
+		copy(res, p)
+		s.mu.Unlock()
+		return res, SourceControl
+	}
+	s.mu.Unlock()
+
+	if !s.creds {
+		return nil, ""
+	}
+	cred, err := wincred.GetGenericCredential(LoopbackCredentialName(keygrip))
+	if err != nil {
+		if !errors.Is(err, windows.ERROR_NOT_FOUND) {
+			log.Printf("Unable to read loopback passphrase for %s from Credential Manager: %s", keygrip, err)
+		}
+		return nil, ""
+	}
+	return credentialPassphrase(cred.CredentialBlob), SourceCredentials
+}
+
+// credentialPassphrase returns passphrase stored in Credential Manager blob as UTF-8. cmdkey and Credential Manager UI
+// store passwords as UTF-16LE, which is recognized by NUL or control bytes UTF-8 passphrase would not have. Blob is wiped
+// when it is decoded.
+func credentialPassphrase(blob []byte) []byte {
+	utf16le := len(blob)%2 == 0 && !utf8.Valid(blob)
+	for i := 0; !utf16le && i < len(blob) && len(blob)%2 == 0; i++ {
+		utf16le = blob[i] < 0x20
+	}
+	if !utf16le {
+		return blob
+	}
+	defer util.Wipe(blob)
+
+	// decoded directly into result, so there are no intermediate copies to wipe
+	res, n := make([]byte, len(blob)/2*3), 0
+	for i := 0; i < len(blob); i += 2 {
+		r := rune(blob[i]) | rune(blob[i+1])<<8
+		if utf16.IsSurrogate(r) && i+3 < len(blob) {
+			if dec := utf16.DecodeRune(r, rune(blob[i+2])|rune(blob[i+3])<<8); dec != utf8.RuneError {
+				r = dec
+				i += 2
+			}
+		}
+		n += utf8.EncodeRune(res[n:], r)
+	}
+	return res[:n]
+}
+
+// set stores passphrase for whitelisted keygrip.
+func (s *loopbackStore) set(keygrip string, pass []byte) error {
+	if s == nil {
+		return errors.New("loopback bridging is not configured")
+	}
+	keygrip, err := normalizeKeygrip(keygrip)
+	if err != nil {
+		return err
+	}
+	if !s.keys[keygrip] {
+		return fmt.Errorf("key %s is not allowed for loopback bridging", keygrip)
+	}
+	if len(pass) == 0 || len(pass) > maxLoopbackPassphrase {
+		return fmt.Errorf("passphrase should be from 1 to %d bytes long", maxLoopbackPassphrase)
+	}
+	buf, err := util.NewSecureBuffer(len(pass))
+	if err != nil {
+		return err
+	}
+	_, _ = buf.Write(pass)
+
+	e := &loopbackEntry{pass: buf}
+	if s.ttl > 0 {
+		e.expires = time.Now().Add(s.ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[keygrip]; ok {
+		old.pass.Free()
+	}
+	s.entries[keygrip] = e
+	log.Printf("Loopback passphrase for %s has been set", keygrip)
+	return nil
+}
+
+// forget drops passphrase for keygrip or all passphrases when keygrip is empty.
+func (s *loopbackStore) forget(keygrip string) {
+	if s == nil {
+		return
+	}
+	keygrip = strings.ToUpper(strings.TrimSpace(keygrip))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.entries {
+		if len(keygrip) == 0 || k == keygrip {
+			e.pass.Free()
+			delete(s.entries, k)
+			log.Printf("Loopback passphrase for %s has been dropped", k)
+		}
+	}
+}
+
+// list returns whitelisted keys and state of their passphrases.
+func (s *loopbackStore) list() []LoopbackKey {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]LoopbackKey, 0, len(s.keys))
+	for k := range s.keys {
+		lk := LoopbackKey{Keygrip: k}
+		switch {
+		case s.valid(k):
+			lk.Source = SourceControl
+			if e := s.entries[k]; !e.expires.IsZero() {
+				lk.Expires = e.expires.Format(time.RFC3339)
+			}
+		case s.creds:
+			if cred, err := wincred.GetGenericCredential(LoopbackCredentialName(k)); err == nil {
+				util.Wipe(cred.CredentialBlob)
+				lk.Source = SourceCredentials
+			}
+		default:
+		}
+		res = append(res, lk)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Keygrip < res[j].Keygrip })
+	return res
+}
+
+// escapeData percent-encodes passphrase into Assuan D lines without making copies outside of returned slice, so it
+// could be wiped.
+func escapeData(p []byte) []byte {
+	const (
+		hexDigits = "0123456789ABCDEF"
+		maxData   = common.MaxLineLen - 16
+	)
+	// large enough for worst case, so append never reallocates leaving unwiped copy behind
+	res := make([]byte, 0, len(p)*3+4*(len(p)*3/(maxData-4)+2))
+	res = append(res, "D "...)
+	line := 2
+	for _, b := range p {
+		if line >= maxData {
+			res = append(res, "\nD "...)
+			line = 2
+		}
+		switch b {
+		case '\r', '\n', '%', '\\':
+			res = append(res, '%', hexDigits[b>>4], hexDigits[b&0xF])
+			line += 3
+		default:
+			res = append(res, b)
+			line++
+		}
+	}
+	return append(res, '\n')
+}
+
+// SetPassphrase stores passphrase for whitelisted key, gpg-agent gets it instead of asking pinentry.
+func (a *Agent) SetPassphrase(keygrip string, pass []byte) error {
+	return a.loopback.set(keygrip, pass)
+}
+
+// ForgetPassphrase drops passphrase set for key, all passphrases are dropped when keygrip is empty.
+func (a *Agent) ForgetPassphrase(keygrip string) error {
+	if a.loopback == nil {
+		return errors.New("loopback bridging is not configured")
+	}
+	a.loopback.forget(keygrip)
+	return nil
+}
+
+// LoopbackKeys returns keys whitelisted for loopback bridging.
+func (a *Agent) LoopbackKeys() []LoopbackKey {
+	return a.loopback.list()
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16Blob encodes s the way cmdkey stores passwords.
+func utf16Blob(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func TestCredentialPassphrase(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		blob []byte
+		want string
+	}{
+		{"utf8", []byte("correct horse"), "correct horse"},
+		{"utf8 non-ascii", []byte("пароль €"), "пароль €"},
+		{"utf16 ascii", utf16Blob("correct horse"), "correct horse"},
+		{"utf16 cyrillic", utf16Blob("пароль"), "пароль"},
+		{"utf16 surrogates", utf16Blob("key 🔑"), "key 🔑"},
+		{"odd length", []byte("abc"), "abc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blob := append([]byte(nil), tc.blob...)
+			got := credentialPassphrase(blob)
+			if string(got) != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			if !bytes.Equal(blob, tc.blob) && !bytes.Equal(blob, make([]byte, len(blob))) {
+				t.Fatal("decoded blob was not wiped")
+			}
+		})
+	}
+}
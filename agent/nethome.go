@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// maxHomeCheck limits how long reachability check of network GnuPG home could take.
+const maxHomeCheck = 10 * time.Second
+
+// gpgconfSocketDir asks gpgconf where gpg-agent with given home puts its sockets.
+func gpgconfSocketDir(gpgconf, home string) (string, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	cmd := exec.Command(gpgconf, "--homedir", home, "--list-dirs", "socketdir")
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to run \"%s\": %w", cmd.String(), err)
+	}
+	// gpgconf percent-escapes values
+	dir, err := common.UnescapeParameters(strings.TrimSpace(string(out)))
+	if err != nil {
+		return "", fmt.Errorf("unable to decode gpgconf output \"%s\": %w", out, err)
+	}
+	if len(dir) == 0 {
+		return "", fmt.Errorf("gpgconf did not report socketdir for %s", home)
+	}
+	return util.CleanPath(filepath.FromSlash(dir)), nil
+}
+
+// prepareNetworkHome checks if GnuPG home is on network share. Sockets there are slow and break when share goes away,
+// so if configured socket directory is on the share too, local directory GnuPG uses for sockets (2.3+ keeps them under
+// LOCALAPPDATA) is taken instead.
+func (a *Agent) prepareNetworkHome() {
+	if !util.IsRemotePath(a.Cfg.GPG.Home) {
+		return
+	}
+	a.netHome = true
+	log.Printf("GnuPG home %s is on network share", a.Cfg.GPG.Home)
+
+	sdir := a.Cfg.GPG.Sockets
+	if len(sdir) == 0 {
+		sdir = a.Cfg.GPG.Home
+	}
+	if !a.Cfg.GPG.Network.LocalSockets || !util.IsRemotePath(sdir) {
+		return
+	}
+	dir, err := gpgconfSocketDir(filepath.Join(filepath.Dir(a.Exe), "gpgconf.exe"), a.Cfg.GPG.Home)
+	if err != nil {
+		log.Printf("Unable to find local socket directory: %s", err)
+		return
+	}
+	if util.IsRemotePath(dir) {
+		log.Printf("gpg-agent keeps sockets on network share %s, use GnuPG 2.3 or newer in non-portable mode to have them local", dir)
+		return
+	}
+	log.Printf("Using local socket directory %s instead of %s", dir, sdir)
+	a.Cfg.GPG.Sockets = dir
+}
+
+// dialRetry dials upstream Assuan socket, when GnuPG home is on network share attempts are repeated as the first one
+// often fails while share is waking up.
+func (c *Connector) dialRetry(id int64) (net.Conn, error) {
+	conn, err := client.Dial(c.PathGPG())
+	for i := 0; err != nil && i < c.retries; i++ {
+		log.Printf("[%d] Unable to dial assuan socket \"%s\", retrying in %s: %s", id, c.PathGPG(), c.retryDelay, err.Error())
+		time.Sleep(c.retryDelay)
+		conn, err = client.Dial(c.PathGPG())
+	}
+	return conn, err
+}
+
+// HomeOffline tells if GnuPG home on network share could not be reached on last check.
+func (a *Agent) HomeOffline() bool {
+	return a != nil && atomic.LoadInt32(&a.offline) != 0
+}
+
+// watchHome periodically checks if GnuPG home on network share is reachable and tells user when this changes, so
+// failing gpg operations have explanation.
+func (a *Agent) watchHome() {
+	interval := a.Cfg.GPG.Network.CheckInterval
+	timeout := interval
+	if timeout > maxHomeCheck {
+		timeout = maxHomeCheck
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-t.C:
+			a.checkHome(timeout)
+		}
+	}
+}
+
+func (a *Agent) checkHome(timeout time.Duration) {
+	err := util.PathReachable(a.Cfg.GPG.Home, timeout)
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&a.offline, 0, 1) {
+			log.Printf("GnuPG home is offline: %s", err)
+			notify.Notify(notify.HomeOffline, util.GPGAgentName,
+				fmt.Sprintf("GnuPG home %s is not reachable, gpg operations will fail until network share is back", a.Cfg.GPG.Home),
+				"home", a.Cfg.GPG.Home, "state", "offline")
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&a.offline, 1, 0) {
+		log.Print("GnuPG home is online again")
+		// connections made while share was away may be stuck
+		for _, c := range a.conns {
+			if c != nil {
+				c.pool.drop()
+			}
+		}
+		notify.Notify(notify.HomeOffline, util.GPGAgentName, fmt.Sprintf("GnuPG home %s is reachable again", a.Cfg.GPG.Home),
+			"home", a.Cfg.GPG.Home, "state", "online")
+	}
+}
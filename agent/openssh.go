@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// openSSHServiceTimeout limits single request to Windows OpenSSH ssh-agent service.
+const openSSHServiceTimeout = 30 * time.Second
+
+// queryOpenSSHService processes ssh-agent request with Windows OpenSSH ssh-agent service instead of gpg-agent.
+func queryOpenSSHService(req []byte) ([]byte, error) {
+
+	timeout := 5 * time.Second
+	conn, err := winio.DialPipe(util.SSHAgentPipeName, &timeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s service: %w", util.OpenSSHAgentService, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(openSSHServiceTimeout))
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(req)))
+	if _, err := conn.Write(append(length[:], req...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(length[:])
+	if l > util.MaxAgentMsgLen-4 {
+		return nil, fmt.Errorf("%s service reply too large: %d", util.OpenSSHAgentService, l)
+	}
+	resp := make([]byte, l)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Delegates is true when ssh requests are sent to Windows OpenSSH ssh-agent service rather than to gpg-agent.
+func (a *Agent) Delegates() bool {
+	return strings.EqualFold(a.Cfg.GUI.OpenSSHService, config.ServiceDelegate)
+}
+
+// DelegatesPipe is true when OpenSSH named pipe is left to Windows OpenSSH ssh-agent service and is not served.
+func (a *Agent) DelegatesPipe() bool {
+	return a.Delegates() && strings.EqualFold(a.Cfg.GUI.PipeName, util.SSHAgentPipeName)
+}
+
+// openSSHServiceStatus describes Windows OpenSSH ssh-agent service and how agent deals with it.
+func (a *Agent) openSSHServiceStatus() string {
+	installed, running, auto := util.OpenSSHAgentState()
+	if !installed {
+		return "not installed"
+	}
+	state := "stopped"
+	if running {
+		state = "running"
+	}
+	if auto {
+		state += ", starts automatically"
+	}
+	switch strings.ToLower(a.Cfg.GUI.OpenSSHService) {
+	case config.ServiceDelegate:
+		return state + "\nssh requests are delegated to it, gpg-agent ssh keys are not used"
+	case config.ServiceTakeover:
+		return state + "\nis stopped and disabled, so agent-gui could serve its pipe"
+	default:
+	}
+	return state
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// pipeOptions are hardening parameters of OpenSSH named pipe. Remote clients are always rejected - go-winio creates
+// every pipe instance with PIPE_REJECT_REMOTE_CLIENTS - and it always allows unlimited number of instances, so
+// maximum is enforced by counting served clients instead.
+type pipeOptions struct {
+	inBuffer, outBuffer int32
+	maxInstances        int32
+	impersonation       uint32
+	// number of clients being served
+	active int32
+}
+
+func newPipeOptions(cfg *config.PipeConfig) pipeOptions {
+	po := pipeOptions{
+		inBuffer:      int32(cfg.InBuffer),
+		outBuffer:     int32(cfg.OutBuffer),
+		maxInstances:  int32(cfg.MaxInstances),
+		impersonation: util.ImpersonationAnonymous,
+	}
+	switch strings.ToLower(cfg.Impersonation) {
+	case "identification":
+		po.impersonation = util.ImpersonationIdentification
+	case "impersonation":
+		po.impersonation = util.ImpersonationImpersonation
+	default:
+	}
+	return po
+}
+
+// admit checks accepted pipe client, on success release has to be called when client is done.
+func (po *pipeOptions) admit(conn net.Conn) error {
+	if po.impersonation != util.ImpersonationAnonymous {
+		level, err := util.PipeImpersonationLevel(conn)
+		if err != nil {
+			return fmt.Errorf("unable to get client impersonation level: %w", err)
+		}
+		if level < po.impersonation {
+			return fmt.Errorf("client allows %s, at least %s is required", util.ImpersonationLevelName(level), util.ImpersonationLevelName(po.impersonation))
+		}
+	}
+	if n := atomic.AddInt32(&po.active, 1); po.maxInstances > 0 && n > po.maxInstances {
+		atomic.AddInt32(&po.active, -1)
+		return fmt.Errorf("%d clients are already served", po.maxInstances)
+	}
+	return nil
+}
+
+func (po *pipeOptions) release() {
+	atomic.AddInt32(&po.active, -1)
+}
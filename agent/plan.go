@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// PlannedEndpoint describes endpoint which would be created with current configuration.
+type PlannedEndpoint struct {
+	Endpoint
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Plan describes what agent would do with current configuration.
+type Plan struct {
+	Version   string            `json:"gnupg_version"`
+	Exe       string            `json:"gpg_agent"`
+	Endpoints []PlannedEndpoint `json:"endpoints"`
+	Upstream  []PlannedEndpoint `json:"gpg_agent_sockets"`
+}
+
+// Conflicts returns number of endpoints with detected problems.
+func (p *Plan) Conflicts() int {
+	var n int
+	for _, e := range append(p.Endpoints, p.Upstream...) {
+		if len(e.Conflict) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// DryRun computes endpoints for prepared agent detecting conflicts. Nothing is bound or created, existing endpoints are
+// only probed.
+func (a *Agent) DryRun() *Plan {
+
+	p := &Plan{Version: a.Ver, Exe: a.Exe}
+	if a.Cfg.GUI.FakeAgent {
+		p.Exe = "in-process fake agent"
+	}
+
+	seen := make(map[string]ConnectorType)
+	for _, c := range a.conns {
+		// browser socket is created by gpg-agent, but not served by us
+		if c == nil || c.index == ConnectorSockAgentBrowser {
+			continue
+		}
+		// Windows OpenSSH ssh-agent service keeps its pipe
+		if c.index == ConnectorPipeSSH && a.DelegatesPipe() {
+			continue
+		}
+		for _, addr := range c.plannedAddrs() {
+			e := PlannedEndpoint{Endpoint: Endpoint{ID: c.index.ID(), Name: c.index.String(), Address: addr}}
+			key := strings.ToLower(addr)
+			if other, ok := seen[key]; ok {
+				e.Conflict = fmt.Sprintf("same address is used by %s", other)
+			} else {
+				seen[key] = c.index
+				e.Conflict = c.probe(addr)
+			}
+			p.Endpoints = append(p.Endpoints, e)
+		}
+	}
+
+	for _, ct := range []ConnectorType{ConnectorSockAgent, ConnectorSockAgentExtra, ConnectorSockAgentBrowser, ConnectorSockAgentSSH} {
+		e := PlannedEndpoint{Endpoint: Endpoint{ID: ct.ID(), Name: ct.String(), Address: a.conns[ct].PathGPG()}}
+		if util.FileExists(e.Address) {
+			e.Conflict = "socket file exists, gpg-agent is probably running and will be killed"
+		}
+		p.Upstream = append(p.Upstream, e)
+	}
+	return p
+}
+
+// plannedAddrs returns addresses connector would be serving on.
+func (c *Connector) plannedAddrs() []string {
+	switch c.index {
+	case ConnectorPipeSSH:
+		return []string{c.name}
+	case ConnectorExtraPort, ConnectorNoise:
+		ips, err := util.ResolveBindHosts(c.bind)
+		if err != nil {
+			return []string{fmt.Sprintf("%s:%d (%s)", strings.Join(c.bind, ","), c.port, err)}
+		}
+		res := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			res = append(res, net.JoinHostPort(ip, strconv.Itoa(c.port)))
+		}
+		return res
+	case ConnectorWebSocket:
+		return []string{fmt.Sprintf("localhost:%d", c.port)}
+	case ConnectorXShell:
+		return []string{"localhost:<random port>"}
+	case ConnectorHvsockSSH, ConnectorHvsockExtra:
+		return []string{fmt.Sprintf("vsock:%d", c.port)}
+	default:
+	}
+	return []string{c.PathGUI()}
+}
+
+// probe checks if address is already taken.
+func (c *Connector) probe(addr string) string {
+	switch c.index {
+	case ConnectorPipeSSH:
+		if util.PipeExists(addr) {
+			return "named pipe is already served by another process (Windows OpenSSH ssh-agent service?)"
+		}
+	case ConnectorExtraPort, ConnectorNoise, ConnectorWebSocket:
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err.Error()
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		if conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), time.Second); err == nil {
+			conn.Close()
+			return "port is already in use"
+		}
+	case ConnectorXShell, ConnectorHvsockSSH, ConnectorHvsockExtra:
+	default:
+		if len(addr) >= util.MaxNameLen {
+			return fmt.Sprintf("path is longer than %d characters allowed for AF_UNIX sockets", util.MaxNameLen-1)
+		}
+		if _, err := os.Lstat(addr); err == nil {
+			return "file exists, stale socket or another agent is running"
+		}
+	}
+	return ""
+}
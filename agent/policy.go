@@ -0,0 +1,564 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// ID returns short connector name used in configuration.
+func (ct ConnectorType) ID() string {
+	switch ct {
+	case ConnectorSockAgent:
+		return "gpg"
+	case ConnectorSockAgentExtra:
+		return "gpg-extra"
+	case ConnectorSockAgentBrowser:
+		return "gpg-browser"
+	case ConnectorSockAgentSSH:
+		return "ssh-socket"
+	case ConnectorPipeSSH:
+		return "ssh-pipe"
+	case ConnectorSockAgentCygwinSSH:
+		return "ssh-cygwin"
+	case ConnectorExtraPort:
+		return "extra-port"
+	case ConnectorXShell:
+		return "xagent"
+	case ConnectorHvsockSSH:
+		return "hyperv-ssh"
+	case ConnectorHvsockExtra:
+		return "hyperv-extra"
+	case ConnectorNoise:
+		return "noise"
+	case ConnectorWebSocket:
+		return "websocket"
+	case ConnectorSockDirmngr:
+		return "dirmngr"
+	default:
+	}
+	return fmt.Sprintf("connector-%d", ct)
+}
+
+type action int
+
+const (
+	actionAllow action = iota
+	actionConfirm
+	actionConfirmOnce
+	actionDeny
+)
+
+func parseAction(s string) (action, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return actionAllow, nil
+	case "confirm":
+		return actionConfirm, nil
+	case "confirm_once":
+		return actionConfirmOnce, nil
+	case "deny":
+		return actionDeny, nil
+	default:
+	}
+	return actionDeny, fmt.Errorf("unknown policy action \"%s\", should be one of \"allow\", \"confirm\", \"confirm_once\" or \"deny\"", s)
+}
+
+func (a action) String() string {
+	switch a {
+	case actionAllow:
+		return "allow"
+	case actionConfirm:
+		return "confirm"
+	case actionConfirmOnce:
+		return "confirm_once"
+	default:
+	}
+	return "deny"
+}
+
+// request is operation policy decision is made for.
+type request struct {
+	connector ConnectorType
+	client    *ClientInfo
+	op        string
+	key       string
+	// user could answer with standing approval for client to use key
+	remember bool
+}
+
+type policyRule struct {
+	name       string
+	connectors []string
+	processes  []string
+	publishers []string
+	keys       []string
+	hours      *notify.WorkingHours
+	action     action
+}
+
+// matches checks all rule conditions except key.
+func (r *policyRule) matches(req *request, now time.Time) bool {
+	if len(r.connectors) > 0 {
+		found := false
+		for _, c := range r.connectors {
+			if ok, _ := filepath.Match(strings.ToLower(c), req.connector.ID()); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.processes) > 0 && (req.client == nil || !matchImage(r.processes, req.client.Image)) {
+		return false
+	}
+	if len(r.publishers) > 0 {
+		if req.client == nil {
+			return false
+		}
+		ok, err := matchPublisher(r.publishers, req.client)
+		if err != nil {
+			log.Printf("Policy rule \"%s\": %s", r.name, err)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return r.hours == nil || r.hours.Contains(now)
+}
+
+func (r *policyRule) matchesKey(key string) bool {
+	return matchKey(r.keys, key)
+}
+
+// matchKey checks key against list of ssh key fingerprints (case sensitive) or gpg keygrips.
+func matchKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key || (!strings.HasPrefix(k, "SHA256:") && strings.EqualFold(k, key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides which clients could connect and which key operations they could perform. Rules are evaluated in
+// order and first matching one wins, if no rule matches default action (deny unless configured otherwise) is taken.
+type Policy struct {
+	clients *clientPolicy
+	rules   []policyRule
+	def     action
+	active  bool
+	once    bool
+	// remote clients could sign and authenticate but not decrypt
+	denyRemoteDecrypt bool
+	// what to do with signatures requested over forwarded ssh connections
+	forwarding forwardGuard
+	// time ranges when key operations require confirmation or are denied
+	quietHours []quietRange
+	// limits of key operations per hour and day
+	quotas []keyQuota
+
+	// confirmations are asked with toast notification instead of message box
+	toast bool
+	// confirmations wait in single queue window instead of stacking dialogs one after another
+	queue bool
+	// confirmations require Windows credentials of current user, dlg helps to bring dialog to foreground
+	credui bool
+	dlg    util.DlgDetails
+	// status returns agent state, it is shown when user wants to know more before answering
+	status func() string
+	// "Always allow" answers are offered and remembered in approvals
+	remember  bool
+	approvals *approvalStore
+
+	confirm sync.Mutex // one confirmation dialog at a time
+	seen    map[string]bool
+}
+
+// NewPolicy prepares access policy from configuration, returns nil if there is nothing to enforce.
+func NewPolicy(cfg *config.GUIConfig) (*Policy, error) {
+	p := &Policy{
+		clients: newClientPolicy(&cfg.Clients),
+		active: len(cfg.Policy.Rules) > 0 || len(cfg.Policy.Default) > 0 || cfg.Policy.ConfirmFirstUse || cfg.Policy.DenyRemoteDecrypt ||
+			len(cfg.Policy.QuietHours) > 0 || len(cfg.Policy.Quotas) > 0,
+		once: cfg.Policy.ConfirmFirstUse,
+		seen: make(map[string]bool),
+
+		remember: cfg.Policy.Remember,
+
+		denyRemoteDecrypt: cfg.Policy.DenyRemoteDecrypt,
+	}
+	switch strings.ToLower(cfg.Policy.ConfirmWith) {
+	case "", "dialog":
+	case "toast":
+		p.toast = true
+	case "queue":
+		p.queue = true
+	case "credui":
+		p.credui, p.dlg = true, cfg.PinDlg
+	default:
+		return nil, fmt.Errorf("gui.policy.confirm_with: unknown value \"%s\", should be \"dialog\", \"toast\", \"queue\" or \"credui\"", cfg.Policy.ConfirmWith)
+	}
+	var err error
+	if p.forwarding, err = newForwardGuard(&cfg.Policy.Forwarding); err != nil {
+		return nil, err
+	}
+	if p.quietHours, err = newQuietRanges(cfg.Policy.QuietHours); err != nil {
+		return nil, err
+	}
+	if p.quotas, err = newKeyQuotas(cfg.Policy.Quotas); err != nil {
+		return nil, err
+	}
+	if !p.active {
+		if p.clients == nil && !p.forwarding.configured() {
+			return nil, nil
+		}
+		return p, nil
+	}
+
+	if len(cfg.Policy.Rules) > 0 {
+		p.def = actionDeny
+	}
+	if len(cfg.Policy.Default) > 0 {
+		if p.def, err = parseAction(cfg.Policy.Default); err != nil {
+			return nil, fmt.Errorf("gui.policy.default: %w", err)
+		}
+	}
+	for i, rc := range cfg.Policy.Rules {
+		r := policyRule{
+			name:       rc.Name,
+			connectors: rc.Connectors,
+			processes:  rc.Processes,
+			publishers: rc.Publishers,
+			keys:       rc.Keys,
+		}
+		if len(r.name) == 0 {
+			r.name = fmt.Sprintf("#%d", i+1)
+		}
+		var err error
+		if r.action, err = parseAction(rc.Action); err != nil {
+			return nil, fmt.Errorf("gui.policy rule %s: %w", r.name, err)
+		}
+		if len(rc.Hours) > 0 || len(rc.Days) > 0 {
+			hours, days := rc.Hours, rc.Days
+			if len(hours) == 0 {
+				hours = "00:00-00:00"
+			}
+			if len(days) == 0 {
+				days = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+			}
+			if r.hours, err = notify.ParseWorkingHours(hours, days); err != nil {
+				return nil, fmt.Errorf("gui.policy rule %s: %w", r.name, err)
+			}
+			if len(rc.Hours) == 0 {
+				// whole day
+				r.hours.To = 24 * time.Hour
+			}
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// decide returns action for request and name of the rule which produced it. When request has no key yet (connection
+// is being accepted) and first matching rule depends on key, decision is postponed to the key operation: actionAllow
+// is returned with final set to false.
+func (p *Policy) decide(req *request, now time.Time) (act action, rule string, final bool) {
+	if p == nil || !p.active {
+		return actionAllow, "", true
+	}
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.matches(req, now) {
+			continue
+		}
+		if len(r.keys) > 0 {
+			if len(req.key) == 0 {
+				return actionAllow, r.name, false
+			}
+			if !r.matchesKey(req.key) {
+				continue
+			}
+		}
+		return r.action, r.name, true
+	}
+	return p.def, "default", true
+}
+
+// ask shows confirmation dialog for key operation. With once set key is remembered until session is locked, so
+// subsequent operations with it proceed silently.
+func (p *Policy) ask(req *request, once bool) bool {
+	if p.queue {
+		if ok, answered := p.askQueue(req, once); answered {
+			return ok
+		}
+	}
+
+	p.confirm.Lock()
+	defer p.confirm.Unlock()
+
+	if once && p.seen[req.key] {
+		return true
+	}
+	var ok, always, answered bool
+	if p.toast {
+		ok, always, answered = p.askToast(req)
+	}
+	if p.credui {
+		ok, answered = p.askCredUI(req, once)
+	}
+	if !answered {
+		ok, always = p.askDialog(req, once)
+	}
+	if ok && once {
+		p.seen[req.key] = true
+	}
+	if always {
+		p.approvals.add(req.client, req.key)
+	}
+	return ok
+}
+
+// Buttons of approval dialog.
+const (
+	dlgAllowOnce = 100 + iota
+	dlgAlwaysAllow
+	dlgDeny
+)
+
+// dialogOutcome maps button pressed in approval dialog to decision. Only button saying so remembers approval, closing
+// dialog denies request.
+func dialogOutcome(button int) (ok, always bool) {
+	switch button {
+	case dlgAllowOnce:
+		return true, false
+	case dlgAlwaysAllow:
+		return true, true
+	default:
+	}
+	return false, false
+}
+
+// askDialog asks for confirmation with dialog which buttons say what they do, Deny is default. When request could be
+// remembered dialog has button to always allow it. Without task dialog plain message box is used, which never
+// remembers approval.
+func (p *Policy) askDialog(req *request, once bool) (ok, always bool) {
+	text := fmt.Sprintf("%s is requesting %s with key\n\n%s\n\nvia %s.", req.client, req.op, req.key, req.connector)
+	allow := "Allow this time"
+	if once {
+		text = fmt.Sprintf("First use of the key in this session.\n\n%s", text)
+		allow = "Allow until session is locked"
+	}
+	buttons := []util.TaskDialogButton{{ID: dlgAllowOnce, Text: allow}}
+	if req.remember {
+		buttons = append(buttons, util.TaskDialogButton{ID: dlgAlwaysAllow, Text: fmt.Sprintf("Always allow %s to use this key", req.client.Image)})
+	}
+	buttons = append(buttons, util.TaskDialogButton{ID: dlgDeny, Text: "Deny"})
+	button, err := util.AskTaskDialog(util.WinAgentName, fmt.Sprintf("Allow %s?", req.op), text, buttons, dlgDeny)
+	if err == nil {
+		return dialogOutcome(button)
+	}
+	log.Printf("Unable to ask for confirmation with task dialog: %s", err)
+	if util.MessageBox(util.WinAgentName, text+"\n\nAllow?", util.MB_YESNO|util.MB_ICONQUESTION|util.MB_SETFOREGROUND|util.MB_DEFBUTTON2) == util.IDYES {
+		return dialogOutcome(dlgAllowOnce)
+	}
+	return dialogOutcome(dlgDeny)
+}
+
+// askCredUI asks for confirmation with Windows credentials of current user, so approval could not be given by a stray
+// click or by another user at the keyboard. When dialog could not be used answered is false and message box should
+// be used instead.
+func (p *Policy) askCredUI(req *request, once bool) (ok, answered bool) {
+	text := fmt.Sprintf("%s is requesting %s with key %s via %s. Sign in to allow.", req.client, req.op, req.key, req.connector)
+	if once {
+		text += " Further requests with this key will be allowed until session is locked."
+	}
+	ok, err := util.ConfirmWithWindowsCredentials(p.dlg, util.WinAgentName, text)
+	if err != nil {
+		log.Printf("Unable to ask for confirmation with Windows credentials: %s", err)
+		return false, false
+	}
+	return ok, true
+}
+
+// askQueue adds confirmation to approval queue window, so parallel requests could be answered together instead of
+// waiting for each other. When window could not be used answered is false and message box should be used instead.
+func (p *Policy) askQueue(req *request, once bool) (ok, answered bool) {
+	p.confirm.Lock()
+	seen := once && p.seen[req.key]
+	p.confirm.Unlock()
+	if seen {
+		return true, true
+	}
+	var process string
+	if req.client != nil {
+		process = req.client.String()
+	}
+	decision, err := util.AskApproval(fmt.Sprintf("%s: %s with %s via %s", req.client, req.op, req.key, req.connector), process, req.remember, confirmTimeout)
+	if err != nil {
+		log.Printf("Unable to ask for confirmation in approval queue: %s", err)
+		return false, false
+	}
+	ok = decision != util.ApprovalDenied
+	if ok && once {
+		p.confirm.Lock()
+		p.seen[req.key] = true
+		p.confirm.Unlock()
+	}
+	if decision == util.ApprovalAlways {
+		p.approvals.add(req.client, req.key)
+	}
+	return ok, true
+}
+
+// confirmTimeout limits how long toast confirmation waits for user, request is denied after that.
+const confirmTimeout = 2 * time.Minute
+
+// askToast asks for confirmation with toast notification. When user wants to see agent status first or toasts are not
+// available answered is false and message box should be used instead.
+func (p *Policy) askToast(req *request) (ok, always, answered bool) {
+	text := fmt.Sprintf("%s is requesting %s with key %s via %s", req.client, req.op, req.key, req.connector)
+	choices := []string{"Allow once", "Deny", "Open status"}
+	if req.remember {
+		choices = append(choices, "Always allow")
+	}
+	choice, err := notify.Ask("policy", "Allow "+req.op+"?", text, choices, confirmTimeout)
+	if err != nil {
+		log.Printf("Unable to ask for confirmation with toast: %s", err)
+		return false, false, false
+	}
+	switch choice {
+	case 0:
+		return true, false, true
+	case 2:
+		if p.status != nil {
+			util.ShowOKMessage(util.MsgInformation, util.WinAgentName, p.status())
+		}
+		return false, false, false
+	case 3:
+		return true, true, true
+	default:
+	}
+	return false, false, true
+}
+
+// forget drops keys confirmed in this session.
+func (p *Policy) forget() {
+	if p == nil {
+		return
+	}
+	p.confirm.Lock()
+	defer p.confirm.Unlock()
+
+	if len(p.seen) > 0 {
+		log.Printf("Forgetting %d key(s) confirmed in this session", len(p.seen))
+		p.seen = make(map[string]bool)
+	}
+}
+
+// policyRef holds current policy, so it could be replaced while connectors are serving.
+type policyRef struct {
+	v atomic.Value
+	// survive policy reloads
+	quiet     quietOverride
+	quotas    quotaCounters
+	approvals *approvalStore
+}
+
+func (r *policyRef) get() *Policy {
+	if r == nil {
+		return nil
+	}
+	p, _ := r.v.Load().(*Policy)
+	return p
+}
+
+func (r *policyRef) set(p *Policy) {
+	r.v.Store(p)
+}
+
+// SetPolicy replaces access policy without restarting connectors.
+func (a *Agent) SetPolicy(cfg *config.GUIConfig) error {
+	p, err := NewPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		p.status, p.approvals = a.Status, a.policy.approvals
+	}
+	a.policy.set(p)
+	a.Cfg.GUI.Clients, a.Cfg.GUI.Policy = cfg.Clients, cfg.Policy
+	log.Print("Access policy has been updated")
+	return nil
+}
+
+// authorize evaluates policy for key operation asking user when rule requires confirmation. Remote is true when client
+// is on another machine or VM or comes through extra socket connector.
+func (c *Connector) authorize(ci *ClientInfo, op, key string, remote bool) error {
+	if len(key) == 0 {
+		key = "unknown key"
+	}
+	if err := c.checkUnlocked(ci, op, key); err != nil {
+		return err
+	}
+	p := c.policy.get()
+	if p == nil || !p.active {
+		return nil
+	}
+	if remote && op == "decrypt" && p.denyRemoteDecrypt {
+		err := fmt.Errorf("%s with key %s by %s denied, decryption is not allowed for remote clients", op, key, ci)
+		log.Printf("Rejecting request on %s: %s", c.index, err)
+		c.denied(err)
+		return err
+	}
+	if err := c.checkQuota(p, ci, op, key); err != nil {
+		return err
+	}
+	req := &request{connector: c.index, client: ci, op: op, key: key}
+	now := time.Now()
+	act, rule, _ := p.decide(req, now)
+	q, span, quiet := p.quiet(now)
+	quiet = quiet && !c.policy.quiet.active(now)
+	if quiet && act != actionDeny {
+		if q == actionDeny || act != actionConfirm {
+			act, rule = q, "quiet hours "+span
+		}
+	}
+	if act == actionAllow && p.once {
+		act = actionConfirmOnce
+	}
+
+	var err error
+	switch act {
+	case actionAllow:
+	case actionConfirm, actionConfirmOnce:
+		// remembered approvals do not answer for user who is away
+		if p.remember && !quiet && c.policy.approvals.allowed(ci, key) {
+			log.Printf("Allowing %s with key %s by %s on %s, approval is remembered", op, key, ci, c.index)
+			break
+		}
+		req.remember = p.remember && !quiet && rememberable(ci)
+		if !p.ask(req, act == actionConfirmOnce) {
+			err = fmt.Errorf("%s with key %s by %s was not confirmed", op, key, ci)
+		}
+	default:
+		err = fmt.Errorf("%s with key %s by %s denied by policy rule \"%s\"", op, key, ci, rule)
+	}
+	if err == nil {
+		c.countQuota(p, key)
+		return nil
+	}
+	log.Printf("Rejecting request on %s: %s", c.index, err)
+	c.denied(err)
+	return err
+}
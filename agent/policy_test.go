@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// policyConnector returns connector of type ct enforcing policy made from cfg.
+func policyConnector(t *testing.T, ct ConnectorType, cfg config.PolicyConfig) *Connector {
+	t.Helper()
+	p, err := NewPolicy(&config.GUIConfig{Policy: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConnector(ct, "", "", "", new(int32), nil)
+	c.policy = &policyRef{}
+	c.policy.set(p)
+	return c
+}
+
+func TestDenyRemoteDecrypt(t *testing.T) {
+	// local peer, as AF_UNIX socket or named pipe would be
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		ct     ConnectorType
+		denied bool
+	}{
+		{ConnectorSockAgent, false},
+		{ConnectorSockAgentBrowser, false},
+		{ConnectorSockAgentExtra, true},
+		{ConnectorExtraPort, true},
+		{ConnectorHvsockExtra, true},
+	} {
+		c := policyConnector(t, tc.ct, config.PolicyConfig{Default: "allow", DenyRemoteDecrypt: true})
+		remote := c.remoteKeyUse(conn)
+		if err := c.authorize(nil, "decrypt", "KEYGRIP", remote); (err != nil) != tc.denied {
+			t.Errorf("%s: decrypt denied %t, expected %t", tc.ct, err != nil, tc.denied)
+		}
+		if err := c.authorize(nil, "sign", "KEYGRIP", remote); err != nil {
+			t.Errorf("%s: sign denied: %s", tc.ct, err)
+		}
+	}
+}
+
+func TestQuotaCountsAuthorizedOnly(t *testing.T) {
+	c := policyConnector(t, ConnectorSockAgent, config.PolicyConfig{
+		Default: "allow",
+		Quotas:  []config.QuotaConfig{{Hourly: 1}},
+		Rules:   []config.PolicyRuleConfig{{Keys: []string{"DENIED"}, Action: "deny"}},
+	})
+	used := func(key string) int {
+		qc := &c.policy.quotas
+		qc.mu.Lock()
+		defer qc.mu.Unlock()
+		return qc.current(key).inHour
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.authorize(nil, "sign", "DENIED", false); err == nil {
+			t.Fatal("operation should be denied by rule")
+		}
+	}
+	if n := used("DENIED"); n != 0 {
+		t.Fatalf("denied operations used up %d of quota", n)
+	}
+
+	if err := c.authorize(nil, "sign", "ALLOWED", false); err != nil {
+		t.Fatalf("first operation denied: %s", err)
+	}
+	if n := used("ALLOWED"); n != 1 {
+		t.Fatalf("allowed operation counted %d times", n)
+	}
+	if err := c.authorize(nil, "sign", "ALLOWED", false); err == nil {
+		t.Fatal("operation over hourly quota should be denied")
+	}
+	if n := used("ALLOWED"); n != 1 {
+		t.Fatalf("operation denied by quota was counted, usage %d", n)
+	}
+}
+
+func TestDialogOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		button     int
+		ok, always bool
+	}{
+		{"allow once", dlgAllowOnce, true, false},
+		{"always allow", dlgAlwaysAllow, true, true},
+		{"deny", dlgDeny, false, false},
+		{"closed", util.IDCANCEL, false, false},
+		{"message box no", util.IDNO, false, false},
+		{"message box yes", util.IDYES, false, false},
+	} {
+		if ok, always := dialogOutcome(tc.button); ok != tc.ok || always != tc.always {
+			t.Errorf("%s: got ok %t always %t, want ok %t always %t", tc.name, ok, always, tc.ok, tc.always)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+const (
+	// defaultPoolHealth is interval of idle connection checks.
+	defaultPoolHealth = 30 * time.Second
+	// poolWait limits how long client waits for its turn when all gpg-agent connections are busy.
+	poolWait = time.Minute
+	// resetTimeout limits time spent on talking to gpg-agent over idle connection.
+	resetTimeout = 5 * time.Second
+	// maxAccepted limits number of remembered OPTION lines, option values (ttyname, putenv) may differ every time.
+	maxAccepted = 256
+)
+
+// idleConn is gpg-agent connection kept for next client.
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+	// options previous client has set, see optionKey
+	options string
+}
+
+// optionKey identifies set of OPTION lines connection carries, empty for connection nobody has set options on.
+func optionKey(options []string) string {
+	return strings.Join(options, "\n")
+}
+
+// PoolStats is a snapshot of upstream pool counters.
+type PoolStats struct {
+	Idle   int   `json:"idle"`
+	Open   int   `json:"open"`
+	Dialed int64 `json:"dialed"`
+	Reused int64 `json:"reused"`
+	Waited int64 `json:"waited,omitempty"`
+	Failed int64 `json:"failed_checks,omitempty"`
+}
+
+// upstreamPool keeps authenticated connections to gpg-agent socket ready for clients, so bursts of short lived ssh and
+// gpg invocations do not pay for dialing and nonce exchange every time. Idle connections are checked periodically and
+// replaced when gpg-agent stops answering. Number of connections open to gpg-agent at once could be limited, clients
+// waiting for one are served in order of arrival. Options clients set stay with connection after RESET, so connection
+// only goes to client setting exactly the same options (gpg, gpgsm and ssh send the same ones every time).
+type upstreamPool struct {
+	size   int
+	health time.Duration
+	batch  *batchMode
+	dial   func(id int64) (net.Conn, error)
+
+	// connections clients are using, idle ones are not counted
+	conns slots
+
+	mu       sync.Mutex
+	idle     []idleConn
+	greeting []byte
+	// OPTION lines gpg-agent has accepted, session answers them itself until it knows which connection to take
+	accepted map[string]bool
+	dialed   int64
+	reused   int64
+	failed   int64
+
+	// maintenance runs only while there is something to maintain, so idle agent does not wake up
+	running bool
+	closed  bool
+	stop    chan struct{}
+}
+
+// newUpstreamPool prepares pool for connector. Batch mode keeps connections even when pool size is 0.
+func newUpstreamPool(cfg *config.PoolConfig, batch *batchMode, dial func(id int64) (net.Conn, error)) *upstreamPool {
+	p := &upstreamPool{size: cfg.Size, health: cfg.Health, batch: batch, dial: dial, stop: make(chan struct{}),
+		conns: slots{max: cfg.Max, wait: poolWait, what: "gpg-agent connections"}}
+	if p.health <= 0 {
+		p.health = defaultPoolHealth
+	}
+	return p
+}
+
+// capacity returns number of idle connections pool keeps now.
+func (p *upstreamPool) capacity() int {
+	n := p.size
+	if p.batch.on() && p.batch.connections > n {
+		n = p.batch.connections
+	}
+	return n
+}
+
+// reusable checks if connection client is done with should be returned to the pool.
+func (p *upstreamPool) reusable() bool {
+	return p != nil && p.capacity() > 0
+}
+
+// get returns gpg-agent connection nobody has set options on and its greeting. Idle connection is taken if there is
+// one, otherwise new one is dialed. When connection limit is reached caller waits for its turn. Every successful get
+// must be followed by put.
+func (p *upstreamPool) get(id int64) (net.Conn, []byte, error) {
+	if _, err := p.reserve(id); err != nil {
+		return nil, nil, err
+	}
+	conn, greeting, err := p.bind(id, nil)
+	if err != nil {
+		p.conns.release()
+		return nil, nil, err
+	}
+	return conn, greeting, nil
+}
+
+// deferred checks if client could be greeted before it is known which connection it gets - greeting is known.
+func (p *upstreamPool) deferred() bool {
+	if !p.reusable() {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.greeting != nil
+}
+
+// reserve waits for connection slot and returns greeting of gpg-agent if it is known. Connection itself is taken by
+// bind, slot is freed by put.
+func (p *upstreamPool) reserve(id int64) ([]byte, error) {
+	p.mu.Lock()
+	if p.size > 0 {
+		// pool is topped up in background
+		p.wake()
+	}
+	greeting := p.greeting
+	p.mu.Unlock()
+
+	if err := p.conns.acquire(id); err != nil {
+		return nil, err
+	}
+	return greeting, nil
+}
+
+// take removes idle connection with given options from pool, most recently used first as it is least likely to be
+// stale.
+func (p *upstreamPool) take(key string) (idleConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		if ic := p.idle[i]; ic.options == key {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return ic, true
+		}
+	}
+	return idleConn{}, false
+}
+
+// known checks if gpg-agent has accepted OPTION line before.
+func (p *upstreamPool) known(option string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted[option]
+}
+
+// bind returns gpg-agent connection with options set for client reserve was called for: idle connection with exactly
+// the same options if there is one, otherwise idle or new connection nobody has set options on, with options sent to
+// gpg-agent.
+func (p *upstreamPool) bind(id int64, options []string) (net.Conn, []byte, error) {
+	for _, key := range []string{optionKey(options), ""} {
+		for {
+			ic, ok := p.take(key)
+			if !ok {
+				break
+			}
+			if time.Since(ic.since) > p.health && !p.check(ic.conn) {
+				continue
+			}
+			if len(key) == 0 && len(options) > 0 {
+				if err := command(ic.conn, options...); err != nil {
+					log.Printf("[%d] Unable to set options on gpg-agent connection: %s", id, err.Error())
+					ic.conn.Close()
+					continue
+				}
+			}
+			p.mu.Lock()
+			p.reused++
+			greeting := p.greeting
+			p.mu.Unlock()
+			if p.batch.on() {
+				p.batch.reuse()
+			}
+			log.Printf("[%d] Reusing gpg-agent connection", id)
+			return ic.conn, greeting, nil
+		}
+		if len(options) == 0 {
+			break
+		}
+	}
+
+	conn, greeting, err := p.connect(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := command(conn, options...); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unable to set options: %w", err)
+	}
+	return conn, greeting, nil
+}
+
+// connect dials new authenticated gpg-agent connection.
+func (p *upstreamPool) connect(id int64) (net.Conn, []byte, error) {
+	conn, greeting, err := dialGreeting(id, p.dial)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.mu.Lock()
+	p.greeting = greeting
+	p.dialed++
+	p.mu.Unlock()
+	return conn, greeting, nil
+}
+
+// dialGreeting dials Assuan server and reads its greeting.
+func dialGreeting(id int64, dial func(id int64) (net.Conn, error)) (net.Conn, []byte, error) {
+	conn, err := dial(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(resetTimeout))
+	greeting, err := readAssuanLine(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unable to read greeting: %w", err)
+	}
+	return conn, greeting, nil
+}
+
+// put returns connection client is done with. Connection is reset and kept if pool has room for it, otherwise it is
+// closed. RESET keeps options, so they are remembered with connection. Nil conn only frees connection slot.
+func (p *upstreamPool) put(id int64, conn net.Conn, options []string) {
+	defer p.conns.release()
+	if conn == nil {
+		return
+	}
+
+	p.mu.Lock()
+	full := len(p.idle) >= p.capacity()
+	p.mu.Unlock()
+	if full {
+		conn.Close()
+		return
+	}
+
+	if err := command(conn, "RESET"); err != nil {
+		log.Printf("[%d] Unable to reset gpg-agent connection: %s", id, err.Error())
+		conn.Close()
+		return
+	}
+	p.mu.Lock()
+	if p.accepted == nil || len(p.accepted) >= maxAccepted {
+		p.accepted = make(map[string]bool)
+	}
+	for _, o := range options {
+		p.accepted[o] = true
+	}
+	p.mu.Unlock()
+	p.keep(conn, optionKey(options))
+}
+
+// keep adds connection to idle list, closing it if there is no room.
+func (p *upstreamPool) keep(conn net.Conn, options string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.capacity() {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now(), options: options})
+	p.wake()
+}
+
+// wake starts maintenance if it is not running. Must be called with mutex held.
+func (p *upstreamPool) wake() {
+	if !p.running && !p.closed {
+		p.running = true
+		go p.maintain()
+	}
+}
+
+// command sends commands over idle connection and checks that all of them succeed.
+func command(conn net.Conn, cmds ...string) error {
+	_ = conn.SetDeadline(time.Now().Add(resetTimeout))
+	defer conn.SetDeadline(time.Time{}) //nolint:errcheck
+	for _, cmd := range cmds {
+		if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+			return err
+		}
+		reply, err := readAssuanLine(conn)
+		if err != nil {
+			return err
+		}
+		if assuanVerb(reply) != "OK" {
+			return fmt.Errorf("%s: %s", cmd, string(reply))
+		}
+	}
+	return nil
+}
+
+// check makes sure idle connection is still alive, closing it if it is not.
+func (p *upstreamPool) check(conn net.Conn) bool {
+	if err := command(conn, "NOP"); err != nil {
+		log.Printf("Dropping stale gpg-agent connection: %s", err)
+		conn.Close()
+		p.mu.Lock()
+		p.failed++
+		p.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// maintain periodically checks idle connections and dials new ones up to configured size, it stops when pool is empty
+// and there is nothing to top up.
+func (p *upstreamPool) maintain() {
+	t := time.NewTicker(p.health)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+		for _, ic := range idle {
+			if p.check(ic.conn) {
+				p.keep(ic.conn, ic.options)
+			}
+		}
+
+		for {
+			p.mu.Lock()
+			n := len(p.idle)
+			p.mu.Unlock()
+			if n >= p.size {
+				break
+			}
+			conn, _, err := p.connect(0)
+			if err != nil {
+				// gpg-agent may be restarting, try on next tick
+				break
+			}
+			p.keep(conn, "")
+		}
+
+		p.mu.Lock()
+		if len(p.idle) == 0 && p.size == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// drop closes all idle connections. gpg-agent may have been replaced, so accepted options are forgotten too.
+func (p *upstreamPool) drop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ic := range p.idle {
+		ic.conn.Close()
+	}
+	p.idle = nil
+	p.accepted = nil
+}
+
+// close stops pool maintenance and closes idle connections.
+func (p *upstreamPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.stop)
+	}
+	p.mu.Unlock()
+	p.drop()
+}
+
+// String formats pool counters in single line.
+func (ps *PoolStats) String() string {
+	res := fmt.Sprintf("open %d, idle %d, dialed %d, reused %d", ps.Open, ps.Idle, ps.Dialed, ps.Reused)
+	if ps.Waited > 0 || ps.Failed > 0 {
+		res += fmt.Sprintf(" (waited %d, failed checks %d)", ps.Waited, ps.Failed)
+	}
+	return res
+}
+
+// snapshot returns pool counters, nil for connectors without pool.
+func (p *upstreamPool) snapshot() *PoolStats {
+	if p == nil {
+		return nil
+	}
+	conns := p.conns.snapshot()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &PoolStats{Idle: len(p.idle), Open: conns.Active, Dialed: p.dialed, Reused: p.reused, Waited: conns.Waited, Failed: p.failed}
+}
+
+// interruptRead makes read pending on conn return and waits for reader to finish.
+func interruptRead(conn net.Conn, done <-chan struct{}) {
+	for {
+		// relay may set its own deadline between reads, so keep pushing
+		_ = conn.SetReadDeadline(time.Now())
+		select {
+		case <-done:
+			_ = conn.SetReadDeadline(time.Time{})
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+// fakeUpstream dials in-memory gpg-agent which greets and answers OK to every command.
+func fakeUpstream(dialed *int32) func(id int64) (net.Conn, error) {
+	return func(id int64) (net.Conn, error) {
+		atomic.AddInt32(dialed, 1)
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			if _, err := io.WriteString(server, "OK Pleased to meet you\n"); err != nil {
+				return
+			}
+			sc := bufio.NewScanner(server)
+			for sc.Scan() {
+				if _, err := io.WriteString(server, "OK\n"); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}
+}
+
+// gpgOptions are options gpg sends to gpg-agent right after connecting.
+func gpgOptions(tty string) []string {
+	return []string{
+		"OPTION ttyname=" + tty,
+		"OPTION ttytype=xterm-256color",
+		"OPTION display=:0",
+		"OPTION lc-ctype=en_US.UTF-8",
+		"OPTION lc-messages=en_US.UTF-8",
+		"OPTION allow-pinentry-notify",
+		"OPTION agent-awareness=2.1.0",
+	}
+}
+
+// poolClient talks to gpg-agent from pool the way handleAssuanRequest does and returns connection it ended up with.
+// Lines answered by session itself are counted in local.
+func poolClient(t *testing.T, c *Connector, id int64, lines []string) (conn net.Conn, local int) {
+	t.Helper()
+	s := &assuanSession{agent: io.Discard}
+	if c.pool.deferred() {
+		if _, err := c.pool.reserve(id); err != nil {
+			t.Fatal(err)
+		}
+		s.known = c.pool.known
+		s.bind = func(options []string) (err error) {
+			conn, _, err = c.pool.bind(id, options)
+			return err
+		}
+	} else {
+		var err error
+		if conn, _, err = c.pool.get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range lines {
+		var reply bytes.Buffer
+		if !s.clientLine([]byte(l+"\n"), &reply) {
+			if reply.String() != "OK\n" {
+				t.Fatalf("%q: unexpected reply %q", l, reply.String())
+			}
+			local++
+			continue
+		}
+		s.agentLine([]byte("OK\n"))
+	}
+	if conn == nil {
+		t.Fatal("session did not connect to gpg-agent")
+	}
+	if !c.keepUpstream(s, false) {
+		t.Fatal("idle connection is not kept")
+	}
+	if c.keepUpstream(s, true) {
+		t.Fatal("connection with announced TTY is kept")
+	}
+	c.done(id, conn, s.optionSet())
+	return conn, local
+}
+
+func TestPoolReusesConnectionsWithSameOptions(t *testing.T) {
+	var dialed int32
+	c := NewConnector(ConnectorSockAgent, "", "", "", new(int32), nil)
+	c.pool = newUpstreamPool(&config.PoolConfig{Size: 2}, nil, fakeUpstream(&dialed))
+	defer c.pool.close()
+
+	gpg := append(gpgOptions("/dev/pts/1"), "HAVEKEY 0123ABCD")
+	first, local := poolClient(t, c, 1, gpg)
+	if local != 0 {
+		t.Fatalf("first client got %d local replies", local)
+	}
+
+	// the same options are answered by session and connection which has them is taken
+	next, local := poolClient(t, c, 2, gpg)
+	if next != first || local != len(gpg)-1 || atomic.LoadInt32(&dialed) != 1 {
+		t.Fatalf("connection reused %t, local replies %d, dialed %d", next == first, local, dialed)
+	}
+
+	// client on another terminal must not get ttyname of the first one
+	other, _ := poolClient(t, c, 3, append(gpgOptions("/dev/pts/2"), "HAVEKEY 0123ABCD"))
+	if other == first || atomic.LoadInt32(&dialed) != 2 {
+		t.Fatalf("connection with other ttyname reused %t, dialed %d", other == first, dialed)
+	}
+
+	// client without options gets neither
+	plain, _ := poolClient(t, c, 4, []string{"GETINFO version"})
+	if plain == first || plain == other {
+		t.Fatal("connection with options given to client without them")
+	}
+	if atomic.LoadInt32(&dialed) != 3 {
+		t.Fatalf("dialed %d connections", dialed)
+	}
+}
+
+func TestPoolReplaysOptionsOnCleanConnection(t *testing.T) {
+	var dialed int32
+	c := NewConnector(ConnectorSockAgent, "", "", "", new(int32), nil)
+	c.pool = newUpstreamPool(&config.PoolConfig{Size: 2}, nil, fakeUpstream(&dialed))
+	defer c.pool.close()
+
+	poolClient(t, c, 1, append(gpgOptions("/dev/pts/1"), "HAVEKEY 0123ABCD"))
+	clean, _ := poolClient(t, c, 2, []string{"GETINFO version"})
+
+	// options gpg-agent has seen before, but not this set of them - clean connection gets them
+	options := gpgOptions("/dev/pts/1")[:5]
+	conn, local := poolClient(t, c, 3, append(options, "GETINFO version"))
+	if conn != clean || local != len(options) || atomic.LoadInt32(&dialed) != 2 {
+		t.Fatalf("clean connection reused %t, local replies %d, dialed %d", conn == clean, local, dialed)
+	}
+	if next, _ := poolClient(t, c, 4, append(options, "GETINFO version")); next != clean {
+		t.Fatal("connection with replayed options was not reused for the same options")
+	}
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/windows"
+)
+
+// sshAgentIdentitiesAnswer is SSH_AGENT_IDENTITIES_ANSWER message type.
+const sshAgentIdentitiesAnswer = 12
+
+// PublicKey is key which could be shared with other devices: ssh key in authorized_keys format or OpenPGP key
+// fingerprint.
+type PublicKey struct {
+	// Label is short description shown to user
+	Label string `json:"label"`
+	// Text is what is given away: authorized_keys line or fingerprint
+	Text string `json:"text"`
+}
+
+// SSHKeys lists public keys ssh clients are offered.
+func (a *Agent) SSHKeys() ([]PublicKey, error) {
+	resp, err := sshBackend([]byte{11})
+	if err != nil {
+		return nil, fmt.Errorf("unable to request ssh identities: %w", err)
+	}
+	if len(resp) < 5 || resp[0] != sshAgentIdentitiesAnswer {
+		return nil, errors.New("unexpected answer to ssh identities request")
+	}
+	n, rest := binary.BigEndian.Uint32(resp[1:5]), resp[5:]
+	var res []PublicKey
+	for i := uint32(0); i < n; i++ {
+		blob, next, ok := sshString(rest)
+		if !ok {
+			return nil, errors.New("bad ssh identities answer")
+		}
+		comment, next, ok := sshString(next)
+		if !ok {
+			return nil, errors.New("bad ssh identities answer")
+		}
+		rest = next
+		pk, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			// keys of unknown types are not an error, they just could not be shown
+			continue
+		}
+		text := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+		if len(comment) > 0 {
+			text += " " + string(comment)
+		}
+		label := fmt.Sprintf("%s %s", pk.Type(), ssh.FingerprintSHA256(pk))
+		if len(comment) > 0 {
+			label = fmt.Sprintf("%s (%s)", label, comment)
+		}
+		res = append(res, PublicKey{Label: label, Text: text})
+	}
+	return res, nil
+}
+
+// PGPKeys lists fingerprints of OpenPGP secret keys in GnuPG home.
+func (a *Agent) PGPKeys() ([]PublicKey, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	cmd := exec.Command(filepath.Join(filepath.Dir(a.Exe), "gpg.exe"), "--homedir", a.Cfg.GPG.Home,
+		"--batch", "--with-colons", "--fixed-list-mode", "--list-secret-keys")
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list secret keys: %w", err)
+	}
+	return parseSecretKeys(string(out)), nil
+}
+
+// unescapeColons decodes \xNN escapes gpg uses in --with-colons field values.
+func unescapeColons(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseSecretKeys takes primary key fingerprints and first user ids from gpg --with-colons output.
+func parseSecretKeys(out string) []PublicKey {
+	var (
+		res     []PublicKey
+		cur     *PublicKey
+		primary bool
+	)
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(strings.TrimRight(line, "\r"), ":")
+		if len(f) < 10 {
+			continue
+		}
+		switch f[0] {
+		case "sec":
+			res = append(res, PublicKey{})
+			cur, primary = &res[len(res)-1], true
+		case "ssb":
+			primary = false
+		case "fpr":
+			if cur != nil && primary && len(cur.Text) == 0 {
+				cur.Text = f[9]
+			}
+		case "uid":
+			if cur != nil && len(cur.Label) == 0 {
+				cur.Label = unescapeColons(f[9])
+			}
+		default:
+		}
+	}
+	keys := res[:0]
+	for _, k := range res {
+		if len(k.Text) == 0 {
+			continue
+		}
+		switch {
+		case len(k.Label) == 0:
+			k.Label = k.Text
+		case len(k.Text) > 16:
+			k.Label = fmt.Sprintf("%s (%s)", k.Label, k.Text[len(k.Text)-16:])
+		default:
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
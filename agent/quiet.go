@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// quietRange is time range during which key operations require confirmation or are denied, catching automation
+// misusing agent while user is away.
+type quietRange struct {
+	span   string
+	hours  *notify.WorkingHours
+	action action
+}
+
+func newQuietRanges(cfg []config.QuietHoursConfig) ([]quietRange, error) {
+	var res []quietRange
+	for i, qc := range cfg {
+		days := qc.Days
+		if len(days) == 0 {
+			days = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+		}
+		hours, err := notify.ParseWorkingHours(qc.Hours, days)
+		if err != nil {
+			return nil, fmt.Errorf("gui.policy.quiet_hours #%d: %w", i+1, err)
+		}
+		q := quietRange{span: qc.Hours, hours: hours, action: actionConfirm}
+		switch strings.ToLower(qc.Action) {
+		case "", "confirm":
+		case "deny":
+			q.action = actionDeny
+		default:
+			return nil, fmt.Errorf("gui.policy.quiet_hours #%d: unknown action \"%s\", should be \"confirm\" or \"deny\"", i+1, qc.Action)
+		}
+		res = append(res, q)
+	}
+	return res, nil
+}
+
+// quiet returns strictest action of quiet ranges containing t and the range itself, ok is false outside of quiet
+// hours.
+func (p *Policy) quiet(t time.Time) (act action, span string, ok bool) {
+	for _, q := range p.quietHours {
+		if !q.hours.Contains(t) {
+			continue
+		}
+		if !ok || q.action == actionDeny {
+			act, span, ok = q.action, q.span, true
+		}
+	}
+	return act, span, ok
+}
+
+// quietEnd finds when quiet hours containing t are over.
+func (p *Policy) quietEnd(t time.Time) time.Time {
+	end := t.Truncate(time.Minute)
+	for i := 0; i < 7*24*60; i++ {
+		if _, _, ok := p.quiet(end); !ok {
+			break
+		}
+		end = end.Add(time.Minute)
+	}
+	return end
+}
+
+// quietOverride suspends quiet hours from tray menu until current quiet period is over.
+type quietOverride struct {
+	mu     sync.Mutex
+	until  time.Time
+	timer  *time.Timer
+	report func(on bool)
+}
+
+func (o *quietOverride) active(t time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return t.Before(o.until)
+}
+
+// QuietHoursState describes quiet hours policy.
+type QuietHoursState struct {
+	Configured bool      `json:"configured"`
+	Active     bool      `json:"active"`
+	Action     string    `json:"action,omitempty"`
+	Hours      string    `json:"hours,omitempty"`
+	Overridden time.Time `json:"overridden_until,omitempty"`
+}
+
+// String formats quiet hours state in single line.
+func (qs *QuietHoursState) String() string {
+	switch {
+	case !qs.Configured:
+		return "not configured"
+	case !qs.Overridden.IsZero():
+		return fmt.Sprintf("%s (%s), ignored until %s", qs.Hours, qs.Action, qs.Overridden.Format("15:04"))
+	case qs.Active:
+		what := "require confirmation"
+		if qs.Action == actionDeny.String() {
+			what = "are denied"
+		}
+		return fmt.Sprintf("%s now, key operations %s", qs.Hours, what)
+	default:
+	}
+	return "not now"
+}
+
+// QuietHours returns state of quiet hours policy.
+func (a *Agent) QuietHours() QuietHoursState {
+	p := a.policy.get()
+	if p == nil || len(p.quietHours) == 0 {
+		return QuietHoursState{}
+	}
+	now := time.Now()
+	qs := QuietHoursState{Configured: true}
+	var act action
+	act, qs.Hours, qs.Active = p.quiet(now)
+	if qs.Active {
+		qs.Action = act.String()
+		if a.policy.quiet.active(now) {
+			o := &a.policy.quiet
+			o.mu.Lock()
+			qs.Overridden = o.until
+			o.mu.Unlock()
+		}
+	}
+	return qs
+}
+
+// OverrideQuietHours makes key operations follow regular policy until current quiet period is over, or restores
+// quiet hours.
+func (a *Agent) OverrideQuietHours(on bool) error {
+	o := &a.policy.quiet
+	p := a.policy.get()
+	now := time.Now()
+
+	o.mu.Lock()
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	o.until = time.Time{}
+	if on {
+		if p == nil {
+			o.mu.Unlock()
+			return fmt.Errorf("quiet hours are not configured")
+		}
+		if _, _, ok := p.quiet(now); !ok {
+			o.mu.Unlock()
+			return fmt.Errorf("it is not quiet hours now")
+		}
+		o.until = p.quietEnd(now)
+		o.timer = time.AfterFunc(o.until.Sub(now), func() {
+			log.Print("Quiet hours override has expired")
+			_ = a.OverrideQuietHours(false)
+		})
+	}
+	report, until := o.report, o.until
+	o.mu.Unlock()
+
+	if on {
+		log.Printf("Quiet hours are ignored until %s", until.Format("15:04"))
+	} else {
+		log.Print("Quiet hours are enforced")
+	}
+	if report != nil {
+		report(on)
+	}
+	return nil
+}
+
+// OnQuietOverride sets function called when quiet hours override is switched.
+func (a *Agent) OnQuietOverride(f func(on bool)) {
+	a.policy.quiet.mu.Lock()
+	defer a.policy.quiet.mu.Unlock()
+	a.policy.quiet.report = f
+}
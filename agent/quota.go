@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// keyQuota limits number of operations with keys per clock hour and per day - tripwire for runaway automation or
+// compromised client hammering the agent.
+type keyQuota struct {
+	keys   []string
+	hourly int
+	daily  int
+	warn   bool
+}
+
+func newKeyQuotas(cfg []config.QuotaConfig) ([]keyQuota, error) {
+	var res []keyQuota
+	for i, qc := range cfg {
+		q := keyQuota{keys: qc.Keys, hourly: qc.Hourly, daily: qc.Daily}
+		if q.hourly < 0 || q.daily < 0 || q.hourly == 0 && q.daily == 0 {
+			return nil, fmt.Errorf("gui.policy.quotas #%d: hourly or daily limit has to be positive", i+1)
+		}
+		switch strings.ToLower(qc.Action) {
+		case "", "deny":
+		case "warn":
+			q.warn = true
+		default:
+			return nil, fmt.Errorf("gui.policy.quotas #%d: unknown action \"%s\", should be \"deny\" or \"warn\"", i+1, qc.Action)
+		}
+		res = append(res, q)
+	}
+	return res, nil
+}
+
+func (q *keyQuota) matches(key string) bool {
+	return len(q.keys) == 0 || matchKey(q.keys, key)
+}
+
+// keyUsage counts operations with single key in current hour and day.
+type keyUsage struct {
+	hour, day            time.Time
+	inHour, inDay        int
+	reportedH, reportedD bool
+}
+
+// roll starts new hour and day buckets when clock moved on.
+func (u *keyUsage) roll(now time.Time) {
+	if h := now.Truncate(time.Hour); !h.Equal(u.hour) {
+		u.hour, u.inHour, u.reportedH = h, 0, false
+	}
+	y, m, d := now.Date()
+	if day := time.Date(y, m, d, 0, 0, 0, 0, now.Location()); !day.Equal(u.day) {
+		u.day, u.inDay, u.reportedD = day, 0, false
+	}
+}
+
+// quotaCounters keep key usage across policy reloads.
+type quotaCounters struct {
+	mu    sync.Mutex
+	usage map[string]*keyUsage
+}
+
+// KeyQuotaUsage describes operations made with key in current hour and day.
+type KeyQuotaUsage struct {
+	Key    string `json:"key"`
+	Hour   int    `json:"hour"`
+	Hourly int    `json:"hourly,omitempty"`
+	Day    int    `json:"day"`
+	Daily  int    `json:"daily,omitempty"`
+}
+
+// String formats key usage in single line.
+func (ku *KeyQuotaUsage) String() string {
+	limit := func(n int) string {
+		if n == 0 {
+			return "-"
+		}
+		return strconv.Itoa(n)
+	}
+	return fmt.Sprintf("%s: %d of %s this hour, %d of %s today", ku.Key, ku.Hour, limit(ku.Hourly), ku.Day, limit(ku.Daily))
+}
+
+// limits returns strictest hourly and daily limits applying to key and if exceeding them is only warned about.
+func (p *Policy) limits(key string) (hourly, daily int, warn, ok bool) {
+	warn = true
+	for i := range p.quotas {
+		q := &p.quotas[i]
+		if !q.matches(key) {
+			continue
+		}
+		ok = true
+		if q.hourly > 0 && (hourly == 0 || q.hourly < hourly) {
+			hourly = q.hourly
+		}
+		if q.daily > 0 && (daily == 0 || q.daily < daily) {
+			daily = q.daily
+		}
+		warn = warn && q.warn
+	}
+	return hourly, daily, warn, ok
+}
+
+// current returns usage of key in current hour and day. Must be called with mutex held.
+func (qc *quotaCounters) current(key string) *keyUsage {
+	if qc.usage == nil {
+		qc.usage = make(map[string]*keyUsage)
+	}
+	u, found := qc.usage[key]
+	if !found {
+		u = &keyUsage{}
+		qc.usage[key] = u
+	}
+	u.roll(time.Now())
+	return u
+}
+
+// checkQuota rejects operation with key when quota is exceeded. First operation over every limit is notified once per
+// hour or day. Operation is counted by countQuota only after it is authorized.
+func (c *Connector) checkQuota(p *Policy, ci *ClientInfo, op, key string) error {
+	hourly, daily, warn, ok := p.limits(key)
+	if !ok {
+		return nil
+	}
+
+	qc := &c.policy.quotas
+	qc.mu.Lock()
+	u := qc.current(key)
+	var over, report string
+	switch {
+	case hourly > 0 && u.inHour >= hourly:
+		over = fmt.Sprintf("hourly quota of %d", hourly)
+		if !u.reportedH {
+			u.reportedH, report = true, over
+		}
+	case daily > 0 && u.inDay >= daily:
+		over = fmt.Sprintf("daily quota of %d", daily)
+		if !u.reportedD {
+			u.reportedD, report = true, over
+		}
+	default:
+	}
+	qc.mu.Unlock()
+
+	if len(report) > 0 {
+		text := fmt.Sprintf("key %s exceeded %s operations (%s by %s via %s)", key, report, op, ci, c.index)
+		if !warn {
+			text += ", further operations are denied"
+		}
+		log.Printf("Quota: %s", text)
+		notify.Notify(notify.Quota, "Key quota exceeded", text, "key", key, "connector", c.index.String(), "quota", report)
+	}
+	if len(over) == 0 || warn {
+		return nil
+	}
+	err := fmt.Errorf("%s with key %s by %s denied, %s operations is exceeded", op, key, ci, over)
+	log.Printf("Rejecting request on %s: %s", c.index, err)
+	c.denied(err)
+	return err
+}
+
+// countQuota counts authorized operation with key, so operations denied by policy or not confirmed by user do not use
+// up quota.
+func (c *Connector) countQuota(p *Policy, key string) {
+	if _, _, _, ok := p.limits(key); !ok {
+		return
+	}
+	qc := &c.policy.quotas
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	u := qc.current(key)
+	u.inHour++
+	u.inDay++
+}
+
+// QuotaUsage returns usage of keys which have quotas in current hour and day.
+func (a *Agent) QuotaUsage() []KeyQuotaUsage {
+	p := a.policy.get()
+	if p == nil || len(p.quotas) == 0 {
+		return nil
+	}
+	qc := &a.policy.quotas
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	now := time.Now()
+	var res []KeyQuotaUsage
+	for key, u := range qc.usage {
+		hourly, daily, _, ok := p.limits(key)
+		if !ok {
+			continue
+		}
+		u.roll(now)
+		res = append(res, KeyQuotaUsage{Key: key, Hour: u.inHour, Hourly: hourly, Day: u.inDay, Daily: daily})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
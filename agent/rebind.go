@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// upstreamSettle is how long after gpg-agent exits or could not be dialed socket is checked, tool which killed it may be
+// starting its own one.
+const upstreamSettle = 2 * time.Second
+
+// socketStamp identifies gpg-agent instance behind socket file. On Windows socket is emulated: file keeps TCP port and
+// nonce, both are new every time gpg-agent starts.
+type socketStamp struct {
+	data []byte
+	mod  time.Time
+}
+
+func readSocketStamp(path string) (socketStamp, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return socketStamp{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return socketStamp{}, false
+	}
+	return socketStamp{data: data, mod: fi.ModTime()}, true
+}
+
+func (s socketStamp) same(o socketStamp) bool {
+	return bytes.Equal(s.data, o.data) && s.mod.Equal(o.mod)
+}
+
+// upstreamProcess opens gpg-agent process we talk to - the one we started or the one we adopted. Returns 0 if it is
+// gone. Must be called with restart mutex held.
+func (a *Agent) upstreamProcess() windows.Handle {
+	pid := a.Adopted()
+	if pid == 0 && a.cmd != nil && a.cmd.Process != nil {
+		pid = a.cmd.Process.Pid
+	}
+	if pid == 0 {
+		return 0
+	}
+	h, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return 0
+	}
+	if ev, err := windows.WaitForSingleObject(h, 0); err != nil || ev == windows.WAIT_OBJECT_0 {
+		windows.CloseHandle(h) //nolint:errcheck
+		return 0
+	}
+	return h
+}
+
+// exited tells if gpg-agent process we talk to is gone. Must be called with restart mutex held.
+func (a *Agent) exited() bool {
+	h := a.upstreamProcess()
+	if h == 0 {
+		return true
+	}
+	windows.CloseHandle(h) //nolint:errcheck
+	return false
+}
+
+// queryPID asks gpg-agent serving socket for its process id.
+func queryPID(sockPath string) int {
+	var data []byte
+	if err := sendAssuanCmd(sockPath,
+		func(ses *client.Session) (err error) {
+			data, err = ses.SimpleCmd("GETINFO", "pid")
+			return err
+		},
+	); err != nil {
+		log.Printf("Unable to get gpg-agent pid: %s", err)
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// Adopted returns process id of gpg-agent another tool started in place of ours or 0.
+func (a *Agent) Adopted() int {
+	if a == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&a.adopted))
+}
+
+// upstreamLost is called by connectors when gpg-agent could not be dialed, so it is checked without waiting for its
+// process to exit.
+func (a *Agent) upstreamLost() {
+	select {
+	case a.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// waitProcess returns channel closed when process exits, handle is closed after that. Nil handle gives nil channel
+// which is never ready.
+func waitProcess(h windows.Handle) <-chan struct{} {
+	if h == 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer windows.CloseHandle(h) //nolint:errcheck
+		_, _ = windows.WaitForSingleObject(h, windows.INFINITE)
+		close(done)
+	}()
+	return done
+}
+
+// watchUpstream notices when gpg-agent is restarted underneath us (gpgconf --kill gpg-agent, Kleopatra, gpg started
+// after agent was killed) and makes connectors use whatever serves gpg-agent socket now. Connections to the old
+// instance are dropped, new ones are dialed using current socket file. Nothing is polled: checks are done when gpg-agent
+// process exits or connector fails to dial it. On stop gpg-agent is killed, so process wait ends as well.
+func (a *Agent) watchUpstream() {
+	for {
+		a.restart.Lock()
+		exited := waitProcess(a.upstreamProcess())
+		a.restart.Unlock()
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-exited:
+		case <-a.recheck:
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(upstreamSettle):
+		}
+		a.checkUpstream()
+	}
+}
+
+func (a *Agent) checkUpstream() {
+	// restarts and checks should not step on each other
+	a.restart.Lock()
+	defer a.restart.Unlock()
+	if a.ctx.Err() != nil {
+		// agent is stopped
+		return
+	}
+
+	sockPath := a.conns[ConnectorSockAgent].PathGPG()
+	dead := a.exited()
+	cur, ok := readSocketStamp(sockPath)
+	if ok && cur.same(a.stamp) {
+		if !dead {
+			return
+		}
+		// socket file is left behind by gpg-agent which is gone
+		ok = false
+	}
+	if !ok && !dead {
+		// socket is being replaced, look again later
+		return
+	}
+
+	// pooled connections lead to the old instance
+	for _, c := range a.conns {
+		if c != nil {
+			c.pool.drop()
+		}
+	}
+
+	if !ok {
+		log.Print("gpg-agent was killed outside of agent-gui, starting it again")
+		_ = a.cmd.Wait()
+		a.cmdOutput.Reset()
+		if err := a.Start(); err != nil {
+			log.Printf("Unable to start gpg-agent: %s", err)
+			return
+		}
+		notify.Notify(notify.AgentRestarted, util.GPGAgentName, "gpg-agent was killed by another tool and started again", "pid", strconv.Itoa(a.PID()))
+		return
+	}
+
+	a.stamp = cur
+	if !dead {
+		log.Print("gpg-agent socket was replaced, connections are dialed again")
+		return
+	}
+	pid := queryPID(sockPath)
+	atomic.StoreInt32(&a.adopted, int32(pid))
+	log.Printf("gpg-agent was restarted by another tool (pid %d), connections go to it now. It runs without agent-gui options - restart agent to get them back", pid)
+	notify.Notify(notify.AgentRestarted, util.GPGAgentName,
+		fmt.Sprintf("gpg-agent was restarted by another tool (pid %d) without agent-gui options, restart agent to get them back", pid),
+		"pid", strconv.Itoa(pid), "adopted", "true")
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of connector counters.
+type Stats struct {
+	Accepted      int64     `json:"accepted"`
+	Active        int64     `json:"active"`
+	Failed        int64     `json:"failed"`
+	AssuanErrors  int64     `json:"assuan_errors"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+	// Commands counts Assuan commands by verb, commands not in trackedCommands are counted as OTHER
+	Commands map[string]CommandStats `json:"commands,omitempty"`
+	// Pool describes gpg-agent connections of Assuan connectors
+	Pool *PoolStats `json:"pool,omitempty"`
+	// Limit describes concurrency limit of connector
+	Limit *LimitStats `json:"limit,omitempty"`
+}
+
+// CommandStats counts Assuan commands of single kind client sent through connector.
+type CommandStats struct {
+	Count    int64 `json:"count"`
+	Errors   int64 `json:"errors,omitempty"`
+	Rejected int64 `json:"rejected,omitempty"`
+	TimeMs   int64 `json:"time_ms"`
+}
+
+// trackedCommands are Assuan commands counted separately, so map size does not depend on what clients send.
+var trackedCommands = map[string]bool{
+	"PKSIGN": true, "PKDECRYPT": true, "GENKEY": true, "PASSWD": true, "IMPORT_KEY": true, "EXPORT_KEY": true,
+	"DELETE_KEY": true, "GET_PASSPHRASE": true, "PRESET_PASSPHRASE": true, "CLEAR_PASSPHRASE": true, "READKEY": true,
+	"HAVEKEY": true, "KEYINFO": true, "LEARN": true, "SCD": true, "KEYWRAP_KEY": true, "KEYTOCARD": true,
+}
+
+// CommandsString formats command counters in single line sorted by verb.
+func (st *Stats) CommandsString() string {
+	verbs := make([]string, 0, len(st.Commands))
+	for v := range st.Commands {
+		verbs = append(verbs, v)
+	}
+	sort.Strings(verbs)
+	parts := make([]string, 0, len(verbs))
+	for _, v := range verbs {
+		cs := st.Commands[v]
+		part := fmt.Sprintf("%s %d", v, cs.Count)
+		if cs.Errors > 0 || cs.Rejected > 0 {
+			part += fmt.Sprintf(" (errors %d, rejected %d)", cs.Errors, cs.Rejected)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// connStats collects connector counters, safe for concurrent use.
+type connStats struct {
+	accepted, active, failed int64
+	assuanErrs               int64
+	in, out                  int64
+
+	mu        sync.Mutex
+	lastErr   string
+	lastErrAt time.Time
+	cmds      map[string]*CommandStats
+}
+
+// trackedConn counts traffic on accepted connection.
+type trackedConn struct {
+	net.Conn
+	s    *connStats
+	once sync.Once
+}
+
+func (t *trackedConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	atomic.AddInt64(&t.s.in, int64(n))
+	return n, err
+}
+
+func (t *trackedConn) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	atomic.AddInt64(&t.s.out, int64(n))
+	return n, err
+}
+
+func (t *trackedConn) Close() error {
+	t.once.Do(func() { atomic.AddInt64(&t.s.active, -1) })
+	return t.Conn.Close()
+}
+
+// track counts accepted connection and wraps it to count traffic.
+func (s *connStats) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&s.accepted, 1)
+	atomic.AddInt64(&s.active, 1)
+	return &trackedConn{Conn: conn, s: s}
+}
+
+// fail records failed connection, client closing connection is not a failure.
+func (s *connStats) fail(err error) {
+	if err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+	atomic.AddInt64(&s.failed, 1)
+	s.setLastError(err.Error())
+}
+
+// assuanError records error gpg-agent returned to client.
+func (s *connStats) assuanError(msg string) {
+	atomic.AddInt64(&s.assuanErrs, 1)
+	s.setLastError(msg)
+}
+
+// command records Assuan command client sent, rejected commands never reach gpg-agent.
+func (s *connStats) command(verb string, err error, rejected bool, elapsed time.Duration) {
+	if !trackedCommands[verb] {
+		verb = "OTHER"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmds == nil {
+		s.cmds = make(map[string]*CommandStats)
+	}
+	cs, ok := s.cmds[verb]
+	if !ok {
+		cs = &CommandStats{}
+		s.cmds[verb] = cs
+	}
+	cs.Count++
+	cs.TimeMs += elapsed.Milliseconds()
+	switch {
+	case rejected:
+		cs.Rejected++
+	case err != nil:
+		cs.Errors++
+	default:
+	}
+}
+
+func (s *connStats) setLastError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = msg
+	s.lastErrAt = time.Now()
+}
+
+func (s *connStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cmds map[string]CommandStats
+	if len(s.cmds) > 0 {
+		cmds = make(map[string]CommandStats, len(s.cmds))
+		for v, cs := range s.cmds {
+			cmds[v] = *cs
+		}
+	}
+	return Stats{
+		Accepted:      atomic.LoadInt64(&s.accepted),
+		Active:        atomic.LoadInt64(&s.active),
+		Failed:        atomic.LoadInt64(&s.failed),
+		AssuanErrors:  atomic.LoadInt64(&s.assuanErrs),
+		BytesIn:       atomic.LoadInt64(&s.in),
+		BytesOut:      atomic.LoadInt64(&s.out),
+		LastError:     s.lastErr,
+		LastErrorTime: s.lastErrAt,
+		Commands:      cmds,
+	}
+}
+
+// Stats returns snapshot of connector counters.
+func (c *Connector) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	st := c.stats.snapshot()
+	st.Pool = c.pool.snapshot()
+	st.Limit = c.limit.snapshot()
+	return st
+}
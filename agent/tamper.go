@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// pinentryPath returns pinentry executable gpg-agent is going to use.
+func (a *Agent) pinentryPath() string {
+	if !a.Cfg.GPG.StdPin {
+		expath, err := os.Executable()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(filepath.Dir(expath), "pinentry.exe")
+	}
+	// command line option wins over configuration files
+	for i, arg := range a.Cfg.GPG.Args {
+		if arg == "--pinentry-program" && i+1 < len(a.Cfg.GPG.Args) {
+			return a.Cfg.GPG.Args[i+1]
+		}
+		if strings.HasPrefix(arg, "--pinentry-program=") {
+			return strings.TrimPrefix(arg, "--pinentry-program=")
+		}
+	}
+	for _, fname := range []string{a.Cfg.GPG.Config, filepath.Join(a.Cfg.GPG.Home, "gpg-agent.conf")} {
+		if p := confPinentry(fname); len(p) > 0 {
+			return p
+		}
+	}
+	for _, name := range []string{"pinentry.exe", "pinentry-basic.exe"} {
+		if fname := filepath.Join(a.Cfg.GPG.Path, "bin", name); util.FileExists(fname) {
+			return fname
+		}
+	}
+	return ""
+}
+
+// confPinentry looks for pinentry-program option in gpg-agent.conf.
+func confPinentry(fname string) string {
+	if len(fname) == 0 {
+		return ""
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var res string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "pinentry-program") {
+			res = strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "pinentry-program")), `"`)
+		}
+	}
+	return res
+}
+
+func fileSHA256(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyBinary checks executable against pinned hash or, if there is none, its Authenticode signature.
+func verifyBinary(fname string, v *config.VerifyConfig) error {
+	base := filepath.Base(fname)
+	for name, want := range v.Hashes {
+		if !strings.EqualFold(name, base) {
+			continue
+		}
+		sum, err := fileSHA256(fname)
+		if err != nil {
+			return fmt.Errorf("unable to hash %s: %w", fname, err)
+		}
+		if !strings.EqualFold(sum, strings.TrimSpace(want)) {
+			return fmt.Errorf("%s has been modified: sha256 %s does not match pinned value", fname, sum)
+		}
+		return nil
+	}
+	if !v.Signature {
+		return nil
+	}
+	sig, err := util.VerifyAuthenticode(fname)
+	if err != nil {
+		return err
+	}
+	if len(v.Publishers) == 0 {
+		return nil
+	}
+	for _, p := range v.Publishers {
+		if strings.EqualFold(p, sig.Publisher) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is signed by \"%s\" who is not trusted", fname, sig.Publisher)
+}
+
+// verifyBinaries performs tamper check of executables before they are started, reporting failures.
+func (a *Agent) verifyBinaries(fnames ...string) error {
+	v := &a.Cfg.GPG.Verify
+	if len(v.Hashes) == 0 && !v.Signature {
+		return nil
+	}
+	for _, fname := range fnames {
+		if len(fname) == 0 {
+			continue
+		}
+		if err := verifyBinary(fname, v); err != nil {
+			err = fmt.Errorf("tamper check failed, refusing to start: %w", err)
+			notify.Notify(notify.Tamper, "Tamper check", err.Error(), "file", fname)
+			return err
+		}
+		log.Printf("Tamper check passed for %s", fname)
+	}
+	return nil
+}
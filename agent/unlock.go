@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+// defaultUnlockDuration is length of unlock window when configuration does not say.
+const defaultUnlockDuration = 15 * time.Minute
+
+// ErrUnlockDisabled is returned when unlock window is requested but mode is not enabled.
+var ErrUnlockDisabled = errors.New("unlock window mode is not enabled (gui.unlock_window.enabled)")
+
+// UnlockState describes unlock window mode.
+type UnlockState struct {
+	Enabled bool      `json:"enabled"`
+	Open    bool      `json:"open"`
+	Until   time.Time `json:"until,omitempty"`
+}
+
+// String formats unlock window state in single line.
+func (us *UnlockState) String() string {
+	switch {
+	case !us.Enabled:
+		return "disabled"
+	case us.Open:
+		return "open until " + us.Until.Format("15:04:05")
+	default:
+	}
+	return "closed, key operations are denied"
+}
+
+// unlockWindow keeps agent inert: all key operations are denied unless window explicitly opened by user is open.
+type unlockWindow struct {
+	enabled  bool
+	duration time.Duration
+
+	mu     sync.Mutex
+	until  time.Time
+	timer  *time.Timer
+	report func(open bool)
+}
+
+func newUnlockWindow(cfg *config.UnlockConfig) *unlockWindow {
+	u := &unlockWindow{enabled: cfg.Enabled, duration: cfg.Duration}
+	if u.duration <= 0 {
+		u.duration = defaultUnlockDuration
+	}
+	return u
+}
+
+// closed checks if key operations should be denied.
+func (u *unlockWindow) closed() bool {
+	if u == nil || !u.enabled {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !time.Now().Before(u.until)
+}
+
+func (u *unlockWindow) state() UnlockState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st := UnlockState{Enabled: u.enabled}
+	if u.enabled && time.Now().Before(u.until) {
+		st.Open, st.Until = true, u.until
+	}
+	return st
+}
+
+func (u *unlockWindow) notify(open bool) {
+	u.mu.Lock()
+	report := u.report
+	u.mu.Unlock()
+	if report != nil {
+		report(open)
+	}
+}
+
+// OpenUnlockWindow allows key operations for d (configured duration if d is 0). Opening window which is already open
+// extends it.
+func (a *Agent) OpenUnlockWindow(d time.Duration) error {
+	u := a.unlock
+	if !u.enabled {
+		return ErrUnlockDisabled
+	}
+	if d <= 0 {
+		d = u.duration
+	}
+	u.mu.Lock()
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	u.until = time.Now().Add(d)
+	u.timer = time.AfterFunc(d, func() {
+		log.Print("Unlock window has expired")
+		a.CloseUnlockWindow()
+	})
+	u.mu.Unlock()
+
+	log.Printf("Unlock window is open for %s", d)
+	u.notify(true)
+	return nil
+}
+
+// CloseUnlockWindow denies key operations again.
+func (a *Agent) CloseUnlockWindow() {
+	u := a.unlock
+	if !u.enabled {
+		return
+	}
+	u.mu.Lock()
+	if u.timer != nil {
+		u.timer.Stop()
+		u.timer = nil
+	}
+	wasOpen := time.Now().Before(u.until)
+	u.until = time.Time{}
+	u.mu.Unlock()
+
+	if wasOpen {
+		log.Print("Unlock window is closed")
+	}
+	u.notify(false)
+}
+
+// OnUnlock sets function called when unlock window is opened or closed.
+func (a *Agent) OnUnlock(f func(open bool)) {
+	a.unlock.mu.Lock()
+	defer a.unlock.mu.Unlock()
+	a.unlock.report = f
+}
+
+// Unlock returns state of unlock window mode.
+func (a *Agent) Unlock() UnlockState {
+	return a.unlock.state()
+}
+
+// checkUnlocked rejects key operation when unlock window is closed.
+func (c *Connector) checkUnlocked(ci *ClientInfo, op, key string) error {
+	if !c.unlock.closed() {
+		return nil
+	}
+	err := fmt.Errorf("%s with key %s by %s denied, unlock window is closed", op, key, ci)
+	log.Printf("Rejecting request on %s: %s", c.index, err)
+	c.denied(err)
+	return err
+}
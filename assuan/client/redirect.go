@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// redirectMagic starts socket file which points to socket elsewhere (libassuan socket redirection).
+const redirectMagic = "%Assuan%\n"
+
+// maxRedirectSize limits how much of socket file is read looking for redirection.
+const maxRedirectSize = 2048
+
+// expandBraces replaces ${NAME} with value of environment variable NAME, as libassuan does for redirection targets.
+// Other uses of $ are left alone.
+func expandBraces(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		b.WriteString(os.Getenv(s[i+2 : i+j]))
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// Redirect returns path socket file fn points to when it is libassuan redirection file:
+//
+//	%Assuan%
+//	socket=${LOCALAPPDATA}\gnupg\S.gpg-agent
+//
+// (this is how socketdir is moved away from GnuPG home). Otherwise fn itself is returned. Missing file is not an
+// error, so Redirect could be used for sockets which are not there yet.
+func Redirect(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fn, nil
+		}
+		return fn, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxRedirectSize))
+	if err != nil {
+		return fn, err
+	}
+	// file could have been edited on Windows
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasPrefix(data, []byte(redirectMagic)) {
+		return fn, nil
+	}
+	rest := string(data[len(redirectMagic):])
+	if !strings.HasPrefix(rest, "socket=") {
+		return fn, fmt.Errorf("bad assuan redirection in \"%s\": socket is not specified", fn)
+	}
+	rest = strings.TrimPrefix(rest, "socket=")
+	end := strings.IndexByte(rest, '\n')
+	if end < 0 {
+		return fn, fmt.Errorf("bad assuan redirection in \"%s\": line is not terminated", fn)
+	}
+	target := expandBraces(strings.TrimSpace(rest[:end]))
+	if len(target) == 0 {
+		return fn, fmt.Errorf("bad assuan redirection in \"%s\": empty socket name", fn)
+	}
+	return target, nil
+}
@@ -0,0 +1,54 @@
+package client_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assuan "github.com/rupor-github/win-gpg-agent/assuan/client"
+)
+
+func TestRedirect(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("WGA_TEST_SOCKETDIR", filepath.Join(dir, "sockets"))
+
+	for _, c := range []struct {
+		name, content, expected string
+		fail                    bool
+	}{
+		{"plain", "12345\n0123456789abcdef", "", false},
+		{"redirect", "%Assuan%\nsocket=/run/user/1000/gnupg/S.gpg-agent\n", "/run/user/1000/gnupg/S.gpg-agent", false},
+		{"crlf", "%Assuan%\r\nsocket=C:\\gnupg\\S.gpg-agent\r\n", "C:\\gnupg\\S.gpg-agent", false},
+		{"env", "%Assuan%\nsocket=${WGA_TEST_SOCKETDIR}/S.gpg-agent\n", filepath.Join(dir, "sockets") + "/S.gpg-agent", false},
+		{"no socket", "%Assuan%\nport=1234\n", "", true},
+		{"unterminated", "%Assuan%\nsocket=/tmp/S.gpg-agent", "", true},
+	} {
+		fn := filepath.Join(dir, c.name)
+		if err := os.WriteFile(fn, []byte(c.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := assuan.Redirect(fn)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+			continue
+		}
+		expected := c.expected
+		if len(expected) == 0 {
+			expected = fn
+		}
+		if got != expected {
+			t.Errorf("%s: got %s, expected %s", c.name, got, expected)
+		}
+	}
+
+	missing := filepath.Join(dir, "missing")
+	if got, err := assuan.Redirect(missing); err != nil || got != missing {
+		t.Errorf("missing file: got %s, %v", got, err)
+	}
+}
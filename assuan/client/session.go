@@ -17,9 +17,14 @@ import (
 	"github.com/rupor-github/win-gpg-agent/assuan/common"
 )
 
-// Dial Asuan file socket on Windows - read contents of the target file and connect to a TCP port.
+// Dial Asuan file socket on Windows - read contents of the target file and connect to a TCP port. Socket
+// redirection files are followed.
 func Dial(fn string) (net.Conn, error) {
 
+	fn, err := Redirect(fn)
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.Open(fn)
 	if err != nil {
 		return nil, err
@@ -55,7 +60,7 @@ func Dial(fn string) (net.Conn, error) {
 		return nil, err
 	}
 
-	log.Printf("Client dial for assuan socket \"%s\" - port: %d, nonce: %X", fn, port, nonce)
+	log.Printf("Client dial for assuan socket \"%s\" - port: %d", fn, port)
 
 	// Try to connect to the libassaun TCP socket hosted on localhost
 	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
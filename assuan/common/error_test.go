@@ -1,6 +1,9 @@
 package common_test
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/rupor-github/win-gpg-agent/assuan/common"
@@ -41,3 +44,13 @@ func TestDecodeErrCmd(t *testing.T) {
 		t.Errorf("Error message mismatch: wanted '%s', got '%s'", "Unknown IPC command", err.Message)
 	}
 }
+
+func TestExplain(t *testing.T) {
+	err := fmt.Errorf("unable to send PKSIGN: %w", common.DecodeErrCmd("67109115 Forbidden <GPG Agent>"))
+	if got := common.Explain(err); !strings.Contains(got, "restricted (extra) socket") {
+		t.Errorf("Hint is missing: %s", got)
+	}
+	if got := common.Explain(errors.New("plain")); got != "plain" {
+		t.Errorf("Unexpected explanation: %s", got)
+	}
+}
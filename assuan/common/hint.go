@@ -0,0 +1,48 @@
+package common
+
+import (
+	"errors"
+)
+
+// hints maps common error codes to explanations which make sense to users of relayed connections.
+var hints = map[ErrorCode]string{
+	ErrForbidden:      "command is not allowed on restricted (extra) socket used for remote access",
+	ErrAssUnknownCmd:  "command is not known or not allowed remotely - extra socket restricts available commands",
+	ErrNoSeckey:       "secret key is not available - check that key is imported or card is inserted",
+	ErrNoPubkey:       "public key is not available - import it first",
+	ErrUnusableSeckey: "secret key is not usable - expired, revoked or stub without card",
+	ErrBadPassphrase:  "wrong passphrase",
+	ErrBadPIN:         "wrong PIN",
+	ErrPinBlocked:     "PIN is blocked - use admin PIN or reset code to unblock",
+	ErrCanceled:       "operation was canceled (pinentry dialog closed?)",
+	ErrNotConfirmed:   "operation was not confirmed by user",
+	ErrTimeout:        "timeout - nobody answered pinentry in time",
+	ErrNoPinEntry:     "pinentry program could not be started - check pinentry-program setting",
+	ErrPinEntry:       "pinentry program failed",
+	ErrCardNotPresent: "smartcard is not present - insert card or token",
+	ErrCardRemoved:    "smartcard was removed during operation",
+	ErrWrongCard:      "wrong smartcard - key is stored on different card",
+	ErrNoScdaemon:     "scdaemon is not available - check card reader and GnuPG installation",
+	ErrNoAgent:        "gpg-agent is not running or could not be reached",
+	ErrNotSupported:   "operation is not supported by this gpg-agent version or key type",
+	ErrLocked:         "resource is locked by another process",
+}
+
+// Hint returns human readable explanation of error or empty string if nothing useful is known.
+func (e Error) Hint() string {
+	return hints[e.Code]
+}
+
+// Explain returns error text extended with hint when err is (or wraps) protocol error with known code.
+func Explain(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e Error
+	if errors.As(err, &e) {
+		if h := e.Hint(); len(h) > 0 {
+			return err.Error() + " (" + h + ")"
+		}
+	}
+	return err.Error()
+}
@@ -24,21 +24,22 @@ type ReadWriter struct {
 
 // Pipe is a wrapper for Assuan command stream.
 type Pipe struct {
-	scnr *bufio.Scanner
-	r    io.Reader
-	w    io.Writer
+	scnr   *bufio.Scanner
+	r      io.Reader
+	w      io.Writer
+	status func(keyword, params string)
 }
 
 // New crreates and initializes Pipe using biderectional stream.
 func New(stream io.ReadWriter) Pipe {
-	p := Pipe{bufio.NewScanner(stream), stream, stream}
+	p := Pipe{scnr: bufio.NewScanner(stream), r: stream, w: stream}
 	p.scnr.Buffer(make([]byte, 0, MaxLineLen), MaxLineLen)
 	return p
 }
 
 // NewPipe crreates and initializes Pipe using 2 streams.
 func NewPipe(in io.Reader, out io.Writer) Pipe {
-	p := Pipe{bufio.NewScanner(in), in, out}
+	p := Pipe{scnr: bufio.NewScanner(in), r: in, w: out}
 	p.scnr.Buffer(make([]byte, 0, MaxLineLen), MaxLineLen)
 	return p
 }
@@ -66,10 +67,17 @@ func (p *Pipe) RestrictInputLen(restrict bool) {
 	}
 }
 
+// OnStatus sets function status information is passed to, nil discards it.
+// Parameters are not unescaped: status lines use '+' for spaces on top of
+// percent-encoding, so only receiver knows how to decode them.
+func (p *Pipe) OnStatus(fn func(keyword, params string)) {
+	p.status = fn
+}
+
 // ReadLine reads raw request/response in following format: command <parameters>
 //
 // Empty lines and lines starting with # are ignored as specified by protocol.
-// Additionally, status information is silently discarded for now.
+// Additionally, status information is discarded unless OnStatus was called.
 func (p *Pipe) ReadLine() (cmd string, params string, err error) {
 	var line string
 	for {
@@ -82,6 +90,14 @@ func (p *Pipe) ReadLine() (cmd string, params string, err error) {
 		}
 		line = p.scnr.Text()
 
+		if p.status != nil && strings.HasPrefix(line, "S ") {
+			parts := strings.SplitN(line[2:], " ", 2)
+			if len(parts) == 1 {
+				parts = append(parts, "")
+			}
+			p.status(parts[0], parts[1])
+		}
+
 		// We got something that looks like a message. Let's parse it.
 		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "S ") && len(strings.TrimSpace(line)) != 0 {
 			break
@@ -154,6 +170,48 @@ func (p *Pipe) WriteData(input []byte) error {
 	return nil
 }
 
+// WriteSecretData is similar to WriteData but intended for sensitive values
+// (passphrases): data is escaped directly into line buffer without
+// intermediate strings and the buffer is wiped afterwards.
+func (p *Pipe) WriteSecretData(input []byte) error {
+	const hexDigits = "0123456789ABCDEF"
+
+	var line [MaxLineLen]byte
+	defer func() {
+		for i := range line {
+			line[i] = 0
+		}
+	}()
+
+	line[0], line[1] = 'D', ' '
+	n := 2
+	flush := func() error {
+		line[n] = '\n'
+		_, err := p.w.Write(line[:n+1])
+		n = 2
+		return err
+	}
+	for _, b := range input {
+		if n+3 > MaxLineLen-1 { // room for escaped byte and line feed
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		switch b {
+		case '\r', '\n', '%', '\\':
+			line[n], line[n+1], line[n+2] = '%', hexDigits[b>>4], hexDigits[b&0xF]
+			n += 3
+		default:
+			line[n] = b
+			n++
+		}
+	}
+	if n > 2 {
+		return flush()
+	}
+	return nil
+}
+
 // WriteDataReader is similar to WriteData but sends data from input Reader
 // until EOF.
 func (p *Pipe) WriteDataReader(input io.Reader) error {
@@ -58,6 +58,28 @@ CMD F!_)`
 			t.Errorf("Params mismatch: wanted %s, got %s", "F!_)", params)
 		}
 	})
+	t.Run("status", func(t *testing.T) {
+		sample := `S SERIALNO D2760001240103040006%2B
+S PROGRESS
+OK`
+		pipe := common.NewPipe(strings.NewReader(sample), nil)
+		defer pipe.Close()
+
+		var status []string
+		pipe.OnStatus(func(keyword, params string) {
+			status = append(status, keyword+"|"+params)
+		})
+		cmd, _, err := pipe.ReadLine()
+		if err != nil {
+			t.Error("Unexpected error on pipe.ReadLine:", err)
+		}
+		if cmd != "OK" {
+			t.Errorf("Command mismatch: wanted %s, got %s", "OK", cmd)
+		}
+		if strings.Join(status, ",") != "SERIALNO|D2760001240103040006%2B,PROGRESS|" {
+			t.Errorf("Status mismatch: got %v", status)
+		}
+	})
 }
 
 func TestPipe_WriteLine(t *testing.T) {
@@ -141,6 +163,33 @@ func TestPipe_WriteData(t *testing.T) {
 			t.Errorf("pipe.WriteData wrote wrong line: '%s'", buf.String())
 		}
 	})
+	t.Run("secret data", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		pipe := common.NewPipe(nil, &buf)
+		defer pipe.Close()
+
+		data := []byte(strings.Repeat("pass%\\\r\n", common.MaxLineLen))
+
+		if err := pipe.WriteSecretData(data); err != nil {
+			t.Error("Unexpected error on pipe.WriteSecretData:", err)
+			t.FailNow()
+		}
+		var joined strings.Builder
+		for _, part := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if len(part)+1 > common.MaxLineLen {
+				t.Error("pipe.WriteSecretData wrote line bigger than MaxLineLen")
+				t.FailNow()
+			}
+			if !strings.HasPrefix(part, "D ") {
+				t.Errorf("pipe.WriteSecretData wrote wrong line: '%s'", part)
+				t.FailNow()
+			}
+			joined.WriteString(part[2:])
+		}
+		if joined.String() != common.EscapeParameters(string(data)) {
+			t.Error("pipe.WriteSecretData corrupted data")
+		}
+	})
 	// TODO: Test that wrapping is done correctly and no data is corrupted.
 }
 
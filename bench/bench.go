@@ -0,0 +1,298 @@
+// Package bench generates synthetic ssh-agent and Assuan load against agent endpoints and measures throughput and
+// latencies. It is used by hidden --bench mode of agent-gui (against fake backend) and by Go benchmarks, to validate
+// performance oriented changes.
+package bench
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Protocols endpoints could speak.
+const (
+	ProtoSSH    = "ssh"
+	ProtoAssuan = "assuan"
+)
+
+// Scenarios of synthetic traffic.
+const (
+	// SSHList requests identities over persistent connection.
+	SSHList = "list"
+	// SSHSign signs with first identity over persistent connection.
+	SSHSign = "sign"
+	// AssuanCommand sends GETINFO version over persistent connection.
+	AssuanCommand = "command"
+	// AssuanSession dials, reads greeting, sends GETINFO version and BYE for every operation - what gpg invocation does.
+	AssuanSession = "session"
+)
+
+// Scenarios returns scenarios for protocol.
+func Scenarios(proto string) []string {
+	switch proto {
+	case ProtoSSH:
+		return []string{SSHList, SSHSign}
+	case ProtoAssuan:
+		return []string{AssuanCommand, AssuanSession}
+	default:
+	}
+	return nil
+}
+
+// Target is endpoint to put load on.
+type Target struct {
+	Name  string
+	Proto string
+	Dial  func() (net.Conn, error)
+}
+
+// Options control load.
+type Options struct {
+	// Duration of every scenario
+	Duration time.Duration
+	// Concurrency is number of parallel clients
+	Concurrency int
+}
+
+// Result describes single scenario run.
+type Result struct {
+	Target   string        `json:"target"`
+	Scenario string        `json:"scenario"`
+	Clients  int           `json:"clients"`
+	Ops      int64         `json:"ops"`
+	Errors   int64         `json:"errors"`
+	Elapsed  time.Duration `json:"elapsed"`
+	P50      time.Duration `json:"p50"`
+	P95      time.Duration `json:"p95"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+	// FirstError is text of the first failure, if any
+	FirstError string `json:"first_error,omitempty"`
+}
+
+// OpsPerSec returns throughput of successful operations.
+func (r *Result) OpsPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// String formats result in single line.
+func (r *Result) String() string {
+	res := fmt.Sprintf("%-24s %-8s %3d clients %9.1f ops/s  p50 %-9s p95 %-9s p99 %-9s max %-9s",
+		r.Target, r.Scenario, r.Clients, r.OpsPerSec(), round(r.P50), round(r.P95), round(r.P99), round(r.Max))
+	if r.Errors > 0 {
+		res += fmt.Sprintf(" errors %d (%s)", r.Errors, r.FirstError)
+	}
+	return res
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+	}
+	return d.Round(time.Microsecond)
+}
+
+// worker performs operations of single client, op is called repeatedly until context is canceled.
+type worker struct {
+	conn net.Conn
+	op   func() error
+}
+
+func (w *worker) close() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// newWorker prepares client for scenario.
+func newWorker(t *Target, scenario string) (*worker, error) {
+	if scenario == AssuanSession {
+		return &worker{op: func() error {
+			conn, err := t.Dial()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if err := assuanReply(r); err != nil {
+				return fmt.Errorf("greeting: %w", err)
+			}
+			if err := assuanCmd(conn, r, "GETINFO version"); err != nil {
+				return err
+			}
+			return assuanCmd(conn, r, "BYE")
+		}}, nil
+	}
+
+	conn, err := t.Dial()
+	if err != nil {
+		return nil, err
+	}
+	w := &worker{conn: conn}
+	switch scenario {
+	case SSHList:
+		client := agent.NewClient(conn)
+		w.op = func() error {
+			_, err := client.List()
+			return err
+		}
+	case SSHSign:
+		client := agent.NewClient(conn)
+		keys, err := client.List()
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		if len(keys) == 0 {
+			w.close()
+			return nil, errors.New("agent has no keys to sign with")
+		}
+		data := []byte("win-gpg-agent benchmark")
+		w.op = func() error {
+			_, err := client.Sign(keys[0], data)
+			return err
+		}
+	case AssuanCommand:
+		r := bufio.NewReader(conn)
+		if err := assuanReply(r); err != nil {
+			w.close()
+			return nil, fmt.Errorf("greeting: %w", err)
+		}
+		w.op = func() error {
+			return assuanCmd(conn, r, "GETINFO version")
+		}
+	default:
+		w.close()
+		return nil, fmt.Errorf("unknown scenario %s", scenario)
+	}
+	return w, nil
+}
+
+// assuanCmd sends command and waits for its result.
+func assuanCmd(w io.Writer, r *bufio.Reader, cmd string) error {
+	if _, err := io.WriteString(w, cmd+"\n"); err != nil {
+		return err
+	}
+	return assuanReply(r)
+}
+
+// assuanReply skips data and status lines until OK or ERR.
+func assuanReply(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "OK"):
+			return nil
+		case strings.HasPrefix(line, "ERR"):
+			return errors.New(strings.TrimSpace(line))
+		default:
+		}
+	}
+}
+
+// Run puts load of scenario on target for configured duration.
+func Run(ctx context.Context, t *Target, scenario string, opts Options) *Result {
+
+	clients := opts.Concurrency
+	if clients <= 0 {
+		clients = 1
+	}
+	res := &Result{Target: t.Name, Scenario: scenario, Clients: clients}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		res.Errors++
+		if len(res.FirstError) == 0 {
+			res.FirstError = err.Error()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w, err := newWorker(t, scenario)
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer w.close()
+
+			local := make([]time.Duration, 0, 1024)
+			for ctx.Err() == nil {
+				begin := time.Now()
+				if err := w.op(); err != nil {
+					fail(err)
+					if w.conn != nil {
+						// persistent connection is likely broken
+						break
+					}
+					continue
+				}
+				local = append(local, time.Since(begin))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	res.Ops = int64(len(latencies))
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		at := func(p float64) time.Duration {
+			return latencies[int(float64(len(latencies)-1)*p)]
+		}
+		res.P50, res.P95, res.P99, res.Max = at(0.50), at(0.95), at(0.99), latencies[len(latencies)-1]
+	}
+	return res
+}
+
+// RunAll runs every scenario of every target one after another.
+func RunAll(ctx context.Context, targets []*Target, opts Options, report func(*Result)) []*Result {
+	var results []*Result
+	for _, t := range targets {
+		for _, s := range Scenarios(t.Proto) {
+			if ctx.Err() != nil {
+				return results
+			}
+			r := Run(ctx, t, s, opts)
+			if report != nil {
+				report(r)
+			}
+			results = append(results, r)
+		}
+	}
+	return results
+}
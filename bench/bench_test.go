@@ -0,0 +1,126 @@
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/testagent"
+)
+
+func TestMain(m *testing.M) {
+	// fake agent and Assuan client log every command
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// sshTarget serves ssh-agent protocol of fake agent on loopback TCP, the way connectors relay it to Pageant.
+func sshTarget(tb testing.TB, fake *testagent.Agent) *Target {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [4]byte
+				for {
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					req := make([]byte, binary.BigEndian.Uint32(length[:]))
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					resp, err := fake.SSH(req)
+					if err != nil {
+						return
+					}
+					binary.BigEndian.PutUint32(length[:], uint32(len(resp)))
+					if _, err := conn.Write(append(length[:], resp...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	addr := l.Addr().String()
+	return &Target{Name: "fake ssh-agent", Proto: ProtoSSH, Dial: func() (net.Conn, error) { return net.Dial("tcp", addr) }}
+}
+
+func assuanTarget(tb testing.TB, fake *testagent.Agent) *Target {
+	sock := filepath.Join(tb.TempDir(), "S.gpg-agent")
+	if err := fake.ServeAssuan(sock); err != nil {
+		tb.Fatal(err)
+	}
+	return &Target{Name: "fake gpg-agent", Proto: ProtoAssuan, Dial: func() (net.Conn, error) { return client.Dial(sock) }}
+}
+
+func fakeAgent(tb testing.TB) *testagent.Agent {
+	fake, err := testagent.New()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { fake.Close() })
+	return fake
+}
+
+func TestRun(t *testing.T) {
+	fake := fakeAgent(t)
+	targets := []*Target{sshTarget(t, fake), assuanTarget(t, fake)}
+	results := RunAll(context.Background(), targets, Options{Duration: 100 * time.Millisecond, Concurrency: 2}, nil)
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Ops == 0 || r.Errors != 0 {
+			t.Errorf("%s", r)
+		}
+		if r.P50 > r.P99 || r.P99 > r.Max {
+			t.Errorf("latencies are out of order: %s", r)
+		}
+	}
+}
+
+func benchmark(b *testing.B, t *Target, scenario string) {
+	w, err := newWorker(t, scenario)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.op(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSSHList(b *testing.B) {
+	benchmark(b, sshTarget(b, fakeAgent(b)), SSHList)
+}
+
+func BenchmarkSSHSign(b *testing.B) {
+	benchmark(b, sshTarget(b, fakeAgent(b)), SSHSign)
+}
+
+func BenchmarkAssuanCommand(b *testing.B) {
+	benchmark(b, assuanTarget(b, fakeAgent(b)), AssuanCommand)
+}
+
+func BenchmarkAssuanSession(b *testing.B) {
+	benchmark(b, assuanTarget(b, fakeAgent(b)), AssuanSession)
+}
@@ -0,0 +1,121 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/systray"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// activitySize is number of recent events shown in "Activity" submenu.
+const activitySize = 10
+
+// activityEvents are events worth showing in tray menu independently of notification rules.
+var activityEvents = []notify.Event{notify.KeyUsed, notify.ClientDenied, notify.AgentRestarted, notify.CardRemoved, notify.Tamper, notify.Forwarded, notify.Quota}
+
+// activityLog keeps last events, newest first.
+type activityLog struct {
+	mu      sync.Mutex
+	entries []notify.Message
+	changed chan struct{}
+}
+
+var activity = &activityLog{changed: make(chan struct{}, 1)}
+
+// Send implements notify.Backend.
+func (a *activityLog) Send(m *notify.Message) error {
+	a.mu.Lock()
+	a.entries = append([]notify.Message{*m}, a.entries...)
+	if len(a.entries) > activitySize {
+		a.entries = a.entries[:activitySize]
+	}
+	a.mu.Unlock()
+
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Entries returns copy of recent events.
+func (a *activityLog) Entries() []notify.Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := make([]notify.Message, len(a.entries))
+	copy(res, a.entries)
+	return res
+}
+
+// setupActivity starts recording recent events for tray menu.
+func setupActivity() error {
+	return notify.AddSink(activityEvents, activity)
+}
+
+// addActivityMenu creates submenu with recent events, clicking on item shows its details.
+func addActivityMenu(a *activityLog) {
+
+	const maxTitle = 64
+
+	miAct := systray.AddMenuItem("Activity", "Recent events")
+	items := make([]*systray.MenuItem, activitySize)
+	for i := range items {
+		items[i] = miAct.AddSubMenuItem("", "Show details")
+		items[i].Hide()
+	}
+	miAct.Disable()
+
+	var (
+		mu      sync.Mutex
+		entries []notify.Message
+	)
+
+	refresh := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		entries = a.Entries()
+		for i, item := range items {
+			if i >= len(entries) {
+				item.Hide()
+				continue
+			}
+			text := strings.Join(strings.Fields(entries[i].Text), " ")
+			if r := []rune(text); len(r) > maxTitle {
+				text = string(r[:maxTitle]) + "..."
+			}
+			item.SetTitle(fmt.Sprintf("%s  %s", entries[i].Time.Format("15:04:05"), text))
+			item.Show()
+		}
+		if len(entries) > 0 {
+			miAct.Enable()
+		}
+	}
+	// events could have happened before tray was ready
+	refresh()
+
+	go func() {
+		for range a.changed {
+			refresh()
+		}
+	}()
+
+	for i, item := range items {
+		go func(i int, item *systray.MenuItem) {
+			for range item.ClickedCh {
+				mu.Lock()
+				var m *notify.Message
+				if i < len(entries) {
+					m = &entries[i]
+				}
+				mu.Unlock()
+				if m == nil {
+					continue
+				}
+				util.ShowOKMessage(util.MsgInformation, trayTitle, fmt.Sprintf("%s\n\n%s\n\n%s", m.Time.Format("2006-01-02 15:04:05"), m.Title, m.Text))
+			}
+		}(i, item)
+	}
+}
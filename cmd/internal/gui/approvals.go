@@ -0,0 +1,36 @@
+package gui
+
+import (
+	"log"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// manageApprovals shows remembered "Always allow" decisions and revokes ones user removes from the list.
+func manageApprovals(a *agent.Agent) {
+	aps := a.Approvals()
+	if len(aps) == 0 {
+		util.ShowOKMessage(util.MsgInformation, trayTitle, "There are no remembered approvals.\n\nAnswer \"Always allow\" to confirmation to let process use key without asking again.")
+		return
+	}
+	items := make([]string, 0, len(aps))
+	for i := range aps {
+		items = append(items, aps[i].String())
+	}
+	removed, err := util.ManageList(trayTitle+" - remembered approvals", items)
+	if err != nil {
+		log.Printf("Unable to show approvals: %s", err)
+		return
+	}
+	if len(removed) == 0 {
+		return
+	}
+	revoke := make([]agent.Approval, 0, len(removed))
+	for _, i := range removed {
+		revoke = append(revoke, aps[i])
+	}
+	if _, err := a.RevokeApprovals(revoke); err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+	}
+}
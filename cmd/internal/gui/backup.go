@@ -0,0 +1,21 @@
+package gui
+
+import (
+	"log"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// backupKeyring writes keyring snapshot on user request and tells where it went.
+func backupKeyring(a *agent.Agent) {
+	defer util.HandlePanic()
+
+	dir, err := a.Backup()
+	if err != nil {
+		log.Print(err.Error())
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return
+	}
+	util.ShowOKMessage(util.MsgInformation, trayTitle, "Public keyring and ownertrust are saved to\n\n"+dir)
+}
@@ -0,0 +1,114 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/bench"
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+// benchInstance is name of instance bench mode runs as, so it never touches sockets and pipes of real one.
+const benchInstance = "bench"
+
+// runBench starts agent with fake backend, puts synthetic ssh and Assuan load on every connector which could be
+// reached from this process and on fake gpg-agent directly (for comparison) and prints results. Configuration (pool,
+// limits, batch) is taken from cfg, but all paths and pipe names are those of separate bench instance. Returns process
+// exit code.
+func runBench(cfg *config.Config, d time.Duration, clients int) int {
+
+	def, err := config.LoadInstance(benchInstance)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConfig
+	}
+	cfg.GUI.Instance = benchInstance
+	cfg.GUI.Home, cfg.GUI.Sockets, cfg.GUI.PipeName, cfg.GPG.Sockets = def.GUI.Home, def.GUI.Sockets, def.GUI.PipeName, def.GPG.Sockets
+	cfg.GUI.FakeAgent, cfg.GUI.Headless, cfg.GUI.SetEnv = true, true, false
+	cfg.GPG.Log = false
+
+	for _, dir := range []string{cfg.GUI.Home, cfg.GUI.Sockets} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitConfig
+		}
+	}
+
+	// every connection is logged, this would measure logging
+	log.SetOutput(io.Discard)
+
+	a, err := agent.NewAgent(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	for _, ct := range []agent.ConnectorType{agent.ConnectorSockAgent, agent.ConnectorSockAgentExtra, agent.ConnectorSockAgentSSH, agent.ConnectorPipeSSH} {
+		if err := a.Serve(ct); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitCode(err)
+		}
+	}
+	if err := a.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	defer func() {
+		if err := a.Stop(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
+	unix := func(path string) func() (net.Conn, error) {
+		return func() (net.Conn, error) { return net.Dial("unix", path) }
+	}
+	gpg := a.GetConnector(agent.ConnectorSockAgent)
+	pipe := a.GetConnector(agent.ConnectorPipeSSH).Name()
+	targets := []*bench.Target{
+		{Name: "fake gpg-agent (direct)", Proto: bench.ProtoAssuan, Dial: func() (net.Conn, error) { return client.Dial(gpg.PathGPG()) }},
+		{Name: agent.ConnectorSockAgent.ID(), Proto: bench.ProtoAssuan, Dial: unix(gpg.PathGUI())},
+		{Name: agent.ConnectorSockAgentExtra.ID(), Proto: bench.ProtoAssuan, Dial: unix(a.GetConnector(agent.ConnectorSockAgentExtra).PathGUI())},
+		{Name: agent.ConnectorSockAgentSSH.ID(), Proto: bench.ProtoSSH, Dial: unix(a.GetConnector(agent.ConnectorSockAgentSSH).PathGUI())},
+		{Name: agent.ConnectorPipeSSH.ID(), Proto: bench.ProtoSSH, Dial: func() (net.Conn, error) { return winio.DialPipe(pipe, nil) }},
+	}
+
+	opts := bench.Options{Duration: d, Concurrency: clients}
+	if !aJSON {
+		fmt.Printf("Running every scenario for %s with %d clients\n\n", d, clients)
+	}
+	results := bench.RunAll(context.Background(), targets, opts, func(r *bench.Result) {
+		if !aJSON {
+			fmt.Println(r)
+		}
+	})
+
+	code := exitOK
+	for _, r := range results {
+		if r.Errors > 0 {
+			code = exitProblems
+		}
+	}
+	if aJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Results []*bench.Result `json:"results"`
+			Stats   []agent.Stats   `json:"connectors"`
+		}{results, []agent.Stats{gpg.Stats(), a.GetConnector(agent.ConnectorSockAgentSSH).Stats()}}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return code
+	}
+	fmt.Printf("\n%s\n", a.Status())
+	return code
+}
@@ -0,0 +1,32 @@
+package gui
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// cardText describes inserted OpenPGP card for dashboard.
+func cardText(a *agent.Agent) string {
+	ci, err := a.Card()
+	if err != nil {
+		return fmt.Sprintf("No usable OpenPGP card:\r\n\r\n%s", err)
+	}
+	return ci.String()
+}
+
+// showCardDashboard shows state of OpenPGP card with buttons for common card operations.
+func showCardDashboard(a *agent.Agent) {
+	defer util.HandlePanic()
+
+	actions := []util.InfoAction{
+		{Title: "Learn card", Run: a.LearnCard},
+		{Title: "Change PIN", Run: func() error { return a.ChangeCardPIN(false) }},
+		{Title: "Change Admin PIN", Run: func() error { return a.ChangeCardPIN(true) }},
+	}
+	if err := util.ShowInfo(trayTitle+" - smartcard", func() string { return cardText(a) }, actions); err != nil {
+		log.Printf("Unable to show smartcard dashboard: %s", err)
+	}
+}
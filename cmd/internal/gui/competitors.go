@@ -0,0 +1,163 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const competitorsInterval = 5 * time.Minute
+
+var (
+	competitorsLock sync.Mutex
+	competitors     []util.Competitor
+)
+
+// offerStop asks user if competitor should be stopped and does it. Returns true if competitor was stopped.
+func offerStop(c util.Competitor) bool {
+	what := fmt.Sprintf("Terminate %s (pid %d)?", c.Name, c.PID)
+	if len(c.Service) > 0 {
+		what = fmt.Sprintf("Stop and disable %s service? This requires administrative rights.", c.Service)
+	}
+	if util.MessageBox(trayTitle, fmt.Sprintf("Competing agent detected:\n\n%s\n\n%s", c.String(), what), util.MB_YESNO|util.MB_ICONWARNING|util.MB_SETFOREGROUND) != util.IDYES {
+		return false
+	}
+	if err := util.StopCompetitor(&c); err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return false
+	}
+	log.Printf("Competing agent stopped: %s", c.String())
+	return true
+}
+
+// openSSHService is competitor entry for Windows OpenSSH ssh-agent service.
+var openSSHService = util.Competitor{Name: "Windows OpenSSH ssh-agent service", Service: util.OpenSSHAgentService}
+
+// takeOver stops and disables Windows OpenSSH ssh-agent service without asking when gui.openssh_service is takeover.
+func takeOver(cfg *config.Config) {
+	if !strings.EqualFold(cfg.GUI.OpenSSHService, config.ServiceTakeover) {
+		return
+	}
+	if installed, running, auto := util.OpenSSHAgentState(); !installed || !running && !auto {
+		return
+	}
+	if err := util.StopCompetitor(&openSSHService); err != nil {
+		log.Printf("Unable to take over %s: %s", util.SSHAgentPipeName, err)
+		return
+	}
+	log.Printf("%s service is stopped and disabled", util.OpenSSHAgentService)
+}
+
+// relevantCompetitors drops Windows OpenSSH ssh-agent service when it is delegated to or taken over.
+func relevantCompetitors(cfg *config.Config, list []util.Competitor) []util.Competitor {
+	if strings.EqualFold(cfg.GUI.OpenSSHService, config.ServiceAsk) {
+		return list
+	}
+	res := list[:0]
+	for _, c := range list {
+		if c.Service != util.OpenSSHAgentService {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// claimPipe is called before OpenSSH pipe is served, if it is taken user is offered to stop its owner rather than
+// failing to bind. Returns description of pipe owner which is still there.
+func claimPipe(cfg *config.Config) string {
+	takeOver(cfg)
+	pipe := cfg.GUI.PipeName
+	for i := 0; i < 50 && util.PipeExists(pipe) && strings.EqualFold(cfg.GUI.OpenSSHService, config.ServiceTakeover); i++ {
+		// service may still be going away
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !util.PipeExists(pipe) {
+		return ""
+	}
+	for _, c := range util.DetectCompetitors(pipe, cfg.GPG.Home, 0) {
+		if c.Endpoint != pipe {
+			continue
+		}
+		log.Printf("Competing agent: %s", c.String())
+		if cfg.GUI.Headless || !c.CanStop() || !offerStop(c) {
+			return c.String()
+		}
+		for i := 0; i < 50 && util.PipeExists(pipe); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if util.PipeExists(pipe) {
+			return c.String()
+		}
+	}
+	return ""
+}
+
+// watchCompetitors periodically looks for other agents and notifies about every new one, clicking on notification
+// offers to stop it.
+func watchCompetitors(ctx context.Context, cfg *config.Config) {
+	defer util.HandlePanic()
+
+	reported := make(map[string]bool)
+	for {
+		// service could have been enabled back
+		takeOver(cfg)
+		// we serve the pipe (or it is delegated), there is no need to connect to it
+		found := relevantCompetitors(cfg, util.DetectCompetitors("", cfg.GPG.Home, uint32(gpgAgent.PID())))
+		competitorsLock.Lock()
+		competitors = found
+		competitorsLock.Unlock()
+
+		current := make(map[string]bool, len(found))
+		for _, c := range found {
+			key := c.Key()
+			current[key] = true
+			if reported[key] {
+				continue
+			}
+			log.Printf("Competing agent: %s", c.String())
+			m := &notify.Message{
+				Event:  notify.Competitor,
+				Title:  trayTitle,
+				Text:   c.String(),
+				Fields: map[string]string{"name": c.Name, "endpoint": c.Endpoint, "image": c.Image},
+			}
+			if c.CanStop() {
+				c := c
+				m.Text += "\nClick to stop it."
+				m.Action = func() { offerStop(c) }
+			}
+			notify.Send(m)
+		}
+		// competitor which went away will be reported again when it is back
+		reported = current
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(competitorsInterval):
+		}
+	}
+}
+
+// competitorsStatus formats last detected competitors for Status dialog.
+func competitorsStatus() string {
+	competitorsLock.Lock()
+	defer competitorsLock.Unlock()
+
+	if len(competitors) == 0 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteString("---------------------------\nCompeting agents:")
+	for _, c := range competitors {
+		fmt.Fprintf(&buf, "\n  %s", c.String())
+	}
+	return buf.String()
+}
@@ -0,0 +1,237 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// controller exposes running instance to control API.
+type controller struct{}
+
+func (controller) Status() *control.Status {
+	st := &control.Status{
+		Version:   misc.GetVersion(),
+		PID:       os.Getpid(),
+		GnuPG:     gpgAgent.Ver,
+		AgentPID:  gpgAgent.PID(),
+		Locked:    gpgAgent.Locked(),
+		Away:      gpgAgent.Disconnected(),
+		Endpoints: gpgAgent.Endpoints(),
+		Keys:      -1,
+		Gclpr:     strings.TrimSpace(strings.TrimPrefix(clipHelp, "---------------------------")),
+		Home:      gpgAgent.Cfg.GUI.Home,
+		Sockets:   gpgAgent.Cfg.GUI.Sockets,
+		Loopback:  gpgAgent.LoopbackKeys(),
+	}
+	if bs := gpgAgent.Batch(); bs.Active || bs.Signs > 0 {
+		st.Batch = &bs
+	}
+	if us := gpgAgent.Unlock(); us.Enabled {
+		st.Unlock = &us
+	}
+	if keys, err := gpgAgent.Keys(); err == nil {
+		st.Keys = len(keys)
+	} else {
+		log.Printf("Unable to get keys: %s", err)
+	}
+	return st
+}
+
+func (controller) Keys() ([]agent.KeyInfo, error) {
+	return gpgAgent.Keys()
+}
+
+func (controller) ClearCache() error {
+	return gpgAgent.ClearCache()
+}
+
+func (controller) Restart() error {
+	return gpgAgent.Restart()
+}
+
+func (controller) Stop() error {
+	log.Print("Requesting exit (control API)")
+	requestExit()
+	return nil
+}
+
+func (controller) Reload() error {
+	// do not go down if new configuration is broken
+	if _, err := config.LoadInstance(aInstance, aConfigName); err != nil {
+		return fmt.Errorf("unable to load configuration from %s: %w", aConfigName, err)
+	}
+	log.Print("Requesting reload (control API)")
+	reloadRequested = true
+	requestExit()
+	return nil
+}
+
+func (controller) ReloadPolicy() error {
+	cfg, err := config.LoadInstance(aInstance, aConfigName)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration from %s: %w", aConfigName, err)
+	}
+	return gpgAgent.SetPolicy(&cfg.GUI)
+}
+
+func (controller) SetPassphrase(keygrip string, pass []byte) error {
+	return gpgAgent.SetPassphrase(keygrip, pass)
+}
+
+func (controller) ForgetPassphrase(keygrip string) error {
+	return gpgAgent.ForgetPassphrase(keygrip)
+}
+
+func (controller) SetBatch(on bool) error {
+	return gpgAgent.SetBatch(on)
+}
+
+func (controller) OpenUnlockWindow(d time.Duration) error {
+	return gpgAgent.OpenUnlockWindow(d)
+}
+
+func (controller) CloseUnlockWindow() error {
+	gpgAgent.CloseUnlockWindow()
+	return nil
+}
+
+func controlServe(ctx context.Context, cfg *config.Config) {
+	token, err := control.Token(cfg.GUI.Home, cfg.GUI.Control.Token)
+	if err != nil {
+		log.Printf("Control API is disabled: %s", err)
+		return
+	}
+	opts := &control.Options{Pipe: util.ControlPipeName(cfg.GUI.Instance), Port: cfg.GUI.Control.Port, Token: token, Tokens: cfg.GUI.Control.Tokens, CertFile: cfg.GUI.Control.Cert, KeyFile: cfg.GUI.Control.Key}
+	go func() {
+		defer util.HandlePanic()
+		if err := control.Serve(ctx, opts, controller{}); err != nil {
+			log.Printf("Control API returned error: %s", err)
+		}
+	}()
+}
+
+// sendVerb contacts running instance and asks it to perform action, returns process exit code.
+func sendVerb(cfg *config.Config, verb func(*control.Client) error) int {
+	util.AttachConsole()
+
+	c, err := control.NewClient(util.ControlPipeName(cfg.GUI.Instance), cfg.GUI.Home, cfg.GUI.Control.Token)
+	if err == nil {
+		err = verb(c)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// setPassphrase returns verb which reads passphrase from stdin (first line, so it could be piped from secret store or
+// typed) and sends it to running instance.
+func setPassphrase(keygrip string) func(*control.Client) error {
+	return func(c *control.Client) error {
+		pass, err := util.NewSecureBuffer(control.MaxPassphrase)
+		if err != nil {
+			return err
+		}
+		defer pass.Free()
+		var b [1]byte
+		for {
+			n, err := os.Stdin.Read(b[:])
+			if n == 0 || b[0] == '\n' {
+				if err != nil && !errors.Is(err, io.EOF) {
+					return fmt.Errorf("unable to read passphrase: %w", err)
+				}
+				if n == 0 && err == nil {
+					continue
+				}
+				break
+			}
+			if _, err := pass.Write(b[:]); err != nil {
+				return err
+			}
+		}
+		if p := pass.Bytes(); len(p) > 0 && p[len(p)-1] == '\r' {
+			pass.Truncate(len(p) - 1)
+		}
+		return c.SetPassphrase(keygrip, pass.Bytes())
+	}
+}
+
+// forgetPassphrase returns verb which makes running instance drop passphrase for key, "all" drops every passphrase.
+func forgetPassphrase(keygrip string) func(*control.Client) error {
+	return func(c *control.Client) error {
+		if strings.EqualFold(keygrip, "all") {
+			keygrip = ""
+		}
+		return c.ForgetPassphrase(keygrip)
+	}
+}
+
+// batchVerb returns verb which turns batch signing mode of running instance on or off.
+func batchVerb(mode string) (func(*control.Client) error, error) {
+	switch strings.ToLower(mode) {
+	case "on":
+		return (*control.Client).StartBatch, nil
+	case "off":
+		return (*control.Client).StopBatch, nil
+	default:
+	}
+	return nil, fmt.Errorf("--batch: unknown value \"%s\", should be \"on\" or \"off\"", mode)
+}
+
+// unlockVerb returns verb which opens unlock window of running instance for duration ("on" - configured one) or
+// closes it.
+func unlockVerb(mode string) (func(*control.Client) error, error) {
+	switch strings.ToLower(mode) {
+	case "on":
+		return func(c *control.Client) error { return c.OpenUnlockWindow(0) }, nil
+	case "off":
+		return (*control.Client).CloseUnlockWindow, nil
+	default:
+	}
+	d, err := time.ParseDuration(mode)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("--unlock: unknown value \"%s\", should be \"on\", \"off\" or duration", mode)
+	}
+	return func(c *control.Client) error { return c.OpenUnlockWindow(d) }, nil
+}
+
+// printStatus contacts running instance and prints its status to console, returns process exit code.
+func printStatus(cfg *config.Config) int {
+	util.AttachConsole()
+
+	c, err := control.NewClient(util.ControlPipeName(cfg.GUI.Instance), cfg.GUI.Home, cfg.GUI.Control.Token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	st, err := c.Status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !aJSON {
+		fmt.Fprint(os.Stdout, st)
+		return 0
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+type dryRunEnv struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	WSLENV string `json:"wslenv,omitempty"`
+}
+
+type dryRunReport struct {
+	Config   string      `json:"config"`
+	Instance string      `json:"instance,omitempty"`
+	Plan     *agent.Plan `json:"plan"`
+	Control  string      `json:"control_pipe"`
+	SetEnv   bool        `json:"setenv"`
+	Env      []dryRunEnv `json:"env,omitempty"`
+	Problems []string    `json:"problems,omitempty"`
+}
+
+// dryRun prints what would be created with current configuration without binding anything, returns process exit code.
+func dryRun(cfg *config.Config) int {
+	util.AttachConsole()
+
+	a, err := agent.Prepare(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	r := &dryRunReport{Config: aConfigName, Instance: cfg.GUI.Instance, Plan: a.DryRun(), Control: util.ControlPipeName(cfg.GUI.Instance), SetEnv: cfg.GUI.SetEnv}
+	if !util.FileExists(aConfigName) {
+		r.Config += " (not found, using defaults)"
+	}
+	if util.PipeExists(r.Control) {
+		r.Problems = append(r.Problems, fmt.Sprintf("control pipe %s exists, instance is already running", r.Control))
+	}
+	pipe := cfg.GUI.PipeName
+	if a.DelegatesPipe() {
+		pipe = ""
+	}
+	for _, c := range relevantCompetitors(cfg, util.DetectCompetitors(pipe, cfg.GPG.Home, 0)) {
+		if len(c.Endpoint) > 0 || len(c.Service) > 0 {
+			r.Problems = append(r.Problems, "competing agent "+c.String())
+		}
+	}
+	if _, err := os.Stat(cfg.GPG.Home); err != nil {
+		r.Problems = append(r.Problems, fmt.Sprintf("gpg.homedir %s is not accessible: %s", cfg.GPG.Home, err))
+	}
+	if r.SetEnv {
+		for _, v := range envVars(a, !strings.EqualFold(cfg.GUI.SSH, "cygwin")) {
+			if len(v.value) == 0 && !v.external {
+				continue
+			}
+			r.Env = append(r.Env, dryRunEnv{Name: v.name, Value: v.value, WSLENV: v.wslenvEntry()})
+		}
+	}
+
+	if aJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		r.print()
+	}
+	if len(r.Problems) > 0 || r.Plan.Conflicts() > 0 {
+		return exitProblems
+	}
+	return 0
+}
+
+func (r *dryRunReport) print() {
+	fmt.Printf("Configuration: %s\n", r.Config)
+	if len(r.Instance) > 0 {
+		fmt.Printf("Instance:      %s\n", r.Instance)
+	}
+	fmt.Printf("gpg-agent:     %s (%s)\n", r.Plan.Exe, r.Plan.Version)
+	fmt.Printf("Control API:   %s\n", r.Control)
+
+	endpoints := func(header string, eps []agent.PlannedEndpoint) {
+		fmt.Printf("\n%s:\n", header)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, e := range eps {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", e.Name, e.Address, e.Conflict)
+		}
+		w.Flush()
+	}
+	endpoints("Endpoints agent-gui would serve", r.Plan.Endpoints)
+	endpoints("Sockets gpg-agent would create", r.Plan.Upstream)
+
+	if r.SetEnv {
+		fmt.Print("\nUser environment variables:\n")
+		for _, e := range r.Env {
+			if len(e.Value) > 0 {
+				fmt.Printf("  %s=%s\n", e.Name, e.Value)
+			}
+		}
+		var wslenv []string
+		for _, e := range r.Env {
+			if len(e.WSLENV) > 0 {
+				wslenv = append(wslenv, e.WSLENV)
+			}
+		}
+		if len(wslenv) > 0 {
+			fmt.Printf("  WSLENV+=%s\n", strings.Join(wslenv, ":"))
+		}
+	} else {
+		fmt.Print("\nUser environment is not modified (gui.setenv is off)\n")
+	}
+
+	if len(r.Problems) > 0 {
+		fmt.Print("\nProblems:\n")
+		for _, p := range r.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	if n := r.Plan.Conflicts(); n > 0 {
+		fmt.Printf("\n%d endpoint(s) have conflicts\n", n)
+	}
+}
@@ -0,0 +1,76 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Process exit codes. They are part of command line interface - wrapper scripts branch on them, so never renumber.
+const (
+	exitOK        = 0
+	exitFailure   = 1 // anything not classified below
+	exitProblems  = 2 // --dry-run found conflicts, --bench had errors
+	exitConfig    = 3 // bad command line or configuration
+	exitPlatform  = 4 // Windows does not support what is needed
+	exitRunning   = 5 // instance is already running
+	exitNoGPG     = 6 // GnuPG is not found
+	exitBindError = 7 // connector could not be served
+)
+
+var exitCauses = map[int]string{
+	exitFailure:   "failure",
+	exitProblems:  "problems",
+	exitConfig:    "config",
+	exitPlatform:  "platform",
+	exitRunning:   "already_running",
+	exitNoGPG:     "gpg_not_found",
+	exitBindError: "bind",
+}
+
+// startupError is what --errors-json prints to stdout, single JSON object per line.
+type startupError struct {
+	Code  int    `json:"code"`
+	Cause string `json:"cause"`
+	Error string `json:"error"`
+}
+
+// exitCode classifies errors returned by agent.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, agent.ErrGPGNotFound):
+		return exitNoGPG
+	case errors.Is(err, agent.ErrBind):
+		return exitBindError
+	default:
+	}
+	return exitFailure
+}
+
+// reportError tells user about failure: message box normally, structured record on stdout with --errors-json.
+func reportError(code int, err error) {
+	if !aErrorsJSON {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return
+	}
+	util.AttachConsole()
+	if err := json.NewEncoder(os.Stdout).Encode(startupError{Code: code, Cause: exitCauses[code], Error: err.Error()}); err != nil {
+		log.Printf("Unable to report error: %s", err)
+	}
+}
+
+// fatal reports error and terminates process with code.
+func fatal(code int, err error) {
+	reportError(code, err)
+	os.Exit(code)
+}
+
+// fatalf is fatal with formatted message.
+func fatalf(code int, format string, args ...interface{}) {
+	fatal(code, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,162 @@
+package gui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const envGitSSHName = "GIT_SSH"
+
+// gitSetting is single global git configuration value helper would set.
+type gitSetting struct {
+	key, value, current string
+}
+
+// gitPlan describes what has to be changed so Git for Windows uses served agent and Windows GnuPG.
+type gitPlan struct {
+	git      string
+	settings []gitSetting
+	sshEnv   string
+	notes    []string
+}
+
+// findGit locates Git for Windows using its installation record, then PATH.
+func findGit() (string, error) {
+	for _, root := range []registry.Key{registry.LOCAL_MACHINE, registry.CURRENT_USER} {
+		k, err := registry.OpenKey(root, `SOFTWARE\GitForWindows`, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		dir, _, err := k.GetStringValue("InstallPath")
+		k.Close()
+		if fname := filepath.Join(dir, "cmd", "git.exe"); err == nil && util.FileExists(fname) {
+			return fname, nil
+		}
+	}
+	fname, err := exec.LookPath("git.exe")
+	if err != nil {
+		return "", fmt.Errorf("Git for Windows is not found")
+	}
+	return fname, nil
+}
+
+func gitCommand(git string, args ...string) *exec.Cmd {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	cmd := exec.Command(git, args...)
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	return cmd
+}
+
+// gitForwardPath formats Windows path the way git configuration expects it.
+func gitForwardPath(path string) string {
+	return filepath.ToSlash(util.CleanPath(path))
+}
+
+func prepareGitPlan(cfg *config.Config) (*gitPlan, error) {
+
+	git, err := findGit()
+	if err != nil {
+		return nil, err
+	}
+	p := &gitPlan{git: git}
+
+	add := func(key, value string) {
+		var current string
+		if out, err := gitCommand(git, "config", "--global", "--get", key).Output(); err == nil {
+			current = strings.TrimSpace(string(out))
+		}
+		p.settings = append(p.settings, gitSetting{key: key, value: value, current: current})
+	}
+
+	gpg := filepath.Join(cfg.GPG.Path, "bin", "gpg.exe")
+	if util.FileExists(gpg) {
+		add("gpg.program", gitForwardPath(gpg))
+	} else {
+		p.notes = append(p.notes, fmt.Sprintf("%s is not found, gpg.program is not changed", gpg))
+	}
+
+	if strings.EqualFold(cfg.GUI.SSH, "cygwin") {
+		p.notes = append(p.notes, "gui.openssh is cygwin - ssh bundled with Git uses SSH_AUTH_SOCK, ssh settings are not changed")
+		return p, nil
+	}
+	ssh := filepath.Join(os.Getenv("SystemRoot"), "System32", "OpenSSH", "ssh.exe")
+	if !util.FileExists(ssh) {
+		p.notes = append(p.notes, fmt.Sprintf("Windows OpenSSH client %s is not found, ssh settings are not changed", ssh))
+		return p, nil
+	}
+	add("core.sshCommand", gitForwardPath(ssh))
+	p.sshEnv = ssh
+	return p, nil
+}
+
+func (p *gitPlan) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Git: %s\n", p.git)
+	for _, s := range p.settings {
+		current := s.current
+		if len(current) == 0 {
+			current = "<not set>"
+		}
+		fmt.Fprintf(&buf, "\ngit config --global %s \"%s\"\n    currently: %s", s.key, s.value, current)
+	}
+	if len(p.sshEnv) > 0 {
+		fmt.Fprintf(&buf, "\n\nuser environment %s=%s", envGitSSHName, p.sshEnv)
+	}
+	for _, n := range p.notes {
+		fmt.Fprintf(&buf, "\n\n%s", n)
+	}
+	return buf.String()
+}
+
+func (p *gitPlan) apply() error {
+	for _, s := range p.settings {
+		if s.current == s.value {
+			continue
+		}
+		if out, err := gitCommand(p.git, "config", "--global", s.key, s.value).CombinedOutput(); err != nil {
+			return fmt.Errorf("unable to set %s: %w (%s)", s.key, err, strings.TrimSpace(string(out)))
+		}
+		log.Printf("Git global %s set to %s", s.key, s.value)
+	}
+	if len(p.sshEnv) > 0 {
+		// unlike other variables this one should survive agent-gui exit, as git configuration does
+		if err := util.PrepareUserEnvironmentVariable(envGitSSHName, p.sshEnv, false, ""); err != nil {
+			return fmt.Errorf("unable to add %s to user environment: %w", envGitSSHName, err)
+		}
+	}
+	return nil
+}
+
+// configureGit detects Git for Windows and after confirmation points its global configuration to served agent and
+// Windows GnuPG. Returns process exit code.
+func configureGit(cfg *config.Config) int {
+	p, err := prepareGitPlan(cfg)
+	if err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return 1
+	}
+	if len(p.settings) == 0 {
+		util.ShowOKMessage(util.MsgInformation, trayTitle, p.String()+"\n\nNothing to configure.")
+		return 0
+	}
+	if util.MessageBox(trayTitle, p.String()+"\n\nWrite these settings to global .gitconfig?", util.MB_YESNO|util.MB_ICONQUESTION|util.MB_SETFOREGROUND) != util.IDYES {
+		return 0
+	}
+	if err := p.apply(); err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return 1
+	}
+	util.ShowOKMessage(util.MsgInformation, trayTitle, "Git is configured. Restart shells and editors to pick up changes.")
+	return 0
+}
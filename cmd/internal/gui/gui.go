@@ -0,0 +1,1015 @@
+package gui
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/allan-simon/go-singleinstance"
+	"github.com/atotto/clipboard"
+	"github.com/pborman/getopt/v2"
+	"go.uber.org/multierr"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/gclpr"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/systray"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+var (
+	title       = "agent-gui"
+	tooltip     = "GUI wrapper for gpg-agent"
+	cli         = getopt.New()
+	aConfigName = title + ".conf"
+	usageString string
+	aShowHelp   bool
+	aDebug      bool
+	aStatus     bool
+	aWatch      bool
+	aJSON       bool
+	aStop       bool
+	aReload     bool
+	aPolicy     bool
+	aNoTray     bool
+	aConsole    bool
+	aInstance   string
+	aFakeAgent  bool
+	aDryRun     bool
+	aGit        bool
+	aVSCode     string
+	aListWSL    bool
+	aLoopback   string
+	aExport     string
+	aImport     string
+	aPSModule   string
+	aPerf       string
+	aWSL        string
+	aInstall    bool
+	aUninstall  bool
+	aErrorsJSON bool
+	aSetPass    string
+	aForgetPass string
+	aBatch      string
+	aUnlock     string
+	aBench      time.Duration
+	aBenchConns = 8
+	gpgAgent    *agent.Agent
+	clipCancel  context.CancelFunc
+	clipCtx     context.Context
+	clipHelp    string
+	clipHistory *gclpr.History
+	// set when running instance should start its fresh copy on exit
+	reloadRequested bool
+	// batch signing mode changes for tray menu
+	batchCh = make(chan bool, 1)
+	// unlock window changes for tray menu
+	unlockCh = make(chan bool, 1)
+	// quiet hours override changes for tray menu
+	quietCh = make(chan bool, 1)
+)
+
+const (
+	envGPGHomeName    = "GNUPG_HOME"
+	envGPGSocketsName = "GNUPG_SOCKETS"
+	envGUIHomeName    = "AGENT_HOME"
+	envGUISocketsName = "AGENT_SOCKETS"
+	envPipeName       = "SSH_AUTH_SOCK"
+)
+
+func onReady() {
+
+	log.Print("Entering systray")
+
+	setTrayAppearance()
+
+	miStat := systray.AddMenuItem("Status", "Shows application state")
+	miHelp := systray.AddMenuItem("About", "Shows application help")
+	miLog := systray.AddMenuItem("gpg-agent log", "Opens gpg-agent log file")
+	if len(gpgAgent.LogFile()) == 0 {
+		miLog.Hide()
+	}
+	addActivityMenu(activity)
+	if clipHistory != nil {
+		addHistoryMenu(clipHistory)
+	}
+	addQRCodeMenu(gpgAgent)
+	miBatch := systray.AddMenuItemCheckbox("Batch signing", "Reuses gpg-agent connections, caches passphrases longer and shows only first use of every key", gpgAgent.Batch().Active)
+	miUnlock := systray.AddMenuItemCheckbox("Unlock key operations", "Allows key operations until unlock window expires", gpgAgent.Unlock().Open)
+	if !gpgAgent.Unlock().Enabled {
+		miUnlock.Hide()
+	}
+	miQuiet := systray.AddMenuItemCheckbox("Ignore quiet hours", "Key operations follow regular policy until current quiet hours are over", false)
+	if len(gpgAgent.Cfg.GUI.Policy.QuietHours) == 0 {
+		miQuiet.Hide()
+	}
+	miApprovals := systray.AddMenuItem("Approvals", "Shows remembered \"Always allow\" decisions")
+	if !gpgAgent.Cfg.GUI.Policy.Remember && len(gpgAgent.Approvals()) == 0 {
+		miApprovals.Hide()
+	}
+	miCard := systray.AddMenuItem("Smartcard", "Shows OpenPGP card state, PIN retry counters and card operations")
+	miKeys := systray.AddMenuItem("Key expiry", "Shows when own signing and ssh keys expire")
+	miBackup := systray.AddMenuItem("Back up keyring", "Writes snapshot of public keyring and ownertrust")
+	miGit := systray.AddMenuItem("Configure Git", "Makes Git for Windows use this agent and Windows GnuPG")
+	systray.AddSeparator()
+	miQuit := systray.AddMenuItem("Exit", "Exits application")
+
+	go func() {
+		defer util.HandlePanic()
+		for {
+			select {
+			case <-miHelp.ClickedCh:
+				util.ShowOKMessage(util.MsgInformation, trayTitle, usageString)
+			case <-miLog.ClickedCh:
+				openAgentLog()
+			case <-miBatch.ClickedCh:
+				if err := gpgAgent.SetBatch(!gpgAgent.Batch().Active); err != nil {
+					log.Printf("Unable to switch batch signing mode: %s", err.Error())
+				}
+			case <-miUnlock.ClickedCh:
+				if gpgAgent.Unlock().Open {
+					gpgAgent.CloseUnlockWindow()
+				} else if err := gpgAgent.OpenUnlockWindow(0); err != nil {
+					log.Printf("Unable to open unlock window: %s", err.Error())
+				}
+			case <-miQuiet.ClickedCh:
+				if err := gpgAgent.OverrideQuietHours(!miQuiet.Checked()); err != nil {
+					util.ShowOKMessage(util.MsgInformation, trayTitle, err.Error())
+				}
+			case on := <-quietCh:
+				if on {
+					miQuiet.Check()
+				} else {
+					miQuiet.Uncheck()
+				}
+			case open := <-unlockCh:
+				if open {
+					miUnlock.Check()
+				} else {
+					miUnlock.Uncheck()
+				}
+			case on := <-batchCh:
+				if on {
+					miBatch.Check()
+				} else {
+					miBatch.Uncheck()
+				}
+			case <-miApprovals.ClickedCh:
+				manageApprovals(gpgAgent)
+			case <-miCard.ClickedCh:
+				go showCardDashboard(gpgAgent)
+			case <-miKeys.ClickedCh:
+				go showKeys(gpgAgent, "")
+			case <-miBackup.ClickedCh:
+				go backupKeyring(gpgAgent)
+			case <-miGit.ClickedCh:
+				configureGit(gpgAgent.Cfg)
+			case <-miStat.ClickedCh:
+				if gpgAgent != nil {
+					help := gpgAgent.Status() + "\n\n" + clipHelp
+					if m := gclpr.LastMismatch(); len(m) > 0 {
+						help += "\ngclpr protocol mismatch: " + m
+					}
+					if c := competitorsStatus(); len(c) > 0 {
+						help += "\n" + c
+					}
+					util.ShowOKMessage(util.MsgInformation, trayTitle, help)
+				}
+			case <-miQuit.ClickedCh:
+				log.Print("Requesting exit")
+				systray.Quit()
+				return
+			}
+		}
+	}()
+}
+
+// addHistoryMenu creates submenu with remote clipboard history, clicking on item puts its text back into clipboard.
+func addHistoryMenu(h *gclpr.History) {
+
+	const maxTitle = 48
+
+	miHist := systray.AddMenuItem("Clipboard history", "Remote clipboard payloads")
+	items := make([]*systray.MenuItem, h.Size())
+	for i := range items {
+		items[i] = miHist.AddSubMenuItem("", "Restore to clipboard")
+		items[i].Hide()
+	}
+	miHist.Disable()
+
+	var (
+		mu      sync.Mutex
+		entries []gclpr.HistoryEntry
+	)
+
+	refresh := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		entries = h.Entries()
+		for i, item := range items {
+			if i >= len(entries) {
+				item.Hide()
+				continue
+			}
+			text := strings.Join(strings.Fields(entries[i].Text), " ")
+			if r := []rune(text); len(r) > maxTitle {
+				text = string(r[:maxTitle]) + "..."
+			}
+			item.SetTitle(fmt.Sprintf("%s  %s", entries[i].When.Format("15:04:05"), text))
+			item.Show()
+		}
+		if len(entries) > 0 {
+			miHist.Enable()
+		}
+	}
+
+	go func() {
+		for range h.Changed() {
+			refresh()
+		}
+	}()
+
+	for i, item := range items {
+		go func(i int, item *systray.MenuItem) {
+			for range item.ClickedCh {
+				mu.Lock()
+				var text string
+				if i < len(entries) {
+					text = entries[i].Text
+				}
+				mu.Unlock()
+				if len(text) == 0 {
+					continue
+				}
+				if err := clipboard.WriteAll(text); err != nil {
+					log.Printf("Unable to restore clipboard from history: %s", err.Error())
+				}
+			}
+		}(i, item)
+	}
+}
+
+func onExit() {
+	// stop servicing clipboard and uri requests
+	clipCancel()
+	// and all gpg related translations
+	if err := gpgAgent.Stop(); err != nil {
+		log.Printf("Problem stopping gpg agent: %s", err.Error())
+	}
+	log.Print("Exiting systray")
+}
+
+func onSession(e systray.SessionEvent) {
+	switch e {
+	case systray.SesLock:
+		atomic.StoreInt32(&sessionLocked, 1)
+		gpgAgent.SessionLock()
+	case systray.SesUnlock:
+		atomic.StoreInt32(&sessionLocked, 0)
+		gpgAgent.SessionUnlock()
+	case systray.SesConsoleDisconnect, systray.SesRemoteDisconnect:
+		gpgAgent.SessionDisconnect()
+	case systray.SesConsoleConnect, systray.SesRemoteConnect:
+		gpgAgent.SessionReconnect()
+		// shell of reattached session could have missed icon and environment changes made while it was away
+		systray.RestoreIcon()
+		if refreshVars != nil {
+			go refreshVars()
+		}
+	default:
+		return
+	}
+	watchers.stateChanged()
+}
+
+// envVar describes user environment variable agent-gui sets.
+type envVar struct {
+	initialized bool
+	name, value string
+	// put on WSLENV list with flags
+	wslenv bool
+	flags  string
+	// variable is not ours, only its WSLENV entry is managed
+	external bool
+}
+
+// wslenvEntry returns WSLENV list entry of variable or empty string.
+func (v *envVar) wslenvEntry() string {
+	if !v.wslenv {
+		return ""
+	}
+	return util.WSLENVEntry(v.name, v.flags)
+}
+
+func (v *envVar) set() error {
+	if v.external {
+		return util.RegisterWSLENV(v.name, v.flags)
+	}
+	return util.PrepareUserEnvironmentVariable(v.name, v.value, v.wslenv, v.flags)
+}
+
+func (v *envVar) clean() error {
+	if v.external {
+		return util.UnregisterWSLENV(v.name, v.flags)
+	}
+	return util.CleanUserEnvironmentVariable(v.name, v.wslenv, v.flags)
+}
+
+// envVars returns environment variables to be set for agent configuration with WSLENV flags adjusted by gui.wslenv.
+func envVars(a *agent.Agent, native bool) []envVar {
+
+	vars := []envVar{
+		{name: envPipeName, value: a.Cfg.GUI.PipeName},
+		{name: "WSL_" + envPipeName, value: a.GetConnector(agent.ConnectorSockAgentSSH).PathGUI(), wslenv: true, flags: "up"},
+		{name: "WSL_" + envGPGHomeName, value: a.Cfg.GPG.Home, wslenv: true, flags: "up"},
+		{name: "WIN_" + envGPGHomeName, value: util.PrepareWindowsPath(a.Cfg.GPG.Home), wslenv: true, flags: "u"},
+		{name: "WSL_" + envGPGSocketsName, value: a.Cfg.GPG.Sockets, wslenv: true, flags: "up"},
+		{name: "WIN_" + envGPGSocketsName, value: util.PrepareWindowsPath(a.Cfg.GPG.Sockets), wslenv: true, flags: "u"},
+		{name: "WSL_" + envGUIHomeName, value: a.Cfg.GUI.Home, wslenv: true, flags: "up"},
+		{name: "WIN_" + envGUIHomeName, value: util.PrepareWindowsPath(a.Cfg.GUI.Home), wslenv: true, flags: "u"},
+		{name: "WSL_" + envGUISocketsName, value: a.Cfg.GUI.Sockets, wslenv: true, flags: "up"},
+		{name: "WIN_" + envGUISocketsName, value: util.PrepareWindowsPath(a.Cfg.GUI.Sockets), wslenv: true, flags: "u"},
+	}
+
+	if !native {
+		// set variable for Cygwin OpenSSH rather then for Windows OpenSSH using path form of detected Cygwin flavor
+		vars[0].value = a.Dialect.Path(a.GetConnector(agent.ConnectorSockAgentCygwinSSH).PathGUI())
+	}
+
+	// "-" keeps variable out of WSLENV, names we do not set only get WSLENV entries
+	var external []string
+	for name := range a.Cfg.GUI.WSLEnv {
+		external = append(external, name)
+	}
+	sort.Strings(external)
+	for _, name := range external {
+		flags, found := a.Cfg.GUI.WSLEnv[name], false
+		for i := range vars {
+			if vars[i].name == name {
+				vars[i].wslenv, vars[i].flags, found = flags != "-", flags, true
+				break
+			}
+		}
+		if !found && flags != "-" {
+			vars = append(vars, envVar{name: name, wslenv: true, flags: flags, external: true})
+		}
+	}
+	return vars
+}
+
+// wslenvPaths returns true when variable is passed to WSL with path translation.
+func wslenvPaths(a *agent.Agent, name string) bool {
+	if !a.Cfg.GUI.SetEnv {
+		return false
+	}
+	for _, v := range envVars(a, true) {
+		if v.name == name {
+			return v.wslenv && strings.ContainsAny(v.flags, "pl")
+		}
+	}
+	return false
+}
+
+// refreshVars sets registered environment variables again and tells shell about them, nil if none are set.
+var refreshVars func()
+
+func setVars(native bool) (func(), error) {
+
+	vars := envVars(gpgAgent, native)
+
+	cleaner := func() {
+		for i := len(vars) - 1; i >= 0; i-- {
+			if vars[i].initialized {
+				if err := vars[i].clean(); err != nil {
+					log.Printf("Unable to delete %s from user environment: %s", vars[i].name, err.Error())
+				}
+				vars[i].initialized = false
+			}
+		}
+	}
+
+	// register everything
+	for i := 0; i < len(vars); i++ {
+		if len(vars[i].value) == 0 && !vars[i].external {
+			continue
+		}
+		if err := vars[i].set(); err != nil {
+			cleaner()
+			return nil, fmt.Errorf("unable to add %s to user environment: %w", vars[i].name, err)
+		}
+		vars[i].initialized = true
+	}
+	refreshVars = func() {
+		for i := range vars {
+			if !vars[i].initialized {
+				continue
+			}
+			if err := vars[i].set(); err != nil {
+				log.Printf("Unable to refresh %s in user environment: %s", vars[i].name, err.Error())
+			}
+		}
+	}
+	return cleaner, nil
+}
+
+func run() error {
+
+	// Eventually gpg-agent on Windows will directly support Windows openssh server (Oh, hear the call! — Good hunting all) - https://dev.gnupg.org/T3883.
+	// Until then we need to create specific translation layers. In addition assuan S.gpg-agent.ssh is presently broken under Windows (at least in
+	// GnuPG 2.2.25), so we have to resort to putty support instead to transport data from/to named pipe (Windows openssh at least up to 8.1) and AF_UNIX
+	// socket (WSL). NOTE: WSL2 requires additional layer of translation using socat on Linux side and either HYPER-V socket server or helper on Windows end
+	// since AF_UNIX interop is not (yet? ever?) implemented.
+
+	// Transact on local TCP socket for XAgent protocol
+	if gpgAgent.Cfg.GUI.XAgentCookieSize > 0 {
+		if err := gpgAgent.Serve(agent.ConnectorXShell); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorXShell)
+	}
+
+	// Transact on Cygwin socket for ssh Cygwin/MSYS ports
+	if err := gpgAgent.Serve(agent.ConnectorSockAgentCygwinSSH); err != nil {
+		return err
+	}
+	defer gpgAgent.Close(agent.ConnectorSockAgentCygwinSSH)
+
+	// Transact on pipe for Windows openssh, unless it is left to Windows OpenSSH ssh-agent service
+	if gpgAgent.DelegatesPipe() {
+		log.Printf("%s is left to %s service", gpgAgent.Cfg.GUI.PipeName, util.OpenSSHAgentService)
+		if err := util.StartOpenSSHAgent(); err != nil {
+			startupWarning("%s", err.Error())
+		}
+	} else {
+		owner := claimPipe(gpgAgent.Cfg)
+		if err := gpgAgent.Serve(agent.ConnectorPipeSSH); err != nil {
+			if len(owner) > 0 {
+				return fmt.Errorf("%w, pipe is owned by %s", err, owner)
+			}
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorPipeSSH)
+	}
+
+	// Transact on AF_UNIX socket for ssh
+	if err := gpgAgent.Serve(agent.ConnectorSockAgentSSH); err != nil {
+		return err
+	}
+	defer gpgAgent.Close(agent.ConnectorSockAgentSSH)
+
+	// Transact on local tcp cocket for gpg agent
+	if gpgAgent.Cfg.GUI.ExtraPort != 0 {
+		if err := gpgAgent.Serve(agent.ConnectorExtraPort); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorExtraPort)
+	}
+
+	// Transact on Hyper-V sockets for guest VMs
+	if gpgAgent.Cfg.GUI.HyperV.SSHPort > 0 {
+		if err := gpgAgent.Serve(agent.ConnectorHvsockSSH); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorHvsockSSH)
+	}
+	if gpgAgent.Cfg.GUI.HyperV.ExtraPort > 0 {
+		if err := gpgAgent.Serve(agent.ConnectorHvsockExtra); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorHvsockExtra)
+	}
+
+	// Transact on Noise encrypted TCP transport for remote machines
+	if gpgAgent.Cfg.GUI.Noise.Port > 0 {
+		if err := gpgAgent.Serve(agent.ConnectorNoise); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorNoise)
+	}
+
+	// Transact on WebSocket for browser based ssh clients
+	if gpgAgent.Cfg.GUI.WebSocket.Port > 0 {
+		if err := gpgAgent.Serve(agent.ConnectorWebSocket); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorWebSocket)
+	}
+
+	// Transact on AF_UNIX socket for gpg agent
+	if err := gpgAgent.Serve(agent.ConnectorSockAgent); err != nil {
+		return err
+	}
+	defer gpgAgent.Close(agent.ConnectorSockAgent)
+
+	// Transact on AF_UNIX socket for gpg agent
+	if err := gpgAgent.Serve(agent.ConnectorSockAgentExtra); err != nil {
+		return err
+	}
+	defer gpgAgent.Close(agent.ConnectorSockAgentExtra)
+
+	// Transact on AF_UNIX socket for dirmngr, so keyserver operations in WSL use Windows side
+	if gpgAgent.Cfg.GUI.Dirmngr.Enabled {
+		if err := gpgAgent.Serve(agent.ConnectorSockDirmngr); err != nil {
+			return err
+		}
+		defer gpgAgent.Close(agent.ConnectorSockDirmngr)
+	}
+
+	if gpgAgent.Cfg.GUI.SetEnv {
+		cleaner, err := setVars(!strings.EqualFold(gpgAgent.Cfg.GUI.SSH, "cygwin"))
+		if err != nil {
+			return err
+		}
+		defer cleaner()
+	}
+
+	gpgAgent.OnLogProblem(notifyLogProblems(time.Minute))
+	// batch mode could be switched by control API or expire, tray menu follows
+	gpgAgent.OnBatch(func(on bool) {
+		watchers.stateChanged()
+		select {
+		case batchCh <- on:
+		default:
+		}
+	})
+	// unlock window could be opened by control API or hotkey and expires, tray menu follows
+	gpgAgent.OnUnlock(func(open bool) {
+		watchers.stateChanged()
+		select {
+		case unlockCh <- open:
+		default:
+		}
+	})
+	gpgAgent.OnQuietOverride(func(on bool) {
+		watchers.stateChanged()
+		select {
+		case quietCh <- on:
+		default:
+		}
+	})
+	if u := gpgAgent.Cfg.GUI.Unlock; u.Enabled && len(u.Hotkey) > 0 {
+		stop, err := util.RegisterHotkey(u.Hotkey, func() {
+			if err := gpgAgent.OpenUnlockWindow(0); err != nil {
+				log.Printf("Unable to open unlock window: %s", err.Error())
+			}
+		})
+		if err != nil {
+			startupWarning("Unlock window could only be opened from tray menu: %s", err)
+		} else {
+			defer stop()
+		}
+	}
+	if stop := setupTracing(gpgAgent.Cfg); stop != nil {
+		defer stop()
+	}
+	if err := gpgAgent.Start(); err != nil {
+		return err
+	}
+
+	// Serve control API for scripts, dashboards and command line verbs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controlServe(ctx, gpgAgent.Cfg)
+	startPerfCounters(ctx, gpgAgent)
+	if remove := publishDiscovery(gpgAgent); remove != nil {
+		defer remove()
+	}
+	go writeStartupReport(gpgAgent)
+	notify.Notify(notify.AgentStarted, trayTitle, "Agent started", "pid", strconv.Itoa(os.Getpid()), "gpg_agent_pid", strconv.Itoa(gpgAgent.PID()))
+
+	if !gpgAgent.Cfg.GUI.Headless {
+		go handleNotifications(ctx)
+	}
+	if gpgAgent.Cfg.GUI.Notify.FocusAssist {
+		go releaseHeldNotifications(ctx)
+	}
+	go watchCompetitors(ctx, gpgAgent.Cfg)
+	if gpgAgent.Cfg.GUI.ScreensaverLock {
+		go watchScreensaver(ctx, gpgAgent)
+	}
+	if gpgAgent.Cfg.GUI.KeyExpiry.Interval > 0 && !gpgAgent.Cfg.GUI.FakeAgent {
+		go watchKeyExpiry(ctx, gpgAgent)
+	}
+	if gpgAgent.Cfg.GUI.UpdateCheck > 0 {
+		go checkUpdates(ctx, gpgAgent.Cfg.GUI.UpdateCheck, gpgAgent.Cfg.GUI.Proxy.Mode(gpgAgent.Cfg.GUI.Proxy.Update))
+	}
+
+	if gpgAgent.Cfg.GUI.Headless {
+		runHeadless()
+		return nil
+	}
+	systray.Run(onReady, onExit, onSession)
+	return nil
+}
+
+func buildUsageString() string {
+	var buf = new(strings.Builder)
+	fmt.Fprintf(buf, "\n%s\n\nVersion:\n\t%s (%s)\n\t%s\n\n", tooltip, misc.GetVersion(), runtime.Version(), misc.GetGitHash())
+	cli.PrintUsage(buf)
+	return buf.String()
+}
+
+func clipServe(cfg *config.Config) {
+	clipCtx, clipCancel = context.WithCancel(context.Background())
+	clipHistory = gclpr.EnableHistory(cfg.GUI.Clp.History)
+	opts := &gclpr.Options{LE: cfg.GUI.Clp.LE, PasteLE: cfg.GUI.Clp.PasteLE, Formats: cfg.GUI.Clp.Formats, MinVersion: cfg.GUI.Clp.MinVer, MaxVersion: cfg.GUI.Clp.MaxVer}
+	def := clipText(gclpr.TextOptions{}, "default", config.CLPPeerConfig{LE: cfg.GUI.Clp.LE, PasteLE: cfg.GUI.Clp.PasteLE, Encoding: cfg.GUI.Clp.Encoding})
+	opts.CodePage = def.CodePage
+	if cfg.GUI.Clp.Unix {
+		// local clients (WSL) do not need keys
+		socketName := filepath.Join(cfg.GUI.Sockets, util.SocketGclprName)
+		uopts := opts
+		if pc, ok := cfg.GUI.Clp.Peers["unix"]; ok {
+			to := clipText(def, "unix", pc)
+			uopts = &gclpr.Options{LE: to.LE, PasteLE: to.PasteLE, CodePage: to.CodePage, Formats: opts.Formats, MinVersion: opts.MinVersion, MaxVersion: opts.MaxVersion}
+		}
+		go func() {
+			if err := gclpr.ServeUnix(clipCtx, socketName, uopts); err != nil {
+				log.Printf("gclpr serveUnix() returned error: %s", err.Error())
+			}
+		}()
+	}
+	if cfg.GUI.Clp.TLS.Enabled {
+		var err error
+		if opts.TLS, err = clipTLS(&cfg.GUI.Clp.TLS); err != nil {
+			log.Printf("gclpr mutual TLS is not available, only public keys will be used: %s", err.Error())
+		}
+	}
+	if len(cfg.GUI.Clp.Keys) > 0 || opts.TLS != nil {
+		var (
+			hpk, pkey [32]byte
+			pkeys     = make(map[[32]byte][32]byte)
+		)
+		for i, k := range cfg.GUI.Clp.Keys {
+			pk, err := hex.DecodeString(k)
+			if err != nil || len(pk) != 32 {
+				log.Printf("Bad gclpr public key %d. Ignoring", i)
+				continue
+			}
+			hpk = sha256.Sum256(pk)
+			copy(pkey[:], pk)
+			pkeys[hpk] = pkey
+			log.Printf("gclpr found public key: %s [%s]", k, hex.EncodeToString(hpk[:]))
+			if verbs, ok := cfg.GUI.Clp.Perms[k]; ok {
+				if opts.Permissions == nil {
+					opts.Permissions = make(map[[32]byte][]string)
+				}
+				opts.Permissions[hpk] = verbs
+				log.Printf("gclpr public key %d is restricted to %v", i, verbs)
+			}
+			if pc, ok := cfg.GUI.Clp.Peers[k]; ok {
+				if opts.Text == nil {
+					opts.Text = make(map[[32]byte]gclpr.TextOptions)
+				}
+				opts.Text[hpk] = clipText(def, fmt.Sprintf("public key %d", i), pc)
+			}
+		}
+		if len(pkeys) > 0 || opts.TLS != nil {
+			// we have possible clients for remote clipboard
+			bind := "localhost"
+			if len(cfg.GUI.Clp.Bind) > 0 {
+				bind = strings.Join(cfg.GUI.Clp.Bind, ", ")
+			}
+			clipHelp = fmt.Sprintf("---------------------------\ngclpr (protocol %s) is serving %d key(s) on port %d (%s)", gclpr.ServerVersion(), len(pkeys), cfg.GUI.Clp.Port, bind)
+			if opts.TLS != nil {
+				clipHelp += " with mutual TLS"
+			}
+			go func() {
+				if err := gclpr.Serve(clipCtx, cfg.GUI.Clp.Bind, cfg.GUI.Clp.Port, pkeys, opts); err != nil {
+					log.Printf("gclpr serve() returned error: %s", err.Error())
+					clipHelp = "gclpr is not running"
+				}
+			}()
+		}
+	}
+	if len(cfg.GUI.Clp.Sync.Peers) > 0 {
+		// push local clipboard changes to remote gclpr servers
+		peers := make([]*gclpr.Peer, 0, len(cfg.GUI.Clp.Sync.Peers))
+		for _, addr := range cfg.GUI.Clp.Sync.Peers {
+			p, err := gclpr.NewPeer(addr, cfg.GUI.Clp.Sync.Key, gclpr.Magic)
+			if err != nil {
+				log.Printf("%s. Ignoring", err.Error())
+				continue
+			}
+			p.TLS = opts.TLS
+			p.Text = def
+			if pc, ok := cfg.GUI.Clp.Peers[addr]; ok {
+				p.Text = clipText(def, addr, pc)
+			}
+			peers = append(peers, p)
+		}
+		if len(peers) > 0 {
+			go gclpr.Watch(clipCtx, peers, cfg.GUI.Clp.Sync.Interval)
+			if len(clipHelp) == 0 {
+				clipHelp = "---------------------------"
+			}
+			clipHelp += fmt.Sprintf("\ngclpr is pushing clipboard changes to %s", strings.Join(cfg.GUI.Clp.Sync.Peers, ", "))
+		}
+	}
+	if cfg.GUI.Clp.Unix {
+		if len(clipHelp) == 0 {
+			clipHelp = "---------------------------"
+		}
+		clipHelp += fmt.Sprintf("\ngclpr is serving AF_UNIX socket %s", filepath.Join(cfg.GUI.Sockets, util.SocketGclprName))
+	}
+}
+
+// clipText overrides default text translation with values configured for particular gclpr client.
+func clipText(def gclpr.TextOptions, name string, pc config.CLPPeerConfig) gclpr.TextOptions {
+	to := def
+	if len(pc.LE) > 0 {
+		to.LE = pc.LE
+	}
+	if len(pc.PasteLE) > 0 {
+		to.PasteLE = pc.PasteLE
+	}
+	if len(pc.Encoding) > 0 {
+		cp, err := util.CodePage(pc.Encoding)
+		if err != nil {
+			log.Printf("gclpr %s: %s. Ignoring", name, err.Error())
+			return to
+		}
+		if cp == util.CodePageUTF8 {
+			cp = 0
+		}
+		to.CodePage = cp
+	}
+	return to
+}
+
+// clipTLS prepares mutual TLS configuration for gclpr using certificates from Windows certificate store.
+func clipTLS(cfg *config.CLPTLSConfig) (*tls.Config, error) {
+	cert, err := util.StoreCertificate(cfg.Store, cfg.Cert)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := util.StoreCertPool(cfg.CAStore)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("gclpr is using certificate \"%s\" from store %s, trusting store %s", cert.Leaf.Subject, cfg.Store, cfg.CAStore)
+	return gclpr.NewTLSConfig(cert, roots, cfg.Subjects), nil
+}
+
+// lockFileName returns name of the lock file instance keeps open while it is running.
+func lockFileName() string {
+	return filepath.Join(os.TempDir(), util.InstanceName(title, aInstance)+".lock")
+}
+
+// otherInstances returns lock files of other running agent-gui instances - they are kept open while instance is running.
+func otherInstances(lockName string) []string {
+	var res []string
+	names, _ := filepath.Glob(filepath.Join(os.TempDir(), title+"*.lock"))
+	for _, name := range names {
+		if strings.EqualFold(name, lockName) {
+			continue
+		}
+		if f, err := os.OpenFile(name, os.O_RDWR, 0); err == nil {
+			// stale lock
+			f.Close()
+			continue
+		}
+		res = append(res, filepath.Base(name))
+	}
+	return res
+}
+
+// Main runs agent-gui: either command line verb acting on running instance or new instance itself.
+func Main() {
+
+	util.InitCrashReporter(title, 200)
+	defer util.HandlePanic()
+
+	util.NewLogWriter(title, 0, false)
+
+	// Process arguments
+	cli.SetProgram("agent-gui.exe")
+	cli.SetParameters("")
+	cli.FlagLong(&aConfigName, "config", 'c', "Configuration file", "path")
+	cli.FlagLong(&aInstance, "instance", 0, "Run (or act on) separate named instance with its own configuration, pipe names and sockets", "name")
+	cli.FlagLong(&aShowHelp, "help", 'h', "Show help")
+	cli.FlagLong(&aDebug, "debug", 'd', "Turn on debugging")
+	cli.FlagLong(&aStatus, "status", 0, "Print status of running instance and exit")
+	cli.FlagLong(&aJSON, "json", 0, "Use JSON for --status output")
+	cli.FlagLong(&aWatch, "watch", 0, "Print events and state changes of running instance as NDJSON stream until interrupted")
+	cli.FlagLong(&aNoTray, "no-tray", 0, "Run headless without tray icon, log to console and gui.log_file")
+	cli.FlagLong(&aConsole, "console", 0, "Run in terminal with interactive commands instead of tray icon")
+	cli.FlagLong(&aStop, "stop", 0, "Gracefully stop running instance and exit")
+	cli.FlagLong(&aReload, "reload", 0, "Make running instance re-read configuration and exit")
+	cli.FlagLong(&aPolicy, "reload-policy", 0, "Make running instance re-read access policy without restarting and exit")
+	cli.FlagLong(&aBatch, "batch", 0, "Turn batch signing mode of running instance on or off and exit", "on|off")
+	cli.FlagLong(&aUnlock, "unlock", 0, "Open unlock window of running instance (for configured or given duration) or close it and exit", "on|off|duration")
+	cli.FlagLong(&aSetPass, "set-passphrase", 0, "Read passphrase from stdin and give it to running instance for key whitelisted in gui.loopback, then exit", "keygrip")
+	cli.FlagLong(&aForgetPass, "forget-passphrase", 0, "Make running instance drop passphrase set for key (\"all\" for every key) and exit", "keygrip")
+	cli.FlagLong(&aDryRun, "dry-run", 0, "Print endpoints and environment variables configuration would produce, detect conflicts and exit")
+	cli.FlagLong(&aGit, "configure-git", 0, "Configure Git for Windows to use served ssh-agent pipe and Windows GnuPG (asks for confirmation) and exit")
+	cli.FlagLong(&aVSCode, "configure-vscode", 0, "Write VS Code Remote - SSH settings and devcontainer socket mounts for workspace using running instance endpoints and exit", "dir")
+	cli.FlagLong(&aListWSL, "list-wsl", 0, "List WSL distributions with their versions and interop capabilities and exit (--json is supported)")
+	cli.FlagLong(&aLoopback, "loopback-exempt", 0, "List store packaged applications with loopback isolation state (\"list\", --json is supported) or exempt package, SID or likely terminals and ssh clients (\"detected\") after confirmation and exit", "list|detected|package")
+	cli.FlagLong(&aWSL, "configure-wsl", 0, "Wire ssh and gpg agent sockets into WSL distribution (\"all\" for every one) according to its version and interop capabilities and exit", "distro")
+	cli.FlagLong(&aExport, "export-state", 0, "Write passphrase protected bundle with configuration (without private keys), remembered approvals and WSL profile snippets for moving to another machine and exit", "file")
+	cli.FlagLong(&aImport, "import-state", 0, "Restore bundle written by --export-state (instance should not be running) and exit", "file")
+	cli.FlagLong(&aPSModule, "powershell-module", 0, "Generate WinGpgAgent PowerShell module talking to control pipe of instance in directory (for example one from PSModulePath) and exit", "dir")
+	cli.FlagLong(&aPerf, "perf-counters", 0, "Register (asks for administrative rights) or remove performance counters with instance status, they are also visible as WMI class, and exit", "install|uninstall")
+	cli.FlagLong(&aInstall, "install-defaults", 0, "Create default configuration file, autostart entry and environment variables non-interactively and exit")
+	cli.FlagLong(&aUninstall, "uninstall", 0, "Stop running instance, remove autostart entry, environment variables and unmodified configuration file and exit")
+	cli.FlagLong(&aErrorsJSON, "errors-json", 0, "Print startup errors as JSON to stdout instead of showing message box (see exit codes in README)")
+	cli.FlagLong(&aFakeAgent, "fake-agent", 0, "Use built-in fake gpg-agent with test key instead of GnuPG (for testing)")
+
+	usageString = buildUsageString()
+
+	// hidden, registered after usage is built
+	cli.FlagLong(&aBench, "bench", 0, "Put synthetic load on connectors served by fake gpg-agent for duration of every scenario, print results and exit", "duration")
+	cli.FlagLong(&aBenchConns, "bench-clients", 0, "Number of parallel clients for --bench", "number")
+
+	// configuration will be picked up at the same place where executable is
+	expath, err := os.Executable()
+	if err == nil {
+		aConfigName = filepath.Join(filepath.Dir(expath), aConfigName)
+	}
+
+	if err := cli.Getopt(os.Args, nil); err != nil {
+		fatal(exitConfig, err)
+	}
+
+	if aShowHelp {
+		util.ShowOKMessage(util.MsgInformation, trayTitle, usageString)
+		os.Exit(0)
+	}
+
+	// Named instance has its own configuration file unless told otherwise
+	if len(aInstance) > 0 && !cli.IsSet("config") {
+		aConfigName = filepath.Join(filepath.Dir(aConfigName), util.InstanceName(title, aInstance)+".conf")
+	}
+
+	// Read configuration
+	cfg, err := config.LoadInstance(aInstance, aConfigName)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	if aDebug {
+		cfg.GUI.Debug = aDebug
+	}
+	if aBench > 0 {
+		util.AttachConsole()
+		os.Exit(runBench(cfg, aBench, aBenchConns))
+	}
+	if aNoTray || aConsole {
+		cfg.GUI.Headless = true
+	}
+	cfg.GUI.FakeAgent = aFakeAgent
+	util.NewLogWriter(title, 0, cfg.GUI.Debug)
+	util.SetCrashFingerprint(*cfg)
+	setupTray(cfg)
+
+	if err := os.MkdirAll(cfg.GUI.Home, 0700); err != nil {
+		fatal(exitConfig, err)
+	}
+	if cfg.GUI.Sockets != cfg.GUI.Home {
+		log.Printf("Sockets are relocated from %s to %s as path is too long for AF_UNIX", cfg.GUI.Home, cfg.GUI.Sockets)
+		if err := os.MkdirAll(cfg.GUI.Sockets, 0700); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	// Check if our Windows is modern enough to support AF_UNIX sockets - needed by WSL
+	if ok, err := util.IsProperWindowsVer(); err != nil {
+		fatal(exitPlatform, err)
+	} else if !ok {
+		fatalf(exitPlatform, "This Windows version does not support AF_UNIX sockets")
+	}
+
+	// Command line verbs are acting on already running instance
+	switch {
+	case aStatus:
+		os.Exit(printStatus(cfg))
+	case aWatch:
+		os.Exit(watchInstance(cfg))
+	case aStop:
+		os.Exit(sendVerb(cfg, (*control.Client).Stop))
+	case aReload:
+		os.Exit(sendVerb(cfg, (*control.Client).Reload))
+	case aPolicy:
+		os.Exit(sendVerb(cfg, (*control.Client).ReloadPolicy))
+	case len(aBatch) > 0:
+		verb, err := batchVerb(aBatch)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		os.Exit(sendVerb(cfg, verb))
+	case len(aUnlock) > 0:
+		verb, err := unlockVerb(aUnlock)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		os.Exit(sendVerb(cfg, verb))
+	case len(aSetPass) > 0:
+		os.Exit(sendVerb(cfg, setPassphrase(aSetPass)))
+	case len(aForgetPass) > 0:
+		os.Exit(sendVerb(cfg, forgetPassphrase(aForgetPass)))
+	case aDryRun:
+		os.Exit(dryRun(cfg))
+	case aGit:
+		os.Exit(configureGit(cfg))
+	case aInstall:
+		os.Exit(installDefaults(cfg))
+	case aUninstall:
+		os.Exit(uninstall(cfg))
+	case len(aVSCode) > 0:
+		os.Exit(setupVSCode(cfg, aVSCode))
+	case aListWSL:
+		os.Exit(listWSL())
+	case len(aWSL) > 0:
+		os.Exit(configureWSL(cfg, aWSL))
+	case len(aLoopback) > 0:
+		os.Exit(loopbackExempt(cfg, aLoopback))
+	case len(aExport) > 0:
+		os.Exit(exportState(cfg, aExport))
+	case len(aImport) > 0:
+		os.Exit(importState(cfg, aImport))
+	case len(aPSModule) > 0:
+		os.Exit(writePowerShellModule(cfg, aPSModule))
+	case len(aPerf) > 0:
+		os.Exit(perfCountersVerb(aPerf))
+	default:
+	}
+
+	if cfg.GUI.Headless {
+		if err := setupHeadless(cfg.GUI.LogFile); err != nil {
+			fatal(exitFailure, err)
+		}
+	}
+
+	// Only allow single instance of gui to run
+	lockName := lockFileName()
+	inst, err := singleinstance.CreateLockFile(lockName)
+	if err != nil {
+		log.Print("Application already running")
+		if aErrorsJSON {
+			reportError(exitRunning, fmt.Errorf("%s is already running", util.InstanceName(title, aInstance)))
+		}
+		os.Exit(exitRunning)
+	}
+
+	if err := multierr.Combine(setupNotifications(&cfg.GUI.Notify, cfg.GUI.Instance, cfg.GUI.Proxy.Mode(cfg.GUI.Proxy.Webhook)), setupAudit(&cfg.GUI.Audit), setupHooks(&cfg.GUI), setupActivity(), setupWatch()); err != nil {
+		fatal(exitConfig, err)
+	}
+
+	// serve gclpr if requested
+	clipServe(cfg)
+
+	log.Printf("%v+", *cfg)
+
+	// We want to fully control gpg-agent, so if it is running - either we left it from previous run or it is not ours
+	// Both cases should never happen so try to kill it just in case... unless other named instances are running their own.
+	if others := otherInstances(lockName); cfg.GUI.FakeAgent {
+		log.Print("Using fake gpg-agent, not killing gpg-agent")
+	} else if len(others) == 0 {
+		if err := util.KillRunningAgent(); err != nil {
+			fatal(exitFailure, err)
+		}
+	} else {
+		log.Printf("Other instances are running (%s), not killing gpg-agent", strings.Join(others, ", "))
+	}
+
+	// Now - start our own instance of gpg-agent
+	gpgAgent, err = agent.NewAgent(cfg)
+	if err != nil {
+		fatal(exitCode(err), err)
+	}
+
+	// Enter main processing loop
+	code := exitOK
+	if err := run(); err != nil {
+		code = exitCode(err)
+		reportError(code, err)
+	}
+
+	// Not necessary at all
+	inst.Close()
+	os.Remove(lockName)
+
+	if reloadRequested {
+		log.Print("Starting new instance to pick up configuration changes")
+		if err := exec.Command(expath, os.Args[1:]...).Start(); err != nil {
+			util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		}
+	}
+	os.Exit(code)
+}
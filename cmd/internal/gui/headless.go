@@ -0,0 +1,138 @@
+package gui
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/systray"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+var (
+	headlessQuit = make(chan struct{})
+	quitOnce     sync.Once
+)
+
+// setupHeadless redirects logging to console and/or log file since there is no tray to show anything. In console mode
+// terminal is used for interactive commands, so log is not sent there.
+func setupHeadless(logFile string) error {
+	if aConsole {
+		if !util.AllocConsole() {
+			return fmt.Errorf("unable to attach to console")
+		}
+	} else if util.AttachConsole() {
+		util.TeeLogWriter(os.Stderr)
+	}
+	if len(logFile) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	util.TeeLogWriter(f)
+	return nil
+}
+
+// requestExit makes main loop to terminate gracefully.
+func requestExit() {
+	if !gpgAgent.Cfg.GUI.Headless {
+		systray.Quit()
+		return
+	}
+	quitOnce.Do(func() { close(headlessQuit) })
+}
+
+// runHeadless blocks until exit is requested by control API or interrupt, there is no session lock tracking without tray.
+func runHeadless() {
+	log.Print("Running headless")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	if aConsole {
+		go runConsole()
+	}
+
+	select {
+	case <-headlessQuit:
+	case s := <-sig:
+		log.Printf("Got %s, exiting", s)
+	}
+	onExit()
+}
+
+const consoleHelp = `Commands:
+  status  - show state of running agent
+  keys    - list keys known to gpg-agent
+  clear   - clear gpg-agent passphrase cache
+  restart - restart gpg-agent
+  log     - show recent problems from gpg-agent log
+  quit    - stop and exit
+`
+
+// runConsole reads commands from terminal until quit is requested or input is closed.
+func runConsole() {
+	defer util.HandlePanic()
+
+	var c controller
+
+	fmt.Fprintf(os.Stdout, "%s\n\n%s\n> ", tooltip, consoleHelp)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var err error
+		switch cmd := strings.ToLower(strings.TrimSpace(scanner.Text())); cmd {
+		case "":
+		case "status":
+			fmt.Fprint(os.Stdout, c.Status())
+		case "keys":
+			var keys []agent.KeyInfo
+			if keys, err = c.Keys(); err == nil {
+				for _, k := range keys {
+					cached := ""
+					if k.Cached {
+						cached = " (cached)"
+					}
+					fmt.Fprintf(os.Stdout, "%s %s %s%s\n", k.Keygrip, k.Type, k.IDStr, cached)
+				}
+			}
+		case "clear":
+			if err = c.ClearCache(); err == nil {
+				fmt.Fprintln(os.Stdout, "Passphrase cache cleared")
+			}
+		case "restart":
+			if err = c.Restart(); err == nil {
+				fmt.Fprintln(os.Stdout, "gpg-agent restarted")
+			}
+		case "log":
+			if fname := gpgAgent.LogFile(); len(fname) == 0 {
+				fmt.Fprintln(os.Stdout, "gpg-agent log is disabled")
+			} else {
+				fmt.Fprintf(os.Stdout, "%s\n", fname)
+				for _, line := range gpgAgent.LogProblems() {
+					fmt.Fprintf(os.Stdout, "  %s\n", line)
+				}
+			}
+		case "quit", "exit":
+			requestExit()
+			return
+		case "help", "?":
+			fmt.Fprint(os.Stdout, consoleHelp)
+		default:
+			fmt.Fprintf(os.Stdout, "Unknown command %q\n%s", cmd, consoleHelp)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Error: %s\n", common.Explain(err))
+		}
+		fmt.Fprint(os.Stdout, "> ")
+	}
+	requestExit()
+}
@@ -0,0 +1,104 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/notify"
+)
+
+// defaultHookTimeout limits how long hook could run unless configured otherwise, it is killed after that.
+const defaultHookTimeout = 30 * time.Second
+
+// hook runs configured command for every event it is subscribed to.
+type hook struct {
+	name     string
+	command  []string
+	timeout  time.Duration
+	instance string
+}
+
+// hookVarName makes environment variable name from event field name.
+func hookVarName(field string) string {
+	return "WGA_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+		}
+		return '_'
+	}, field)
+}
+
+// env returns environment of hook process: agent-gui environment with event details added.
+func (h *hook) env(m *notify.Message) []string {
+	env := append(os.Environ(),
+		"WGA_EVENT="+string(m.Event),
+		"WGA_TIME="+m.Time.Format(time.RFC3339),
+		"WGA_TITLE="+m.Title,
+		"WGA_MESSAGE="+m.Text,
+		"WGA_INSTANCE="+h.instance,
+		fmt.Sprintf("WGA_AGENT_GUI_PID=%d", os.Getpid()),
+	)
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, hookVarName(k)+"="+m.Fields[k])
+	}
+	return env
+}
+
+// Send implements notify.Backend, hooks are run in parallel as events come.
+func (h *hook) Send(m *notify.Message) error {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = h.env(m)
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	begin := time.Now()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("hook %s for %s was killed after %s", h.name, m.Event, h.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("hook %s for %s failed: %w, output: %s", h.name, m.Event, err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("Hook %s for %s is done in %s", h.name, m.Event, time.Since(begin).Round(time.Millisecond))
+	return nil
+}
+
+// setupHooks subscribes configured commands to their events.
+func setupHooks(cfg *config.GUIConfig) error {
+	for i, hc := range cfg.Hooks {
+		h := &hook{name: fmt.Sprintf("#%d (%s)", i+1, hc.Command[0]), command: hc.Command, timeout: hc.Timeout, instance: cfg.Instance}
+		if h.timeout == 0 {
+			h.timeout = defaultHookTimeout
+		}
+		events := make([]notify.Event, 0, len(hc.Events))
+		for _, ev := range hc.Events {
+			events = append(events, notify.Event(ev))
+		}
+		if err := notify.AddSink(events, h); err != nil {
+			return fmt.Errorf("gui.hooks %s: %w", h.name, err)
+		}
+		log.Printf("Hook %s runs on %v", h.name, hc.Events)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// expiryText describes when key expires in words.
+func expiryText(k *agent.ExpiringKey) string {
+	date := k.Expires.Format("2006-01-02")
+	switch days := k.Days(); {
+	case k.Expired || days < 0:
+		return "expired on " + date
+	case days == 0:
+		return "expires today"
+	case days == 1:
+		return "expires tomorrow"
+	default:
+		return fmt.Sprintf("expires in %d days (%s)", days, date)
+	}
+}
+
+// keyKind names key for user.
+func keyKind(k *agent.ExpiringKey) string {
+	if k.Subkey() {
+		return k.Usage + " subkey"
+	}
+	return k.Usage + " key"
+}
+
+// keysText lists own keys which expire, key with fingerprint focus is marked and goes first.
+func keysText(a *agent.Agent, focus string) string {
+	keys, err := a.KeyExpiry()
+	if err != nil {
+		return fmt.Sprintf("Unable to list keys:\r\n\r\n%s", err)
+	}
+	if len(keys) == 0 {
+		return "None of signing or ssh keys with secret part available expire."
+	}
+	for i := range keys {
+		if keys[i].Fingerprint == focus {
+			keys[0], keys[i] = keys[i], keys[0]
+			break
+		}
+	}
+	var buf strings.Builder
+	for _, k := range keys {
+		mark := "  "
+		if k.Fingerprint == focus {
+			mark = "> "
+		}
+		fmt.Fprintf(&buf, "%s%s\r\n", mark, k.UserID)
+		fmt.Fprintf(&buf, "  %-16s%s\r\n", keyKind(&k), k.Fingerprint)
+		if k.Subkey() {
+			fmt.Fprintf(&buf, "  %-16s%s\r\n", "primary key", k.Primary)
+		}
+		fmt.Fprintf(&buf, "  %-16s%s\r\n\r\n", "", expiryText(&k))
+	}
+	buf.WriteString("Use \"gpg --quick-set-expire <primary key> <period> [<subkey>]\" to extend key validity\r\n")
+	return buf.String()
+}
+
+// showKeys shows own keys which expire, focus selects key user came for (from expiry warning).
+func showKeys(a *agent.Agent, focus string) {
+	defer util.HandlePanic()
+
+	if err := util.ShowInfo(trayTitle+" - keys", func() string { return keysText(a, focus) }, nil); err != nil {
+		log.Printf("Unable to show keys: %s", err)
+	}
+}
+
+// watchKeyExpiry periodically checks own signing and ssh keys and warns about the ones close to expiry. Every key is
+// mentioned at most once a day, clicking on warning shows the key.
+func watchKeyExpiry(ctx context.Context, a *agent.Agent) {
+	defer util.HandlePanic()
+
+	warned := make(map[string]string)
+	for {
+		keys, err := a.KeyExpiry()
+		if err != nil {
+			log.Printf("Unable to check key expiry: %s", err)
+		}
+		today := time.Now().Format("2006-01-02")
+		for i := range keys {
+			k := keys[i]
+			// keys which expired long ago are of no interest anymore
+			if days := k.Days(); days >= a.Cfg.GUI.KeyExpiry.Days || days < -a.Cfg.GUI.KeyExpiry.Days || warned[k.Fingerprint] == today {
+				continue
+			}
+			warned[k.Fingerprint] = today
+			text := fmt.Sprintf("Key %s (%s) %s", k.UserID, keyKind(&k), expiryText(&k))
+			log.Print(text)
+			fpr := k.Fingerprint
+			notify.Send(&notify.Message{
+				Event: notify.KeyExpiring,
+				Title: trayTitle + " key expiry",
+				Text:  text + ". Click to see the key.",
+				Fields: map[string]string{"key": fpr, "primary": k.Primary, "uid": k.UserID, "usage": k.Usage,
+					"expires": k.Expires.Format(time.RFC3339), "days": strconv.Itoa(k.Days())},
+				Action: func() { go showKeys(a, fpr) },
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.Cfg.GUI.KeyExpiry.Interval):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Special --loopback-exempt arguments.
+const (
+	loopbackList     = "list"
+	loopbackDetected = "detected"
+)
+
+// loopbackPorts describes agent endpoints on loopback TCP ports, which store packaged clients could not reach without
+// exemption.
+func loopbackPorts(cfg *config.Config) []string {
+	var res []string
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"gpg-agent extra port (gui.extra_port)", cfg.GUI.ExtraPort},
+		{"gclpr (gui.gclpr.port)", cfg.GUI.Clp.Port},
+		{"WebSocket (gui.websocket.port)", cfg.GUI.WebSocket.Port},
+		{"control API (gui.control.port)", cfg.GUI.Control.Port},
+	} {
+		if p.port > 0 {
+			res = append(res, fmt.Sprintf("%s - %d", p.name, p.port))
+		}
+	}
+	return res
+}
+
+// loopbackExempt lists store packaged applications with their loopback isolation state ("list") or, after
+// confirmation, exempts likely terminals and ssh clients ("detected") or single package (by package family name or
+// SID). Returns process exit code.
+func loopbackExempt(cfg *config.Config, target string) int {
+	acs, err := util.AppContainers()
+	if err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return exitFailure
+	}
+
+	if strings.EqualFold(target, loopbackList) {
+		util.AttachConsole()
+		if aJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(acs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitFailure
+			}
+			return exitOK
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, ac := range acs {
+			mark, state := " ", "isolated"
+			if ac.Client {
+				mark = "*"
+			}
+			if ac.Exempt {
+				state = "exempt"
+			}
+			fmt.Fprintf(w, "%s %s\t%s\t%s\n", mark, ac.Moniker, state, ac.SID)
+		}
+		w.Flush()
+		return exitOK
+	}
+
+	var (
+		selected []util.AppContainer
+		found    bool
+	)
+	for _, ac := range acs {
+		match := ac.Client
+		if !strings.EqualFold(target, loopbackDetected) {
+			match = strings.EqualFold(target, ac.Moniker) || strings.EqualFold(target, ac.SID)
+		}
+		if !match {
+			continue
+		}
+		found = true
+		if !ac.Exempt {
+			selected = append(selected, ac)
+		}
+	}
+	switch {
+	case !found && strings.EqualFold(target, loopbackDetected):
+		util.ShowOKMessage(util.MsgInformation, trayTitle, "No store packaged terminals or ssh clients are found.")
+		return exitOK
+	case !found:
+		util.ShowOKMessage(util.MsgError, trayTitle, fmt.Sprintf("Package \"%s\" is not found, see agent-gui.exe --loopback-exempt list", target))
+		return exitFailure
+	case len(selected) == 0:
+		util.ShowOKMessage(util.MsgInformation, trayTitle, "Selected packages are already exempted from loopback isolation.")
+		return exitOK
+	default:
+	}
+
+	var buf strings.Builder
+	buf.WriteString("These store packaged applications will be allowed to connect to services on this computer over loopback (requires administrative rights):\n")
+	sids := make([]string, 0, len(selected))
+	for _, ac := range selected {
+		fmt.Fprintf(&buf, "\n    %s", ac.Moniker)
+		sids = append(sids, ac.SID)
+	}
+	if ports := loopbackPorts(cfg); len(ports) > 0 {
+		buf.WriteString("\n\nAgent endpoints they could reach:\n")
+		for _, p := range ports {
+			fmt.Fprintf(&buf, "\n    %s", p)
+		}
+	} else {
+		buf.WriteString("\n\nNo agent endpoints are configured on loopback ports, named pipe and AF_UNIX sockets do not depend on this exemption.")
+	}
+	if util.MessageBox(trayTitle, buf.String()+"\n\nContinue?", util.MB_YESNO|util.MB_ICONQUESTION|util.MB_SETFOREGROUND) != util.IDYES {
+		return exitOK
+	}
+	if err := util.ExemptFromLoopbackIsolation(sids); err != nil {
+		util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+		return exitFailure
+	}
+	util.ShowOKMessage(util.MsgInformation, trayTitle, "Loopback exemption is added. Restart exempted applications to pick it up.")
+	return exitOK
+}
@@ -0,0 +1,230 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/skratchdot/open-golang/open"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/systray"
+	"github.com/rupor-github/win-gpg-agent/trace"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+var (
+	notifyLock   sync.Mutex
+	notifyAction func()
+)
+
+// trayNotify shows tray notification, action (if any) is performed when user clicks on it.
+func trayNotify(m *notify.Message) error {
+	if gpgAgent == nil || gpgAgent.Cfg.GUI.Headless {
+		log.Printf("%s: %s", m.Title, m.Text)
+		return nil
+	}
+	notifyLock.Lock()
+	notifyAction = m.Action
+	notifyLock.Unlock()
+	systray.ShowNotification(m.Title, m.Text)
+	return nil
+}
+
+// toastAppID is application identity toasts of the instance are shown with.
+func toastAppID(instance string) string {
+	return "rupor-github.win-gpg-agent." + util.InstanceName(title, instance)
+}
+
+// setupNotifications registers notification backends and applies configured rules. Webhook requests go through proxy.
+func setupNotifications(cfg *config.NotifyConfig, instance, proxy string) error {
+	notify.Register("tray", notify.BackendFunc(trayNotify))
+	notify.Register("toast", notify.Toast())
+	if err := notify.SetAppID(toastAppID(instance), trayTitle, trayIcon); err != nil {
+		log.Printf("Toasts will be shown on behalf of PowerShell: %s", err)
+	}
+	if len(cfg.Webhook) > 0 {
+		hc, err := util.HTTPClient(proxy)
+		if err != nil {
+			return fmt.Errorf("bad gui.proxy for webhook: %w", err)
+		}
+		notify.Register("webhook", notify.Webhook(cfg.Webhook, hc))
+	}
+
+	var wh *notify.WorkingHours
+	if len(cfg.WorkingHours) > 0 {
+		var err error
+		if wh, err = notify.ParseWorkingHours(cfg.WorkingHours, cfg.WorkingDays); err != nil {
+			return err
+		}
+	}
+	rules := make(map[notify.Event][]notify.Rule, len(cfg.Events))
+	for ev, list := range cfg.Events {
+		for _, r := range list {
+			for _, name := range r.Backends {
+				if name == "webhook" && len(cfg.Webhook) == 0 {
+					return fmt.Errorf("notification event %q uses webhook, but gui.notifications.webhook is not set", ev)
+				}
+			}
+			rules[notify.Event(ev)] = append(rules[notify.Event(ev)], notify.Rule{Backends: r.Backends, OutsideHours: r.OutsideHours})
+		}
+	}
+	if err := notify.SetRules(rules, wh); err != nil {
+		return err
+	}
+	if !cfg.FocusAssist {
+		return nil
+	}
+	critical := make([]notify.Event, 0, len(cfg.Critical))
+	for _, ev := range cfg.Critical {
+		critical = append(critical, notify.Event(ev))
+	}
+	if err := notify.SetDoNotDisturb(util.DoNotDisturb, critical); err != nil {
+		return fmt.Errorf("gui.notifications.critical: %w", err)
+	}
+	return nil
+}
+
+// releaseHeldNotifications delivers notifications held during Focus Assist soon after it is turned off, even if
+// nothing else happens.
+func releaseHeldNotifications(ctx context.Context) {
+	defer util.HandlePanic()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+			notify.Release()
+		}
+	}
+}
+
+// setupAudit starts exporting security events to syslog collector if configured.
+func setupAudit(cfg *config.AuditConfig) error {
+	if len(cfg.Address) == 0 {
+		return nil
+	}
+	b, err := notify.Syslog(notify.SyslogOptions{Address: cfg.Address, TLS: cfg.TLS, CAFile: cfg.CA, Format: cfg.Format, Version: misc.GetVersion()})
+	if err != nil {
+		return err
+	}
+	events := make([]notify.Event, 0, len(cfg.Events))
+	for _, ev := range cfg.Events {
+		events = append(events, notify.Event(ev))
+	}
+	if err := notify.AddSink(events, b); err != nil {
+		return err
+	}
+	log.Printf("Exporting %v audit events to %s", cfg.Events, cfg.Address)
+	return nil
+}
+
+// setupTracing starts exporting spans of relayed operations to OpenTelemetry collector if configured, returned function
+// (if any) flushes them on exit.
+func setupTracing(cfg *config.Config) func() {
+	tc := &cfg.GUI.Tracing
+	if len(tc.Endpoint) == 0 {
+		return nil
+	}
+	hc, err := util.HTTPClient(cfg.GUI.Proxy.Mode(cfg.GUI.Proxy.Tracing))
+	if err != nil {
+		startupWarning("Traces are not exported, bad gui.proxy: %s", err)
+		return nil
+	}
+	stop, err := trace.Setup(trace.Options{Endpoint: tc.Endpoint, Headers: tc.Headers, Service: tc.Service, Version: misc.GetVersion(), Client: hc})
+	if err != nil {
+		startupWarning("Traces are not exported: %s", err)
+		return nil
+	}
+	return stop
+}
+
+// handleNotifications performs action of the last shown notification on click.
+func handleNotifications(ctx context.Context) {
+	defer util.HandlePanic()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-systray.NotificationClickedCh:
+			notifyLock.Lock()
+			action := notifyAction
+			notifyLock.Unlock()
+			if action != nil {
+				action()
+			}
+		}
+	}
+}
+
+// checkUpdates periodically looks at project releases and notifies user once about every newer version.
+func checkUpdates(ctx context.Context, interval time.Duration, proxy string) {
+	defer util.HandlePanic()
+
+	hc, err := util.HTTPClient(proxy)
+	if err != nil {
+		log.Printf("Update checking is disabled, bad gui.proxy: %s", err)
+		return
+	}
+	var notified string
+	for {
+		rel, err := util.LatestRelease(ctx, hc, util.ReleasesURL)
+		switch {
+		case err != nil:
+			log.Print(err.Error())
+		case rel.Tag != notified && util.IsNewerVersion(misc.GetVersion(), rel.Tag):
+			notified = rel.Tag
+			log.Printf("New version %s is available at %s", rel.Tag, rel.URL)
+			url := rel.URL
+			notify.Send(&notify.Message{
+				Event:  notify.Update,
+				Title:  trayTitle + " update",
+				Text:   fmt.Sprintf("Version %s is available (running %s). Click to open download page.", rel.Tag, misc.GetVersion()),
+				Fields: map[string]string{"version": rel.Tag, "url": url},
+				Action: func() {
+					if err := open.Start(url); err != nil {
+						log.Printf("Unable to open %s: %s", url, err)
+					}
+				},
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// notifyLogProblems returns function which sends problems from gpg-agent log as notifications, not more often than
+// once per interval to avoid flood when something (card reader for example) keeps failing.
+func notifyLogProblems(interval time.Duration) func(string) {
+	var (
+		mu   sync.Mutex
+		last time.Time
+	)
+	return func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(last) < interval {
+			return
+		}
+		last = time.Now()
+		notify.Send(&notify.Message{Event: notify.AgentLog, Title: util.GPGAgentName, Text: line + "\nClick to open gpg-agent log.", Action: openAgentLog})
+	}
+}
+
+// openAgentLog opens gpg-agent log file with associated application.
+func openAgentLog() {
+	fname := gpgAgent.LogFile()
+	if len(fname) == 0 {
+		return
+	}
+	if err := open.Start(fname); err != nil {
+		log.Printf("Unable to open %s: %s", fname, err)
+	}
+}
@@ -0,0 +1,179 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const (
+	perfInstall   = "install"
+	perfUninstall = "uninstall"
+	// perfManifest is written next to executable, unlodctr needs the same file to remove counters
+	perfManifest = "agent-gui.perf.man"
+	perfInterval = 5 * time.Second
+	// perfResourceBase is id of counter set name in string tables of executables (cmake/agent.rc.in and
+	// cmake/win-gpg-agent.rc.in), description follows name and every counter takes next two ids the same way
+	perfResourceBase = 1100
+)
+
+var (
+	perfProvider   = windows.GUID{Data1: 0x7ff33f57, Data2: 0x7766, Data3: 0x410e, Data4: [8]byte{0x91, 0xba, 0x9b, 0xf9, 0x5e, 0x17, 0x73, 0xad}}
+	perfCounterSet = windows.GUID{Data1: 0x139d0902, Data2: 0x6f28, Data3: 0x42a0, Data4: [8]byte{0x93, 0x9c, 0x4f, 0xd6, 0x18, 0xe8, 0xa4, 0xc0}}
+)
+
+// Counters of "win-gpg-agent" counter set, ids are positions in perfCounters plus one.
+const (
+	perfRunning = iota + 1
+	perfAgentPID
+	perfConnectorsUp
+	perfActive
+	perfAccepted
+	perfFailed
+	perfLastError
+	perfLocked
+)
+
+var perfCounters = []struct{ name, desc string }{
+	{"Running", "1 while agent-gui is running"},
+	{"gpg-agent PID", "Process id of gpg-agent, 0 when it is not running"},
+	{"Connectors Up", "Number of connectors serving clients"},
+	{"Active Connections", "Client connections being served by all connectors"},
+	{"Accepted Connections", "Client connections accepted by all connectors since start"},
+	{"Failed Connections", "Client connections which ended with error since start"},
+	{"Last Error Time", "Unix time of the last connector error, 0 when there were none"},
+	{"Session Locked", "1 while user session is locked and keys could not be used"},
+}
+
+// perfManifestXML describes counter set for lodctr. Names are referenced by resource id, lodctr and consumers read
+// them from executable resources.
+func perfManifestXML(exe string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<instrumentationManifest xmlns="http://schemas.microsoft.com/win/2004/08/events" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <instrumentation>
+    <counters xmlns="http://schemas.microsoft.com/win/2005/12/counters" schemaVersion="1.1">
+`)
+	fmt.Fprintf(&b, "      <provider applicationIdentity=\"%s\" providerType=\"userMode\" providerGuid=\"%s\" providerName=\"WinGpgAgent\" symbol=\"WinGpgAgent\">\n", html.EscapeString(exe), perfProvider)
+	fmt.Fprintf(&b, "        <counterSet guid=\"%s\" uri=\"WinGpgAgent.Status\" symbol=\"Status\" name=\"win-gpg-agent\" nameID=\"%d\" description=\"Status of agent-gui instances\" descriptionID=\"%d\" instances=\"multiple\">\n",
+		perfCounterSet, perfResourceBase, perfResourceBase+1)
+	for i, c := range perfCounters {
+		id := perfResourceBase + 2*(i+1)
+		fmt.Fprintf(&b, "          <counter id=\"%d\" uri=\"WinGpgAgent.Status.%d\" name=\"%s\" nameID=\"%d\" description=\"%s\" descriptionID=\"%d\" type=\"perf_counter_rawcount\" detailLevel=\"standard\"/>\n",
+			i+1, i+1, html.EscapeString(c.name), id, html.EscapeString(c.desc), id+1)
+	}
+	b.WriteString(`        </counterSet>
+      </provider>
+    </counters>
+  </instrumentation>
+</instrumentationManifest>
+`)
+	return b.String()
+}
+
+// perfCountersVerb registers or removes performance counters, returns process exit code.
+func perfCountersVerb(action string) int {
+	util.AttachConsole()
+
+	install := strings.EqualFold(action, perfInstall)
+	if !install && !strings.EqualFold(action, perfUninstall) {
+		fmt.Fprintf(os.Stderr, "Unknown --perf-counters action %q, use %s or %s\n", action, perfInstall, perfUninstall)
+		return exitConfig
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	manifest := filepath.Join(filepath.Dir(exe), perfManifest)
+	if install {
+		if err := os.WriteFile(manifest, []byte(perfManifestXML(filepath.Base(exe))), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	} else if !util.PerfProviderRegistered(perfProvider) {
+		fmt.Println("Performance counters are not registered")
+		return exitOK
+	}
+	if err := util.RegisterPerfManifest(perfProvider, manifest, filepath.Dir(exe), install); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if install {
+		fmt.Printf("Performance counters are registered from %s, restart agent-gui to publish them\n", manifest)
+	} else {
+		os.Remove(manifest)
+		fmt.Println("Performance counters are removed")
+	}
+	return exitOK
+}
+
+// startPerfCounters publishes instance status as performance counters (and so as WMI Win32_PerfRawData_* class) while
+// ctx is not done. Nothing is published unless counters were registered with --perf-counters.
+func startPerfCounters(ctx context.Context, a *agent.Agent) {
+	if !util.PerfProviderRegistered(perfProvider) {
+		return
+	}
+	name := util.InstanceName(title, a.Cfg.GUI.Instance)
+	if user := os.Getenv("USERNAME"); len(user) > 0 {
+		name = user + ":" + name
+	}
+	pc, err := util.StartPerfCounters(perfProvider, perfCounterSet, len(perfCounters), name)
+	if err != nil {
+		startupWarning("Performance counters are not published: %s", err)
+		return
+	}
+	log.Printf("Publishing performance counters as %s", name)
+
+	update := func() {
+		var up, active, accepted, failed, lastErr uint32
+		for _, e := range a.Endpoints() {
+			up++
+			if e.Stats == nil {
+				continue
+			}
+			active += uint32(e.Stats.Active)
+			accepted += uint32(e.Stats.Accepted)
+			failed += uint32(e.Stats.Failed)
+			if t := uint32(e.Stats.LastErrorTime.Unix()); !e.Stats.LastErrorTime.IsZero() && t > lastErr {
+				lastErr = t
+			}
+		}
+		var locked uint32
+		if a.Locked() {
+			locked = 1
+		}
+		for id, v := range map[int]uint32{perfRunning: 1, perfAgentPID: uint32(a.PID()), perfConnectorsUp: up, perfActive: active,
+			perfAccepted: accepted, perfFailed: failed, perfLastError: lastErr, perfLocked: locked} {
+			if err := pc.Set(id, v); err != nil {
+				log.Printf("Unable to update performance counters: %s", err)
+				return
+			}
+		}
+	}
+	go func() {
+		defer util.HandlePanic()
+		defer pc.Close()
+
+		t := time.NewTicker(perfInterval)
+		defer t.Stop()
+		for {
+			update()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,40 @@
+package gui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// writePowerShellModule generates PowerShell module for instance control pipe in dir (one of $env:PSModulePath
+// directories makes it available to Import-Module by name). Returns process exit code.
+func writePowerShellModule(cfg *config.Config, dir string) int {
+	util.AttachConsole()
+
+	psm1, psd1, err := control.PowerShellModule(util.ControlPipeName(cfg.GUI.Instance), filepath.Join(cfg.GUI.Home, control.TokenFileName), misc.GetVersion())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	mdir := filepath.Join(dir, control.PowerShellModuleName)
+	if err := os.MkdirAll(mdir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	for name, data := range map[string][]byte{control.PowerShellModuleName + ".psm1": psm1, control.PowerShellModuleName + ".psd1": psd1} {
+		if err := os.WriteFile(filepath.Join(mdir, name), data, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	}
+	fmt.Printf("PowerShell module is written to %s\n", mdir)
+	if len(cfg.GUI.Control.Token) > 0 {
+		fmt.Println("gui.control.token is set in configuration, pass it to module functions with -Token")
+	}
+	return exitOK
+}
@@ -0,0 +1,85 @@
+package gui
+
+import (
+	"log"
+	"sync"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/systray"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// qrKeysSize is maximum number of keys listed in "QR code" submenu.
+const qrKeysSize = 16
+
+// publicKeys lists ssh public keys and OpenPGP secret key fingerprints, either list could be missing.
+func publicKeys(a *agent.Agent) []agent.PublicKey {
+	ssh, err := a.SSHKeys()
+	if err != nil {
+		log.Printf("Unable to list ssh keys: %s", err)
+	}
+	pgp, err := a.PGPKeys()
+	if err != nil {
+		log.Printf("Unable to list OpenPGP keys: %s", err)
+	}
+	return append(ssh, pgp...)
+}
+
+// addQRCodeMenu creates submenu with public keys, clicking on key shows it as QR code. Keys are listed when menu is
+// created and on request, listing runs gpg, so it is not done every time menu is opened.
+func addQRCodeMenu(a *agent.Agent) {
+
+	miQR := systray.AddMenuItem("QR code", "Shows public key or fingerprint as QR code")
+	items := make([]*systray.MenuItem, qrKeysSize)
+	for i := range items {
+		items[i] = miQR.AddSubMenuItem("", "Show as QR code")
+		items[i].Hide()
+	}
+	miRefresh := miQR.AddSubMenuItem("Refresh list", "Lists keys again")
+
+	var (
+		mu   sync.Mutex
+		keys []agent.PublicKey
+	)
+
+	refresh := func() {
+		list := publicKeys(a)
+		mu.Lock()
+		defer mu.Unlock()
+		keys = list
+		for i, item := range items {
+			if i >= len(keys) {
+				item.Hide()
+				continue
+			}
+			item.SetTitle(keys[i].Label)
+			item.Show()
+		}
+	}
+	go func() {
+		defer util.HandlePanic()
+		refresh()
+		for range miRefresh.ClickedCh {
+			refresh()
+		}
+	}()
+
+	for i, item := range items {
+		go func(i int, item *systray.MenuItem) {
+			for range item.ClickedCh {
+				mu.Lock()
+				var k *agent.PublicKey
+				if i < len(keys) {
+					k = &keys[i]
+				}
+				mu.Unlock()
+				if k == nil {
+					continue
+				}
+				if err := util.ShowQRCode(trayTitle+" - "+k.Label, k.Text); err != nil {
+					util.ShowOKMessage(util.MsgError, trayTitle, err.Error())
+				}
+			}
+		}(i, item)
+	}
+}
@@ -0,0 +1,64 @@
+package gui
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// screensaverInterval is how often screensaver state is checked, there is no notification when it starts.
+const screensaverInterval = 2 * time.Second
+
+// sessionLocked follows WTS lock notifications, so screensaver never unlocks session which was really locked.
+var sessionLocked int32
+
+// watchScreensaver treats screensaver activation as session lock (gui.screensaver_lock). When screensaver stops agent
+// is unlocked one check later, by then Windows configured to lock on resume has sent its own lock notification.
+func watchScreensaver(ctx context.Context, a *agent.Agent) {
+	defer util.HandlePanic()
+
+	t := time.NewTicker(screensaverInterval)
+	defer t.Stop()
+
+	// screensaver is seen running, agent was locked because of it, unlock is due on next check
+	var active, locked, pending bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		running, err := util.ScreensaverRunning()
+		if err != nil {
+			log.Printf("Screensaver is not watched: %s", err)
+			return
+		}
+		switch {
+		case running:
+			if !active {
+				log.Print("Screensaver started")
+				active = true
+				if !a.Locked() {
+					a.SessionLock()
+					watchers.stateChanged()
+					locked = true
+				}
+			}
+			pending = false
+		case active:
+			log.Print("Screensaver stopped")
+			active, pending = false, locked
+		case pending:
+			pending, locked = false, false
+			if atomic.LoadInt32(&sessionLocked) == 0 {
+				a.SessionUnlock()
+				watchers.stateChanged()
+			}
+		default:
+		}
+	}
+}
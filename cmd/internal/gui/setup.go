@@ -0,0 +1,169 @@
+package gui
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+const autostartKey = `SOFTWARE\Microsoft\Windows\CurrentVersion\Run`
+
+// autostartName is name of per-user autostart entry for current instance.
+func autostartName(cfg *config.Config) string {
+	return util.InstanceName(title, cfg.GUI.Instance)
+}
+
+// autostartCommand is command line autostart entry runs - the same executable, instance and configuration file.
+func autostartCommand(cfg *config.Config) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	cmd := fmt.Sprintf("\"%s\"", exe)
+	if len(cfg.GUI.Instance) > 0 {
+		cmd += fmt.Sprintf(" --instance \"%s\"", cfg.GUI.Instance)
+	}
+	if cli.IsSet("config") {
+		cmd += fmt.Sprintf(" --config \"%s\"", aConfigName)
+	}
+	return cmd, nil
+}
+
+// installDefaults non-interactively creates default configuration file (when there is none), per-user autostart entry
+// and user environment variables. It could be called repeatedly, returns process exit code.
+func installDefaults(cfg *config.Config) int {
+	util.AttachConsole()
+
+	var failed bool
+	report := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	}
+
+	if util.FileExists(aConfigName) {
+		fmt.Printf("Configuration %s exists, left unchanged\n", aConfigName)
+	} else if err := os.WriteFile(aConfigName, []byte(config.Defaults(cfg.GUI.Instance)), 0600); err != nil {
+		report(fmt.Errorf("unable to write configuration: %w", err))
+	} else {
+		fmt.Printf("Created %s\n", aConfigName)
+	}
+
+	if cmd, err := autostartCommand(cfg); err != nil {
+		report(fmt.Errorf("unable to prepare autostart entry: %w", err))
+	} else if k, _, err := registry.CreateKey(registry.CURRENT_USER, autostartKey, registry.SET_VALUE); err != nil {
+		report(fmt.Errorf("unable to open autostart key: %w", err))
+	} else {
+		if err := k.SetStringValue(autostartName(cfg), cmd); err != nil {
+			report(fmt.Errorf("unable to add autostart entry: %w", err))
+		} else {
+			fmt.Printf("Autostart %s: %s\n", autostartName(cfg), cmd)
+		}
+		k.Close()
+	}
+
+	if cfg.GUI.SetEnv {
+		a, err := agent.Prepare(cfg)
+		if err != nil {
+			report(err)
+		} else {
+			for _, v := range envVars(a, !strings.EqualFold(cfg.GUI.SSH, "cygwin")) {
+				if len(v.value) == 0 && !v.external {
+					continue
+				}
+				if err := v.set(); err != nil {
+					report(fmt.Errorf("unable to add %s to user environment: %w", v.name, err))
+					continue
+				}
+				if v.external {
+					fmt.Printf("WSLENV %s\n", v.wslenvEntry())
+				} else {
+					fmt.Printf("Environment %s=%s\n", v.name, v.value)
+				}
+			}
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// uninstall stops running instance and removes everything installDefaults creates. Configuration file is only removed
+// when it was not modified. Returns process exit code.
+func uninstall(cfg *config.Config) int {
+	util.AttachConsole()
+
+	var failed bool
+	report := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	}
+
+	// running instance would restore environment on exit otherwise
+	if pipe := util.ControlPipeName(cfg.GUI.Instance); util.PipeExists(pipe) {
+		if c, err := control.NewClient(pipe, cfg.GUI.Home, cfg.GUI.Control.Token); err != nil {
+			report(err)
+		} else if err := c.Stop(); err != nil {
+			report(fmt.Errorf("unable to stop running instance: %w", err))
+		} else {
+			for i := 0; i < 50 && util.PipeExists(pipe); i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			fmt.Println("Running instance stopped")
+		}
+	}
+
+	if k, err := registry.OpenKey(registry.CURRENT_USER, autostartKey, registry.SET_VALUE); err == nil {
+		if err := k.DeleteValue(autostartName(cfg)); err == nil {
+			fmt.Printf("Autostart %s removed\n", autostartName(cfg))
+		} else if !errors.Is(err, registry.ErrNotExist) {
+			report(fmt.Errorf("unable to remove autostart entry: %w", err))
+		}
+		k.Close()
+	}
+
+	if err := notify.RemoveAppID(toastAppID(cfg.GUI.Instance)); err == nil {
+		fmt.Printf("Toast application id %s removed\n", toastAppID(cfg.GUI.Instance))
+	} else if !errors.Is(err, registry.ErrNotExist) {
+		report(fmt.Errorf("unable to remove toast application id: %w", err))
+	}
+
+	if a, err := agent.Prepare(cfg); err != nil {
+		report(err)
+	} else {
+		for _, v := range envVars(a, !strings.EqualFold(cfg.GUI.SSH, "cygwin")) {
+			if err := v.clean(); err == nil {
+				fmt.Printf("Environment %s removed\n", v.name)
+			} else if !errors.Is(err, registry.ErrNotExist) {
+				report(fmt.Errorf("unable to delete %s from user environment: %w", v.name, err))
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(aConfigName); err == nil {
+		if !bytes.Equal(data, []byte(config.Defaults(cfg.GUI.Instance))) {
+			fmt.Printf("Configuration %s was modified, left in place\n", aConfigName)
+		} else if err := os.Remove(aConfigName); err != nil {
+			report(fmt.Errorf("unable to remove configuration: %w", err))
+		} else {
+			fmt.Printf("Removed %s\n", aConfigName)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
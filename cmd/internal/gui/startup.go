@@ -0,0 +1,161 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// startupFileName is the name of the file in gui.homedir describing how running instance has started.
+const startupFileName = "startup.json"
+
+var (
+	startupLock     sync.Mutex
+	startupWarnings []string
+)
+
+// startupWarning logs problem which does not prevent instance from running and keeps it for startup report.
+func startupWarning(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	startupLock.Lock()
+	startupWarnings = append(startupWarnings, msg)
+	startupLock.Unlock()
+}
+
+type startupPaths struct {
+	Config      string `json:"config"`
+	Home        string `json:"homedir"`
+	Sockets     string `json:"socketdir"`
+	GnuPG       string `json:"gpg_install_path"`
+	GPGHome     string `json:"gpg_homedir"`
+	GPGSockets  string `json:"gpg_socketdir"`
+	Pipe        string `json:"pipe_name"`
+	ControlPipe string `json:"control_pipe"`
+	Log         string `json:"log_file,omitempty"`
+}
+
+// startupReport is machine readable description of started instance for support tooling and WSL scripts.
+type startupReport struct {
+	Version   string           `json:"version"`
+	GitHash   string           `json:"git_hash"`
+	Go        string           `json:"go_version"`
+	Started   time.Time        `json:"started"`
+	PID       int              `json:"pid"`
+	Instance  string           `json:"instance,omitempty"`
+	Headless  bool             `json:"headless"`
+	GnuPG     string           `json:"gnupg_version"`
+	AgentPID  int              `json:"gpg_agent_pid"`
+	Paths     startupPaths     `json:"paths"`
+	Endpoints []agent.Endpoint `json:"endpoints"`
+	Env       []dryRunEnv      `json:"env,omitempty"`
+	Warnings  []string         `json:"warnings,omitempty"`
+}
+
+// writeStartupReport saves startup report into gui.homedir, replacing one left by previous start.
+func writeStartupReport(a *agent.Agent) {
+	defer util.HandlePanic()
+
+	cfg := a.Cfg
+	r := &startupReport{
+		Version:  misc.GetVersion(),
+		GitHash:  misc.GetGitHash(),
+		Go:       runtime.Version(),
+		Started:  time.Now(),
+		PID:      os.Getpid(),
+		Instance: cfg.GUI.Instance,
+		Headless: cfg.GUI.Headless,
+		GnuPG:    a.Ver,
+		AgentPID: a.PID(),
+		Paths: startupPaths{
+			Config:      aConfigName,
+			Home:        cfg.GUI.Home,
+			Sockets:     cfg.GUI.Sockets,
+			GnuPG:       cfg.GPG.Path,
+			GPGHome:     cfg.GPG.Home,
+			GPGSockets:  cfg.GPG.Sockets,
+			Pipe:        cfg.GUI.PipeName,
+			ControlPipe: util.ControlPipeName(cfg.GUI.Instance),
+			Log:         cfg.GUI.LogFile,
+		},
+	}
+	for _, e := range a.Endpoints() {
+		// statistics are meaningless right after start
+		e.Stats = nil
+		r.Endpoints = append(r.Endpoints, e)
+	}
+	if cfg.GUI.SetEnv {
+		for _, v := range envVars(a, !strings.EqualFold(cfg.GUI.SSH, "cygwin")) {
+			if len(v.value) == 0 && !v.external {
+				continue
+			}
+			r.Env = append(r.Env, dryRunEnv{Name: v.name, Value: v.value, WSLENV: v.wslenvEntry()})
+		}
+	}
+	startupLock.Lock()
+	r.Warnings = append(r.Warnings, startupWarnings...)
+	startupLock.Unlock()
+	// competitors are logged and notified separately
+	for _, c := range relevantCompetitors(cfg, util.DetectCompetitors("", cfg.GPG.Home, uint32(a.PID()))) {
+		r.Warnings = append(r.Warnings, "Competing agent: "+c.String())
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Printf("Unable to prepare startup report: %s", err)
+		return
+	}
+	// readers should never see partially written file
+	fname := filepath.Join(cfg.GUI.Home, startupFileName)
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		log.Printf("Unable to write startup report: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		log.Printf("Unable to write startup report: %s", err)
+		return
+	}
+	log.Printf("Startup report is written to %s", fname)
+}
+
+// publishDiscovery writes discovery file with sockets of running instance at well known location, returned function
+// (if any) removes it on exit.
+func publishDiscovery(a *agent.Agent) func() {
+	d := &util.Discovery{
+		PID:      os.Getpid(),
+		Instance: a.Cfg.GUI.Instance,
+		Sockets:  make(map[string]util.DiscoveryEndpoint),
+	}
+	if !a.DelegatesPipe() {
+		d.Pipe = a.Cfg.GUI.PipeName
+	}
+	for name, ct := range map[string]agent.ConnectorType{
+		util.DiscoveryGPG:     agent.ConnectorSockAgent,
+		util.DiscoverySSH:     agent.ConnectorSockAgentSSH,
+		util.DiscoveryExtra:   agent.ConnectorSockAgentExtra,
+		util.DiscoveryDirmngr: agent.ConnectorSockDirmngr,
+	} {
+		if c := a.GetConnector(ct); c != nil && len(c.Address()) > 0 {
+			d.Sockets[name] = util.NewDiscoveryEndpoint(c.PathGUI())
+		}
+	}
+	remove, err := util.WriteDiscovery(a.Cfg.GUI.Instance, d)
+	if err != nil {
+		startupWarning("Sockets are not published: %s", err)
+		return nil
+	}
+	log.Printf("Sockets are published in %s", util.DiscoveryFile(a.Cfg.GUI.Instance))
+	return remove
+}
@@ -0,0 +1,331 @@
+package gui
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/allan-simon/go-singleinstance"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// stateVersion is version of state bundle format.
+const stateVersion = 1
+
+// stateBundle is what is moved to another machine with --export-state and --import-state. Private keys are never
+// included: gclpr public keys travel in configuration, private_key values are dropped from it.
+type stateBundle struct {
+	Version   int               `json:"version"`
+	Created   time.Time         `json:"created"`
+	Host      string            `json:"host,omitempty"`
+	Agent     string            `json:"agent_version"`
+	Config    string            `json:"config,omitempty"`
+	Dropped   []string          `json:"dropped,omitempty"`
+	Approvals []agent.Approval  `json:"approvals,omitempty"`
+	Profiles  map[string]string `json:"wsl_profiles,omitempty"`
+}
+
+// stripPrivateKeys removes every private_key value from YAML configuration, comments are preserved. Returns names of
+// removed values.
+func stripPrivateKeys(data []byte) ([]byte, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	var dropped []string
+	var walk func(n *yaml.Node, path string)
+	walk = func(n *yaml.Node, path string) {
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml.MappingNode:
+			content := n.Content[:0]
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				name := strings.TrimPrefix(path+"."+k.Value, ".")
+				if k.Value == "private_key" {
+					dropped = append(dropped, name)
+					continue
+				}
+				walk(v, name)
+				content = append(content, k, v)
+			}
+			n.Content = content
+		default:
+		}
+	}
+	walk(&doc, "")
+	if len(dropped) == 0 {
+		return data, nil, nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), dropped, nil
+}
+
+// readBundlePassphrase asks for bundle passphrase on terminal program was started from, twice when bundle is created.
+func readBundlePassphrase(confirm bool) (*util.SecureBuffer, error) {
+	ppid := uint32(os.Getppid())
+	pass, err := util.ReadConsoleSecret(ppid, "Bundle passphrase: ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase (run from terminal): %w", err)
+	}
+	if pass.Len() == 0 {
+		pass.Free()
+		return nil, errors.New("empty passphrase")
+	}
+	if !confirm {
+		return pass, nil
+	}
+	again, err := util.ReadConsoleSecret(ppid, "Repeat passphrase: ")
+	if err != nil {
+		pass.Free()
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	defer again.Free()
+	if !bytes.Equal(pass.Bytes(), again.Bytes()) {
+		pass.Free()
+		return nil, errors.New("passphrases do not match")
+	}
+	return pass, nil
+}
+
+// wslProfiles reads agent environment files --configure-wsl generated in WSL distributions.
+func wslProfiles() map[string]string {
+	distros, err := util.WSLDistros()
+	if err != nil {
+		return nil
+	}
+	res := make(map[string]string)
+	for _, d := range distros {
+		out, err := util.WSLRun(d.Name, fmt.Sprintf(`cat "${HOME}/%s" 2>/dev/null || true`, wslEnvFile))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", d.Name, err)
+			continue
+		}
+		if strings.Contains(out, wslHeader) {
+			res[d.Name] = out
+		}
+	}
+	return res
+}
+
+// exportState writes passphrase protected bundle with configuration, remembered approvals and WSL profile snippets.
+// Returns process exit code.
+func exportState(cfg *config.Config, fname string) int {
+	// passphrase is read from console before standard handles are attached to it
+	pass, err := readBundlePassphrase(true)
+	util.AttachConsole()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer pass.Free()
+
+	b := &stateBundle{Version: stateVersion, Created: time.Now(), Agent: misc.GetVersion()}
+	b.Host, _ = os.Hostname()
+	data, err := os.ReadFile(aConfigName)
+	switch {
+	case err == nil:
+		if data, b.Dropped, err = stripPrivateKeys(data); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to process configuration %s: %s\n", aConfigName, err)
+			return exitConfig
+		}
+		b.Config = string(data)
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Printf("Configuration file %s does not exist, defaults are used\n", aConfigName)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if b.Approvals, err = agent.LoadApprovals(cfg.GUI.Home); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	b.Profiles = wslProfiles()
+
+	data, err = json.Marshal(b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	sealed, err := util.SealBundle(data, pass.Bytes())
+	util.Wipe(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if err := os.WriteFile(fname, sealed, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	fmt.Printf("State is exported to %s:\n", fname)
+	if len(b.Config) > 0 {
+		fmt.Printf("  configuration %s\n", aConfigName)
+	}
+	for _, d := range b.Dropped {
+		fmt.Printf("  %s is not exported\n", d)
+	}
+	fmt.Printf("  %d remembered approval(s)\n", len(b.Approvals))
+	for name := range b.Profiles {
+		fmt.Printf("  WSL profile of %s\n", name)
+	}
+	return exitOK
+}
+
+// importState restores bundle created by exportState: configuration replaces current one (which is kept as .bak),
+// approvals are added to remembered ones and WSL distributions which had profile snippets are configured again, so
+// paths are right for this machine. Returns process exit code.
+func importState(cfg *config.Config, fname string) int {
+	// running instance would overwrite approvals and would not see new configuration, holding its lock also keeps
+	// it from starting while state is imported
+	lockName := lockFileName()
+	inst, err := singleinstance.CreateLockFile(lockName)
+	if err != nil {
+		util.AttachConsole()
+		fmt.Fprintf(os.Stderr, "%s is running, stop it first (--stop)\n", util.InstanceName(title, aInstance))
+		return exitRunning
+	}
+	defer func() {
+		inst.Close()
+		os.Remove(lockName)
+	}()
+
+	// passphrase is read from console before standard handles are attached to it
+	pass, err := readBundlePassphrase(false)
+	util.AttachConsole()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	sealed, err := os.ReadFile(fname)
+	if err != nil {
+		pass.Free()
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	data, err := util.OpenBundle(sealed, pass.Bytes())
+	pass.Free()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	b := &stateBundle{}
+	err = json.Unmarshal(data, b)
+	util.Wipe(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad bundle: %s\n", err)
+		return exitFailure
+	}
+	if b.Version != stateVersion {
+		fmt.Fprintf(os.Stderr, "Unsupported bundle version %d\n", b.Version)
+		return exitFailure
+	}
+	fmt.Printf("Importing state exported from %s on %s by %s\n", b.Host, b.Created.Format(time.RFC1123), b.Agent)
+
+	code := exitOK
+	if len(b.Config) > 0 {
+		if old, err := os.ReadFile(aConfigName); err == nil && !bytes.Equal(old, []byte(b.Config)) {
+			if err := os.WriteFile(aConfigName+".bak", old, 0600); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to keep current configuration: %s\n", err)
+				return exitFailure
+			}
+			fmt.Printf("Current configuration is saved as %s.bak\n", aConfigName)
+		}
+		if err := os.WriteFile(aConfigName, []byte(b.Config), 0600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		fmt.Printf("Configuration is written to %s\n", aConfigName)
+		for _, d := range b.Dropped {
+			fmt.Printf("  %s was not exported, set it again\n", d)
+		}
+		if cfg, err = config.LoadInstance(aInstance, aConfigName); err != nil {
+			fmt.Fprintf(os.Stderr, "Imported configuration is not valid: %s\n", err)
+			return exitConfig
+		}
+	}
+
+	if len(b.Approvals) > 0 {
+		if err := os.MkdirAll(cfg.GUI.Home, 0700); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		if n, err := agent.ImportApprovals(cfg.GUI.Home, b.Approvals); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to import approvals: %s\n", err)
+			code = exitProblems
+		} else {
+			fmt.Printf("%d of %d remembered approval(s) are imported\n", n, len(b.Approvals))
+		}
+	}
+
+	if len(b.Profiles) > 0 {
+		if c := importProfiles(cfg, b.Profiles); c != exitOK {
+			code = c
+		}
+	}
+	if code == exitOK {
+		fmt.Println("\nStart agent-gui to use imported state.")
+	}
+	return code
+}
+
+// importProfiles configures again WSL distributions which had profile snippets on exporting machine.
+func importProfiles(cfg *config.Config, profiles map[string]string) int {
+	a, err := agent.Prepare(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	distros, err := util.WSLDistros()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WSL profiles are not imported: %s\n", err)
+		return exitProblems
+	}
+	code := exitOK
+	for name := range profiles {
+		var p *wslPlan
+		for _, d := range distros {
+			if strings.EqualFold(d.Name, name) {
+				p = prepareWSLPlan(a, d)
+				break
+			}
+		}
+		if p == nil {
+			fmt.Printf("%s: WSL distribution is not found, profile is not imported\n", name)
+			continue
+		}
+		if len(p.Method) > 0 {
+			if err := p.apply(); err != nil {
+				p.Notes = append(p.Notes, err.Error())
+				p.Method = ""
+			}
+		}
+		if len(p.Method) > 0 {
+			fmt.Printf("%s (%s): configured using %s\n", name, wslVersion(p.Distro), p.Method)
+		} else {
+			fmt.Printf("%s (%s): not configured\n", name, wslVersion(p.Distro))
+			code = exitProblems
+		}
+		for _, n := range p.Notes {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	return code
+}
@@ -0,0 +1,64 @@
+package gui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/systray"
+)
+
+var (
+	// trayTitle is shown in message boxes and notifications, title stays the same since it names files and instances.
+	trayTitle   = title
+	trayTooltip = tooltip
+	trayIcon    string
+)
+
+// setupTray selects tray icon, title and tooltip for instance. Named instances without explicit settings have instance
+// name added, so several running instances could be told apart.
+func setupTray(cfg *config.Config) {
+	tc := cfg.GUI.Tray
+	if len(cfg.GUI.Instance) > 0 {
+		trayTitle = fmt.Sprintf("%s [%s]", title, cfg.GUI.Instance)
+		trayTooltip = fmt.Sprintf("%s [%s]", tooltip, cfg.GUI.Instance)
+		if ic, ok := tc.Instances[cfg.GUI.Instance]; ok {
+			if len(ic.Icon) > 0 {
+				tc.Icon = ic.Icon
+			}
+			if len(ic.Title) > 0 {
+				tc.Title = ic.Title
+			}
+			if len(ic.Tooltip) > 0 {
+				tc.Tooltip = ic.Tooltip
+			}
+		}
+	}
+	if len(tc.Title) > 0 {
+		trayTitle = tc.Title
+	}
+	if len(tc.Tooltip) > 0 {
+		trayTooltip = tc.Tooltip
+	}
+	if len(tc.Icon) > 0 {
+		trayIcon = os.ExpandEnv(tc.Icon)
+		if !filepath.IsAbs(trayIcon) {
+			// relative to configuration file
+			trayIcon = filepath.Join(filepath.Dir(aConfigName), trayIcon)
+		}
+	}
+}
+
+// setTrayAppearance applies selected icon and tooltip, built-in icon is used when custom one could not be loaded.
+func setTrayAppearance() {
+	if len(trayIcon) == 0 {
+		systray.SetIcon(systray.MakeIntResource(1000))
+	} else if err := systray.SetIconFromFile(trayIcon); err != nil {
+		log.Printf("Unable to load tray icon %s, using default: %s", trayIcon, err.Error())
+		systray.SetIcon(systray.MakeIntResource(1000))
+	}
+	systray.SetTitle(trayTitle)
+	systray.SetTooltip(trayTooltip)
+}
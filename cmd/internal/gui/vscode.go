@@ -0,0 +1,144 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Where agent sockets are mounted inside containers.
+const (
+	containerSocketDir = "/run/agent-gui"
+	containerGPGSocket = containerSocketDir + "/S.gpg-agent"
+	containerSSHSocket = containerSocketDir + "/S.gpg-agent.ssh"
+)
+
+// endpointAddress returns address of running connector with given id or empty string.
+func endpointAddress(eps []agent.Endpoint, id string) string {
+	for _, e := range eps {
+		if e.ID == id {
+			return e.Address
+		}
+	}
+	return ""
+}
+
+// mergeJSON reads JSON object from fname (if it exists), lets update modify it and writes it back. Files with comments
+// (JSONC) could not be merged safely and are left untouched.
+func mergeJSON(fname string, update func(map[string]interface{})) error {
+	doc := make(map[string]interface{})
+	data, err := os.ReadFile(fname)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("unable to merge into %s (comments or trailing commas?): %w", fname, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return err
+	}
+	update(doc)
+	if data, err = json.MarshalIndent(doc, "", "  "); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(fname, append(data, '\n'), 0600)
+}
+
+// addMount appends bind mount to devcontainer mounts unless mount with the same target is already there.
+func addMount(doc map[string]interface{}, source, target string) {
+	mount := fmt.Sprintf("source=%s,target=%s,type=bind", filepath.ToSlash(source), target)
+	mounts, _ := doc["mounts"].([]interface{})
+	for i, m := range mounts {
+		s, ok := m.(string)
+		if !ok {
+			continue
+		}
+		for _, part := range strings.Split(s, ",") {
+			if strings.TrimSpace(part) == "target="+target {
+				mounts[i] = mount
+				doc["mounts"] = mounts
+				return
+			}
+		}
+	}
+	doc["mounts"] = append(mounts, mount)
+}
+
+// setupVSCode writes VS Code user settings and devcontainer configuration of workspace dir using paths of running
+// instance connectors. Returns process exit code.
+func setupVSCode(cfg *config.Config, dir string) int {
+	util.AttachConsole()
+
+	c, err := control.NewClient(util.ControlPipeName(cfg.GUI.Instance), cfg.GUI.Home, cfg.GUI.Control.Token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	st, err := c.Status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var failed bool
+
+	// Remote - SSH: use Windows OpenSSH which talks to served pipe and forward agent
+	if ssh := filepath.Join(os.Getenv("SystemRoot"), "System32", "OpenSSH", "ssh.exe"); util.FileExists(ssh) {
+		fname := filepath.Join(os.Getenv("APPDATA"), "Code", "User", "settings.json")
+		if err := mergeJSON(fname, func(doc map[string]interface{}) {
+			doc["remote.SSH.path"] = ssh
+			doc["remote.SSH.enableAgentForwarding"] = true
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		} else {
+			fmt.Printf("Updated %s\n", fname)
+		}
+	}
+
+	// Dev Containers: bind mount AF_UNIX sockets and point SSH_AUTH_SOCK to them
+	gpgSock := endpointAddress(st.Endpoints, agent.ConnectorSockAgentExtra.ID())
+	sshSock := endpointAddress(st.Endpoints, agent.ConnectorSockAgentSSH.ID())
+	if len(gpgSock) == 0 && len(sshSock) == 0 {
+		fmt.Fprintln(os.Stderr, "running instance does not serve AF_UNIX sockets, devcontainer is not configured")
+		return 1
+	}
+	fname := filepath.Join(dir, ".devcontainer", "devcontainer.json")
+	if err := mergeJSON(fname, func(doc map[string]interface{}) {
+		if len(gpgSock) > 0 {
+			addMount(doc, gpgSock, containerGPGSocket)
+		}
+		if len(sshSock) > 0 {
+			addMount(doc, sshSock, containerSSHSocket)
+			env, _ := doc["remoteEnv"].(map[string]interface{})
+			if env == nil {
+				env = make(map[string]interface{})
+			}
+			env["SSH_AUTH_SOCK"] = containerSSHSocket
+			doc["remoteEnv"] = env
+		}
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	} else {
+		fmt.Printf("Updated %s\n", fname)
+		if len(gpgSock) > 0 {
+			fmt.Printf("Inside container link gpg socket with: ln -sf %s $(gpgconf --list-dirs agent-socket)\n", containerGPGSocket)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package gui
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/control"
+	"github.com/rupor-github/win-gpg-agent/notify"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// watchQueue is number of lines buffered for every watcher, slow watcher loses lines rather than blocking agent.
+const watchQueue = 64
+
+// watchStateEvents are events after which fresh state snapshot is sent to watchers.
+var watchStateEvents = map[notify.Event]bool{notify.AgentRestarted: true, notify.CardRemoved: true}
+
+// watchHub fans out events and state changes to control API watch streams (status bar widgets, prompt segments).
+type watchHub struct {
+	mu   sync.Mutex
+	subs map[chan *control.WatchEvent]struct{}
+}
+
+var watchers = &watchHub{subs: make(map[chan *control.WatchEvent]struct{})}
+
+// Send implements notify.Backend.
+func (h *watchHub) Send(m *notify.Message) error {
+	h.publish(&control.WatchEvent{Type: control.WatchEventType, Time: m.Time, Event: string(m.Event), Title: m.Title, Text: m.Text, Fields: m.Fields})
+	if watchStateEvents[m.Event] {
+		h.stateChanged()
+	}
+	return nil
+}
+
+func (h *watchHub) publish(ev *control.WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *watchHub) watched() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// stateChanged sends state snapshot to watchers. Snapshot talks to gpg-agent, so it is never done on caller's
+// goroutine.
+func (h *watchHub) stateChanged() {
+	if !h.watched() {
+		return
+	}
+	go func() {
+		defer util.HandlePanic()
+		h.publish(&control.WatchEvent{Type: control.WatchStateType, Time: time.Now(), State: controller{}.Status()})
+	}()
+}
+
+// subscribe returns channel which gets current state first and then events and state changes until ctx is done.
+func (h *watchHub) subscribe(ctx context.Context) <-chan *control.WatchEvent {
+	ch := make(chan *control.WatchEvent, watchQueue)
+	ch <- &control.WatchEvent{Type: control.WatchStateType, Time: time.Now(), State: controller{}.Status()}
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subs, ch)
+		close(ch)
+		h.mu.Unlock()
+	}()
+	return ch
+}
+
+func (controller) Watch(ctx context.Context) <-chan *control.WatchEvent {
+	return watchers.subscribe(ctx)
+}
+
+// setupWatch makes all events available to watch streams.
+func setupWatch() error {
+	return notify.AddSink(notify.Events, watchers)
+}
+
+// watchInstance prints events and state changes of running instance to stdout as NDJSON until interrupted, returns
+// process exit code.
+func watchInstance(cfg *config.Config) int {
+	util.AttachConsole()
+
+	c, err := control.NewClient(util.ControlPipeName(cfg.GUI.Instance), cfg.GUI.Home, cfg.GUI.Control.Token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = c.Watch(ctx, func(line []byte) error {
+		_, err := fmt.Fprintf(os.Stdout, "%s\n", line)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,418 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Ways agent sockets could be wired into WSL distribution.
+const (
+	// WSL1 uses Windows AF_UNIX sockets directly, paths come translated with WSLENV
+	wslMethodWSLENV = "wslenv"
+	// profile snippet with fixed paths (WSL1 without interop) or socat relays started on login (WSL2)
+	wslMethodProfile = "profile"
+	// WSL2 with systemd gets socket activated user units
+	wslMethodSystemd = "systemd"
+)
+
+// Files created in distribution, relative to user home.
+const (
+	wslEnvFile  = ".config/win-gpg-agent/env.sh"
+	wslUnitDir  = ".config/systemd/user"
+	wslUnitName = "win-gpg-agent"
+	wslHeader   = "# Generated by agent-gui.exe --configure-wsl, will be overwritten."
+)
+
+// wslRelay is Linux end of single agent socket in WSL2 distribution.
+type wslRelay struct {
+	// suffix of systemd units
+	id string
+	// name of socket to listen on
+	name string
+	// command which talks to agent on stdin/stdout
+	exec []string
+	// socat address used instead of exec when set
+	address string
+}
+
+// socatTarget returns second socat address of relay.
+func (r *wslRelay) socatTarget() string {
+	if len(r.address) > 0 {
+		return r.address
+	}
+	// socat splits EXEC on spaces and has no quoting for them
+	return fmt.Sprintf("EXEC:\"%s\",nofork", strings.ReplaceAll(strings.Join(r.exec, " "), ":", `\:`))
+}
+
+// unitExec returns relay command line for systemd unit.
+func (r *wslRelay) unitExec(socat string) string {
+	args := r.exec
+	if len(r.address) > 0 {
+		args = []string{socat, "STDIO", r.address}
+	}
+	quoted := make([]string, 0, len(args))
+	for _, a := range args {
+		quoted = append(quoted, "\""+strings.ReplaceAll(a, `"`, `\"`)+"\"")
+	}
+	return strings.Join(quoted, " ")
+}
+
+// wslPlan describes wiring of single distribution.
+type wslPlan struct {
+	Distro util.WSLDistro `json:"distro"`
+	Method string         `json:"method,omitempty"`
+	// Init is name of process 1 in distribution, systemd units are only used when it is systemd
+	Init   string            `json:"init,omitempty"`
+	Files  map[string]string `json:"files,omitempty"`
+	Script string            `json:"script,omitempty"`
+	Notes  []string          `json:"notes,omitempty"`
+	// check is run after plan is applied, anything it prints is a problem
+	check string
+}
+
+// wslProbe is what we need to know about distribution from inside.
+type wslProbe struct {
+	init, socat, sorelay, sockets string
+	// uid of default user and "uid mode" of sockets directory as seen in distribution
+	uid, owner string
+}
+
+// probeWSL starts distribution and collects information necessary to wire it.
+func probeWSL(d util.WSLDistro, sorelay, sockets string) (*wslProbe, error) {
+	script := fmt.Sprintf(`echo "init=$(cat /proc/1/comm 2>/dev/null)"
+echo "socat=$(command -v socat 2>/dev/null)"
+echo "sorelay=$(wslpath -u %[1]s 2>/dev/null)"
+sockets="$(wslpath -u %[2]s 2>/dev/null)"
+echo "sockets=${sockets}"
+echo "uid=$(id -u)"
+[ -z "${sockets}" ] || echo "owner=$(stat -c '%%u %%a' "${sockets}" 2>/dev/null)"
+`, util.WSLShellQuote(sorelay), util.WSLShellQuote(sockets))
+	out, err := util.WSLRun(d.Name, script)
+	if err != nil {
+		return nil, err
+	}
+	p := &wslProbe{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "init":
+			p.init = kv[1]
+		case "socat":
+			p.socat = kv[1]
+		case "sorelay":
+			p.sorelay = kv[1]
+		case "sockets":
+			p.sockets = kv[1]
+		case "uid":
+			p.uid = kv[1]
+		case "owner":
+			p.owner = kv[1]
+		default:
+		}
+	}
+	return p, nil
+}
+
+// prepareWSLPlan decides how distribution should be wired based on its version and interop capabilities.
+func prepareWSLPlan(a *agent.Agent, d util.WSLDistro) *wslPlan {
+
+	p := &wslPlan{Distro: d, Files: make(map[string]string)}
+
+	gpgSock := a.GetConnector(agent.ConnectorSockAgent).PathGUI()
+	sshSock := a.GetConnector(agent.ConnectorSockAgentSSH).PathGUI()
+	sockets := util.PrepareWindowsPath(filepath.Dir(gpgSock))
+
+	sorelay := ""
+	if expath, err := os.Executable(); err == nil {
+		sorelay = filepath.Join(filepath.Dir(expath), "sorelay.exe")
+	}
+
+	probe, err := probeWSL(d, sorelay, sockets)
+	if err != nil {
+		p.Notes = append(p.Notes, fmt.Sprintf("unable to look inside distribution: %s", err))
+		return p
+	}
+	p.Init = probe.init
+
+	if d.Version == 1 {
+		if len(probe.sockets) == 0 {
+			p.Notes = append(p.Notes, fmt.Sprintf("%s is not visible in distribution (are Windows drives mounted?)", sockets))
+			return p
+		}
+		// WSL1 talks to Windows AF_UNIX sockets directly, prefer paths coming with WSLENV so relocation is picked up
+		dir, ssh := util.WSLShellQuote(probe.sockets), "${WIN_GPG_AGENT_SOCKETS}/"+filepath.Base(sshSock)
+		p.Method = wslMethodProfile
+		if d.Interop && wslenvPaths(a, "WSL_"+envGUISocketsName) {
+			p.Method = wslMethodWSLENV
+			dir = fmt.Sprintf("\"${WSL_%s:-%s}\"", envGUISocketsName, probe.sockets)
+			if wslenvPaths(a, "WSL_"+envPipeName) {
+				ssh = fmt.Sprintf("${WSL_%s:-%s}", envPipeName, ssh)
+			}
+		}
+		p.Files[wslEnvFile] = fmt.Sprintf(`%s
+WIN_GPG_AGENT_SOCKETS=%s
+export GNUPGHOME="${WIN_GPG_AGENT_SOCKETS}"
+export SSH_AUTH_SOCK="%s"
+unset WIN_GPG_AGENT_SOCKETS
+`, wslHeader, dir, ssh)
+		p.Script = wslProfileHook
+		if probe.owner != probe.uid+" 700" {
+			// Windows sockets are shared by all users of distribution unless directory is private, which is only
+			// possible when DrvFs keeps Linux permissions
+			quoted := util.WSLShellQuote(probe.sockets)
+			p.Script = fmt.Sprintf("chmod 700 %s 2>/dev/null || true\n", quoted) + p.Script
+			p.check = fmt.Sprintf(`[ "$(stat -c '%%u %%a' %[1]s 2>/dev/null)" = "$(id -u) 700" ] || echo %[2]s`, quoted,
+				util.WSLShellQuote(fmt.Sprintf("%s is accessible to other users of distribution, mount Windows drives with metadata option ([automount] options = \"metadata\" in /etc/wsl.conf) to make it private", probe.sockets)))
+		}
+		return p
+	}
+
+	// WSL2 has no AF_UNIX interop, sockets have to be relayed
+	var relays []*wslRelay
+	switch {
+	case d.Interop && len(probe.sorelay) > 0 && util.FileExists(sorelay):
+		relays = []*wslRelay{
+			{id: "gpg", name: "S.gpg-agent", exec: append([]string{probe.sorelay}, sorelayTarget(a, util.DiscoveryGPG, gpgSock)...)},
+			{id: "ssh", name: "S.gpg-agent.ssh", exec: append([]string{probe.sorelay}, sorelayTarget(a, util.DiscoverySSH, sshSock)...)},
+		}
+	case a.Cfg.GUI.HyperV.SSHPort > 0 || a.Cfg.GUI.HyperV.ExtraPort > 0:
+		// no way to start Windows helper, but Hyper-V sockets are reachable from WSL2 VM
+		if port := a.Cfg.GUI.HyperV.ExtraPort; port > 0 {
+			relays = append(relays, &wslRelay{id: "gpg", name: "S.gpg-agent", address: fmt.Sprintf("VSOCK-CONNECT:2:%d", port)})
+		}
+		if port := a.Cfg.GUI.HyperV.SSHPort; port > 0 {
+			relays = append(relays, &wslRelay{id: "ssh", name: "S.gpg-agent.ssh", address: fmt.Sprintf("VSOCK-CONNECT:2:%d", port)})
+		}
+	case !d.Interop:
+		p.Notes = append(p.Notes, "interop is disabled and gui.hyperv ports are not configured, there is nothing to relay to")
+		return p
+	default:
+		p.Notes = append(p.Notes, fmt.Sprintf("%s is not found or not visible in distribution", sorelay))
+		return p
+	}
+
+	if probe.init == "systemd" {
+		p.Method = wslMethodSystemd
+		var units []string
+		for _, r := range relays {
+			if len(r.address) > 0 && len(probe.socat) == 0 {
+				p.Notes = append(p.Notes, "socat is not installed in distribution")
+				p.Method = ""
+				return p
+			}
+			name := wslUnitName + "-" + r.id
+			p.Files[wslUnitDir+"/"+name+".socket"] = fmt.Sprintf(`%s
+[Unit]
+Description=win-gpg-agent %s relay
+
+[Socket]
+ListenStream=%%t/gnupg/%s
+SocketMode=0600
+DirectoryMode=0700
+Accept=yes
+
+[Install]
+WantedBy=sockets.target
+`, wslHeader, r.name, r.name)
+			p.Files[wslUnitDir+"/"+name+"@.service"] = fmt.Sprintf(`%s
+[Unit]
+Description=win-gpg-agent %s relay connection
+
+[Service]
+ExecStart=%s
+StandardInput=socket
+StandardOutput=socket
+`, wslHeader, r.name, r.unitExec(probe.socat))
+			units = append(units, name+".socket")
+		}
+		p.Files[wslEnvFile] = fmt.Sprintf(`%s
+export SSH_AUTH_SOCK="${XDG_RUNTIME_DIR:-/run/user/$(id -u)}/gnupg/S.gpg-agent.ssh"
+`, wslHeader)
+		// gpg-agent units from distribution would fight for the same sockets
+		p.Script = fmt.Sprintf(`systemctl --user mask gpg-agent.socket gpg-agent-ssh.socket gpg-agent-extra.socket gpg-agent-browser.socket >/dev/null 2>&1 || true
+systemctl --user daemon-reload
+systemctl --user enable --now %s
+`, strings.Join(units, " ")) + wslProfileHook
+		return p
+	}
+
+	if len(probe.socat) == 0 {
+		p.Notes = append(p.Notes, "socat is not installed in distribution")
+		return p
+	}
+	p.Method = wslMethodProfile
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s\nmkdir -p -m 700 \"${HOME}/.gnupg\"\n", wslHeader)
+	for _, r := range relays {
+		sock := "${HOME}/.gnupg/" + r.name
+		fmt.Fprintf(&buf, `if ! %[1]s -u OPEN:/dev/null UNIX-CONNECT:"%[2]s" >/dev/null 2>&1; then
+    rm -f "%[2]s"
+    ( setsid %[1]s UNIX-LISTEN:"%[2]s",fork,umask=077 %[3]s & ) >/dev/null 2>&1
+fi
+`, probe.socat, sock, r.socatTarget())
+	}
+	buf.WriteString("export SSH_AUTH_SOCK=\"${HOME}/.gnupg/S.gpg-agent.ssh\"\n")
+	p.Files[wslEnvFile] = buf.String()
+	p.Script = wslProfileHook
+	return p
+}
+
+// sorelayTarget returns sorelay arguments selecting socket: published endpoint name, so sockets could move without
+// regenerating relays, or path when instance name could not survive socat EXEC splitting.
+func sorelayTarget(a *agent.Agent, endpoint, path string) []string {
+	args := []string{"--endpoint", endpoint}
+	if inst := a.Cfg.GUI.Instance; len(inst) > 0 {
+		if strings.ContainsAny(inst, " \t\"'\\:,!") {
+			return []string{filepath.ToSlash(path)}
+		}
+		args = append(args, "--instance", inst)
+	}
+	return args
+}
+
+// wslProfileHook makes login shells source generated environment file.
+var wslProfileHook = fmt.Sprintf(`touch "${HOME}/.profile"
+for f in .profile .bash_profile .zprofile; do
+    [ -f "${HOME}/${f}" ] || continue
+    grep -qF '%[1]s' "${HOME}/${f}" || printf '\n[ -f "${HOME}/%[1]s" ] && . "${HOME}/%[1]s"\n' >> "${HOME}/${f}"
+done
+`, wslEnvFile)
+
+func (p *wslPlan) apply() error {
+	if len(p.Files) > 0 {
+		if err := util.WSLWriteFiles(p.Distro.Name, p.Files); err != nil {
+			return err
+		}
+	}
+	if len(p.Script) > 0 {
+		if _, err := util.WSLRun(p.Distro.Name, "set -e\n"+p.Script); err != nil {
+			return err
+		}
+	}
+	if len(p.check) > 0 {
+		out, err := util.WSLRun(p.Distro.Name, p.check)
+		if err != nil {
+			return err
+		}
+		if out = strings.TrimSpace(out); len(out) > 0 {
+			p.Notes = append(p.Notes, out)
+		}
+	}
+	return nil
+}
+
+func wslVersion(d util.WSLDistro) string {
+	res := fmt.Sprintf("WSL%d", d.Version)
+	if !d.Interop {
+		res += ", no interop"
+	}
+	if d.Default {
+		res += ", default"
+	}
+	return res
+}
+
+// listWSL prints WSL distributions registered for current user. Returns process exit code.
+func listWSL() int {
+	util.AttachConsole()
+
+	distros, err := util.WSLDistros()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if aJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(distros); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	if len(distros) == 0 {
+		fmt.Println("No WSL distributions are registered")
+		return exitOK
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, d := range distros {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Name, wslVersion(d), d.BasePath)
+	}
+	w.Flush()
+	return exitOK
+}
+
+// configureWSL wires agent sockets into selected ("all" for every one) WSL distributions. Returns process exit code.
+func configureWSL(cfg *config.Config, name string) int {
+	util.AttachConsole()
+
+	a, err := agent.Prepare(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	distros, err := util.WSLDistros()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	var plans []*wslPlan
+	for _, d := range distros {
+		if strings.EqualFold(name, "all") || strings.EqualFold(name, d.Name) {
+			plans = append(plans, prepareWSLPlan(a, d))
+		}
+	}
+	if len(plans) == 0 {
+		fmt.Fprintf(os.Stderr, "WSL distribution %s is not found\n", name)
+		return exitConfig
+	}
+
+	code := exitOK
+	for _, p := range plans {
+		if len(p.Method) > 0 {
+			if err := p.apply(); err != nil {
+				p.Notes = append(p.Notes, err.Error())
+				p.Method = ""
+			}
+		}
+		if len(p.Method) == 0 {
+			code = exitProblems
+		}
+	}
+
+	if aJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plans); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return code
+	}
+	for _, p := range plans {
+		if len(p.Method) > 0 {
+			fmt.Printf("%s (%s): configured using %s\n", p.Distro.Name, wslVersion(p.Distro), p.Method)
+		} else {
+			fmt.Printf("%s (%s): not configured\n", p.Distro.Name, wslVersion(p.Distro))
+		}
+		for _, n := range p.Notes {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	if code == exitOK {
+		fmt.Println("\nStart new WSL shells to pick up changes.")
+	}
+	return code
+}
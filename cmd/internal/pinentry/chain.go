@@ -0,0 +1,73 @@
+package pinentry
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// chainBuiltin names our own dialogs in pinentry chain.
+const chainBuiltin = "builtin"
+
+// selectChain returns pinentry programs to try in order. Caller could ask for particular chain by setting
+// PINENTRY_USER_DATA, gpg-agent passes it from gpg environment to pinentry.
+func selectChain(cfg *config.PinentryConfig) []string {
+	if data := os.Getenv("PINENTRY_USER_DATA"); len(data) > 0 {
+		for name, chain := range cfg.Callers {
+			if strings.EqualFold(name, data) {
+				log.Printf("Using pinentry chain %v for caller \"%s\"", chain, data)
+				return chain
+			}
+		}
+	}
+	return cfg.Chain
+}
+
+// runExternal starts external pinentry passing our stdin/stdout (Assuan pipe from gpg-agent) to it. Returns false if
+// program could not be started, otherwise its exit code.
+func runExternal(path string) (bool, int) {
+	cmd := exec.Command(os.ExpandEnv(path))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Printf("Unable to start pinentry %s: %s", path, err)
+		return false, 0
+	}
+	log.Printf("Handed over to pinentry %s [%d]", path, cmd.Process.Pid)
+	if err := cmd.Wait(); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return true, ee.ExitCode()
+		}
+		log.Printf("Pinentry %s failed: %s", path, err)
+		return true, 1
+	}
+	return true, 0
+}
+
+// runChain goes over chain until some pinentry starts. Built-in dialogs are skipped when there is no desktop to show
+// them on, "tty" is built-in pinentry asking on terminal of the client. Returns false if chain is exhausted, otherwise
+// exit code.
+func runChain(chain []string, builtin func(tty bool) int) (bool, int) {
+	for _, p := range chain {
+		switch {
+		case strings.EqualFold(p, chainTTY):
+			return true, builtin(true)
+		case strings.EqualFold(p, chainBuiltin):
+			if !util.InteractiveDesktop() {
+				log.Print("No interactive desktop, skipping built-in pinentry")
+				continue
+			}
+			return true, builtin(false)
+		default:
+		}
+		if ok, code := runExternal(p); ok {
+			return true, code
+		}
+	}
+	return false, 0
+}
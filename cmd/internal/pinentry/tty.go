@@ -0,0 +1,80 @@
+package pinentry
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/pinentry"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// chainTTY names built-in pinentry which always asks on terminal of the client.
+const chainTTY = "tty"
+
+// ttyClient returns PID of the client process which console should be used for prompts, agent-gui passes it to
+// gpg-agent as ttyname. Zero means dialogs should be used.
+func (cbs *callbacksState) ttyClient(s *pinentry.Settings) uint32 {
+	if !strings.HasPrefix(s.Opts.TTYName, agent.TTYPrefix) {
+		return 0
+	}
+	pid, err := strconv.ParseUint(strings.TrimPrefix(s.Opts.TTYName, agent.TTYPrefix), 10, 32)
+	if err != nil || pid == 0 {
+		return 0
+	}
+	mode := strings.ToLower(cbs.cfg.GUI.Pinentry.TTY)
+	switch {
+	case cbs.forceTTY || mode == "always":
+	case mode == "never":
+		return 0
+	case util.OtherSession(uint32(pid)) || !util.InteractiveDesktop():
+	default:
+		return 0
+	}
+	return uint32(pid)
+}
+
+// ttyText prepares plain text prompt from pinentry settings.
+func ttyText(errorMessage, description, prompt string) string {
+	var buf strings.Builder
+	buf.WriteString("\n")
+	if len(errorMessage) > 0 {
+		buf.WriteString(strings.TrimSpace(errorMessage) + "\n\n")
+	}
+	if len(description) > 0 {
+		buf.WriteString(strings.TrimSpace(description) + "\n\n")
+	}
+	if prompt = strings.TrimSpace(prompt); len(prompt) == 0 {
+		prompt = "PIN:"
+	}
+	buf.WriteString(prompt + " ")
+	return buf.String()
+}
+
+// ttyPrompt asks for passphrase on terminal of process pid. Falls back to dialogs if console is not reachable.
+func (cbs *callbacksState) ttyPrompt(pid uint32, errorMessage, description, prompt string) (bool, *util.SecureBuffer, bool) {
+	passwd, err := util.ReadConsoleSecret(pid, ttyText(errorMessage, description, prompt))
+	if err != nil {
+		log.Printf("Unable to ask on terminal, using dialog: %s", err.Error())
+		return util.PromptForWindowsCredentials(cbs.cfg.GUI.PinDlg, errorMessage, description, prompt, false)
+	}
+	return false, passwd, false
+}
+
+// ttyConfirm asks yes/no question on terminal of process pid, ok is false if console is not reachable.
+func ttyConfirm(pid uint32, description, prompt string, onebutton bool) (yes, ok bool) {
+	text := ttyText("", description, prompt)
+	if onebutton {
+		text += "[press Enter] "
+	} else {
+		text += "[y/N] "
+	}
+	answer, err := util.ReadConsoleLine(pid, text)
+	if err != nil {
+		log.Printf("Unable to ask on terminal, using dialog: %s", err.Error())
+		return false, false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return onebutton || answer == "y" || answer == "yes", true
+}
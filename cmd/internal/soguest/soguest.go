@@ -0,0 +1,305 @@
+//go:build linux
+// +build linux
+
+// Package soguest is guest side of agent relay for Linux virtual machines which are not WSL (Hyper-V, VMware,
+// VirtualBox): there is no interop to run sorelay.exe, so connection goes out of VM to agent-gui Hyper-V socket or
+// Noise encrypted TCP port directly.
+package soguest
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/noise"
+)
+
+var (
+	title   = "soguest"
+	tooltip = "Agent relay for Linux virtual machines"
+	verStr  = fmt.Sprintf("%s (%s) %s", misc.GetVersion(), runtime.Version(), misc.GetGitHash())
+	// Arguments.
+	cli        = getopt.New()
+	aShowHelp  bool
+	aShowVer   bool
+	aVerbose   bool
+	aListen    string
+	aSockMode  = "600"
+	aVsock     int
+	aVsockCID  = cidHost
+	aNoise     string
+	aNoiseKey  string
+	aKeyFile   = defaultKeyFile()
+	aPair      bool
+	relayCount int64
+)
+
+// relayBufferSize is size of copy buffer for each relay direction.
+const relayBufferSize = 256 * 1024
+
+// defaultKeyFile is where guest Noise private key is kept: $XDG_CONFIG_HOME/win-gpg-agent/guest.key.
+func defaultKeyFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if len(dir) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "guest.key"
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "win-gpg-agent", "guest.key")
+}
+
+// Main runs relay between Linux socket (or stdin/stdout) and agent-gui on Windows host.
+func Main() {
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	log.SetPrefix(title + ": ")
+
+	cli.SetProgram(title)
+	cli.FlagLong(&aListen, "listen", 'l', "Create Linux socket at this path and relay every connection instead of stdin/stdout", "path")
+	cli.FlagLong(&aSockMode, "socket-mode", 0, "Permissions of Linux socket, only owner could connect by default", "octal")
+	cli.FlagLong(&aVsock, "vsock", 0, "Connect to agent-gui gui.hyperv port of the host over AF_VSOCK", "port")
+	cli.FlagLong(&aVsockCID, "vsock-cid", 0, "AF_VSOCK address of the host", "cid")
+	cli.FlagLong(&aNoise, "noise", 0, "Connect to agent-gui Noise encrypted transport at this address", "host:port")
+	cli.FlagLong(&aNoiseKey, "noise-key", 0, "Hex encoded public key of agent-gui Noise transport (shown in Status)", "key")
+	cli.FlagLong(&aKeyFile, "key-file", 0, "File with hex encoded Noise private key of this guest", "path")
+	cli.FlagLong(&aPair, "pair", 0, "Create guest key file unless it exists, print public key to add to gui.noise.public_keys and exit")
+	cli.FlagLong(&aVerbose, "verbose", 'v', "Log connection lifecycle to stderr")
+	cli.FlagLong(&aShowVer, "version", 0, "Show version information")
+	cli.FlagLong(&aShowHelp, "help", 'h', "Show help")
+
+	if err := cli.Getopt(os.Args, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Unsupported options in %+v: %s\n", os.Args, err.Error())
+		os.Exit(1)
+	}
+
+	if aShowHelp {
+		fmt.Fprintf(os.Stderr, "\n%s\n\n\t%s\n\n", tooltip, verStr)
+		cli.PrintUsage(os.Stderr)
+		os.Exit(0)
+	}
+
+	if aShowVer {
+		fmt.Fprintf(os.Stderr, "\n%s\n", verStr)
+		os.Exit(0)
+	}
+
+	if aPair {
+		kp, created, err := guestKey(true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		if created {
+			fmt.Fprintf(os.Stderr, "New key pair is saved in %s\n", aKeyFile)
+		}
+		fmt.Fprintf(os.Stderr, "Add public key to gui.noise.public_keys of agent-gui configuration:\n")
+		fmt.Fprintf(os.Stdout, "%s\n", hex.EncodeToString(kp.Public[:]))
+		os.Exit(0)
+	}
+
+	if !aVerbose {
+		log.SetOutput(io.Discard)
+	}
+
+	if cli.NArgs() != 0 {
+		fmt.Fprintf(os.Stderr, "No positional parameters expected, we have %d instead\n", cli.NArgs())
+		os.Exit(1)
+	}
+
+	dial, target, err := dialer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if len(aListen) == 0 {
+		if err := relay(dial, target, stdio{}); err != nil {
+			if !aVerbose {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := serve(dial, target); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// dialer returns function connecting to agent end selected by command line.
+func dialer() (func() (io.ReadWriteCloser, error), string, error) {
+	switch {
+	case aVsock > 0 && len(aNoise) > 0:
+		return nil, "", errors.New("either --vsock or --noise should be specified, not both")
+	case aVsock > 0:
+		cid, port := uint32(aVsockCID), uint32(aVsock)
+		return func() (io.ReadWriteCloser, error) {
+			return dialVsock(cid, port)
+		}, fmt.Sprintf("vsock:%d:%d", cid, port), nil
+	case len(aNoise) > 0:
+		kp, _, err := guestKey(false)
+		if err != nil {
+			return nil, "", err
+		}
+		server, err := noise.ParseKey(aNoiseKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad --noise-key: %w", err)
+		}
+		addr := aNoise
+		return func() (io.ReadWriteCloser, error) {
+			return noise.Dial(addr, kp, server)
+		}, "noise:" + addr, nil
+	default:
+	}
+	return nil, "", errors.New("agent end is not specified, use --vsock or --noise")
+}
+
+// guestKey reads guest Noise key pair from key file, creating new one when asked to.
+func guestKey(create bool) (*noise.KeyPair, bool, error) {
+	data, err := os.ReadFile(aKeyFile)
+	if err == nil {
+		kp, err := noise.NewKeyPair(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, false, fmt.Errorf("bad key in %s: %w", aKeyFile, err)
+		}
+		return kp, false, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, false, fmt.Errorf("unable to read guest key (run %s --pair first): %w", title, err)
+	}
+	kp, err := noise.GenerateKeyPair()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(aKeyFile), 0700); err != nil {
+		return nil, false, fmt.Errorf("unable to create directory for key file: %w", err)
+	}
+	// never overwrite key created concurrently
+	f, err := os.OpenFile(aKeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to create key file: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s\n", hex.EncodeToString(kp.Private[:])); err != nil {
+		return nil, false, fmt.Errorf("unable to write key file: %w", err)
+	}
+	return kp, true, nil
+}
+
+// stdio is client end when relay runs from socat EXEC or systemd socket unit with Accept=yes.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return os.Stdin.Close() }
+
+// serve listens on Linux socket and relays every accepted connection until interrupted.
+func serve(dial func() (io.ReadWriteCloser, error), target string) error {
+	mode, err := strconv.ParseUint(aSockMode, 8, 32)
+	if err != nil || mode > 0777 || mode&0600 != 0600 {
+		return fmt.Errorf("bad socket mode \"%s\", should be octal number like 600 or 660", aSockMode)
+	}
+	if conn, err := net.Dial("unix", aListen); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already served", aListen)
+	}
+	// stale socket of previous run
+	if fi, err := os.Lstat(aListen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(aListen)
+	}
+	// socket should never be reachable with default permissions, even briefly
+	umask := syscall.Umask(0177)
+	l, err := net.Listen("unix", aListen)
+	syscall.Umask(umask)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(aListen, os.FileMode(mode)); err != nil {
+		return fmt.Errorf("unable to set socket permissions: %w", err)
+	}
+	log.Printf("event=listen path=%q target=%q", aListen, target)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			_ = relay(dial, target, conn)
+		}()
+	}
+}
+
+// relay connects to agent end and copies data both ways until either side is done.
+func relay(dial func() (io.ReadWriteCloser, error), target string, client io.ReadWriteCloser) error {
+	defer client.Close()
+
+	id := atomic.AddInt64(&relayCount, 1)
+	begin := time.Now()
+	log.Printf("event=dial id=%d target=%q", id, target)
+	conn, err := dial()
+	if err != nil {
+		log.Printf("event=error id=%d stage=dial target=%q elapsed=%s err=%q", id, target, time.Since(begin), err.Error())
+		return fmt.Errorf("unable to dial %s: %w", target, err)
+	}
+	defer conn.Close()
+	log.Printf("event=connected id=%d target=%q elapsed=%s", id, target, time.Since(begin))
+
+	// whichever side finishes first ends relay, closing both ends unblocks the other copy
+	done := make(chan struct{}, 2)
+	var sent, received int64
+	go func() {
+		l, _ := copyBuffer(conn, client)
+		atomic.StoreInt64(&sent, l)
+		done <- struct{}{}
+	}()
+	go func() {
+		l, _ := copyBuffer(client, conn)
+		atomic.StoreInt64(&received, l)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	conn.Close()
+	if _, ok := client.(stdio); !ok {
+		// blocking stdin could not be interrupted, process exits anyway
+		<-done
+	}
+	log.Printf("event=closed id=%d target=%q sent=%d received=%d duration=%s", id, target, atomic.LoadInt64(&sent), atomic.LoadInt64(&received), time.Since(begin))
+	return nil
+}
+
+// copyBuffer copies src to dst with large buffer, bypassing io.ReaderFrom and io.WriterTo of connections.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, relayBufferSize))
+}
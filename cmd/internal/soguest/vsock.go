@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package soguest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux AF_VSOCK bits syscall package does not have.
+const (
+	afVsock = 40
+	// cidHost is VMADDR_CID_HOST - hypervisor host as seen from guest.
+	cidHost = 2
+)
+
+// sockaddrVM is struct sockaddr_vm.
+type sockaddrVM struct {
+	family    uint16
+	reserved1 uint16
+	port      uint32
+	cid       uint32
+	zero      [4]byte
+}
+
+// dialVsock connects to port of AF_VSOCK address cid. On Hyper-V guests hv_sock transport maps port to service GUID
+// agent-gui registers for gui.hyperv ports. Go networking does not know AF_VSOCK, so connected socket is wrapped in
+// non-blocking os.File, which runtime poller still handles.
+func dialVsock(cid, port uint32) (io.ReadWriteCloser, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create vsock socket (is vsock transport loaded?): %w", err)
+	}
+	sa := sockaddrVM{family: afVsock, port: port, cid: cid}
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("unable to connect to vsock %d:%d: %w", cid, port, errno)
+		}
+		break
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port)), nil
+}
@@ -0,0 +1,216 @@
+package sorelay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// socketNames are names of published endpoints sockets have in GnuPG socket directory.
+var socketNames = map[string]string{
+	util.DiscoveryGPG:     util.SocketAgentName,
+	util.DiscoverySSH:     util.SocketAgentSSHName,
+	util.DiscoveryExtra:   util.SocketAgentExtraName,
+	util.DiscoveryDirmngr: util.SocketDirmngrName,
+}
+
+// findSocket returns Windows path of agent-gui socket: from discovery file of running instance or, when there is none,
+// from WIN_AGENT_SOCKETS (WIN_AGENT_HOME) agent-gui sets in user environment.
+func findSocket(endpoint, instance string) (string, error) {
+	name, ok := socketNames[endpoint]
+	if !ok {
+		return "", fmt.Errorf("unknown endpoint \"%s\", should be one of gpg, ssh, extra or dirmngr", endpoint)
+	}
+	d, err := util.ReadDiscovery(instance)
+	if err == nil {
+		return d.Socket(endpoint)
+	}
+	if len(instance) == 0 {
+		for _, v := range []string{"WIN_AGENT_SOCKETS", "WIN_AGENT_HOME"} {
+			if dir := os.Getenv(v); len(dir) > 0 {
+				return filepath.Join(filepath.FromSlash(dir), name), nil
+			}
+		}
+	}
+	return "", err
+}
+
+// relayCommand returns command line which runs this program in relay mode for endpoint, with executable path
+// translated for WSL at run time.
+func relayCommand(endpoint, instance string) (string, error) {
+	expath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := []string{"--endpoint", endpoint}
+	if len(instance) > 0 {
+		args = append(args, "--instance", instance)
+	}
+	if !strings.EqualFold(filepath.Base(expath), title+".exe") {
+		// multi-call executable
+		args = append([]string{"relay"}, args...)
+	}
+	return fmt.Sprintf("$(wslpath -u %s) %s", util.WSLShellQuote(expath), strings.Join(args, " ")), nil
+}
+
+// socketAccess describes ownership and permissions of Linux socket relay creates.
+type socketAccess struct {
+	mode  uint64
+	user  string
+	group string
+}
+
+// ownerName is user or group name or numeric id acceptable for chown.
+var ownerName = regexp.MustCompile(`^([a-z_][a-z0-9_.-]*\$?|[0-9]+)$`)
+
+// parseSocketAccess validates --socket-mode and --socket-owner values.
+func parseSocketAccess(mode, owner string) (*socketAccess, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return nil, fmt.Errorf("bad socket mode \"%s\", should be octal number like 600 or 660", mode)
+	}
+	if m&0600 != 0600 {
+		return nil, fmt.Errorf("socket mode %s would lock out socket owner", mode)
+	}
+	if m&0007 != 0 {
+		return nil, fmt.Errorf("socket mode %s would let in every user", mode)
+	}
+	sa := &socketAccess{mode: m}
+	if len(owner) == 0 {
+		return sa, nil
+	}
+	sa.user = owner
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		sa.user, sa.group = owner[:i], owner[i+1:]
+	}
+	for _, n := range []string{sa.user, sa.group} {
+		if len(n) > 0 && !ownerName.MatchString(n) {
+			return nil, fmt.Errorf("bad socket owner \"%s\", should be user[:group]", owner)
+		}
+	}
+	if len(sa.user) == 0 {
+		return nil, fmt.Errorf("bad socket owner \"%s\", user is not specified", owner)
+	}
+	return sa, nil
+}
+
+// dirMode is mode of socket directory: private unless group or others are let in, then they could traverse it but
+// not list.
+func (sa *socketAccess) dirMode() string {
+	if sa.mode&0077 == 0 {
+		return "700"
+	}
+	return "711"
+}
+
+// socatOptions are UNIX-LISTEN options applying access to created socket.
+func (sa *socketAccess) socatOptions() string {
+	opts := fmt.Sprintf(",umask=077,mode=%o", sa.mode)
+	if len(sa.user) > 0 {
+		opts += ",user=" + sa.user
+	}
+	if len(sa.group) > 0 {
+		opts += ",group=" + sa.group
+	}
+	return opts
+}
+
+// peerCheck is perl script socat runs for every accepted connection before relay. It gets peer credentials of socket
+// on stdin (SO_PEERCRED) and runs relay only for socket owner or, when group has access, for its members. Arguments
+// are uid, gid or "-" and relay command line. perl-base is essential package in Debian and Ubuntu.
+const peerCheck = `my ($uid, $gid) = (shift, shift);
+my $cred = getsockopt(STDIN, 1, 17) or die "sorelay: unable to get peer credentials: $!\n";
+my ($pid, $puid, $pgid) = unpack("lLL", $cred);
+my $ok = $puid == $uid;
+if (!$ok && $gid ne "-") {
+    $ok = $pgid == $gid;
+    if (!$ok && open(my $st, "<", "/proc/$pid/status")) {
+        while (<$st>) {
+            $ok = grep { $_ == $gid } split(" ", $1) if /^Groups:\s*(.*)/;
+        }
+    }
+}
+$ok or die "sorelay: rejecting connection from uid $puid\n";
+exec { $ARGV[0] } @ARGV or die "sorelay: unable to run relay: $!\n";
+`
+
+// socatCommand returns command line of socat relay listening on "${_sr_sock}" with access applied, accepted
+// connections are checked against "${_sr_uid}" ("${_sr_gid}" when group has access) by "${_sr_check}" script.
+func (sa *socketAccess) socatCommand(relay string) string {
+	gid := "-"
+	if sa.mode&0070 != 0 {
+		gid = "${_sr_gid}"
+	}
+	return fmt.Sprintf(`socat UNIX-LISTEN:"${_sr_sock}",fork%s EXEC:"perl ${_sr_check} ${_sr_uid} %s %s",nofork`,
+		sa.socatOptions(), gid, relay)
+}
+
+// groupCommand returns shell command printing gid of socket group.
+func (sa *socketAccess) groupCommand() string {
+	if len(sa.group) == 0 {
+		// socat only changes owner, group is the one of user running it
+		return "id -g"
+	}
+	return fmt.Sprintf("getent group %s | cut -d: -f3", sa.group)
+}
+
+// autoScript returns shell code to be evaluated in WSL shell init (eval "$(sorelay.exe --auto ssh)"). On WSL2 it
+// makes Linux socket in $XDG_RUNTIME_DIR/gnupg with socat relay to this program unless relay is already running, on
+// WSL1 Windows AF_UNIX socket is used directly. For ssh SSH_AUTH_SOCK is exported. Socket directory not owned by
+// current user and socket not owned by expected user are never used, so other users of shared distribution could not
+// plant their own relay. Relay refuses connections from users socket is not meant for even if they could reach it.
+func autoScript(endpoint, instance string, sa *socketAccess) (string, error) {
+	winpath, err := findSocket(endpoint, instance)
+	if err != nil {
+		return "", err
+	}
+	relay, err := relayCommand(endpoint, instance)
+	if err != nil {
+		return "", err
+	}
+	name := socketNames[endpoint]
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `# sorelay.exe --auto %[1]s
+_sr_dir="${XDG_RUNTIME_DIR:-/tmp/sorelay-$(id -u)}/gnupg"
+_sr_sock="${_sr_dir}/%[2]s"
+_sr_uid="$(id -u %[5]s)"
+_sr_gid="$(%[7]s)"
+_sr_check="${_sr_dir}/peercheck.pl"
+mkdir -p -m %[6]s "${_sr_dir}"
+if [ -z "${_sr_uid}" ] || [ -z "${_sr_gid}" ]; then
+    echo "sorelay: unable to find uid and gid of socket owner, not using ${_sr_sock}" >&2
+elif [ ! -O "${_sr_dir}" ]; then
+    echo "sorelay: ${_sr_dir} is not owned by $(id -un), not using it" >&2
+elif [ -e "${_sr_sock}" ] && [ ! -L "${_sr_sock}" ] && [ "$(stat -c %%u "${_sr_sock}")" != "${_sr_uid}" ]; then
+    echo "sorelay: ${_sr_sock} is owned by uid $(stat -c %%u "${_sr_sock}") instead of ${_sr_uid}, not using it" >&2
+else
+    chmod %[6]s "${_sr_dir}"
+    case "$(uname -r)" in
+    *microsoft-standard*|*WSL2*)
+        if ! command -v perl >/dev/null 2>&1; then
+            echo "sorelay: perl is needed to check peers of ${_sr_sock}, not starting relay" >&2
+        elif ! socat -u OPEN:/dev/null UNIX-CONNECT:"${_sr_sock}" >/dev/null 2>&1; then
+            cat > "${_sr_check}.$$" <<'_SR_EOF'
+%[8]s_SR_EOF
+            mv -f "${_sr_check}.$$" "${_sr_check}"
+            rm -f "${_sr_sock}"
+            ( setsid %[3]s & ) >/dev/null 2>&1
+        fi
+        ;;
+    *)
+        ln -sfn "$(wslpath -u %[4]s)" "${_sr_sock}"
+        ;;
+    esac
+`, endpoint, name, sa.socatCommand(relay), util.WSLShellQuote(winpath), sa.user, sa.dirMode(), sa.groupCommand(), peerCheck)
+	if endpoint == util.DiscoverySSH {
+		buf.WriteString("    export SSH_AUTH_SOCK=\"${_sr_sock}\"\n")
+	}
+	buf.WriteString("fi\nunset _sr_dir _sr_sock _sr_uid _sr_gid _sr_check\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,69 @@
+package sorelay
+
+import "testing"
+
+func TestParseSocketAccess(t *testing.T) {
+	for _, tc := range []struct {
+		mode, owner string
+		ok          bool
+		user, group string
+	}{
+		{"600", "", true, "", ""},
+		{"0660", "docker", true, "docker", ""},
+		{"660", "alice:docker", true, "alice", "docker"},
+		{"660", "1000:1001", true, "1000", "1001"},
+		{"", "", false, "", ""},
+		{"abc", "", false, "", ""},
+		{"680", "", false, "", ""},
+		{"1600", "", false, "", ""},
+		{"060", "", false, "", ""},
+		{"666", "", false, "", ""},
+		{"601", "", false, "", ""},
+		{"600", ":docker", false, "", ""},
+		{"600", "Alice", false, "", ""},
+		{"600", "alice:", true, "alice", ""},
+		{"600", "alice bob", false, "", ""},
+		{"600", "alice;rm", false, "", ""},
+		{"600", "alice:$(id)", false, "", ""},
+		{"600", "-alice", false, "", ""},
+	} {
+		sa, err := parseSocketAccess(tc.mode, tc.owner)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q %q: error %v, expected success %t", tc.mode, tc.owner, err, tc.ok)
+			continue
+		}
+		if err == nil && (sa.user != tc.user || sa.group != tc.group) {
+			t.Errorf("%q %q: owner %q:%q, expected %q:%q", tc.mode, tc.owner, sa.user, sa.group, tc.user, tc.group)
+		}
+	}
+}
+
+func TestSocatCommand(t *testing.T) {
+	const relay = "$(wslpath -u 'C:\\tools\\sorelay.exe') --endpoint ssh"
+	for _, tc := range []struct {
+		mode, owner string
+		dir, group  string
+		want        string
+	}{
+		{"600", "", "700", "id -g",
+			`socat UNIX-LISTEN:"${_sr_sock}",fork,umask=077,mode=600 EXEC:"perl ${_sr_check} ${_sr_uid} - ` + relay + `",nofork`},
+		{"640", "alice", "711", "id -g",
+			`socat UNIX-LISTEN:"${_sr_sock}",fork,umask=077,mode=640,user=alice EXEC:"perl ${_sr_check} ${_sr_uid} ${_sr_gid} ` + relay + `",nofork`},
+		{"660", "alice:docker", "711", "getent group docker | cut -d: -f3",
+			`socat UNIX-LISTEN:"${_sr_sock}",fork,umask=077,mode=660,user=alice,group=docker EXEC:"perl ${_sr_check} ${_sr_uid} ${_sr_gid} ` + relay + `",nofork`},
+	} {
+		sa, err := parseSocketAccess(tc.mode, tc.owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sa.socatCommand(relay); got != tc.want {
+			t.Errorf("%s %s:\n got %s\nwant %s", tc.mode, tc.owner, got, tc.want)
+		}
+		if got := sa.dirMode(); got != tc.dir {
+			t.Errorf("%s %s: directory mode %s, expected %s", tc.mode, tc.owner, got, tc.dir)
+		}
+		if got := sa.groupCommand(); got != tc.group {
+			t.Errorf("%s %s: group command %q, expected %q", tc.mode, tc.owner, got, tc.group)
+		}
+	}
+}
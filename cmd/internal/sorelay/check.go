@@ -0,0 +1,117 @@
+package sorelay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// checkTimeout limits waiting for agent response in --check mode.
+const checkTimeout = 10 * time.Second
+
+// Protocols agent end could be checked with.
+const (
+	protoSSH     = "ssh"
+	protoAssuan  = "assuan"
+	protoConnect = "connect"
+)
+
+// checkProtocol guesses what agent end talks: ssh-agent sockets and pipes are asked for identities, gpg-agent and
+// dirmngr sockets greet. Hyper-V port could be either, so it is only connected to.
+func checkProtocol(socketName string) string {
+	name := strings.ToLower(filepath.Base(socketName))
+	switch {
+	case aEndpoint == util.DiscoverySSH, strings.Contains(name, "ssh"):
+		return protoSSH
+	case len(aEndpoint) > 0, aAssuan, len(aNoise) > 0, len(aSSPI) > 0, strings.HasPrefix(name, "s."):
+		return protoAssuan
+	default:
+	}
+	return protoConnect
+}
+
+// check dials agent end once, makes trivial request and prints timings, returns process exit code.
+func check(cfg *config.Config, socketName string) int {
+	fmt.Printf("target:   %s\n", socketName)
+
+	begin := time.Now()
+	conn, err := dial(cfg, socketName)
+	if err != nil {
+		fmt.Printf("connect:  FAILED after %s: %s\n", time.Since(begin).Round(time.Microsecond), err)
+		return 1
+	}
+	defer conn.Close()
+	fmt.Printf("connect:  %s\n", time.Since(begin).Round(time.Microsecond))
+
+	if nc, ok := conn.(net.Conn); ok {
+		_ = nc.SetDeadline(time.Now().Add(checkTimeout))
+	}
+
+	proto := checkProtocol(socketName)
+	begin = time.Now()
+	var result string
+	switch proto {
+	case protoSSH:
+		result, err = checkSSH(conn)
+	case protoAssuan:
+		result, err = checkAssuan(conn)
+	default:
+		fmt.Print("response: not checked, protocol is unknown\n")
+		return 0
+	}
+	elapsed := time.Since(begin).Round(time.Microsecond)
+	if err != nil {
+		fmt.Printf("%-9s FAILED after %s: %s\n", proto+":", elapsed, err)
+		return 1
+	}
+	fmt.Printf("%-9s %s in %s\n", proto+":", result, elapsed)
+	return 0
+}
+
+// checkSSH asks ssh-agent for identities.
+func checkSSH(conn io.ReadWriter) (string, error) {
+	const (
+		requestIdentities = 11
+		identitiesAnswer  = 12
+	)
+	if _, err := conn.Write([]byte{0, 0, 0, 1, requestIdentities}); err != nil {
+		return "", err
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return "", err
+	}
+	l := binary.BigEndian.Uint32(length[:])
+	if l < 5 || l > util.MaxAgentMsgLen {
+		return "", fmt.Errorf("bad reply length %d", l)
+	}
+	resp := make([]byte, l)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return "", err
+	}
+	if resp[0] != identitiesAnswer {
+		return "", fmt.Errorf("unexpected reply type %d", resp[0])
+	}
+	return fmt.Sprintf("%d identities", binary.BigEndian.Uint32(resp[1:5])), nil
+}
+
+// checkAssuan waits for server greeting.
+func checkAssuan(conn io.Reader) (string, error) {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "OK") {
+		return "", fmt.Errorf("unexpected greeting \"%s\"", line)
+	}
+	return fmt.Sprintf("greeting \"%s\"", line), nil
+}
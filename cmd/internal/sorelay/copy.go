@@ -0,0 +1,30 @@
+package sorelay
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// relayBufferSize is size of copy buffer for each relay direction. Every chunk crossing WSL interop costs a round
+// trip through hypervisor channel, larger buffer than default 32KB of io.Copy means fewer of them (see
+// BenchmarkRelayCopy). Zero-copy (splice) is not available since this is Windows process talking to interop pipes.
+const relayBufferSize = 256 * 1024
+
+// relayCopy copies src to dst with large buffer. Source and destination are hidden behind plain interfaces, so
+// io.ReaderFrom and io.WriterTo of connections and files (which use their own 32KB buffers) are bypassed.
+func relayCopy(dst io.Writer, src io.Reader) (int64, error) {
+	return copyBuffer(dst, src, make([]byte, relayBufferSize))
+}
+
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
+// rate formats throughput of relayed data for lifecycle log.
+func rate(n int64, d time.Duration) string {
+	if n == 0 || d <= 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.2fMB/s", float64(n)/d.Seconds()/(1024*1024))
+}
@@ -0,0 +1,82 @@
+package sorelay
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// discardConn returns loopback TCP connection everything written to which is read and discarded.
+func discardConn(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+// countingWriter counts writes, in relay every one of them is a chunk crossing to the other side.
+type countingWriter struct {
+	io.Writer
+	writes int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Writer.Write(p)
+}
+
+// benchmarkCopy relays 64MB from pipe (stdin of relay) to TCP connection (agent side) with buffer of given size.
+func benchmarkCopy(b *testing.B, size int) {
+	const total = 64 << 20
+	conn := discardConn(b)
+	defer conn.Close()
+	w := &countingWriter{Writer: conn}
+	chunk := make([]byte, 1<<20)
+
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			defer pw.Close()
+			for n := 0; n < total; n += len(chunk) {
+				if _, err := pw.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+		n, err := copyBuffer(w, r, make([]byte, size))
+		r.Close()
+		if err != nil || n != total {
+			b.Fatalf("relayed %d bytes: %v", n, err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+// BenchmarkRelayCopy32K is io.Copy default, the way sorelay used to relay.
+func BenchmarkRelayCopy32K(b *testing.B) {
+	benchmarkCopy(b, 32*1024)
+}
+
+func BenchmarkRelayCopy256K(b *testing.B) {
+	benchmarkCopy(b, relayBufferSize)
+}
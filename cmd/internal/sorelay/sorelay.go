@@ -0,0 +1,251 @@
+package sorelay
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/pborman/getopt/v2"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/noise"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+var (
+	title   = "sorelay"
+	tooltip = "Socket relay program for WSL"
+	verStr  = fmt.Sprintf("%s (%s) %s", misc.GetVersion(), runtime.Version(), misc.GetGitHash())
+	// Arguments.
+	cli         = getopt.New()
+	aConfigName = title + ".conf"
+	aShowHelp   bool
+	aShowVer    bool
+	aDebug      bool
+	aAssuan     bool
+	aHvsock     int
+	aNoise      string
+	aNoiseKey   string
+	aNoiseGen   bool
+	aSSPI       string
+	aSSPISPN    string
+	aEndpoint   string
+	aInstance   string
+	aAuto       string
+	aSockMode   = "600"
+	aSockOwner  string
+	aCheck      bool
+	aVerbose    bool
+)
+
+// Main runs socket relay copying data between stdin/stdout and agent socket.
+func Main() {
+
+	util.NewLogWriter(title, 0, false)
+
+	// configuration will be picked up at the same place where executable is
+	expath, err := os.Executable()
+	if err == nil {
+		aConfigName = filepath.Join(filepath.Dir(expath), aConfigName)
+	}
+
+	cli.SetProgram("sorelay.exe")
+	cli.SetParameters("path-to-socket")
+	cli.FlagLong(&aAssuan, "assuan", 'a', "Open Assuan socket instead of Unix one")
+	cli.FlagLong(&aHvsock, "hvsock", 0, "Inside Hyper-V guest connect to host Hyper-V socket with this vsock port instead of socket path", "port")
+	cli.FlagLong(&aNoise, "noise", 0, "Connect to remote agent Noise encrypted transport at this address instead of socket path", "host:port")
+	cli.FlagLong(&aNoiseKey, "noise-key", 0, "Hex encoded public key of remote agent Noise transport", "key")
+	cli.FlagLong(&aNoiseGen, "noise-genkey", 0, "Generate new Noise key pair and exit")
+	cli.FlagLong(&aSSPI, "sspi", 0, "Connect to remote agent extra port at this address authenticating as current domain user", "host:port")
+	cli.FlagLong(&aSSPISPN, "sspi-spn", 0, "Service principal name of remote agent for Kerberos (NTLM is used if not set)", "spn")
+	cli.FlagLong(&aEndpoint, "endpoint", 'e', "Connect to socket published by running agent-gui instead of socket path (gpg, ssh, extra or dirmngr)", "name")
+	cli.FlagLong(&aInstance, "instance", 0, "Use sockets published by named agent-gui instance with --endpoint or --auto", "name")
+	cli.FlagLong(&aAuto, "auto", 0, "Print shell code for WSL shell init which creates Linux socket in $XDG_RUNTIME_DIR/gnupg relayed to published socket and exit", "gpg|ssh|extra|dirmngr")
+	cli.FlagLong(&aSockMode, "socket-mode", 0, "Permissions of Linux socket created by --auto relay, only owner could connect by default", "octal")
+	cli.FlagLong(&aSockOwner, "socket-owner", 0, "Owner of Linux socket created by --auto relay, changing it requires root", "user[:group]")
+	cli.FlagLong(&aConfigName, "config", 'c', "Configuration file", "path")
+	cli.FlagLong(&aCheck, "check", 0, "Check if agent end is reachable and responds, print latency and exit")
+	cli.FlagLong(&aVerbose, "verbose", 'v', "Log connection lifecycle to stderr")
+	cli.FlagLong(&aShowVer, "version", 0, "Show version information")
+	cli.FlagLong(&aShowHelp, "help", 'h', "Show help")
+	cli.FlagLong(&aDebug, "debug", 'd', "Turn on debugging")
+
+	if err := cli.Getopt(os.Args, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Unsupported options in %+v: %s", os.Args, err.Error())
+	}
+
+	if aShowHelp {
+		fmt.Fprintf(os.Stderr, "\n%s\n\n\t%s\n\n", tooltip, verStr)
+		cli.PrintUsage(os.Stderr)
+		os.Exit(0)
+	}
+
+	if aShowVer {
+		fmt.Fprintf(os.Stderr, "\n%s\n", verStr)
+		os.Exit(0)
+	}
+
+	if aNoiseGen {
+		kp, err := noise.GenerateKeyPair()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to generate key pair: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "private_key: %s\npublic_key:  %s\n", hex.EncodeToString(kp.Private[:]), hex.EncodeToString(kp.Public[:]))
+		os.Exit(0)
+	}
+
+	if len(aAuto) > 0 {
+		sa, err := parseSocketAccess(aSockMode, aSockOwner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		script, err := autoScript(aAuto, aInstance, sa)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to find %s socket: %s\n", aAuto, err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprint(os.Stdout, script)
+		os.Exit(0)
+	}
+
+	if cli.IsSet("socket-mode") || cli.IsSet("socket-owner") {
+		fmt.Fprintf(os.Stderr, "--socket-mode and --socket-owner could only be used with --auto\n")
+		os.Exit(1)
+	}
+
+	if aHvsock > 0 || len(aNoise) > 0 || len(aSSPI) > 0 || len(aEndpoint) > 0 {
+		if cli.NArgs() != 0 {
+			fmt.Fprintf(os.Stderr, "No socket path should be specified with --hvsock, --noise, --sspi or --endpoint, we have %d parameters instead", cli.NArgs())
+			os.Exit(1)
+		}
+	} else if cli.NArgs() != 1 {
+		fmt.Fprintf(os.Stderr, "Single path to socket should be specified as positional argument, we have %d parameters instead", cli.NArgs())
+		os.Exit(1)
+	}
+	socketName := cli.Arg(0)
+	if aHvsock > 0 {
+		socketName = fmt.Sprintf("hvsock:%d", aHvsock)
+	}
+	if len(aNoise) > 0 {
+		socketName = "noise:" + aNoise
+	}
+	if len(aSSPI) > 0 {
+		socketName = "sspi:" + aSSPI
+	}
+	if len(aEndpoint) > 0 {
+		if socketName, err = findSocket(aEndpoint, aInstance); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to find %s socket: %s\n", aEndpoint, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Read configuration
+	cfg, err := config.Load(aConfigName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load configuration from %s: %s\n", aConfigName, err.Error())
+		os.Exit(1)
+	}
+	if aDebug {
+		cfg.GUI.Debug = aDebug
+	}
+	util.NewLogWriter(title, 0, cfg.GUI.Debug)
+
+	if aVerbose {
+		util.TeeLogWriter(os.Stderr)
+	}
+
+	if aCheck {
+		os.Exit(check(cfg, socketName))
+	}
+
+	begin := time.Now()
+	log.Printf("event=dial target=%q pid=%d", socketName, os.Getpid())
+	conn, err := dial(cfg, socketName)
+	if err != nil {
+		log.Printf("event=error stage=dial target=%q elapsed=%s err=%q", socketName, time.Since(begin), err.Error())
+		if !aVerbose {
+			fmt.Fprintf(os.Stderr, "Unable to dial %s: %s\n", socketName, err.Error())
+		}
+		os.Exit(1)
+	}
+	defer conn.Close()
+	log.Printf("event=connected target=%q elapsed=%s", socketName, time.Since(begin))
+
+	// whichever side finishes first ends relay
+	var sent int64
+	go func() {
+		l, err := relayCopy(conn, os.Stdin)
+		atomic.StoreInt64(&sent, l)
+		if err != nil && !util.IsNetClosing(err) {
+			log.Printf("event=error stage=relay direction=stdin-to-target target=%q bytes=%d duration=%s err=%q", socketName, l, time.Since(begin), err.Error())
+			os.Exit(1)
+		}
+		elapsed := time.Since(begin)
+		log.Printf("event=closed reason=stdin-eof target=%q sent=%d duration=%s sent_rate=%s", socketName, l, elapsed, rate(l, elapsed))
+		os.Exit(0)
+	}()
+
+	l, err := relayCopy(os.Stdout, conn)
+	if err != nil && !util.IsNetClosing(err) {
+		log.Printf("event=error stage=relay direction=target-to-stdout target=%q bytes=%d duration=%s err=%q", socketName, l, time.Since(begin), err.Error())
+		return
+	}
+	elapsed := time.Since(begin)
+	log.Printf("event=closed reason=target-eof target=%q sent=%d received=%d duration=%s received_rate=%s", socketName, atomic.LoadInt64(&sent), l, elapsed, rate(l, elapsed))
+}
+
+// dial connects to agent end of relay.
+func dial(cfg *config.Config, socketName string) (io.ReadWriteCloser, error) {
+	switch {
+	case len(aNoise) > 0:
+		return dialNoise(cfg)
+	case len(aSSPI) > 0:
+		return dialSSPI()
+	case aHvsock > 0:
+		return util.DialHvsock(util.HvsockVMID(util.HvsockParent), winio.VsockServiceID(uint32(aHvsock)))
+	case aAssuan:
+		return client.Dial(socketName)
+	case strings.HasPrefix(socketName, `\\.\pipe\`):
+		timeout := 5 * time.Second
+		return winio.DialPipe(socketName, &timeout)
+	default:
+	}
+	return net.Dial("unix", socketName)
+}
+
+func dialNoise(cfg *config.Config) (io.ReadWriteCloser, error) {
+	kp, err := noise.NewKeyPair(cfg.GUI.Noise.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bad gui.noise.private_key: %w", err)
+	}
+	server, err := noise.ParseKey(aNoiseKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad --noise-key: %w", err)
+	}
+	return noise.Dial(aNoise, kp, server)
+}
+
+func dialSSPI() (io.ReadWriteCloser, error) {
+	conn, err := net.Dial("tcp", aSSPI)
+	if err != nil {
+		return nil, err
+	}
+	if err := util.SSPIInitiate(conn, aSSPISPN); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to authenticate to %s: %w", aSSPI, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,11 @@
+//go:build linux
+// +build linux
+
+// Guest side relay for Linux virtual machines, everything is implemented by soguest package.
+package main
+
+import "github.com/rupor-github/win-gpg-agent/cmd/internal/soguest"
+
+func main() {
+	soguest.Main()
+}
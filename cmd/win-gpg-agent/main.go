@@ -0,0 +1,74 @@
+// Multi-call binary: agent-gui, pinentry and sorelay in one executable, so they could never be of different versions.
+// Subcommand is selected by first argument or, when executable is copied or linked under old name, by its name.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/cmd/internal/gui"
+	"github.com/rupor-github/win-gpg-agent/cmd/internal/pinentry"
+	"github.com/rupor-github/win-gpg-agent/cmd/internal/sorelay"
+	"github.com/rupor-github/win-gpg-agent/misc"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+type subcommand struct {
+	name, exe, help string
+	main            func()
+	console         bool
+}
+
+var subcommands = []subcommand{
+	{name: "gui", exe: "agent-gui", help: "GUI wrapper for gpg-agent (default)", main: gui.Main},
+	{name: "pinentry", exe: "pinentry", help: "Pinentry program for GnuPG", main: pinentry.Main, console: true},
+	{name: "relay", exe: "sorelay", help: "Socket relay program for WSL", main: sorelay.Main, console: true},
+}
+
+func usage() {
+	util.AttachConsole()
+	fmt.Fprintf(os.Stderr, "\nwin-gpg-agent %s (%s) %s\n\nUsage: win-gpg-agent [subcommand] [options]\n\n", misc.GetVersion(), runtime.Version(), misc.GetGitHash())
+	for _, s := range subcommands {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s (was %s.exe)\n", s.name, s.help, s.exe)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"win-gpg-agent <subcommand> --help\" for subcommand options.\n")
+}
+
+func main() {
+
+	sc := &subcommands[0]
+
+	exe := strings.TrimSuffix(strings.ToLower(filepath.Base(os.Args[0])), ".exe")
+	found := false
+	for i := range subcommands {
+		if exe == subcommands[i].exe {
+			sc, found = &subcommands[i], true
+			break
+		}
+	}
+	if !found && len(os.Args) > 1 {
+		switch arg := strings.ToLower(os.Args[1]); arg {
+		case "help", "-h", "--help":
+			usage()
+			os.Exit(0)
+		default:
+			for i := range subcommands {
+				if arg == subcommands[i].name {
+					sc = &subcommands[i]
+					// subcommands parse os.Args themselves
+					os.Args = append(os.Args[:1], os.Args[2:]...)
+					break
+				}
+			}
+		}
+	}
+
+	if sc.console {
+		// executable is built for GUI subsystem, redirected handles (gpg-agent, socat) are not affected
+		util.AttachConsole()
+	}
+	sc.main()
+}
@@ -3,6 +3,7 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,12 +16,32 @@ import (
 
 // GPGConfig structs wraps configuration values for GnuPG.
 type GPGConfig struct {
-	Path    string   `yaml:"install_path,omitempty"`
-	Home    string   `yaml:"homedir,omitempty"`
-	Sockets string   `yaml:"socketdir,omitempty"`
-	StdPin  bool     `yaml:"use_standard_pinentry,omitempty"`
-	Config  string   `yaml:"gpg_agent_conf,omitempty"`
-	Args    []string `yaml:"gpg_agent_args,omitempty"`
+	Path    string       `yaml:"install_path,omitempty"`
+	Home    string       `yaml:"homedir,omitempty"`
+	Sockets string       `yaml:"socketdir,omitempty"`
+	StdPin  bool         `yaml:"use_standard_pinentry,omitempty"`
+	Config  string       `yaml:"gpg_agent_conf,omitempty"`
+	Args    []string     `yaml:"gpg_agent_args,omitempty"`
+	Log     bool         `yaml:"log,omitempty"`
+	Verify  VerifyConfig `yaml:"verify,omitempty"`
+	Network NetworkHome  `yaml:"network_home,omitempty"`
+}
+
+// NetworkHome wraps configuration values used when gpg.homedir is on network share (roaming profiles, redirected
+// folders, mapped drives).
+type NetworkHome struct {
+	LocalSockets  bool          `yaml:"local_sockets,omitempty"`
+	Retries       int           `yaml:"retries,omitempty"`
+	RetryDelay    time.Duration `yaml:"retry_delay,omitempty"`
+	CheckInterval time.Duration `yaml:"check_interval,omitempty"`
+}
+
+// VerifyConfig wraps configuration values for gpg-agent and pinentry tamper check. Hashes are keyed by executable base
+// name, executables without pinned hash must have valid Authenticode signature if Signature is set.
+type VerifyConfig struct {
+	Hashes     map[string]string `yaml:"sha256,omitempty"`
+	Signature  bool              `yaml:"signature,omitempty"`
+	Publishers []string          `yaml:"publishers,omitempty"`
 }
 
 var defaultGPGConfig = `
@@ -28,28 +49,386 @@ gpg:
   install_path: "${ProgramFiles(x86)}\\gnupg"
   homedir: "${APPDATA}\\gnupg"
   socketdir: "${LOCALAPPDATA}\\gnupg"
+  log: true
+  network_home:
+    local_sockets: true
+    retries: 3
+    retry_delay: 500ms
+    check_interval: 30s
 `
 
+// ProxyConfig selects proxy for outbound connections of network facing features: "system" (WinHTTP/IE settings including
+// PAC and auto-detection), "environment" (HTTP_PROXY/HTTPS_PROXY variables), "none" or explicit proxy URL. Features
+// without own setting use Default.
+type ProxyConfig struct {
+	Default string `yaml:"default,omitempty"`
+	Update  string `yaml:"update_check,omitempty"`
+	Webhook string `yaml:"webhook,omitempty"`
+	Dirmngr string `yaml:"dirmngr,omitempty"`
+	Tracing string `yaml:"tracing,omitempty"`
+}
+
+// Mode returns proxy mode for feature setting v.
+func (p *ProxyConfig) Mode(v string) string {
+	if len(v) == 0 {
+		return p.Default
+	}
+	return v
+}
+
+// DirmngrConfig wraps configuration values for dirmngr socket relay.
+type DirmngrConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+}
+
+// CLPSyncConfig wraps configuration values for pushing local clipboard changes to remote gclpr servers.
+type CLPSyncConfig struct {
+	Peers    []string      `yaml:"peers,omitempty"`
+	Key      string        `yaml:"private_key,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// CLPTLSConfig wraps configuration values for protecting gclpr traffic with mutual TLS.
+type CLPTLSConfig struct {
+	Enabled  bool     `yaml:"enabled,omitempty"`
+	Store    string   `yaml:"store,omitempty"`
+	Cert     string   `yaml:"certificate,omitempty"`
+	CAStore  string   `yaml:"ca_store,omitempty"`
+	Subjects []string `yaml:"allowed_subjects,omitempty"`
+}
+
+// CLPPeerConfig wraps text translation values for particular gclpr client.
+type CLPPeerConfig struct {
+	LE       string `yaml:"line_endings,omitempty"`
+	PasteLE  string `yaml:"paste_line_endings,omitempty"`
+	Encoding string `yaml:"encoding,omitempty"`
+}
+
 // CLPConfig wraps configuration values for gclpr.
 type CLPConfig struct {
-	Port int      `yaml:"port,omitempty"`
-	LE   string   `yaml:"line_endings,omitempty"`
-	Keys []string `yaml:"public_keys,omitempty"`
+	Port     int                      `yaml:"port,omitempty"`
+	Bind     []string                 `yaml:"bind,omitempty"`
+	Unix     bool                     `yaml:"unix_socket,omitempty"`
+	LE       string                   `yaml:"line_endings,omitempty"`
+	PasteLE  string                   `yaml:"paste_line_endings,omitempty"`
+	Encoding string                   `yaml:"encoding,omitempty"`
+	Peers    map[string]CLPPeerConfig `yaml:"peers,omitempty"`
+	Formats  []string                 `yaml:"formats,omitempty"`
+	MinVer   string                   `yaml:"min_client_version,omitempty"`
+	MaxVer   string                   `yaml:"max_client_version,omitempty"`
+	Keys     []string                 `yaml:"public_keys,omitempty"`
+	Perms    map[string][]string      `yaml:"permissions,omitempty"`
+	History  int                      `yaml:"history,omitempty"`
+	Sync     CLPSyncConfig            `yaml:"sync,omitempty"`
+	TLS      CLPTLSConfig             `yaml:"tls,omitempty"`
+}
+
+// PipeConfig wraps creation parameters of gui.pipe_name named pipe. MaxInstances is number of clients served at once
+// (0 - no limit), buffer sizes are in bytes (0 - system default), Impersonation is minimal impersonation level client
+// has to grant ("anonymous" accepts any client).
+type PipeConfig struct {
+	MaxInstances  int    `yaml:"max_instances,omitempty"`
+	InBuffer      int    `yaml:"in_buffer,omitempty"`
+	OutBuffer     int    `yaml:"out_buffer,omitempty"`
+	Impersonation string `yaml:"impersonation,omitempty"`
+}
+
+// HVConfig wraps configuration values for Hyper-V sockets exposed to guest VMs.
+type HVConfig struct {
+	SSHPort   int    `yaml:"ssh_port,omitempty"`
+	ExtraPort int    `yaml:"extra_port,omitempty"`
+	VMID      string `yaml:"vm_id,omitempty"`
+}
+
+// NoiseConfig wraps configuration values for Noise protocol encrypted remote transport.
+type NoiseConfig struct {
+	Port  int      `yaml:"port,omitempty"`
+	Bind  []string `yaml:"bind,omitempty"`
+	Agent string   `yaml:"agent,omitempty"`
+	Key   string   `yaml:"private_key,omitempty"`
+	Keys  []string `yaml:"public_keys,omitempty"`
+}
+
+// WSConfig wraps configuration values for WebSocket bridge to ssh-agent.
+type WSConfig struct {
+	Port    int      `yaml:"port,omitempty"`
+	Origins []string `yaml:"origins,omitempty"`
+	Token   string   `yaml:"token,omitempty"`
+}
+
+// TrayConfig wraps configuration values for tray icon appearance. Instances overrides values for named instances.
+type TrayConfig struct {
+	Icon      string                `yaml:"icon,omitempty"`
+	Title     string                `yaml:"title,omitempty"`
+	Tooltip   string                `yaml:"tooltip,omitempty"`
+	Instances map[string]TrayConfig `yaml:"instances,omitempty"`
+}
+
+// Control API scopes, main token has all of them.
+const (
+	// ScopeReadStatus allows reading status and keys
+	ScopeReadStatus = "read-status"
+	// ScopeClearCache allows clearing gpg-agent passphrase cache
+	ScopeClearCache = "clear-cache"
+	// ScopeManageKeys allows setting and forgetting loopback passphrases
+	ScopeManageKeys = "manage-keys"
+	// ScopeControl allows restart, stop, reload and switching modes
+	ScopeControl = "control"
+)
+
+// ControlScopes lists all control API scopes.
+var ControlScopes = []string{ScopeReadStatus, ScopeClearCache, ScopeManageKeys, ScopeControl}
+
+// CtlTokenConfig is additional control API token limited to listed scopes.
+type CtlTokenConfig struct {
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// CtlConfig wraps configuration values for localhost control API. Tokens are additional tokens by name.
+type CtlConfig struct {
+	Port   int                       `yaml:"port,omitempty"`
+	Token  string                    `yaml:"token,omitempty"`
+	Tokens map[string]CtlTokenConfig `yaml:"tokens,omitempty"`
+	Cert   string                    `yaml:"tls_cert,omitempty"`
+	Key    string                    `yaml:"tls_key,omitempty"`
+}
+
+// NotifyRuleConfig selects notification backends for event class.
+type NotifyRuleConfig struct {
+	Backends     []string `yaml:"backends,omitempty"`
+	OutsideHours bool     `yaml:"outside_working_hours,omitempty"`
+}
+
+// NotifyConfig wraps configuration values for notifications.
+type NotifyConfig struct {
+	Webhook      string                        `yaml:"webhook,omitempty"`
+	WorkingHours string                        `yaml:"working_hours,omitempty"`
+	WorkingDays  []string                      `yaml:"working_days,omitempty"`
+	Events       map[string][]NotifyRuleConfig `yaml:"events,omitempty"`
+	FocusAssist  bool                          `yaml:"focus_assist,omitempty"`
+	Critical     []string                      `yaml:"critical,omitempty"`
+}
+
+// AuditConfig wraps configuration values for security events export to syslog collector.
+type AuditConfig struct {
+	Address string   `yaml:"address,omitempty"`
+	TLS     bool     `yaml:"tls,omitempty"`
+	CA      string   `yaml:"ca_file,omitempty"`
+	Format  string   `yaml:"format,omitempty"`
+	Events  []string `yaml:"events,omitempty"`
+}
+
+// HookConfig wraps configuration values for command run on events. Command is program with its arguments, event
+// details are passed to it in WGA_* environment variables.
+type HookConfig struct {
+	Events  []string      `yaml:"events,omitempty"`
+	Command []string      `yaml:"command,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// TracingConfig wraps configuration values for OpenTelemetry traces export. Endpoint is OTLP/HTTP traces URL.
+type TracingConfig struct {
+	Endpoint string            `yaml:"endpoint,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Service  string            `yaml:"service_name,omitempty"`
+}
+
+// SSPIConfig wraps configuration values for Negotiate (Kerberos/NTLM) authentication of remote clients.
+type SSPIConfig struct {
+	Enabled    bool     `yaml:"enabled,omitempty"`
+	Principals []string `yaml:"principals,omitempty"`
+}
+
+// ClientsConfig restricts which local processes could use agent. Allow lists executable base names or full path
+// patterns (case insensitive, filepath.Match syntax), Publishers lists acceptable Authenticode signers.
+type ClientsConfig struct {
+	Allow        []string `yaml:"allow,omitempty"`
+	Publishers   []string `yaml:"publishers,omitempty"`
+	AllowUnknown bool     `yaml:"allow_unknown,omitempty"`
+}
+
+// PolicyRuleConfig describes single policy rule. All specified conditions must match for rule to apply.
+type PolicyRuleConfig struct {
+	Name       string   `yaml:"name,omitempty"`
+	Connectors []string `yaml:"connectors,omitempty"`
+	Processes  []string `yaml:"processes,omitempty"`
+	Publishers []string `yaml:"publishers,omitempty"`
+	Keys       []string `yaml:"keys,omitempty"`
+	Hours      string   `yaml:"hours,omitempty"`
+	Days       []string `yaml:"days,omitempty"`
+	Action     string   `yaml:"action,omitempty"`
+}
+
+// ForwardingConfig wraps configuration values of agent forwarding guard. Action is taken for ssh signatures requested
+// over forwarded agent connections: "warn" (default), "allow", "confirm" or "deny". Burst forwarded signatures within
+// Window are reported as suspicious regardless of action.
+type ForwardingConfig struct {
+	Action string        `yaml:"action,omitempty"`
+	Burst  int           `yaml:"burst,omitempty"`
+	Window time.Duration `yaml:"window,omitempty"`
+}
+
+// QuietHoursConfig describes time range (may cross midnight) and week days (all by default) during which key operations
+// require confirmation or are denied, Action is "confirm" (default) or "deny".
+type QuietHoursConfig struct {
+	Hours  string   `yaml:"hours,omitempty"`
+	Days   []string `yaml:"days,omitempty"`
+	Action string   `yaml:"action,omitempty"`
+}
+
+// QuotaConfig limits number of operations with listed keys (every key if none listed) per clock hour and per day, 0
+// means no limit. Action is "deny" (default) or "warn" when quota is exceeded.
+type QuotaConfig struct {
+	Keys   []string `yaml:"keys,omitempty"`
+	Hourly int      `yaml:"hourly,omitempty"`
+	Daily  int      `yaml:"daily,omitempty"`
+	Action string   `yaml:"action,omitempty"`
+}
+
+// PolicyConfig wraps configuration values for access policy.
+type PolicyConfig struct {
+	Default           string             `yaml:"default,omitempty"`
+	ConfirmFirstUse   bool               `yaml:"confirm_first_use,omitempty"`
+	DenyRemoteDecrypt bool               `yaml:"deny_remote_decrypt,omitempty"`
+	ConfirmWith       string             `yaml:"confirm_with,omitempty"`
+	Remember          bool               `yaml:"remember,omitempty"`
+	Forwarding        ForwardingConfig   `yaml:"forwarding,omitempty"`
+	QuietHours        []QuietHoursConfig `yaml:"quiet_hours,omitempty"`
+	Quotas            []QuotaConfig      `yaml:"quotas,omitempty"`
+	Rules             []PolicyRuleConfig `yaml:"rules,omitempty"`
+}
+
+// PinentryConfig wraps configuration values for selecting pinentry program. Callers maps value of PINENTRY_USER_DATA
+// environment variable gpg client passes through gpg-agent to chain used for it. TTY selects when passphrases are
+// asked on terminal of the client instead of desktop: "auto", "always" or "never".
+type PinentryConfig struct {
+	Chain   []string            `yaml:"chain,omitempty"`
+	Callers map[string][]string `yaml:"callers,omitempty"`
+	TTY     string              `yaml:"tty,omitempty"`
 }
 
+// LoopbackConfig wraps configuration values for loopback bridging: gpg-agent gets passphrases for listed keygrips from
+// agent-gui instead of pinentry, so keys could be used unattended. Passphrases are set over control API or, with
+// Credentials, read from Credential Manager. TTL limits how long passphrase set over control API is kept.
+type LoopbackConfig struct {
+	Keys        []string      `yaml:"keys,omitempty"`
+	Credentials bool          `yaml:"credential_manager,omitempty"`
+	TTL         time.Duration `yaml:"ttl,omitempty"`
+}
+
+// BatchConfig wraps configuration values for batch signing mode tuned for bursts of sign requests. Mode is turned on
+// from tray menu, control API or on start with Enabled. CacheTTL is passed to gpg-agent (restarting it) for passphrase
+// cache, Connections limits number of idle gpg-agent connections kept for reuse per connector and Duration turns mode
+// off automatically.
+type BatchConfig struct {
+	Enabled     bool          `yaml:"enabled,omitempty"`
+	CacheTTL    time.Duration `yaml:"cache_ttl,omitempty"`
+	Connections int           `yaml:"connections,omitempty"`
+	Duration    time.Duration `yaml:"duration,omitempty"`
+}
+
+// UnlockConfig wraps configuration values for unlock window mode: when Enabled every key operation is denied unless
+// window opened from tray menu, Hotkey (like "Ctrl+Alt+U") or control API is open. Duration is window length.
+type UnlockConfig struct {
+	Enabled  bool          `yaml:"enabled,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+	Hotkey   string        `yaml:"hotkey,omitempty"`
+}
+
+// BackupConfig wraps configuration values for keyring backup reminder. Every Interval (0 - never) user is reminded to
+// back up public keyring and ownertrust of GnuPG home or, with Auto, snapshot is written to Directory without asking.
+// Keep is number of snapshots kept in Directory (0 - all).
+type BackupConfig struct {
+	Interval  time.Duration `yaml:"interval,omitempty"`
+	Directory string        `yaml:"directory,omitempty"`
+	Auto      bool          `yaml:"auto,omitempty"`
+	Keep      int           `yaml:"keep,omitempty"`
+}
+
+// KeyExpiryConfig wraps configuration values for key expiry monitoring. Every Interval (0 - never) own signing and ssh
+// keys are checked and user is warned about the ones expiring in less than Days days.
+type KeyExpiryConfig struct {
+	Interval time.Duration `yaml:"check_interval,omitempty"`
+	Days     int           `yaml:"warn_days,omitempty"`
+}
+
+// PoolConfig wraps configuration values for pooling of gpg-agent connections. Size is number of idle authenticated
+// connections kept ready per connector (0 - connections are only kept in batch mode), Max limits connections open to
+// gpg-agent at once with clients waiting in order of arrival (0 - no limit), Health is interval of idle connection
+// checks.
+type PoolConfig struct {
+	Size   int           `yaml:"size,omitempty"`
+	Max    int           `yaml:"max,omitempty"`
+	Health time.Duration `yaml:"health_check,omitempty"`
+}
+
+// LimitConfig wraps concurrency limit of connector, GUIConfig.Limits are keyed by connector name ("*" applies to
+// connectors not listed). Max is number of clients served at once (0 - no limit), clients over
+// the limit wait in order of arrival for up to Wait before connection is dropped.
+type LimitConfig struct {
+	Max  int           `yaml:"max,omitempty"`
+	Wait time.Duration `yaml:"wait,omitempty"`
+}
+
+// Ways to deal with Windows OpenSSH ssh-agent service, see GUIConfig.OpenSSHService.
+const (
+	// ServiceAsk offers to stop service when it owns the pipe
+	ServiceAsk = "ask"
+	// ServiceTakeover stops and disables service and serves its pipe
+	ServiceTakeover = "takeover"
+	// ServiceDelegate leaves pipe to service and sends ssh requests to it
+	ServiceDelegate = "delegate"
+)
+
 // GUIConfig wraps configuration values for agent-gui, pinentry and sorelay.
 type GUIConfig struct {
-	Debug             bool            `yaml:"debug,omitempty"`
-	SetEnv            bool            `yaml:"setenv,omitempty"`
-	IgnoreSessionLock bool            `yaml:"ignore_session_lock,omitempty"`
-	SSH               string          `yaml:"openssh,omitempty"`
-	PipeName          string          `yaml:"pipe_name,omitempty"`
-	ExtraPort         int             `yaml:"extra_port,omitempty"`
-	Home              string          `yaml:"homedir,omitempty"`
-	Deadline          time.Duration   `yaml:"deadline,omitempty"`
-	XAgentCookieSize  int             `yaml:"xagent_cookie_size,omitempty"`
-	PinDlg            util.DlgDetails `yaml:"pin_dialog,omitempty"`
-	Clp               CLPConfig       `yaml:"gclpr,omitempty"`
+	Debug             bool                   `yaml:"debug,omitempty"`
+	Headless          bool                   `yaml:"headless,omitempty"`
+	LogFile           string                 `yaml:"log_file,omitempty"`
+	UpdateCheck       time.Duration          `yaml:"update_check,omitempty"`
+	SetEnv            bool                   `yaml:"setenv,omitempty"`
+	WSLEnv            map[string]string      `yaml:"wslenv,omitempty"`
+	IgnoreSessionLock bool                   `yaml:"ignore_session_lock,omitempty"`
+	ScreensaverLock   bool                   `yaml:"screensaver_lock,omitempty"`
+	SSH               string                 `yaml:"openssh,omitempty"`
+	OpenSSHService    string                 `yaml:"openssh_service,omitempty"`
+	CygwinDialect     string                 `yaml:"cygwin_dialect,omitempty"`
+	CygwinNonceTTL    time.Duration          `yaml:"cygwin_nonce_ttl,omitempty"`
+	PipeName          string                 `yaml:"pipe_name,omitempty"`
+	Pipe              PipeConfig             `yaml:"pipe,omitempty"`
+	ExtraPort         int                    `yaml:"extra_port,omitempty"`
+	ExtraBind         []string               `yaml:"extra_bind,omitempty"`
+	ExtraSSPI         SSPIConfig             `yaml:"extra_sspi,omitempty"`
+	Home              string                 `yaml:"homedir,omitempty"`
+	Deadline          time.Duration          `yaml:"deadline,omitempty"`
+	XAgentCookieSize  int                    `yaml:"xagent_cookie_size,omitempty"`
+	PinDlg            util.DlgDetails        `yaml:"pin_dialog,omitempty"`
+	Tray              TrayConfig             `yaml:"tray,omitempty"`
+	Pinentry          PinentryConfig         `yaml:"pinentry,omitempty"`
+	Clp               CLPConfig              `yaml:"gclpr,omitempty"`
+	Dirmngr           DirmngrConfig          `yaml:"dirmngr,omitempty"`
+	Proxy             ProxyConfig            `yaml:"proxy,omitempty"`
+	HyperV            HVConfig               `yaml:"hyperv,omitempty"`
+	Noise             NoiseConfig            `yaml:"noise,omitempty"`
+	WebSocket         WSConfig               `yaml:"websocket,omitempty"`
+	Control           CtlConfig              `yaml:"control,omitempty"`
+	Notify            NotifyConfig           `yaml:"notifications,omitempty"`
+	Audit             AuditConfig            `yaml:"audit,omitempty"`
+	Hooks             []HookConfig           `yaml:"hooks,omitempty"`
+	Tracing           TracingConfig          `yaml:"tracing,omitempty"`
+	Clients           ClientsConfig          `yaml:"clients,omitempty"`
+	Policy            PolicyConfig           `yaml:"policy,omitempty"`
+	Loopback          LoopbackConfig         `yaml:"loopback,omitempty"`
+	Batch             BatchConfig            `yaml:"batch,omitempty"`
+	Pool              PoolConfig             `yaml:"pool,omitempty"`
+	Limits            map[string]LimitConfig `yaml:"limits,omitempty"`
+	Unlock            UnlockConfig           `yaml:"unlock_window,omitempty"`
+	Backup            BackupConfig           `yaml:"backup,omitempty"`
+	KeyExpiry         KeyExpiryConfig        `yaml:"key_expiry,omitempty"`
+	Sockets           string                 `yaml:"-"`
+	Instance          string                 `yaml:"-"`
+	FakeAgent         bool                   `yaml:"-"`
 }
 
 var defaultGUIConfig = `
@@ -57,13 +436,44 @@ gui:
   debug: false
   setenv: true
   openssh: windows
+  openssh_service: ask
+  cygwin_dialect: auto
+  cygwin_nonce_ttl: 1h
   ignore_session_lock: false
+  screensaver_lock: false
   deadline: 1m
   xagent_cookie_size: 16
   pipe_name: %s
+  pipe:
+    max_instances: 64
+    in_buffer: 65536
+    out_buffer: 65536
+    impersonation: identification
   homedir: "${LOCALAPPDATA}\\gnupg\\%s"
   gclpr:
     port: 2850
+    tls:
+      store: My
+      ca_store: Root
+  proxy:
+    default: system
+  noise:
+    agent: extra
+  tracing:
+    service_name: win-gpg-agent
+  notifications:
+    focus_assist: true
+    critical: [tamper_detected, agent_forwarded, competing_agent]
+  audit:
+    format: cef
+    events: [key_used, client_denied, tamper_detected]
+  unlock_window:
+    duration: 15m
+  backup:
+    keep: 10
+  key_expiry:
+    check_interval: 12h
+    warn_days: 30
   pin_dialog:
     delay: 300ms
     name: Windows Security
@@ -76,13 +486,22 @@ type Config struct {
 	GPG GPGConfig
 }
 
+// Defaults returns YAML text of default configuration for named instance, suitable as initial configuration file.
+func Defaults(instance string) string {
+	return fmt.Sprintf(defaultGUIConfig, util.InstanceName(util.SSHAgentPipeName, instance), util.InstanceName(util.WinAgentName, instance)) + defaultGPGConfig
+}
+
 // Load prepares configuration structures using all available sources.
 func Load(fnames ...string) (*Config, error) {
+	return LoadInstance("", fnames...)
+}
+
+// LoadInstance prepares configuration for named instance - default pipe name and home directory are derived from it.
+func LoadInstance(instance string, fnames ...string) (*Config, error) {
 
 	configSources := []ucfg.YAMLOption{
 		ucfg.Expand(os.LookupEnv),
-		ucfg.Source(strings.NewReader(fmt.Sprintf(defaultGUIConfig, util.SSHAgentPipeName, util.WinAgentName))),
-		ucfg.Source(strings.NewReader(defaultGPGConfig)),
+		ucfg.Source(strings.NewReader(Defaults(instance))),
 	}
 	for _, fname := range fnames {
 		if len(fname) != 0 && util.FileExists(fname) {
@@ -102,6 +521,19 @@ func Load(fnames ...string) (*Config, error) {
 		return nil, err
 	}
 
+	cfg.GUI.Instance = instance
+
+	// long path prefix is not understood by gpg-agent and WSL path translation
+	cfg.GPG.Path = util.CleanPath(cfg.GPG.Path)
+	cfg.GPG.Home = util.CleanPath(cfg.GPG.Home)
+	cfg.GPG.Sockets = util.CleanPath(cfg.GPG.Sockets)
+	cfg.GUI.Home = util.CleanPath(cfg.GUI.Home)
+	cfg.GUI.Sockets = util.SocketDir(cfg.GUI.Home)
+	if len(cfg.GUI.Backup.Directory) == 0 {
+		cfg.GUI.Backup.Directory = filepath.Join(cfg.GUI.Home, "backups")
+	}
+	cfg.GUI.Backup.Directory = util.CleanPath(cfg.GUI.Backup.Directory)
+
 	if cfg.GUI.XAgentCookieSize < 0 {
 		cfg.GUI.XAgentCookieSize = 0
 	}
@@ -109,8 +541,104 @@ func Load(fnames ...string) (*Config, error) {
 		cfg.GUI.XAgentCookieSize = 32
 	}
 
-	if filepath.Clean(cfg.GPG.Sockets) == filepath.Clean(cfg.GUI.Home) {
-		return nil, fmt.Errorf("potential conflict as gpg.socketdir=[%s] and gui.homedir=[%s] are pointing to the same location", filepath.Clean(cfg.GPG.Sockets), filepath.Clean(cfg.GUI.Home))
+	switch strings.ToLower(cfg.GUI.CygwinDialect) {
+	case util.DialectAuto, util.DialectCygwin, util.DialectMSYS2:
+	default:
+		return nil, fmt.Errorf("unsupported gui.cygwin_dialect=[%s], should be \"auto\", \"cygwin\" or \"msys2\"", cfg.GUI.CygwinDialect)
+	}
+	if cfg.GUI.Pipe.MaxInstances < 0 {
+		return nil, fmt.Errorf("gui.pipe.max_instances=[%d] should not be negative", cfg.GUI.Pipe.MaxInstances)
+	}
+	for _, b := range []struct {
+		name string
+		size int
+	}{{"in_buffer", cfg.GUI.Pipe.InBuffer}, {"out_buffer", cfg.GUI.Pipe.OutBuffer}} {
+		if b.size < 0 || b.size > 1<<24 {
+			return nil, fmt.Errorf("gui.pipe.%s=[%d] should be between 0 (system default) and 16777216", b.name, b.size)
+		}
+	}
+	switch strings.ToLower(cfg.GUI.Pipe.Impersonation) {
+	case "anonymous", "identification", "impersonation":
+	default:
+		return nil, fmt.Errorf("unsupported gui.pipe.impersonation=[%s], should be \"anonymous\", \"identification\" or \"impersonation\"", cfg.GUI.Pipe.Impersonation)
+	}
+	if cfg.GUI.CygwinNonceTTL != 0 && cfg.GUI.CygwinNonceTTL < time.Minute {
+		return nil, fmt.Errorf("gui.cygwin_nonce_ttl=[%s] is too short, should be 0 (never replace) or at least 1m", cfg.GUI.CygwinNonceTTL)
+	}
+
+	switch strings.ToLower(cfg.GUI.OpenSSHService) {
+	case ServiceAsk, ServiceTakeover, ServiceDelegate:
+	default:
+		return nil, fmt.Errorf("unsupported gui.openssh_service=[%s], should be \"ask\", \"takeover\" or \"delegate\"", cfg.GUI.OpenSSHService)
+	}
+
+	if cfg.GUI.Noise.Agent != "extra" && cfg.GUI.Noise.Agent != "ssh" {
+		return nil, fmt.Errorf("unsupported gui.noise.agent=[%s], should be either \"extra\" or \"ssh\"", cfg.GUI.Noise.Agent)
+	}
+
+	for name, flags := range cfg.GUI.WSLEnv {
+		if flags == "-" {
+			flags = ""
+		}
+		if err := util.CheckWSLENV(name, flags); err != nil {
+			return nil, fmt.Errorf("gui.wslenv: %w", err)
+		}
+	}
+
+	if ep := cfg.GUI.Tracing.Endpoint; len(ep) > 0 {
+		if u, err := url.Parse(ep); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("gui.tracing.endpoint: \"%s\" is not http(s) URL", ep)
+		}
+	}
+
+	for name, t := range cfg.GUI.Control.Tokens {
+		if len(t.Token) < 16 {
+			return nil, fmt.Errorf("gui.control.tokens.%s: token has to be at least 16 characters long", name)
+		}
+		if t.Token == cfg.GUI.Control.Token {
+			return nil, fmt.Errorf("gui.control.tokens.%s: token is the same as gui.control.token", name)
+		}
+		for _, scope := range t.Scopes {
+			known := false
+			for _, s := range ControlScopes {
+				known = known || s == scope
+			}
+			if !known {
+				return nil, fmt.Errorf("gui.control.tokens.%s: unknown scope \"%s\", should be one of \"%s\"", name, scope, strings.Join(ControlScopes, "\", \""))
+			}
+		}
+	}
+
+	for i, h := range cfg.GUI.Hooks {
+		if len(h.Events) == 0 || len(h.Command) == 0 || len(h.Command[0]) == 0 {
+			return nil, fmt.Errorf("gui.hooks #%d: both events and command are required", i+1)
+		}
+		if h.Timeout < 0 {
+			return nil, fmt.Errorf("gui.hooks #%d: timeout=[%s] should not be negative", i+1, h.Timeout)
+		}
+	}
+
+	if len(cfg.GUI.Unlock.Hotkey) > 0 {
+		if _, _, err := util.ParseHotkey(cfg.GUI.Unlock.Hotkey); err != nil {
+			return nil, fmt.Errorf("gui.unlock_window.hotkey: %w", err)
+		}
+	}
+
+	if cfg.GUI.Backup.Interval < 0 || cfg.GUI.Backup.Keep < 0 {
+		return nil, fmt.Errorf("gui.backup: interval=[%s] and keep=[%d] should not be negative", cfg.GUI.Backup.Interval, cfg.GUI.Backup.Keep)
+	}
+
+	if cfg.GUI.KeyExpiry.Interval < 0 || cfg.GUI.KeyExpiry.Days < 0 {
+		return nil, fmt.Errorf("gui.key_expiry: check_interval=[%s] and warn_days=[%d] should not be negative", cfg.GUI.KeyExpiry.Interval, cfg.GUI.KeyExpiry.Days)
+	}
+
+	if cfg.GPG.Network.Retries < 0 || cfg.GPG.Network.RetryDelay < 0 || cfg.GPG.Network.CheckInterval < 0 {
+		return nil, fmt.Errorf("gpg.network_home: retries=[%d], retry_delay=[%s] and check_interval=[%s] should not be negative",
+			cfg.GPG.Network.Retries, cfg.GPG.Network.RetryDelay, cfg.GPG.Network.CheckInterval)
+	}
+
+	if strings.EqualFold(cfg.GPG.Sockets, cfg.GUI.Home) {
+		return nil, fmt.Errorf("potential conflict as gpg.socketdir=[%s] and gui.homedir=[%s] are pointing to the same location", cfg.GPG.Sockets, cfg.GUI.Home)
 	}
 
 	return &cfg, nil
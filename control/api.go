@@ -0,0 +1,56 @@
+package control
+
+import (
+	"net/http"
+
+	"github.com/rupor-github/win-gpg-agent/config"
+)
+
+// Control API paths. Requests carry "Authorization: Bearer <token>" header, errors are returned as plain text with
+// HTTP status >= 400, results as JSON. API is versioned by path prefix, calls are never changed incompatibly.
+const (
+	PathStatus         = "/v1/status"
+	PathKeys           = "/v1/keys"
+	PathWatch          = "/v1/watch"
+	PathCacheClear     = "/v1/cache/clear"
+	PathAgentRestart   = "/v1/agent/restart"
+	PathStop           = "/v1/stop"
+	PathReload         = "/v1/reload"
+	PathPolicyReload   = "/v1/policy/reload"
+	PathLoopbackSet    = "/v1/loopback/set"
+	PathLoopbackForget = "/v1/loopback/forget"
+	PathBatchStart     = "/v1/batch/start"
+	PathBatchStop      = "/v1/batch/stop"
+	PathUnlockOpen     = "/v1/unlock/open"
+	PathUnlockClose    = "/v1/unlock/close"
+)
+
+// Endpoint describes single control API call.
+type Endpoint struct {
+	Method string
+	Path   string
+	// Scope token must have to make this call
+	Scope string
+	Doc   string
+	// Cmdlet is the name of PowerShell function generated for the call, calls which need parameters or stream
+	// results have none
+	Cmdlet string
+}
+
+// Endpoints is the complete control API, it is what PowerShell module is generated from.
+var Endpoints = []Endpoint{
+	{http.MethodGet, PathStatus, config.ScopeReadStatus, "Returns status of running instance.", "Get-WgaStatus"},
+	{http.MethodGet, PathKeys, config.ScopeReadStatus, "Returns keys known to gpg-agent.", "Get-WgaKey"},
+	{http.MethodGet, PathWatch, config.ScopeReadStatus, "Streams NDJSON with state snapshots and events.", ""},
+	{http.MethodPost, PathCacheClear, config.ScopeClearCache, "Clears gpg-agent passphrase cache.", "Clear-WgaCache"},
+	{http.MethodPost, PathAgentRestart, config.ScopeControl, "Restarts gpg-agent.", "Restart-WgaAgent"},
+	{http.MethodPost, PathStop, config.ScopeControl, "Shuts down running instance.", "Stop-WgaInstance"},
+	{http.MethodPost, PathReload, config.ScopeControl, "Restarts running instance with freshly read configuration.", "Restart-WgaInstance"},
+	{http.MethodPost, PathPolicyReload, config.ScopeControl, "Re-reads access policy from configuration.", "Update-WgaPolicy"},
+	{http.MethodPost, PathLoopbackSet, config.ScopeManageKeys, "Sets passphrase (request body) for ?keygrip= whitelisted for loopback bridging.", ""},
+	{http.MethodPost, PathLoopbackForget, config.ScopeManageKeys, "Forgets passphrase for ?keygrip= or all passphrases.", ""},
+	{http.MethodPost, PathBatchStart, config.ScopeControl, "Turns batch signing mode on.", "Start-WgaBatch"},
+	{http.MethodPost, PathBatchStop, config.ScopeControl, "Turns batch signing mode off.", "Stop-WgaBatch"},
+	{http.MethodPost, PathUnlockOpen, config.ScopeControl, "Allows key operations for ?duration= (configured one if omitted).", ""},
+	{http.MethodPost, PathUnlockClose, config.ScopeControl, "Denies key operations again.", "Close-WgaUnlockWindow"},
+}
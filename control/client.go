@@ -0,0 +1,226 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+)
+
+// Client talks to running instance over control named pipe.
+type Client struct {
+	hc    *http.Client
+	token string
+}
+
+// NewClient prepares client for instance listening on pipe, token is read from home directory unless specified.
+func NewClient(pipe, home, token string) (*Client, error) {
+	token, err := Token(home, token)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 5 * time.Second
+	return &Client{
+		hc: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return winio.DialPipeContext(ctx, pipe)
+				},
+				ResponseHeaderTimeout: time.Minute,
+				IdleConnTimeout:       timeout,
+			},
+		},
+		token: token,
+	}, nil
+}
+
+func (c *Client) do(method, path string, v interface{}) error {
+	return c.send(method, path, nil, v)
+}
+
+func (c *Client) send(method, path string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, "http://agent-gui"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to contact running instance: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Status requests status of running instance.
+func (c *Client) Status() (*Status, error) {
+	st := &Status{}
+	if err := c.do(http.MethodGet, PathStatus, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Keys requests list of keys known to gpg-agent.
+func (c *Client) Keys() ([]agent.KeyInfo, error) {
+	var keys []agent.KeyInfo
+	if err := c.do(http.MethodGet, PathKeys, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ClearCache asks running instance to clear gpg-agent passphrase cache.
+func (c *Client) ClearCache() error {
+	return c.do(http.MethodPost, PathCacheClear, nil)
+}
+
+// Restart asks running instance to restart gpg-agent.
+func (c *Client) Restart() error {
+	return c.do(http.MethodPost, PathAgentRestart, nil)
+}
+
+// Stop asks running instance to shut down gracefully.
+func (c *Client) Stop() error {
+	return c.do(http.MethodPost, PathStop, nil)
+}
+
+// Reload asks running instance to restart itself with freshly read configuration.
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, PathReload, nil)
+}
+
+// ReloadPolicy asks running instance to re-read access policy from configuration without restarting.
+func (c *Client) ReloadPolicy() error {
+	return c.do(http.MethodPost, PathPolicyReload, nil)
+}
+
+// SetPassphrase gives running instance passphrase for key whitelisted for loopback bridging.
+func (c *Client) SetPassphrase(keygrip string, pass []byte) error {
+	return c.send(http.MethodPost, PathLoopbackSet+"?keygrip="+url.QueryEscape(keygrip), bytes.NewReader(pass), nil)
+}
+
+// ForgetPassphrase asks running instance to drop passphrase for key or all passphrases when keygrip is empty.
+func (c *Client) ForgetPassphrase(keygrip string) error {
+	return c.do(http.MethodPost, PathLoopbackForget+"?keygrip="+url.QueryEscape(keygrip), nil)
+}
+
+// StartBatch asks running instance to turn batch signing mode on.
+func (c *Client) StartBatch() error {
+	return c.do(http.MethodPost, PathBatchStart, nil)
+}
+
+// StopBatch asks running instance to turn batch signing mode off.
+func (c *Client) StopBatch() error {
+	return c.do(http.MethodPost, PathBatchStop, nil)
+}
+
+// OpenUnlockWindow asks running instance to allow key operations for d (configured duration if d is 0).
+func (c *Client) OpenUnlockWindow(d time.Duration) error {
+	path := PathUnlockOpen
+	if d > 0 {
+		path += "?duration=" + url.QueryEscape(d.String())
+	}
+	return c.do(http.MethodPost, path, nil)
+}
+
+// CloseUnlockWindow asks running instance to deny key operations again.
+func (c *Client) CloseUnlockWindow() error {
+	return c.do(http.MethodPost, PathUnlockClose, nil)
+}
+
+// Watch streams events and state changes of running instance calling f with every NDJSON line, until f returns error,
+// ctx is canceled or instance goes away.
+func (c *Client) Watch(ctx context.Context, f func(line []byte) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://agent-gui"+PathWatch, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	// stream is endless, so no overall timeout here
+	hc := &http.Client{Transport: c.hc.Transport}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to contact running instance: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if err := f(sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("watch stream is broken: %w", err)
+	}
+	return nil
+}
+
+// String formats status in human readable form.
+func (st *Status) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "agent-gui %s (pid %d)\n", st.Version, st.PID)
+	fmt.Fprintf(&buf, "gpg-agent %s (pid %d)\n", st.GnuPG, st.AgentPID)
+	fmt.Fprintf(&buf, "session locked: %t\n", st.Locked)
+	fmt.Fprintf(&buf, "keys: %d\n", st.Keys)
+	if st.Sockets != st.Home {
+		fmt.Fprintf(&buf, "sockets: %s (relocated from %s)\n", st.Sockets, st.Home)
+	}
+	for _, e := range st.Endpoints {
+		fmt.Fprintf(&buf, "%s: %s\n", e.Name, e.Address)
+		if e.Stats != nil {
+			fmt.Fprintf(&buf, "    accepted %d, active %d, failed %d, gpg-agent errors %d, in %d bytes, out %d bytes\n",
+				e.Stats.Accepted, e.Stats.Active, e.Stats.Failed, e.Stats.AssuanErrors, e.Stats.BytesIn, e.Stats.BytesOut)
+			if len(e.Stats.Commands) > 0 {
+				fmt.Fprintf(&buf, "    commands: %s\n", e.Stats.CommandsString())
+			}
+			if len(e.Stats.LastError) > 0 {
+				fmt.Fprintf(&buf, "    last error at %s: %s\n", e.Stats.LastErrorTime.Format("15:04:05"), e.Stats.LastError)
+			}
+		}
+	}
+	if st.Batch != nil {
+		fmt.Fprintf(&buf, "batch signing: %s\n", st.Batch)
+	}
+	if st.Unlock != nil {
+		fmt.Fprintf(&buf, "unlock window: %s\n", st.Unlock)
+	}
+	for _, k := range st.Loopback {
+		source := k.Source
+		if len(source) == 0 {
+			source = "no passphrase"
+		}
+		if len(k.Expires) > 0 {
+			source += ", expires " + k.Expires
+		}
+		fmt.Fprintf(&buf, "loopback %s: %s\n", k.Keygrip, source)
+	}
+	if len(st.Gclpr) > 0 {
+		fmt.Fprintf(&buf, "%s\n", st.Gclpr)
+	}
+	return buf.String()
+}
@@ -0,0 +1,344 @@
+// Package control implements HTTP API (on named pipe and optionally on localhost HTTP(S) port) which allows command line
+// verbs, scripts and dashboards to query and control running agent-gui instance.
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+
+	"github.com/rupor-github/win-gpg-agent/agent"
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/config"
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// MaxPassphrase limits size of request body carrying passphrase for loopback bridging.
+const MaxPassphrase = 4096
+
+// TokenFileName is the name of the file in agent-gui home directory with API token, so local tools could find it.
+const TokenFileName = "control.token"
+
+// Status is a snapshot of running instance state.
+type Status struct {
+	Version   string              `json:"version"`
+	PID       int                 `json:"pid"`
+	GnuPG     string              `json:"gnupg_version"`
+	AgentPID  int                 `json:"gpg_agent_pid"`
+	Locked    bool                `json:"session_locked"`
+	Away      bool                `json:"session_disconnected,omitempty"`
+	Endpoints []agent.Endpoint    `json:"endpoints"`
+	Keys      int                 `json:"keys"`
+	Gclpr     string              `json:"gclpr,omitempty"`
+	Home      string              `json:"homedir"`
+	Sockets   string              `json:"socketdir"`
+	Loopback  []agent.LoopbackKey `json:"loopback,omitempty"`
+	Batch     *agent.BatchStats   `json:"batch,omitempty"`
+	Unlock    *agent.UnlockState  `json:"unlock_window,omitempty"`
+}
+
+// Types of watch stream lines.
+const (
+	WatchEventType = "event"
+	WatchStateType = "state"
+)
+
+// WatchEvent is a single line of /v1/watch NDJSON stream: either event (key used, client denied, agent restarted...)
+// or state snapshot, which is sent first and then every time agent state changes.
+type WatchEvent struct {
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	Event  string            `json:"event,omitempty"`
+	Title  string            `json:"title,omitempty"`
+	Text   string            `json:"message,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	State  *Status           `json:"state,omitempty"`
+}
+
+// Provider is implemented by the program which runs control API.
+type Provider interface {
+	Status() *Status
+	Keys() ([]agent.KeyInfo, error)
+	ClearCache() error
+	Restart() error
+	Stop() error
+	Reload() error
+	ReloadPolicy() error
+	SetPassphrase(keygrip string, pass []byte) error
+	ForgetPassphrase(keygrip string) error
+	SetBatch(on bool) error
+	OpenUnlockWindow(d time.Duration) error
+	CloseUnlockWindow() error
+	// Watch returns channel with events and state changes, it is closed when ctx is done.
+	Watch(ctx context.Context) <-chan *WatchEvent
+}
+
+// Options describes where and how API is served.
+type Options struct {
+	Pipe     string
+	Port     int
+	Token    string
+	Tokens   map[string]config.CtlTokenConfig
+	CertFile string
+	KeyFile  string
+}
+
+// Token returns configured token or reads/creates random one in home directory.
+func Token(home, token string) (string, error) {
+	if len(token) != 0 {
+		return token, nil
+	}
+	fname := filepath.Join(home, TokenFileName)
+	if data, err := os.ReadFile(fname); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate control token: %w", err)
+	}
+	token = hex.EncodeToString(buf)
+	if err := os.WriteFile(fname, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("unable to save control token: %w", err)
+	}
+	return token, nil
+}
+
+type server struct {
+	p      Provider
+	token  string
+	tokens map[string]config.CtlTokenConfig
+}
+
+// authorized finds token of request and checks its scopes. Name of the token is returned for logging.
+func (s *server) authorized(r *http.Request, scope string) (name string, known, allowed bool) {
+	token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare(token, []byte(s.token)) == 1 {
+		return "main", true, true
+	}
+	for n, t := range s.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t.Token)) != 1 {
+			continue
+		}
+		for _, sc := range t.Scopes {
+			if sc == scope {
+				return n, true, true
+			}
+		}
+		return n, true, false
+	}
+	return "", false, false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to encode control API response: %s", err)
+	}
+}
+
+func (s *server) handle(method, scope string, f func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, known, allowed := s.authorized(r, scope)
+		if !known {
+			log.Printf("Rejecting control API request from %s with bad token", r.RemoteAddr)
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		if !allowed {
+			log.Printf("Rejecting control API request %s from %s: token \"%s\" has no \"%s\" scope", r.URL.Path, r.RemoteAddr, name, scope)
+			http.Error(w, "token has no "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := f(w, r); err != nil {
+			msg := common.Explain(err)
+			log.Printf("Control API request %s failed: %s", r.URL.Path, msg)
+			http.Error(w, msg, http.StatusInternalServerError)
+		}
+	}
+}
+
+// Serve runs control API on named pipe and optionally on localhost TCP port until context is canceled.
+func Serve(ctx context.Context, opts *Options, p Provider) error {
+
+	s := &server{p: p, token: opts.Token, tokens: opts.Tokens}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathStatus, s.handle(http.MethodGet, config.ScopeReadStatus, func(w http.ResponseWriter, r *http.Request) error {
+		writeJSON(w, s.p.Status())
+		return nil
+	}))
+	mux.HandleFunc(PathKeys, s.handle(http.MethodGet, config.ScopeReadStatus, func(w http.ResponseWriter, r *http.Request) error {
+		keys, err := s.p.Keys()
+		if err != nil {
+			return err
+		}
+		writeJSON(w, keys)
+		return nil
+	}))
+	mux.HandleFunc(PathWatch, s.handle(http.MethodGet, config.ScopeReadStatus, func(w http.ResponseWriter, r *http.Request) error {
+		fl, ok := w.(http.Flusher)
+		if !ok {
+			return fmt.Errorf("streaming is not supported")
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for ev := range s.p.Watch(r.Context()) {
+			if err := enc.Encode(ev); err != nil {
+				// watcher went away, channel is closed with request context
+				continue
+			}
+			fl.Flush()
+		}
+		return nil
+	}))
+	mux.HandleFunc(PathCacheClear, s.handle(http.MethodPost, config.ScopeClearCache, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.ClearCache(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathAgentRestart, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.Restart(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+
+	mux.HandleFunc(PathStop, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.Stop(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathReload, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.Reload(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathPolicyReload, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.ReloadPolicy(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+
+	mux.HandleFunc(PathLoopbackSet, s.handle(http.MethodPost, config.ScopeManageKeys, func(w http.ResponseWriter, r *http.Request) error {
+		// raw body, so passphrase does not end up in Go strings
+		pass, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxPassphrase))
+		defer util.Wipe(pass)
+		if err != nil {
+			return fmt.Errorf("unable to read passphrase: %w", err)
+		}
+		if err := s.p.SetPassphrase(r.URL.Query().Get("keygrip"), pass); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathLoopbackForget, s.handle(http.MethodPost, config.ScopeManageKeys, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.ForgetPassphrase(r.URL.Query().Get("keygrip")); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+
+	mux.HandleFunc(PathBatchStart, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.SetBatch(true); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathBatchStop, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.SetBatch(false); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+
+	mux.HandleFunc(PathUnlockOpen, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		var d time.Duration
+		if v := r.URL.Query().Get("duration"); len(v) > 0 {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("bad duration: %w", err)
+			}
+		}
+		if err := s.p.OpenUnlockWindow(d); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+	mux.HandleFunc(PathUnlockClose, s.handle(http.MethodPost, config.ScopeControl, func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.p.CloseUnlockWindow(); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}))
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	// named pipe is always available to local tools running as the same user
+	pl, err := winio.ListenPipe(opts.Pipe, &winio.PipeConfig{SecurityDescriptor: "D:P(A;;GA;;;OW)"})
+	if err != nil {
+		return fmt.Errorf("unable to listen for control API on %s: %w", opts.Pipe, err)
+	}
+	go func() {
+		log.Printf("Serving control API on %s", opts.Pipe)
+		if err := srv.Serve(pl); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control API on %s returned error: %s", opts.Pipe, err)
+		}
+	}()
+
+	if opts.Port <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(opts.Port)))
+	if err != nil {
+		return fmt.Errorf("unable to listen for control API: %w", err)
+	}
+	log.Printf("Serving control API on %s", l.Addr())
+	if len(opts.CertFile) > 0 && len(opts.KeyFile) > 0 {
+		err = srv.ServeTLS(l, opts.CertFile, opts.KeyFile)
+	} else {
+		err = srv.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package control
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// PowerShellModuleName is the name of generated PowerShell module.
+const PowerShellModuleName = "WinGpgAgent"
+
+// PowerShell talks to control pipe directly with HTTP/1.0, so response is never chunked and connection is closed when
+// it is complete.
+var psModule = template.Must(template.New("psm1").Funcs(template.FuncMap{"quote": psQuote}).Parse(`# Generated by agent-gui {{.Version}}, regenerate with "agent-gui --powershell-module" instead of editing.
+
+$script:WgaPipe = {{quote .Pipe}}
+$script:WgaTokenFile = {{quote .TokenFile}}
+$script:CRLF = [string][char]13 + [char]10
+
+<#
+.SYNOPSIS
+Sends request to running agent-gui instance over its control pipe and returns parsed JSON result.
+#>
+function Invoke-WgaRequest {
+    [CmdletBinding()]
+    param(
+        [Parameter(Mandatory)][ValidateSet('GET', 'POST')][string]$Method,
+        [Parameter(Mandatory)][string]$Path,
+        [string]$Pipe = $script:WgaPipe,
+        [string]$Token,
+        [int]$TimeoutMs = 5000
+    )
+    if (-not $Token) {
+        $Token = (Get-Content -LiteralPath $script:WgaTokenFile -Raw -ErrorAction Stop).Trim()
+    }
+    $name = $Pipe -replace '^\\\\\.\\pipe\\', ''
+    $client = [System.IO.Pipes.NamedPipeClientStream]::new('.', $name, [System.IO.Pipes.PipeDirection]::InOut)
+    try {
+        $client.Connect($TimeoutMs)
+        $request = "$Method $Path HTTP/1.0${CRLF}Host: agent-gui${CRLF}Authorization: Bearer $Token${CRLF}Content-Length: 0${CRLF}${CRLF}"
+        $bytes = [System.Text.Encoding]::ASCII.GetBytes($request)
+        $client.Write($bytes, 0, $bytes.Length)
+        $client.Flush()
+        $response = [System.IO.StreamReader]::new($client, [System.Text.Encoding]::UTF8).ReadToEnd()
+    } finally {
+        $client.Dispose()
+    }
+    $head, $body = $response -split "${CRLF}${CRLF}", 2
+    $line = ($head -split $CRLF)[0]
+    if ($line -notmatch '^HTTP/\d\.\d (\d{3})') {
+        throw "Unexpected response from agent-gui: $line"
+    }
+    if ([int]$Matches[1] -ge 400) {
+        throw "agent-gui: $($line.Substring(9)): $("$body".Trim())"
+    }
+    if ("$body".Trim()) {
+        $body | ConvertFrom-Json
+    }
+}
+{{range .Cmdlets}}
+<#
+.SYNOPSIS
+{{.Doc}}
+.NOTES
+{{.Method}} {{.Path}}, token needs "{{.Scope}}" scope.
+#>
+function {{.Cmdlet}} {
+    [CmdletBinding({{if eq .Method "POST"}}SupportsShouldProcess{{end}})]
+    param(
+        [string]$Pipe = $script:WgaPipe,
+        [string]$Token
+    )
+{{- if eq .Method "POST"}}
+    if ($PSCmdlet.ShouldProcess($Pipe, {{quote .Doc}})) {
+        Invoke-WgaRequest -Method POST -Path {{quote .Path}} -Pipe $Pipe -Token $Token
+    }
+{{- else}}
+    Invoke-WgaRequest -Method {{.Method}} -Path {{quote .Path}} -Pipe $Pipe -Token $Token
+{{- end}}
+}
+{{end}}
+Export-ModuleMember -Function Invoke-WgaRequest{{range .Cmdlets}}, {{.Cmdlet}}{{end}}
+`))
+
+var psManifest = template.Must(template.New("psd1").Funcs(template.FuncMap{"quote": psQuote}).Parse(`# Generated by agent-gui {{.Version}}
+@{
+    RootModule        = '{{.Name}}.psm1'
+    ModuleVersion     = '{{.ModuleVersion}}'
+    GUID              = '5b0c3c36-4b7e-4f43-9a55-0b3f6a2d9e71'
+    Author            = 'win-gpg-agent'
+    Description       = 'Manage running agent-gui instance over its control pipe.'
+    PowerShellVersion = '5.1'
+    FunctionsToExport = @('Invoke-WgaRequest'{{range .Cmdlets}}, {{quote .Cmdlet}}{{end}})
+    CmdletsToExport   = @()
+    VariablesToExport = @()
+    AliasesToExport   = @()
+}
+`))
+
+// psQuote makes single quoted PowerShell string literal.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+var psVersion = regexp.MustCompile(`^\d+(\.\d+){1,3}`)
+
+// PowerShellModule generates PowerShell module (.psm1 and .psd1 contents) with a function for every control API call
+// which has Cmdlet name, functions talk to instance on pipe using token from tokenFile unless -Token is given.
+func PowerShellModule(pipe, tokenFile, version string) (psm1, psd1 []byte, err error) {
+	data := struct {
+		Name, Version, ModuleVersion string
+		Pipe, TokenFile              string
+		Cmdlets                      []Endpoint
+	}{Name: PowerShellModuleName, Version: version, ModuleVersion: "0.0.0", Pipe: pipe, TokenFile: tokenFile}
+	if v := psVersion.FindString(version); len(v) > 0 {
+		data.ModuleVersion = v
+	}
+	for _, e := range Endpoints {
+		if len(e.Cmdlet) > 0 {
+			data.Cmdlets = append(data.Cmdlets, e)
+		}
+	}
+	var m, d bytes.Buffer
+	if err := psModule.Execute(&m, &data); err != nil {
+		return nil, nil, err
+	}
+	if err := psManifest.Execute(&d, &data); err != nil {
+		return nil, nil, err
+	}
+	return m.Bytes(), d.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package gclpr
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"golang.org/x/crypto/nacl/sign"
+)
+
+// secWriter signs every rpc frame it sends the same way gclpr client does, so remote gclpr server could authenticate us.
+type secWriter struct {
+	conn  net.Conn
+	hpk   [32]byte
+	key   *[64]byte
+	magic []byte
+}
+
+func (sw *secWriter) Read(p []byte) (n int, err error) {
+	return sw.conn.Read(p)
+}
+
+func (sw *secWriter) Write(p []byte) (n int, err error) {
+	out := make([]byte, 0, len(sw.magic)+len(sw.hpk)+len(p)+sign.Overhead)
+	out = append(out, sw.magic...)
+	out = append(out, sw.hpk[:]...)
+	out = sign.Sign(out, p, sw.key)
+	if _, err = sw.conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (sw *secWriter) Close() error {
+	return sw.conn.Close()
+}
+
+// Peer is remote gclpr server we could push our clipboard content to.
+type Peer struct {
+	Addr string
+	// TLS if not nil is used to establish mutual TLS connection to the peer.
+	TLS *tls.Config
+	// Text is translation applied to text before it is sent, only PasteLE and CodePage are used.
+	Text  TextOptions
+	hpk   [32]byte
+	key   *[64]byte
+	magic []byte
+}
+
+// NewPeer prepares Peer using hex encoded private signing key - the same one gclpr client on this machine would use.
+func NewPeer(addr, key string, magic []byte) (*Peer, error) {
+	k, err := hex.DecodeString(key)
+	if err != nil || len(k) != 64 {
+		return nil, fmt.Errorf("bad gclpr private key for peer %s", addr)
+	}
+	p := &Peer{Addr: addr, key: new([64]byte), magic: magic}
+	copy(p.key[:], k)
+	// public part of the key is kept in the second half
+	p.hpk = sha256.Sum256(k[32:])
+	return p, nil
+}
+
+// Copy sends text to remote peer clipboard.
+func (p *Peer) Copy(text string, timeout time.Duration) error {
+	text, err := p.Text.toRemote(text)
+	if err != nil {
+		return fmt.Errorf("unable to prepare text for gclpr peer %s: %w", p.Addr, err)
+	}
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect to gclpr peer %s: %w", p.Addr, err)
+	}
+	if p.TLS != nil {
+		cfg := p.TLS.Clone()
+		if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+			cfg.ServerName = host
+		}
+		conn = tls.Client(conn, cfg)
+	}
+	if timeout != 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	client := rpc.NewClient(&secWriter{conn: conn, hpk: p.hpk, key: p.key, magic: p.magic})
+	defer client.Close()
+
+	if err := client.Call("Clipboard.Copy", text, &struct{}{}); err != nil {
+		return fmt.Errorf("gclpr peer %s copy failed: %w", p.Addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package gclpr
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/atotto/clipboard"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// Data is used to rpc clipboard content in formats other than plain text (protocol 1.2+).
+type Data struct {
+	Format string
+	Bytes  []byte
+}
+
+// Clipboard is used to rpc clipboard content.
+type Clipboard struct {
+	opts *Options
+	p    permitter
+}
+
+// NewClipboard initializes Clipboard structure.
+func NewClipboard(opts *Options, p permitter) *Clipboard {
+	return &Clipboard{opts: opts, p: p}
+}
+
+// Copy is implementation of rpc "copy" command.
+func (c *Clipboard) Copy(text string, _ *struct{}) error {
+	log.Printf("Copy request received len: %d\n", len(text))
+	if err := checkAllowed(c.p, VerbCopy); err != nil {
+		return err
+	}
+	text, err := c.opts.textFor(c.p).fromRemote(text)
+	if err != nil {
+		return err
+	}
+	setLastRemote(text)
+	history.add(text)
+	return clipboard.WriteAll(text)
+}
+
+// Paste is implementation of rpc "paste" command.
+func (c *Clipboard) Paste(_ struct{}, resp *string) error {
+	if err := checkAllowed(c.p, VerbPaste); err != nil {
+		return err
+	}
+	t, err := clipboard.ReadAll()
+	log.Printf("Paste request received len: %d, error: '%+v'\n", len(t), err)
+	if err != nil {
+		return err
+	}
+	*resp, err = c.opts.textFor(c.p).toRemote(t)
+	return err
+}
+
+func (c *Clipboard) format(name string) (uint32, error) {
+	allowed := false
+	for _, f := range c.opts.Formats {
+		if strings.EqualFold(f, name) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return 0, fmt.Errorf("clipboard format %s is not enabled", name)
+	}
+	cf := util.ClipboardFormat(name)
+	if cf == 0 {
+		return 0, fmt.Errorf("clipboard format %s is not supported", name)
+	}
+	return cf, nil
+}
+
+// CopyData is implementation of rpc "copy" command for rich formats (png, dib, html).
+func (c *Clipboard) CopyData(d Data, _ *struct{}) error {
+	log.Printf("CopyData request received format: %s, len: %d\n", d.Format, len(d.Bytes))
+	if err := checkAllowed(c.p, VerbCopy); err != nil {
+		return err
+	}
+	cf, err := c.format(d.Format)
+	if err != nil {
+		return err
+	}
+	return util.WriteClipboard(cf, d.Bytes)
+}
+
+// PasteData is implementation of rpc "paste" command for rich formats (png, dib, html).
+func (c *Clipboard) PasteData(format string, resp *Data) error {
+	if err := checkAllowed(c.p, VerbPaste); err != nil {
+		return err
+	}
+	cf, err := c.format(format)
+	if err != nil {
+		return err
+	}
+	data, err := util.ReadClipboard(cf)
+	log.Printf("PasteData request received format: %s, len: %d, error: '%+v'\n", format, len(data), err)
+	resp.Format, resp.Bytes = format, data
+	return err
+}
@@ -0,0 +1,58 @@
+package gclpr
+
+import (
+	"strings"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// ConvertLE is used to normaliza line endings when exchanging clipboard content. Any mix of CRLF, LF and lone CR is
+// accepted.
+func ConvertLE(text, op string) string {
+	switch {
+	case strings.EqualFold("lf", op):
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		return strings.ReplaceAll(text, "\r", "\n")
+	case strings.EqualFold("crlf", op):
+		return strings.ReplaceAll(ConvertLE(text, "lf"), "\n", "\r\n")
+	default:
+		return text
+	}
+}
+
+// TextOptions defines how plain text is translated between Windows clipboard and particular remote client.
+type TextOptions struct {
+	// LE is line endings translation for text coming from remote client.
+	LE string
+	// PasteLE is line endings translation for text sent to remote client.
+	PasteLE string
+	// CodePage is encoding remote client is using, 0 means UTF-8.
+	CodePage uint32
+}
+
+// fromRemote converts text received from remote client to form suitable for Windows clipboard.
+func (to TextOptions) fromRemote(text string) (string, error) {
+	if to.CodePage != 0 {
+		var err error
+		if text, err = util.DecodeCodePage([]byte(text), to.CodePage); err != nil {
+			return "", err
+		}
+	}
+	// Windows clipboard text is zero terminated and BOM shows up as garbage in some applications
+	text = strings.TrimPrefix(text, "\uFEFF")
+	text = strings.ReplaceAll(text, "\x00", "")
+	return ConvertLE(text, to.LE), nil
+}
+
+// toRemote converts Windows clipboard text to form remote client expects.
+func (to TextOptions) toRemote(text string) (string, error) {
+	text = ConvertLE(text, to.PasteLE)
+	if to.CodePage == 0 {
+		return text, nil
+	}
+	data, err := util.EncodeCodePage(text, to.CodePage)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,75 @@
+package gclpr
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryEntry is single remote clipboard payload.
+type HistoryEntry struct {
+	When time.Time
+	Text string
+}
+
+// History keeps last N payloads received from remote clients, newest first.
+type History struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	size    int
+	changed chan struct{}
+}
+
+// history is shared by all gclpr servers, nil when disabled.
+var history *History
+
+// EnableHistory starts recording remote clipboard payloads, keeping at most size entries.
+func EnableHistory(size int) *History {
+	if size <= 0 {
+		return nil
+	}
+	history = &History{size: size, changed: make(chan struct{}, 1)}
+	return history
+}
+
+func (h *History) add(text string) {
+	if h == nil || len(text) == 0 {
+		return
+	}
+	h.mu.Lock()
+	// do not keep duplicates - move existing entry to the top instead
+	for i, e := range h.entries {
+		if e.Text == text {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			break
+		}
+	}
+	h.entries = append([]HistoryEntry{{When: time.Now(), Text: text}}, h.entries...)
+	if len(h.entries) > h.size {
+		h.entries = h.entries[:h.size]
+	}
+	h.mu.Unlock()
+
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Entries returns copy of current history.
+func (h *History) Entries() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]HistoryEntry, len(h.entries))
+	copy(res, h.entries)
+	return res
+}
+
+// Size returns maximum number of entries kept.
+func (h *History) Size() int {
+	return h.size
+}
+
+// Changed returns channel which is signaled every time history is updated.
+func (h *History) Changed() <-chan struct{} {
+	return h.changed
+}
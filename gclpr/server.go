@@ -0,0 +1,322 @@
+// Package gclpr implements server side of gclpr remote clipboard protocol (see https://github.com/rupor-github/gclpr).
+//
+// Package is derived from server package of gclpr (MIT license, see LICENSE), which used to be vendored. Upstream Serve
+// takes single "host:port" and does net.Listen itself, so it could not listen on several addresses or on both IPv4 and
+// IPv6 (gui.gclpr.bind) - here listeners come from util.ListenTCP. Protocol code is kept as close to upstream as
+// possible, so fixes could be carried over in both directions.
+package gclpr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/nacl/sign"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// DefaultPort is used by gclpr clients when nothing else is specified.
+const DefaultPort = 2850
+
+// Magic is protocol signature and version. Major version must match, minor is bumped when new rpc calls are added:
+// 1.2 added CopyData/PasteData for rich clipboard formats.
+var Magic = []byte{'g', 'c', 'l', 'p', 'r', 1, 2, 0}
+
+// Options defines behavior of gclpr server.
+type Options struct {
+	// LE is line endings translation for text coming from remote clients.
+	LE string
+	// PasteLE is line endings translation for text sent to remote clients.
+	PasteLE string
+	// CodePage is encoding of remote clients text, 0 means UTF-8.
+	CodePage uint32
+	// Text overrides text translation for key with given hash.
+	Text map[[32]byte]TextOptions
+	// Formats lists rich clipboard formats (png, dib, html) remote clients are allowed to exchange.
+	Formats []string
+	// MinVersion and MaxVersion specify range of client protocol versions to accept, empty means 1.1.0 and current server version.
+	MinVersion, MaxVersion string
+	// Permissions lists verbs (copy, paste, open) allowed for key with given hash, keys not present here are not restricted.
+	Permissions map[[32]byte][]string
+	// TLS if not nil wraps TCP traffic in mutual TLS, clients are authenticated by certificates and public keys become optional.
+	TLS *tls.Config
+}
+
+// textFor returns text translation for client, p could be nil.
+func (opts *Options) textFor(p permitter) TextOptions {
+	if p != nil {
+		if to, ok := opts.Text[p.key()]; ok {
+			return to
+		}
+	}
+	return TextOptions{LE: opts.LE, PasteLE: opts.PasteLE, CodePage: opts.CodePage}
+}
+
+// versionRange validates configured client versions range.
+func (opts *Options) versionRange() (min, max Version, err error) {
+	min, max = Version{1, 1, 0}, ServerVersion()
+	// patch level never affects compatibility
+	max[2] = 255
+	if len(opts.MinVersion) > 0 {
+		if min, err = ParseVersion(opts.MinVersion); err != nil {
+			return
+		}
+	}
+	if len(opts.MaxVersion) > 0 {
+		if max, err = ParseVersion(opts.MaxVersion); err != nil {
+			return
+		}
+		if strings.Count(opts.MaxVersion, ".") == 1 {
+			max[2] = 255
+		}
+	}
+	if max.Less(min) {
+		err = fmt.Errorf("bad gclpr client versions range %s - %s", min, max)
+	}
+	return
+}
+
+type secConn struct {
+	conn           net.Conn
+	pkeys          map[[32]byte][32]byte
+	perms          map[[32]byte][]string
+	magic          []byte
+	minVer, maxVer Version
+	// when set and there are no public keys frames are accepted without signature check - peer was authenticated by TLS
+	tlsOnly bool
+	// hash of public key which authenticated last request
+	hpk [32]byte
+}
+
+// Verbs which could be restricted per client key.
+const (
+	VerbCopy  = "copy"
+	VerbPaste = "paste"
+	VerbOpen  = "open"
+)
+
+// permitter decides if connected client is allowed to perform operation.
+type permitter interface {
+	allowed(verb string) bool
+	key() [32]byte
+}
+
+// key returns hash of public key which authenticated last request.
+func (sc *secConn) key() [32]byte {
+	return sc.hpk
+}
+
+// allowed checks permissions of the key which signed the request, keys without explicit permissions could do anything.
+func (sc *secConn) allowed(verb string) bool {
+	verbs, ok := sc.perms[sc.hpk]
+	if !ok {
+		return true
+	}
+	for _, v := range verbs {
+		if strings.EqualFold(v, verb) {
+			return true
+		}
+	}
+	log.Printf("Key %s is not allowed to %s", hex.EncodeToString(sc.hpk[:]), verb)
+	return false
+}
+
+func checkAllowed(p permitter, verb string) error {
+	if p != nil && !p.allowed(verb) {
+		return fmt.Errorf("%s is not permitted for this key", verb)
+	}
+	return nil
+}
+
+func (sc *secConn) Read(p []byte) (n int, err error) {
+
+	var (
+		hpk, pk [32]byte
+		in      = make([]byte, len(p)+len(hpk)+len(sc.magic)+sign.Overhead)
+	)
+
+	n, err = sc.conn.Read(in)
+	if err != nil {
+		return
+	}
+
+	if n <= len(sc.magic)+len(hpk)+sign.Overhead {
+		log.Printf("Message is too short: %d", n)
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	magic := make([]byte, len(sc.magic))
+	copy(magic, in[0:len(magic)])
+
+	// check signature and make sure client version is within accepted range
+	if !bytes.Equal(magic[0:5], sc.magic[0:5]) {
+		log.Printf("Bad signature: server [%x], client [%x]", sc.magic, magic)
+		return 0, rpc.ErrShutdown
+	}
+	if v := magicVersion(magic); v.Less(sc.minVer) || sc.maxVer.Less(v) {
+		log.Printf("Incompatible protocol version from '%s': client %s, accepted %s - %s", sc.conn.RemoteAddr(), v, sc.minVer, sc.maxVer)
+		setMismatch(sc.conn.RemoteAddr().String(), v)
+		return 0, rpc.ErrShutdown
+	}
+
+	copy(hpk[:], in[len(magic):len(magic)+len(hpk)])
+
+	if sc.tlsOnly && len(sc.pkeys) == 0 {
+		// signed message is signature followed by payload
+		out := in[len(magic)+len(hpk)+sign.Overhead : n]
+		copy(p, out)
+		return len(out), nil
+	}
+
+	var ok bool
+	if pk, ok = sc.pkeys[hpk]; !ok {
+		log.Printf("Call with unauthorized key: %s", hex.EncodeToString(hpk[:]))
+		return 0, rpc.ErrShutdown
+	}
+
+	out, ok := sign.Open([]byte{}, in[len(magic)+len(hpk):n], &pk)
+	if !ok {
+		log.Printf("Call fails verification with key: %s", hex.EncodeToString(pk[:]))
+		return 0, rpc.ErrShutdown
+	}
+	sc.hpk = hpk
+	copy(p, out)
+	return len(out), nil
+}
+
+func (sc *secConn) Write(p []byte) (n int, err error) {
+	return sc.conn.Write(p)
+}
+
+func (sc *secConn) Close() error {
+	return sc.conn.Close()
+}
+
+// newServer prepares rpc server for a single connection, p (if not nil) is consulted before each operation.
+func newServer(opts *Options, p permitter) (*rpc.Server, error) {
+	srv := rpc.NewServer()
+	if err := srv.Register(NewURI(p)); err != nil {
+		return nil, fmt.Errorf("unable to register URI rpc object: %w", err)
+	}
+	if err := srv.Register(NewClipboard(opts, p)); err != nil {
+		return nil, fmt.Errorf("unable to register Clipboard rpc object: %w", err)
+	}
+	return srv, nil
+}
+
+// Serve handles backend rpc calls on port for every address in hosts (see util.ResolveBindHosts).
+func Serve(ctx context.Context, hosts []string, port int, pkeys map[[32]byte][32]byte, opts *Options) error {
+
+	minVer, maxVer, err := opts.versionRange()
+	if err != nil {
+		return err
+	}
+
+	l, err := util.ListenTCP(hosts, port)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("gclpr server listens on '%s'\n", util.ListenerAddrs(l))
+	if opts.TLS != nil {
+		l = tls.NewListener(l, opts.TLS)
+		log.Print("gclpr server requires mutual TLS\n")
+	}
+
+	// This will break the loop
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	log.Print("gclpr server is ready\n")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !util.IsNetClosing(err) {
+				return fmt.Errorf("gclpr server is unable to accept requests: %w", err)
+			}
+			log.Print("gclpr server is shutting down\n")
+			return nil
+		}
+		go func(sc *secConn) {
+			defer sc.Close()
+			log.Printf("gclpr server accepted request from '%s'", sc.conn.RemoteAddr())
+			srv, err := newServer(opts, sc)
+			if err != nil {
+				log.Print(err.Error())
+				return
+			}
+			srv.ServeConn(sc)
+			log.Printf("gclpr server handled request from '%s'", sc.conn.RemoteAddr())
+		}(&secConn{
+			conn:    conn,
+			pkeys:   pkeys,
+			perms:   opts.Permissions,
+			magic:   Magic,
+			minVer:  minVer,
+			maxVer:  maxVer,
+			tlsOnly: opts.TLS != nil,
+		})
+	}
+}
+
+// ServeUnix handles backend rpc calls on AF_UNIX socket. Since socket is only reachable locally (WSL included) and protected by
+// file system permissions, there is no key exchange and rpc stream is not signed.
+func ServeUnix(ctx context.Context, socketName string, opts *Options) error {
+
+	srv, err := newServer(opts, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(socketName) > util.MaxNameLen {
+		return fmt.Errorf("socket name is too long: %d, max allowed: %d", len(socketName), util.MaxNameLen)
+	}
+	_, err = os.Stat(socketName)
+	if err == nil || !os.IsNotExist(err) {
+		if err = os.Remove(socketName); err != nil {
+			return fmt.Errorf("failed to unlink socket %s: %w", socketName, err)
+		}
+	}
+
+	l, err := net.Listen("unix", socketName)
+	if err != nil {
+		return fmt.Errorf("could not open socket %s: %w", socketName, err)
+	}
+
+	log.Printf("gclpr server listens on '%s'\n", socketName)
+
+	// This will break the loop
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		os.Remove(socketName)
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !util.IsNetClosing(err) {
+				return fmt.Errorf("gclpr server is unable to accept requests on %s: %w", socketName, err)
+			}
+			log.Printf("gclpr server on %s is shutting down\n", socketName)
+			return nil
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			log.Printf("gclpr server accepted request on '%s'", socketName)
+			srv.ServeConn(conn)
+			log.Printf("gclpr server handled request on '%s'", socketName)
+		}(conn)
+	}
+}
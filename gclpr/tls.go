@@ -0,0 +1,38 @@
+package gclpr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// NewTLSConfig prepares mutual TLS configuration: both sides present certificates signed by authority from roots. If
+// subjects is not empty peer certificate common name or full subject has to match one of its entries.
+func NewTLSConfig(cert *tls.Certificate, roots *x509.CertPool, subjects []string) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		RootCAs:      roots,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(subjects) == 0 {
+				return nil
+			}
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return errors.New("no verified peer certificate")
+			}
+			leaf := chains[0][0]
+			for _, s := range subjects {
+				if strings.EqualFold(s, leaf.Subject.CommonName) || strings.EqualFold(s, leaf.Subject.String()) {
+					return nil
+				}
+			}
+			log.Printf("gclpr rejecting peer certificate \"%s\"", leaf.Subject)
+			return fmt.Errorf("peer certificate \"%s\" is not allowed", leaf.Subject)
+		},
+	}
+}
@@ -1,4 +1,4 @@
-package server
+package gclpr
 
 import (
 	"log"
@@ -8,16 +8,19 @@ import (
 
 // URI is used to rpc open command.
 type URI struct {
-	// placeholder
+	p permitter
 }
 
 // NewURI initializes URI structure.
-func NewURI() *URI {
-	return &URI{}
+func NewURI(p permitter) *URI {
+	return &URI{p: p}
 }
 
 // Open is implementation of "lemonade" rpc "open" command.
 func (u *URI) Open(uri string, _ *struct{}) error {
 	log.Printf("URI Open received: '%s'", uri)
+	if err := checkAllowed(u.p, VerbOpen); err != nil {
+		return err
+	}
 	return open.Run(uri)
 }
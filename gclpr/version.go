@@ -0,0 +1,78 @@
+package gclpr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is gclpr protocol version as transmitted in the last 3 bytes of magic.
+type Version [3]byte
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// Less compares versions.
+func (v Version) Less(o Version) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
+
+// ParseVersion converts "major.minor[.patch]" string to Version.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v, fmt.Errorf("bad gclpr version '%s', expecting major.minor[.patch]", s)
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return v, fmt.Errorf("bad gclpr version '%s': %w", s, err)
+		}
+		v[i] = byte(n)
+	}
+	return v, nil
+}
+
+func magicVersion(magic []byte) Version {
+	var v Version
+	copy(v[:], magic[len(magic)-len(v):])
+	return v
+}
+
+// ServerVersion returns version of protocol this server implements.
+func ServerVersion() Version {
+	return magicVersion(Magic)
+}
+
+// mismatch remembers last client rejected because of incompatible protocol version.
+var mismatch struct {
+	sync.Mutex
+	when   time.Time
+	client Version
+	addr   string
+}
+
+func setMismatch(addr string, v Version) {
+	mismatch.Lock()
+	defer mismatch.Unlock()
+	mismatch.when, mismatch.client, mismatch.addr = time.Now(), v, addr
+}
+
+// LastMismatch describes last client rejected because of protocol version, or returns empty string.
+func LastMismatch() string {
+	mismatch.Lock()
+	defer mismatch.Unlock()
+	if mismatch.when.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%s client %s from '%s' was rejected, server protocol is %s", mismatch.when.Format(time.RFC3339), mismatch.client, mismatch.addr, ServerVersion())
+}
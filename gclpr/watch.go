@@ -0,0 +1,91 @@
+package gclpr
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/atotto/clipboard"
+
+	"github.com/rupor-github/win-gpg-agent/util"
+)
+
+// lastRemote remembers text last received from remote clients, so it would not be sent back to peers by Watch.
+var lastRemote struct {
+	sync.Mutex
+	text string
+}
+
+func setLastRemote(text string) {
+	lastRemote.Lock()
+	defer lastRemote.Unlock()
+	lastRemote.text = text
+}
+
+func isLastRemote(text string) bool {
+	lastRemote.Lock()
+	defer lastRemote.Unlock()
+	return lastRemote.text == text
+}
+
+// Watch monitors Windows clipboard and pushes every change to all peers until ctx is canceled.
+// Content which came from remote clients is never pushed back.
+func Watch(ctx context.Context, peers []*Peer, interval time.Duration) {
+
+	if interval <= 0 {
+		interval = time.Second
+	}
+	// clipboard is only polled when change notifications are not available
+	var ticker *time.Ticker
+	poll := func() <-chan time.Time {
+		if ticker == nil {
+			return nil
+		}
+		return ticker.C
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	changed, err := util.ClipboardChanges(ctx)
+	if err != nil {
+		log.Printf("gclpr will poll clipboard every %s: %s", interval, err)
+		ticker = time.NewTicker(interval)
+	}
+
+	seq := util.ClipboardSequenceNumber()
+	log.Printf("gclpr watching clipboard for %d peer(s)", len(peers))
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("gclpr clipboard watcher is shutting down")
+			return
+		case _, ok := <-changed:
+			if !ok {
+				log.Printf("gclpr lost clipboard notifications, will poll clipboard every %s", interval)
+				changed, ticker = nil, time.NewTicker(interval)
+				continue
+			}
+		case <-poll():
+		}
+		cur := util.ClipboardSequenceNumber()
+		if cur == seq {
+			continue
+		}
+		seq = cur
+
+		text, err := clipboard.ReadAll()
+		if err != nil || len(text) == 0 || isLastRemote(text) {
+			continue
+		}
+		for _, p := range peers {
+			if err := p.Copy(text, interval*5); err != nil {
+				log.Print(err.Error())
+				continue
+			}
+			log.Printf("gclpr pushed %d bytes to peer %s", len(text), p.Addr)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package noise
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Conn is net.Conn with Noise transport encryption on top of it.
+type Conn struct {
+	net.Conn
+	peer [keyLen]byte
+
+	rmu  sync.Mutex
+	recv *cipherState
+	raw  []byte // partially received message - read deadlines may interrupt us in the middle
+	data []byte // decrypted but not yet consumed payload
+
+	wmu  sync.Mutex
+	send *cipherState
+	out  []byte
+}
+
+// Server performs handshake on accepted connection. Only initiators whose static public keys are in peers are allowed.
+func Server(conn net.Conn, s *KeyPair, peers map[[keyLen]byte]bool) (*Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	send, recv, rs, err := responder(conn, s, func(pk [keyLen]byte) bool { return peers[pk] })
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &Conn{Conn: conn, peer: rs, recv: recv, send: send}, nil
+}
+
+// Client performs handshake on dialed connection to server with known static public key.
+func Client(conn net.Conn, s *KeyPair, server [keyLen]byte) (*Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	send, recv, err := initiator(conn, s, server)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &Conn{Conn: conn, peer: server, recv: recv, send: send}, nil
+}
+
+// Dial connects to Noise server.
+func Dial(addr string, s *KeyPair, server [keyLen]byte) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := Client(conn, s, server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+// PeerKey returns static public key of the other side.
+func (c *Conn) PeerKey() [keyLen]byte {
+	return c.peer
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.data) == 0 {
+		msg, err := c.readRaw()
+		if err != nil {
+			return 0, err
+		}
+		if c.data, err = c.recv.decrypt(c.data[:0], nil, msg); err != nil {
+			return 0, fmt.Errorf("noise message authentication failed: %w", err)
+		}
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// readRaw accumulates complete message in c.raw keeping partial data between calls.
+func (c *Conn) readRaw() ([]byte, error) {
+	need := 2
+	for {
+		if len(c.raw) >= 2 {
+			need = 2 + int(binary.BigEndian.Uint16(c.raw))
+			if need < 2+tagLen {
+				return nil, fmt.Errorf("bad noise message length %d", need-2)
+			}
+		}
+		if len(c.raw) == need && need > 2 {
+			msg := c.raw[2:]
+			c.raw = c.raw[:0]
+			return msg, nil
+		}
+		if cap(c.raw) < need {
+			raw := make([]byte, len(c.raw), 2+MaxMessage)
+			copy(raw, c.raw)
+			c.raw = raw
+		}
+		n, err := c.Conn.Read(c.raw[len(c.raw):need])
+		c.raw = c.raw[:len(c.raw)+n]
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxMessage-tagLen {
+			chunk = chunk[:MaxMessage-tagLen]
+		}
+		var err error
+		c.out = append(c.out[:0], 0, 0)
+		if c.out, err = c.send.encrypt(c.out, nil, chunk); err != nil {
+			return written, err
+		}
+		binary.BigEndian.PutUint16(c.out, uint16(len(c.out)-2))
+		if _, err := c.Conn.Write(c.out); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,346 @@
+// Package noise implements Noise_IK_25519_ChaChaPoly_SHA256 handshake and transport so agents could be forwarded
+// to remote machines with authenticated encryption and without any PKI - every peer has single static key pair and
+// knows public keys of the other side (same model gclpr uses).
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	protocolName = "Noise_IK_25519_ChaChaPoly_SHA256"
+	prologue     = "win-gpg-agent"
+	keyLen       = 32
+	tagLen       = 16
+	// MaxMessage is maximum size of single Noise message on the wire.
+	MaxMessage = 65535
+)
+
+// ErrUnknownPeer is returned when initiator static key is not in the list of allowed keys.
+var ErrUnknownPeer = errors.New("peer public key is not allowed")
+
+// KeyPair is Curve25519 static key pair.
+type KeyPair struct {
+	Private [keyLen]byte
+	Public  [keyLen]byte
+}
+
+// GenerateKeyPair creates new random key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	var priv [keyLen]byte
+	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return nil, fmt.Errorf("unable to generate private key: %w", err)
+	}
+	return newKeyPair(priv)
+}
+
+// NewKeyPair restores key pair from hex encoded private key.
+func NewKeyPair(private string) (*KeyPair, error) {
+	priv, err := ParseKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyPair(priv)
+}
+
+func newKeyPair(priv [keyLen]byte) (*KeyPair, error) {
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive public key: %w", err)
+	}
+	kp := &KeyPair{Private: priv}
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// ParseKey decodes hex encoded 32 bytes key.
+func ParseKey(key string) ([keyLen]byte, error) {
+	var k [keyLen]byte
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return k, fmt.Errorf("bad key encoding: %w", err)
+	}
+	if len(b) != keyLen {
+		return k, fmt.Errorf("bad key length %d, expected %d", len(b), keyLen)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// cipherState is Noise CipherState.
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(k []byte) *cipherState {
+	aead, err := chacha20poly1305.New(k)
+	if err != nil {
+		// key length is always correct here
+		panic(err)
+	}
+	return &cipherState{aead: aead}
+}
+
+func (cs *cipherState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.n)
+	return nonce[:]
+}
+
+func (cs *cipherState) encrypt(out, ad, plaintext []byte) ([]byte, error) {
+	if cs.n == ^uint64(0) {
+		return nil, errors.New("nonce exhausted")
+	}
+	out = cs.aead.Seal(out, cs.nonce(), plaintext, ad)
+	cs.n++
+	return out, nil
+}
+
+func (cs *cipherState) decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	if cs.n == ^uint64(0) {
+		return nil, errors.New("nonce exhausted")
+	}
+	out, err := cs.aead.Open(out, cs.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	cs.n++
+	return out, nil
+}
+
+// symmetricState is Noise SymmetricState.
+type symmetricState struct {
+	cs *cipherState
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+}
+
+func newSymmetricState() *symmetricState {
+	ss := &symmetricState{}
+	// protocol name is exactly HASHLEN bytes long
+	copy(ss.h[:], protocolName)
+	ss.ck = ss.h
+	ss.mixHash([]byte(prologue))
+	return ss
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	temp := hmacSHA256(ck, ikm)
+	out1 := hmacSHA256(temp, []byte{1})
+	out2 := hmacSHA256(temp, out1, []byte{2})
+	return out1, out2
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	h.Sum(ss.h[:0])
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(ss.ck[:], ikm)
+	copy(ss.ck[:], ck)
+	ss.cs = newCipherState(k)
+}
+
+func (ss *symmetricState) encryptAndHash(out, plaintext []byte) ([]byte, error) {
+	start := len(out)
+	out, err := ss.cs.encrypt(out, ss.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(out[start:])
+	return out, nil
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out, err := ss.cs.decrypt(nil, ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return out, nil
+}
+
+func (ss *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(ss.ck[:], nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	out, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return nil, fmt.Errorf("bad DH: %w", err)
+	}
+	return out, nil
+}
+
+// initiator performs IK handshake from client side: -> e, es, s, ss / <- e, ee, se.
+func initiator(rw io.ReadWriter, s *KeyPair, rs [keyLen]byte) (send, recv *cipherState, err error) {
+
+	ss := newSymmetricState()
+	ss.mixHash(rs[:])
+
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// first message
+	msg := append(make([]byte, 0, 2*keyLen+2*tagLen), e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	k, err := dh(e.Private[:], rs[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if msg, err = ss.encryptAndHash(msg, s.Public[:]); err != nil {
+		return nil, nil, err
+	}
+	if k, err = dh(s.Private[:], rs[:]); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if msg, err = ss.encryptAndHash(msg, nil); err != nil {
+		return nil, nil, err
+	}
+	if err := writeMessage(rw, msg); err != nil {
+		return nil, nil, err
+	}
+
+	// second message
+	if msg, err = readMessage(rw, nil); err != nil {
+		return nil, nil, err
+	}
+	if len(msg) != keyLen+tagLen {
+		return nil, nil, fmt.Errorf("bad handshake response length %d", len(msg))
+	}
+	re := msg[:keyLen]
+	ss.mixHash(re)
+	if k, err = dh(e.Private[:], re); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if k, err = dh(s.Private[:], re); err != nil {
+		return nil, nil, err
+	}
+	ss.mixKey(k)
+	if _, err := ss.decryptAndHash(msg[keyLen:]); err != nil {
+		return nil, nil, fmt.Errorf("handshake response authentication failed: %w", err)
+	}
+
+	send, recv = ss.split()
+	return send, recv, nil
+}
+
+// responder performs IK handshake from server side returning initiator static key.
+func responder(rw io.ReadWriter, s *KeyPair, allowed func([keyLen]byte) bool) (send, recv *cipherState, rs [keyLen]byte, err error) {
+
+	ss := newSymmetricState()
+	ss.mixHash(s.Public[:])
+
+	// first message
+	msg, err := readMessage(rw, nil)
+	if err != nil {
+		return nil, nil, rs, err
+	}
+	if len(msg) != 2*keyLen+2*tagLen {
+		return nil, nil, rs, fmt.Errorf("bad handshake request length %d", len(msg))
+	}
+	re := msg[:keyLen]
+	ss.mixHash(re)
+	k, err := dh(s.Private[:], re)
+	if err != nil {
+		return nil, nil, rs, err
+	}
+	ss.mixKey(k)
+	pk, err := ss.decryptAndHash(msg[keyLen : 2*keyLen+tagLen])
+	if err != nil {
+		return nil, nil, rs, fmt.Errorf("handshake request authentication failed: %w", err)
+	}
+	copy(rs[:], pk)
+	if allowed != nil && !allowed(rs) {
+		return nil, nil, rs, ErrUnknownPeer
+	}
+	if k, err = dh(s.Private[:], rs[:]); err != nil {
+		return nil, nil, rs, err
+	}
+	ss.mixKey(k)
+	if _, err := ss.decryptAndHash(msg[2*keyLen+tagLen:]); err != nil {
+		return nil, nil, rs, fmt.Errorf("handshake request authentication failed: %w", err)
+	}
+
+	// second message
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, rs, err
+	}
+	msg = append(make([]byte, 0, keyLen+tagLen), e.Public[:]...)
+	ss.mixHash(e.Public[:])
+	if k, err = dh(e.Private[:], re); err != nil {
+		return nil, nil, rs, err
+	}
+	ss.mixKey(k)
+	if k, err = dh(e.Private[:], rs[:]); err != nil {
+		return nil, nil, rs, err
+	}
+	ss.mixKey(k)
+	if msg, err = ss.encryptAndHash(msg, nil); err != nil {
+		return nil, nil, rs, err
+	}
+	if err := writeMessage(rw, msg); err != nil {
+		return nil, nil, rs, err
+	}
+
+	recv, send = ss.split()
+	return send, recv, rs, nil
+}
+
+// writeMessage sends single length prefixed message.
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMessage {
+		return fmt.Errorf("message is too long: %d", len(msg))
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readMessage reads single length prefixed message.
+func readMessage(r io.Reader, buf []byte) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,86 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func pipe(t *testing.T, client, server *KeyPair, peers map[[keyLen]byte]bool) (*Conn, *Conn, error) {
+	t.Helper()
+
+	c, s := net.Pipe()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := Server(s, server, peers)
+		if err != nil {
+			s.Close()
+		}
+		ch <- result{conn, err}
+	}()
+	cc, cerr := Client(c, client, server.Public)
+	if cerr != nil {
+		c.Close()
+	}
+	r := <-ch
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return cc, r.conn, cerr
+}
+
+func TestRoundTrip(t *testing.T) {
+	ckp, _ := GenerateKeyPair()
+	skp, _ := GenerateKeyPair()
+
+	cc, sc, err := pipe(t, ckp, skp, map[[keyLen]byte]bool{ckp.Public: true})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if sc.PeerKey() != ckp.Public {
+		t.Fatal("server sees wrong client key")
+	}
+
+	payload := bytes.Repeat([]byte("0123456789"), 20000) // spans several messages
+	go func() {
+		cc.Write(payload)
+		cc.Close()
+	}()
+	got, err := io.ReadAll(sc)
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("payload mismatch: got %d bytes, expected %d", len(got), len(payload))
+	}
+}
+
+func TestUnknownPeer(t *testing.T) {
+	ckp, _ := GenerateKeyPair()
+	skp, _ := GenerateKeyPair()
+
+	if _, _, err := pipe(t, ckp, skp, map[[keyLen]byte]bool{}); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("expected ErrUnknownPeer, got %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	kp2, err := NewKeyPair(hex.EncodeToString(kp.Private[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kp2.Public != kp.Public {
+		t.Fatal("public key mismatch")
+	}
+	if _, err := ParseKey("00"); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
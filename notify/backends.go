@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Webhook returns backend which POSTs messages as JSON to url. Payload has "text" field understood by Slack and
+// Mattermost incoming webhooks in addition to full event description. Requests are made with hc (http.DefaultClient if nil).
+func Webhook(url string, hc *http.Client) Backend {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	host, _ := os.Hostname()
+	return BackendFunc(func(m *Message) error {
+		payload := struct {
+			*Message
+			Text string `json:"text"`
+			Host string `json:"host"`
+		}{m, fmt.Sprintf("%s: %s (%s)", m.Title, m.Text, host), host}
+
+		data, err := json.Marshal(&payload)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	})
+}
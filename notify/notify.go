@@ -0,0 +1,424 @@
+// Package notify delivers events (key used, agent restarted, card removed...) to configurable backends - tray
+// balloon, Windows toast, webhook or log - selected per event class.
+package notify
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a class of events user could be notified about.
+type Event string
+
+// Supported event classes.
+const (
+	KeyUsed             Event = "key_used"
+	AgentRestarted      Event = "agent_restarted"
+	CardRemoved         Event = "card_removed"
+	ClientDenied        Event = "client_denied"
+	AgentLog            Event = "agent_log"
+	Update              Event = "update_available"
+	Tamper              Event = "tamper_detected"
+	Competitor          Event = "competing_agent"
+	Forwarded           Event = "agent_forwarded"
+	Quota               Event = "quota_exceeded"
+	AgentStarted        Event = "agent_started"
+	SessionLocked       Event = "session_locked"
+	SessionUnlocked     Event = "session_unlocked"
+	SessionDisconnected Event = "session_disconnected"
+	ConnectorFailed     Event = "connector_failed"
+	HomeOffline         Event = "home_offline"
+	BackupDue           Event = "backup_due"
+	BackupDone          Event = "backup_done"
+	KeyExpiring         Event = "key_expiring"
+)
+
+// Events lists all known event classes.
+var Events = []Event{KeyUsed, AgentRestarted, CardRemoved, ClientDenied, AgentLog, Update, Tamper, Competitor, Forwarded, Quota,
+	AgentStarted, SessionLocked, SessionUnlocked, SessionDisconnected, ConnectorFailed, HomeOffline, BackupDue,
+	BackupDone, KeyExpiring}
+
+// Message is a single event occurrence.
+type Message struct {
+	Event  Event             `json:"event"`
+	Time   time.Time         `json:"time"`
+	Title  string            `json:"title"`
+	Text   string            `json:"message"`
+	Fields map[string]string `json:"fields,omitempty"`
+	// Action is performed when user clicks on interactive notification.
+	Action func() `json:"-"`
+	// Buttons are additional actions for backends which could show them (toast).
+	Buttons []Button `json:"-"`
+	// Quiet message is only delivered to sinks, user is not bothered.
+	Quiet bool `json:"-"`
+}
+
+// Button is named action shown on notification.
+type Button struct {
+	Label string
+	Do    func()
+}
+
+// Backend delivers messages.
+type Backend interface {
+	Send(m *Message) error
+}
+
+// BackendFunc adapts function to Backend interface.
+type BackendFunc func(m *Message) error
+
+// Send implements Backend.
+func (f BackendFunc) Send(m *Message) error {
+	return f(m)
+}
+
+// Rule selects backends for event class, there could be several rules for the same class.
+type Rule struct {
+	Backends []string
+	// OutsideHours limits delivery to time outside of working hours.
+	OutsideHours bool
+}
+
+// defaultRules preserve behavior from before backends were configurable - only important events reach tray.
+var defaultRules = map[Event][]Rule{
+	KeyUsed:             {{Backends: []string{"log"}}},
+	AgentRestarted:      {{Backends: []string{"tray"}}},
+	CardRemoved:         {{Backends: []string{"tray"}}},
+	ClientDenied:        {{Backends: []string{"log"}}},
+	AgentLog:            {{Backends: []string{"tray"}}},
+	Update:              {{Backends: []string{"tray"}}},
+	Tamper:              {{Backends: []string{"tray"}}},
+	Competitor:          {{Backends: []string{"tray"}}},
+	Forwarded:           {{Backends: []string{"tray"}}},
+	Quota:               {{Backends: []string{"tray"}}},
+	AgentStarted:        {{Backends: []string{"log"}}},
+	SessionLocked:       {{Backends: []string{"log"}}},
+	SessionUnlocked:     {{Backends: []string{"log"}}},
+	SessionDisconnected: {{Backends: []string{"log"}}},
+	ConnectorFailed:     {{Backends: []string{"tray"}}},
+	HomeOffline:         {{Backends: []string{"tray"}}},
+	BackupDue:           {{Backends: []string{"tray"}}},
+	BackupDone:          {{Backends: []string{"log"}}},
+	KeyExpiring:         {{Backends: []string{"tray"}}},
+}
+
+// interactive backends interrupt user, they are held while user does not want to be disturbed.
+var interactive = map[string]bool{"tray": true, "toast": true}
+
+// heldLimit is number of held messages kept per backend, only their count is remembered after that.
+const heldLimit = 100
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]Backend{"log": BackendFunc(logSend)}
+	rules    = copyRules(defaultRules)
+	hours    *WorkingHours
+	sinks    = make(map[Event][]Backend)
+	// do not disturb check and events which are delivered regardless
+	dnd      func() bool
+	critical map[Event]bool
+	held     = make(map[string]*heldMessages)
+)
+
+type heldMessages struct {
+	msgs    []*Message
+	dropped int
+}
+
+func copyRules(src map[Event][]Rule) map[Event][]Rule {
+	res := make(map[Event][]Rule, len(src))
+	for k, v := range src {
+		res[k] = v
+	}
+	return res
+}
+
+func logSend(m *Message) error {
+	log.Printf("%s: %s", m.Title, m.Text)
+	return nil
+}
+
+// Register makes backend available by name, replacing previously registered one.
+func Register(name string, b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+	backends[name] = b
+}
+
+// SetRules replaces delivery rules for listed event classes and working hours definition.
+func SetRules(r map[Event][]Rule, wh *WorkingHours) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for ev, list := range r {
+		if _, ok := defaultRules[ev]; !ok {
+			return fmt.Errorf("unknown notification event %q", ev)
+		}
+		for _, rule := range list {
+			if rule.OutsideHours && wh == nil {
+				return fmt.Errorf("notification event %q requires working hours to be defined", ev)
+			}
+		}
+	}
+	rules = copyRules(defaultRules)
+	for ev, rule := range r {
+		rules[ev] = rule
+	}
+	hours = wh
+	return nil
+}
+
+// AddSink makes backend receive all events of listed classes independently of configured rules and working hours. It
+// is intended for audit exporters.
+func AddSink(events []Event, b Backend) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, ev := range events {
+		if _, ok := defaultRules[ev]; !ok {
+			return fmt.Errorf("unknown event %q", ev)
+		}
+	}
+	for _, ev := range events {
+		sinks[ev] = append(sinks[ev], b)
+	}
+	return nil
+}
+
+// Backends returns names of registered backends.
+func Backends() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	res := make([]string, 0, len(backends))
+	for name := range backends {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// SetDoNotDisturb installs check telling if user does not want to be disturbed (Focus Assist). While it returns true
+// messages for interactive backends (tray, toast) are held unless their event class is listed in always, Release
+// delivers summary of held messages afterwards. nil check delivers everything immediately.
+func SetDoNotDisturb(check func() bool, always []Event) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	crit := make(map[Event]bool, len(always))
+	for _, ev := range always {
+		if _, ok := defaultRules[ev]; !ok {
+			return fmt.Errorf("unknown event %q", ev)
+		}
+		crit[ev] = true
+	}
+	dnd, critical = check, crit
+	return nil
+}
+
+// Send delivers message to all backends selected for its event class. Delivery is asynchronous, failures are logged.
+func Send(m *Message) {
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+
+	mu.RLock()
+	check := dnd
+	mu.RUnlock()
+	hold := check != nil && !m.Quiet && check()
+	if !hold {
+		Release()
+	}
+
+	mu.Lock()
+	hold = hold && !critical[m.Event]
+	selected := make(map[string]Backend)
+	for _, rule := range rules[m.Event] {
+		if m.Quiet {
+			break
+		}
+		if rule.OutsideHours && hours != nil && hours.Contains(m.Time) {
+			continue
+		}
+		for _, name := range rule.Backends {
+			b, ok := backends[name]
+			switch {
+			case !ok:
+				log.Printf("Notification backend %q is not available for %s", name, m.Event)
+			case hold && interactive[name]:
+				h := held[name]
+				if h == nil {
+					h = &heldMessages{}
+					held[name] = h
+				}
+				if len(h.msgs) < heldLimit {
+					h.msgs = append(h.msgs, m)
+				} else {
+					h.dropped++
+				}
+			default:
+				selected[name] = b
+			}
+		}
+	}
+	for i, b := range sinks[m.Event] {
+		selected[fmt.Sprintf("sink %d", i)] = b
+	}
+	mu.Unlock()
+
+	deliver(m, selected)
+}
+
+func deliver(m *Message, selected map[string]Backend) {
+	for name, b := range selected {
+		go func(name string, b Backend) {
+			if err := b.Send(m); err != nil {
+				log.Printf("Unable to deliver %s notification via %s: %s", m.Event, name, err)
+			}
+		}(name, b)
+	}
+}
+
+// Release delivers messages held while user did not want to be disturbed, unless that is still the case. Single held
+// message is delivered as it is, several are summarized in one.
+func Release() {
+	mu.RLock()
+	check, empty := dnd, len(held) == 0
+	mu.RUnlock()
+	if empty || (check != nil && check()) {
+		return
+	}
+
+	mu.Lock()
+	pending := held
+	held = make(map[string]*heldMessages)
+	selected := make(map[string]Backend, len(pending))
+	for name := range pending {
+		if b, ok := backends[name]; ok {
+			selected[name] = b
+		}
+	}
+	mu.Unlock()
+
+	for name, h := range pending {
+		b, ok := selected[name]
+		if !ok || len(h.msgs) == 0 {
+			continue
+		}
+		deliver(summary(h), map[string]Backend{name: b})
+	}
+}
+
+// summary makes single message out of held ones, newest are listed.
+func summary(h *heldMessages) *Message {
+	if len(h.msgs) == 1 && h.dropped == 0 {
+		return h.msgs[0]
+	}
+	const listed = 5
+
+	total := len(h.msgs) + h.dropped
+	last := h.msgs[len(h.msgs)-1]
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d notifications arrived while you were not to be disturbed:", total)
+	from := len(h.msgs) - listed
+	if from < 0 {
+		from = 0
+	}
+	for _, m := range h.msgs[from:] {
+		fmt.Fprintf(&b, "\n%s %s: %s", m.Time.Format("15:04"), m.Title, m.Text)
+	}
+	if more := total - (len(h.msgs) - from); more > 0 {
+		fmt.Fprintf(&b, "\n...and %d more", more)
+	}
+	return &Message{Event: last.Event, Time: time.Now(), Title: "Held notifications", Text: b.String(),
+		Fields: map[string]string{"held": fmt.Sprint(total)}}
+}
+
+// Notify is shortcut to send message with optional key/value fields.
+func Notify(ev Event, title, text string, kv ...string) {
+	Send(newMessage(ev, title, text, kv))
+}
+
+// Quiet is like Notify but message only reaches sinks (audit, activity), configured backends are skipped.
+func Quiet(ev Event, title, text string, kv ...string) {
+	m := newMessage(ev, title, text, kv)
+	m.Quiet = true
+	Send(m)
+}
+
+func newMessage(ev Event, title, text string, kv []string) *Message {
+	m := &Message{Event: ev, Title: title, Text: text}
+	if len(kv) > 1 {
+		m.Fields = make(map[string]string, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			m.Fields[kv[i]] = kv[i+1]
+		}
+	}
+	return m
+}
+
+// WorkingHours defines daily time range and week days.
+type WorkingHours struct {
+	From, To time.Duration // since midnight
+	Days     map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseWorkingHours parses range like "09:00-18:00" and list of week days (mon, tue...). Empty days mean Monday to Friday.
+func ParseWorkingHours(span string, days []string) (*WorkingHours, error) {
+	parts := strings.Split(span, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad working hours %q, expected HH:MM-HH:MM", span)
+	}
+	from, err := parseClock(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseClock(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	wh := &WorkingHours{From: from, To: to, Days: make(map[time.Weekday]bool)}
+	if len(days) == 0 {
+		days = []string{"mon", "tue", "wed", "thu", "fri"}
+	}
+	for _, d := range days {
+		name := strings.ToLower(strings.TrimSpace(d))
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		wd, ok := weekdays[name]
+		if !ok {
+			return nil, fmt.Errorf("bad week day %q", d)
+		}
+		wh.Days[wd] = true
+	}
+	return wh, nil
+}
+
+// Contains reports if t is within working hours. Ranges crossing midnight (22:00-06:00) belong to the day they start.
+func (wh *WorkingHours) Contains(t time.Time) bool {
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if wh.From <= wh.To {
+		return wh.Days[t.Weekday()] && since >= wh.From && since < wh.To
+	}
+	if since >= wh.From {
+		return wh.Days[t.Weekday()]
+	}
+	return since < wh.To && wh.Days[t.AddDate(0, 0, -1).Weekday()]
+}
@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkingHours(t *testing.T) {
+	wh, err := ParseWorkingHours("09:00-18:00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-01 is Monday
+	for _, tc := range []struct {
+		at   string
+		want bool
+	}{
+		{"2024-01-01 09:00", true},
+		{"2024-01-01 17:59", true},
+		{"2024-01-01 18:00", false},
+		{"2024-01-01 08:59", false},
+		{"2024-01-06 12:00", false}, // Saturday
+	} {
+		at, _ := time.Parse("2006-01-02 15:04", tc.at)
+		if got := wh.Contains(at); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.at, got, tc.want)
+		}
+	}
+
+	night, err := ParseWorkingHours("22:00-06:00", []string{"Friday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		at   string
+		want bool
+	}{
+		{"2024-01-05 23:00", true},  // Friday night
+		{"2024-01-06 05:00", true},  // belongs to Friday
+		{"2024-01-06 23:00", false}, // Saturday night
+		{"2024-01-05 05:00", false}, // belongs to Thursday
+	} {
+		at, _ := time.Parse("2006-01-02 15:04", tc.at)
+		if got := night.Contains(at); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.at, got, tc.want)
+		}
+	}
+
+	if _, err := ParseWorkingHours("9-18", nil); err == nil {
+		t.Error("bad range accepted")
+	}
+	if _, err := ParseWorkingHours("09:00-18:00", []string{"someday"}); err == nil {
+		t.Error("bad day accepted")
+	}
+}
+
+func TestSend(t *testing.T) {
+	got := make(chan string, 4)
+	Register("test", BackendFunc(func(m *Message) error {
+		got <- m.Fields["key"]
+		return nil
+	}))
+
+	wh, _ := ParseWorkingHours("00:00-23:59", []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"})
+	if err := SetRules(map[Event][]Rule{KeyUsed: {{Backends: []string{"test"}, OutsideHours: true}}}, wh); err != nil {
+		t.Fatal(err)
+	}
+	Notify(KeyUsed, "Key used", "inside hours", "key", "inside")
+
+	if err := SetRules(map[Event][]Rule{KeyUsed: {{Backends: []string{"test"}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	Notify(KeyUsed, "Key used", "always", "key", "always")
+
+	select {
+	case k := <-got:
+		if k != "always" {
+			t.Errorf("message delivered inside working hours: %s", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	if err := SetRules(map[Event][]Rule{"nonsense": {{Backends: []string{"log"}}}}, nil); err == nil {
+		t.Error("unknown event accepted")
+	}
+}
+
+func TestDoNotDisturb(t *testing.T) {
+	got := make(chan *Message, 4)
+	Register("tray", BackendFunc(func(m *Message) error {
+		got <- m
+		return nil
+	}))
+	defer SetDoNotDisturb(nil, nil)
+
+	var busy int32 = 1
+	if err := SetDoNotDisturb(func() bool { return atomic.LoadInt32(&busy) != 0 }, []Event{Tamper}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRules(map[Event][]Rule{AgentRestarted: {{Backends: []string{"tray"}}}, Tamper: {{Backends: []string{"tray"}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	Notify(AgentRestarted, "gpg-agent", "first")
+	Notify(AgentRestarted, "gpg-agent", "second")
+	Notify(Tamper, "Tamper", "critical")
+
+	select {
+	case m := <-got:
+		if m.Event != Tamper {
+			t.Errorf("%s delivered while busy", m.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("critical message was not delivered")
+	}
+	Release()
+
+	atomic.StoreInt32(&busy, 0)
+	Release()
+	select {
+	case m := <-got:
+		if !strings.Contains(m.Text, "2 notifications") || !strings.Contains(m.Text, "second") {
+			t.Errorf("unexpected summary: %s", m.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held messages were not delivered")
+	}
+	select {
+	case m := <-got:
+		t.Errorf("unexpected message after summary: %s", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := SetDoNotDisturb(func() bool { return false }, []Event{"nonsense"}); err == nil {
+		t.Error("unknown event accepted")
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	b, err := Syslog(SyslogOptions{Address: l.Addr().String(), Version: "1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{Event: ClientDenied, Time: time.Now(), Title: "Client denied", Text: "bad token a=b",
+		Fields: map[string]string{"connector": "websocket", "reason": "bad|token"}}
+	go func() {
+		if err := b.Send(m); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	n, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(n))
+	if err != nil {
+		t.Fatalf("bad frame length %q", n)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<84>1 ", " client_denied - CEF:0|rupor-github|win-gpg-agent|1.0|client_denied|Client denied|7|",
+		"cs1Label=connector cs1=websocket", "reason=bad|token", `msg=bad token a\=b`} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("%q not found in %s", want, msg)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogOptions describes audit collector.
+type SyslogOptions struct {
+	Address string // host:port
+	TLS     bool
+	CAFile  string // when empty system roots are used
+	Format  string // "cef" (default) or "rfc5424"
+	Version string // product version reported in CEF header
+}
+
+const (
+	facilityAuthPriv = 10
+	severityAlert    = 1
+	severityWarning  = 4
+	severityNotice   = 5
+	// private enterprise number used for structured data, see RFC 5424 section 7.2.2
+	sdID = "wga@32473"
+)
+
+type syslogSender struct {
+	opts SyslogOptions
+	host string
+	tls  *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Syslog returns backend shipping events to syslog collector over TCP or TLS (RFC 5424 messages with RFC 6587 octet
+// counting framing) in CEF or plain RFC 5424 format.
+func Syslog(opts SyslogOptions) (Backend, error) {
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, fmt.Errorf("bad syslog collector address %q: %w", opts.Address, err)
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = "cef"
+	case "cef", "rfc5424":
+	default:
+		return nil, fmt.Errorf("unsupported audit format %q, should be either \"cef\" or \"rfc5424\"", opts.Format)
+	}
+	s := &syslogSender{opts: opts}
+	s.host, _ = os.Hostname()
+	if opts.TLS {
+		host, _, _ := net.SplitHostPort(opts.Address)
+		s.tls = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if len(opts.CAFile) > 0 {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read audit CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+			}
+			s.tls.RootCAs = pool
+		}
+	}
+	return s, nil
+}
+
+func (s *syslogSender) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if s.tls != nil {
+		return tls.DialWithDialer(d, "tcp", s.opts.Address, s.tls)
+	}
+	return d.Dial("tcp", s.opts.Address)
+}
+
+// Send implements Backend, connection is reestablished once if collector went away.
+func (s *syslogSender) Send(m *Message) error {
+	msg := s.format(m)
+	frame := []byte(strconv.Itoa(len(msg)) + " " + msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				return fmt.Errorf("unable to connect to audit collector: %w", err)
+			}
+			s.conn = conn
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := s.conn.Write(frame)
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return err
+		}
+		log.Printf("Audit collector connection failed, reconnecting: %s", err)
+	}
+}
+
+func severity(ev Event) int {
+	switch ev {
+	case Tamper:
+		return severityAlert
+	case ClientDenied, Forwarded, Quota:
+		return severityWarning
+	default:
+	}
+	return severityNotice
+}
+
+// format produces RFC 5424 message.
+func (s *syslogSender) format(m *Message) string {
+	pri := facilityAuthPriv*8 + severity(m.Event)
+	hdr := fmt.Sprintf("<%d>1 %s %s win-gpg-agent %d %s ", pri, m.Time.UTC().Format(time.RFC3339Nano), nilValue(s.host), os.Getpid(), m.Event)
+	if s.opts.Format == "cef" {
+		return hdr + "- " + s.cef(m)
+	}
+	return hdr + structuredData(m) + " " + m.Text
+}
+
+func nilValue(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func structuredData(m *Message) string {
+	if len(m.Fields) == 0 {
+		return "-"
+	}
+	var buf strings.Builder
+	buf.WriteString("[" + sdID)
+	for _, k := range sortedKeys(m.Fields) {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(m.Fields[k])
+		fmt.Fprintf(&buf, ` %s="%s"`, k, v)
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+var (
+	cefHeader    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtension = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// cefSeverity maps event class to CEF 0-10 scale.
+func cefSeverity(ev Event) int {
+	switch ev {
+	case Tamper:
+		return 10
+	case ClientDenied:
+		return 7
+	case Forwarded, Quota:
+		return 5
+	case KeyUsed:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// cef formats message as ArcSight Common Event Format.
+func (s *syslogSender) cef(m *Message) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "CEF:0|rupor-github|win-gpg-agent|%s|%s|%s|%d|", cefHeader.Replace(s.opts.Version), cefHeader.Replace(string(m.Event)),
+		cefHeader.Replace(m.Title), cefSeverity(m.Event))
+	fmt.Fprintf(&buf, "rt=%d dvchost=%s", m.Time.UnixNano()/int64(time.Millisecond), cefExtension.Replace(s.host))
+	// standard CEF keys where they exist, custom strings otherwise
+	custom := 0
+	for _, k := range sortedKeys(m.Fields) {
+		v := cefExtension.Replace(m.Fields[k])
+		switch k {
+		case "operation":
+			fmt.Fprintf(&buf, " act=%s", v)
+		case "reason":
+			fmt.Fprintf(&buf, " reason=%s", v)
+		default:
+			if custom < 6 {
+				custom++
+				fmt.Fprintf(&buf, " cs%dLabel=%s cs%d=%s", custom, cefExtension.Replace(k), custom, v)
+			}
+		}
+	}
+	fmt.Fprintf(&buf, " msg=%s", cefExtension.Replace(m.Text))
+	return buf.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
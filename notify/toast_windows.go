@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// psAppID is AppUserModelID of PowerShell, toasts have to be shown on behalf of registered application.
+const psAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// toastWait is how long toast with actions waits for user to click on it.
+const toastWait = 5 * time.Minute
+
+const appIDKey = `Software\Classes\AppUserModelId\`
+
+var appID struct {
+	sync.RWMutex
+	id string
+}
+
+// SetAppID registers application identity toasts are shown on behalf of, so they carry our name and icon and are
+// grouped together in Action Center. Until it is called toasts are shown as coming from PowerShell.
+func SetAppID(id, name, icon string) error {
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, appIDKey+id, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("unable to register toast application id %s: %w", id, err)
+	}
+	defer k.Close()
+	if err := k.SetStringValue("DisplayName", name); err != nil {
+		return fmt.Errorf("unable to register toast application id %s: %w", id, err)
+	}
+	if len(icon) > 0 {
+		if err := k.SetStringValue("IconUri", icon); err != nil {
+			return fmt.Errorf("unable to register toast application id %s: %w", id, err)
+		}
+	}
+	appID.Lock()
+	appID.id = id
+	appID.Unlock()
+	return nil
+}
+
+// RemoveAppID deletes application identity registered by SetAppID.
+func RemoveAppID(id string) error {
+	return registry.DeleteKey(registry.CURRENT_USER, appIDKey+id)
+}
+
+func currentAppID() string {
+	appID.RLock()
+	defer appID.RUnlock()
+	if len(appID.id) == 0 {
+		return psAppID
+	}
+	return appID.id
+}
+
+// Toast is shown and if wait is not zero activation is reported on stdout: "body" for click on toast itself or index
+// of the button. Activated and Dismissed are WinRT events, PowerShell delivers them to Wait-Event.
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+$xml.LoadXml('%s')
+$toast = [Windows.UI.Notifications.ToastNotification]::new($xml)
+$toast.Group = '%s'
+$toast.Tag = '%s'
+$wait = %d
+if ($wait -gt 0) {
+	$toast.ExpirationTime = [DateTimeOffset]::Now.AddSeconds($wait)
+	Register-ObjectEvent -InputObject $toast -EventName Activated -SourceIdentifier activated | Out-Null
+	Register-ObjectEvent -InputObject $toast -EventName Dismissed -SourceIdentifier dismissed | Out-Null
+}
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('%s').Show($toast)
+if ($wait -gt 0) {
+	$e = Wait-Event -Timeout $wait
+	if ($e -and $e.SourceIdentifier -eq 'activated') {
+		[Console]::Out.Write($e.SourceArgs[1].Arguments)
+	}
+}
+`
+
+// toast describes single toast notification.
+type toast struct {
+	title, text string
+	// group is used for Action Center header, toasts with the same group are shown together
+	group, header string
+	// scenario "reminder" keeps toast on screen until user acts on it
+	scenario string
+	buttons  []string
+	wait     time.Duration
+}
+
+var toastSeq uint64
+
+func (t *toast) xml() string {
+	var buf strings.Builder
+	buf.WriteString(`<toast launch="body"`)
+	if len(t.scenario) > 0 {
+		fmt.Fprintf(&buf, ` scenario="%s"`, t.scenario)
+	}
+	buf.WriteString(`>`)
+	if len(t.group) > 0 {
+		fmt.Fprintf(&buf, `<header id="%s" title="%s" arguments="body"/>`, xmlEscape(t.group), xmlEscape(t.header))
+	}
+	fmt.Fprintf(&buf, `<visual><binding template="ToastGeneric"><text>%s</text><text>%s</text></binding></visual>`, xmlEscape(t.title), xmlEscape(t.text))
+	if len(t.buttons) > 0 {
+		buf.WriteString(`<actions>`)
+		for i, b := range t.buttons {
+			fmt.Fprintf(&buf, `<action content="%s" arguments="%d" activationType="foreground"/>`, xmlEscape(b), i)
+		}
+		buf.WriteString(`</actions>`)
+	}
+	buf.WriteString(`</toast>`)
+	return buf.String()
+}
+
+// show displays toast and waits for activation if requested. Returns "body", button index or empty string when toast
+// was dismissed or timed out.
+func (t *toast) show() (string, error) {
+	seq := atomic.AddUint64(&toastSeq, 1)
+	script := fmt.Sprintf(toastScript, t.xml(), xmlEscape(t.group), fmt.Sprintf("t%d", seq), int(t.wait/time.Second), currentAppID())
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// xmlEscape escapes text for XML inside single quoted PowerShell string.
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		switch r {
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '&':
+			buf.WriteString("&amp;")
+		case '"':
+			buf.WriteString("&quot;")
+		case '\'':
+			buf.WriteString("&apos;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// groupHeader returns Action Center header title for event class.
+func groupHeader(ev Event) string {
+	s := strings.ReplaceAll(string(ev), "_", " ")
+	if len(s) == 0 {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// Toast returns backend showing Windows toast notifications (Action Center) grouped by event class. Message action
+// and buttons are performed when user clicks on toast or button.
+func Toast() Backend {
+	return BackendFunc(func(m *Message) error {
+		t := &toast{title: m.Title, text: m.Text, group: string(m.Event), header: groupHeader(m.Event)}
+		for _, b := range m.Buttons {
+			t.buttons = append(t.buttons, b.Label)
+		}
+		if m.Action != nil || len(m.Buttons) > 0 {
+			t.wait = toastWait
+		}
+		res, err := t.show()
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(res) == 0:
+		case res == "body":
+			if m.Action != nil {
+				m.Action()
+			}
+		default:
+			var i int
+			if _, err := fmt.Sscanf(res, "%d", &i); err == nil && i >= 0 && i < len(m.Buttons) && m.Buttons[i].Do != nil {
+				m.Buttons[i].Do()
+			}
+		}
+		return nil
+	})
+}
+
+// Ask shows toast with choices as buttons and waits for user to pick one. Returns index of selected choice or -1 when
+// toast was dismissed, clicked outside of buttons or timeout expired.
+func Ask(group, title, text string, choices []string, timeout time.Duration) (int, error) {
+	t := &toast{title: title, text: text, group: group, header: groupHeader(Event(group)), scenario: "reminder", buttons: choices, wait: timeout}
+	res, err := t.show()
+	if err != nil {
+		return -1, err
+	}
+	var i int
+	if _, err := fmt.Sscanf(res, "%d", &i); err != nil || i < 0 || i >= len(choices) {
+		log.Printf("No choice made for \"%s\"", title)
+		return -1, nil
+	}
+	return i, nil
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/rupor-github/win-gpg-agent/assuan/common"
 	"github.com/rupor-github/win-gpg-agent/assuan/server"
+	"github.com/rupor-github/win-gpg-agent/util"
 	"github.com/rupor-github/win-gpg-agent/wincred"
 )
 
@@ -27,7 +28,8 @@ func CredentialName(key string) string {
 
 // Callbacks list functions to be implemented by caller.
 type Callbacks struct {
-	GetPIN  func(*common.Pipe, *Settings) (string, *common.Error)
+	// GetPIN returns entered passphrase in secure buffer, it is wiped and freed after being sent.
+	GetPIN  func(*common.Pipe, *Settings) (*util.SecureBuffer, *common.Error)
 	Confirm func(*common.Pipe, *Settings) (bool, *common.Error)
 	Msg     func(*common.Pipe, *Settings) *common.Error
 }
@@ -275,7 +277,9 @@ func Serve(callbacks Callbacks, ver string) error {
 			return err
 		}
 
-		if err := pipe.WriteData([]byte(pass)); err != nil {
+		defer pass.Free()
+
+		if err := pipe.WriteSecretData(pass.Bytes()); err != nil {
 			return nil
 		}
 		return nil
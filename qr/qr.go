@@ -0,0 +1,566 @@
+// Package qr encodes data as QR Code (ISO/IEC 18004) symbols in byte mode, it is just enough to show public keys and
+// fingerprints on screen so they could be scanned by mobile applications.
+package qr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level is error correction level of the symbol.
+type Level int
+
+// Error correction levels, from lowest to highest, every one recovers larger share of damaged codewords.
+const (
+	Low      Level = iota // ~7%
+	Medium                // ~15%
+	Quartile              // ~25%
+	High                  // ~30%
+)
+
+func (l Level) String() string {
+	switch l {
+	case Low:
+		return "L"
+	case Medium:
+		return "M"
+	case Quartile:
+		return "Q"
+	case High:
+		return "H"
+	default:
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// formatBits is how level is written into format information.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+const (
+	minVersion = 1
+	maxVersion = 40
+)
+
+// ErrTooLong is returned when data does not fit into the largest symbol.
+var ErrTooLong = errors.New("data is too long for QR code")
+
+// Error correction codewords per block and number of blocks, indexed by level and version (0 is unused).
+var (
+	eccCodewordsPerBlock = [4][maxVersion + 1]int{
+		{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+		{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	}
+	eccBlocks = [4][maxVersion + 1]int{
+		{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+		{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+		{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+		{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+	}
+)
+
+// Code is encoded symbol, modules are addressed from top left corner. Quiet zone is not included.
+type Code struct {
+	Version int
+	Level   Level
+	Mask    int
+	Size    int
+
+	modules  []bool
+	function []bool
+}
+
+// Dark tells if module at column x and row y is dark, modules outside of symbol are light.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// String renders symbol as text with quiet zone, two characters per module, handy for tests and consoles.
+func (c *Code) String() string {
+	const quiet = 4
+	var b []byte
+	for y := -quiet; y < c.Size+quiet; y++ {
+		for x := -quiet; x < c.Size+quiet; x++ {
+			if c.Dark(x, y) {
+				b = append(b, "##"...)
+			} else {
+				b = append(b, "  "...)
+			}
+		}
+		b = append(b, '\n')
+	}
+	return string(b)
+}
+
+// Encode makes the smallest symbol which holds data with at least requested error correction level. When data fits
+// into the same symbol with higher level it is used instead.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < Low || level > High {
+		return nil, fmt.Errorf("bad error correction level %d", int(level))
+	}
+	version := 0
+	for v := minVersion; v <= maxVersion; v++ {
+		if segmentBits(len(data), v) <= dataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLong, len(data))
+	}
+	for l := level + 1; l <= High; l++ {
+		if segmentBits(len(data), version) <= dataCodewords(version, l)*8 {
+			level = l
+		}
+	}
+
+	c := newCode(version, level)
+	c.drawCodewords(c.addECCAndInterleave(encodeSegment(data, version, level)))
+
+	// pick mask with the lowest penalty, masks are applied with XOR so the same call removes them
+	best, penalty := 0, -1
+	for m := 0; m < 8; m++ {
+		c.applyMask(m)
+		c.drawFormatBits(m)
+		if p := c.penalty(); penalty < 0 || p < penalty {
+			best, penalty = m, p
+		}
+		c.applyMask(m)
+	}
+	c.Mask = best
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	c.function = nil
+	return c, nil
+}
+
+// countBits is size of byte mode character count indicator.
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// segmentBits is size of byte mode segment with n bytes of data.
+func segmentBits(n, version int) int {
+	if n >= 1<<countBits(version) {
+		return 1 << 30
+	}
+	return 4 + countBits(version) + 8*n
+}
+
+// rawDataModules is number of modules available for data and error correction codewords.
+func rawDataModules(version int) int {
+	res := (16*version+128)*version + 64
+	if version >= 2 {
+		n := version/7 + 2
+		res -= (25*n-10)*n - 55
+		if version >= 7 {
+			res -= 36
+		}
+	}
+	return res
+}
+
+// dataCodewords is number of 8 bit data codewords symbol holds.
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - eccCodewordsPerBlock[level][version]*eccBlocks[level][version]
+}
+
+// bitBuffer accumulates bits most significant first.
+type bitBuffer []bool
+
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>i)&1 != 0)
+	}
+}
+
+// encodeSegment makes data codewords: byte mode segment, terminator and padding.
+func encodeSegment(data []byte, version int, level Level) []byte {
+	capacity := dataCodewords(version, level) * 8
+	var bb bitBuffer
+	bb.append(0x4, 4)
+	bb.append(len(data), countBits(version))
+	for _, d := range data {
+		bb.append(int(d), 8)
+	}
+	term := capacity - len(bb)
+	if term > 4 {
+		term = 4
+	}
+	bb.append(0, term)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := 0xEC; len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	res := make([]byte, len(bb)/8)
+	for i, set := range bb {
+		if set {
+			res[i>>3] |= 1 << (7 - uint(i&7))
+		}
+	}
+	return res
+}
+
+// addECCAndInterleave splits data into blocks, adds error correction codewords to every block and interleaves them.
+func (c *Code) addECCAndInterleave(data []byte) []byte {
+	var (
+		blocks   = eccBlocks[c.Level][c.Version]
+		eccLen   = eccCodewordsPerBlock[c.Level][c.Version]
+		raw      = rawDataModules(c.Version) / 8
+		short    = blocks - raw%blocks
+		shortLen = raw / blocks
+		divisor  = rsDivisor(eccLen)
+		all      = make([][]byte, 0, blocks)
+		k        = 0
+		dataLen  = shortLen - eccLen
+		res      = make([]byte, 0, raw)
+	)
+	for i := 0; i < blocks; i++ {
+		n := dataLen
+		if i >= short {
+			n++
+		}
+		b := make([]byte, 0, shortLen+1)
+		b = append(b, data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(b, divisor)
+		if i < short {
+			// placeholder keeps all blocks the same length, it is skipped when interleaving
+			b = append(b, 0)
+		}
+		all = append(all, append(b, ecc...))
+	}
+	for i := range all[0] {
+		for j, b := range all {
+			if i != dataLen || j >= short {
+				res = append(res, b[i])
+			}
+		}
+	}
+	return res
+}
+
+// gfMul multiplies in GF(2^8) with polynomial 0x11D.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor computes Reed-Solomon generator polynomial of degree, leading coefficient is omitted.
+func rsDivisor(degree int) []byte {
+	res := make([]byte, degree)
+	res[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range res {
+			res[j] = gfMul(res[j], root)
+			if j+1 < len(res) {
+				res[j] ^= res[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return res
+}
+
+// rsRemainder computes error correction codewords for data.
+func rsRemainder(data, divisor []byte) []byte {
+	res := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ res[0]
+		copy(res, res[1:])
+		res[len(res)-1] = 0
+		for i := range res {
+			res[i] ^= gfMul(divisor[i], factor)
+		}
+	}
+	return res
+}
+
+// newCode makes symbol with all function patterns drawn, format bits are drawn later with the mask.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	c := &Code{Version: version, Level: level, Size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	pos := alignmentPositions(version)
+	n := len(pos)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			// corners with finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			c.drawAlignment(pos[i], pos[j])
+		}
+	}
+	// reserve format areas, real bits are drawn with mask
+	c.drawFormatBits(0)
+	c.drawVersion()
+	return c
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func maxAbs(a, b int) int {
+	if a, b = abs(a), abs(b); a > b {
+		return a
+	}
+	return b
+}
+
+// drawFinder draws finder pattern with separator around it, centered at x, y.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			d := maxAbs(dx, dy)
+			c.setFunction(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawAlignment draws alignment pattern centered at x, y.
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, maxAbs(dx, dy) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns centers of alignment patterns in ascending order, the same for rows and columns.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	res := make([]int, n)
+	res[0] = 6
+	for i, pos := n-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		res[i] = pos
+	}
+	return res
+}
+
+// formatInfo returns 15 bits of format information: level and mask protected by BCH code.
+func formatInfo(level Level, mask int) int {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionInfo returns 18 bits of version information, it is only present in symbols of version 7 and up.
+func versionInfo(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func bit(v, i int) bool {
+	return (v>>uint(i))&1 != 0
+}
+
+// drawFormatBits draws both copies of format information.
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatInfo(c.Level, mask)
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(bits, i))
+	}
+	// always dark
+	c.setFunction(8, c.Size-8, true)
+}
+
+// drawVersion draws both copies of version information.
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	bits := versionInfo(c.Version)
+	for i := 0; i < 18; i++ {
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places codewords in zigzag order into modules which are not occupied by function patterns.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// vertical timing pattern
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.function[y*c.Size+x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = bit(int(data[i>>3]), 7-(i&7))
+				i++
+			}
+		}
+	}
+}
+
+// masked tells if module at x, y is inverted by mask.
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	case 7:
+		return ((x+y)%2+x*y%3)%2 == 0
+	default:
+	}
+	return false
+}
+
+// applyMask inverts data modules selected by mask, applying it again removes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y*c.Size+x] && masked(mask, x, y) {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores masked symbol, mask with the lowest score is used.
+func (c *Code) penalty() int {
+	var res, dark int
+	line := make([]bool, c.Size)
+	for _, vertical := range []bool{false, true} {
+		for i := 0; i < c.Size; i++ {
+			for j := range line {
+				if vertical {
+					line[j] = c.Dark(i, j)
+				} else {
+					line[j] = c.Dark(j, i)
+				}
+			}
+			res += linePenalty(line)
+		}
+	}
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				res += 3
+			}
+		}
+	}
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return res + k*10
+}
+
+// linePenalty scores runs of the same color and finder-like patterns in single row or column, modules outside of
+// symbol are light.
+func linePenalty(line []bool) int {
+	res := 0
+	for i := 0; i < len(line); {
+		j := i
+		for j < len(line) && line[j] == line[i] {
+			j++
+		}
+		if n := j - i; n >= 5 {
+			res += 3 + n - 5
+		}
+		i = j
+	}
+	at := func(i int) bool { return i >= 0 && i < len(line) && line[i] }
+	finder := []bool{true, false, true, true, true, false, true}
+	for i := 0; i+len(finder) <= len(line); i++ {
+		match := true
+		for k, v := range finder {
+			if line[i+k] != v {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for k := 1; k <= 4; k++ {
+			before = before && !at(i-k)
+			after = after && !at(i+len(finder)-1+k)
+		}
+		if before || after {
+			res += 40
+		}
+	}
+	return res
+}
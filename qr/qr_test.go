@@ -0,0 +1,173 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCapacity(t *testing.T) {
+	// byte mode capacities from the standard
+	for _, c := range []struct {
+		version int
+		level   Level
+		bytes   int
+	}{
+		{1, Low, 17}, {1, Medium, 14}, {1, Quartile, 11}, {1, High, 7},
+		{2, Low, 32}, {7, Medium, 122}, {10, Medium, 213}, {10, High, 119},
+		{40, Low, 2953}, {40, Medium, 2331}, {40, Quartile, 1663}, {40, High, 1273},
+	} {
+		got := (dataCodewords(c.version, c.level)*8 - 4 - countBits(c.version)) / 8
+		if got != c.bytes {
+			t.Errorf("%d-%s: capacity %d, expected %d", c.version, c.level, got, c.bytes)
+		}
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" in 1-M symbol
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(len(expected))); !bytes.Equal(got, expected) {
+		t.Fatalf("error correction codewords %v, expected %v", got, expected)
+	}
+}
+
+func TestFormatVersionInfo(t *testing.T) {
+	for _, c := range []struct {
+		level    Level
+		mask     int
+		expected int
+	}{
+		{Low, 0, 0x77c4}, {Medium, 0, 0x5412}, {Quartile, 7, 0x2bed}, {High, 5, 0x0255},
+	} {
+		if got := formatInfo(c.level, c.mask); got != c.expected {
+			t.Errorf("%s mask %d: format %015b, expected %015b", c.level, c.mask, got, c.expected)
+		}
+	}
+	if got := versionInfo(7); got != 0x07c94 {
+		t.Errorf("version 7: %018b", got)
+	}
+	if got := versionInfo(40); got != 0x28c69 {
+		t.Errorf("version 40: %018b", got)
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	for v, expected := range map[int][]int{
+		1: nil, 2: {6, 18}, 7: {6, 22, 38}, 32: {6, 34, 60, 86, 112, 138}, 36: {6, 24, 50, 76, 102, 128, 154}, 40: {6, 30, 58, 86, 114, 142, 170},
+	} {
+		got := alignmentPositions(v)
+		if len(got) != len(expected) {
+			t.Errorf("version %d: %v, expected %v", v, got, expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("version %d: %v, expected %v", v, got, expected)
+				break
+			}
+		}
+	}
+}
+
+// readCodewords takes codewords back from symbol, it is reverse of drawCodewords with the mask removed.
+func readCodewords(c *Code) []byte {
+	blank := newCode(c.Version, c.Level)
+	var (
+		res []byte
+		cur byte
+		n   int
+	)
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if blank.function[y*c.Size+x] {
+					continue
+				}
+				cur <<= 1
+				if c.Dark(x, y) != masked(c.Mask, x, y) {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					res = append(res, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestEncode(t *testing.T) {
+	key := []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHNvbWUgdGVzdCBrZXkgdGhhdCBpcyBub3QgcmVhbA== user@host")
+	for _, c := range []struct {
+		data    []byte
+		level   Level
+		version int
+	}{
+		{[]byte("HELLO WORLD"), Low, 1},
+		{[]byte("D8B1 5C9F 60A4 3E25 7A84  0E51 1F3C 4B27 9D60 AC12"), Medium, 4},
+		{key, Medium, 6},
+		{bytes.Repeat([]byte{0x5a}, 500), Low, 15},
+	} {
+		code, err := Encode(c.data, c.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Version != c.version || code.Level < c.level {
+			t.Errorf("%d bytes: got %d-%s, expected %d-%s", len(c.data), code.Version, code.Level, c.version, c.level)
+		}
+		if code.Size != code.Version*4+17 {
+			t.Errorf("size %d for version %d", code.Size, code.Version)
+		}
+
+		// format information read from both copies
+		var first, second int
+		for i := 0; i <= 5; i++ {
+			first |= b2i(code.Dark(8, i)) << i
+		}
+		first |= b2i(code.Dark(8, 7))<<6 | b2i(code.Dark(8, 8))<<7 | b2i(code.Dark(7, 8))<<8
+		for i := 9; i < 15; i++ {
+			first |= b2i(code.Dark(14-i, 8)) << i
+		}
+		for i := 0; i < 8; i++ {
+			second |= b2i(code.Dark(code.Size-1-i, 8)) << i
+		}
+		for i := 8; i < 15; i++ {
+			second |= b2i(code.Dark(8, code.Size-15+i)) << i
+		}
+		if expected := formatInfo(code.Level, code.Mask); first != expected || second != expected {
+			t.Errorf("format information %015b and %015b, expected %015b", first, second, expected)
+		}
+
+		blank := newCode(code.Version, code.Level)
+		expected := blank.addECCAndInterleave(encodeSegment(c.data, code.Version, code.Level))
+		if got := readCodewords(code); !bytes.Equal(got[:len(expected)], expected) {
+			t.Errorf("%d bytes: codewords do not match", len(c.data))
+		}
+	}
+}
+
+func TestTooLong(t *testing.T) {
+	if _, err := Encode(make([]byte, 2954), Low); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+	if _, err := Encode(make([]byte, 2953), Low); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
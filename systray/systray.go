@@ -61,6 +61,9 @@ var (
 
 	currentID = uint32(0)
 	quitOnce  sync.Once
+
+	// NotificationClickedCh is notified when user clicks on notification shown by ShowNotification.
+	NotificationClickedCh = make(chan struct{}, 1)
 )
 
 func init() {
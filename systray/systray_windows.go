@@ -271,6 +271,39 @@ func (t *winTray) setTooltip(src string) error {
 	return t.nid.modify()
 }
 
+// Shows balloon notification (toast on Windows 10) near the icon.
+func (t *winTray) showNotification(title, text string) error {
+	const (
+		NIF_INFO  = 0x00000010
+		NIIF_INFO = 0x00000001
+	)
+	bt, err := windows.UTF16FromString(title)
+	if err != nil {
+		return err
+	}
+	bi, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+
+	t.muNID.Lock()
+	defer t.muNID.Unlock()
+	if t.nid == nil {
+		return errors.New("tray icon is not initialized")
+	}
+	t.nid.InfoTitle = [64]uint16{}
+	t.nid.Info = [256]uint16{}
+	copy(t.nid.InfoTitle[:len(t.nid.InfoTitle)-1], bt)
+	copy(t.nid.Info[:len(t.nid.Info)-1], bi)
+	t.nid.InfoFlags = NIIF_INFO
+	t.nid.Flags |= NIF_INFO
+	t.nid.Size = uint32(unsafe.Sizeof(*t.nid))
+	err = t.nid.modify()
+	// do not show it again on subsequent modifications
+	t.nid.Flags &^= NIF_INFO
+	return err
+}
+
 var wt winTray
 
 // WindowProc callback function that processes messages sent to a window.
@@ -324,9 +357,15 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 		t.muNID.Unlock()
 		systrayExit()
 	case t.wmSystrayMessage:
+		const NIN_BALLOONUSERCLICK = 0x0405
 		switch lParam {
 		case WM_RBUTTONUP, WM_LBUTTONUP:
 			t.showMenu()
+		case NIN_BALLOONUSERCLICK:
+			select {
+			case NotificationClickedCh <- struct{}{}:
+			default:
+			}
 		}
 	case t.wmTaskbarCreated: // on explorer.exe restarts
 		t.muNID.Lock()
@@ -934,6 +973,11 @@ func SetIcon(iconBytes []byte) {
 	}
 }
 
+// SetIconFromFile sets the systray icon from .ico file.
+func SetIconFromFile(path string) error {
+	return wt.setIcon(path)
+}
+
 // SetTemplateIcon sets the systray icon as a template icon (on macOS), falling back
 // to a regular icon on other platforms.
 // templateIconBytes and iconBytes should be the content of .ico for windows and
@@ -993,6 +1037,29 @@ func (item *MenuItem) SetIcon(iconBytes []byte) {
 	}
 }
 
+// ShowNotification displays notification with title and text near the systray icon. When user clicks on it
+// NotificationClickedCh is notified.
+func ShowNotification(title, text string) {
+	if err := wt.showNotification(title, text); err != nil {
+		log.Printf("Unable to show notification: %v", err)
+		return
+	}
+}
+
+// RestoreIcon shows tray icon again if shell lost it, for example while session was disconnected.
+func RestoreIcon() {
+	wt.muNID.Lock()
+	defer wt.muNID.Unlock()
+	if wt.nid == nil {
+		return
+	}
+	if err := wt.nid.modify(); err != nil {
+		if err := wt.nid.add(); err != nil {
+			log.Printf("Unable to restore tray icon: %v", err)
+		}
+	}
+}
+
 // SetTooltip sets the systray tooltip to display on mouse hover of the tray icon,
 // only available on Mac and Windows.
 func SetTooltip(tooltip string) {
@@ -0,0 +1,195 @@
+// Package testagent implements minimal in-process replacement for gpg-agent - Assuan protocol on emulated Windows
+// socket file and ssh-agent protocol - with deterministic test keys. It lets integration tests and contributors without
+// GnuPG installation (including non-Windows CI) exercise connectors and relays.
+package testagent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // fake keygrip
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/common"
+	"github.com/rupor-github/win-gpg-agent/assuan/server"
+)
+
+// Version is reported by GETINFO version.
+const Version = "2.2.99-fake"
+
+// seed is used to derive deterministic test key.
+const seed = "win-gpg-agent test key"
+
+// Key returns deterministic ed25519 test key.
+func Key() ed25519.PrivateKey {
+	s := sha256.Sum256([]byte(seed))
+	return ed25519.NewKeyFromSeed(s[:])
+}
+
+// Keygrip returns fake (but stable) keygrip of test key.
+func Keygrip() string {
+	sum := sha1.Sum(Key().Public().(ed25519.PublicKey)) //nolint:gosec // fake keygrip
+	return hex.EncodeToString(sum[:])
+}
+
+// Agent is fake gpg-agent.
+type Agent struct {
+	keyring agent.Agent
+
+	mu      sync.Mutex
+	l       net.Listener
+	nonce   [16]byte
+	sockets []string
+	done    chan struct{}
+	once    sync.Once
+}
+
+// New creates fake agent with test key loaded.
+func New() (*Agent, error) {
+	a := &Agent{keyring: agent.NewKeyring(), done: make(chan struct{})}
+	if err := a.keyring.Add(agent.AddedKey{PrivateKey: Key(), Comment: "win-gpg-agent test key"}); err != nil {
+		return nil, fmt.Errorf("unable to add test key: %w", err)
+	}
+	return a, nil
+}
+
+// PublicKey returns ssh public key of test key in authorized_keys format.
+func PublicKey() string {
+	pk, _ := ssh.NewPublicKey(Key().Public())
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(pk)))
+}
+
+// SSH processes single ssh-agent protocol request (without length prefix) returning response (without length prefix).
+// This is how requests are sent to Pageant, so it could be used in its place.
+func (a *Agent) SSH(req []byte) ([]byte, error) {
+	in := make([]byte, 4, 4+len(req))
+	binary.BigEndian.PutUint32(in, uint32(len(req)))
+	in = append(in, req...)
+
+	var out bytes.Buffer
+	if err := agent.ServeAgent(a.keyring, struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(in), &out}); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if out.Len() < 4 {
+		return nil, errors.New("no response from ssh agent")
+	}
+	return out.Bytes()[4:], nil
+}
+
+// ServeAssuan listens on localhost and writes Windows Assuan socket files (port and nonce) to all paths, as gpg-agent does.
+func (a *Agent) ServeAssuan(paths ...string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := rand.Read(a.nonce[:]); err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("unable to listen: %w", err)
+	}
+	data := append([]byte(strconv.Itoa(l.Addr().(*net.TCPAddr).Port)+"\n"), a.nonce[:]...)
+	for _, p := range paths {
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			l.Close()
+			return fmt.Errorf("unable to write socket file: %w", err)
+		}
+		a.sockets = append(a.sockets, p)
+	}
+	a.l = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go a.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var nonce [16]byte
+	if _, err := io.ReadFull(conn, nonce[:]); err != nil || nonce != a.nonce {
+		log.Print("Fake agent: bad nonce, dropping connection")
+		return
+	}
+	_ = server.Serve(conn, a.proto())
+}
+
+func (a *Agent) proto() server.ProtoInfo {
+	ok := func(*common.Pipe, interface{}, string) error { return nil }
+	return server.ProtoInfo{
+		Greeting: "Pleased to meet you (fake gpg-agent)",
+		Handlers: map[string]server.CommandHandler{
+			"GETINFO": func(pipe *common.Pipe, _ interface{}, params string) error {
+				switch params {
+				case "version":
+					return pipe.WriteData([]byte(Version))
+				case "pid":
+					return pipe.WriteData([]byte(strconv.Itoa(os.Getpid())))
+				}
+				return &common.Error{Src: common.ErrSrcGPGagent, Code: common.ErrAssParameter, SrcName: "gpg-agent", Message: "unknown value for WHAT"}
+			},
+			"KEYINFO": func(pipe *common.Pipe, _ interface{}, params string) error {
+				return pipe.WriteData([]byte(fmt.Sprintf("KEYINFO %s D - - - P - - -\n", Keygrip())))
+			},
+			"HAVEKEY": func(pipe *common.Pipe, _ interface{}, params string) error {
+				if params == Keygrip() {
+					return nil
+				}
+				return &common.Error{Src: common.ErrSrcGPGagent, Code: common.ErrNoSeckey, SrcName: "gpg-agent", Message: "No secret key"}
+			},
+			"RELOADAGENT": ok,
+			"KILLAGENT": func(*common.Pipe, interface{}, string) error {
+				a.once.Do(func() { close(a.done) })
+				return nil
+			},
+		},
+		GetDefaultState: func() interface{} { return nil },
+		SetOption:       func(interface{}, string, string) error { return nil },
+	}
+}
+
+// Done is closed when agent receives KILLAGENT.
+func (a *Agent) Done() <-chan struct{} {
+	return a.done
+}
+
+// Close stops serving Assuan and removes socket files.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.once.Do(func() { close(a.done) })
+	var err error
+	if a.l != nil {
+		err = a.l.Close()
+		a.l = nil
+	}
+	for _, p := range a.sockets {
+		os.Remove(p)
+	}
+	a.sockets = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package testagent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rupor-github/win-gpg-agent/assuan/client"
+)
+
+func TestAssuan(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "S.gpg-agent")
+	if err := a.ServeAssuan(sock); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	conn, err := client.Dial(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ses, err := client.Init(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ses.SimpleCmd("GETINFO", "version")
+	if err != nil || string(data) != Version {
+		t.Fatalf("GETINFO version: %q, %v", data, err)
+	}
+	data, err = ses.SimpleCmd("KEYINFO", "--list --data")
+	if err != nil || !strings.Contains(string(data), Keygrip()) {
+		t.Fatalf("KEYINFO: %q, %v", data, err)
+	}
+	if _, err := ses.SimpleCmd("HAVEKEY", "00"); err == nil {
+		t.Fatal("HAVEKEY of unknown key succeeded")
+	}
+	if _, err := ses.SimpleCmd("KILLAGENT", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-a.Done():
+	default:
+		t.Fatal("KILLAGENT was ignored")
+	}
+}
+
+func TestSSH(t *testing.T) {
+	const (
+		requestIdentities = 11
+		identitiesAnswer  = 12
+	)
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := a.SSH([]byte{requestIdentities})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) < 5 || resp[0] != identitiesAnswer || resp[4] != 1 {
+		t.Fatalf("unexpected identities answer: %v", resp)
+	}
+}
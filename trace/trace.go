@@ -0,0 +1,339 @@
+// Package trace exports spans of relayed operations (client connection, policy decisions, gpg-agent round trips) to
+// OpenTelemetry collector using OTLP/HTTP with JSON encoding, so latency of signing could be broken down. Without
+// exporter every function is cheap no-op.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// batchSize is number of spans which causes immediate export.
+	batchSize = 256
+	// queueSize is number of spans kept while collector is slow or unreachable, newer spans are dropped.
+	queueSize = 4096
+	// flushInterval is how often collected spans are exported.
+	flushInterval = 5 * time.Second
+)
+
+// Span kinds as defined by OTLP.
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+)
+
+// Options describes where spans are exported.
+type Options struct {
+	// Endpoint is OTLP/HTTP traces URL, like http://localhost:4318/v1/traces
+	Endpoint string
+	Headers  map[string]string
+	Service  string
+	Version  string
+	// Client is used for export requests (http.DefaultClient if nil)
+	Client *http.Client
+}
+
+type exporter struct {
+	opts     Options
+	resource []attribute
+	queue    chan *Span
+	dropped  int64
+}
+
+var (
+	mu  sync.RWMutex
+	exp *exporter
+)
+
+// Setup starts exporting spans. Returned function stops export, flushing spans collected by then.
+func Setup(opts Options) (func(), error) {
+	if len(opts.Endpoint) == 0 {
+		return nil, fmt.Errorf("OTLP endpoint is not specified")
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	host, _ := os.Hostname()
+	e := &exporter{
+		opts: opts,
+		resource: []attribute{
+			attr("service.name", opts.Service),
+			attr("service.version", opts.Version),
+			attr("host.name", host),
+			attr("process.pid", strconv.Itoa(os.Getpid())),
+		},
+		queue: make(chan *Span, queueSize),
+	}
+	mu.Lock()
+	exp = e
+	mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.run(ctx)
+	}()
+	log.Printf("Exporting traces to %s", opts.Endpoint)
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// Enabled checks if spans are exported.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return exp != nil
+}
+
+func (e *exporter) run(ctx context.Context) {
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			log.Printf("Unable to export %d spans: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= batchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-ctx.Done():
+			mu.Lock()
+			exp = nil
+			mu.Unlock()
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+					continue
+				default:
+				}
+				break
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		if n := atomic.AddInt64(&e.dropped, 1); n%1000 == 1 {
+			log.Printf("Trace export queue is full, %d spans are dropped so far", n)
+		}
+	}
+}
+
+// OTLP JSON encoding, see opentelemetry-proto trace/v1/trace.proto.
+type (
+	anyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	attribute struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID    string      `json:"traceId"`
+		SpanID     string      `json:"spanId"`
+		ParentID   string      `json:"parentSpanId,omitempty"`
+		Name       string      `json:"name"`
+		Kind       int         `json:"kind"`
+		Start      string      `json:"startTimeUnixNano"`
+		End        string      `json:"endTimeUnixNano"`
+		Attributes []attribute `json:"attributes,omitempty"`
+		Status     *status     `json:"status,omitempty"`
+	}
+)
+
+func attr(k, v string) attribute {
+	return attribute{Key: k, Value: anyValue{StringValue: v}}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *exporter) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.trace[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      nanos(s.start),
+			End:        nanos(s.end),
+			Attributes: s.attrs,
+		}
+		if s.parent != ([8]byte{}) {
+			o.ParentID = hex.EncodeToString(s.parent[:])
+		}
+		if len(s.err) > 0 {
+			o.Status = &status{Code: 2, Message: s.err}
+		}
+		spans = append(spans, o)
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": e.resource},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/rupor-github/win-gpg-agent", "version": e.opts.Version},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.opts.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Span is a timed part of operation. Nil span (tracing is off) ignores everything, so callers never check.
+type Span struct {
+	exp    *exporter
+	trace  [16]byte
+	id     [8]byte
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	err    string
+
+	mu    sync.Mutex
+	attrs []attribute
+}
+
+func newSpan(e *exporter, name string, kind int, start time.Time, kv []string) *Span {
+	s := &Span{exp: e, name: name, kind: kind, start: start}
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs = append(s.attrs, attr(kv[i], kv[i+1]))
+	}
+	return s
+}
+
+// Start begins new trace with root span for operation served to client, kv are attribute key/value pairs.
+func Start(name string, kv ...string) *Span {
+	mu.RLock()
+	e := exp
+	mu.RUnlock()
+	if e == nil {
+		return nil
+	}
+	s := newSpan(e, name, kindServer, time.Now(), kv)
+	if s == nil {
+		return nil
+	}
+	if _, err := rand.Read(s.trace[:]); err != nil {
+		return nil
+	}
+	return s
+}
+
+func (s *Span) child(name string, kind int, start time.Time, kv []string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := newSpan(s.exp, name, kind, start, kv)
+	if c == nil {
+		return nil
+	}
+	c.trace, c.parent = s.trace, s.id
+	return c
+}
+
+// Child begins span for internal step of operation (policy decision, waiting for confirmation).
+func (s *Span) Child(name string, kv ...string) *Span {
+	return s.child(name, kindInternal, time.Now(), kv)
+}
+
+// Upstream begins span for round trip to gpg-agent or other backend.
+func (s *Span) Upstream(name string, kv ...string) *Span {
+	return s.child(name, kindClient, time.Now(), kv)
+}
+
+// Record adds finished round trip to gpg-agent which started at start and ended now.
+func (s *Span) Record(name string, start time.Time, err error, kv ...string) {
+	s.child(name, kindClient, start, kv).End(err)
+}
+
+// Set adds attribute to span.
+func (s *Span) Set(k, v string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attr(k, v))
+	s.mu.Unlock()
+}
+
+// End finishes span, err marks it as failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.exp.enqueue(s)
+}
@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	// disabled tracing does nothing
+	var none *Span
+	none.Child("policy").End(nil)
+	if Start("connection") != nil {
+		t.Fatal("span started without exporter")
+	}
+
+	stop, err := Setup(Options{Endpoint: srv.URL, Service: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := Start("connection", "connector", "test")
+	root.Child("policy").End(errors.New("denied"))
+	root.End(nil)
+	stop()
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	child, parent := spans[0], spans[1]
+	if child.TraceID != parent.TraceID || child.ParentID != parent.SpanID || len(parent.ParentID) != 0 {
+		t.Errorf("spans are not linked: %+v", spans)
+	}
+	if child.Status == nil || child.Status.Code != 2 || parent.Status != nil {
+		t.Errorf("unexpected status: %+v", spans)
+	}
+	if Enabled() {
+		t.Error("exporter is still enabled after stop")
+	}
+}
@@ -0,0 +1,142 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const appContainerMappingsKey = `Software\Classes\Local Settings\Software\Microsoft\Windows\CurrentVersion\AppContainer\Mappings`
+
+var pNetworkIsolationGetAppContainerConfig = windows.NewLazySystemDLL("firewallapi").NewProc("NetworkIsolationGetAppContainerConfig")
+
+// appContainerClientHints are parts of package names which suggest store packaged terminal or ssh client.
+var appContainerClientHints = []string{"ssh", "term", "putty", "shell", "kitty", "git"}
+
+// AppContainer describes store packaged application of current user. Such applications cannot connect to loopback
+// TCP ports unless they are exempted from network isolation.
+type AppContainer struct {
+	SID         string `json:"sid"`
+	Moniker     string `json:"package"`
+	DisplayName string `json:"display_name,omitempty"`
+	Exempt      bool   `json:"loopback_exempt"`
+	// Client is true when package name looks like terminal or ssh client
+	Client bool `json:"likely_client"`
+}
+
+// AppContainers lists application containers of current user with their loopback exemption state, likely terminals
+// and ssh clients first.
+func AppContainers() ([]AppContainer, error) {
+
+	exempt, err := LoopbackExemptions()
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := registry.OpenKey(registry.CURRENT_USER, appContainerMappingsKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		if err == registry.ErrNotExist {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to open AppContainer registry key: %w", err)
+	}
+	defer k.Close()
+
+	sids, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to enumerate AppContainers: %w", err)
+	}
+	var res []AppContainer
+	for _, sid := range sids {
+		ak, err := registry.OpenKey(k, sid, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		ac := AppContainer{SID: sid, Exempt: exempt[strings.ToUpper(sid)]}
+		ac.Moniker, _, _ = ak.GetStringValue("Moniker")
+		// indirect resource strings (@{...}) are not worth resolving
+		if name, _, err := ak.GetStringValue("DisplayName"); err == nil && !strings.HasPrefix(name, "@") {
+			ac.DisplayName = name
+		}
+		ak.Close()
+		if len(ac.Moniker) == 0 {
+			continue
+		}
+		lname := strings.ToLower(ac.Moniker + " " + ac.DisplayName)
+		for _, h := range appContainerClientHints {
+			if strings.Contains(lname, h) {
+				ac.Client = true
+				break
+			}
+		}
+		res = append(res, ac)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Client != res[j].Client {
+			return res[i].Client
+		}
+		return strings.ToLower(res[i].Moniker) < strings.ToLower(res[j].Moniker)
+	})
+	return res, nil
+}
+
+// LoopbackExemptions returns upper case SIDs of application containers which are allowed to use loopback.
+func LoopbackExemptions() (map[string]bool, error) {
+	var (
+		count uint32
+		sids  *windows.SIDAndAttributes
+	)
+	// the list is allocated by firewall API and not freed: it is small and only read by short lived command line verbs
+	if r, _, _ := pNetworkIsolationGetAppContainerConfig.Call(uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&sids))); r != 0 {
+		return nil, fmt.Errorf("NetworkIsolationGetAppContainerConfig: %w", windows.Errno(r))
+	}
+	res := make(map[string]bool, count)
+	if count == 0 || sids == nil {
+		return res, nil
+	}
+	for _, sa := range unsafe.Slice(sids, count) {
+		if sa.Sid != nil {
+			res[strings.ToUpper(sa.Sid.String())] = true
+		}
+	}
+	return res, nil
+}
+
+// ExemptFromLoopbackIsolation lets application containers with SIDs use loopback. This requires administrative
+// rights, so CheckNetIsolation.exe is started elevated (single UAC prompt is shown) and exemptions are waited for.
+func ExemptFromLoopbackIsolation(sids []string) error {
+	cmds := make([]string, 0, len(sids))
+	for _, sid := range sids {
+		if _, err := windows.StringToSid(sid); err != nil {
+			return fmt.Errorf("bad AppContainer SID %s: %w", sid, err)
+		}
+		cmds = append(cmds, "CheckNetIsolation.exe LoopbackExempt -a -p="+sid)
+	}
+	args := "/c " + strings.Join(cmds, " & ")
+	if err := windows.ShellExecute(0, windows.StringToUTF16Ptr("runas"), windows.StringToUTF16Ptr("cmd.exe"), windows.StringToUTF16Ptr(args), nil, windows.SW_HIDE); err != nil {
+		return fmt.Errorf("unable to run elevated CheckNetIsolation.exe: %w", err)
+	}
+	var missing []string
+	for i := 0; i < 100; i++ {
+		exempt, err := LoopbackExemptions()
+		if err != nil {
+			return err
+		}
+		missing = missing[:0]
+		for _, sid := range sids {
+			if !exempt[strings.ToUpper(sid)] {
+				missing = append(missing, sid)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s still not exempted from loopback isolation", strings.Join(missing, ", "))
+}
@@ -0,0 +1,314 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	queueClass     = "win-gpg-agent-approvals"
+	queueList      = 200
+	queueAllow     = 201
+	queueDeny      = 202
+	queueAllowProc = 203
+	queueDenyAll   = 204
+	queueAlways    = 205
+	queueBtnW      = 150
+	queueBtnH      = 30
+	queueGap       = 8
+	queueWidth     = 5*queueBtnW + 6*queueGap
+	queueListH     = 220
+	// queueRefresh is posted to window when pending approvals change
+	queueRefresh = win.WM_APP + 1
+)
+
+// ApprovalDecision is user answer to confirmation in approval queue window.
+type ApprovalDecision int
+
+// Possible decisions.
+const (
+	ApprovalDenied ApprovalDecision = iota
+	ApprovalAllowed
+	// allowed and should be remembered
+	ApprovalAlways
+)
+
+// approval is pending confirmation waiting in queue window.
+type approval struct {
+	text     string
+	process  string
+	remember bool
+	answer   chan ApprovalDecision
+}
+
+// approvalQueue is state of the only approval queue window agent could show. Window is created with first pending
+// approval and destroyed when the last one is answered.
+type approvalQueue struct {
+	mu      sync.Mutex
+	items   []*approval
+	wnd     win.HWND
+	list    win.HWND
+	running bool
+	// processes user allowed everything from while window is shown
+	allowed map[string]bool
+}
+
+var (
+	queueOnce sync.Once
+	queueErr  error
+	queue     = &approvalQueue{}
+)
+
+// AskApproval adds confirmation to the approval queue window and waits for user decision. Process identifies client,
+// so "Allow all from process" answers every pending and new confirmation with the same value until window is closed
+// (empty process is never grouped). With remember set "Always allow" answer is accepted for confirmation, otherwise
+// it is the same as "Allow". Confirmation is denied when it is not answered in timeout.
+func AskApproval(text, process string, remember bool, timeout time.Duration) (ApprovalDecision, error) {
+	queueOnce.Do(func() { queueErr = registerQueueClass() })
+	if queueErr != nil {
+		return ApprovalDenied, fmt.Errorf("unable to register approval queue window class: %w", queueErr)
+	}
+
+	a := &approval{text: text, process: process, remember: remember, answer: make(chan ApprovalDecision, 1)}
+
+	q := queue
+	q.mu.Lock()
+	if len(process) > 0 && q.allowed[process] {
+		q.mu.Unlock()
+		return ApprovalAllowed, nil
+	}
+	q.items = append(q.items, a)
+	if q.running {
+		// window which is still being created shows all items anyway
+		if q.wnd != 0 {
+			win.PostMessage(q.wnd, queueRefresh, 0, 0)
+		}
+	} else {
+		q.running = true
+		go q.run()
+	}
+	q.mu.Unlock()
+
+	select {
+	case d := <-a.answer:
+		return d, nil
+	case <-time.After(timeout):
+	}
+	q.mu.Lock()
+	q.remove(a)
+	q.mu.Unlock()
+	// answer could have been given right before removal
+	select {
+	case d := <-a.answer:
+		return d, nil
+	default:
+	}
+	return ApprovalDenied, nil
+}
+
+// remove drops approval from queue and refreshes window, should be called with lock held.
+func (q *approvalQueue) remove(a *approval) {
+	for i, v := range q.items {
+		if v == a {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	if q.wnd != 0 {
+		win.PostMessage(q.wnd, queueRefresh, 0, 0)
+	}
+}
+
+// answer gives decision to approvals selected by pick, should be called with lock held.
+func (q *approvalQueue) answer(d ApprovalDecision, pick func(i int, a *approval) bool) {
+	rest := q.items[:0]
+	for i, a := range q.items {
+		if pick(i, a) {
+			if d == ApprovalAlways && !a.remember {
+				a.answer <- ApprovalAllowed
+			} else {
+				a.answer <- d
+			}
+			continue
+		}
+		rest = append(rest, a)
+	}
+	q.items = rest
+}
+
+func queueWndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	q := queue
+	switch msg {
+	case queueRefresh:
+		q.refresh()
+		return 0
+	case win.WM_COMMAND:
+		id, code := int(win.LOWORD(uint32(wParam))), win.HIWORD(uint32(wParam))
+		if id == queueList && code == win.LBN_DBLCLK {
+			id = queueAllow
+		} else if code != win.BN_CLICKED {
+			break
+		}
+		sel := int(int32(win.SendMessage(q.list, win.LB_GETCURSEL, 0, 0)))
+		q.mu.Lock()
+		switch id {
+		case queueAllow:
+			q.answer(ApprovalAllowed, func(i int, _ *approval) bool { return i == sel })
+		case queueAlways:
+			q.answer(ApprovalAlways, func(i int, _ *approval) bool { return i == sel })
+		case queueDeny:
+			q.answer(ApprovalDenied, func(i int, _ *approval) bool { return i == sel })
+		case queueAllowProc:
+			if sel >= 0 && sel < len(q.items) {
+				proc := q.items[sel].process
+				if len(proc) > 0 {
+					q.allowed[proc] = true
+					log.Printf("Allowing all requests from %s while approval queue is shown", proc)
+				}
+				q.answer(ApprovalAllowed, func(i int, a *approval) bool { return i == sel || (len(proc) > 0 && a.process == proc) })
+			}
+		case queueDenyAll:
+			q.answer(ApprovalDenied, func(int, *approval) bool { return true })
+		default:
+		}
+		q.mu.Unlock()
+		q.refresh()
+		return 0
+	case win.WM_CLOSE:
+		// closing window denies everything still pending
+		q.mu.Lock()
+		q.answer(ApprovalDenied, func(int, *approval) bool { return true })
+		q.mu.Unlock()
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		win.PostQuitMessage(0)
+		return 0
+	default:
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+// refresh shows pending approvals, window is closed when there are none left.
+func (q *approvalQueue) refresh() {
+	q.mu.Lock()
+	texts := make([]string, 0, len(q.items))
+	for _, a := range q.items {
+		texts = append(texts, a.text)
+	}
+	q.mu.Unlock()
+
+	if len(texts) == 0 {
+		win.DestroyWindow(q.wnd)
+		return
+	}
+	sel := int32(win.SendMessage(q.list, win.LB_GETCURSEL, 0, 0))
+	win.SendMessage(q.list, win.LB_RESETCONTENT, 0, 0)
+	for _, t := range texts {
+		win.SendMessage(q.list, win.LB_ADDSTRING, 0, uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(t))))
+	}
+	if sel < 0 || int(sel) >= len(texts) {
+		sel = 0
+	}
+	win.SendMessage(q.list, win.LB_SETCURSEL, uintptr(sel), 0)
+	setText(q.wnd, fmt.Sprintf("%s - %d pending approval(s)", WinAgentName, len(texts)))
+}
+
+func registerQueueClass() error {
+	wc := win.WNDCLASSEX{
+		HInstance:     win.GetModuleHandle(nil),
+		LpszClassName: windows.StringToUTF16Ptr(queueClass),
+		LpfnWndProc:   windows.NewCallback(queueWndProc),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	if a := win.RegisterClassEx(&wc); a == 0 {
+		return windows.GetLastError()
+	}
+	return nil
+}
+
+func (q *approvalQueue) child(class, text string, style uint32, id, x, y, w, h int32) win.HWND {
+	hwnd := win.CreateWindowEx(0, windows.StringToUTF16Ptr(class), windows.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, w, h, q.wnd, win.HMENU(id), win.GetModuleHandle(nil), nil)
+	win.SendMessage(hwnd, win.WM_SETFONT, uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)), 1)
+	return hwnd
+}
+
+// run shows queue window and pumps its messages until all approvals are answered.
+func (q *approvalQueue) run() {
+	defer HandlePanic()
+
+	// window messages are delivered to the thread which created window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var (
+		height = queueGap + queueListH + queueGap + queueBtnH + queueGap
+		frameW = int32(win.GetSystemMetrics(win.SM_CXFIXEDFRAME))*2 + 2
+		frameH = int32(win.GetSystemMetrics(win.SM_CYFIXEDFRAME)*2 + win.GetSystemMetrics(win.SM_CYCAPTION))
+		w, h   = int32(queueWidth) + frameW, int32(height) + frameH
+		x      = (win.GetSystemMetrics(win.SM_CXSCREEN) - w) / 2
+		y      = (win.GetSystemMetrics(win.SM_CYSCREEN) - h) / 2
+	)
+	wnd := win.CreateWindowEx(win.WS_EX_DLGMODALFRAME|win.WS_EX_TOPMOST, windows.StringToUTF16Ptr(queueClass), windows.StringToUTF16Ptr(WinAgentName),
+		win.WS_CAPTION|win.WS_SYSMENU, x, y, w, h, 0, 0, win.GetModuleHandle(nil), nil)
+	if wnd == 0 {
+		log.Printf("Unable to create approval queue window: %s", windows.GetLastError())
+		q.mu.Lock()
+		q.answer(ApprovalDenied, func(int, *approval) bool { return true })
+		q.running = false
+		q.mu.Unlock()
+		return
+	}
+
+	q.mu.Lock()
+	q.wnd = wnd
+	q.allowed = make(map[string]bool)
+	q.list = q.child("LISTBOX", "", win.LBS_NOTIFY|win.WS_BORDER|win.WS_VSCROLL|win.WS_TABSTOP, queueList, queueGap, queueGap, queueWidth-2*queueGap, queueListH)
+	q.mu.Unlock()
+
+	top := int32(queueGap + queueListH + queueGap)
+	for i, b := range []struct {
+		id    int32
+		title string
+	}{{queueAllow, "Allow"}, {queueAlways, "Always allow"}, {queueDeny, "Deny"}, {queueAllowProc, "Allow all from process"}, {queueDenyAll, "Deny all"}} {
+		style := uint32(win.WS_TABSTOP)
+		if b.id == queueDeny {
+			style |= win.BS_DEFPUSHBUTTON
+		}
+		q.child("BUTTON", b.title, style, b.id, queueGap+int32(i)*(queueBtnW+queueGap), top, queueBtnW, queueBtnH)
+	}
+	q.refresh()
+
+	win.ShowWindow(wnd, win.SW_SHOWNORMAL)
+	win.SetFocus(q.list)
+	win.SetForegroundWindow(wnd)
+
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		if win.IsDialogMessage(wnd, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wnd, q.list, q.allowed = 0, 0, nil
+	if len(q.items) > 0 {
+		// approvals arrived while window was closing
+		go q.run()
+		return
+	}
+	q.running = false
+}
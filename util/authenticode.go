@@ -0,0 +1,166 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modWinTrust                           = windows.NewLazySystemDLL("wintrust")
+	pWTHelperProvDataFromStateData        = modWinTrust.NewProc("WTHelperProvDataFromStateData")
+	pWTHelperGetProvSignerFromChain       = modWinTrust.NewProc("WTHelperGetProvSignerFromChain")
+	pWTHelperGetProvCertFromChain         = modWinTrust.NewProc("WTHelperGetProvCertFromChain")
+	pCryptCATAdminAcquireContext2         = modWinTrust.NewProc("CryptCATAdminAcquireContext2")
+	pCryptCATAdminReleaseContext          = modWinTrust.NewProc("CryptCATAdminReleaseContext")
+	pCryptCATAdminCalcHashFromFileHandle2 = modWinTrust.NewProc("CryptCATAdminCalcHashFromFileHandle2")
+	pCryptCATAdminEnumCatalogFromHash     = modWinTrust.NewProc("CryptCATAdminEnumCatalogFromHash")
+	pCryptCATAdminReleaseCatalogContext   = modWinTrust.NewProc("CryptCATAdminReleaseCatalogContext")
+	pCryptCATCatalogInfoFromContext       = modWinTrust.NewProc("CryptCATCatalogInfoFromContext")
+)
+
+// Signature describes result of Authenticode verification.
+type Signature struct {
+	Publisher string
+	Catalog   bool // signed by Windows catalog rather than embedded signature
+}
+
+type cryptProviderCert struct {
+	Size uint32
+	Cert *windows.CertContext
+}
+
+type wintrustCatalogInfo struct {
+	Size           uint32
+	CatalogVersion uint32
+	CatalogPath    *uint16
+	MemberTag      *uint16
+	MemberPath     *uint16
+	MemberFile     windows.Handle
+	Hash           *byte
+	HashSize       uint32
+	CatalogContext uintptr
+	CatAdmin       windows.Handle
+}
+
+type catalogInfo struct {
+	Size        uint32
+	CatalogFile [windows.MAX_PATH]uint16
+}
+
+// VerifyAuthenticode checks that file has valid Authenticode signature (embedded or from system catalog) and returns
+// signer name. Revocation is not checked, so verification works offline.
+func VerifyAuthenticode(fname string) (*Signature, error) {
+	path, err := windows.UTF16PtrFromString(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi := &windows.WinTrustFileInfo{Size: uint32(unsafe.Sizeof(windows.WinTrustFileInfo{})), FilePath: path}
+	publisher, err := winVerifyTrust(windows.WTD_CHOICE_FILE, unsafe.Pointer(fi))
+	if err == nil {
+		return &Signature{Publisher: publisher}, nil
+	}
+	if !errors.Is(err, windows.Errno(windows.TRUST_E_NOSIGNATURE)) {
+		return nil, fmt.Errorf("bad signature on %s: %w", fname, err)
+	}
+	// many Windows binaries (OpenSSH client among them) do not carry signature and are signed by catalog instead
+	if publisher, err = verifyCatalog(fname); err != nil {
+		return nil, fmt.Errorf("%s is not signed: %w", fname, err)
+	}
+	return &Signature{Publisher: publisher, Catalog: true}, nil
+}
+
+func winVerifyTrust(choice uint32, info unsafe.Pointer) (string, error) {
+	data := &windows.WinTrustData{
+		Size:                            uint32(unsafe.Sizeof(windows.WinTrustData{})),
+		UIChoice:                        windows.WTD_UI_NONE,
+		RevocationChecks:                windows.WTD_REVOKE_NONE,
+		UnionChoice:                     choice,
+		FileOrCatalogOrBlobOrSgnrOrCert: info,
+		StateAction:                     windows.WTD_STATEACTION_VERIFY,
+		ProvFlags:                       windows.WTD_REVOCATION_CHECK_NONE | windows.WTD_CACHE_ONLY_URL_RETRIEVAL,
+	}
+	err := windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	defer func() {
+		data.StateAction = windows.WTD_STATEACTION_CLOSE
+		_ = windows.WinVerifyTrustEx(windows.InvalidHWND, &windows.WINTRUST_ACTION_GENERIC_VERIFY_V2, data)
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	prov, _, _ := pWTHelperProvDataFromStateData.Call(uintptr(data.StateData))
+	if prov == 0 {
+		return "", errors.New("no provider data")
+	}
+	sgnr, _, _ := pWTHelperGetProvSignerFromChain.Call(prov, 0, 0, 0)
+	if sgnr == 0 {
+		return "", errors.New("no signer")
+	}
+	pc, _, _ := pWTHelperGetProvCertFromChain.Call(sgnr, 0)
+	if pc == 0 {
+		return "", errors.New("no signer certificate")
+	}
+	// memory is owned by wintrust state data and stays valid until it is closed
+	cert := (*(**cryptProviderCert)(unsafe.Pointer(&pc))).Cert
+
+	const certNameSimpleDisplayType = 4
+	n := windows.CertGetNameString(cert, certNameSimpleDisplayType, 0, nil, nil, 0)
+	if n <= 1 {
+		return "", errors.New("unable to get signer name")
+	}
+	buf := make([]uint16, n)
+	windows.CertGetNameString(cert, certNameSimpleDisplayType, 0, nil, &buf[0], n)
+	return windows.UTF16ToString(buf), nil
+}
+
+func verifyCatalog(fname string) (string, error) {
+	alg, _ := windows.UTF16PtrFromString("SHA256")
+	var admin windows.Handle
+	if r, _, err := pCryptCATAdminAcquireContext2.Call(uintptr(unsafe.Pointer(&admin)), 0, uintptr(unsafe.Pointer(alg)), 0, 0); r == 0 {
+		return "", fmt.Errorf("CryptCATAdminAcquireContext2: %w", err)
+	}
+	defer pCryptCATAdminReleaseContext.Call(uintptr(admin), 0) //nolint:errcheck
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := make([]byte, 64)
+	size := uint32(len(hash))
+	if r, _, err := pCryptCATAdminCalcHashFromFileHandle2.Call(uintptr(admin), f.Fd(), uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&hash[0])), 0); r == 0 {
+		return "", fmt.Errorf("CryptCATAdminCalcHashFromFileHandle2: %w", err)
+	}
+	hash = hash[:size]
+
+	cat, _, err := pCryptCATAdminEnumCatalogFromHash.Call(uintptr(admin), uintptr(unsafe.Pointer(&hash[0])), uintptr(size), 0, 0)
+	if cat == 0 {
+		return "", windows.Errno(windows.TRUST_E_NOSIGNATURE)
+	}
+	defer pCryptCATAdminReleaseCatalogContext.Call(uintptr(admin), cat, 0) //nolint:errcheck
+
+	ci := catalogInfo{Size: uint32(unsafe.Sizeof(catalogInfo{}))}
+	if r, _, err := pCryptCATCatalogInfoFromContext.Call(cat, uintptr(unsafe.Pointer(&ci)), 0); r == 0 {
+		return "", fmt.Errorf("CryptCATCatalogInfoFromContext: %w", err)
+	}
+
+	tag, _ := windows.UTF16PtrFromString(strings.ToUpper(fmt.Sprintf("%x", hash)))
+	member, _ := windows.UTF16PtrFromString(fname)
+	info := &wintrustCatalogInfo{
+		Size:        uint32(unsafe.Sizeof(wintrustCatalogInfo{})),
+		CatalogPath: &ci.CatalogFile[0],
+		MemberTag:   tag,
+		MemberPath:  member,
+		MemberFile:  windows.Handle(f.Fd()),
+		Hash:        &hash[0],
+		HashSize:    size,
+		CatAdmin:    admin,
+	}
+	return winVerifyTrust(windows.WTD_CHOICE_CATALOG, unsafe.Pointer(info))
+}
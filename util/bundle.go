@@ -0,0 +1,95 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Passphrase protected bundle is: magic, salt, nonce and XChaCha20-Poly1305 ciphertext with key derived by
+// PBKDF2-HMAC-SHA256. Unlike DPAPI it could be opened on another machine.
+const (
+	bundleMagic      = "win-gpg-agent bundle v1\n"
+	bundleSaltSize   = 16
+	bundleIterations = 600000
+)
+
+// ErrBundlePassphrase is returned when bundle could not be opened with given passphrase.
+var ErrBundlePassphrase = errors.New("wrong passphrase or damaged bundle")
+
+// pbkdf2 derives key of keyLen bytes from passphrase (RFC 8018) with HMAC-SHA256.
+func pbkdf2(pass, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	var (
+		key   = make([]byte, 0, keyLen)
+		u     = make([]byte, 0, prf.Size())
+		t     = make([]byte, prf.Size())
+		index [4]byte
+	)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(index[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// SealBundle encrypts data with passphrase.
+func SealBundle(data, pass []byte) ([]byte, error) {
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	salt := make([]byte, bundleSaltSize)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(pbkdf2(pass, salt, bundleIterations, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(bundleMagic), salt...)
+	out = append(out, nonce...)
+	// header is authenticated too
+	return aead.Seal(out, nonce, data, out), nil
+}
+
+// OpenBundle decrypts data sealed with SealBundle.
+func OpenBundle(data, pass []byte) ([]byte, error) {
+	header := len(bundleMagic) + bundleSaltSize + chacha20poly1305.NonceSizeX
+	if len(data) < header+chacha20poly1305.Overhead || !bytes.HasPrefix(data, []byte(bundleMagic)) {
+		return nil, fmt.Errorf("not a %s bundle", WinAgentName)
+	}
+	salt := data[len(bundleMagic) : len(bundleMagic)+bundleSaltSize]
+	nonce := data[len(bundleMagic)+bundleSaltSize : header]
+	aead, err := chacha20poly1305.NewX(pbkdf2(pass, salt, bundleIterations, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, data[header:], data[:header])
+	if err != nil {
+		return nil, ErrBundlePassphrase
+	}
+	return plain, nil
+}
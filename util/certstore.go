@@ -0,0 +1,187 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modNCrypt         = windows.NewLazySystemDLL("ncrypt")
+	pNCryptSignHash   = modNCrypt.NewProc("NCryptSignHash")
+	pNCryptFreeObject = modNCrypt.NewProc("NCryptFreeObject")
+)
+
+const (
+	bcryptPadPKCS1 = 0x2
+	bcryptPadPSS   = 0x8
+)
+
+type bcryptPKCS1PaddingInfo struct {
+	algID *uint16
+}
+
+type bcryptPSSPaddingInfo struct {
+	algID *uint16
+	salt  uint32
+}
+
+// ncryptKey is crypto.Signer for private key kept by CNG key storage provider, key material never leaves it.
+type ncryptKey struct {
+	h   uintptr
+	pub crypto.PublicKey
+}
+
+func (k *ncryptKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func hashAlgID(h crypto.Hash) (*uint16, error) {
+	var name string
+	switch h {
+	case crypto.SHA1:
+		name = "SHA1"
+	case crypto.SHA256:
+		name = "SHA256"
+	case crypto.SHA384:
+		name = "SHA384"
+	case crypto.SHA512:
+		name = "SHA512"
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %v", h)
+	}
+	return windows.UTF16PtrFromString(name)
+}
+
+func (k *ncryptKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	var (
+		padding unsafe.Pointer
+		flags   uintptr
+	)
+	if _, ok := k.pub.(*rsa.PublicKey); ok {
+		alg, err := hashAlgID(opts.HashFunc())
+		if err != nil {
+			return nil, err
+		}
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			salt := pss.SaltLength
+			if salt <= 0 {
+				salt = opts.HashFunc().Size()
+			}
+			padding, flags = unsafe.Pointer(&bcryptPSSPaddingInfo{algID: alg, salt: uint32(salt)}), bcryptPadPSS
+		} else {
+			padding, flags = unsafe.Pointer(&bcryptPKCS1PaddingInfo{algID: alg}), bcryptPadPKCS1
+		}
+	}
+
+	var size uint32
+	if r, _, _ := pNCryptSignHash.Call(k.h, uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		0, 0, uintptr(unsafe.Pointer(&size)), flags); r != 0 {
+		return nil, fmt.Errorf("NCryptSignHash failed: 0x%08X", uint32(r))
+	}
+	sig := make([]byte, size)
+	if r, _, _ := pNCryptSignHash.Call(k.h, uintptr(padding), uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&sig[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), flags); r != 0 {
+		return nil, fmt.Errorf("NCryptSignHash failed: 0x%08X", uint32(r))
+	}
+	runtime.KeepAlive(padding)
+	sig = sig[:size]
+
+	if _, ok := k.pub.(*ecdsa.PublicKey); ok {
+		// CNG returns r|s, Go expects ASN.1 sequence
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])})
+	}
+	return sig, nil
+}
+
+func certBytes(ctx *windows.CertContext) []byte {
+	return append([]byte(nil), unsafe.Slice(ctx.EncodedCert, ctx.Length)...)
+}
+
+// StoreCertificate looks up certificate in current user system store (e.g. "My") by its SHA1 thumbprint (hex) or
+// subject substring and returns it with private key suitable for TLS.
+func StoreCertificate(store, name string) (*tls.Certificate, error) {
+
+	if len(name) == 0 {
+		return nil, errors.New("certificate name is empty")
+	}
+
+	hs, err := windows.CertOpenSystemStore(0, windows.StringToUTF16Ptr(store))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open certificate store %s: %w", store, err)
+	}
+	defer windows.CertCloseStore(hs, 0) //nolint:errcheck
+
+	const encoding = windows.X509_ASN_ENCODING | windows.PKCS_7_ASN_ENCODING
+
+	var ctx *windows.CertContext
+	if thumb, err := hex.DecodeString(name); err == nil && len(thumb) == 20 {
+		blob := windows.CryptHashBlob{Size: uint32(len(thumb)), Data: &thumb[0]}
+		ctx, err = windows.CertFindCertificateInStore(hs, encoding, 0, windows.CERT_FIND_HASH, unsafe.Pointer(&blob), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find certificate %s in store %s: %w", name, store, err)
+		}
+	} else {
+		ctx, err = windows.CertFindCertificateInStore(hs, encoding, 0, windows.CERT_FIND_SUBJECT_STR, unsafe.Pointer(windows.StringToUTF16Ptr(name)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find certificate \"%s\" in store %s: %w", name, store, err)
+		}
+	}
+	defer windows.CertFreeCertificateContext(ctx) //nolint:errcheck
+
+	der := certBytes(ctx)
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate \"%s\": %w", name, err)
+	}
+
+	var (
+		h        windows.Handle
+		spec     uint32
+		mustFree bool
+	)
+	if err := windows.CryptAcquireCertificatePrivateKey(ctx, windows.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG, nil, &h, &spec, &mustFree); err != nil {
+		return nil, fmt.Errorf("unable to access private key of certificate \"%s\": %w", name, err)
+	}
+	key := &ncryptKey{h: uintptr(h), pub: leaf.PublicKey}
+	if mustFree {
+		runtime.SetFinalizer(key, func(k *ncryptKey) { _, _, _ = pNCryptFreeObject.Call(k.h) })
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// StoreCertPool returns all certificates from current user system store (e.g. "Root") as x509.CertPool.
+func StoreCertPool(store string) (*x509.CertPool, error) {
+
+	hs, err := windows.CertOpenSystemStore(0, windows.StringToUTF16Ptr(store))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open certificate store %s: %w", store, err)
+	}
+	defer windows.CertCloseStore(hs, 0) //nolint:errcheck
+
+	pool := x509.NewCertPool()
+	var ctx *windows.CertContext
+	for {
+		if ctx, err = windows.CertEnumCertificatesInStore(hs, ctx); err != nil || ctx == nil {
+			break
+		}
+		if c, err := x509.ParseCertificate(certBytes(ctx)); err == nil {
+			pool.AddCert(c)
+		}
+	}
+	return pool, nil
+}
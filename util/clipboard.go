@@ -0,0 +1,198 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	pGetClipboardSequenceNumber = modUser32.NewProc("GetClipboardSequenceNumber")
+	pRegisterClipboardFormat    = modUser32.NewProc("RegisterClipboardFormatW")
+	pGlobalSize                 = kernel.NewProc("GlobalSize")
+)
+
+// Standard clipboard formats we know how to handle.
+const (
+	CF_DIB         = 8
+	CF_UNICODETEXT = 13
+)
+
+// ClipboardSequenceNumber returns clipboard sequence number for the current window station, it changes every time clipboard content changes.
+func ClipboardSequenceNumber() uint32 {
+	r, _, _ := pGetClipboardSequenceNumber.Call()
+	return uint32(r)
+}
+
+// ClipboardFormat converts format name (text, dib, png, html) to Windows clipboard format identifier, returning 0 for unknown names.
+func ClipboardFormat(name string) uint32 {
+	var reg string
+	switch strings.ToLower(name) {
+	case "text":
+		return CF_UNICODETEXT
+	case "dib":
+		return CF_DIB
+	case "png":
+		reg = "PNG"
+	case "html":
+		reg = "HTML Format"
+	default:
+		return 0
+	}
+	r, _, _ := pRegisterClipboardFormat.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(reg))))
+	return uint32(r)
+}
+
+// openClipboard retries since clipboard could be temporarily held by another process.
+func openClipboard() error {
+	for i := 0; i < 10; i++ {
+		if win.OpenClipboard(0) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("unable to open clipboard")
+}
+
+// ReadClipboard returns raw clipboard content in requested format.
+func ReadClipboard(format uint32) ([]byte, error) {
+
+	// clipboard ownership is per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := openClipboard(); err != nil {
+		return nil, err
+	}
+	defer win.CloseClipboard()
+
+	if !win.IsClipboardFormatAvailable(format) {
+		return nil, fmt.Errorf("clipboard format %d is not available", format)
+	}
+	h := win.GetClipboardData(format)
+	if h == 0 {
+		return nil, fmt.Errorf("unable to get clipboard data in format %d", format)
+	}
+	size, _, _ := pGlobalSize.Call(uintptr(h))
+	p := win.GlobalLock(win.HGLOBAL(h))
+	if p == nil {
+		return nil, fmt.Errorf("unable to lock clipboard data in format %d", format)
+	}
+	defer win.GlobalUnlock(win.HGLOBAL(h))
+
+	data := make([]byte, size)
+	copy(data, unsafe.Slice((*byte)(p), size))
+	return data, nil
+}
+
+// WriteClipboard replaces clipboard content with raw data in requested format.
+func WriteClipboard(format uint32, data []byte) error {
+
+	// clipboard ownership is per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := openClipboard(); err != nil {
+		return err
+	}
+	defer win.CloseClipboard()
+
+	if !win.EmptyClipboard() {
+		return fmt.Errorf("unable to empty clipboard")
+	}
+	h := win.GlobalAlloc(win.GMEM_MOVEABLE, uintptr(len(data)))
+	if h == 0 {
+		return fmt.Errorf("unable to allocate %d bytes for clipboard", len(data))
+	}
+	p := win.GlobalLock(h)
+	if p == nil {
+		return fmt.Errorf("unable to lock clipboard memory")
+	}
+	copy(unsafe.Slice((*byte)(p), len(data)), data)
+	win.GlobalUnlock(h)
+
+	if win.SetClipboardData(format, win.HANDLE(h)) == 0 {
+		// on success system owns memory, otherwise it is on us
+		win.GlobalFree(h)
+		return fmt.Errorf("unable to set clipboard data in format %d", format)
+	}
+	return nil
+}
+
+// clipboardClass is window class of clipboard listener.
+const clipboardClass = "win-gpg-agent-clipboard"
+
+// ClipboardChanges reports clipboard content changes until ctx is canceled using clipboard format listener on hidden
+// message-only window, so nothing has to be polled. Changes coming faster than they are received are coalesced,
+// channel is closed when listening stops.
+func ClipboardChanges(ctx context.Context) (<-chan struct{}, error) {
+
+	ch := make(chan struct{}, 1)
+	ready := make(chan error, 1)
+	go func() {
+		// window messages are delivered to the thread which created it
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(ch)
+
+		proc := func(hwnd win.HWND, msg uint32, wparam, lparam uintptr) uintptr {
+			switch msg {
+			case win.WM_CLIPBOARDUPDATE:
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+				return 0
+			case win.WM_DESTROY:
+				win.PostQuitMessage(0)
+				return 0
+			default:
+			}
+			return win.DefWindowProc(hwnd, msg, wparam, lparam)
+		}
+		wc := win.WNDCLASSEX{
+			HInstance:     win.GetModuleHandle(nil),
+			LpszClassName: windows.StringToUTF16Ptr(clipboardClass),
+			LpfnWndProc:   windows.NewCallback(proc),
+		}
+		wc.CbSize = uint32(unsafe.Sizeof(wc))
+		if a := win.RegisterClassEx(&wc); a == 0 {
+			ready <- fmt.Errorf("unable to RegisterClassEx for %s", clipboardClass)
+			return
+		}
+		defer win.UnregisterClass(wc.LpszClassName)
+
+		hwnd := win.CreateWindowEx(0, wc.LpszClassName, wc.LpszClassName, 0, 0, 0, 0, 0, win.HWND_MESSAGE, 0, wc.HInstance, nil)
+		if hwnd == 0 {
+			ready <- fmt.Errorf("unable to CreateWindowEx for %s", clipboardClass)
+			return
+		}
+		// listener is removed when window is destroyed
+		if !win.AddClipboardFormatListener(hwnd) {
+			win.DestroyWindow(hwnd)
+			ready <- fmt.Errorf("unable to AddClipboardFormatListener")
+			return
+		}
+		ready <- nil
+
+		go func() {
+			<-ctx.Done()
+			win.PostMessage(hwnd, win.WM_CLOSE, 0, 0)
+		}()
+		var msg win.MSG
+		for win.GetMessage(&msg, 0, 0, 0) > 0 {
+			win.TranslateMessage(&msg)
+			win.DispatchMessage(&msg)
+		}
+	}()
+	if err := <-ready; err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var pWideCharToMultiByte = kernel.NewProc("WideCharToMultiByte")
+
+// CodePageUTF8 is Windows code page identifier for UTF-8.
+const CodePageUTF8 = 65001
+
+var codePages = map[string]uint32{
+	"utf-8":      CodePageUTF8,
+	"utf8":       CodePageUTF8,
+	"latin1":     28591,
+	"iso-8859-1": 28591,
+	"cp1252":     1252,
+	"cp1251":     1251,
+	"cp866":      866,
+	"koi8-r":     20866,
+	"cp437":      437,
+}
+
+// CodePage converts encoding name (utf-8, latin1, cp1252, koi8-r... or numeric Windows code page) to code page
+// identifier. Empty name means UTF-8.
+func CodePage(name string) (uint32, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 {
+		return CodePageUTF8, nil
+	}
+	if cp, ok := codePages[name]; ok {
+		return cp, nil
+	}
+	if cp, err := strconv.ParseUint(strings.TrimPrefix(name, "cp"), 10, 16); err == nil {
+		return uint32(cp), nil
+	}
+	return 0, fmt.Errorf("unknown encoding \"%s\"", name)
+}
+
+// DecodeCodePage converts text in code page cp to Go string. Invalid UTF-8 sequences are replaced rather than passed on.
+func DecodeCodePage(data []byte, cp uint32) (string, error) {
+	if cp == CodePageUTF8 || len(data) == 0 {
+		return strings.ToValidUTF8(string(data), "\uFFFD"), nil
+	}
+	n, err := windows.MultiByteToWideChar(cp, 0, &data[0], int32(len(data)), nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("unable to convert from code page %d: %w", cp, err)
+	}
+	out := make([]uint16, n)
+	if n, err = windows.MultiByteToWideChar(cp, 0, &data[0], int32(len(data)), &out[0], n); err != nil {
+		return "", fmt.Errorf("unable to convert from code page %d: %w", cp, err)
+	}
+	return string(utf16.Decode(out[:n])), nil
+}
+
+// EncodeCodePage converts Go string to code page cp. Characters code page does not have are replaced with its default
+// character.
+func EncodeCodePage(text string, cp uint32) ([]byte, error) {
+	if cp == CodePageUTF8 || len(text) == 0 {
+		return []byte(text), nil
+	}
+	in := utf16.Encode([]rune(text))
+	n, _, err := pWideCharToMultiByte.Call(uintptr(cp), 0, uintptr(unsafe.Pointer(&in[0])), uintptr(len(in)), 0, 0, 0, 0)
+	if n == 0 {
+		return nil, fmt.Errorf("unable to convert to code page %d: %w", cp, err)
+	}
+	out := make([]byte, n)
+	n, _, err = pWideCharToMultiByte.Call(uintptr(cp), 0, uintptr(unsafe.Pointer(&in[0])), uintptr(len(in)), uintptr(unsafe.Pointer(&out[0])), n, 0, 0)
+	if n == 0 {
+		return nil, fmt.Errorf("unable to convert to code page %d: %w", cp, err)
+	}
+	return out[:n], nil
+}
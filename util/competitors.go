@@ -0,0 +1,291 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"github.com/mitchellh/go-ps"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// OpenSSHAgentService is name of Windows OpenSSH ssh-agent service.
+const OpenSSHAgentService = "ssh-agent"
+
+var pGetNamedPipeServerProcessID = kernel.NewProc("GetNamedPipeServerProcessId")
+
+// Competitor is another program which owns (or is going to take) endpoint agent needs, or talks to agents in the way
+// which may surprise user.
+type Competitor struct {
+	Name string `json:"name"`
+	// Endpoint is what competitor owns, empty for clients
+	Endpoint string `json:"endpoint,omitempty"`
+	PID      uint32 `json:"pid,omitempty"`
+	Image    string `json:"image,omitempty"`
+	// Service is name of Windows service to stop, when competitor is one
+	Service string `json:"service,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+func (c *Competitor) String() string {
+	res := c.Name
+	if len(c.Endpoint) > 0 {
+		res = c.Endpoint + ": " + res
+	}
+	if c.PID != 0 {
+		res += fmt.Sprintf(" (pid %d)", c.PID)
+	}
+	if len(c.Note) > 0 {
+		res += " - " + c.Note
+	}
+	return res
+}
+
+// Key identifies competitor, so it could be reported once.
+func (c *Competitor) Key() string {
+	return fmt.Sprintf("%s|%s|%d", c.Name, c.Endpoint, c.PID)
+}
+
+// CanStop is true when competitor could be stopped by StopCompetitor.
+func (c *Competitor) CanStop() bool {
+	return len(c.Service) > 0 || c.PID != 0
+}
+
+// PipeServerPID returns process id of named pipe server. Note, that this connects to the pipe.
+func PipeServerPID(name string) (uint32, error) {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	h, err := windows.CreateFile(p, windows.GENERIC_READ, 0, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(h) //nolint:errcheck
+
+	var pid uint32
+	if r, _, err := pGetNamedPipeServerProcessID.Call(uintptr(h), uintptr(unsafe.Pointer(&pid))); r == 0 {
+		return 0, fmt.Errorf("GetNamedPipeServerProcessId: %w", err)
+	}
+	return pid, nil
+}
+
+// describeProcess names well known agent implementations by executable.
+func describeProcess(image string) (name string, service string) {
+	switch strings.ToLower(filepath.Base(image)) {
+	case "ssh-agent.exe":
+		if strings.Contains(strings.ToLower(image), `\system32\openssh\`) {
+			return "Windows OpenSSH ssh-agent service", OpenSSHAgentService
+		}
+		return "ssh-agent", ""
+	case "pageant.exe":
+		return "PuTTY Pageant", ""
+	case "keepass.exe":
+		return "KeePass (KeeAgent plugin)", ""
+	case "keepassxc.exe":
+		return "KeePassXC", ""
+	case GPGAgentName + ".exe":
+		return "gpg-agent not started by agent-gui (gpg4win, Kleopatra?)", ""
+	case "":
+		return "unknown process", ""
+	}
+	return filepath.Base(image), ""
+}
+
+func openSSHAgentService(access uint32) (*mgr.Service, error) {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseServiceHandle(m) //nolint:errcheck
+
+	name, err := windows.UTF16PtrFromString(OpenSSHAgentService)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.OpenService(m, name, access)
+	if err != nil {
+		return nil, err
+	}
+	return &mgr.Service{Name: OpenSSHAgentService, Handle: h}, nil
+}
+
+// OpenSSHAgentState reports if Windows OpenSSH ssh-agent service is installed, running and starts automatically.
+func OpenSSHAgentState() (installed, running, auto bool) {
+	s, err := openSSHAgentService(windows.SERVICE_QUERY_STATUS | windows.SERVICE_QUERY_CONFIG)
+	if err != nil {
+		return false, false, false
+	}
+	defer s.Close()
+
+	if st, err := s.Query(); err == nil {
+		running = st.State != svc.Stopped
+	}
+	if c, err := s.Config(); err == nil {
+		auto = c.StartType == windows.SERVICE_AUTO_START
+	}
+	return true, running, auto
+}
+
+// gpgAgentConfOption checks if option is set in gpg-agent.conf in GnuPG home.
+func gpgAgentConfOption(home, option string) bool {
+	f, err := os.Open(filepath.Join(home, "gpg-agent.conf"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) > 0 && fields[0] == option {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectCompetitors looks for other agents: owner of OpenSSH named pipe (unless it is us, empty pipe skips the check as
+// it requires connecting), owner of Pageant window (unless it is our gpg-agent), gpg-agents not started by us,
+// KeePassXC and gpg-agent.conf options which make gpg-agent itself compete for the pipe. agentPID is process id of
+// gpg-agent we started (0 if none).
+func DetectCompetitors(pipe, gpgHome string, agentPID uint32) []Competitor {
+
+	var (
+		res  []Competitor
+		self = uint32(os.Getpid())
+		seen = make(map[uint32]bool)
+	)
+	add := func(endpoint string, pid uint32) {
+		seen[pid] = true
+		image, _ := ProcessImage(pid)
+		name, service := describeProcess(image)
+		res = append(res, Competitor{Name: name, Endpoint: endpoint, PID: pid, Image: image, Service: service})
+	}
+
+	if len(pipe) > 0 && PipeExists(pipe) {
+		if pid, err := PipeServerPID(pipe); err == nil && pid != self {
+			add(pipe, pid)
+		} else if err != nil && !errors.Is(err, windows.ERROR_PIPE_BUSY) {
+			res = append(res, Competitor{Name: "unknown process", Endpoint: pipe, Note: err.Error()})
+		}
+	}
+
+	if hwnd := win.FindWindow(windows.StringToUTF16Ptr("Pageant"), windows.StringToUTF16Ptr("Pageant")); hwnd != 0 {
+		var pid uint32
+		if _, err := windows.GetWindowThreadProcessId(windows.HWND(hwnd), &pid); err == nil && pid != agentPID && pid != self {
+			add("Pageant window", pid)
+			res[len(res)-1].Note = "ssh requests will be answered by it instead of gpg-agent"
+		}
+	}
+
+	if installed, running, auto := OpenSSHAgentState(); installed && !running && auto {
+		res = append(res, Competitor{Name: "Windows OpenSSH ssh-agent service", Service: OpenSSHAgentService,
+			Note: "starts automatically and may take the pipe before agent-gui does"})
+	}
+
+	if processes, err := ps.Processes(); err == nil {
+		for _, p := range processes {
+			pid := uint32(p.Pid())
+			if seen[pid] || pid == agentPID || pid == self {
+				continue
+			}
+			switch strings.ToLower(p.Executable()) {
+			case GPGAgentName + ".exe":
+				add("", pid)
+			case "keepassxc.exe":
+				add("", pid)
+				last := &res[len(res)-1]
+				last.Note = "if SSH agent integration is enabled it adds keys to whatever agent is on the pipe"
+				// not something to stop
+				last.PID, last.Image = 0, ""
+			default:
+			}
+		}
+	}
+
+	if gpgAgentConfOption(gpgHome, "enable-win32-openssh-support") {
+		res = append(res, Competitor{Name: "gpg-agent.conf",
+			Note: "enable-win32-openssh-support makes gpg-agent compete for OpenSSH pipe, remove it"})
+	}
+	return res
+}
+
+// StopCompetitor stops and disables service or terminates process. Service control normally requires administrative
+// rights, so when access is denied elevated sc.exe is started (user sees UAC prompt) and we wait for it to finish.
+func StopCompetitor(c *Competitor) error {
+
+	if len(c.Service) == 0 {
+		if c.PID == 0 {
+			return fmt.Errorf("%s could not be stopped", c.Name)
+		}
+		h, err := windows.OpenProcess(windows.PROCESS_TERMINATE, false, c.PID)
+		if err != nil {
+			return fmt.Errorf("unable to open process %d: %w", c.PID, err)
+		}
+		defer windows.CloseHandle(h) //nolint:errcheck
+		if err := windows.TerminateProcess(h, 1); err != nil {
+			return fmt.Errorf("unable to terminate process %d: %w", c.PID, err)
+		}
+		return nil
+	}
+
+	s, err := openSSHAgentService(windows.SERVICE_STOP | windows.SERVICE_CHANGE_CONFIG | windows.SERVICE_QUERY_STATUS | windows.SERVICE_QUERY_CONFIG)
+	if err == nil {
+		defer s.Close()
+		if st, err := s.Query(); err == nil && st.State != svc.Stopped {
+			if _, err := s.Control(svc.Stop); err != nil {
+				return fmt.Errorf("unable to stop %s service: %w", c.Service, err)
+			}
+		}
+		cfg, err := s.Config()
+		if err != nil {
+			return err
+		}
+		cfg.StartType = windows.SERVICE_DISABLED
+		return s.UpdateConfig(cfg)
+	}
+	if !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return fmt.Errorf("unable to open %s service: %w", c.Service, err)
+	}
+
+	args := fmt.Sprintf("/c sc.exe stop %[1]s & sc.exe config %[1]s start= disabled", c.Service)
+	if err := windows.ShellExecute(0, windows.StringToUTF16Ptr("runas"), windows.StringToUTF16Ptr("cmd.exe"), windows.StringToUTF16Ptr(args), nil, windows.SW_HIDE); err != nil {
+		return fmt.Errorf("unable to run elevated sc.exe: %w", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, running, auto := OpenSSHAgentState(); !running && !auto {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s service is still running", c.Service)
+}
+
+// StartOpenSSHAgent starts Windows OpenSSH ssh-agent service unless it is already running.
+func StartOpenSSHAgent() error {
+	s, err := openSSHAgentService(windows.SERVICE_START | windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return fmt.Errorf("unable to open %s service: %w", OpenSSHAgentService, err)
+	}
+	defer s.Close()
+
+	st, err := s.Query()
+	if err != nil {
+		return err
+	}
+	if st.State != svc.Stopped {
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("unable to start %s service: %w", OpenSSHAgentService, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	pAttachConsole = kernel.NewProc("AttachConsole")
+	pAllocConsole  = kernel.NewProc("AllocConsole")
+	pFreeConsole   = kernel.NewProc("FreeConsole")
+)
+
+// AttachConsole connects GUI subsystem program to the console of its parent process (if there is one), so output of
+// command line verbs is visible when program is started from terminal. Redirected standard handles are left alone.
+func AttachConsole() bool {
+	const attachParentProcess = ^uintptr(0)
+
+	if h, err := windows.GetStdHandle(windows.STD_OUTPUT_HANDLE); err == nil && h != 0 && h != windows.InvalidHandle {
+		// output is redirected to file or pipe
+		return true
+	}
+	if r, _, _ := pAttachConsole.Call(attachParentProcess); r == 0 {
+		return false
+	}
+	return reopenConsole()
+}
+
+// AllocConsole creates new console window for GUI subsystem program if it could not be attached to parent one.
+func AllocConsole() bool {
+	if AttachConsole() {
+		return true
+	}
+	if r, _, _ := pAllocConsole.Call(); r == 0 {
+		return false
+	}
+	return reopenConsole()
+}
+
+func reopenConsole() bool {
+	out, err := os.OpenFile("CONOUT$", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	os.Stdout, os.Stderr = out, out
+	if in, err := os.OpenFile("CONIN$", os.O_RDWR, 0); err == nil {
+		os.Stdin = in
+	}
+	return true
+}
+
+// maxConsoleLine is longest line ReadConsoleSecret accepts, the same limit Windows credentials dialog has.
+const maxConsoleLine = 256
+
+// withConsole attaches to console of process pid for the duration of f. Standard handles are not touched.
+func withConsole(pid uint32, f func(in, out windows.Handle) error) error {
+	_, _, _ = pFreeConsole.Call()
+	if r, _, err := pAttachConsole.Call(uintptr(pid)); r == 0 {
+		return fmt.Errorf("unable to attach to console of process %d: %w", pid, err)
+	}
+	defer pFreeConsole.Call() //nolint:errcheck
+
+	open := func(name string) (windows.Handle, error) {
+		return windows.CreateFile(windows.StringToUTF16Ptr(name), windows.GENERIC_READ|windows.GENERIC_WRITE,
+			windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+	}
+	in, err := open("CONIN$")
+	if err != nil {
+		return fmt.Errorf("unable to open console input: %w", err)
+	}
+	defer windows.CloseHandle(in) //nolint:errcheck
+	out, err := open("CONOUT$")
+	if err != nil {
+		return fmt.Errorf("unable to open console output: %w", err)
+	}
+	defer windows.CloseHandle(out) //nolint:errcheck
+	return f(in, out)
+}
+
+func writeConsole(out windows.Handle, text string) error {
+	// console expects CRLF, pseudo consoles of ssh sessions included
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	s := windows.StringToUTF16(text)
+	var n uint32
+	return windows.WriteConsole(out, &s[0], uint32(len(s)-1), &n, nil)
+}
+
+// readConsole reads single line into buf, line ending is replaced with NUL. Echo is turned off when secret is set.
+func readConsole(in windows.Handle, buf []uint16, secret bool) error {
+	var mode uint32
+	if err := windows.GetConsoleMode(in, &mode); err != nil {
+		return fmt.Errorf("unable to get console mode: %w", err)
+	}
+	newMode := mode | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT
+	if secret {
+		newMode &^= windows.ENABLE_ECHO_INPUT
+	} else {
+		newMode |= windows.ENABLE_ECHO_INPUT
+	}
+	if err := windows.SetConsoleMode(in, newMode); err != nil {
+		return fmt.Errorf("unable to set console mode: %w", err)
+	}
+	defer windows.SetConsoleMode(in, mode) //nolint:errcheck
+
+	var n uint32
+	if err := windows.ReadConsole(in, &buf[0], uint32(len(buf)-1), &n, nil); err != nil {
+		return fmt.Errorf("unable to read console: %w", err)
+	}
+	for n > 0 && (buf[n-1] == '\r' || buf[n-1] == '\n') {
+		n--
+	}
+	buf[n] = 0
+	return nil
+}
+
+// ReadConsoleSecret shows text on console of process pid (terminal of ssh session for example) and reads line without
+// echo. Line never touches Go heap.
+func ReadConsoleSecret(pid uint32, text string) (*SecureBuffer, error) {
+	raw, err := NewSecureBuffer((maxConsoleLine + 1) * 2)
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Free()
+	buf := unsafe.Slice((*uint16)(unsafe.Pointer(&raw.buf[0])), maxConsoleLine+1)
+
+	var res *SecureBuffer
+	err = withConsole(pid, func(in, out windows.Handle) error {
+		if err := writeConsole(out, text); err != nil {
+			return err
+		}
+		err := readConsole(in, buf, true)
+		_ = writeConsole(out, "\n")
+		if err != nil {
+			return err
+		}
+		res, err = SecureFromUTF16(buf)
+		return err
+	})
+	return res, err
+}
+
+// ReadConsoleLine shows text on console of process pid and reads line of input.
+func ReadConsoleLine(pid uint32, text string) (string, error) {
+	buf := make([]uint16, maxConsoleLine+1)
+	err := withConsole(pid, func(in, out windows.Handle) error {
+		if err := writeConsole(out, text); err != nil {
+			return err
+		}
+		return readConsole(in, buf, false)
+	})
+	if err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf), nil
+}
@@ -0,0 +1,192 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modDbgHelp                   = windows.NewLazySystemDLL("dbghelp")
+	pMiniDumpWriteDump           = modDbgHelp.NewProc("MiniDumpWriteDump")
+	pSetUnhandledExceptionFilter = kernel.NewProc("SetUnhandledExceptionFilter")
+)
+
+// logRing keeps last lines of log output to be included in crash report.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.lines[r.next] = time.Now().Format("15:04:05.000 ") + l
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return len(p), nil
+}
+
+func (r *logRing) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var res []string
+	if r.full {
+		res = append(res, r.lines[r.next:]...)
+	}
+	res = append(res, r.lines[:r.next]...)
+	return strings.Join(res, "\n")
+}
+
+type crashReporter struct {
+	title       string
+	ring        *logRing
+	fingerprint string
+	once        sync.Once
+}
+
+var crash *crashReporter
+
+// InitCrashReporter starts collecting last log lines and installs Windows unhandled exception filter, so crashes
+// produce report (and minidump) next to the executable. Should be called before NewLogWriter.
+func InitCrashReporter(title string, lines int) {
+	if lines <= 0 {
+		lines = 200
+	}
+	crash = &crashReporter{title: title, ring: &logRing{lines: make([]string, lines)}}
+	_, _, _ = pSetUnhandledExceptionFilter.Call(windows.NewCallback(exceptionFilter))
+}
+
+// SetCrashFingerprint records hash of configuration, so reports could be matched to configuration without including it.
+func SetCrashFingerprint(cfg interface{}) {
+	if crash == nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", cfg)))
+	crash.fingerprint = hex.EncodeToString(sum[:8])
+}
+
+// HandlePanic should be deferred at the beginning of goroutines, on panic it writes crash report, shows it location and exits.
+func HandlePanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	buf := make([]byte, 1<<20)
+	stack := buf[:runtime.Stack(buf, true)]
+	reportCrash(fmt.Sprintf("panic: %v", r), string(stack), 0)
+	os.Exit(2)
+}
+
+type exceptionRecord struct {
+	Code    uint32
+	Flags   uint32
+	Record  uintptr
+	Address uintptr
+}
+
+type exceptionPointers struct {
+	Record  *exceptionRecord
+	Context uintptr
+}
+
+// exceptionFilter is called by Windows for exceptions nobody (including Go runtime) handled.
+func exceptionFilter(ep *exceptionPointers) uintptr {
+	const exceptionContinueSearch = 0
+
+	reason := "unhandled exception"
+	if ep != nil && ep.Record != nil {
+		reason = fmt.Sprintf("unhandled exception 0x%08X at 0x%X", ep.Record.Code, ep.Record.Address)
+	}
+	reportCrash(reason, "", uintptr(unsafe.Pointer(ep)))
+	return exceptionContinueSearch
+}
+
+func crashDir() string {
+	if expath, err := os.Executable(); err == nil {
+		dir := filepath.Dir(expath)
+		// check if we could write there
+		if f, err := os.CreateTemp(dir, "crash"); err == nil {
+			f.Close()
+			os.Remove(f.Name())
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+func reportCrash(reason, stack string, ep uintptr) {
+	if crash == nil {
+		return
+	}
+	crash.once.Do(func() {
+		base := filepath.Join(crashDir(), fmt.Sprintf("%s-crash-%s", crash.title, time.Now().Format("20060102-150405")))
+
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "%s crashed at %s\n\n%s\n\n", crash.title, time.Now().Format(time.RFC3339), reason)
+		fmt.Fprintf(&buf, "Go: %s %s/%s\nConfiguration fingerprint: %s\n\n", runtime.Version(), runtime.GOOS, runtime.GOARCH, crash.fingerprint)
+		if len(stack) > 0 {
+			fmt.Fprintf(&buf, "---------------------------\nStacks:\n---------------------------\n%s\n\n", stack)
+		}
+		fmt.Fprintf(&buf, "---------------------------\nLast log lines:\n---------------------------\n%s\n", crash.ring)
+
+		msg := fmt.Sprintf("%s has crashed: %s", crash.title, reason)
+		if err := os.WriteFile(base+".txt", []byte(buf.String()), 0600); err != nil {
+			msg += fmt.Sprintf("\n\nUnable to write crash report: %s", err)
+		} else {
+			msg += fmt.Sprintf("\n\nCrash report was written to\n%s.txt", base)
+		}
+		if ep != 0 {
+			if err := writeMiniDump(base+".dmp", ep); err == nil {
+				msg += fmt.Sprintf("\n\nMinidump was written to\n%s.dmp", base)
+			}
+		}
+		msg += "\n\nPlease attach it to the bug report."
+		ShowOKMessage(MsgError, crash.title, msg)
+	})
+}
+
+type miniDumpExceptionInformation struct {
+	ThreadID          uint32
+	ExceptionPointers uintptr
+	ClientPointers    int32
+}
+
+func writeMiniDump(fname string, ep uintptr) error {
+	const (
+		miniDumpNormal = 0
+		// do not let stack contents (passphrases being processed) into dump, only pointers
+		miniDumpFilterMemory = 0x8
+	)
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info := miniDumpExceptionInformation{ThreadID: windows.GetCurrentThreadId(), ExceptionPointers: ep}
+	r, _, err := pMiniDumpWriteDump.Call(uintptr(windows.CurrentProcess()), uintptr(windows.GetCurrentProcessId()), f.Fd(),
+		miniDumpNormal|miniDumpFilterMemory, uintptr(unsafe.Pointer(&info)), 0, 0)
+	if r == 0 {
+		return fmt.Errorf("MiniDumpWriteDump failed: %w", err)
+	}
+	return nil
+}
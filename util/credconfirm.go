@@ -0,0 +1,163 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	pLsaConnectUntrusted            = modSecur32.NewProc("LsaConnectUntrusted")
+	pLsaLookupAuthenticationPackage = modSecur32.NewProc("LsaLookupAuthenticationPackage")
+	pLsaLogonUser                   = modSecur32.NewProc("LsaLogonUser")
+	pLsaFreeReturnBuffer            = modSecur32.NewProc("LsaFreeReturnBuffer")
+	pLsaDeregisterLogonProcess      = modSecur32.NewProc("LsaDeregisterLogonProcess")
+	pAllocateLocallyUniqueID        = windows.NewLazySystemDLL("advapi32").NewProc("AllocateLocallyUniqueId")
+)
+
+// lsaString is LSA_STRING.
+type lsaString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        *byte
+}
+
+func newLSAString(s string) *lsaString {
+	b := append([]byte(s), 0)
+	return &lsaString{Length: uint16(len(s)), MaximumLength: uint16(len(b)), Buffer: &b[0]}
+}
+
+// tokenSource is TOKEN_SOURCE.
+type tokenSource struct {
+	SourceName       [8]byte
+	SourceIdentifier windows.LUID
+}
+
+// ConfirmWithWindowsCredentials asks user to confirm operation with Windows credentials (password, PIN or Windows
+// Hello, whatever user normally signs in with) in standard Windows security dialog limited to current user. Entered
+// credentials are verified by LSA and have to belong to the user we run as, so approval is bound to Windows identity
+// rather than to a click. It returns false if user canceled or credentials did not verify, error means dialog could
+// not be used at all.
+func ConfirmWithWindowsCredentials(details DlgDetails, caption, message string) (bool, error) {
+
+	const (
+		CREDUIWIN_ENUMERATE_CURRENT_USER = 0x200
+		interactiveLogon                 = 2
+		statusLogonFailure               = 0xC000006D
+		statusAccountRestriction         = 0xC000006E
+	)
+
+	var lsa windows.Handle
+	if r, _, _ := pLsaConnectUntrusted.Call(uintptr(unsafe.Pointer(&lsa))); r != 0 {
+		return false, fmt.Errorf("LsaConnectUntrusted: %w", windows.NTStatus(r))
+	}
+	defer pLsaDeregisterLogonProcess.Call(uintptr(lsa)) //nolint:errcheck
+
+	var pkg uint32
+	if r, _, _ := pLsaLookupAuthenticationPackage.Call(uintptr(lsa), uintptr(unsafe.Pointer(newLSAString("Negotiate"))), uintptr(unsafe.Pointer(&pkg))); r != 0 {
+		return false, fmt.Errorf("LsaLookupAuthenticationPackage: %w", windows.NTStatus(r))
+	}
+
+	// see PromptForWindowsCredentials
+	go func() {
+		<-time.After(details.Delay)
+		if hwnd := win.FindWindow(windows.StringToUTF16Ptr(details.WndClass), windows.StringToUTF16Ptr(details.WndName)); hwnd != 0 {
+			win.SetForegroundWindow(hwnd)
+		}
+	}()
+
+	message = cleanLabel(message)
+	if len(message) > CREDUI_MAX_MESSAGE_LENGTH {
+		message = message[:CREDUI_MAX_MESSAGE_LENGTH]
+	}
+	uiInfo := credUIInfo{
+		MessageText: windows.StringToUTF16Ptr(message),
+		CaptionText: windows.StringToUTF16Ptr(caption),
+	}
+	uiInfo.Size = uint32(unsafe.Sizeof(uiInfo))
+
+	var (
+		outBuf       *uint8
+		sizeOfOutBuf uint32
+		save         int32
+	)
+	r, _, _ := pPromptForWindowsCredentials.Call(
+		uintptr(unsafe.Pointer(&uiInfo)),
+		0,
+		uintptr(unsafe.Pointer(&pkg)),
+		0, 0,
+		uintptr(unsafe.Pointer(&outBuf)),
+		uintptr(unsafe.Pointer(&sizeOfOutBuf)),
+		uintptr(unsafe.Pointer(&save)),
+		CREDUIWIN_ENUMERATE_CURRENT_USER,
+	)
+	if r == uintptr(windows.ERROR_CANCELLED) {
+		return false, nil
+	}
+	if r != 0 {
+		return false, fmt.Errorf("CredUIPromptForWindowsCredentials: %w", windows.Errno(r))
+	}
+	defer func() {
+		Wipe(unsafe.Slice(outBuf, sizeOfOutBuf))
+		windows.CoTaskMemFree(unsafe.Pointer(outBuf))
+	}()
+
+	var (
+		source     = tokenSource{SourceName: [8]byte{'a', 'g', 'e', 'n', 't', 'g', 'u', 'i'}}
+		profile    uintptr
+		profileLen uint32
+		luid       windows.LUID
+		token      windows.Token
+		quotas     [8]uint64 // QUOTA_LIMITS
+		subStatus  uint32
+	)
+	if r, _, err := pAllocateLocallyUniqueID.Call(uintptr(unsafe.Pointer(&source.SourceIdentifier))); r == 0 {
+		return false, fmt.Errorf("AllocateLocallyUniqueId: %w", err)
+	}
+	r, _, _ = pLsaLogonUser.Call(
+		uintptr(lsa),
+		uintptr(unsafe.Pointer(newLSAString(WinAgentName))),
+		interactiveLogon,
+		uintptr(pkg),
+		uintptr(unsafe.Pointer(outBuf)),
+		uintptr(sizeOfOutBuf),
+		0,
+		uintptr(unsafe.Pointer(&source)),
+		uintptr(unsafe.Pointer(&profile)),
+		uintptr(unsafe.Pointer(&profileLen)),
+		uintptr(unsafe.Pointer(&luid)),
+		uintptr(unsafe.Pointer(&token)),
+		uintptr(unsafe.Pointer(&quotas[0])),
+		uintptr(unsafe.Pointer(&subStatus)),
+	)
+	switch r {
+	case 0:
+	case statusLogonFailure, statusAccountRestriction:
+		log.Printf("Windows credentials did not verify: %s", windows.NTStatus(r))
+		return false, nil
+	default:
+		return false, fmt.Errorf("LsaLogonUser: %w", windows.NTStatus(r))
+	}
+	defer token.Close()
+	if profile != 0 {
+		defer pLsaFreeReturnBuffer.Call(profile) //nolint:errcheck
+	}
+
+	u, err := token.GetTokenUser()
+	if err != nil {
+		return false, err
+	}
+	self, err := ProcessUser(windows.GetCurrentProcessId())
+	if err != nil {
+		return false, err
+	}
+	if !u.User.Sid.Equals(self) {
+		log.Printf("Windows credentials of %s were entered instead of ours", sidName(u.User.Sid))
+		return false, nil
+	}
+	return true, nil
+}
@@ -25,6 +25,8 @@ type DlgDetails struct {
 	Delay    time.Duration `yaml:"delay,omitempty"`
 	WndName  string        `yaml:"name,omitempty"`
 	WndClass string        `yaml:"class,omitempty"`
+	PinPad   string        `yaml:"pin_pad,omitempty"`
+	Shuffle  bool          `yaml:"pin_pad_shuffle,omitempty"`
 }
 
 func prepareAuthBuf(user string) (buf *uint8, size uint32) {
@@ -98,8 +100,9 @@ const (
 
 // PromptForWindowsCredentials calls Windows CredUI.dll to pupup "standard" Windows security dialog using provided description, prompt and a flag,
 // indicating that user could make a choice to save the result in Windows Credential manager. It returns canceled flag (indicating error or user's
-// refusal to complete operation) and when false string with entered password/pin and flag indicating that user checked "Remember me" checkbox.
-func PromptForWindowsCredentials(details DlgDetails, errorMessage, description, prompt string, save bool) (bool, string, bool) {
+// refusal to complete operation) and when false secure buffer with entered password/pin (caller must Free it) and flag indicating that user
+// checked "Remember me" checkbox.
+func PromptForWindowsCredentials(details DlgDetails, errorMessage, description, prompt string, save bool) (bool, *SecureBuffer, bool) {
 
 	// NOTE: since pinentry is being started from arbitrary "background" process after long chain of executions timing may vary and often
 	// passphrase dialog would not come into foreground (as it should) - instead meaningless icon will flash on taskbar. To fight it we
@@ -167,8 +170,13 @@ func PromptForWindowsCredentials(details DlgDetails, errorMessage, description,
 	// ERROR_CANCELED is the only other option
 	if r1 != 0 {
 		log.Printf("CredUIPromptForWindowsCredentialsW LastErr: %s, ret: %d", err.Error(), r1)
-		return true, "", false
+		return true, nil, false
 	}
+	// packed credentials contain password in clear
+	defer func() {
+		Wipe(unsafe.Slice(outBuf, sizeOfOutBuf))
+		windows.CoTaskMemFree(unsafe.Pointer(outBuf))
+	}()
 
 	// Let's unpack the result
 
@@ -177,10 +185,17 @@ func PromptForWindowsCredentials(details DlgDetails, errorMessage, description,
 		cchMaxUserName   = uint32(CREDUI_MAX_USERNAME_LENGTH)
 		szDomainName     = make([]uint16, CREDUI_MAX_DOMAIN_TARGET_LENGTH+1)
 		cchMaxDomainName = uint32(CREDUI_MAX_DOMAIN_TARGET_LENGTH)
-		szPassword       = make([]uint16, CREDUI_MAX_PASSWORD_LENGTH+1)
 		cchMaxPassword   = uint32(CREDUI_MAX_PASSWORD_LENGTH)
 	)
 
+	sbPassword, err := NewSecureBuffer((CREDUI_MAX_PASSWORD_LENGTH + 1) * 2)
+	if err != nil {
+		log.Print(err)
+		return true, nil, false
+	}
+	defer sbPassword.Free()
+	szPassword := unsafe.Slice((*uint16)(unsafe.Pointer(&sbPassword.buf[0])), CREDUI_MAX_PASSWORD_LENGTH+1)
+
 	r1, _, err = pCredUnPackAuthenticationBuffer.Call(
 		0,                                        // DWORD  dwFlags,
 		uintptr(unsafe.Pointer(outBuf)),          // PVOID  pAuthBuffer,
@@ -195,11 +210,14 @@ func PromptForWindowsCredentials(details DlgDetails, errorMessage, description,
 
 	if r1 == 0 {
 		log.Printf("CredUnPackAuthenticationBufferW LastErr: %s, ret: %d", err.Error(), r1)
-		return true, "", false
+		return true, nil, false
 	}
 
-	res := windows.UTF16ToString(szPassword)
-	windows.CoTaskMemFree(unsafe.Pointer(outBuf))
+	res, err := SecureFromUTF16(szPassword)
+	if err != nil {
+		log.Print(err)
+		return true, nil, false
+	}
 
 	// Store checkbox state to be used later
 	SetIntOption(optionName, uint64(saveFlag))
@@ -1,18 +1,122 @@
 package util
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/windows"
 )
 
+// Supported Cygwin socket dialects. MSYS2 (and Git for Windows which is built on it) shares Cygwin socket emulation
+// and handshake, but mounts drives at root (/c) rather than under /cygdrive (/cygdrive/c).
+const (
+	DialectAuto   = "auto"
+	DialectCygwin = "cygwin"
+	DialectMSYS2  = "msys2"
+)
+
+// CygwinDialect describes conventions of particular Cygwin flavor.
+type CygwinDialect struct {
+	Name string
+	// Root is installation directory dialect was detected from, may be empty.
+	Root string
+	// Prefix is cygdrive mount point.
+	Prefix string
+}
+
+func (d CygwinDialect) String() string {
+	if len(d.Root) == 0 {
+		return fmt.Sprintf("%s (cygdrive %s)", d.Name, d.Prefix)
+	}
+	return fmt.Sprintf("%s (cygdrive %s, from %s)", d.Name, d.Prefix, d.Root)
+}
+
+// Path converts absolute Windows path to POSIX form dialect understands. UNC paths are returned with forward slashes.
+func (d CygwinDialect) Path(winpath string) string {
+	winpath = CleanPath(winpath)
+	vol := filepath.VolumeName(winpath)
+	if len(vol) != 2 || vol[1] != ':' {
+		return filepath.ToSlash(winpath)
+	}
+	return strings.TrimSuffix(d.Prefix, "/") + "/" + strings.ToLower(vol[:1]) + filepath.ToSlash(winpath[2:])
+}
+
+func defaultDialect(name string) CygwinDialect {
+	if name == DialectMSYS2 {
+		return CygwinDialect{Name: DialectMSYS2, Prefix: "/"}
+	}
+	return CygwinDialect{Name: DialectCygwin, Prefix: "/cygdrive"}
+}
+
+// inspectRoot checks if dir is Cygwin or MSYS2 installation root and reads cygdrive prefix from its etc/fstab.
+func inspectRoot(dir string) (CygwinDialect, bool) {
+	var d CygwinDialect
+	switch {
+	case FileExists(filepath.Join(dir, "usr", "bin", "msys-2.0.dll")):
+		d = defaultDialect(DialectMSYS2)
+	case FileExists(filepath.Join(dir, "bin", "cygwin1.dll")):
+		d = defaultDialect(DialectCygwin)
+	default:
+		return d, false
+	}
+	d.Root = dir
+	f, err := os.Open(filepath.Join(dir, "etc", "fstab"))
+	if err != nil {
+		return d, true
+	}
+	defer f.Close()
+	// none /cygdrive cygdrive binary,posix=0,user 0 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") && fields[2] == "cygdrive" {
+			d.Prefix = fields[1]
+		}
+	}
+	return d, true
+}
+
+// DetectCygwinDialect returns requested dialect. For "auto" installation providing ssh.exe on PATH is inspected first,
+// then well known installation locations. Cygwin conventions are assumed when nothing is found.
+func DetectCygwinDialect(name string) CygwinDialect {
+	name = strings.ToLower(name)
+	if name != DialectAuto && len(name) != 0 {
+		return defaultDialect(name)
+	}
+	var roots []string
+	if p, err := exec.LookPath("ssh.exe"); err == nil {
+		dir := filepath.Dir(p)
+		// <root>/bin/ssh.exe or <root>/usr/bin/ssh.exe
+		roots = append(roots, filepath.Dir(dir), filepath.Dir(filepath.Dir(dir)))
+	}
+	roots = append(roots,
+		filepath.Join(os.Getenv("ProgramFiles"), "Git"),
+		`C:\msys64`,
+		`C:\cygwin64`,
+		`C:\cygwin`,
+	)
+	for _, r := range roots {
+		if d, ok := inspectRoot(r); ok {
+			return d
+		}
+	}
+	return defaultDialect(DialectCygwin)
+}
+
 // CygwinNonceString converts binary nonce to printable string in net order.
 func CygwinNonceString(nonce [16]byte) string {
 	var buf [35]byte
@@ -27,46 +131,169 @@ func CygwinNonceString(nonce [16]byte) string {
 	return string(buf[:])
 }
 
-// CygwinCreateSocketFile creates CygWin socket file with proper content and attributes.
-func CygwinCreateSocketFile(fname string, port int) (nonce [16]byte, err error) {
-	if _, err = rand.Read(nonce[:]); err != nil {
-		return
+// CygwinNonce is secret of Cygwin socket emulation kept in socket file - only processes which could read the file are
+// able to connect. It is replaced periodically, previous nonce stays valid until next replacement, so clients which
+// have just read socket file are not rejected.
+type CygwinNonce struct {
+	fname string
+	port  int
+
+	mu       sync.Mutex
+	current  [16]byte
+	previous *[16]byte
+	timer    *time.Timer
+	stopped  bool
+}
+
+// NewCygwinNonce creates Cygwin socket file with random nonce for TCP port. If ttl is not zero nonce is replaced
+// every ttl until Stop is called.
+func NewCygwinNonce(fname string, port int, ttl time.Duration) (*CygwinNonce, error) {
+	n := &CygwinNonce{fname: fname, port: port}
+	if err := n.rotate(); err != nil {
+		return nil, err
 	}
-	if err = ioutil.WriteFile(fname, []byte(fmt.Sprintf("!<socket >%d s %s", port, CygwinNonceString(nonce))), 0600); err != nil {
-		return
+	if ttl > 0 {
+		n.mu.Lock()
+		n.timer = time.AfterFunc(ttl, func() {
+			if err := n.rotate(); err != nil {
+				log.Printf("Unable to replace Cygwin socket nonce: %s", err)
+			}
+			n.mu.Lock()
+			if !n.stopped {
+				n.timer.Reset(ttl)
+			}
+			n.mu.Unlock()
+		})
+		n.mu.Unlock()
 	}
-	var cpath *uint16
-	if cpath, err = windows.UTF16PtrFromString(fname); err != nil {
-		return
+	return n, nil
+}
+
+// Stop ends nonce replacement, socket file is left to the caller.
+func (n *CygwinNonce) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stopped = true
+	if n.timer != nil {
+		n.timer.Stop()
 	}
-	err = windows.SetFileAttributes(cpath, windows.FILE_ATTRIBUTE_SYSTEM|windows.FILE_ATTRIBUTE_READONLY)
-	return
 }
 
-// CygwinPerformHandshake exchanges handshake data.
-func CygwinPerformHandshake(conn io.ReadWriter, nonce [16]byte) error {
+// String returns current nonce as it is written in socket file.
+func (n *CygwinNonce) String() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return CygwinNonceString(n.current)
+}
 
-	var nonceR [16]byte
-	if _, err := conn.Read(nonceR[:]); err != nil {
+// rotate generates new nonce and atomically replaces socket file.
+func (n *CygwinNonce) rotate() error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil
+	}
+	if err := writeCygwinSocketFile(n.fname, n.port, nonce); err != nil {
 		return err
 	}
-	if !bytes.Equal(nonce[:], nonceR[:]) {
-		return fmt.Errorf("invalid nonce received - expecting %x but got %x", nonce[:], nonceR[:])
+	if n.current != [16]byte{} {
+		prev := n.current
+		n.previous = &prev
 	}
-	if _, err := conn.Write(nonce[:]); err != nil {
+	n.current = nonce
+	return nil
+}
+
+// valid checks nonce received from client in constant time.
+func (n *CygwinNonce) valid(nonce []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ok := subtle.ConstantTimeCompare(n.current[:], nonce)
+	if n.previous != nil {
+		ok |= subtle.ConstantTimeCompare(n.previous[:], nonce)
+	}
+	return ok == 1
+}
+
+// writeCygwinSocketFile writes socket file with proper content and attributes. File is replaced with rename, so
+// clients never read it half written.
+func writeCygwinSocketFile(fname string, port int, nonce [16]byte) error {
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("!<socket >%d s %s", port, CygwinNonceString(nonce))), 0600); err != nil {
 		return err
 	}
+	if err := setFileAttributes(tmp, windows.FILE_ATTRIBUTE_SYSTEM|windows.FILE_ATTRIBUTE_READONLY); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// read only file could not be replaced
+	if err := setFileAttributes(fname, windows.FILE_ATTRIBUTE_NORMAL); err != nil && !errors.Is(err, windows.ERROR_FILE_NOT_FOUND) {
+		_ = setFileAttributes(tmp, windows.FILE_ATTRIBUTE_NORMAL)
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		_ = setFileAttributes(tmp, windows.FILE_ATTRIBUTE_NORMAL)
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
 
-	// read client pid:uid:gid
-	buf := make([]byte, 12)
-	if _, err := conn.Read(buf); err != nil {
+func setFileAttributes(fname string, attrs uint32) error {
+	cpath, err := windows.UTF16PtrFromString(fname)
+	if err != nil {
 		return err
 	}
+	return windows.SetFileAttributes(cpath, attrs)
+}
+
+// CygwinPeer is what Cygwin client tells about itself during handshake.
+type CygwinPeer struct {
+	PID, UID, GID uint32
+}
+
+// cygwinUnknownID is (uid_t)-1 - Cygwin could not map Windows account of the client.
+const cygwinUnknownID = 0xFFFFFFFF
+
+// CygwinPerformHandshake exchanges handshake data: client sends nonce which is echoed back, then its pid:uid:gid and
+// receives ours pid with the same uid:gid. Anything short, different or unknown is rejected.
+func CygwinPerformHandshake(conn io.ReadWriter, n *CygwinNonce) (*CygwinPeer, error) {
+
+	var nonceR [16]byte
+	if _, err := io.ReadFull(conn, nonceR[:]); err != nil {
+		return nil, fmt.Errorf("unable to read nonce: %w", err)
+	}
+	if !n.valid(nonceR[:]) {
+		return nil, errors.New("invalid nonce received")
+	}
+	if _, err := conn.Write(nonceR[:]); err != nil {
+		return nil, err
+	}
+
+	// read client pid:uid:gid
+	var buf [12]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, fmt.Errorf("unable to read credentials: %w", err)
+	}
+	peer := &CygwinPeer{
+		PID: binary.LittleEndian.Uint32(buf[0:]),
+		UID: binary.LittleEndian.Uint32(buf[4:]),
+		GID: binary.LittleEndian.Uint32(buf[8:]),
+	}
+	if peer.PID == 0 || peer.UID == cygwinUnknownID || peer.GID == cygwinUnknownID {
+		return nil, fmt.Errorf("invalid credentials pid=%d uid=%d gid=%d", peer.PID, int32(peer.UID), int32(peer.GID))
+	}
 
 	// Send back our info, making sure that gid:uid are the same as received
-	binary.LittleEndian.PutUint32(buf, uint32(os.Getpid()))
-	if _, err := conn.Write(buf); err != nil {
-		return err
+	binary.LittleEndian.PutUint32(buf[:], uint32(os.Getpid()))
+	if _, err := conn.Write(buf[:]); err != nil {
+		return nil, err
 	}
-	return nil
+	return peer, nil
 }
@@ -0,0 +1,19 @@
+package util
+
+import "testing"
+
+func TestCygwinDialectPath(t *testing.T) {
+	for _, tc := range []struct {
+		d        CygwinDialect
+		in, want string
+	}{
+		{defaultDialect(DialectCygwin), `C:\Users\x\AppData\Local\gnupg\agent-gui\S.gpg-agent.ssh.cyg`, `/cygdrive/c/Users/x/AppData/Local/gnupg/agent-gui/S.gpg-agent.ssh.cyg`},
+		{defaultDialect(DialectMSYS2), `D:\home\S.gpg-agent.ssh.cyg`, `/d/home/S.gpg-agent.ssh.cyg`},
+		{CygwinDialect{Name: DialectCygwin, Prefix: "/mnt/"}, `\\?\E:\sockets`, `/mnt/e/sockets`},
+		{defaultDialect(DialectMSYS2), `\\server\share\sockets`, `//server/share/sockets`},
+	} {
+		if got := tc.d.Path(tc.in); got != tc.want {
+			t.Errorf("%s %q: got %q, want %q", tc.d.Name, tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	pGetProcessWindowStation   = modUser32.NewProc("GetProcessWindowStation")
+	pGetUserObjectInformationW = modUser32.NewProc("GetUserObjectInformationW")
+)
+
+// InteractiveDesktop reports if process could show windows user would see. Processes started by services and from
+// OpenSSH sessions live on invisible window station, dialogs they show are never seen and wait forever.
+func InteractiveDesktop() bool {
+
+	const (
+		UOI_FLAGS   = 1
+		WSF_VISIBLE = 1
+	)
+
+	var session uint32
+	if err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session); err == nil && session == 0 {
+		return false
+	}
+
+	ws, _, _ := pGetProcessWindowStation.Call()
+	if ws == 0 {
+		return false
+	}
+	var flags struct {
+		inherit, reserved int32
+		flags             uint32
+	}
+	var needed uint32
+	if r, _, _ := pGetUserObjectInformationW.Call(ws, UOI_FLAGS, uintptr(unsafe.Pointer(&flags)), unsafe.Sizeof(flags), uintptr(unsafe.Pointer(&needed))); r == 0 {
+		// cannot tell, assume desktop is there as before
+		return true
+	}
+	return flags.flags&WSF_VISIBLE != 0
+}
+
+// SessionID returns Terminal Services session of process.
+func SessionID(pid uint32) (uint32, error) {
+	var session uint32
+	if err := windows.ProcessIdToSessionId(pid, &session); err != nil {
+		return 0, fmt.Errorf("unable to get session of process %d: %w", pid, err)
+	}
+	return session, nil
+}
+
+// OtherSession reports if process pid runs in different session than we do (OpenSSH session for example).
+func OtherSession(pid uint32) bool {
+	their, err := SessionID(pid)
+	if err != nil {
+		return false
+	}
+	our, err := SessionID(windows.GetCurrentProcessId())
+	return err == nil && our != their
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Names of endpoints in discovery file.
+const (
+	DiscoveryGPG     = "gpg"
+	DiscoverySSH     = "ssh"
+	DiscoveryExtra   = "extra"
+	DiscoveryDirmngr = "dirmngr"
+)
+
+// DiscoveryEndpoint is AF_UNIX socket path in Windows and WSL (default /mnt automount root) notation.
+type DiscoveryEndpoint struct {
+	Windows string `json:"windows"`
+	WSL     string `json:"wsl"`
+}
+
+// Discovery is published by running instance at well known location, so relays and scripts could find its sockets
+// without hard coded paths.
+type Discovery struct {
+	PID      int                          `json:"pid"`
+	Instance string                       `json:"instance,omitempty"`
+	Pipe     string                       `json:"ssh_pipe,omitempty"`
+	Sockets  map[string]DiscoveryEndpoint `json:"sockets"`
+}
+
+// DiscoveryFile returns well known path of discovery file of instance: %LOCALAPPDATA%\win-gpg-agent\agent-gui.json,
+// independent of configuration.
+func DiscoveryFile(instance string) string {
+	dir := os.Getenv("LOCALAPPDATA")
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "win-gpg-agent", InstanceName(WinAgentName, instance)+".json")
+}
+
+// NewDiscoveryEndpoint describes socket with Windows path.
+func NewDiscoveryEndpoint(path string) DiscoveryEndpoint {
+	path = CleanPath(path)
+	return DiscoveryEndpoint{Windows: path, WSL: CygwinDialect{Prefix: "/mnt"}.Path(path)}
+}
+
+// Names returns sorted names of published sockets.
+func (d *Discovery) Names() []string {
+	res := make([]string, 0, len(d.Sockets))
+	for name := range d.Sockets {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// WriteDiscovery publishes discovery file of instance. Returned function removes it.
+func WriteDiscovery(instance string, d *Discovery) (func(), error) {
+	fname := DiscoveryFile(instance)
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create directory for discovery file: %w", err)
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return nil, fmt.Errorf("unable to write discovery file: %w", err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to write discovery file: %w", err)
+	}
+	return func() { os.Remove(fname) }, nil
+}
+
+// ReadDiscovery reads discovery file of running instance.
+func ReadDiscovery(instance string) (*Discovery, error) {
+	fname := DiscoveryFile(instance)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s is not found, is %s running?", fname, InstanceName(WinAgentName, instance))
+		}
+		return nil, fmt.Errorf("unable to read discovery file: %w", err)
+	}
+	d := &Discovery{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("bad discovery file %s: %w", fname, err)
+	}
+	return d, nil
+}
+
+// Socket returns Windows path of published socket.
+func (d *Discovery) Socket(name string) (string, error) {
+	ep, ok := d.Sockets[name]
+	if !ok {
+		return "", fmt.Errorf("socket \"%s\" is not published, available are %v", name, d.Names())
+	}
+	return ep.Windows, nil
+}
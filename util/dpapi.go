@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// dpapiEntropy binds protected data to this program, so other DPAPI users of the same account could not decrypt it by
+// accident.
+var dpapiEntropy = []byte("win-gpg-agent")
+
+func dataBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+// blobBytes copies data out of blob allocated by DPAPI and frees it.
+func blobBytes(b *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	if b.Size == 0 {
+		return nil
+	}
+	return append([]byte(nil), unsafe.Slice(b.Data, b.Size)...)
+}
+
+// ProtectData encrypts data with DPAPI for current user, result could only be decrypted by the same user on the same
+// machine (or with roaming profile).
+func ProtectData(data []byte, description string) ([]byte, error) {
+	desc, err := windows.UTF16PtrFromString(description)
+	if err != nil {
+		return nil, err
+	}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(dataBlob(data), desc, dataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("CryptProtectData: %w", err)
+	}
+	return blobBytes(&out), nil
+}
+
+// UnprotectData decrypts data produced by ProtectData.
+func UnprotectData(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(dataBlob(data), nil, dataBlob(dpapiEntropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("CryptUnprotectData: %w", err)
+	}
+	return blobBytes(&out), nil
+}
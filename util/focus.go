@@ -0,0 +1,44 @@
+package util
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	pNtQueryWnfStateData          = windows.NewLazySystemDLL("ntdll").NewProc("NtQueryWnfStateData")
+	pSHQueryUserNotificationState = windows.NewLazySystemDLL("shell32").NewProc("SHQueryUserNotificationState")
+)
+
+// focusAssistState is WNF_SHEL_QUIET_MOMENT_SHELL_MODE_CHANGED, its data is Focus Assist mode: 0 - off, 1 - priority
+// only, 2 - alarms only. There is no documented API for it.
+const focusAssistState uint64 = 0x0d83063ea3bf5075
+
+// DoNotDisturb reports if user should not be interrupted with notifications: Focus Assist is on or shell says that
+// user is busy, presenting or running full screen application.
+func DoNotDisturb() bool {
+	if pNtQueryWnfStateData.Find() == nil {
+		var (
+			state = focusAssistState
+			stamp uint32
+			mode  uint32
+			size  = uint32(unsafe.Sizeof(mode))
+		)
+		if r, _, _ := pNtQueryWnfStateData.Call(uintptr(unsafe.Pointer(&state)), 0, 0, uintptr(unsafe.Pointer(&stamp)), uintptr(unsafe.Pointer(&mode)), uintptr(unsafe.Pointer(&size))); r == 0 && size == 4 && mode != 0 {
+			return true
+		}
+	}
+	if pSHQueryUserNotificationState.Find() == nil {
+		const (
+			QUNS_BUSY                    = 2
+			QUNS_RUNNING_D3D_FULL_SCREEN = 3
+			QUNS_PRESENTATION_MODE       = 4
+		)
+		var st uint32
+		if r, _, _ := pSHQueryUserNotificationState.Call(uintptr(unsafe.Pointer(&st))); r == 0 {
+			return st == QUNS_BUSY || st == QUNS_RUNNING_D3D_FULL_SCREEN || st == QUNS_PRESENTATION_MODE
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/lxn/win"
+)
+
+var (
+	pRegisterHotKey     = modUser32.NewProc("RegisterHotKey")
+	pUnregisterHotKey   = modUser32.NewProc("UnregisterHotKey")
+	pPostThreadMessageW = modUser32.NewProc("PostThreadMessageW")
+)
+
+// Hotkey modifiers as expected by RegisterHotKey.
+const (
+	modAlt      = 0x1
+	modControl  = 0x2
+	modShift    = 0x4
+	modWin      = 0x8
+	modNoRepeat = 0x4000
+)
+
+// ParseHotkey parses hotkey like "Ctrl+Alt+U" or "Win+Shift+F12" into modifiers and virtual key code.
+func ParseHotkey(spec string) (mods, vk uint32, err error) {
+	parts := strings.Split(spec, "+")
+	for i, p := range parts {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		if i < len(parts)-1 {
+			switch p {
+			case "CTRL", "CONTROL":
+				mods |= modControl
+			case "ALT":
+				mods |= modAlt
+			case "SHIFT":
+				mods |= modShift
+			case "WIN":
+				mods |= modWin
+			default:
+				return 0, 0, fmt.Errorf("unknown modifier \"%s\" in hotkey \"%s\"", p, spec)
+			}
+			continue
+		}
+		switch {
+		case len(p) == 1 && (p[0] >= 'A' && p[0] <= 'Z' || p[0] >= '0' && p[0] <= '9'):
+			vk = uint32(p[0])
+		case len(p) >= 2 && len(p) <= 3 && p[0] == 'F':
+			var n uint32
+			if _, err := fmt.Sscanf(p[1:], "%d", &n); err != nil || n < 1 || n > 24 {
+				return 0, 0, fmt.Errorf("unknown key \"%s\" in hotkey \"%s\"", p, spec)
+			}
+			vk = win.VK_F1 + n - 1
+		default:
+			return 0, 0, fmt.Errorf("unknown key \"%s\" in hotkey \"%s\"", p, spec)
+		}
+	}
+	if mods == 0 {
+		return 0, 0, fmt.Errorf("hotkey \"%s\" has no modifiers", spec)
+	}
+	return mods, vk, nil
+}
+
+// RegisterHotkey calls f every time system wide hotkey is pressed until returned function is called. Hotkey messages
+// are delivered to the thread which registered it, so dedicated thread with its own message loop is used.
+func RegisterHotkey(spec string, f func()) (func(), error) {
+	mods, vk, err := ParseHotkey(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	const id = 1
+	ready := make(chan error, 1)
+	tid := make(chan uint32, 1)
+	go func() {
+		defer HandlePanic()
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		if r, _, err := pRegisterHotKey.Call(0, id, uintptr(mods|modNoRepeat), uintptr(vk)); r == 0 {
+			ready <- fmt.Errorf("unable to register hotkey \"%s\": %w", spec, err)
+			return
+		}
+		defer pUnregisterHotKey.Call(0, id) //nolint:errcheck
+		tid <- win.GetCurrentThreadId()
+		ready <- nil
+
+		var msg win.MSG
+		for win.GetMessage(&msg, 0, 0, 0) > 0 {
+			if msg.Message == win.WM_HOTKEY && msg.WParam == id {
+				go f()
+			}
+		}
+	}()
+	if err := <-ready; err != nil {
+		return nil, err
+	}
+	thread := <-tid
+	return func() {
+		_, _, _ = pPostThreadMessageW.Call(uintptr(thread), win.WM_QUIT, 0, 0)
+	}, nil
+}
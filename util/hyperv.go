@@ -0,0 +1,112 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"unsafe"
+
+	"github.com/Microsoft/go-winio/pkg/guid"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const gcsKeyName = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\GuestCommunicationServices`
+
+// Well known Hyper-V partition ids.
+const (
+	HvsockWildcard = "00000000-0000-0000-0000-000000000000"
+	HvsockParent   = "a42e7cda-d03f-480c-9cc2-a4de20abb878"
+)
+
+// HvsockVMID converts VM id from configuration, empty string means any VM.
+func HvsockVMID(id string) guid.GUID {
+	if len(id) == 0 {
+		id = HvsockWildcard
+	}
+	g, err := guid.FromString(id)
+	if err != nil {
+		log.Printf("Bad Hyper-V VM id '%s', using wildcard: %s", id, err)
+		g, _ = guid.FromString(HvsockWildcard)
+	}
+	return g
+}
+
+// RegisterHvsockService makes Hyper-V socket service known to the system, so guests could connect to it. It requires write access to HKLM.
+func RegisterHvsockService(id guid.GUID, name string) error {
+
+	keyName := fmt.Sprintf(`%s\{%s}`, gcsKeyName, id)
+
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, keyName, registry.QUERY_VALUE); err == nil {
+		k.Close()
+		return nil
+	}
+
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, keyName, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	if err := k.SetStringValue("ElementName", name); err != nil {
+		return err
+	}
+	log.Printf("Registered Hyper-V socket service %s as '%s'", id, name)
+	return nil
+}
+
+var pConnect = windows.NewLazySystemDLL("ws2_32").NewProc("connect")
+
+type rawHvsockAddr struct {
+	Family    uint16
+	_         uint16
+	VMID      guid.GUID
+	ServiceID guid.GUID
+}
+
+// hvConn is blocking client side Hyper-V socket.
+type hvConn struct {
+	h windows.Handle
+}
+
+func (c *hvConn) Read(p []byte) (int, error) {
+	var n uint32
+	if err := windows.ReadFile(c.h, p, &n, nil); err != nil {
+		return int(n), err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+func (c *hvConn) Write(p []byte) (int, error) {
+	var n uint32
+	err := windows.WriteFile(c.h, p, &n, nil)
+	return int(n), err
+}
+
+func (c *hvConn) Close() error {
+	return windows.Closesocket(c.h)
+}
+
+// DialHvsock connects to Hyper-V socket service on partition vmid. Dialing is not implemented by go-winio yet, so we are
+// using plain blocking socket here, which is sufficient for relaying.
+func DialHvsock(vmid, service guid.GUID) (io.ReadWriteCloser, error) {
+
+	const (
+		afHyperV      = 34
+		hvProtocolRaw = 1
+	)
+
+	h, err := windows.WSASocket(afHyperV, windows.SOCK_STREAM, hvProtocolRaw, nil, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Hyper-V socket: %w", err)
+	}
+	sa := rawHvsockAddr{Family: afHyperV, VMID: vmid, ServiceID: service}
+	if r, _, err := pConnect.Call(uintptr(h), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); r != 0 {
+		windows.Closesocket(h)
+		return nil, fmt.Errorf("unable to connect to Hyper-V socket %s:%s: %w", vmid, service, err)
+	}
+	return &hvConn{h: h}, nil
+}
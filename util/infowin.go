@@ -0,0 +1,210 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	infoClass   = "win-gpg-agent-info"
+	infoText    = 500
+	infoRefresh = 501
+	infoClose   = 502
+	// action buttons get consecutive ids starting with infoAction
+	infoAction = 510
+	infoBtnW   = 130
+	infoBtnH   = 30
+	infoGap    = 8
+	infoTextH  = 320
+	infoMinW   = 560
+	// infoDone is posted to window when action or refresh is finished
+	infoDone = win.WM_APP + 2
+)
+
+// InfoAction is button of information window.
+type InfoAction struct {
+	Title string
+	Run   func() error
+}
+
+// infoViewer is state of the only information window agent could show.
+type infoViewer struct {
+	mu      sync.Mutex
+	wnd     win.HWND
+	text    win.HWND
+	buttons []win.HWND
+	refresh func() string
+	actions []InfoAction
+	// results of background work
+	content string
+	err     error
+}
+
+var (
+	infoOnce sync.Once
+	infoErr  error
+	// there is single state for window procedure, so only one window could be shown
+	infoShown int32
+	iv        *infoViewer
+)
+
+// ShowInfo shows text refresh returns with action buttons under it, it returns when window is closed. Actions and
+// refresh run in background (they may wait for pinentry for example), text is refreshed after every action.
+func ShowInfo(caption string, refresh func() string, actions []InfoAction) error {
+	infoOnce.Do(func() { infoErr = registerInfoClass() })
+	if infoErr != nil {
+		return fmt.Errorf("unable to register information window class: %w", infoErr)
+	}
+	if !atomic.CompareAndSwapInt32(&infoShown, 0, 1) {
+		return errors.New("information window is already shown")
+	}
+	defer atomic.StoreInt32(&infoShown, 0)
+
+	content := refresh()
+
+	// window messages are delivered to the thread which created window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	width := int32(len(actions)+2)*(infoBtnW+infoGap) + infoGap
+	if width < infoMinW {
+		width = infoMinW
+	}
+	var (
+		height = int32(infoGap + infoTextH + infoGap + infoBtnH + infoGap)
+		frameW = int32(win.GetSystemMetrics(win.SM_CXFIXEDFRAME))*2 + 2
+		frameH = int32(win.GetSystemMetrics(win.SM_CYFIXEDFRAME)*2 + win.GetSystemMetrics(win.SM_CYCAPTION))
+		w, h   = width + frameW, height + frameH
+		x      = (win.GetSystemMetrics(win.SM_CXSCREEN) - w) / 2
+		y      = (win.GetSystemMetrics(win.SM_CYSCREEN) - h) / 2
+	)
+	v := &infoViewer{refresh: refresh, actions: actions}
+	iv = v
+	defer func() { iv = nil }()
+
+	v.wnd = win.CreateWindowEx(win.WS_EX_DLGMODALFRAME, windows.StringToUTF16Ptr(infoClass), windows.StringToUTF16Ptr(caption),
+		win.WS_CAPTION|win.WS_SYSMENU|win.WS_MINIMIZEBOX, x, y, w, h, 0, 0, win.GetModuleHandle(nil), nil)
+	if v.wnd == 0 {
+		return fmt.Errorf("unable to create information window: %w", windows.GetLastError())
+	}
+	v.text = v.child("EDIT", content, win.ES_MULTILINE|win.ES_READONLY|win.ES_AUTOVSCROLL|win.WS_BORDER|win.WS_VSCROLL|win.WS_TABSTOP,
+		infoText, infoGap, infoGap, width-2*infoGap, infoTextH)
+	// fixed width font keeps values aligned
+	win.SendMessage(v.text, win.WM_SETFONT, uintptr(win.GetStockObject(win.ANSI_FIXED_FONT)), 1)
+
+	top := int32(infoGap + infoTextH + infoGap)
+	left := int32(infoGap)
+	for i, a := range actions {
+		v.buttons = append(v.buttons, v.child("BUTTON", a.Title, win.WS_TABSTOP, int32(infoAction+i), left, top, infoBtnW, infoBtnH))
+		left += infoBtnW + infoGap
+	}
+	v.buttons = append(v.buttons, v.child("BUTTON", "Refresh", win.WS_TABSTOP, infoRefresh, left, top, infoBtnW, infoBtnH))
+	v.child("BUTTON", "Close", win.WS_TABSTOP|win.BS_DEFPUSHBUTTON, infoClose, width-infoGap-infoBtnW, top, infoBtnW, infoBtnH)
+
+	win.ShowWindow(v.wnd, win.SW_SHOWNORMAL)
+	win.SetForegroundWindow(v.wnd)
+
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		if win.IsDialogMessage(v.wnd, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+	return nil
+}
+
+// run performs action (if any) and refresh in background, buttons are disabled until it is done.
+func (v *infoViewer) run(action func() error) {
+	for _, b := range v.buttons {
+		win.EnableWindow(b, false)
+	}
+	go func() {
+		var err error
+		if action != nil {
+			err = action()
+		}
+		content := v.refresh()
+		v.mu.Lock()
+		v.content, v.err = content, err
+		v.mu.Unlock()
+		win.PostMessage(v.wnd, infoDone, 0, 0)
+	}()
+}
+
+// done shows results of background work.
+func (v *infoViewer) done() {
+	v.mu.Lock()
+	content, err := v.content, v.err
+	v.mu.Unlock()
+	win.SendMessage(v.text, win.WM_SETTEXT, 0, uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(content))))
+	for _, b := range v.buttons {
+		win.EnableWindow(b, true)
+	}
+	if err != nil {
+		win.MessageBox(v.wnd, windows.StringToUTF16Ptr(err.Error()), windows.StringToUTF16Ptr(WinAgentName), win.MB_OK|win.MB_ICONERROR)
+	}
+}
+
+func infoWndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	v := iv
+	switch msg {
+	case infoDone:
+		if v != nil {
+			v.done()
+		}
+		return 0
+	case win.WM_COMMAND:
+		if v == nil || win.HIWORD(uint32(wParam)) != win.BN_CLICKED {
+			break
+		}
+		switch id := int(win.LOWORD(uint32(wParam))); {
+		case id == infoRefresh:
+			v.run(nil)
+		case id == infoClose || id == win.IDCANCEL:
+			win.DestroyWindow(hwnd)
+		case id >= infoAction && id < infoAction+len(v.actions):
+			v.run(v.actions[id-infoAction].Run)
+		default:
+		}
+		return 0
+	case win.WM_CLOSE:
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		win.PostQuitMessage(0)
+		return 0
+	default:
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func registerInfoClass() error {
+	wc := win.WNDCLASSEX{
+		HInstance:     win.GetModuleHandle(nil),
+		LpszClassName: windows.StringToUTF16Ptr(infoClass),
+		LpfnWndProc:   windows.NewCallback(infoWndProc),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	if a := win.RegisterClassEx(&wc); a == 0 {
+		return windows.GetLastError()
+	}
+	return nil
+}
+
+func (v *infoViewer) child(class, text string, style uint32, id, x, y, w, h int32) win.HWND {
+	hwnd := win.CreateWindowEx(0, windows.StringToUTF16Ptr(class), windows.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, w, h, v.wnd, win.HMENU(id), win.GetModuleHandle(nil), nil)
+	win.SendMessage(hwnd, win.WM_SETFONT, uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)), 1)
+	return hwnd
+}
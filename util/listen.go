@@ -0,0 +1,257 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/multierr"
+)
+
+// multiListener merges several TCP listeners into single net.Listener so the same port could be served on a number of addresses at once.
+type multiListener struct {
+	ls    []net.Listener
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (ml *multiListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case ml.errs <- err:
+			case <-ml.done:
+			}
+			return
+		}
+		select {
+		case ml.conns <- conn:
+		case <-ml.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept implements net.Listener.
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case err := <-ml.errs:
+		// one of the listeners failed - stop everything
+		ml.Close()
+		return nil, err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.
+func (ml *multiListener) Close() (err error) {
+	ml.once.Do(func() {
+		close(ml.done)
+		for _, l := range ml.ls {
+			err = multierr.Append(err, l.Close())
+		}
+	})
+	return
+}
+
+// Addr implements net.Listener, returning address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.ls[0].Addr()
+}
+
+// Addrs returns addresses of all listeners.
+func (ml *multiListener) Addrs() []net.Addr {
+	res := make([]net.Addr, 0, len(ml.ls))
+	for _, l := range ml.ls {
+		res = append(res, l.Addr())
+	}
+	return res
+}
+
+// ResolveBindHosts converts list of configured bind addresses into list of IP addresses to listen on.
+// "localhost" is expanded to all loopback addresses (IPv4 and IPv6) available on this machine, empty list means "localhost".
+// Literal "*" (or "::") means all interfaces in dual-stack mode. Subnet in CIDR notation (100.64.0.0/10) is expanded to all local
+// addresses belonging to it and network interface name (Tailscale, wg0) - to all addresses of that interface, which allows to
+// restrict listeners to VPN adapters only.
+func ResolveBindHosts(hosts []string) ([]string, error) {
+
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+
+	seen := make(map[string]bool)
+	res := make([]string, 0, len(hosts))
+	add := func(ip string) {
+		if !seen[ip] {
+			seen[ip] = true
+			res = append(res, ip)
+		}
+	}
+
+	for _, h := range hosts {
+		h = strings.Trim(strings.TrimSpace(h), "[]")
+		switch {
+		case len(h) == 0:
+			continue
+		case h == "*" || h == "::":
+			add("::")
+		case strings.EqualFold(h, "localhost"):
+			for _, ip := range loopbackAddrs() {
+				add(ip)
+			}
+		case net.ParseIP(h) != nil:
+			add(net.ParseIP(h).String())
+		case strings.Contains(h, "/"):
+			_, subnet, err := net.ParseCIDR(h)
+			if err != nil {
+				return nil, fmt.Errorf("bad bind subnet %s: %w", h, err)
+			}
+			ips, err := subnetAddrs(subnet)
+			if err != nil {
+				return nil, err
+			}
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("no local addresses belong to bind subnet %s", h)
+			}
+			for _, ip := range ips {
+				add(ip)
+			}
+		case isInterfaceName(h):
+			ips, err := interfaceAddrs(h)
+			if err != nil {
+				return nil, err
+			}
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("network interface %s has no addresses", h)
+			}
+			for _, ip := range ips {
+				add(ip)
+			}
+		default:
+			ips, err := net.LookupIP(h)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve bind address %s: %w", h, err)
+			}
+			for _, ip := range ips {
+				add(ip.String())
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no usable bind addresses in %v", hosts)
+	}
+	return res, nil
+}
+
+func isInterfaceName(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// interfaceAddrs returns all unicast addresses of named network interface.
+func interfaceAddrs(name string) ([]string, error) {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find network interface %s: %w", name, err)
+	}
+	if ifc.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("network interface %s is down", name)
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get addresses of network interface %s: %w", name, err)
+	}
+	res := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && !ipn.IP.IsLinkLocalUnicast() {
+			res = append(res, ipn.IP.String())
+		}
+	}
+	return res, nil
+}
+
+// subnetAddrs returns all local unicast addresses which belong to subnet.
+func subnetAddrs(subnet *net.IPNet) ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local addresses: %w", err)
+	}
+	res := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && subnet.Contains(ipn.IP) {
+			res = append(res, ipn.IP.String())
+		}
+	}
+	return res, nil
+}
+
+// loopbackAddrs returns loopback addresses for which this machine has protocol support.
+func loopbackAddrs() []string {
+	res := make([]string, 0, 2)
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		// probe by binding ephemeral port - IPv6 may be disabled
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		res = append(res, ip)
+	}
+	if len(res) == 0 {
+		res = append(res, "127.0.0.1")
+	}
+	return res
+}
+
+// ListenTCP opens TCP listener on the same port for every requested bind address (see ResolveBindHosts).
+// If port is 0 ephemeral port allocated for the first address is reused for all others.
+func ListenTCP(hosts []string, port int) (net.Listener, error) {
+
+	ips, err := ResolveBindHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	ml := &multiListener{
+		ls:    make([]net.Listener, 0, len(ips)),
+		conns: make(chan net.Conn),
+		errs:  make(chan error),
+		done:  make(chan struct{}),
+	}
+	for _, ip := range ips {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			return nil, multierr.Append(fmt.Errorf("unable to listen on %s: %w", net.JoinHostPort(ip, strconv.Itoa(port)), err), ml.Close())
+		}
+		if port == 0 {
+			port = l.Addr().(*net.TCPAddr).Port
+		}
+		ml.ls = append(ml.ls, l)
+	}
+	for _, l := range ml.ls {
+		go ml.serve(l)
+	}
+	return ml, nil
+}
+
+// ListenerAddrs returns printable list of all addresses listener is bound to.
+func ListenerAddrs(l net.Listener) string {
+	if ml, ok := l.(*multiListener); ok {
+		addrs := ml.Addrs()
+		parts := make([]string, 0, len(addrs))
+		for _, a := range addrs {
+			parts = append(parts, a.String())
+		}
+		return strings.Join(parts, ", ")
+	}
+	return l.Addr().String()
+}
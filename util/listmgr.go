@@ -0,0 +1,181 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	listClass     = "win-gpg-agent-list"
+	listBox       = 300
+	listRemove    = 301
+	listRemoveAll = 302
+	listClose     = 303
+	listBtnW      = 150
+	listBtnH      = 30
+	listGap       = 8
+	listWidth     = 720
+	listH         = 260
+)
+
+// listManager is state of the only list window agent could show.
+type listManager struct {
+	wnd  win.HWND
+	list win.HWND
+	// original indexes of items still listed and of removed ones
+	kept    []int
+	removed []int
+}
+
+var (
+	listOnce sync.Once
+	listErr  error
+	// there is single state for window procedure, so only one window could be shown
+	listShown int32
+	lm        *listManager
+)
+
+// ManageList shows window with items user could select and remove, it returns original indexes of removed items when
+// window is closed.
+func ManageList(caption string, items []string) ([]int, error) {
+	listOnce.Do(func() { listErr = registerListClass() })
+	if listErr != nil {
+		return nil, fmt.Errorf("unable to register list window class: %w", listErr)
+	}
+	if !atomic.CompareAndSwapInt32(&listShown, 0, 1) {
+		return nil, errors.New("list window is already shown")
+	}
+	defer atomic.StoreInt32(&listShown, 0)
+
+	// window messages are delivered to the thread which created window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var (
+		height = listGap + listH + listGap + listBtnH + listGap
+		frameW = int32(win.GetSystemMetrics(win.SM_CXFIXEDFRAME))*2 + 2
+		frameH = int32(win.GetSystemMetrics(win.SM_CYFIXEDFRAME)*2 + win.GetSystemMetrics(win.SM_CYCAPTION))
+		w, h   = int32(listWidth) + frameW, int32(height) + frameH
+		x      = (win.GetSystemMetrics(win.SM_CXSCREEN) - w) / 2
+		y      = (win.GetSystemMetrics(win.SM_CYSCREEN) - h) / 2
+	)
+	m := &listManager{}
+	lm = m
+	defer func() { lm = nil }()
+
+	m.wnd = win.CreateWindowEx(win.WS_EX_DLGMODALFRAME|win.WS_EX_TOPMOST, windows.StringToUTF16Ptr(listClass), windows.StringToUTF16Ptr(caption),
+		win.WS_CAPTION|win.WS_SYSMENU, x, y, w, h, 0, 0, win.GetModuleHandle(nil), nil)
+	if m.wnd == 0 {
+		return nil, fmt.Errorf("unable to create list window: %w", windows.GetLastError())
+	}
+	m.list = m.child("LISTBOX", "", win.LBS_EXTENDEDSEL|win.LBS_NOINTEGRALHEIGHT|win.WS_BORDER|win.WS_VSCROLL|win.WS_HSCROLL|win.WS_TABSTOP, listBox, listGap, listGap, listWidth-2*listGap, listH)
+	win.SendMessage(m.list, win.LB_SETHORIZONTALEXTENT, listWidth*2, 0)
+	for i, t := range items {
+		win.SendMessage(m.list, win.LB_ADDSTRING, 0, uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(t))))
+		m.kept = append(m.kept, i)
+	}
+	top := int32(listGap + listH + listGap)
+	m.child("BUTTON", "Remove", win.WS_TABSTOP, listRemove, listGap, top, listBtnW, listBtnH)
+	m.child("BUTTON", "Remove all", win.WS_TABSTOP, listRemoveAll, 2*listGap+listBtnW, top, listBtnW, listBtnH)
+	m.child("BUTTON", "Close", win.WS_TABSTOP|win.BS_DEFPUSHBUTTON, listClose, listWidth-listGap-listBtnW, top, listBtnW, listBtnH)
+
+	win.ShowWindow(m.wnd, win.SW_SHOWNORMAL)
+	win.SetFocus(m.list)
+	win.SetForegroundWindow(m.wnd)
+
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		if win.IsDialogMessage(m.wnd, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+	sort.Ints(m.removed)
+	return m.removed, nil
+}
+
+// remove drops selected (or all) items from the list.
+func (m *listManager) remove(all bool) {
+	var sel []int32
+	if all {
+		for i := range m.kept {
+			sel = append(sel, int32(i))
+		}
+	} else if n := int(int32(win.SendMessage(m.list, win.LB_GETSELCOUNT, 0, 0))); n > 0 {
+		sel = make([]int32, n)
+		n = int(int32(win.SendMessage(m.list, win.LB_GETSELITEMS, uintptr(n), uintptr(unsafe.Pointer(&sel[0])))))
+		if n < 0 {
+			return
+		}
+		sel = sel[:n]
+	}
+	// from the end, so positions of items not yet removed do not change
+	sort.Slice(sel, func(i, j int) bool { return sel[i] > sel[j] })
+	for _, i := range sel {
+		if int(i) >= len(m.kept) {
+			continue
+		}
+		win.SendMessage(m.list, win.LB_DELETESTRING, uintptr(i), 0)
+		m.removed = append(m.removed, m.kept[i])
+		m.kept = append(m.kept[:i], m.kept[i+1:]...)
+	}
+}
+
+func listWndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	m := lm
+	switch msg {
+	case win.WM_COMMAND:
+		if m == nil || win.HIWORD(uint32(wParam)) != win.BN_CLICKED {
+			break
+		}
+		switch win.LOWORD(uint32(wParam)) {
+		case listRemove:
+			m.remove(false)
+		case listRemoveAll:
+			m.remove(true)
+		case listClose, win.IDCANCEL:
+			win.DestroyWindow(hwnd)
+		default:
+		}
+		return 0
+	case win.WM_CLOSE:
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		win.PostQuitMessage(0)
+		return 0
+	default:
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func registerListClass() error {
+	wc := win.WNDCLASSEX{
+		HInstance:     win.GetModuleHandle(nil),
+		LpszClassName: windows.StringToUTF16Ptr(listClass),
+		LpfnWndProc:   windows.NewCallback(listWndProc),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	if a := win.RegisterClassEx(&wc); a == 0 {
+		return windows.GetLastError()
+	}
+	return nil
+}
+
+func (m *listManager) child(class, text string, style uint32, id, x, y, w, h int32) win.HWND {
+	hwnd := win.CreateWindowEx(0, windows.StringToUTF16Ptr(class), windows.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, w, h, m.wnd, win.HMENU(id), win.GetModuleHandle(nil), nil)
+	win.SendMessage(hwnd, win.WM_SETFONT, uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)), 1)
+	return hwnd
+}
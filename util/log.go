@@ -3,6 +3,7 @@
 package util
 
 import (
+	"io"
 	"io/ioutil"
 	"log"
 	"unsafe"
@@ -31,6 +32,9 @@ func NewLogWriter(title string, flags int, debug bool) {
 	} else {
 		log.SetOutput(ioutil.Discard)
 	}
+	if crash != nil {
+		log.SetOutput(io.MultiWriter(log.Writer(), crash.ring))
+	}
 }
 
 func (l *logWriter) Write(p []byte) (n int, err error) {
@@ -42,3 +46,9 @@ func (l *logWriter) Write(p []byte) (n int, err error) {
 	_, _, _ = l.proc.Call(uintptr(unsafe.Pointer(text)))
 	return len(p), nil
 }
+
+// TeeLogWriter sends all log output to w in addition to wherever it was going before, regardless of debug mode.
+func TeeLogWriter(w io.Writer) {
+	log.SetFlags(log.Flags() | log.LstdFlags)
+	log.SetOutput(io.MultiWriter(log.Writer(), w))
+}
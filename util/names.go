@@ -1,6 +1,8 @@
 package util
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,11 +29,27 @@ const (
 	SocketAgentExtraName     = "S." + GPGAgentName + ".extra"
 	SocketAgentSSHName       = "S." + GPGAgentName + ".ssh"
 	SocketAgentSSHCygwinName = "S." + GPGAgentName + ".ssh.cyg"
+	SocketGclprName          = "S.gclpr"
+	DirmngrName              = "dirmngr"
+	SocketDirmngrName        = "S." + DirmngrName
 )
 
+// InstanceName decorates name with instance suffix, so several named agent-gui instances could coexist.
+func InstanceName(name, instance string) string {
+	if len(instance) == 0 {
+		return name
+	}
+	return name + "-" + instance
+}
+
+// ControlPipeName returns name of control API named pipe for instance.
+func ControlPipeName(instance string) string {
+	return "\\\\.\\pipe\\" + InstanceName(WinAgentName, instance) + "-control"
+}
+
 // PrepareWindowsPath prepares Windows path for use on unix shell line without quoting.
 func PrepareWindowsPath(path string) string {
-	return filepath.ToSlash(path)
+	return filepath.ToSlash(CleanPath(path))
 }
 
 // FileExists check if file exists.
@@ -43,6 +61,21 @@ func FileExists(filename string) bool {
 	return info.Mode().IsRegular()
 }
 
+// PipeExists checks if named pipe is already being served without connecting to it.
+func PipeExists(name string) bool {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return false
+	}
+	var data windows.Win32finddata
+	h, err := windows.FindFirstFile(p, &data)
+	if err != nil {
+		return false
+	}
+	windows.FindClose(h)
+	return true
+}
+
 // WaitForFileArrival checks for files existence once a second for requested waiting period.
 func WaitForFileArrival(period time.Duration, filenames ...string) bool {
 
@@ -112,6 +145,49 @@ func WaitForFileDeparture(period time.Duration, filenames ...string) {
 	}
 }
 
+// WatchDir reports changes of file names, sizes and write times in directory until ctx is canceled. Changes coming
+// faster than they are received are coalesced, channel is closed when watching stops. Nothing is polled, so idle
+// watcher does not wake up at all.
+func WatchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+
+	h, err := windows.FindFirstChangeNotification(dir, false,
+		windows.FILE_NOTIFY_CHANGE_FILE_NAME|windows.FILE_NOTIFY_CHANGE_SIZE|windows.FILE_NOTIFY_CHANGE_LAST_WRITE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %w", dir, err)
+	}
+	stop, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.FindCloseChangeNotification(h) //nolint:errcheck
+		return nil, fmt.Errorf("unable to create event: %w", err)
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		windows.SetEvent(stop) //nolint:errcheck
+	}()
+	go func() {
+		defer close(ch)
+		defer windows.CloseHandle(stop)              //nolint:errcheck
+		defer windows.FindCloseChangeNotification(h) //nolint:errcheck
+		for {
+			ev, err := windows.WaitForMultipleObjects([]windows.Handle{h, stop}, false, windows.INFINITE)
+			if err != nil || ev != windows.WAIT_OBJECT_0 {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+			if err := windows.FindNextChangeNotification(h); err != nil {
+				log.Printf("Unable to continue watching %s: %s", dir, err)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
 // IsNetClosing exists because ErrNetClosing is not exported. This is probably going to change in 1.16.
 func IsNetClosing(err error) bool {
 	return strings.Contains(err.Error(), "use of closed network connection")
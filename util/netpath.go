@@ -0,0 +1,45 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// IsRemotePath reports if path is on network share: UNC path or drive letter mapped to network (roaming profiles with
+// redirected folders end up here too).
+func IsRemotePath(path string) bool {
+	path = CleanPath(path)
+	if strings.HasPrefix(path, `\\`) && !strings.HasPrefix(path, `\\.\`) {
+		return true
+	}
+	root := filepath.VolumeName(path)
+	if len(root) != 2 || root[1] != ':' {
+		return false
+	}
+	p, err := windows.UTF16PtrFromString(root + `\`)
+	if err != nil {
+		return false
+	}
+	return windows.GetDriveType(p) == windows.DRIVE_REMOTE
+}
+
+// PathReachable checks that path could be accessed in timeout. Access to share whose server went away could hang for
+// long time, such check is abandoned and reported as failure.
+func PathReachable(path string, timeout time.Duration) error {
+	res := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%s did not answer in %s", path, timeout)
+	}
+}
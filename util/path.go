@@ -0,0 +1,53 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	longPathPrefix    = `\\?\`
+	longUNCPathPrefix = `\\?\UNC\`
+)
+
+// CleanPath removes Win32 long path prefix (\\?\ and \\?\UNC\) and cleans the result. Go adds prefix itself when it is
+// necessary, while gpg-agent command line, AF_UNIX socket names and WSL path translation do not understand it.
+func CleanPath(path string) string {
+	if len(path) == 0 {
+		return path
+	}
+	switch {
+	case strings.HasPrefix(path, longUNCPathPrefix):
+		path = `\\` + path[len(longUNCPathPrefix):]
+	case strings.HasPrefix(path, longPathPrefix):
+		path = path[len(longPathPrefix):]
+	}
+	return filepath.Clean(path)
+}
+
+// IsASCII reports if path could be passed to programs which are not Unicode aware without being mangled.
+func IsASCII(path string) bool {
+	for i := 0; i < len(path); i++ {
+		if path[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// ShortPath returns 8.3 form of existing path (which is always ASCII) or path itself if it could not be obtained.
+func ShortPath(path string) string {
+	p, err := windows.UTF16FromString(path)
+	if err != nil {
+		return path
+	}
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n, err := windows.GetShortPathName(&p[0], &buf[0], uint32(len(buf)))
+	if err != nil || n == 0 || int(n) > len(buf) {
+		return path
+	}
+	return windows.UTF16ToString(buf[:n])
+}
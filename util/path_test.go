@@ -0,0 +1,107 @@
+package util
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{``, ``},
+		{`C:\Users\José\AppData\Local\gnupg`, `C:\Users\José\AppData\Local\gnupg`},
+		{`\\?\C:\Users\José\AppData\Local\gnupg\`, `C:\Users\José\AppData\Local\gnupg`},
+		{`\\?\UNC\server\share\Ærø\gnupg`, `\\server\share\Ærø\gnupg`},
+		{`C:\Users\Zoë\..\Zoë\gnupg`, `C:\Users\Zoë\gnupg`},
+	} {
+		if got := CleanPath(tc.in); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestPrepareWindowsPath(t *testing.T) {
+	if got, want := PrepareWindowsPath(`\\?\C:\Users\José\gnupg`), `C:/Users/José/gnupg`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSocketDir(t *testing.T) {
+	t.Setenv("LOCALAPPDATA", `C:\Users\x\AppData\Local`)
+
+	home := `C:\Users\x\AppData\Local\gnupg\agent-gui`
+	if got := SocketDir(home); got != home {
+		t.Errorf("short ASCII home was relocated to %q", got)
+	}
+
+	for _, home := range []string{
+		`C:\Users\José\AppData\Local\gnupg\agent-gui`,
+		`C:\Users\x\AppData\Local\` + strings.Repeat(`very-deep-directory\`, 5) + `agent-gui`,
+	} {
+		got := SocketDir(home)
+		if !IsASCII(got) || len(filepath.Join(got, longestSocketName)) >= MaxNameLen {
+			t.Errorf("%q: unusable socket directory %q", home, got)
+		}
+		if filepath.Dir(filepath.Dir(got)) != `C:\Users\x\AppData\Local` {
+			t.Errorf("%q: unexpected socket directory %q", home, got)
+		}
+		if again := SocketDir(strings.ToUpper(home)); again != got {
+			t.Errorf("%q: socket directory is not stable: %q != %q", home, again, got)
+		}
+	}
+}
+
+func TestUpdateWSLENV(t *testing.T) {
+	for _, tc := range []struct {
+		val, name, flags string
+		add              bool
+		want             string
+	}{
+		{"", "WSL_AGENT_HOME", "up", true, "WSL_AGENT_HOME/up"},
+		{"WSL_AGENT_HOME/up:WT_SESSION", "WSL_AGENT_HOME", "up", true, "WT_SESSION:WSL_AGENT_HOME/up"},
+		{"WSL_AGENT_HOME_OLD/up:WSL_AGENT_HOME/u", "WSL_AGENT_HOME", "", false, "WSL_AGENT_HOME_OLD/up"},
+		{"::WSL_AGENT_HOME::", "WSL_AGENT_HOME", "", false, ""},
+		{"WT_SESSION:WSL_AGENT_HOME/u:WSL_AGENT_HOME", "WSL_AGENT_HOME", "", true, "WT_SESSION:WSL_AGENT_HOME"},
+	} {
+		if got := updateWSLENV(tc.val, tc.name, tc.flags, tc.add); got != tc.want {
+			t.Errorf("%q %q %q: got %q, want %q", tc.val, tc.name, tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestCleanWSLENV(t *testing.T) {
+	for _, tc := range []struct {
+		val, name, flags, want string
+	}{
+		{"WT_SESSION:WSL_AGENT_HOME/up", "WSL_AGENT_HOME", "up", "WT_SESSION"},
+		// changed by user after we set it
+		{"WT_SESSION:WSL_AGENT_HOME/u", "WSL_AGENT_HOME", "up", "WT_SESSION:WSL_AGENT_HOME/u"},
+		{"USERPROFILE/p:WSL_AGENT_HOME/up", "USERPROFILE", "p", "WSL_AGENT_HOME/up"},
+		{"WSL_AGENT_HOME/up", "WSL_AGENT_HOME", "up", ""},
+	} {
+		if got := cleanWSLENV(tc.val, tc.name, tc.flags); got != tc.want {
+			t.Errorf("%q %q %q: got %q, want %q", tc.val, tc.name, tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestCheckWSLENV(t *testing.T) {
+	for _, tc := range []struct {
+		name, flags string
+		ok          bool
+	}{
+		{"WSL_AGENT_HOME", "up", true},
+		{"USERPROFILE", "", true},
+		{"GOPATH", "lw", true},
+		{"GOPATH", "pl", false},
+		{"GOPATH", "x", false},
+		{"A:B", "u", false},
+		{"", "u", false},
+	} {
+		if err := CheckWSLENV(tc.name, tc.flags); (err == nil) != tc.ok {
+			t.Errorf("%q %q: unexpected result %v", tc.name, tc.flags, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modIPHlpAPI                  = windows.NewLazySystemDLL("iphlpapi")
+	pGetExtendedTCPTable         = modIPHlpAPI.NewProc("GetExtendedTcpTable")
+	pGetNamedPipeClientProcessID = kernel.NewProc("GetNamedPipeClientProcessId")
+	errPeerUnknown               = errors.New("unable to identify peer process")
+)
+
+// PeerPID returns process id of the local process on the other side of accepted connection. Named pipes, AF_UNIX
+// sockets and loopback TCP connections are supported.
+func PeerPID(conn net.Conn) (uint32, error) {
+	switch c := conn.(type) {
+	case interface{ Fd() uintptr }:
+		// named pipe
+		var pid uint32
+		if r, _, err := pGetNamedPipeClientProcessID.Call(c.Fd(), uintptr(unsafe.Pointer(&pid))); r == 0 {
+			return 0, fmt.Errorf("GetNamedPipeClientProcessId: %w", err)
+		}
+		return pid, nil
+	case *net.UnixConn:
+		return unixPeerPID(c)
+	case *net.TCPConn:
+		return tcpPeerPID(c)
+	}
+	return 0, errPeerUnknown
+}
+
+func unixPeerPID(c *net.UnixConn) (uint32, error) {
+	const sioAfUnixGetPeerPID = 0x58000100
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		pid  uint32
+		serr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		var ret uint32
+		serr = windows.WSAIoctl(windows.Handle(fd), sioAfUnixGetPeerPID, nil, 0, (*byte)(unsafe.Pointer(&pid)), 4, &ret, nil, 0)
+	}); err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, fmt.Errorf("SIO_AF_UNIX_GETPEERPID: %w", serr)
+	}
+	return pid, nil
+}
+
+func tcpPeerPID(c *net.TCPConn) (uint32, error) {
+	const tcpTableOwnerPIDConnections = 4
+
+	local, lok := c.LocalAddr().(*net.TCPAddr)
+	remote, rok := c.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok || !remote.IP.IsLoopback() {
+		return 0, errPeerUnknown
+	}
+
+	af, rowSize, portOff, pidOff := uint32(windows.AF_INET), 24, [2]int{8, 16}, 20
+	if remote.IP.To4() == nil {
+		af, rowSize, portOff, pidOff = windows.AF_INET6, 56, [2]int{20, 44}, 52
+	}
+
+	var size uint32
+	_, _, _ = pGetExtendedTCPTable.Call(0, uintptr(unsafe.Pointer(&size)), 0, uintptr(af), tcpTableOwnerPIDConnections, 0)
+	for {
+		if size == 0 {
+			return 0, errPeerUnknown
+		}
+		buf := make([]byte, size)
+		r, _, _ := pGetExtendedTCPTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0, uintptr(af), tcpTableOwnerPIDConnections, 0)
+		if windows.Errno(r) == windows.ERROR_INSUFFICIENT_BUFFER {
+			continue
+		}
+		if r != 0 {
+			return 0, fmt.Errorf("GetExtendedTcpTable: %w", windows.Errno(r))
+		}
+		// rows have connection from client side: local port is remote port of accepted connection and vice versa
+		port := func(row []byte, off int) int { return int(binary.BigEndian.Uint16(row[off : off+2])) }
+		n := int(binary.LittleEndian.Uint32(buf))
+		for i := 0; i < n; i++ {
+			off := 4 + i*rowSize
+			if off+rowSize > len(buf) {
+				break
+			}
+			row := buf[off : off+rowSize]
+			if port(row, portOff[0]) == remote.Port && port(row, portOff[1]) == local.Port {
+				return binary.LittleEndian.Uint32(row[pidOff:]), nil
+			}
+		}
+		return 0, errPeerUnknown
+	}
+}
+
+// ProcessImage returns full path of executable image for process.
+func ProcessImage(pid uint32) (string, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", fmt.Errorf("unable to open process %d: %w", pid, err)
+	}
+	defer windows.CloseHandle(h) //nolint:errcheck
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return "", fmt.Errorf("unable to get image name of process %d: %w", pid, err)
+	}
+	return windows.UTF16ToString(buf[:size]), nil
+}
+
+// ProcessUser returns SID of the user process runs as.
+func ProcessUser(pid uint32) (*windows.SID, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open process %d: %w", pid, err)
+	}
+	defer windows.CloseHandle(h) //nolint:errcheck
+
+	var t windows.Token
+	if err := windows.OpenProcessToken(h, windows.TOKEN_QUERY, &t); err != nil {
+		return nil, fmt.Errorf("unable to open token of process %d: %w", pid, err)
+	}
+	defer t.Close()
+
+	u, err := t.GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user of process %d: %w", pid, err)
+	}
+	return u.User.Sid.Copy()
+}
+
+// CheckPeerOwner verifies that local process on the other side of connection (AF_UNIX, named pipe or loopback TCP)
+// runs as the same user we do, so processes of other users logged on to the same machine (Fast User Switching, RDP)
+// are never served. Remote connections, peers which could not be identified and known service relays are reported
+// with errPeerUnknown wrapped. Processes in WSL1 distributions run with token of Windows user who started them, so
+// this rejects other Windows users only - WSL users of the same distribution are kept out by permissions of socket
+// directory.
+func CheckPeerOwner(conn net.Conn) error {
+	pid, err := PeerPID(conn)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPeerUnknown, err)
+	}
+	self, err := ProcessUser(windows.GetCurrentProcessId())
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPeerUnknown, err)
+	}
+	p := peerProcess{pid: pid}
+	if p.user, err = ProcessUser(pid); err == nil && p.user.Equals(self) {
+		return nil
+	}
+	// token of service process could not be opened by user, terminal services know its owner anyway
+	if perr := p.describe(); perr != nil && p.user == nil {
+		return fmt.Errorf("owner of process %d could not be established: %s, %s", pid, err, perr)
+	}
+	return checkPeer(&p, self)
+}
+
+// peerProcess is what is known about process on the other side of connection.
+type peerProcess struct {
+	pid     uint32
+	session uint32
+	// image is executable name without path
+	image string
+	user  *windows.SID
+}
+
+// wtsProcessInfo is WTS_PROCESS_INFOW.
+type wtsProcessInfo struct {
+	session uint32
+	pid     uint32
+	name    *uint16
+	user    *windows.SID
+}
+
+var pWTSEnumerateProcesses = windows.NewLazySystemDLL("wtsapi32").NewProc("WTSEnumerateProcessesW")
+
+// describe fills session, image and owner (if it is not known) of process from terminal services process list.
+func (p *peerProcess) describe() error {
+	var (
+		info  *wtsProcessInfo
+		count uint32
+	)
+	if r, _, err := pWTSEnumerateProcesses.Call(0, 0, 1, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&count))); r == 0 {
+		return fmt.Errorf("WTSEnumerateProcesses: %w", err)
+	}
+	defer windows.WTSFreeMemory(uintptr(unsafe.Pointer(info)))
+
+	for _, pi := range unsafe.Slice(info, count) {
+		if pi.pid != p.pid {
+			continue
+		}
+		p.session, p.image = pi.session, windows.UTF16PtrToString(pi.name)
+		if p.user == nil && pi.user != nil {
+			user, err := pi.user.Copy()
+			if err != nil {
+				return err
+			}
+			p.user = user
+		}
+		return nil
+	}
+	return fmt.Errorf("process %d is not running", p.pid)
+}
+
+// Session 0 services relaying connections of interactive user to our ports: IP Helper service port proxy (netsh
+// interface portproxy) in svchost and WSL localhost forwarding in wslrelay. They run as SYSTEM or LocalService.
+var (
+	relayUsers  = []windows.WELL_KNOWN_SID_TYPE{windows.WinLocalSystemSid, windows.WinLocalServiceSid}
+	relayImages = []string{"svchost.exe", "wslrelay.exe"}
+)
+
+// checkPeer decides if process of another user is rejected. Only known service relays are left to other checks as
+// peers of unknown owner - they forward connections of everybody.
+func checkPeer(p *peerProcess, self *windows.SID) error {
+	switch {
+	case p.user == nil:
+		return fmt.Errorf("owner of process %d could not be established", p.pid)
+	case p.user.Equals(self):
+		return nil
+	case isServiceRelay(p):
+		return fmt.Errorf("%w: process %d is %s service running as %s", errPeerUnknown, p.pid, p.image, sidName(p.user))
+	default:
+	}
+	return fmt.Errorf("process %d belongs to %s", p.pid, sidName(p.user))
+}
+
+// isServiceRelay reports session 0 processes of known relay services.
+func isServiceRelay(p *peerProcess) bool {
+	if p.session != 0 {
+		return false
+	}
+	relay := false
+	for _, name := range relayImages {
+		relay = relay || strings.EqualFold(filepath.Base(p.image), name)
+	}
+	if !relay {
+		return false
+	}
+	for _, t := range relayUsers {
+		if p.user.IsWellKnown(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPeerUnknown reports errors of CheckPeerOwner which mean that owner could not be established.
+func IsPeerUnknown(err error) bool {
+	return errors.Is(err, errPeerUnknown)
+}
+
+func sidName(sid *windows.SID) string {
+	if account, domain, _, err := sid.LookupAccount(""); err == nil {
+		return domain + `\` + account
+	}
+	return sid.String()
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"testing"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestCheckPeer(t *testing.T) {
+	sid := func(s string) *windows.SID {
+		t.Helper()
+		if s == "" {
+			return nil
+		}
+		sid, err := windows.StringToSid(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sid
+	}
+	const (
+		self    = "S-1-5-21-1004336348-1177238915-682003330-1001"
+		other   = "S-1-5-21-1004336348-1177238915-682003330-1002"
+		system  = "S-1-5-18"
+		service = "S-1-5-19"
+		network = "S-1-5-20"
+	)
+
+	for _, tc := range []struct {
+		name    string
+		session uint32
+		image   string
+		user    string
+		// accepted is nil error, unknown is errPeerUnknown which caller leaves to other checks
+		accepted, unknown bool
+	}{
+		{"same user", 1, `C:\Windows\System32\OpenSSH\ssh.exe`, self, true, false},
+		{"same user service", 0, "svchost.exe", self, true, false},
+		{"other user", 2, `C:\Program Files\Git\usr\bin\ssh.exe`, other, false, false},
+		{"other user session 0", 0, "ssh.exe", other, false, false},
+		{"other user svchost", 0, "svchost.exe", other, false, false},
+		{"port proxy", 0, "svchost.exe", system, false, true},
+		{"port proxy path", 0, `C:\Windows\System32\svchost.exe`, system, false, true},
+		{"wsl relay", 0, "wslrelay.exe", service, false, true},
+		{"wsl relay case", 0, "WSLRelay.EXE", system, false, true},
+		{"system shell", 0, "cmd.exe", system, false, false},
+		{"network service", 0, "svchost.exe", network, false, false},
+		{"system svchost session 1", 1, "svchost.exe", system, false, false},
+		{"unknown owner", 0, "svchost.exe", "", false, false},
+	} {
+		p := &peerProcess{pid: 1234, session: tc.session, image: tc.image, user: sid(tc.user)}
+		err := checkPeer(p, sid(self))
+		if (err == nil) != tc.accepted || IsPeerUnknown(err) != tc.unknown {
+			t.Errorf("%s: got %v, accepted %t, unknown %t expected", tc.name, err, tc.accepted, tc.unknown)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+var (
+	modAdvAPI32               = windows.NewLazySystemDLL("advapi32")
+	pPerfStartProvider        = modAdvAPI32.NewProc("PerfStartProvider")
+	pPerfStopProvider         = modAdvAPI32.NewProc("PerfStopProvider")
+	pPerfSetCounterSetInfo    = modAdvAPI32.NewProc("PerfSetCounterSetInfo")
+	pPerfCreateInstance       = modAdvAPI32.NewProc("PerfCreateInstance")
+	pPerfDeleteInstance       = modAdvAPI32.NewProc("PerfDeleteInstance")
+	pPerfSetULongCounterValue = modAdvAPI32.NewProc("PerfSetULongCounterValue")
+)
+
+const (
+	perfCountersetMultiInstances = 2
+	perfCounterRawcount          = 0x00010000
+	perfDetailNovice             = 100
+	perfMaxCounters              = 32
+)
+
+// PERF_COUNTERSET_INFO
+type perfCounterSetInfo struct {
+	CounterSetGUID windows.GUID
+	ProviderGUID   windows.GUID
+	NumCounters    uint32
+	InstanceType   uint32
+}
+
+// PERF_COUNTER_INFO
+type perfCounterInfo struct {
+	CounterID   uint32
+	Type        uint32
+	Attrib      uint64
+	Size        uint32
+	DetailLevel uint32
+	Scale       int32
+	Offset      uint32
+}
+
+// PerfCounters publishes instance of counter set with 32-bit raw counters through PerfLib V2 provider. Consumers
+// (perfmon, Get-Counter, WMI Win32_PerfRawData_* classes) see it only when provider manifest is registered with lodctr,
+// without registration counters are simply not collected.
+type PerfCounters struct {
+	provider windows.Handle
+	instance uintptr
+}
+
+// StartPerfCounters registers provider with counter set of counters (their ids are 1..counters) and creates its
+// instance.
+func StartPerfCounters(provider, counterSet windows.GUID, counters int, instance string) (*PerfCounters, error) {
+	if counters <= 0 || counters > perfMaxCounters {
+		return nil, fmt.Errorf("bad number of counters %d", counters)
+	}
+	if err := pPerfStartProvider.Find(); err != nil {
+		return nil, err
+	}
+	name, err := windows.UTF16PtrFromString(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PerfCounters{}
+	if r, _, _ := pPerfStartProvider.Call(uintptr(unsafe.Pointer(&provider)), 0, uintptr(unsafe.Pointer(&p.provider))); r != 0 {
+		return nil, fmt.Errorf("PerfStartProvider: %w", windows.Errno(r))
+	}
+
+	var tmpl struct {
+		set      perfCounterSetInfo
+		counters [perfMaxCounters]perfCounterInfo
+	}
+	tmpl.set = perfCounterSetInfo{CounterSetGUID: counterSet, ProviderGUID: provider, NumCounters: uint32(counters), InstanceType: perfCountersetMultiInstances}
+	for i := 0; i < counters; i++ {
+		tmpl.counters[i] = perfCounterInfo{CounterID: uint32(i + 1), Type: perfCounterRawcount, Size: 4, DetailLevel: perfDetailNovice, Offset: uint32(i * 4)}
+	}
+	size := unsafe.Sizeof(tmpl.set) + uintptr(counters)*unsafe.Sizeof(tmpl.counters[0])
+	if r, _, _ := pPerfSetCounterSetInfo.Call(uintptr(p.provider), uintptr(unsafe.Pointer(&tmpl)), size); r != 0 {
+		p.Close()
+		return nil, fmt.Errorf("PerfSetCounterSetInfo: %w", windows.Errno(r))
+	}
+	r, _, err := pPerfCreateInstance.Call(uintptr(p.provider), uintptr(unsafe.Pointer(&counterSet)), uintptr(unsafe.Pointer(name)), 0)
+	if r == 0 {
+		p.Close()
+		return nil, fmt.Errorf("PerfCreateInstance: %w", err)
+	}
+	p.instance = r
+	return p, nil
+}
+
+// Set changes value of counter.
+func (p *PerfCounters) Set(id int, v uint32) error {
+	if p == nil || p.instance == 0 {
+		return errors.New("counters are not started")
+	}
+	if r, _, _ := pPerfSetULongCounterValue.Call(uintptr(p.provider), p.instance, uintptr(id), uintptr(v)); r != 0 {
+		return fmt.Errorf("PerfSetULongCounterValue: %w", windows.Errno(r))
+	}
+	return nil
+}
+
+// Close removes counters instance and unregisters provider.
+func (p *PerfCounters) Close() {
+	if p == nil {
+		return
+	}
+	if p.instance != 0 {
+		pPerfDeleteInstance.Call(uintptr(p.provider), p.instance)
+		p.instance = 0
+	}
+	if p.provider != 0 {
+		pPerfStopProvider.Call(uintptr(p.provider))
+		p.provider = 0
+	}
+}
+
+// PerfProviderRegistered tells if counters manifest of provider is registered.
+func PerfProviderRegistered(provider windows.GUID) bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion\Perflib\_V2Providers\`+provider.String(), registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	k.Close()
+	return true
+}
+
+// RegisterPerfManifest installs (or removes) counters manifest, binDir is where binary with counter names resources is.
+// This requires administrative rights, so lodctr.exe is started elevated (single UAC prompt is shown) and result is
+// waited for.
+func RegisterPerfManifest(provider windows.GUID, manifest, binDir string, install bool) error {
+	args := fmt.Sprintf(`/c lodctr.exe /m:"%s" "%s"`, manifest, binDir)
+	if !install {
+		args = fmt.Sprintf(`/c unlodctr.exe /m:"%s"`, manifest)
+	}
+	if err := windows.ShellExecute(0, windows.StringToUTF16Ptr("runas"), windows.StringToUTF16Ptr("cmd.exe"), windows.StringToUTF16Ptr(args), nil, windows.SW_HIDE); err != nil {
+		return fmt.Errorf("unable to run elevated lodctr.exe: %w", err)
+	}
+	for i := 0; i < 100; i++ {
+		if PerfProviderRegistered(provider) == install {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if install {
+		return errors.New("performance counters were not registered")
+	}
+	return errors.New("performance counters are still registered")
+}
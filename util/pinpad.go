@@ -0,0 +1,263 @@
+package util
+
+import (
+	"crypto/rand"
+	"log"
+	"math/big"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+// PIN pad modes.
+const (
+	PinPadOff    = "off"
+	PinPadCard   = "card"
+	PinPadAlways = "always"
+)
+
+// maxPIN is longest PIN which could be entered on PIN pad, card PINs are much shorter.
+const maxPIN = 64
+
+const (
+	padClass    = "win-gpg-agent-pinpad"
+	padDigit    = 100 // ids of digit buttons are padDigit + position
+	padBack     = 120
+	padClear    = 121
+	padBtnW     = 72
+	padBtnH     = 36
+	padGap      = 8
+	padWidth    = 3*padBtnW + 4*padGap
+	padDescH    = 64
+	padDisplayH = 26
+)
+
+// pinPad is state of the only PIN pad window pinentry could show at a time.
+type pinPad struct {
+	wnd, display win.HWND
+	// digit shown on button in every position
+	layout [10]byte
+	pin    *SecureBuffer
+	ok     bool
+}
+
+var (
+	padOnce sync.Once
+	padErr  error
+	padMu   sync.Mutex
+	pad     *pinPad
+)
+
+// UsePinPad decides if PIN pad should be used for prompt in given mode, "card" selects it for smartcard PINs only.
+func UsePinPad(mode, prompt string) bool {
+	switch strings.ToLower(mode) {
+	case PinPadAlways:
+		return true
+	case PinPadCard:
+		// gpg-agent asks for "PIN", "Admin PIN", "Reset Code" when card is involved and for "Passphrase" otherwise
+		p := strings.ToUpper(prompt)
+		return strings.Contains(p, "PIN") || strings.Contains(p, "RESET CODE")
+	default:
+	}
+	return false
+}
+
+// shuffleDigits returns digits in random order using system cryptographic generator, so layout could not be guessed.
+func shuffleDigits() (res [10]byte) {
+	for i := range res {
+		res[i] = byte('0' + i)
+	}
+	for i := len(res) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			log.Printf("Unable to shuffle PIN pad, using fixed layout: %s", err)
+			return fixedDigits()
+		}
+		j := n.Int64()
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// fixedDigits returns phone-like layout: 1-9 in rows, 0 at the bottom.
+func fixedDigits() (res [10]byte) {
+	copy(res[:], "1234567890")
+	return res
+}
+
+func padWndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	p := pad
+	switch msg {
+	case win.WM_COMMAND:
+		if p == nil || win.HIWORD(uint32(wParam)) != win.BN_CLICKED {
+			break
+		}
+		switch id := int(win.LOWORD(uint32(wParam))); {
+		case id >= padDigit && id < padDigit+len(p.layout):
+			if p.pin.Len() < maxPIN {
+				_, _ = p.pin.Write(p.layout[id-padDigit : id-padDigit+1])
+			}
+		case id == padBack:
+			if p.pin.Len() > 0 {
+				p.pin.Truncate(p.pin.Len() - 1)
+			}
+		case id == padClear:
+			p.pin.Truncate(0)
+		case id == win.IDOK:
+			p.ok = true
+			win.DestroyWindow(hwnd)
+			return 0
+		case id == win.IDCANCEL:
+			win.DestroyWindow(hwnd)
+			return 0
+		default:
+		}
+		// only bullets are ever shown, PIN itself never leaves secure buffer
+		setText(p.display, strings.Repeat("●", p.pin.Len()))
+		return 0
+	case win.WM_CLOSE:
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		win.PostQuitMessage(0)
+		return 0
+	default:
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func setText(hwnd win.HWND, text string) {
+	win.SendMessage(hwnd, win.WM_SETTEXT, 0, uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(text))))
+}
+
+func registerPadClass() error {
+	wc := win.WNDCLASSEX{
+		HInstance:     win.GetModuleHandle(nil),
+		LpszClassName: windows.StringToUTF16Ptr(padClass),
+		LpfnWndProc:   windows.NewCallback(padWndProc),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	if a := win.RegisterClassEx(&wc); a == 0 {
+		return windows.GetLastError()
+	}
+	return nil
+}
+
+func (p *pinPad) child(class, text string, style uint32, id, x, y, w, h int32) win.HWND {
+	hwnd := win.CreateWindowEx(0, windows.StringToUTF16Ptr(class), windows.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, w, h, p.wnd, win.HMENU(id), win.GetModuleHandle(nil), nil)
+	win.SendMessage(hwnd, win.WM_SETFONT, uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)), 1)
+	return hwnd
+}
+
+// PromptPinPad shows window with clickable digit buttons for entering PIN with mouse or touch screen. Keyboard input
+// of digits is not accepted, so simple key loggers see nothing. When shuffle is set digits are placed randomly every
+// time. Returns true if operation was canceled.
+func PromptPinPad(details DlgDetails, errorMessage, description, prompt string, shuffle bool) (bool, *SecureBuffer) {
+
+	padOnce.Do(func() { padErr = registerPadClass() })
+	if padErr != nil {
+		log.Printf("Unable to register PIN pad window class: %s", padErr)
+		return true, nil
+	}
+
+	pin, err := NewSecureBuffer(maxPIN)
+	if err != nil {
+		log.Print(err)
+		return true, nil
+	}
+
+	padMu.Lock()
+	defer padMu.Unlock()
+
+	// window messages are delivered to the thread which created window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	p := &pinPad{pin: pin, layout: fixedDigits()}
+	if shuffle {
+		p.layout = shuffleDigits()
+	}
+	pad = p
+	defer func() { pad = nil }()
+
+	description = cleanLabel(description)
+	if len(errorMessage) > 0 {
+		description = cleanLabel(errorMessage) + "\n\n" + description
+	}
+	caption := "Pinentry (go)"
+	if prompt = cleanLabel(prompt); len(prompt) > 0 {
+		caption += " - " + strings.TrimSuffix(prompt, ":")
+	}
+
+	var (
+		rows   = int32(4)
+		height = padGap + padDescH + padGap + padDisplayH + padGap + rows*(padBtnH+padGap) + padGap + padBtnH + padGap
+		frameW = int32(win.GetSystemMetrics(win.SM_CXFIXEDFRAME))*2 + 2
+		frameH = int32(win.GetSystemMetrics(win.SM_CYFIXEDFRAME)*2 + win.GetSystemMetrics(win.SM_CYCAPTION))
+		w, h   = int32(padWidth) + frameW, height + frameH
+		x      = (win.GetSystemMetrics(win.SM_CXSCREEN) - w) / 2
+		y      = (win.GetSystemMetrics(win.SM_CYSCREEN) - h) / 2
+	)
+	p.wnd = win.CreateWindowEx(win.WS_EX_DLGMODALFRAME|win.WS_EX_TOPMOST, windows.StringToUTF16Ptr(padClass), windows.StringToUTF16Ptr(caption),
+		win.WS_CAPTION|win.WS_SYSMENU, x, y, w, h, 0, 0, win.GetModuleHandle(nil), nil)
+	if p.wnd == 0 {
+		log.Printf("Unable to create PIN pad window: %s", windows.GetLastError())
+		pin.Free()
+		return true, nil
+	}
+
+	p.child("STATIC", description, win.SS_LEFT, 0, padGap, padGap, padWidth-2*padGap, padDescH)
+	top := int32(padGap + padDescH + padGap)
+	p.display = p.child("EDIT", "", win.ES_CENTER|win.ES_READONLY|win.WS_BORDER, 0, padGap, top, padWidth-2*padGap, padDisplayH)
+	top += padDisplayH + padGap
+
+	// 3x3 digits, then Clear, last digit, Back
+	for i := 0; i < 9; i++ {
+		r, c := int32(i/3), int32(i%3)
+		style := uint32(win.WS_TABSTOP)
+		if i == 0 {
+			style |= win.WS_GROUP
+		}
+		p.child("BUTTON", string(p.layout[i]), style, int32(padDigit+i), padGap+c*(padBtnW+padGap), top+r*(padBtnH+padGap), padBtnW, padBtnH)
+	}
+	last := top + 3*(padBtnH+padGap)
+	p.child("BUTTON", "Clear", win.WS_TABSTOP, padClear, padGap, last, padBtnW, padBtnH)
+	p.child("BUTTON", string(p.layout[9]), win.WS_TABSTOP, padDigit+9, padGap+padBtnW+padGap, last, padBtnW, padBtnH)
+	p.child("BUTTON", "←", win.WS_TABSTOP, padBack, padGap+2*(padBtnW+padGap), last, padBtnW, padBtnH)
+
+	bottom := last + padBtnH + 2*padGap
+	half := int32(padWidth-3*padGap) / 2
+	ok := p.child("BUTTON", "OK", win.WS_TABSTOP|win.WS_GROUP|win.BS_DEFPUSHBUTTON, win.IDOK, padGap, bottom, half, padBtnH)
+	p.child("BUTTON", "Cancel", win.WS_TABSTOP, win.IDCANCEL, 2*padGap+half, bottom, half, padBtnH)
+
+	win.ShowWindow(p.wnd, win.SW_SHOWNORMAL)
+	win.SetFocus(ok)
+	// see PromptForWindowsCredentials - window started from background process may not get foreground by itself
+	go func(hwnd win.HWND) {
+		<-time.After(details.Delay)
+		win.SetForegroundWindow(hwnd)
+	}(p.wnd)
+
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		if win.IsDialogMessage(p.wnd, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+
+	if !p.ok {
+		pin.Free()
+		return true, nil
+	}
+	return false, pin
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var pImpersonateNamedPipeClient = windows.NewLazySystemDLL("advapi32").NewProc("ImpersonateNamedPipeClient")
+
+// Impersonation levels named pipe client could grant to server (SECURITY_IMPERSONATION_LEVEL).
+const (
+	ImpersonationAnonymous      = windows.SecurityAnonymous
+	ImpersonationIdentification = windows.SecurityIdentification
+	ImpersonationImpersonation  = windows.SecurityImpersonation
+	ImpersonationDelegation     = windows.SecurityDelegation
+)
+
+// ImpersonationLevelName returns configuration name of impersonation level.
+func ImpersonationLevelName(level uint32) string {
+	switch level {
+	case ImpersonationAnonymous:
+		return "anonymous"
+	case ImpersonationIdentification:
+		return "identification"
+	case ImpersonationImpersonation:
+		return "impersonation"
+	case ImpersonationDelegation:
+		return "delegation"
+	default:
+	}
+	return fmt.Sprintf("level %d", level)
+}
+
+// PipeImpersonationLevel returns impersonation level client of accepted named pipe connection allowed (with
+// SECURITY_SQOS_PRESENT flags of CreateFile), clients which do not say anything allow impersonation.
+func PipeImpersonationLevel(conn net.Conn) (uint32, error) {
+	c, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, errPeerUnknown
+	}
+
+	type result struct {
+		level uint32
+		err   error
+	}
+	res := make(chan result, 1)
+	go func() {
+		// impersonation changes identity of OS thread, so it is done on dedicated one
+		runtime.LockOSThread()
+		level, err := threadImpersonationLevel(c.Fd())
+		if rerr := windows.RevertToSelf(); rerr != nil {
+			// thread stays locked and is terminated with goroutine rather than going back to scheduler as client
+			res <- result{err: fmt.Errorf("RevertToSelf: %w", rerr)}
+			return
+		}
+		runtime.UnlockOSThread()
+		res <- result{level: level, err: err}
+	}()
+	r := <-res
+	return r.level, r.err
+}
+
+func threadImpersonationLevel(pipe uintptr) (uint32, error) {
+	if r, _, err := pImpersonateNamedPipeClient.Call(pipe); r == 0 {
+		return 0, fmt.Errorf("ImpersonateNamedPipeClient: %w", err)
+	}
+	var token windows.Token
+	if err := windows.OpenThreadToken(windows.CurrentThread(), windows.TOKEN_QUERY, true, &token); err != nil {
+		if errors.Is(err, windows.ERROR_CANT_OPEN_ANONYMOUS) {
+			return ImpersonationAnonymous, nil
+		}
+		return 0, fmt.Errorf("OpenThreadToken: %w", err)
+	}
+	defer token.Close()
+	var (
+		level uint32
+		size  uint32
+	)
+	if err := windows.GetTokenInformation(token, windows.TokenImpersonationLevel, (*byte)(unsafe.Pointer(&level)), uint32(unsafe.Sizeof(level)), &size); err != nil {
+		return 0, fmt.Errorf("GetTokenInformation: %w", err)
+	}
+	return level, nil
+}
@@ -0,0 +1,235 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modWinHTTP                             = windows.NewLazySystemDLL("winhttp")
+	pWinHttpOpen                           = modWinHTTP.NewProc("WinHttpOpen")
+	pWinHttpCloseHandle                    = modWinHTTP.NewProc("WinHttpCloseHandle")
+	pWinHttpGetProxyForUrl                 = modWinHTTP.NewProc("WinHttpGetProxyForUrl")
+	pWinHttpGetIEProxyConfigForCurrentUser = modWinHTTP.NewProc("WinHttpGetIEProxyConfigForCurrentUser")
+	pWinHttpGetDefaultProxyConfiguration   = modWinHTTP.NewProc("WinHttpGetDefaultProxyConfiguration")
+)
+
+// Proxy modes for network facing features.
+const (
+	ProxySystem      = "system"
+	ProxyEnvironment = "environment"
+	ProxyNone        = "none"
+)
+
+const (
+	winhttpAccessTypeNoProxy    = 1
+	winhttpAccessTypeNamedProxy = 3
+
+	winhttpAutoProxyAutoDetect = 0x1
+	winhttpAutoProxyConfigURL  = 0x2
+	winhttpAutoDetectTypeDHCP  = 0x1
+	winhttpAutoDetectTypeDNSA  = 0x2
+)
+
+type winhttpIEProxyConfig struct {
+	autoDetect    int32
+	autoConfigURL *uint16
+	proxy         *uint16
+	proxyBypass   *uint16
+}
+
+type winhttpAutoProxyOptions struct {
+	flags                 uint32
+	autoDetectFlags       uint32
+	autoConfigURL         *uint16
+	reserved              uintptr
+	reserved2             uint32
+	autoLogonIfChallenged int32
+}
+
+type winhttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
+
+// takeString converts string allocated by WinHTTP and frees it.
+func takeString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	s := windows.UTF16PtrToString(p)
+	win.GlobalFree(win.HGLOBAL(unsafe.Pointer(p)))
+	return s
+}
+
+// pickProxy selects entry for scheme from WinHTTP proxy list ("host:port" or "http=host:port;https=host:port").
+func pickProxy(list, scheme string) string {
+	var generic string
+	for _, e := range strings.FieldsFunc(list, func(r rune) bool { return r == ';' || r == ' ' }) {
+		if i := strings.IndexByte(e, '='); i >= 0 {
+			if strings.EqualFold(e[:i], scheme) {
+				return e[i+1:]
+			}
+			continue
+		}
+		if len(generic) == 0 {
+			generic = e
+		}
+	}
+	return generic
+}
+
+// bypassed checks host against WinHTTP bypass list, "<local>" matches names without dots.
+func bypassed(bypass, host string) bool {
+	host = strings.ToLower(host)
+	for _, e := range strings.FieldsFunc(bypass, func(r rune) bool { return r == ';' || r == ' ' }) {
+		e = strings.ToLower(e)
+		if e == "<local>" {
+			if !strings.Contains(host, ".") {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(e, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func proxyURL(entry string) (*url.URL, error) {
+	if len(entry) == 0 {
+		return nil, nil
+	}
+	if !strings.Contains(entry, "://") {
+		entry = "http://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy \"%s\": %w", entry, err)
+	}
+	return u, nil
+}
+
+// autoProxy runs WPAD and/or PAC script evaluation for target.
+func autoProxy(target string, autoDetect bool, pac *uint16) (string, string, bool) {
+	agent, _ := windows.UTF16PtrFromString("win-gpg-agent")
+	session, _, _ := pWinHttpOpen.Call(uintptr(unsafe.Pointer(agent)), winhttpAccessTypeNoProxy, 0, 0, 0)
+	if session == 0 {
+		return "", "", false
+	}
+	defer pWinHttpCloseHandle.Call(session) //nolint:errcheck
+
+	opts := winhttpAutoProxyOptions{autoConfigURL: pac, autoLogonIfChallenged: 1}
+	if autoDetect {
+		opts.flags |= winhttpAutoProxyAutoDetect
+		opts.autoDetectFlags = winhttpAutoDetectTypeDHCP | winhttpAutoDetectTypeDNSA
+	}
+	if pac != nil {
+		opts.flags |= winhttpAutoProxyConfigURL
+	}
+	u, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", "", false
+	}
+	var info winhttpProxyInfo
+	if r, _, _ := pWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(u)), uintptr(unsafe.Pointer(&opts)), uintptr(unsafe.Pointer(&info))); r == 0 {
+		return "", "", false
+	}
+	proxy, bypass := takeString(info.proxy), takeString(info.proxyBypass)
+	if info.accessType != winhttpAccessTypeNamedProxy {
+		return "", "", true
+	}
+	return proxy, bypass, true
+}
+
+// SystemProxy returns proxy Windows would use for target URL according to user (IE) settings - auto-detection, PAC
+// script or static proxy - falling back to machine wide WinHTTP configuration. Nil means direct connection.
+func SystemProxy(target *url.URL) (*url.URL, error) {
+
+	var proxy, bypass string
+
+	var ie winhttpIEProxyConfig
+	if r, _, _ := pWinHttpGetIEProxyConfigForCurrentUser.Call(uintptr(unsafe.Pointer(&ie))); r != 0 {
+		pac := ie.autoConfigURL
+		resolved := false
+		if ie.autoDetect != 0 || pac != nil {
+			proxy, bypass, resolved = autoProxy(target.String(), ie.autoDetect != 0, pac)
+		}
+		takeString(pac)
+		static, staticBypass := takeString(ie.proxy), takeString(ie.proxyBypass)
+		if !resolved {
+			proxy, bypass = static, staticBypass
+		}
+	}
+	if len(proxy) == 0 {
+		var info winhttpProxyInfo
+		if r, _, _ := pWinHttpGetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&info))); r != 0 {
+			proxy, bypass = takeString(info.proxy), takeString(info.proxyBypass)
+			if info.accessType != winhttpAccessTypeNamedProxy {
+				proxy = ""
+			}
+		}
+	}
+
+	host := target.Hostname()
+	if len(proxy) == 0 || bypassed(bypass, host) {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || strings.EqualFold(host, "localhost") {
+		return nil, nil
+	}
+	return proxyURL(pickProxy(proxy, target.Scheme))
+}
+
+// ProxyFunc returns function suitable for http.Transport.Proxy for mode: "system" (default), "environment", "none" or
+// explicit proxy URL.
+func ProxyFunc(mode string) (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(mode) {
+	case "", ProxySystem:
+		return func(r *http.Request) (*url.URL, error) { return SystemProxy(r.URL) }, nil
+	case ProxyEnvironment:
+		return http.ProxyFromEnvironment, nil
+	case ProxyNone:
+		return nil, nil
+	default:
+	}
+	u, err := proxyURL(mode)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// ResolveProxy returns proxy to use for target URL in mode or nil for direct connection.
+func ResolveProxy(mode, target string) (*url.URL, error) {
+	f, err := ProxyFunc(mode)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f(req)
+}
+
+// HTTPClient returns client making connections through proxy selected by mode.
+func HTTPClient(mode string) (*http.Client, error) {
+	f, err := ProxyFunc(mode)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = f
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,187 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+
+	"github.com/rupor-github/win-gpg-agent/qr"
+)
+
+const (
+	qrClass  = "win-gpg-agent-qr"
+	qrText   = 400
+	qrClose  = 401
+	qrBtnW   = 150
+	qrBtnH   = 30
+	qrGap    = 8
+	qrTextH  = 60
+	qrSymbol = 400
+	// quiet zone around symbol in modules, scanners need it
+	qrQuiet = 4
+)
+
+var pFillRect = modUser32.NewProc("FillRect")
+
+// qrViewer is state of the only QR code window agent could show.
+type qrViewer struct {
+	wnd   win.HWND
+	code  *qr.Code
+	scale int32
+}
+
+var (
+	qrOnce sync.Once
+	qrErr  error
+	// there is single state for window procedure, so only one window could be shown
+	qrShown int32
+	qv      *qrViewer
+)
+
+// ShowQRCode shows text as QR code together with text itself (so it could be selected and copied), it returns when
+// window is closed.
+func ShowQRCode(caption, text string) error {
+	code, err := qr.Encode([]byte(text), qr.Medium)
+	if err != nil {
+		return err
+	}
+	qrOnce.Do(func() { qrErr = registerQRClass() })
+	if qrErr != nil {
+		return fmt.Errorf("unable to register QR code window class: %w", qrErr)
+	}
+	if !atomic.CompareAndSwapInt32(&qrShown, 0, 1) {
+		return errors.New("QR code window is already shown")
+	}
+	defer atomic.StoreInt32(&qrShown, 0)
+
+	// window messages are delivered to the thread which created window
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	v := &qrViewer{code: code, scale: int32(qrSymbol / (code.Size + 2*qrQuiet))}
+	if v.scale < 2 {
+		v.scale = 2
+	}
+	side := v.scale * int32(code.Size+2*qrQuiet)
+	var (
+		width  = side + 2*qrGap
+		height = qrGap + side + qrGap + qrTextH + qrGap + qrBtnH + qrGap
+		frameW = int32(win.GetSystemMetrics(win.SM_CXFIXEDFRAME))*2 + 2
+		frameH = int32(win.GetSystemMetrics(win.SM_CYFIXEDFRAME)*2 + win.GetSystemMetrics(win.SM_CYCAPTION))
+		w, h   = width + frameW, height + frameH
+		x      = (win.GetSystemMetrics(win.SM_CXSCREEN) - w) / 2
+		y      = (win.GetSystemMetrics(win.SM_CYSCREEN) - h) / 2
+	)
+	qv = v
+	defer func() { qv = nil }()
+
+	v.wnd = win.CreateWindowEx(win.WS_EX_DLGMODALFRAME|win.WS_EX_TOPMOST, windows.StringToUTF16Ptr(qrClass), windows.StringToUTF16Ptr(caption),
+		win.WS_CAPTION|win.WS_SYSMENU, x, y, w, h, 0, 0, win.GetModuleHandle(nil), nil)
+	if v.wnd == 0 {
+		return fmt.Errorf("unable to create QR code window: %w", windows.GetLastError())
+	}
+	top := qrGap + side + qrGap
+	// edit control wants CRLF line endings
+	edit := v.child("EDIT", strings.ReplaceAll(text, "\n", "\r\n"), win.ES_MULTILINE|win.ES_READONLY|win.ES_AUTOVSCROLL|win.WS_BORDER|win.WS_VSCROLL|win.WS_TABSTOP,
+		qrText, qrGap, top, side, qrTextH)
+	top += qrTextH + qrGap
+	v.child("BUTTON", "Close", win.WS_TABSTOP|win.BS_DEFPUSHBUTTON, qrClose, width-qrGap-qrBtnW, top, qrBtnW, qrBtnH)
+
+	win.ShowWindow(v.wnd, win.SW_SHOWNORMAL)
+	win.SetFocus(edit)
+	win.SetForegroundWindow(v.wnd)
+
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		if win.IsDialogMessage(v.wnd, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+	return nil
+}
+
+// paint draws symbol with quiet zone around it.
+func (v *qrViewer) paint(hdc win.HDC) {
+	var (
+		side  = v.scale * int32(v.code.Size+2*qrQuiet)
+		light = win.GetStockObject(win.WHITE_BRUSH)
+		dark  = win.GetStockObject(win.BLACK_BRUSH)
+	)
+	rc := win.RECT{Left: qrGap, Top: qrGap, Right: qrGap + side, Bottom: qrGap + side}
+	pFillRect.Call(uintptr(hdc), uintptr(unsafe.Pointer(&rc)), uintptr(light)) //nolint:errcheck
+	for y := 0; y < v.code.Size; y++ {
+		for x := 0; x < v.code.Size; x++ {
+			if !v.code.Dark(x, y) {
+				continue
+			}
+			rc.Left = qrGap + v.scale*int32(x+qrQuiet)
+			rc.Top = qrGap + v.scale*int32(y+qrQuiet)
+			rc.Right, rc.Bottom = rc.Left+v.scale, rc.Top+v.scale
+			pFillRect.Call(uintptr(hdc), uintptr(unsafe.Pointer(&rc)), uintptr(dark)) //nolint:errcheck
+		}
+	}
+}
+
+func qrWndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	v := qv
+	switch msg {
+	case win.WM_PAINT:
+		if v == nil {
+			break
+		}
+		var ps win.PAINTSTRUCT
+		hdc := win.BeginPaint(hwnd, &ps)
+		v.paint(hdc)
+		win.EndPaint(hwnd, &ps)
+		return 0
+	case win.WM_COMMAND:
+		if win.HIWORD(uint32(wParam)) != win.BN_CLICKED {
+			break
+		}
+		switch win.LOWORD(uint32(wParam)) {
+		case qrClose, win.IDCANCEL:
+			win.DestroyWindow(hwnd)
+		default:
+		}
+		return 0
+	case win.WM_CLOSE:
+		win.DestroyWindow(hwnd)
+		return 0
+	case win.WM_DESTROY:
+		win.PostQuitMessage(0)
+		return 0
+	default:
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func registerQRClass() error {
+	wc := win.WNDCLASSEX{
+		HInstance:     win.GetModuleHandle(nil),
+		LpszClassName: windows.StringToUTF16Ptr(qrClass),
+		LpfnWndProc:   windows.NewCallback(qrWndProc),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	if a := win.RegisterClassEx(&wc); a == 0 {
+		return windows.GetLastError()
+	}
+	return nil
+}
+
+func (v *qrViewer) child(class, text string, style uint32, id, x, y, w, h int32) win.HWND {
+	hwnd := win.CreateWindowEx(0, windows.StringToUTF16Ptr(class), windows.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, w, h, v.wnd, win.HMENU(id), win.GetModuleHandle(nil), nil)
+	win.SendMessage(hwnd, win.WM_SETFONT, uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)), 1)
+	return hwnd
+}
@@ -0,0 +1,20 @@
+package util
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+// ScreensaverRunning reports if screensaver is active on the desktop of current session.
+func ScreensaverRunning() (bool, error) {
+	const SPI_GETSCREENSAVERRUNNING = 0x0072
+
+	var running int32
+	if !win.SystemParametersInfo(SPI_GETSCREENSAVERRUNNING, 0, unsafe.Pointer(&running), 0) {
+		return false, fmt.Errorf("SystemParametersInfo: %w", windows.GetLastError())
+	}
+	return running != 0, nil
+}
@@ -0,0 +1,124 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// SecureBuffer keeps sensitive data (passphrases) outside of Go heap - in memory locked into physical memory, so it is
+// never written to the page file, never moved or copied by garbage collector and could be reliably wiped.
+type SecureBuffer struct {
+	addr uintptr
+	buf  []byte
+	n    int
+}
+
+// NewSecureBuffer allocates locked buffer of requested capacity.
+func NewSecureBuffer(size int) (*SecureBuffer, error) {
+	if size <= 0 {
+		size = 1
+	}
+	addr, err := windows.VirtualAlloc(0, uintptr(size), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		return nil, fmt.Errorf("unable to allocate secure buffer: %w", err)
+	}
+	if err := windows.VirtualLock(addr, uintptr(size)); err != nil {
+		// still better than Go heap, it would be wiped when freed
+		log.Printf("Unable to lock secure buffer in memory: %s", err)
+	}
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	return &SecureBuffer{addr: addr, buf: unsafe.Slice((*byte)(p), size)}, nil
+}
+
+// Bytes returns buffer content. Slice must not be used after Free.
+func (b *SecureBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.buf[:b.n]
+}
+
+// Len returns length of buffer content.
+func (b *SecureBuffer) Len() int {
+	if b == nil {
+		return 0
+	}
+	return b.n
+}
+
+// Write appends p to the buffer, it never grows.
+func (b *SecureBuffer) Write(p []byte) (int, error) {
+	if len(p) > len(b.buf)-b.n {
+		return 0, fmt.Errorf("secure buffer overflow: %d bytes do not fit", len(p))
+	}
+	b.n += copy(b.buf[b.n:], p)
+	return len(p), nil
+}
+
+// Truncate discards all but first n bytes of content wiping the rest.
+func (b *SecureBuffer) Truncate(n int) {
+	if n < 0 || n >= b.n {
+		return
+	}
+	Wipe(b.buf[n:b.n])
+	b.n = n
+}
+
+// Free wipes buffer and releases its memory.
+func (b *SecureBuffer) Free() {
+	if b == nil || b.addr == 0 {
+		return
+	}
+	Wipe(b.buf)
+	_ = windows.VirtualUnlock(b.addr, uintptr(len(b.buf)))
+	_ = windows.VirtualFree(b.addr, 0, windows.MEM_RELEASE)
+	b.addr, b.buf, b.n = 0, nil, 0
+}
+
+// Wipe zeroes memory which held sensitive data.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// WipeUTF16 zeroes memory which held sensitive data.
+func WipeUTF16(b []uint16) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// SecureFromUTF16 converts NUL terminated UTF-16 to UTF-8 secure buffer without intermediate copies on Go heap.
+func SecureFromUTF16(s []uint16) (*SecureBuffer, error) {
+	n := 0
+	for n < len(s) && s[n] != 0 {
+		n++
+	}
+	b, err := NewSecureBuffer(n * utf8.UTFMax)
+	if err != nil {
+		return nil, err
+	}
+	var rb [utf8.UTFMax]byte
+	for i := 0; i < n; i++ {
+		r := rune(s[i])
+		if utf16.IsSurrogate(r) && i+1 < n {
+			if dec := utf16.DecodeRune(r, rune(s[i+1])); dec != utf8.RuneError {
+				r = dec
+				i++
+			}
+		}
+		l := utf8.EncodeRune(rb[:], r)
+		_, _ = b.Write(rb[:l])
+	}
+	Wipe(rb[:])
+	return b, nil
+}
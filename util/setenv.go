@@ -1,8 +1,9 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 	"unsafe"
@@ -38,60 +39,124 @@ func notifySystem() {
 	log.Printf("Broadcasting environment change. To   %s, Elapsed %s", time.Now(), time.Since(start))
 }
 
-// PrepareUserEnvironmentVariable modifies user environment. if wslenv is true - its name is added to WSLENV/up list for path translation.
-func PrepareUserEnvironmentVariable(name, value string, wslenv, translate bool) error {
-
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Environment`, registry.QUERY_VALUE|registry.READ|registry.WRITE)
-	if err != nil {
-		return err
+// WSLENVEntry formats WSLENV list entry for variable name with flags.
+func WSLENVEntry(name, flags string) string {
+	if len(flags) == 0 {
+		return name
 	}
-	defer k.Close()
+	return name + "/" + flags
+}
 
-	if err := k.SetStringValue(name, value); err != nil {
-		return err
+// CheckWSLENV validates variable name and flags to be put on WSLENV list.
+func CheckWSLENV(name, flags string) error {
+	if len(name) == 0 || strings.ContainsAny(name, "=:/ ") {
+		return fmt.Errorf("bad variable name \"%s\" for %s", name, wslName)
 	}
-	log.Printf("Set '%s=%s'", name, value)
-	defer notifySystem()
-
-	if !wslenv {
-		return nil
+	for _, f := range flags {
+		if !strings.ContainsRune("plwu", f) {
+			return fmt.Errorf("%s: unknown %s flag '%c', should be one of p, l, u, w", name, wslName, f)
+		}
 	}
-
-	val, _, err := k.GetStringValue(wslName)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+	if strings.ContainsRune(flags, 'p') && strings.ContainsRune(flags, 'l') {
+		return fmt.Errorf("%s: %s flags p and l are mutually exclusive", name, wslName)
 	}
-	log.Printf("Was '%s=%s'", wslName, val)
+	return nil
+}
 
+// updateWSLENV removes name from WSLENV list val and, if add is true, adds it back with flags. Names are matched exactly,
+// so WSL_AGENT_HOME does not affect WSL_AGENT_HOME_OLD. Duplicate entries for name are dropped.
+func updateWSLENV(val, name, flags string, add bool) string {
 	parts := strings.Split(val, ":")
-	vals := make([]string, 0, len(parts))
+	vals := make([]string, 0, len(parts)+1)
 	for _, part := range parts {
 		if len(part) == 0 {
 			continue
 		}
-		if !strings.HasPrefix(part, name) {
+		if n := strings.SplitN(part, "/", 2)[0]; n != name {
 			vals = append(vals, part)
 		}
 	}
-	name += "/u"
-	if translate {
-		name += "p"
+	if add {
+		vals = append(vals, WSLENVEntry(name, flags))
+	}
+	return strings.Join(vals, ":")
+}
+
+// cleanWSLENV removes name from WSLENV list val only if it is still there with flags, so entries changed by user or
+// other tools survive.
+func cleanWSLENV(val, name, flags string) string {
+	entry := WSLENVEntry(name, flags)
+	parts := strings.Split(val, ":")
+	vals := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if len(part) != 0 && part != entry {
+			vals = append(vals, part)
+		}
 	}
-	vals = append(vals, name)
-	val = strings.Join(vals, ":")
+	return strings.Join(vals, ":")
+}
 
-	if err := k.SetStringValue(wslName, val); err != nil {
+// editWSLENV applies edit to user WSLENV value, preserving its registry type (it may reference other variables).
+func editWSLENV(k registry.Key, edit func(string) string) error {
+
+	val, typ, err := k.GetStringValue(wslName)
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
 		return err
 	}
-	log.Printf("Set '%s=%s'", wslName, val)
+	log.Printf("Was '%s=%s'", wslName, val)
 
+	nval := edit(val)
+	switch {
+	case nval == val:
+		return nil
+	case len(nval) == 0:
+		if err := k.DeleteValue(wslName); err != nil {
+			return err
+		}
+		log.Printf("Del '%s'", wslName)
+	default:
+		set := k.SetStringValue
+		if typ == registry.EXPAND_SZ {
+			set = k.SetExpandStringValue
+		}
+		if err := set(wslName, nval); err != nil {
+			return err
+		}
+		log.Printf("Set '%s=%s'", wslName, nval)
+	}
 	return nil
 }
 
+func openEnvironment() (registry.Key, error) {
+	return registry.OpenKey(registry.CURRENT_USER, `Environment`, registry.QUERY_VALUE|registry.READ|registry.WRITE)
+}
+
+// PrepareUserEnvironmentVariable modifies user environment. If wslenv is true - its name is added to WSLENV list with
+// flags (for example "up" for path translation).
+func PrepareUserEnvironmentVariable(name, value string, wslenv bool, flags string) error {
+
+	k, err := openEnvironment()
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	if err := k.SetStringValue(name, value); err != nil {
+		return err
+	}
+	log.Printf("Set '%s=%s'", name, value)
+	defer notifySystem()
+
+	if !wslenv {
+		return nil
+	}
+	return editWSLENV(k, func(val string) string { return updateWSLENV(val, name, flags, true) })
+}
+
 // CleanUserEnvironmentVariable will reverse settings done by PrepareUserEnvironmentVariable.
-func CleanUserEnvironmentVariable(name string, wslenv bool) error {
+func CleanUserEnvironmentVariable(name string, wslenv bool, flags string) error {
 
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Environment`, registry.QUERY_VALUE|registry.READ|registry.WRITE)
+	k, err := openEnvironment()
 	if err != nil {
 		return err
 	}
@@ -106,35 +171,31 @@ func CleanUserEnvironmentVariable(name string, wslenv bool) error {
 	if !wslenv {
 		return nil
 	}
+	return editWSLENV(k, func(val string) string { return cleanWSLENV(val, name, flags) })
+}
+
+// RegisterWSLENV adds variable which is not managed by us to WSLENV list with flags, so it flows into WSL.
+func RegisterWSLENV(name, flags string) error {
 
-	val, _, err := k.GetStringValue(wslName)
-	if err != nil && !os.IsNotExist(err) {
+	k, err := openEnvironment()
+	if err != nil {
 		return err
 	}
-	log.Printf("Was '%s=%s'", wslName, val)
+	defer k.Close()
+	defer notifySystem()
 
-	parts := strings.Split(val, ":")
-	vals := make([]string, 0, len(parts))
-	for _, part := range parts {
-		if len(part) == 0 {
-			continue
-		}
-		if !strings.HasPrefix(part, name) {
-			vals = append(vals, part)
-		}
-	}
-	val = strings.Join(vals, ":")
+	return editWSLENV(k, func(val string) string { return updateWSLENV(val, name, flags, true) })
+}
 
-	if len(val) == 0 {
-		if err := k.DeleteValue(wslName); err != nil {
-			return err
-		}
-		log.Printf("Del '%s'", wslName)
-	} else {
-		if err := k.SetStringValue(wslName, val); err != nil {
-			return err
-		}
-		log.Printf("Set '%s=%s'", wslName, val)
+// UnregisterWSLENV reverses RegisterWSLENV.
+func UnregisterWSLENV(name, flags string) error {
+
+	k, err := openEnvironment()
+	if err != nil {
+		return err
 	}
-	return nil
+	defer k.Close()
+	defer notifySystem()
+
+	return editWSLENV(k, func(val string) string { return cleanWSLENV(val, name, flags) })
 }
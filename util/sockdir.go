@@ -0,0 +1,40 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ShortSocketDirName is directory under LOCALAPPDATA which keeps relocated sockets.
+const ShortSocketDirName = "wga"
+
+// longestSocketName is the longest name of the sockets agent-gui creates.
+var longestSocketName = SocketAgentSSHCygwinName
+
+// socketDirFits checks if sockets could be created in dir: full name has to fit into sun_path and be ASCII - non-ASCII
+// names are not reliably handled by AF_UNIX on Windows and by WSL interop.
+func socketDirFits(dir string) bool {
+	return IsASCII(dir) && len(filepath.Join(dir, longestSocketName)) < MaxNameLen
+}
+
+// SocketDir returns directory where agent-gui should create its sockets. Normally this is home, but if socket paths
+// there would not work for AF_UNIX (deep profile paths, non-ASCII user names) short per-user directory derived from
+// home is returned.
+func SocketDir(home string) string {
+	if socketDirFits(home) {
+		return home
+	}
+	base := os.Getenv("LOCALAPPDATA")
+	if len(base) == 0 {
+		base = os.TempDir()
+	}
+	if !socketDirFits(base) {
+		// 8.3 names are always ASCII and usually shorter
+		base = ShortPath(base)
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(filepath.Clean(home))))
+	return filepath.Join(base, ShortSocketDirName, hex.EncodeToString(sum[:4]))
+}
@@ -0,0 +1,259 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modSecur32                 = windows.NewLazySystemDLL("secur32")
+	pAcquireCredentialsHandle  = modSecur32.NewProc("AcquireCredentialsHandleW")
+	pFreeCredentialsHandle     = modSecur32.NewProc("FreeCredentialsHandle")
+	pAcceptSecurityContext     = modSecur32.NewProc("AcceptSecurityContext")
+	pInitializeSecurityContext = modSecur32.NewProc("InitializeSecurityContextW")
+	pDeleteSecurityContext     = modSecur32.NewProc("DeleteSecurityContext")
+	pQueryContextAttributes    = modSecur32.NewProc("QueryContextAttributesW")
+	pFreeContextBuffer         = modSecur32.NewProc("FreeContextBuffer")
+)
+
+// SSPI constants.
+const (
+	secEOK               = 0
+	secIContinueNeeded   = 0x00090312
+	secpkgCredInbound    = 1
+	secpkgCredOutbound   = 2
+	secpkgAttrNames      = 1
+	securityNativeDrep   = 0x10
+	secbufferToken       = 2
+	secbufferVersion     = 0
+	ascReqAllocateMemory = 0x100
+	ascReqConnection     = 0x800
+	iscReqAllocateMemory = 0x100
+	iscReqConnection     = 0x800
+	iscReqMutualAuth     = 0x2
+
+	// maxSSPIToken limits size of tokens peer could send, Negotiate tokens are under 64K.
+	maxSSPIToken = 64 * 1024
+)
+
+type secHandle struct {
+	lower, upper uintptr
+}
+
+func (h *secHandle) valid() bool {
+	return h.lower != 0 || h.upper != 0
+}
+
+type secBuffer struct {
+	size   uint32
+	typ    uint32
+	buffer *byte
+}
+
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+func newTokenDesc(token []byte) (*secBufferDesc, *secBuffer) {
+	b := &secBuffer{size: uint32(len(token)), typ: secbufferToken}
+	if len(token) > 0 {
+		b.buffer = &token[0]
+	}
+	return &secBufferDesc{version: secbufferVersion, count: 1, buffers: b}, b
+}
+
+// takeToken copies SSPI allocated output token and frees it.
+func takeToken(b *secBuffer) []byte {
+	if b.buffer == nil || b.size == 0 {
+		return nil
+	}
+	res := make([]byte, b.size)
+	copy(res, unsafe.Slice(b.buffer, b.size))
+	_, _, _ = pFreeContextBuffer.Call(uintptr(unsafe.Pointer(b.buffer)))
+	b.buffer, b.size = nil, 0
+	return res
+}
+
+func acquireCredentials(usage uint32) (*secHandle, error) {
+	pkg, _ := windows.UTF16PtrFromString("Negotiate")
+	var (
+		cred   secHandle
+		expiry int64
+	)
+	r, _, _ := pAcquireCredentialsHandle.Call(0, uintptr(unsafe.Pointer(pkg)), uintptr(usage), 0, 0, 0, 0,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK {
+		return nil, fmt.Errorf("AcquireCredentialsHandle: %w", windows.Errno(r))
+	}
+	return &cred, nil
+}
+
+func writeToken(w io.Writer, token []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(token)))
+	if _, err := w.Write(append(hdr[:], token...)); err != nil {
+		return fmt.Errorf("unable to send authentication token: %w", err)
+	}
+	return nil
+}
+
+func readToken(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("unable to read authentication token: %w", err)
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	if l > maxSSPIToken {
+		return nil, fmt.Errorf("authentication token is too large: %d", l)
+	}
+	token := make([]byte, l)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, fmt.Errorf("unable to read authentication token: %w", err)
+	}
+	return token, nil
+}
+
+// SSPIAccept performs server side of Negotiate (Kerberos or NTLM) authentication over stream. Tokens are framed with
+// 4 bytes big endian length. It returns authenticated user name (DOMAIN\user), caller must tell client result by
+// calling SSPIVerdict.
+func SSPIAccept(rw io.ReadWriter) (string, error) {
+	cred, err := acquireCredentials(secpkgCredInbound)
+	if err != nil {
+		return "", err
+	}
+	defer pFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(cred))) //nolint:errcheck
+
+	var ctx secHandle
+	defer func() {
+		if ctx.valid() {
+			_, _, _ = pDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&ctx)))
+		}
+	}()
+
+	for {
+		in, err := readToken(rw)
+		if err != nil {
+			return "", err
+		}
+		inDesc, _ := newTokenDesc(in)
+		outDesc, out := newTokenDesc(nil)
+		var (
+			attrs  uint32
+			expiry int64
+			pctx   uintptr
+		)
+		if ctx.valid() {
+			pctx = uintptr(unsafe.Pointer(&ctx))
+		}
+		r, _, _ := pAcceptSecurityContext.Call(uintptr(unsafe.Pointer(cred)), pctx, uintptr(unsafe.Pointer(inDesc)),
+			ascReqAllocateMemory|ascReqConnection, securityNativeDrep, uintptr(unsafe.Pointer(&ctx)),
+			uintptr(unsafe.Pointer(outDesc)), uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+		token := takeToken(out)
+		if r != secEOK && r != secIContinueNeeded {
+			return "", fmt.Errorf("AcceptSecurityContext: %w", windows.Errno(r))
+		}
+		if len(token) > 0 {
+			if err := writeToken(rw, token); err != nil {
+				return "", err
+			}
+		}
+		if r == secEOK {
+			break
+		}
+	}
+
+	var names struct{ user *uint16 }
+	if r, _, _ := pQueryContextAttributes.Call(uintptr(unsafe.Pointer(&ctx)), secpkgAttrNames, uintptr(unsafe.Pointer(&names))); r != secEOK {
+		return "", fmt.Errorf("QueryContextAttributes: %w", windows.Errno(r))
+	}
+	defer pFreeContextBuffer.Call(uintptr(unsafe.Pointer(names.user))) //nolint:errcheck
+	return windows.UTF16PtrToString(names.user), nil
+}
+
+// SSPIVerdict completes server side of authentication, empty frame tells client it is accepted.
+func SSPIVerdict(w io.Writer, ok bool) error {
+	if !ok {
+		return writeToken(w, []byte("denied"))
+	}
+	return writeToken(w, nil)
+}
+
+// SSPIInitiate performs client side of Negotiate authentication as current user. Empty spn makes Kerberos
+// impossible and NTLM is used.
+func SSPIInitiate(rw io.ReadWriter, spn string) error {
+	cred, err := acquireCredentials(secpkgCredOutbound)
+	if err != nil {
+		return err
+	}
+	defer pFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(cred))) //nolint:errcheck
+
+	var target *uint16
+	if len(spn) > 0 {
+		if target, err = windows.UTF16PtrFromString(spn); err != nil {
+			return err
+		}
+	}
+
+	var (
+		ctx secHandle
+		in  []byte
+	)
+	defer func() {
+		if ctx.valid() {
+			_, _, _ = pDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&ctx)))
+		}
+	}()
+
+	for {
+		var inDescPtr, pctx uintptr
+		if in != nil {
+			inDesc, _ := newTokenDesc(in)
+			inDescPtr = uintptr(unsafe.Pointer(inDesc))
+		}
+		if ctx.valid() {
+			pctx = uintptr(unsafe.Pointer(&ctx))
+		}
+		outDesc, out := newTokenDesc(nil)
+		var (
+			attrs  uint32
+			expiry int64
+		)
+		r, _, _ := pInitializeSecurityContext.Call(uintptr(unsafe.Pointer(cred)), pctx, uintptr(unsafe.Pointer(target)),
+			iscReqAllocateMemory|iscReqConnection|iscReqMutualAuth, 0, securityNativeDrep, inDescPtr, 0,
+			uintptr(unsafe.Pointer(&ctx)), uintptr(unsafe.Pointer(outDesc)), uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+		token := takeToken(out)
+		if r != secEOK && r != secIContinueNeeded {
+			return fmt.Errorf("InitializeSecurityContext: %w", windows.Errno(r))
+		}
+		if len(token) > 0 {
+			if err := writeToken(rw, token); err != nil {
+				return err
+			}
+		}
+		if r == secEOK {
+			break
+		}
+		if in, err = readToken(rw); err != nil {
+			return err
+		}
+		if len(in) == 0 {
+			return errors.New("server finished authentication prematurely")
+		}
+	}
+
+	verdict, err := readToken(rw)
+	if err != nil {
+		return err
+	}
+	if len(verdict) != 0 {
+		return errors.New("access denied by server")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+)
+
+var pTaskDialogIndirect = windows.NewLazySystemDLL("comctl32").NewProc("TaskDialogIndirect")
+
+var (
+	taskDialogOnce     sync.Once
+	taskDialogCallback uintptr
+)
+
+// TaskDialogButton is custom button of task dialog, ID is returned when it is pressed.
+type TaskDialogButton struct {
+	ID   int
+	Text string
+}
+
+// taskDialogConfig builds TASKDIALOGCONFIG. Structure is declared with 1 byte packing in commctrl.h, so it is laid
+// out field by field instead of using Go struct.
+type taskDialogConfig struct {
+	buf []byte
+}
+
+func (c *taskDialogConfig) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	c.buf = append(c.buf, b[:]...)
+}
+
+func (c *taskDialogConfig) ptr(v uintptr) {
+	if unsafe.Sizeof(v) == 4 {
+		c.u32(uint32(v))
+		return
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	c.buf = append(c.buf, b[:]...)
+}
+
+// AskTaskDialog shows task dialog with custom buttons and returns ID of pressed one, IDCANCEL when dialog is closed.
+// Error is returned when task dialog is not available (comctl32 version 6 is not activated by manifest).
+func AskTaskDialog(title, instruction, text string, buttons []TaskDialogButton, def int) (int, error) {
+	const (
+		TDF_ALLOW_DIALOG_CANCELLATION = 0x0008
+		TDF_USE_COMMAND_LINKS         = 0x0010
+		TD_INFORMATION_ICON           = 0xFFFD
+		TDN_CREATED                   = 0
+	)
+	if err := pTaskDialogIndirect.Find(); err != nil {
+		return IDCANCEL, fmt.Errorf("task dialog is not available: %w", err)
+	}
+	taskDialogOnce.Do(func() {
+		taskDialogCallback = windows.NewCallback(func(hwnd win.HWND, msg uint32, wParam, lParam, data uintptr) uintptr {
+			if msg == TDN_CREATED {
+				// prompt comes from background process and should not hide behind client window
+				win.SetForegroundWindow(hwnd)
+			}
+			return 0
+		})
+	})
+
+	// strings are referenced from config by address, keep them until dialog is closed
+	var keep []*uint16
+	str := func(s string) uintptr {
+		p, err := windows.UTF16PtrFromString(s)
+		if err != nil {
+			p, _ = windows.UTF16PtrFromString(fmt.Sprintf("%q", s))
+		}
+		keep = append(keep, p)
+		return uintptr(unsafe.Pointer(p))
+	}
+
+	btns := &taskDialogConfig{}
+	for _, b := range buttons {
+		btns.u32(uint32(b.ID))
+		btns.ptr(str(b.Text))
+	}
+	var pButtons uintptr
+	if len(btns.buf) > 0 {
+		pButtons = uintptr(unsafe.Pointer(&btns.buf[0]))
+	}
+
+	cfg := &taskDialogConfig{}
+	cfg.u32(0) // cbSize, set below
+	cfg.ptr(0) // hwndParent
+	cfg.ptr(0) // hInstance
+	cfg.u32(TDF_ALLOW_DIALOG_CANCELLATION | TDF_USE_COMMAND_LINKS)
+	cfg.u32(0) // dwCommonButtons
+	cfg.ptr(str(title))
+	cfg.ptr(TD_INFORMATION_ICON)
+	cfg.ptr(str(instruction))
+	cfg.ptr(str(text))
+	cfg.u32(uint32(len(buttons)))
+	cfg.ptr(pButtons)
+	cfg.u32(uint32(def))
+	cfg.u32(0) // cRadioButtons
+	cfg.ptr(0) // pRadioButtons
+	cfg.u32(0) // nDefaultRadioButton
+	cfg.ptr(0) // pszVerificationText
+	cfg.ptr(0) // pszExpandedInformation
+	cfg.ptr(0) // pszExpandedControlText
+	cfg.ptr(0) // pszCollapsedControlText
+	cfg.ptr(0) // hFooterIcon
+	cfg.ptr(0) // pszFooter
+	cfg.ptr(taskDialogCallback)
+	cfg.ptr(0) // lpCallbackData
+	cfg.u32(0) // cxWidth
+	binary.LittleEndian.PutUint32(cfg.buf, uint32(len(cfg.buf)))
+
+	var pressed int32
+	hr, _, _ := pTaskDialogIndirect.Call(uintptr(unsafe.Pointer(&cfg.buf[0])), uintptr(unsafe.Pointer(&pressed)), 0, 0)
+	runtime.KeepAlive(keep)
+	runtime.KeepAlive(btns)
+	if int32(hr) < 0 {
+		return IDCANCEL, fmt.Errorf("unable to show task dialog: HRESULT 0x%08X", uint32(hr))
+	}
+	return int(pressed), nil
+}
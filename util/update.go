@@ -0,0 +1,77 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ReleasesURL is GitHub API endpoint describing latest project release.
+const ReleasesURL = "https://api.github.com/repos/rupor-github/win-gpg-agent/releases/latest"
+
+// Release describes published project release.
+type Release struct {
+	Tag string `json:"tag_name"`
+	URL string `json:"html_url"`
+}
+
+// LatestRelease queries releases feed using hc (http.DefaultClient if nil).
+func LatestRelease(ctx context.Context, hc *http.Client, url string) (*Release, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check for updates: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to check for updates: %s", resp.Status)
+	}
+	var rel Release
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return nil, fmt.Errorf("unable to decode release information: %w", err)
+	}
+	return &rel, nil
+}
+
+func parseVersion(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	var res []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// IsNewerVersion reports if version "latest" (v1.6.3 or 1.6.3) is newer than "current".
+func IsNewerVersion(current, latest string) bool {
+	c, l := parseVersion(current), parseVersion(latest)
+	at := func(v []int, i int) int {
+		if i < len(v) {
+			return v[i]
+		}
+		return 0
+	}
+	for i := 0; i < len(l) || i < len(c); i++ {
+		if at(l, i) != at(c, i) {
+			return at(l, i) > at(c, i)
+		}
+	}
+	return false
+}
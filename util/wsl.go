@@ -0,0 +1,149 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const lxssKey = `Software\Microsoft\Windows\CurrentVersion\Lxss`
+
+// Distribution flags as stored by WSL in registry.
+const (
+	wslFlagInterop       = 0x1
+	wslFlagAppendNTPath  = 0x2
+	wslFlagDriveMounting = 0x4
+)
+
+// WSLDistro describes WSL distribution registered for current user.
+type WSLDistro struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Default bool   `json:"default,omitempty"`
+	// Interop is true when distribution could start Windows executables (and so receives WSLENV variables)
+	Interop bool `json:"interop"`
+	// DriveMounting is true when Windows drives are automatically mounted in distribution
+	DriveMounting bool   `json:"drive_mounting"`
+	BasePath      string `json:"base_path,omitempty"`
+}
+
+// WSLDistros lists WSL distributions registered for current user, default one first.
+func WSLDistros() ([]WSLDistro, error) {
+
+	k, err := registry.OpenKey(registry.CURRENT_USER, lxssKey, registry.QUERY_VALUE|registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		if err == registry.ErrNotExist {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to open WSL registry key: %w", err)
+	}
+	defer k.Close()
+
+	def, _, _ := k.GetStringValue("DefaultDistribution")
+	ids, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to enumerate WSL distributions: %w", err)
+	}
+
+	var res []WSLDistro
+	for _, id := range ids {
+		dk, err := registry.OpenKey(k, id, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		d := WSLDistro{ID: id, Default: strings.EqualFold(id, def), Version: 1}
+		d.Name, _, err = dk.GetStringValue("DistributionName")
+		if err != nil || len(d.Name) == 0 {
+			// not a distribution - some other WSL bookkeeping
+			dk.Close()
+			continue
+		}
+		if v, _, err := dk.GetIntegerValue("Version"); err == nil && v >= 2 {
+			d.Version = 2
+		}
+		flags := uint64(wslFlagInterop | wslFlagAppendNTPath | wslFlagDriveMounting)
+		if v, _, err := dk.GetIntegerValue("Flags"); err == nil {
+			flags = v
+		}
+		d.Interop, d.DriveMounting = flags&wslFlagInterop != 0, flags&wslFlagDriveMounting != 0
+		d.BasePath, _, _ = dk.GetStringValue("BasePath")
+		d.BasePath = CleanPath(d.BasePath)
+		dk.Close()
+		res = append(res, d)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Default != res[j].Default {
+			return res[i].Default
+		}
+		return strings.ToLower(res[i].Name) < strings.ToLower(res[j].Name)
+	})
+	return res, nil
+}
+
+func wslExe() string {
+	return filepath.Join(os.Getenv("SystemRoot"), "System32", "wsl.exe")
+}
+
+// WSLRun executes shell script in distribution as its default user and returns its standard output. Note that this
+// starts distribution if it is not running.
+func WSLRun(distro, script string) (string, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+
+	cmd := exec.Command(wslExe(), "--distribution", distro, "--exec", "/bin/sh", "-s")
+	cmd.SysProcAttr = &windows.SysProcAttr{CreationFlags: CREATE_NO_WINDOW}
+	cmd.Stdin = strings.NewReader(script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w (%s)", distro, err, wslOutput(stderr.Bytes()))
+	}
+	return stdout.String(), nil
+}
+
+// wslOutput decodes messages of wsl.exe itself, which are UTF-16, while output of Linux programs is not.
+func wslOutput(data []byte) string {
+	if len(data) >= 2 && len(data)%2 == 0 && data[1] == 0 {
+		u := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			u = append(u, uint16(data[i])|uint16(data[i+1])<<8)
+		}
+		return strings.TrimSpace(windows.UTF16ToString(u))
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// WSLShellQuote quotes string for POSIX shell.
+func WSLShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// WSLWriteFiles writes files (relative to user home in distribution) with given content, creating directories as
+// needed.
+func WSLWriteFiles(distro string, files map[string]string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var script strings.Builder
+	script.WriteString("set -e\ncd \"$HOME\"\n")
+	for i, name := range names {
+		content := files[name]
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		marker := fmt.Sprintf("WIN_GPG_AGENT_EOF_%d", i)
+		fmt.Fprintf(&script, "mkdir -p \"$(dirname %[1]s)\"\ncat > %[1]s <<'%[2]s'\n%[3]s%[2]s\n", WSLShellQuote(name), marker, content)
+	}
+	_, err := WSLRun(distro, script.String())
+	return err
+}
@@ -0,0 +1,227 @@
+// Package websocket implements minimal server side of RFC 6455 sufficient to carry binary byte stream (like ssh-agent
+// protocol) between browser and agent.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // required by RFC 6455
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	// maxFrame limits size of incoming frames - agent messages are small.
+	maxFrame = 1 << 20
+)
+
+// Conn is server side WebSocket connection presenting payload of data frames as continuous byte stream.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	rmu       sync.Mutex
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade validates WebSocket handshake request, hijacks HTTP connection and completes handshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %s", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection could not be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to hijack connection: %w", err)
+	}
+
+	h := sha1.New() //nolint:gosec // required by RFC 6455
+	h.Write([]byte(key + acceptGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to complete websocket handshake: %w", err)
+	}
+	return &Conn{Conn: conn, br: brw.Reader}, nil
+}
+
+// Read implements net.Conn returning payload of binary and text frames. Control frames are handled internally.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *Conn) readHeader() (op byte, length int64, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	op = hdr[0] & 0x0F
+	if hdr[1]&0x80 == 0 {
+		return 0, 0, errors.New("unmasked client frame")
+	}
+	length = int64(hdr[1] & 0x7F)
+	// control frames are never fragmented and carry at most 125 bytes (RFC 6455 section 5.5)
+	if op&0x08 != 0 && (hdr[0]&0x80 == 0 || length > 125) {
+		return 0, 0, fmt.Errorf("invalid websocket control frame: opcode %d, fin %t, length %d", op, hdr[0]&0x80 != 0, length)
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if length < 0 || length > maxFrame {
+		return 0, 0, fmt.Errorf("websocket frame is too large: %d", length)
+	}
+	if _, err = io.ReadFull(c.br, c.mask[:]); err != nil {
+		return 0, 0, err
+	}
+	c.maskPos = 0
+	return op, length, nil
+}
+
+func (c *Conn) nextFrame() error {
+	op, length, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	switch op {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+		switch op {
+		case opClose:
+			_ = c.writeFrame(opClose, payload)
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported websocket opcode %d", op)
+	}
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		c.closed = true
+	}
+
+	hdr := make([]byte, 0, 10+len(payload))
+	hdr = append(hdr, 0x80|op)
+	switch l := len(payload); {
+	case l < 126:
+		hdr = append(hdr, byte(l))
+	case l <= 0xFFFF:
+		hdr = append(hdr, 126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+	default:
+		hdr = append(hdr, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+	}
+	_, err := c.Conn.Write(append(hdr, payload...))
+	return err
+}
+
+// Write implements net.Conn sending p as single binary frame.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends close frame and closes underlying connection.
+func (c *Conn) Close() error {
+	_ = c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,289 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve starts HTTP server upgrading every request and passing connection to handler. Handler result is sent to
+// returned channel, upgrade failures are not.
+func serve(t *testing.T, handler func(c *Conn) error) (*httptest.Server, <-chan error) {
+	t.Helper()
+	res := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// frame server is still waiting for should not hang the test
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		res <- handler(c)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, res
+}
+
+// handshake sends upgrade request with given key and version and returns connection and response.
+func handshake(t *testing.T, srv *httptest.Server, key, version string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := fmt.Sprintf("GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: %s\r\n\r\n", srv.Listener.Addr(), key, version)
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// dial completes handshake and returns client side of WebSocket connection.
+func dial(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, br, resp := handshake(t, srv, "dGhlIHNhbXBsZSBub25jZQ==", "13")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %s", resp.Status)
+	}
+	return conn, br
+}
+
+// frame encodes client frame, masked with fixed key unless masked is false.
+func frame(fin bool, op byte, payload []byte, masked bool) []byte {
+	var b bytes.Buffer
+	first := op
+	if fin {
+		first |= 0x80
+	}
+	b.WriteByte(first)
+	var bit byte
+	if masked {
+		bit = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		b.WriteByte(bit | byte(l))
+	case l <= 0xFFFF:
+		b.WriteByte(bit | 126)
+		_ = binary.Write(&b, binary.BigEndian, uint16(l))
+	default:
+		b.WriteByte(bit | 127)
+		_ = binary.Write(&b, binary.BigEndian, uint64(l))
+	}
+	if !masked {
+		b.Write(payload)
+		return b.Bytes()
+	}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	b.Write(mask[:])
+	for i, c := range payload {
+		b.WriteByte(c ^ mask[i&3])
+	}
+	return b.Bytes()
+}
+
+// readFrame reads single server frame, server frames are never masked.
+func readFrame(t *testing.T, br *bufio.Reader) (op byte, payload []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatalf("unable to read frame: %s", err)
+	}
+	if hdr[0]&0x80 == 0 || hdr[1]&0x80 != 0 {
+		t.Fatalf("unexpected frame header %x", hdr)
+	}
+	length := int(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext uint16
+		_ = binary.Read(br, binary.BigEndian, &ext)
+		length = int(ext)
+	case 127:
+		var ext uint64
+		_ = binary.Read(br, binary.BigEndian, &ext)
+		length = int(ext)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("unable to read frame payload: %s", err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+// echo reads n bytes of stream and writes them back as single frame.
+func echo(n int) func(c *Conn) error {
+	return func(c *Conn) error {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		_, err := c.Write(buf)
+		return err
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	srv, _ := serve(t, echo(1))
+
+	// sample from RFC 6455 section 1.3
+	_, _, resp := handshake(t, srv, "dGhlIHNhbXBsZSBub25jZQ==", "13")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !strings.EqualFold(resp.Header.Get("Connection"), "upgrade") {
+		t.Fatalf("unexpected upgrade headers %v", resp.Header)
+	}
+
+	_, _, resp = handshake(t, srv, "dGhlIHNhbXBsZSBub25jZQ==", "8")
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("old protocol version: unexpected response %s %v", resp.Status, resp.Header)
+	}
+	_, _, resp = handshake(t, srv, "", "13")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing key: unexpected status %s", resp.Status)
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain request: unexpected status %s", resp.Status)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv, res := serve(t, echo(3*70000))
+	conn, br := dial(t, srv)
+
+	// lengths with 7 bit, 16 bit and 64 bit encoding
+	payload := bytes.Repeat([]byte("0123456789"), 3*7000)
+	for _, part := range [][]byte{payload[:100], payload[100:70000], payload[70000:]} {
+		if _, err := conn.Write(frame(true, opBinary, part, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-res; err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+	op, got := readFrame(t, br)
+	if op != opBinary || !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected echo: opcode %d, %d bytes", op, len(got))
+	}
+}
+
+func TestUnmaskedFrame(t *testing.T) {
+	srv, res := serve(t, echo(5))
+	conn, _ := dial(t, srv)
+
+	if _, err := conn.Write(frame(true, opBinary, []byte("hello"), false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; err == nil || !strings.Contains(err.Error(), "unmasked") {
+		t.Fatalf("unmasked frame accepted: %v", err)
+	}
+}
+
+func TestFragmentedFrames(t *testing.T) {
+	srv, res := serve(t, echo(len("hello, world")))
+	conn, br := dial(t, srv)
+
+	// control frames could come between fragments of a message
+	stream := append(frame(false, opText, []byte("hello"), true), frame(true, opPing, []byte("are you there"), true)...)
+	stream = append(stream, frame(false, opContinuation, []byte(", "), true)...)
+	stream = append(stream, frame(false, opContinuation, nil, true)...)
+	stream = append(stream, frame(true, opContinuation, []byte("world"), true)...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+	if op, payload := readFrame(t, br); op != opPong || string(payload) != "are you there" {
+		t.Fatalf("expected pong, got opcode %d %q", op, payload)
+	}
+	if op, payload := readFrame(t, br); op != opBinary || string(payload) != "hello, world" {
+		t.Fatalf("unexpected echo: opcode %d %q", op, payload)
+	}
+}
+
+func TestPongIgnored(t *testing.T) {
+	srv, res := serve(t, echo(2))
+	conn, br := dial(t, srv)
+
+	stream := append(frame(true, opPong, []byte("unsolicited"), true), frame(true, opBinary, []byte("ok"), true)...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+	if op, payload := readFrame(t, br); op != opBinary || string(payload) != "ok" {
+		t.Fatalf("unexpected echo: opcode %d %q", op, payload)
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv, res := serve(t, echo(1))
+	conn, br := dial(t, srv)
+
+	// status 1000 - normal closure
+	if _, err := conn.Write(frame(true, opClose, []byte{0x03, 0xe8}, true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Fatalf("close frame should end stream, got %v", err)
+	}
+	if op, payload := readFrame(t, br); op != opClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Fatalf("expected close echo, got opcode %d %x", op, payload)
+	}
+	// server does not send second close frame on Close
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("connection should be closed after close frame, got %v", err)
+	}
+}
+
+func TestInvalidControlFrames(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+		data       []byte
+	}{
+		{"fragmented ping", "control frame", frame(false, opPing, []byte("x"), true)},
+		{"oversized ping", "control frame", frame(true, opPing, bytes.Repeat([]byte("x"), 126), true)},
+		{"oversized close", "control frame", frame(true, opClose, bytes.Repeat([]byte("x"), 200), true)},
+		{"unknown opcode", "unsupported", frame(true, 0x3, []byte("x"), true)},
+		{"unknown control", "unsupported", frame(true, 0xB, []byte("x"), true)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, res := serve(t, echo(1))
+			conn, _ := dial(t, srv)
+			if _, err := conn.Write(tc.data); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-res; err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected %q error, got %v", tc.want, err)
+			}
+		})
+	}
+}